@@ -2,17 +2,25 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"sybil-api/internal/buckets"
+	"sybil-api/internal/database"
+	"sybil-api/internal/handlers/billing"
+	"sybil-api/internal/handlers/inference"
+	"sybil-api/internal/jwtauth"
+	"sybil-api/internal/lifecycle"
 	"sybil-api/internal/middleware"
 	"sybil-api/internal/routers"
 	"sybil-api/internal/shared"
+	"sybil-api/internal/tokenizer"
+	"sybil-api/internal/tracing"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/labstack/echo/v4"
@@ -28,13 +36,59 @@ func main() {
 	// Flags / ENV Variables
 	writeDSN := flag.String("dsn", "", "Write vitess DSN")
 	readDSN := flag.String("read-dsn", "", "Write vitess DSN")
+	historyEncryptionKeys := flag.String("history-encryption-keys", "", "Comma separated id:base64 keys for chat history encryption, first is active")
+	providerKeyEncryptionKeys := flag.String("provider-key-encryption-keys", "", "Comma separated id:base64 keys for customer provider keys, first is active")
+	residencyDSNs := flag.String("residency-dsns", "", "Comma separated region=dsn pairs for data residency storage")
 	metricsAPIKey := flag.String("metrics-api-key", "", "Metrics api key")
 	redisAddr := flag.String("redis-addr", "", "Redis host:port")
 	debug := flag.Bool("debug", false, "Debug enabled")
 	targonAPIKey := flag.String("targon-api-key", "", "Targon API Key")
 	targonEndpoint := flag.String("targon-endpoint", "", "Targon endpoint")
+	targonSigningSecret := flag.String("targon-signing-secret", "", "HMAC secret to sign targon requests with, unsigned when unset")
+	adminSigningSecret := flag.String("admin-signing-secret", "", "HMAC secret admin requests must be signed with, unchecked when unset")
 	googleSearchEngineID := flag.String("google-search-engine-id", "", "Google search engine id")
 	googleAPIKey := flag.String("google-api-key", "", "Google search api key")
+	googleCSEDailyQuota := flag.Int64("google-cse-daily-quota", 0, "Google CSE daily query quota, 0 for unlimited")
+	braveAPIKey := flag.String("brave-api-key", "", "Brave Search api key")
+	bingAPIKey := flag.String("bing-api-key", "", "Bing Web Search api key")
+	searchProviders := flag.String("search-providers", "google,brave,bing", "Comma separated order search providers are tried in")
+	geoCountryHeader := flag.String("geo-country-header", "CF-IPCountry", "Header set by the edge with the client country code")
+	trainingAPIKey := flag.String("training-api-key", "", "Training service API Key")
+	trainingEndpoint := flag.String("training-endpoint", "", "Training service endpoint")
+	stripeSecretKey := flag.String("stripe-secret-key", "", "Stripe secret key used for auto recharge")
+	stripeWebhookSecret := flag.String("stripe-webhook-secret", "", "Stripe webhook signing secret")
+	sessionJWKSURL := flag.String("session-jwks-url", "", "JWKS url of the web frontend, web session tokens are rejected when unset")
+	sessionIssuer := flag.String("session-issuer", "", "Expected iss claim of web session tokens")
+	sessionAudience := flag.String("session-audience", "", "Expected aud claim of web session tokens")
+	titleModel := flag.String("title-model", "", "Model that generates chat history titles, truncated first message when unset")
+	followupModel := flag.String("followup-model", "", "Model that suggests follow-up questions after search answers, none when unset")
+	redactionModel := flag.String("redaction-model", "", "Model that redacts personal information for users in the model redaction mode, patterns only when unset")
+	searchRerankModel := flag.String("search-rerank-model", "", "Embedding model that reranks chat search results, provider order when unset")
+	searchRerankBudget := flag.Duration("search-rerank-budget", shared.SearchRerankBudget, "Time allowed for reranking chat search results before provider order is used")
+	heroCards := flag.Bool("hero-cards", false, "Send hero cards for weather, stock, definition and sports searches")
+	alphaVantageAPIKey := flag.String("alphavantage-api-key", "", "Alpha Vantage api key for stock hero cards")
+	theSportsDBAPIKey := flag.String("thesportsdb-api-key", "", "TheSportsDB api key for sports hero cards")
+	lifecycleEvents := flag.String("lifecycle-events", "", "Message bus request lifecycle events are published to, one of redis or empty for none")
+	lifecycleStream := flag.String("lifecycle-stream", shared.LifecycleStream, "Stream request lifecycle events are published to")
+	openAPIURL := flag.String("openapi-url", "", "Url of the OpenAPI spec linked from the /v1 index")
+	docsURL := flag.String("docs-url", "", "Url of the api docs linked from the /v1 index")
+	tokenizerDir := flag.String("tokenizer-dir", shared.TokenizerDir, "Directory model tokenizers are cached in")
+	bucketFlushInterval := flag.Duration("bucket-flush-interval", shared.BucketFlushInterval, "Age of a usage bucket at which it is flushed with requests still inflight")
+	bucketMaxFlushRetries := flag.Int("bucket-max-flush-retries", shared.MaxFlushRetries, "Attempts at the charge transaction per usage bucket flush")
+	bucketRetryDelay := flag.Duration("bucket-retry-delay", shared.BucketRetryDelay, "Delay before a failed usage bucket flush is retried")
+	upstreamMaxIdleConns := flag.Int("upstream-max-idle-conns-per-host", shared.UpstreamMaxIdleConnsPerHost, "Idle connections kept per model backend")
+	upstreamMaxConns := flag.Int("upstream-max-conns-per-host", 0, "Connections per model backend, 0 for unlimited")
+	upstreamIdleTimeout := flag.Duration("upstream-idle-conn-timeout", shared.UpstreamIdleConnTimeout, "How long idle model backend connections are kept")
+	upstreamH2CHosts := flag.String("upstream-h2c-hosts", "", "Comma separated host suffixes of model backends spoken to over cleartext HTTP/2")
+	upstreamModelTimeouts := flag.String("upstream-model-timeouts", "", "Comma separated model=duration pairs overriding the model request timeout")
+	streamMaxLineBytes := flag.Int("stream-max-line-bytes", shared.StreamMaxLineBytes, "Longest line read from a model stream before it is cut off")
+	streamMaxBufferBytes := flag.Int("stream-max-buffer-bytes", shared.StreamMaxBufferBytes, "Chunk bytes kept per streamed response before text chunks are merged")
+	maxBodyBytes := flag.String("max-body-bytes", "", "Comma separated endpoint=bytes request body limits, like chat=20971520")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated CIDRs of the proxies in front of the api whose X-Forwarded-For is trusted, the peer address is used when unset")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP HTTP url traces are exported to, like http://otel-collector:4318, tracing is off when unset")
+	traceSampleRatio := flag.Float64("trace-sample-ratio", shared.TraceSampleRatio, "Share of new traces that are sampled, sampled traceparents from trusted proxies are always traced")
+	usageJournalDir := flag.String("usage-journal-dir", shared.UsageJournalDir, "Persistent directory usage charged directly while redis is down is journaled in, unjournaled when empty")
+	bucketFlushCredits := flag.Uint64("bucket-flush-credits", shared.BucketFlushCredits, "Credits at which a usage bucket is flushed early, 0 to disable")
 
 	err := eflag.SetFlagsFromEnvironment()
 	if err != nil {
@@ -42,8 +96,14 @@ func main() {
 	}
 	flag.Parse()
 
+	stopTracing, err := tracing.Setup(context.Background(), *otlpEndpoint, *traceSampleRatio)
+	if err != nil {
+		panic(fmt.Sprintf("failed initializing tracing: %s", err))
+	}
+	defer stopTracing()
+
 	// Write DB init
-	writeDB, err := sql.Open("mysql", *writeDSN)
+	writeDB, err := tracing.OpenMySQL(*writeDSN)
 	if err != nil {
 		panic(fmt.Sprintf("failed initializing sqlClient: %s", err))
 	}
@@ -53,7 +113,7 @@ func main() {
 	}
 
 	// Read db init
-	readDB, err := sql.Open("mysql", *readDSN)
+	readDB, err := tracing.OpenMySQL(*readDSN)
 	if err != nil {
 		panic(fmt.Sprintf("failed initializing readSqlClient: %s", err))
 	}
@@ -62,6 +122,12 @@ func main() {
 		panic(fmt.Sprintf("failed to ping read replica sql db: %s", err))
 	}
 
+	// Regional dbs for accounts with data residency requirements
+	residencyDBs, err := database.OpenResidencyDBs(*residencyDSNs)
+	if err != nil {
+		panic(fmt.Sprintf("failed initializing residency dbs: %s", err))
+	}
+
 	// Load Redis connection
 	redisClient := redis.NewClient(&redis.Options{
 		Addr:     *redisAddr,
@@ -71,6 +137,9 @@ func main() {
 	if err := redisClient.Ping(context.Background()).Err(); err != nil {
 		panic(fmt.Sprintf("failed ping to redis db: %s", err))
 	}
+	if err := tracing.InstrumentRedis(redisClient); err != nil {
+		panic(fmt.Sprintf("failed instrumenting redis: %s", err))
+	}
 
 	defer func() {
 		if redisClient != nil {
@@ -82,6 +151,7 @@ func main() {
 		if readDB != nil {
 			_ = readDB.Close()
 		}
+		residencyDBs.Close()
 	}()
 
 	var logger *zap.Logger
@@ -100,6 +170,11 @@ func main() {
 	log := logger.Sugar()
 
 	e := echo.New()
+	// Key allowlists and search abuse scoring trust the client ip
+	e.IPExtractor, err = middleware.NewIPExtractor(*trustedProxies)
+	if err != nil {
+		panic(fmt.Sprintf("invalid trusted proxies: %s", err))
+	}
 	e.GET(("/ping"), func(c echo.Context) error {
 		return c.String(200, "")
 	})
@@ -120,23 +195,172 @@ func main() {
 	base.Use(emw.CORS())
 	base.Use(middleware.NewRecoverMiddleware(log))
 	base.Use(middleware.NewTrackMiddleware(log))
+	traceMiddleware, err := middleware.NewTraceMiddleware(*trustedProxies)
+	if err != nil {
+		panic(fmt.Sprintf("invalid trusted proxies: %s", err))
+	}
+	base.Use(traceMiddleware)
+	base.Use(middleware.NewCompressMiddleware())
+
+	// Browser sessions authenticate with tokens signed by the frontend instead
+	// of proxying an api key
+	var sessions *jwtauth.Verifier
+	if *sessionJWKSURL != "" {
+		sessions = jwtauth.NewVerifier(*sessionJWKSURL, *sessionIssuer, *sessionAudience)
+	}
+	// Reads that must see recent writes skip the replica while it lags
+	lagMonitor := database.NewLagMonitor(writeDB, readDB, log)
+	lagCtx, stopLagMonitor := context.WithCancel(context.Background())
+	defer stopLagMonitor()
+	go lagMonitor.Run(lagCtx)
+
+	middleware.InitUserMiddleware(redisClient, readDB, writeDB, log, sessions, lagMonitor)
+
+	providerKeyring, err := shared.NewKeyring(*providerKeyEncryptionKeys)
+	if err != nil {
+		panic(fmt.Sprintf("failed loading provider key encryption keys: %s", err))
+	}
+
+	usageSettings := buckets.Settings{
+		FlushIntervalSeconds: int64(bucketFlushInterval.Seconds()),
+		MaxFlushRetries:      *bucketMaxFlushRetries,
+		RetryDelaySeconds:    int64(bucketRetryDelay.Seconds()),
+		FlushCredits:         *bucketFlushCredits,
+	}
+	if err := usageSettings.Validate(); err != nil {
+		panic(fmt.Sprintf("invalid bucket settings: %s", err))
+	}
+
+	modelTimeouts, err := inference.ParseModelTimeouts(*upstreamModelTimeouts)
+	if err != nil {
+		panic(fmt.Sprintf("invalid upstream model timeouts: %s", err))
+	}
+	bodyLimits, err := inference.ParseBodyLimits(*maxBodyBytes)
+	if err != nil {
+		panic(fmt.Sprintf("invalid max body bytes: %s", err))
+	}
+	upstream := inference.UpstreamConfig{
+		MaxIdleConnsPerHost:  *upstreamMaxIdleConns,
+		MaxConnsPerHost:      *upstreamMaxConns,
+		IdleConnTimeout:      *upstreamIdleTimeout,
+		ModelTimeouts:        modelTimeouts,
+		MaxStreamLineBytes:   *streamMaxLineBytes,
+		MaxStreamBufferBytes: *streamMaxBufferBytes,
+	}
+	for _, suffix := range strings.Split(*upstreamH2CHosts, ",") {
+		if suffix = strings.TrimSpace(suffix); suffix != "" {
+			upstream.H2CHosts = append(upstream.H2CHosts, suffix)
+		}
+	}
+
+	var lifecyclePublisher lifecycle.Publisher
+	switch *lifecycleEvents {
+	case "":
+	case "redis":
+		lifecyclePublisher = lifecycle.NewRedisStream(redisClient, *lifecycleStream, shared.LifecycleStreamMaxLen)
+	default:
+		panic(fmt.Sprintf("unknown lifecycle event bus %q", *lifecycleEvents))
+	}
+	lifecycleBus := lifecycle.NewBus(lifecyclePublisher, log)
+	defer lifecycleBus.Shutdown()
 
-	middleware.InitUserMiddleware(redisClient, readDB, log)
+	// Tokenizers are shared by the admin refresh route and inference
+	tokenizers := tokenizer.NewRegistry(*tokenizerDir, redisClient, log)
+	tokenizerCtx, stopTokenizers := context.WithCancel(context.Background())
+	defer stopTokenizers()
+	go tokenizers.Listen(tokenizerCtx)
 
 	// Register routes
-	err = routers.RegisterAdminRoutes(base, writeDB, readDB, redisClient, *targonAPIKey, *targonEndpoint, log)
+	err = routers.RegisterAdminRoutes(base, writeDB, readDB, redisClient, *targonAPIKey, *targonEndpoint, *targonSigningSecret, *adminSigningSecret, tokenizers, log)
 	if err != nil {
 		panic(err)
 	}
 	shutdown, err := routers.RegisterInferenceRoutes(base, writeDB, readDB, redisClient, log, *debug, &routers.InferenceRouterConfig{
-		GoogleSearchEngineID: *googleSearchEngineID,
-		GoogleAPIKey:         *googleAPIKey,
+		GoogleSearchEngineID:  *googleSearchEngineID,
+		GoogleAPIKey:          *googleAPIKey,
+		GoogleCSEDailyQuota:   *googleCSEDailyQuota,
+		BraveAPIKey:           *braveAPIKey,
+		BingAPIKey:            *bingAPIKey,
+		SearchProviders:       *searchProviders,
+		GeoCountryHeader:      *geoCountryHeader,
+		ResidencyDBs:          residencyDBs,
+		HistoryEncryptionKeys: *historyEncryptionKeys,
+		ProviderKeyring:       providerKeyring,
+		TitleModel:            *titleModel,
+		FollowupModel:         *followupModel,
+		RedactionModel:        *redactionModel,
+		SearchRerankModel:     *searchRerankModel,
+		SearchRerankBudget:    *searchRerankBudget,
+		HeroCards:             *heroCards,
+		AlphaVantageAPIKey:    *alphaVantageAPIKey,
+		TheSportsDBAPIKey:     *theSportsDBAPIKey,
+		LagMonitor:            lagMonitor,
+		Lifecycle:             lifecycleBus,
+		UsageSettings:         usageSettings,
+		UsageJournalDir:       *usageJournalDir,
+		Tokenizers:            tokenizers,
+		Upstream:              upstream,
+		BodyLimits:            bodyLimits,
 	})
 	if err != nil {
 		panic(err)
 	}
 	defer shutdown()
 
+	err = routers.RegisterUsageRoutes(base, readDB, log)
+	if err != nil {
+		panic(err)
+	}
+
+	err = routers.RegisterBudgetRoutes(base, writeDB, readDB, redisClient, log)
+	if err != nil {
+		panic(err)
+	}
+
+	err = routers.RegisterAPIKeyRoutes(base, writeDB, readDB, redisClient, log)
+	if err != nil {
+		panic(err)
+	}
+
+	err = routers.RegisterProviderKeyRoutes(base, writeDB, readDB, providerKeyring, log)
+	if err != nil {
+		panic(err)
+	}
+
+	stopBilling, err := routers.RegisterBillingRoutes(base, writeDB, readDB, redisClient, log, &billing.StripeConfig{
+		SecretKey:     *stripeSecretKey,
+		WebhookSecret: *stripeWebhookSecret,
+	}, lifecycleBus)
+	if err != nil {
+		panic(err)
+	}
+	defer stopBilling()
+
+	stopModelAlerts, err := routers.RegisterModelAlertRoutes(base, writeDB, readDB, redisClient, log, *targonAPIKey, *targonEndpoint, *targonSigningSecret)
+	if err != nil {
+		panic(err)
+	}
+	defer stopModelAlerts()
+
+	if *trainingEndpoint != "" {
+		err = routers.RegisterFineTuneRoutes(base, writeDB, readDB, redisClient, log, &routers.FineTuneRouterConfig{
+			TargonAPIKey:        *targonAPIKey,
+			TargonEndpoint:      *targonEndpoint,
+			TargonSigningSecret: *targonSigningSecret,
+			TrainingAPIKey:      *trainingAPIKey,
+			TrainingEndpoint:    *trainingEndpoint,
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	routers.RegisterIndexRoutes(e, base, &routers.IndexConfig{
+		OpenAPIURL:    *openAPIURL,
+		DocsURL:       *docsURL,
+		SessionTokens: sessions != nil,
+	})
+
 	go func() {
 		if err := e.Start(":80"); err != nil && err != http.ErrServerClosed {
 			e.Logger.Fatal("shutting down the server")
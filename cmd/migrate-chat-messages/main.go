@@ -0,0 +1,71 @@
+// Command migrate-chat-messages moves chat histories stored as a single
+// messages blob into chat_message rows, in the main database and every
+// residency database. It is safe to run repeatedly and alongside the api,
+// which moves legacy histories itself the next time they are appended to
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/handlers/inference"
+	"sybil-api/internal/shared"
+
+	_ "github.com/go-sql-driver/mysql"
+	"go.uber.org/zap"
+
+	"github.com/manifold-inc/manifold-sdk/lib/eflag"
+)
+
+func main() {
+	writeDSN := flag.String("dsn", "", "Write vitess DSN")
+	residencyDSNs := flag.String("residency-dsns", "", "Comma separated region=dsn pairs for data residency storage")
+	historyEncryptionKeys := flag.String("history-encryption-keys", "", "Comma separated id:base64 keys for chat history encryption, first is active")
+	batchSize := flag.Int("batch-size", 500, "Histories read per batch")
+
+	err := eflag.SetFlagsFromEnvironment()
+	if err != nil {
+		panic(err)
+	}
+	flag.Parse()
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		panic("Failed init logger")
+	}
+	log := logger.Sugar()
+
+	keyring, err := shared.NewKeyring(*historyEncryptionKeys)
+	if err != nil {
+		panic(fmt.Sprintf("failed loading history encryption keys: %s", err))
+	}
+
+	writeDB, err := sql.Open("mysql", *writeDSN)
+	if err != nil {
+		panic(fmt.Sprintf("failed initializing sqlClient: %s", err))
+	}
+	defer func() {
+		_ = writeDB.Close()
+	}()
+	residencyDBs, err := database.OpenResidencyDBs(*residencyDSNs)
+	if err != nil {
+		panic(fmt.Sprintf("failed initializing residency dbs: %s", err))
+	}
+	defer residencyDBs.Close()
+
+	dbs := map[string]*sql.DB{"default": writeDB}
+	for region, db := range residencyDBs {
+		dbs[region] = db
+	}
+	for region, db := range dbs {
+		moved, err := inference.BackfillChatMessages(context.Background(), db, keyring, log.With("region", region), *batchSize)
+		if err != nil {
+			log.Errorw("Failed to backfill chat messages", "error", err, "region", region, "moved", moved)
+			continue
+		}
+		log.Infow("Finished backfilling chat messages", "region", region, "moved", moved)
+	}
+}
@@ -0,0 +1,62 @@
+package buckets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+var alertClient = &http.Client{Timeout: shared.BudgetAlertTimeout}
+
+// sendBudgetAlert posts the alert to the budgets webhook. Alerts are best
+// effort, a failed delivery is logged and not retried
+func (c *UsageCache) sendBudgetAlert(alert database.BudgetAlert) {
+	log := c.log.With("user_id", alert.UserID, "budget_id", alert.BudgetID, "threshold", alert.Threshold)
+	log.Infow("Budget alert threshold crossed", "spent_credits", alert.SpentCredits, "cap_credits", alert.CapCredits)
+	if alert.WebhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"type":  "budget.threshold_crossed",
+		"alert": alert,
+	})
+	if err != nil {
+		log.Errorw("Failed to marshal budget alert", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shared.BudgetAlertTimeout)
+	defer cancel()
+	// Checked again on send since the host can resolve elsewhere by now
+	if err := shared.ValidateWebhookURL(ctx, alert.WebhookURL); err != nil {
+		metrics.BudgetAlerts.WithLabelValues("rejected").Inc()
+		log.Warnw("Refusing to send budget alert", "error", err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", alert.WebhookURL, bytes.NewBuffer(body))
+	if err != nil {
+		log.Warnw("Failed to build budget alert request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := alertClient.Do(req)
+	if err != nil {
+		metrics.BudgetAlerts.WithLabelValues("error").Inc()
+		log.Warnw("Failed to send budget alert", "error", err)
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		metrics.BudgetAlerts.WithLabelValues(fmt.Sprintf("%d", res.StatusCode)).Inc()
+		log.Warnw("Budget alert webhook returned non 2xx", "status", res.StatusCode)
+		return
+	}
+	metrics.BudgetAlerts.WithLabelValues("ok").Inc()
+}
@@ -4,225 +4,571 @@ package buckets
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sybil-api/internal/database"
 	"sybil-api/internal/metrics"
 	"sybil-api/internal/shared"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aidarkhanov/nanoid"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
+// UsageCache accumulates charges in redis so every replica adds to the same
+// per user bucket. One replica at a time holds the flusher lease and charges
+// buckets to the database once they have no inflight requests, have waited
+// the flush interval or hold the flush credits, see Settings
 type UsageCache struct {
-	buckets       map[uint64]*bucket
-	killedBuckets map[uint64]*bucket
-	mu            sync.Mutex
-	log           *zap.SugaredLogger
-	db            *sql.DB
+	log        *zap.SugaredLogger
+	db         *sql.DB
+	redis      *redis.Client
+	instanceID string
+	// Charges made directly while redis is unavailable, nil when not
+	// configured
+	journal *journal
+
+	defaults Settings
+	settings atomic.Pointer[Settings]
+
+	// Requests started on this instance that have not been charged yet
+	inflight atomic.Int64
+
+	mu sync.Mutex
+	// Flushing keys and journal entries handled by this instance. A zero time
+	// means the charge is running, otherwise it failed and is retried after
+	// that time
+	flushing map[string]time.Time
+	wg       sync.WaitGroup
+	stop     chan struct{}
+}
+
+const (
+	pendingKey     = "sybil:v1:usage:pending"
+	leaderKey      = "sybil:v1:usage:flusher"
+	flushingPrefix = "sybil:v1:usage:flushing:"
+)
+
+func bucketKey(userID uint64) string {
+	return fmt.Sprintf("sybil:v1:usage:bucket:%d", userID)
+}
+
+func inflightKey(userID uint64) string {
+	return fmt.Sprintf("sybil:v1:usage:inflight:%d", userID)
 }
 
-type bucket struct {
-	mu           sync.Mutex
-	userID       uint64
-	totalCredits uint64
-	qim          map[string]*shared.ProcessedQueryInfo
-	inflight     uint64
-	timer        *time.Timer
+// creditsKey totals the credits in the users bucket for the size based flush
+func creditsKey(userID uint64) string {
+	return fmt.Sprintf("sybil:v1:usage:credits:%d", userID)
 }
 
-func NewUsageCache(log *zap.SugaredLogger, db *sql.DB) *UsageCache {
-	return &UsageCache{
-		db:            db,
-		log:           log,
-		buckets:       map[uint64]*bucket{},
-		killedBuckets: map[uint64]*bucket{},
+func flushingKey(userID uint64, batchID string) string {
+	return fmt.Sprintf("%s%d:%s", flushingPrefix, userID, batchID)
+}
+
+// addRequestScript adds a charge to the users bucket, marks the bucket as
+// pending from its first charge and returns the remaining inflight count.
+// Charges are keyed by request id so a retried add is not counted twice
+var addRequestScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 1 then
+	redis.call('INCRBY', KEYS[4], ARGV[5])
+end
+redis.call('ZADD', KEYS[2], 'NX', ARGV[4], ARGV[3])
+local inflight = tonumber(redis.call('GET', KEYS[3]) or '0')
+if inflight > 0 then
+	inflight = redis.call('DECR', KEYS[3])
+end
+return inflight
+`)
+
+// Inflight counts expire so a replica dying mid request cannot hold a bucket
+// open forever
+var addInflightScript = redis.NewScript(`
+local inflight = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return inflight
+`)
+
+var removeInflightScript = redis.NewScript(`
+local inflight = tonumber(redis.call('GET', KEYS[1]) or '0')
+if inflight > 0 then
+	inflight = redis.call('DECR', KEYS[1])
+end
+return inflight
+`)
+
+// takeBucketScript moves a bucket to its flushing key so charges added after
+// this point start a new bucket
+var takeBucketScript = redis.NewScript(`
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('DEL', KEYS[4])
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('RENAME', KEYS[1], KEYS[3])
+return 1
+`)
+
+// holdLeaseScript renews the flusher lease if this instance holds it, or takes
+// it if nobody does
+var holdLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
+var releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func newBatchID() string {
+	id, _ := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 24)
+	return id
+}
+
+// NewUsageCache creates the cache and starts competing for the flusher lease.
+// defaults are the settings used until a runtime override is set. Direct
+// charges are journaled in journalDir, empty leaves them unjournaled
+func NewUsageCache(log *zap.SugaredLogger, db *sql.DB, redisClient *redis.Client, defaults Settings, journalDir string) (*UsageCache, error) {
+	usageJournal, err := newJournal(journalDir, log)
+	if err != nil {
+		return nil, err
+	}
+	if usageJournal == nil {
+		log.Warn("No usage journal dir set, direct charges made while redis is down are lost if they fail")
 	}
+	instanceID, _ := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 16)
+	c := &UsageCache{
+		journal:    usageJournal,
+		db:         db,
+		log:        log,
+		redis:      redisClient,
+		instanceID: instanceID,
+		defaults:   DefaultSettings().merge(defaults),
+		flushing:   map[string]time.Time{},
+		stop:       make(chan struct{}),
+	}
+	c.settings.Store(&c.defaults)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	c.reloadSettings(ctx)
+	cancel()
+	go c.run()
+	return c, nil
 }
 
+// Shutdown waits for this instances inflight requests to be added to their
+// buckets. The leader flushes every pending bucket on its way out, otherwise
+// they are left for the next leader
 func (c *UsageCache) Shutdown() {
 	c.log.Info("Shutting down cache")
-	wg := sync.WaitGroup{}
-	for {
-		c.mu.Lock()
-		total := uint64(0)
-		for _, b := range c.buckets {
-			if b.timer != nil {
-				b.timer.Stop()
-			}
-			total += b.inflight
-		}
-		c.mu.Unlock()
-		if total == 0 {
-			break
-		}
+	close(c.stop)
+	for c.inflight.Load() > 0 {
 		time.Sleep(1 * time.Second)
 	}
-	for _, b := range c.buckets {
-		wg.Add(1)
-		go func() {
-			c.Flush(b.userID)
-			wg.Done()
-		}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shared.BucketLeaderLeaseTTL)
+	leader, err := c.holdLease(ctx)
+	if err == nil && leader {
+		c.flushPending(ctx, true)
+	}
+	cancel()
+	c.wg.Wait()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := releaseLeaseScript.Run(ctx, c.redis, []string{leaderKey}, c.instanceID).Err(); err != nil {
+		c.log.Warnw("Failed to release usage flusher lease", "error", err)
 	}
-	wg.Wait()
 }
 
 func (c *UsageCache) AddInFlightToBucket(userID uint64) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	b := c.GetBucket(userID)
-	b.addInflight()
+	c.inflight.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := addInflightScript.Run(ctx, c.redis, []string{inflightKey(userID)}, shared.BucketInflightTTL.Milliseconds()).Err()
+	if err != nil {
+		c.log.Warnw("Failed to add inflight request", "error", err, "user_id", userID)
+	}
 }
 
 func (c *UsageCache) RemoveInFlightFromBucket(userID uint64) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	b := c.GetBucket(userID)
-	b.decInflight()
+	c.inflight.Add(-1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := removeInflightScript.Run(ctx, c.redis, []string{inflightKey(userID)}).Err(); err != nil {
+		c.log.Warnw("Failed to remove inflight request", "error", err, "user_id", userID)
+	}
+}
+
+func (c *UsageCache) AddRequestToBucket(userID uint64, pqi *shared.ProcessedQueryInfo, id string) {
+	if pqi.TotalCredits == 0 {
+		c.RemoveInFlightFromBucket(userID)
+		return
+	}
+	defer c.inflight.Add(-1)
+
+	// Ephemeral requests carry nothing beyond what billing needs, even while
+	// they wait in the bucket
+	if pqi.Ephemeral {
+		pqi.Metadata = nil
+		pqi.Seed = nil
+	}
+
+	data, err := json.Marshal(pqi)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		var inflight int64
+		inflight, err = addRequestScript.Run(ctx, c.redis,
+			[]string{bucketKey(userID), pendingKey, inflightKey(userID), creditsKey(userID)},
+			id, data, userID, time.Now().UnixMilli(), pqi.TotalCredits,
+		).Int64()
+		cancel()
+		if err == nil {
+			metrics.InflightRequests.WithLabelValues(fmt.Sprintf("%d", userID)).Set(float64(inflight))
+			return
+		}
+	}
+
+	// Without redis the charge is made on its own rather than lost
+	metrics.UsageBucketErrors.Inc()
+	c.log.Errorw("Failed to add request to usage bucket, charging directly", "error", err, "user_id", userID, "request_id", id)
+	c.chargeDirect(userID, pqi, id)
 }
 
-func (b *bucket) addInflight() {
-	b.mu.Lock()
-	b.inflight++
-	b.mu.Unlock()
+// Unflushed is usage charged to buckets that is not in the database yet
+type Unflushed struct {
+	Credits  uint64
+	Requests int64
 }
 
-func (b *bucket) decInflight() {
-	b.mu.Lock()
-	b.inflight--
-	b.mu.Unlock()
+// Unflushed sums the buckets of userIDs. Buckets that are being flushed are
+// not counted, they are in the database within moments unless the flush fails
+func (c *UsageCache) Unflushed(ctx context.Context, userIDs ...uint64) (Unflushed, error) {
+	var unflushed Unflushed
+	pipe := c.redis.Pipeline()
+	credits := make([]*redis.StringCmd, len(userIDs))
+	requests := make([]*redis.IntCmd, len(userIDs))
+	for i, userID := range userIDs {
+		credits[i] = pipe.Get(ctx, creditsKey(userID))
+		requests[i] = pipe.HLen(ctx, bucketKey(userID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return unflushed, err
+	}
+	for i := range userIDs {
+		userCredits, _ := credits[i].Uint64()
+		unflushed.Credits += userCredits
+		unflushed.Requests += requests[i].Val()
+	}
+	return unflushed, nil
 }
 
-func (b *bucket) AddRequest(c *UsageCache, pqi *shared.ProcessedQueryInfo, requestID string) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.qim[requestID] = pqi
+// run renews the flusher lease and, while this instance holds it, flushes due
+// buckets and retries flushes that failed or were abandoned by a dead leader.
+// Every instance reloads the settings, the next leader may be any of them, and
+// replays its own journal, which needs no redis
+func (c *UsageCache) run() {
+	ticker := time.NewTicker(shared.BucketPollInterval)
+	defer ticker.Stop()
+	wasLeader := false
+	reloadedAt := time.Now()
+	var replayedAt time.Time
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
 
-	// Case inflight requests and fresh bucket, set timer
-	if b.totalCredits == 0 && b.timer == nil {
-		c.log.Info("Registering flush for bucket")
-		b.timer = time.AfterFunc(shared.BucketFlushInterval, func() {
-			retry := c.Flush(b.userID)
-			for retry != 0 {
-				c.log.Warn("Flush requested retry, waiting...")
-				time.Sleep(retry)
-				retry = c.Flush(b.userID)
+		if time.Since(replayedAt) >= shared.UsageJournalReplayInterval {
+			c.replayJournal()
+			replayedAt = time.Now()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shared.BucketPollInterval)
+		if time.Since(reloadedAt) >= shared.BucketSettingsReloadInterval {
+			c.reloadSettings(ctx)
+			reloadedAt = time.Now()
+		}
+		leader, err := c.holdLease(ctx)
+		if err != nil {
+			c.log.Warnw("Failed to hold usage flusher lease", "error", err)
+		}
+		if leader != wasLeader {
+			c.log.Infow("Usage flusher leadership changed", "leader", leader, "instance_id", c.instanceID)
+			if leader {
+				metrics.UsageFlushLeader.Set(1)
+			} else {
+				metrics.UsageFlushLeader.Set(0)
 			}
-		})
+			wasLeader = leader
+		}
+		if leader {
+			c.flushPending(ctx, false)
+			c.retryFlushes(ctx)
+		}
+		cancel()
 	}
-	b.totalCredits += pqi.TotalCredits
+}
+
+func (c *UsageCache) holdLease(ctx context.Context) (bool, error) {
+	held, err := holdLeaseScript.Run(ctx, c.redis, []string{leaderKey}, c.instanceID, shared.BucketLeaderLeaseTTL.Milliseconds()).Int()
+	return held == 1, err
+}
 
-	metrics.InflightRequests.WithLabelValues(fmt.Sprintf("%d", pqi.UserID)).Set(float64(b.inflight))
-	// Case no inflight requests so we should flush right away
-	if b.inflight >= 1 && b.timer != nil {
+// flushPending flushes buckets with no inflight requests, whose first charge is
+// older than the flush interval or that hold the flush credits, or every
+// bucket when all is set
+func (c *UsageCache) flushPending(ctx context.Context, all bool) {
+	pending, err := c.redis.ZRangeWithScores(ctx, pendingKey, 0, -1).Result()
+	if err != nil {
+		c.log.Warnw("Failed to read pending usage buckets", "error", err)
+		return
+	}
+	if len(pending) == 0 {
 		return
 	}
 
-	c.log.Info("Executing flush from no more inflights")
-	if b.timer != nil {
-		// This is the case where inflight goes to 0 and flush has already been
-		// called Need to make sure we are doing this correctly w/ mutexes, this
-		// may not even be possible?
-		ok := b.timer.Stop()
-		if !ok {
-			c.log.Info("Flush is already executed")
-			return
+	userIDs := make([]uint64, 0, len(pending))
+	firstCharged := make([]int64, 0, len(pending))
+	// Inflight count and credits of each bucket, in pairs
+	countKeys := make([]string, 0, 2*len(pending))
+	for _, z := range pending {
+		member, _ := z.Member.(string)
+		userID, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			c.redis.ZRem(ctx, pendingKey, z.Member)
+			continue
 		}
+		userIDs = append(userIDs, userID)
+		firstCharged = append(firstCharged, int64(z.Score))
+		countKeys = append(countKeys, inflightKey(userID), creditsKey(userID))
+	}
+	if len(userIDs) == 0 {
+		return
+	}
+	counts, err := c.redis.MGet(ctx, countKeys...).Result()
+	if err != nil {
+		c.log.Warnw("Failed to read inflight counts", "error", err)
+		return
 	}
 
-	go func() {
-		retry := c.Flush(b.userID)
-		for retry != 0 {
-			c.log.Warn("Flush requested retry, waiting...")
-			time.Sleep(retry)
-			retry = c.Flush(b.userID)
+	settings := c.Settings()
+	dueBefore := time.Now().Add(-settings.flushInterval()).UnixMilli()
+	for i, userID := range userIDs {
+		inflight, _ := counts[2*i].(string)
+		rawCredits, _ := counts[2*i+1].(string)
+		credits, _ := strconv.ParseUint(rawCredits, 10, 64)
+		full := settings.FlushCredits > 0 && credits >= settings.FlushCredits
+		if !all && !full && firstCharged[i] > dueBefore && inflight != "" && inflight != "0" {
+			continue
 		}
-	}()
-}
-
-func (c *UsageCache) GetBucket(userID uint64) *bucket {
-	b, ok := c.buckets[userID]
-	if !ok {
-		b = &bucket{qim: map[string]*shared.ProcessedQueryInfo{}, userID: userID}
-		c.buckets[userID] = b
+		batchID := newBatchID()
+		key := flushingKey(userID, batchID)
+		taken, err := takeBucketScript.Run(ctx, c.redis, []string{bucketKey(userID), pendingKey, key, creditsKey(userID)}, userID).Int()
+		if err != nil {
+			c.log.Errorw("Failed to take usage bucket", "error", err, "user_id", userID)
+			continue
+		}
+		if taken == 0 || !c.claimFlush(key) {
+			continue
+		}
+		c.wg.Add(1)
+		go c.flush(userID, key, batchID)
 	}
-	return b
 }
 
-func (c *UsageCache) AddRequestToBucket(userID uint64, pqi *shared.ProcessedQueryInfo, id string) {
-	if pqi.TotalCredits == 0 {
+// retryFlushes picks up flushing keys left behind by failed flushes or by a
+// leader that died part way through one
+func (c *UsageCache) retryFlushes(ctx context.Context) {
+	seen := map[string]bool{}
+	iter := c.redis.Scan(ctx, 0, flushingPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		seen[key] = true
+		userPart, batchID, ok := strings.Cut(strings.TrimPrefix(key, flushingPrefix), ":")
+		userID, err := strconv.ParseUint(userPart, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		if !c.claimFlush(key) {
+			continue
+		}
+		c.log.Infow("Retrying usage bucket flush", "user_id", userID, "batch_id", batchID)
+		c.wg.Add(1)
+		go c.flush(userID, key, batchID)
+	}
+	if err := iter.Err(); err != nil {
+		c.log.Warnw("Failed to scan flushing usage buckets", "error", err)
 		return
 	}
+
+	// Forget failed flushes another leader has since finished
+	c.mu.Lock()
+	for key, retryAt := range c.flushing {
+		if strings.HasPrefix(key, flushingPrefix) && !retryAt.IsZero() && !seen[key] {
+			delete(c.flushing, key)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// claimFlush marks key as being flushed by this instance. It returns false
+// when the key is already being flushed or is waiting out its retry delay
+func (c *UsageCache) claimFlush(key string) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	bucket := c.GetBucket(userID)
-	bucket.AddRequest(c, pqi, id)
-	bucket.decInflight()
+	if retryAt, ok := c.flushing[key]; ok && (retryAt.IsZero() || time.Now().Before(retryAt)) {
+		return false
+	}
+	c.flushing[key] = time.Time{}
+	return true
 }
 
-func (c *UsageCache) Flush(userID uint64) time.Duration {
-	c.log.Info("Starting flush")
+func (c *UsageCache) releaseFlush(key string, success bool) {
 	c.mu.Lock()
-	b, ok := c.buckets[userID]
-	if !ok {
-		c.mu.Unlock()
-		return 0
+	defer c.mu.Unlock()
+	if success {
+		delete(c.flushing, key)
+		return
 	}
+	c.flushing[key] = time.Now().Add(c.Settings().retryDelay())
+}
 
-	_, ok = c.killedBuckets[userID]
-	if ok {
-		c.mu.Unlock()
-		return shared.BucketRetryDelay
+// flush charges a taken bucket. The flushing key is only deleted once the
+// charge commits, and the batch id makes charging it again a no-op
+func (c *UsageCache) flush(userID uint64, key string, batchID string) {
+	defer c.wg.Done()
+	c.log.Info("Starting flush")
+	ctx := context.Background()
+
+	raw, err := c.redis.HGetAll(ctx, key).Result()
+	if err != nil {
+		c.log.Errorw("Failed to read usage bucket", "error", err, "user_id", userID, "batch_id", batchID)
+		c.releaseFlush(key, false)
+		return
 	}
-	c.killedBuckets[userID] = b
-	delete(c.buckets, userID)
-	if b.inflight != 0 {
-		c.buckets[userID] = &bucket{
-			userID:   userID,
-			inflight: b.inflight,
-			qim:      map[string]*shared.ProcessedQueryInfo{},
+	qim := make(map[string]*shared.ProcessedQueryInfo, len(raw))
+	for requestID, data := range raw {
+		var pqi shared.ProcessedQueryInfo
+		if err := json.Unmarshal([]byte(data), &pqi); err != nil {
+			c.log.Errorw("Dropping unreadable usage bucket entry", "error", err, "user_id", userID, "request_id", requestID)
+			continue
 		}
+		qim[requestID] = &pqi
 	}
-	c.mu.Unlock()
 
-	defer func() {
-		// This will also trigger on fail, will need to revisit adding retries
-		c.mu.Lock()
-		delete(c.killedBuckets, userID)
-		c.mu.Unlock()
-	}()
+	if err := c.charge(ctx, userID, qim, batchID); err != nil {
+		c.log.Errorw("Failed to flush usage bucket", "error", err, "user_id", userID, "batch_id", batchID)
+		metrics.ErrorCount.WithLabelValues("unknown", "unknown", fmt.Sprintf("%d", userID), "save_requests").Inc()
+		c.releaseFlush(key, false)
+		return
+	}
+	if err := c.redis.Del(ctx, key).Err(); err != nil {
+		c.log.Warnw("Failed to delete flushed usage bucket", "error", err, "user_id", userID, "batch_id", batchID)
+	}
+	c.releaseFlush(key, true)
+}
 
-	requestsUsed := uint(len(b.qim))
+// charge bills the requests to the user under batchID and saves them in the
+// same transaction. A batch that was already charged is skipped, so a flush
+// retried after its charge committed never bills or saves twice
+func (c *UsageCache) charge(ctx context.Context, userID uint64, qim map[string]*shared.ProcessedQueryInfo, batchID string) error {
+	if len(qim) == 0 {
+		return nil
+	}
+	start := time.Now()
+	requestsUsed := uint(len(qim))
+	var totalCredits uint64
+	spendByKey := map[string]uint64{}
+	for _, pqi := range qim {
+		totalCredits += pqi.TotalCredits
+		if pqi.KeyID != "" {
+			spendByKey[pqi.KeyID] += pqi.TotalCredits
+		}
+	}
 
-	success := false
+	var claimed bool
+	var alerts []database.BudgetAlert
 	var err error
-	for range shared.MaxFlushRetries {
-		ctx := context.Background()
+	for attempt := range c.Settings().MaxFlushRetries {
 		err = database.ExecuteTransaction(ctx, c.db, []func(*sql.Tx) error{
 			func(tx *sql.Tx) error {
-				return database.ChargeUser(ctx, tx, userID, requestsUsed, b.totalCredits)
+				var claimErr error
+				claimed, claimErr = database.ClaimUsageBatch(ctx, tx, batchID, userID, database.UsageBatch{Requests: requestsUsed, Credits: totalCredits})
+				return claimErr
+			},
+			func(tx *sql.Tx) error {
+				if !claimed {
+					return nil
+				}
+				return database.ChargeUser(ctx, tx, userID, requestsUsed, totalCredits, batchID)
+			},
+			func(tx *sql.Tx) error {
+				if !claimed {
+					return nil
+				}
+				var budgetErr error
+				alerts, budgetErr = database.RecordBudgetSpend(ctx, tx, userID, spendByKey, totalCredits)
+				return budgetErr
+			},
+			// Requests are saved with the charge, so a crash in between can
+			// neither lose them nor bill the batch again when it is retried
+			func(tx *sql.Tx) error {
+				if !claimed {
+					return nil
+				}
+				return database.SaveRequests(ctx, tx, c.db, qim, batchID)
 			},
 		})
-		if err != nil {
-			c.log.Errorw("Failed to execute transaction", "error", err)
-			time.Sleep(5 * time.Second)
+		if err == nil {
+			break
+		}
+		if database.IsLockConflict(err) {
+			c.log.Warnw("Retrying usage flush after lock conflict", "error", err, "attempt", attempt+1, "batch_id", batchID)
+			time.Sleep(time.Duration(attempt+1) * shared.LockConflictRetryDelay)
 			continue
 		}
-		err = database.SaveRequests(c.db, b.qim, c.log)
-		if err != nil {
-			c.log.Errorw("Failed to insert records", "error", err)
-			break
+		c.log.Errorw("Failed to execute transaction", "error", err)
+		time.Sleep(5 * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		// A retry after a commit that failed ambiguously lands here. The bucket
+		// is the same one, so a different total means it was read differently
+		charged, err := database.GetUsageBatch(ctx, c.db, batchID)
+		switch {
+		case err != nil:
+			c.log.Warnw("Usage batch was already charged", "user_id", userID, "batch_id", batchID, "lookup_error", err)
+		case charged.Requests != requestsUsed || charged.Credits != totalCredits:
+			metrics.ErrorCount.WithLabelValues("unknown", "unknown", fmt.Sprintf("%d", userID), "usage_batch_mismatch").Inc()
+			c.log.Errorw("Usage batch was already charged with different totals", "user_id", userID, "batch_id", batchID,
+				"charged_credits", charged.Credits, "charged_requests", charged.Requests, "credits", totalCredits, "requests", requestsUsed)
+		default:
+			c.log.Warnw("Usage batch was already charged", "user_id", userID, "batch_id", batchID)
 		}
-
-		success = true
-		break
+		return nil
 	}
-	if !success {
-		c.log.Errorw("Failed 3 times with error", "error", err)
-		metrics.ErrorCount.WithLabelValues("unknown", "unknown", fmt.Sprintf("%d", b.userID), "save_requests").Inc()
-		return 0
+
+	metrics.UsageFlushDuration.Observe(time.Since(start).Seconds())
+	metrics.UsageFlushBatchSize.Observe(float64(len(qim)))
+	c.log.Infow("Flushed bucket", "user_id", userID, "batch_id", batchID, "total_credits_used", totalCredits, "requests", len(qim))
+	for _, alert := range alerts {
+		go c.sendBudgetAlert(alert)
 	}
-	c.log.Infow("Flushed bucket", "user_id", userID, "total_credits_used", b.totalCredits, "requests", len(b.qim))
-	return 0
+	return nil
 }
@@ -0,0 +1,184 @@
+package buckets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+)
+
+// journal is a write ahead log on local disk of the charges made directly
+// while redis is unavailable. Each charge is written to its own file before it
+// is made and the file is only removed once the charge commits. Files left by
+// a failed charge or a crash are charged again under the same batch id, which
+// the usage_batch claim turns into a no-op when the first charge committed
+type journal struct {
+	dir string
+	log *zap.SugaredLogger
+}
+
+type journalEntry struct {
+	UserID   uint64                                `json:"user_id"`
+	BatchID  string                                `json:"batch_id"`
+	Requests map[string]*shared.ProcessedQueryInfo `json:"requests"`
+}
+
+// newJournal returns nil when dir is empty, direct charges are then lost when
+// they fail or the process dies before they commit
+func newJournal(dir string, log *zap.SugaredLogger) (*journal, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create usage journal dir: %w", err)
+	}
+	return &journal{dir: dir, log: log}, nil
+}
+
+func (j *journal) path(batchID string) string {
+	return filepath.Join(j.dir, batchID+".json")
+}
+
+// append writes entry and syncs it to disk, the rename makes a half written
+// entry impossible to replay
+func (j *journal) append(entry journalEntry) (string, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	path := j.path(entry.BatchID)
+	tmp, err := os.CreateTemp(j.dir, entry.BatchID+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// remove drops a charge that committed
+func (j *journal) remove(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		j.log.Errorw("Failed to remove charged usage journal entry", "error", err, "path", path)
+	}
+}
+
+// entries lists the journaled charges that have not committed yet
+func (j *journal) entries() ([]string, error) {
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		paths = append(paths, filepath.Join(j.dir, file.Name()))
+	}
+	return paths, nil
+}
+
+func (j *journal) read(path string) (*journalEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entry journalEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// chargeDirect charges one request without a bucket. It is journaled first so
+// a failed charge is retried by replayJournal instead of being lost
+func (c *UsageCache) chargeDirect(userID uint64, pqi *shared.ProcessedQueryInfo, requestID string) {
+	entry := journalEntry{
+		UserID:   userID,
+		BatchID:  newBatchID(),
+		Requests: map[string]*shared.ProcessedQueryInfo{requestID: pqi},
+	}
+	var path string
+	if c.journal != nil {
+		var err error
+		path, err = c.journal.append(entry)
+		if err != nil {
+			metrics.UsageJournalErrors.Inc()
+			c.log.Errorw("Failed to journal direct charge", "error", err, "user_id", userID, "request_id", requestID, "batch_id", entry.BatchID)
+			path = ""
+		}
+	}
+	if path != "" && !c.claimFlush(path) {
+		return
+	}
+	c.wg.Add(1)
+	go c.chargeJournaled(entry, path)
+}
+
+// chargeJournaled makes a direct charge and removes its journal entry once it
+// committed. An empty path is a charge that could not be journaled
+func (c *UsageCache) chargeJournaled(entry journalEntry, path string) {
+	defer c.wg.Done()
+	err := c.charge(context.Background(), entry.UserID, entry.Requests, entry.BatchID)
+	if err != nil {
+		c.log.Errorw("Failed to charge directly", "error", err, "user_id", entry.UserID, "batch_id", entry.BatchID, "journaled", path != "")
+	}
+	if path == "" {
+		return
+	}
+	if err == nil {
+		c.journal.remove(path)
+	}
+	c.releaseFlush(path, err == nil)
+}
+
+// replayJournal retries the journaled charges that have not committed,
+// starting with those left before this process started
+func (c *UsageCache) replayJournal() {
+	if c.journal == nil {
+		return
+	}
+	paths, err := c.journal.entries()
+	if err != nil {
+		c.log.Warnw("Failed to list usage journal", "error", err)
+		return
+	}
+	for _, path := range paths {
+		if !c.claimFlush(path) {
+			continue
+		}
+		entry, err := c.journal.read(path)
+		if err != nil {
+			c.log.Errorw("Failed to read usage journal entry", "error", err, "path", path)
+			c.releaseFlush(path, false)
+			continue
+		}
+		metrics.UsageJournalReplayed.Inc()
+		c.log.Infow("Replaying journaled usage charge", "user_id", entry.UserID, "batch_id", entry.BatchID)
+		c.wg.Add(1)
+		go c.chargeJournaled(*entry, path)
+	}
+}
@@ -0,0 +1,137 @@
+package buckets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const settingsKey = "sybil:v1:usage:settings"
+
+// Settings tune when buckets are flushed. The defaults come from the
+// deployment flags, overrides set at runtime are stored in redis and picked up
+// by every replica within shared.BucketSettingsReloadInterval. Zero fields in
+// an override keep the default
+type Settings struct {
+	// A bucket is flushed once its first charge is this old, even with
+	// requests still inflight
+	FlushIntervalSeconds int64 `json:"flush_interval_seconds,omitempty"`
+	// Attempts at the charge transaction per flush
+	MaxFlushRetries int `json:"max_flush_retries,omitempty"`
+	// Failed flushes are retried after this
+	RetryDelaySeconds int64 `json:"retry_delay_seconds,omitempty"`
+	// A bucket is flushed once it holds this many credits, 0 waits for the
+	// interval or the last inflight request
+	FlushCredits uint64 `json:"flush_credits,omitempty"`
+}
+
+// DefaultSettings are used for flags that are not set
+func DefaultSettings() Settings {
+	return Settings{
+		FlushIntervalSeconds: int64(shared.BucketFlushInterval.Seconds()),
+		MaxFlushRetries:      shared.MaxFlushRetries,
+		RetryDelaySeconds:    int64(shared.BucketRetryDelay.Seconds()),
+		FlushCredits:         shared.BucketFlushCredits,
+	}
+}
+
+func (s Settings) flushInterval() time.Duration {
+	return time.Duration(s.FlushIntervalSeconds) * time.Second
+}
+
+func (s Settings) retryDelay() time.Duration {
+	return time.Duration(s.RetryDelaySeconds) * time.Second
+}
+
+// Validate checks the set fields are within what the flusher can work with
+func (s Settings) Validate() error {
+	switch {
+	case s.FlushIntervalSeconds < 0 || (s.FlushIntervalSeconds > 0 && s.flushInterval() < shared.BucketPollInterval):
+		return fmt.Errorf("flush_interval_seconds must be at least %d", int64(shared.BucketPollInterval.Seconds()))
+	case s.flushInterval() > shared.BucketInflightTTL:
+		return fmt.Errorf("flush_interval_seconds must be at most %d", int64(shared.BucketInflightTTL.Seconds()))
+	case s.MaxFlushRetries < 0 || s.MaxFlushRetries > 10:
+		return errors.New("max_flush_retries must be at most 10")
+	case s.RetryDelaySeconds < 0 || s.retryDelay() > time.Hour:
+		return errors.New("retry_delay_seconds must be at most 3600")
+	}
+	return nil
+}
+
+// merge returns s with the fields set in override replaced
+func (s Settings) merge(override Settings) Settings {
+	if override.FlushIntervalSeconds > 0 {
+		s.FlushIntervalSeconds = override.FlushIntervalSeconds
+	}
+	if override.MaxFlushRetries > 0 {
+		s.MaxFlushRetries = override.MaxFlushRetries
+	}
+	if override.RetryDelaySeconds > 0 {
+		s.RetryDelaySeconds = override.RetryDelaySeconds
+	}
+	if override.FlushCredits > 0 {
+		s.FlushCredits = override.FlushCredits
+	}
+	return s
+}
+
+// GetSettingsOverride returns the runtime override, empty when none is set
+func GetSettingsOverride(ctx context.Context, redisClient *redis.Client) (Settings, error) {
+	var override Settings
+	raw, err := redisClient.Get(ctx, settingsKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return override, nil
+	}
+	if err != nil {
+		return override, fmt.Errorf("failed to get usage settings: %w", err)
+	}
+	if err := json.Unmarshal(raw, &override); err != nil {
+		return override, fmt.Errorf("failed to decode usage settings: %w", err)
+	}
+	return override, nil
+}
+
+// SetSettingsOverride stores the runtime override, an empty one goes back to
+// the defaults
+func SetSettingsOverride(ctx context.Context, redisClient *redis.Client, override Settings) error {
+	if override == (Settings{}) {
+		if err := redisClient.Del(ctx, settingsKey).Err(); err != nil {
+			return fmt.Errorf("failed to clear usage settings: %w", err)
+		}
+		return nil
+	}
+	raw, err := json.Marshal(override)
+	if err != nil {
+		return err
+	}
+	if err := redisClient.Set(ctx, settingsKey, raw, 0).Err(); err != nil {
+		return fmt.Errorf("failed to set usage settings: %w", err)
+	}
+	return nil
+}
+
+// reloadSettings applies the current override on top of the defaults. The
+// last good settings stay in place when redis cannot be read
+func (c *UsageCache) reloadSettings(ctx context.Context) {
+	override, err := GetSettingsOverride(ctx, c.redis)
+	if err != nil {
+		c.log.Warnw("Failed to reload usage settings", "error", err)
+		return
+	}
+	settings := c.defaults.merge(override)
+	if previous := c.settings.Load(); previous == nil || *previous != settings {
+		c.log.Infow("Usage settings changed", "settings", settings)
+	}
+	c.settings.Store(&settings)
+}
+
+// Settings returns the settings in effect on this instance
+func (c *UsageCache) Settings() Settings {
+	return *c.settings.Load()
+}
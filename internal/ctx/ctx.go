@@ -19,6 +19,12 @@ type InferenceInfo struct {
 	ModelID     uint64
 	Stream      bool
 	InfMetadata *inference.InferenceMetadata
+	// Sent on the customers own provider key
+	BYOK bool
+
+	// System prompt policy applied to the request, 0 when none
+	PolicyID      uint64
+	PolicyVersion uint64
 }
 
 // ContextLogValues should only be accessed for logging, and not for
@@ -39,6 +45,7 @@ type ContextLogValues struct {
 	AllowOverspend bool
 	StoreData      bool
 	Role           string
+	OrganizationID uint64
 
 	// Inference metadata fields
 	InferenceInfo *InferenceInfo
@@ -46,6 +53,11 @@ type ContextLogValues struct {
 	// History related
 	HistoryID string
 
+	// Search locale used for web search and where it came from
+	SearchRegion       string
+	SearchLanguage     string
+	SearchLocaleSource string
+
 	// Override log Log Level
 	// useful for streaming where status code might be sent before errors from
 	// mid-stream or post processing occur
@@ -73,17 +85,28 @@ func (c *ContextLogValues) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 		enc.AddBool("allow_overspend", c.AllowOverspend)
 		enc.AddBool("store_data", c.StoreData)
 		enc.AddString("role", c.Role)
+		if c.OrganizationID != 0 {
+			enc.AddUint64("organization_id", c.OrganizationID)
+		}
 	}
 	if c.InferenceInfo != nil {
 		enc.AddBool("stream", c.InferenceInfo.Stream)
 		enc.AddString("model_url", c.InferenceInfo.ModelURL)
 		enc.AddUint64("model_id", c.InferenceInfo.ModelID)
 		enc.AddString("model_name", c.InferenceInfo.ModelName)
+		if c.InferenceInfo.BYOK {
+			enc.AddBool("byok", true)
+		}
+		if c.InferenceInfo.PolicyID != 0 {
+			enc.AddUint64("policy_id", c.InferenceInfo.PolicyID)
+			enc.AddUint64("policy_version", c.InferenceInfo.PolicyVersion)
+		}
 		if c.InferenceInfo.InfMetadata != nil {
 			enc.AddDuration("ttft", c.InferenceInfo.InfMetadata.TimeToFirstToken)
 			enc.AddDuration("total_time", c.InferenceInfo.InfMetadata.TotalTime)
 			enc.AddBool("completed", c.InferenceInfo.InfMetadata.Completed)
 			enc.AddBool("canceled", c.InferenceInfo.InfMetadata.Canceled)
+			enc.AddBool("cached", c.InferenceInfo.InfMetadata.Cached)
 		}
 	}
 	enc.AddString("request_id", c.RequestID)
@@ -107,6 +130,11 @@ func (c *ContextLogValues) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	if c.HistoryID != "" {
 		enc.AddString("history_id", c.HistoryID)
 	}
+	if c.SearchLocaleSource != "" {
+		enc.AddString("search_region", c.SearchRegion)
+		enc.AddString("search_language", c.SearchLanguage)
+		enc.AddString("search_locale_source", c.SearchLocaleSource)
+	}
 	return nil
 }
 
@@ -116,4 +144,13 @@ type Context struct {
 	Reqid     string
 	User      *shared.UserMetadata
 	LogValues *ContextLogValues
+	// Version of the api the route was called under, empty outside of it
+	APIVersion string
+}
+
+// SetLog replaces the request logger and attaches it to the request context
+// so handlers can pull it with shared.LoggerFromContext
+func (c *Context) SetLog(log *zap.SugaredLogger) {
+	c.Log = log
+	c.SetRequest(c.Request().WithContext(shared.WithLogger(c.Request().Context(), log)))
 }
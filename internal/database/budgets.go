@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"sybil-api/internal/shared"
+)
+
+// BudgetAlert is emitted when spend crosses one of a budgets alert thresholds
+type BudgetAlert struct {
+	BudgetID     uint64  `json:"budget_id"`
+	UserID       uint64  `json:"user_id"`
+	APIKeyID     *string `json:"api_key_id,omitempty"`
+	Period       string  `json:"period"`
+	PeriodStart  string  `json:"period_start"`
+	CapCredits   uint64  `json:"cap_credits"`
+	SpentCredits uint64  `json:"spent_credits"`
+	Threshold    uint64  `json:"threshold_percent"`
+	WebhookURL   string  `json:"-"`
+}
+
+type budgetRow struct {
+	id             uint64
+	apiKeyID       *string
+	period         string
+	capCredits     uint64
+	thresholdsJSON string
+	webhookURL     *string
+	spentCredits   uint64
+	periodStart    string
+	lastThreshold  uint64
+}
+
+// RecordBudgetSpend adds the flushed spend to the users budgets, resetting any
+// budget whose period has rolled over. spendByKey holds the credits used per
+// api key, user wide budgets are charged totalCredits. Returns the alerts for
+// thresholds crossed by this spend
+func RecordBudgetSpend(ctx context.Context, tx *sql.Tx, userID uint64, spendByKey map[string]uint64, totalCredits uint64) ([]BudgetAlert, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, api_key_id, period, cap_credits, alert_thresholds, webhook_url,
+			spent_credits, DATE_FORMAT(period_start, '%Y-%m-%d'), last_alert_threshold
+		FROM budget
+		WHERE user_id = ? AND active = true
+		FOR UPDATE
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get budgets: %w", err)
+	}
+	budgets := []budgetRow{}
+	for rows.Next() {
+		var b budgetRow
+		if err := rows.Scan(&b.id, &b.apiKeyID, &b.period, &b.capCredits, &b.thresholdsJSON, &b.webhookURL,
+			&b.spentCredits, &b.periodStart, &b.lastThreshold); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to scan budget: %w", err)
+		}
+		budgets = append(budgets, b)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed iterating budgets: %w", err)
+	}
+
+	now := time.Now()
+	alerts := []BudgetAlert{}
+	for _, b := range budgets {
+		spend := totalCredits
+		if b.apiKeyID != nil {
+			spend = spendByKey[*b.apiKeyID]
+		}
+		if spend == 0 {
+			continue
+		}
+
+		periodStart := shared.BudgetPeriodStart(b.period, now).Format(time.DateOnly)
+		if b.periodStart != periodStart {
+			b.spentCredits = 0
+			b.lastThreshold = 0
+		}
+		b.spentCredits += spend
+
+		var thresholds []uint64
+		if err := json.Unmarshal([]byte(b.thresholdsJSON), &thresholds); err != nil {
+			thresholds = nil
+		}
+		sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] < thresholds[j] })
+
+		// Only alert on the highest threshold crossed so a large flush doesnt
+		// send one alert per threshold
+		crossed := b.lastThreshold
+		for _, threshold := range thresholds {
+			if threshold > crossed && b.capCredits > 0 && b.spentCredits*100 >= b.capCredits*threshold {
+				crossed = threshold
+			}
+		}
+		if crossed > b.lastThreshold {
+			alerts = append(alerts, BudgetAlert{
+				BudgetID:     b.id,
+				UserID:       userID,
+				APIKeyID:     b.apiKeyID,
+				Period:       b.period,
+				PeriodStart:  periodStart,
+				CapCredits:   b.capCredits,
+				SpentCredits: b.spentCredits,
+				Threshold:    crossed,
+				WebhookURL:   shared.DerefString(b.webhookURL),
+			})
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE budget SET spent_credits = ?, period_start = ?, last_alert_threshold = ?
+			WHERE id = ?
+		`, b.spentCredits, periodStart, crossed, b.id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update budget spend: %w", err)
+		}
+	}
+	return alerts, nil
+}
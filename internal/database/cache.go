@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ClearUserCache drops the cached user metadata for each of the users keys
+// and their web session so a changed setting is seen on the next request
+func ClearUserCache(ctx context.Context, db *sql.DB, redisClient *redis.Client, userID uint64) error {
+	return clearCache(ctx, db, redisClient, `
+		SELECT u.id, k.id FROM user u
+		LEFT JOIN api_key k ON k.user_id = u.id AND k.revoked_at IS NULL
+		WHERE u.id = ?
+	`, userID)
+}
+
+// ClearPoolCache drops the cached user metadata of everyone charged from the
+// same credit pool as the user, every member of their organization when they
+// belong to one, so a changed balance is seen on the next request
+func ClearPoolCache(ctx context.Context, db *sql.DB, redisClient *redis.Client, userID uint64) error {
+	return clearCache(ctx, db, redisClient, `
+		SELECT u.id, k.id FROM user u
+		LEFT JOIN api_key k ON k.user_id = u.id AND k.revoked_at IS NULL
+		WHERE u.id = ? OR u.organization_id = (SELECT organization_id FROM user WHERE id = ?)
+	`, userID, userID)
+}
+
+// clearCache deletes the session and api key cache entries of the user id
+// and nullable api key id rows query returns
+func clearCache(ctx context.Context, db *sql.DB, redisClient *redis.Client, query string, args ...any) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query api keys for cache clear: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	keys := []string{}
+	sessions := map[uint64]bool{}
+	for rows.Next() {
+		var userID uint64
+		var apiKey sql.NullString
+		if err := rows.Scan(&userID, &apiKey); err != nil {
+			continue
+		}
+		if !sessions[userID] {
+			sessions[userID] = true
+			keys = append(keys, shared.SessionCacheKey(userID))
+		}
+		if apiKey.Valid {
+			keys = append(keys, shared.APIKeyCacheKey(apiKey.String))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read api keys for cache clear: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := redisClient.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to clear user cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+)
+
+// LagMonitor measures how far the read replica is behind the primary. Vitess
+// does not expose replication status to clients, so a heartbeat row is
+// written on the primary and its age read back on the replica. Every instance
+// writes the heartbeat, the update is cheap and nobody has to own it
+type LagMonitor struct {
+	wdb *sql.DB
+	rdb *sql.DB
+	log *zap.SugaredLogger
+	// Last measured lag and when it was measured, in unix nanoseconds
+	lag        atomic.Int64
+	measuredAt atomic.Int64
+}
+
+func NewLagMonitor(wdb *sql.DB, rdb *sql.DB, log *zap.SugaredLogger) *LagMonitor {
+	return &LagMonitor{wdb: wdb, rdb: rdb, log: log}
+}
+
+// Run beats and measures every shared.ReplicaHeartbeatInterval until ctx is
+// done
+func (m *LagMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(shared.ReplicaHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		m.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *LagMonitor) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, shared.ReplicaHeartbeatInterval)
+	defer cancel()
+
+	_, err := m.wdb.ExecContext(ctx, `
+		INSERT INTO replica_heartbeat (id, beat_at) VALUES (1, NOW(6))
+		ON DUPLICATE KEY UPDATE beat_at = NOW(6)
+	`)
+	if err != nil {
+		m.log.Warnw("Failed to write replica heartbeat", "error", err)
+		return
+	}
+
+	// The beat is up to one interval old when it is written, so the measured
+	// lag overstates the real one by at most that much
+	var micros int64
+	err = m.rdb.QueryRowContext(ctx, `
+		SELECT TIMESTAMPDIFF(MICROSECOND, beat_at, NOW(6)) FROM replica_heartbeat WHERE id = 1
+	`).Scan(&micros)
+	if err != nil {
+		m.log.Warnw("Failed to read replica heartbeat", "error", err)
+		return
+	}
+	lag := time.Duration(max(micros, 0)) * time.Microsecond
+	m.lag.Store(int64(lag))
+	m.measuredAt.Store(time.Now().UnixNano())
+	metrics.ReplicaLag.Set(lag.Seconds())
+}
+
+// Lagging reports whether reads that must see recent writes should skip the
+// replica. A replica that has not been measured recently counts as lagging.
+// A nil monitor never lags, so callers without one keep reading the replica
+func (m *LagMonitor) Lagging() bool {
+	if m == nil {
+		return false
+	}
+	measuredAt := time.Unix(0, m.measuredAt.Load())
+	if time.Since(measuredAt) > 3*shared.ReplicaHeartbeatInterval {
+		return true
+	}
+	return time.Duration(m.lag.Load()) > shared.ReplicaLagThreshold
+}
+
+// ReadDB returns the replica, or the primary while the replica is lagging.
+// purpose labels the fallback metric. The monitor must not be nil
+func (m *LagMonitor) ReadDB(purpose string) *sql.DB {
+	if !m.Lagging() {
+		return m.rdb
+	}
+	metrics.ReplicaFallbacks.WithLabelValues(purpose).Inc()
+	return m.wdb
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/bits"
+)
+
+const (
+	LedgerKindCharge   = "CHARGE"
+	LedgerKindWriteOff = "WRITE_OFF"
+	LedgerKindGrant    = "GRANT"
+	LedgerKindDeduct   = "DEDUCT"
+	LedgerKindRefund   = "REFUND"
+	LedgerKindPurchase = "PURCHASE"
+)
+
+// LedgerEntry is one append only row of credit_ledger. The credits column on
+// user and organization is the running total of these rows. ExternalID holds
+// the payment provider id for purchases
+type LedgerEntry struct {
+	ID             int64   `json:"id"`
+	UserID         uint64  `json:"user_id"`
+	OrganizationID *uint64 `json:"organization_id,omitempty"`
+	Kind           string  `json:"kind"`
+	Delta          int64   `json:"delta"`
+	BalanceAfter   int64   `json:"balance_after"`
+	RequestID      *string `json:"request_id,omitempty"`
+	BatchID        *string `json:"batch_id,omitempty"`
+	ExternalID     *string `json:"external_id,omitempty"`
+	Reason         string  `json:"reason"`
+	CreatedBy      *uint64 `json:"created_by,omitempty"`
+	CreatedAt      string  `json:"created_at,omitempty"`
+}
+
+// PoolBalance locks and returns the credit balance entry would be applied to,
+// the organization pool when OrganizationID is set and the user otherwise
+func PoolBalance(ctx context.Context, tx *sql.Tx, entry *LedgerEntry) (int64, error) {
+	table, poolID := ledgerPool(entry)
+	var balance int64
+	err := tx.QueryRowContext(ctx, "SELECT credits FROM "+table+" WHERE id = ? FOR UPDATE", poolID).Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+// ApplyLedgerEntry appends entry to the ledger and moves the pool balance by
+// its delta in the same transaction. BalanceAfter and ID are filled in
+func ApplyLedgerEntry(ctx context.Context, tx *sql.Tx, entry *LedgerEntry) error {
+	balance, err := PoolBalance(ctx, tx, entry)
+	if err != nil {
+		return fmt.Errorf("failed to get pool balance: %w", err)
+	}
+	entry.BalanceAfter = balance + entry.Delta
+
+	table, poolID := ledgerPool(entry)
+	_, err = tx.ExecContext(ctx, "UPDATE "+table+" SET credits = ? WHERE id = ?", entry.BalanceAfter, poolID)
+	if err != nil {
+		return fmt.Errorf("failed to update %s credits: %w", table, err)
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO credit_ledger (user_id, organization_id, kind, delta, balance_after, request_id, batch_id, external_id, reason, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.UserID, entry.OrganizationID, entry.Kind, entry.Delta, entry.BalanceAfter, entry.RequestID, entry.BatchID, entry.ExternalID, entry.Reason, entry.CreatedBy)
+	if err != nil {
+		return fmt.Errorf("failed to insert ledger entry: %w", err)
+	}
+	entry.ID, err = res.LastInsertId()
+	return err
+}
+
+// RequestDebit returns the credits actually taken from the pool for a request
+// costing credits in batchID: its share of the batch CHARGE entry less any
+// write off. ok is false when the batch was not paid in credits, either from
+// plan requests or because it was never charged
+func RequestDebit(ctx context.Context, tx *sql.Tx, batchID string, credits uint64) (uint64, bool, error) {
+	var charges int
+	var charged, writtenOff int64
+	err := tx.QueryRowContext(ctx, `
+		SELECT
+			COUNT(CASE WHEN kind = ? THEN 1 END),
+			COALESCE(SUM(CASE WHEN kind = ? THEN -delta ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN kind = ? THEN delta ELSE 0 END), 0)
+		FROM credit_ledger
+		WHERE batch_id = ? AND kind IN (?, ?)
+	`, LedgerKindCharge, LedgerKindCharge, LedgerKindWriteOff, batchID, LedgerKindCharge, LedgerKindWriteOff).Scan(&charges, &charged, &writtenOff)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get batch charge: %w", err)
+	}
+	if charges == 0 {
+		return 0, false, nil
+	}
+	debited := charged - writtenOff
+	if debited <= 0 {
+		return 0, true, nil
+	}
+
+	var batchCredits uint64
+	err = tx.QueryRowContext(ctx, "SELECT credits FROM usage_batch WHERE batch_id = ?", batchID).Scan(&batchCredits)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get usage batch: %w", err)
+	}
+	if batchCredits == 0 {
+		return 0, true, nil
+	}
+	credits = min(credits, batchCredits)
+	// debited * credits can overflow 64 bits, the quotient cannot since
+	// credits is at most batchCredits
+	hi, lo := bits.Mul64(uint64(debited), credits)
+	share, _ := bits.Div64(hi, lo, batchCredits)
+	return share, true, nil
+}
+
+func ledgerPool(entry *LedgerEntry) (string, uint64) {
+	if entry.OrganizationID != nil {
+		return "organization", *entry.OrganizationID
+	}
+	return "user", entry.UserID
+}
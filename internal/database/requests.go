@@ -3,13 +3,18 @@ package database
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sybil-api/internal/shared"
+	"sync"
 	"time"
 
-	"go.uber.org/zap"
+	"github.com/go-sql-driver/mysql"
 )
 
 type DailyStats struct {
@@ -24,25 +29,61 @@ type DailyStats struct {
 	TimeToFirstToken     int64
 	TotalTime            int64
 	CanceledRequestCount uint64
+	// Share of the above served on reserved capacity
+	ReservedRequestCount uint64
+	ReservedInputTokens  uint64
+	ReservedOutputTokens uint64
+	ReservedSpend        uint64
 }
 
-// SaveRequests saves the request details 
-func SaveRequests(db *sql.DB, qim map[string]*shared.ProcessedQueryInfo, log *zap.SugaredLogger) error {
-	requestSQLStr := `INSERT INTO request (
+const requestInsertColumns = `INSERT INTO request (
             user_id, request_id, endpoint,
             prompt_tokens, completion_tokens,
-            time_to_first_token, total_time, created_at, model_id
+            time_to_first_token, total_time, created_at, model_id, seed,
+            credits, metadata, batch_id, byok, icpt, ocpt, crc, price_multiplier, reserved, completed
         ) VALUES`
 
+const requestInsertRow = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+// fullChunkStmts holds the prepared insert for a full chunk of requests per
+// database, shared by every flush so it is only planned once
+var fullChunkStmts sync.Map
+
+func requestInsertQuery(rows int) string {
+	return requestInsertColumns + strings.TrimSuffix(strings.Repeat(requestInsertRow+",", rows), ",")
+}
+
+func fullChunkStmt(ctx context.Context, db *sql.DB) (*sql.Stmt, error) {
+	if stmt, ok := fullChunkStmts.Load(db); ok {
+		return stmt.(*sql.Stmt), nil
+	}
+	stmt, err := db.PrepareContext(ctx, requestInsertQuery(shared.SaveRequestsChunkSize))
+	if err != nil {
+		return nil, err
+	}
+	actual, loaded := fullChunkStmts.LoadOrStore(db, stmt)
+	if loaded {
+		_ = stmt.Close()
+	}
+	return actual.(*sql.Stmt), nil
+}
+
+// SaveRequests saves the request details and adds them to the daily stats in
+// tx, so they commit together with the charge for the same batch. db is the
+// database tx runs on and holds the prepared insert. Requests are inserted
+// shared.SaveRequestsChunkSize rows at a time so a large bucket stays under
+// the max packet size
+func SaveRequests(ctx context.Context, tx *sql.Tx, db *sql.DB, qim map[string]*shared.ProcessedQueryInfo, batchID string) error {
 	statsSQLStr := `INSERT INTO daily_stats (
-		date, user_id, model, request_count, input_tokens, output_tokens, total_spend, time_to_first_token, total_time, canceled_requests, model_id
+		date, user_id, model, request_count, input_tokens, output_tokens, total_spend, time_to_first_token, total_time, canceled_requests, model_id,
+		reserved_requests, reserved_input_tokens, reserved_output_tokens, reserved_spend
 	) VALUES`
 
 	today := time.Now().Format("2006-01-02")
 
 	aggregated := make(map[string]*DailyStats)
 
-	requestVals := []any{}
+	requestRows := [][]any{}
 	statsVals := []any{}
 
 	if len(qim) == 0 {
@@ -63,6 +104,12 @@ func SaveRequests(db *sql.DB, qim map[string]*shared.ProcessedQueryInfo, log *za
 		existing.InputTokens += qi.Usage.PromptTokens
 		existing.OutputTokens += qi.Usage.CompletionTokens
 		existing.TotalSpend += qi.TotalCredits
+		if qi.Reserved {
+			existing.ReservedRequestCount += 1
+			existing.ReservedInputTokens += qi.Usage.PromptTokens
+			existing.ReservedOutputTokens += qi.Usage.CompletionTokens
+			existing.ReservedSpend += qi.TotalCredits
+		}
 		if !qi.Usage.IsCanceled {
 			existing.TimeToFirstToken += qi.TimeToFirstToken.Milliseconds()
 			existing.TotalTime += qi.TotalTime.Milliseconds()
@@ -71,22 +118,38 @@ func SaveRequests(db *sql.DB, qim map[string]*shared.ProcessedQueryInfo, log *za
 			existing.CanceledRequestCount += 1
 			continue
 		}
-		requestSQLStr += "(?, ?, ?, ?, ?, ?, ?, ?, ?),"
-		requestVals = append(requestVals,
+		if qi.Ephemeral {
+			continue
+		}
+		var metadata *string
+		if len(qi.Metadata) > 0 {
+			stored := qi.Metadata
+			if !qi.StoreData {
+				stored = hashMetadata(qi.Metadata)
+			}
+			if metadataJSON, err := json.Marshal(stored); err == nil {
+				m := string(metadataJSON)
+				metadata = &m
+			}
+		}
+		requestRows = append(requestRows, []any{
 			qi.UserID, id, qi.Endpoint,
 			qi.Usage.PromptTokens, qi.Usage.CompletionTokens,
 			qi.TimeToFirstToken.Milliseconds(), qi.TotalTime.Milliseconds(),
 			qi.CreatedAt,
 			qi.ModelID,
-		)
+			qi.Seed,
+			qi.TotalCredits, metadata, batchID, qi.BYOK,
+			qi.ICPT, qi.OCPT, qi.CRC, qi.PriceMultiplier, qi.Reserved, qi.Completed,
+		})
 	}
 
 	for _, val := range aggregated {
-		statsSQLStr += "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?),"
-		statsVals = append(statsVals, today, val.UserID, val.Model, val.RequestCount, val.InputTokens, val.OutputTokens, val.TotalSpend, val.TimeToFirstToken, val.TotalTime, val.CanceledRequestCount, val.ModelID)
+		statsSQLStr += "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?),"
+		statsVals = append(statsVals, today, val.UserID, val.Model, val.RequestCount, val.InputTokens, val.OutputTokens, val.TotalSpend, val.TimeToFirstToken, val.TotalTime, val.CanceledRequestCount, val.ModelID,
+			val.ReservedRequestCount, val.ReservedInputTokens, val.ReservedOutputTokens, val.ReservedSpend)
 	}
 
-	requestSQLStr = strings.TrimSuffix(requestSQLStr, ",")
 	statsSQLStr = strings.TrimSuffix(statsSQLStr, ",")
 	statsSQLStr += ` ON DUPLICATE KEY UPDATE
 		canceled_requests = canceled_requests + VALUES(canceled_requests),
@@ -95,54 +158,197 @@ func SaveRequests(db *sql.DB, qim map[string]*shared.ProcessedQueryInfo, log *za
 		output_tokens = output_tokens + VALUES(output_tokens),
 		total_spend = total_spend + VALUES(total_spend),
 		time_to_first_token = time_to_first_token + VALUES(time_to_first_token),
-		total_time = total_time + VALUES(total_time)`
+		total_time = total_time + VALUES(total_time),
+		reserved_requests = reserved_requests + VALUES(reserved_requests),
+		reserved_input_tokens = reserved_input_tokens + VALUES(reserved_input_tokens),
+		reserved_output_tokens = reserved_output_tokens + VALUES(reserved_output_tokens),
+		reserved_spend = reserved_spend + VALUES(reserved_spend)`
 
 	// Save request history
-	if len(requestVals) > 0 {
-		_, err := db.Exec(requestSQLStr, requestVals...)
+	for start := 0; start < len(requestRows); start += shared.SaveRequestsChunkSize {
+		chunk := requestRows[start:min(start+shared.SaveRequestsChunkSize, len(requestRows))]
+		args := make([]any, 0, len(chunk)*len(chunk[0]))
+		for _, row := range chunk {
+			args = append(args, row...)
+		}
+		var err error
+		if len(chunk) == shared.SaveRequestsChunkSize {
+			var stmt *sql.Stmt
+			stmt, err = fullChunkStmt(ctx, db)
+			if err != nil {
+				return fmt.Errorf("failed to prepare request insert: %w", err)
+			}
+			_, err = tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+		} else {
+			_, err = tx.ExecContext(ctx, requestInsertQuery(len(chunk)), args...)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to save request: %w", err)
 		}
 	}
 
-	_, err := db.Exec(statsSQLStr, statsVals...)
-	if err != nil {
+	if _, err := tx.ExecContext(ctx, statsSQLStr, statsVals...); err != nil {
 		return fmt.Errorf("failed to save request: %w", err)
 	}
 
 	return nil
 }
 
-func ChargeUser(ctx context.Context, tx *sql.Tx, userID uint64, requestsUsed uint, creditsUsed uint64) error {
-	var planRequests uint
-	var credits uint64
-	err := tx.QueryRowContext(ctx, "SELECT COALESCE(plan_requests, 0), credits FROM user WHERE id = ? FOR UPDATE", userID).Scan(&planRequests, &credits)
-	if err != nil {
-		return fmt.Errorf("failed to get user plan data: %w", err)
+// hashMetadata replaces metadata values with their sha256 for users who do not
+// allow their content to be kept. Keys are kept so requests can still be
+// matched on a known value
+func hashMetadata(metadata map[string]string) map[string]string {
+	hashed := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		sum := sha256.Sum256([]byte(value))
+		hashed[key] = "sha256:" + hex.EncodeToString(sum[:])
 	}
+	return hashed
+}
+
+// IsLockConflict reports whether mysql picked err's statement as a deadlock
+// victim or it timed out waiting on a lock, which concurrent flushes of the
+// same daily stats rows can cause. Either rolls back the whole transaction,
+// so it has to be retried from the start
+func IsLockConflict(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1213 || mysqlErr.Number == 1205)
+}
 
-	switch {
-	case planRequests >= 1:
+// IsDuplicateKey reports whether err is mysql rejecting a row that breaks a
+// unique key
+func IsDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// PoolState is what a pool has left when a bucket is charged to it
+type PoolState struct {
+	PlanRequests   uint  `json:"plan_requests"`
+	Credits        int64 `json:"credits"`
+	AllowOverspend bool  `json:"allow_overspend"`
+}
+
+// Settlement is how a bucket is charged to a pool
+type Settlement struct {
+	// Plan requests are used instead of credits whenever any are left, even
+	// when the bucket holds more requests than remain
+	UsedPlan          bool  `json:"used_plan"`
+	PlanRequestsAfter uint  `json:"plan_requests_after"`
+	Charged           int64 `json:"charged"`
+	WrittenOff        int64 `json:"written_off"`
+	CreditsAfter      int64 `json:"credits_after"`
+}
+
+// SettleCharge decides how requestsUsed requests costing creditsUsed are
+// charged to pool. ChargeUser applies it, so it must stay free of side effects
+func SettleCharge(pool PoolState, requestsUsed uint, creditsUsed uint64) Settlement {
+	if pool.PlanRequests >= 1 {
 		requestBalance := uint(0)
-		if planRequests > requestsUsed {
-			requestBalance = planRequests - requestsUsed
+		if pool.PlanRequests > requestsUsed {
+			requestBalance = pool.PlanRequests - requestsUsed
 		}
-		_, err = tx.ExecContext(ctx, "UPDATE user SET plan_requests = ? WHERE id = ?", requestBalance, userID)
+		return Settlement{UsedPlan: true, PlanRequestsAfter: requestBalance, CreditsAfter: pool.Credits}
+	}
+
+	settlement := Settlement{Charged: int64(creditsUsed), CreditsAfter: pool.Credits - int64(creditsUsed)}
+	if settlement.CreditsAfter < 0 && !pool.AllowOverspend {
+		settlement.WrittenOff = -settlement.CreditsAfter
+		settlement.CreditsAfter = 0
+	}
+	return settlement
+}
+
+// ChargeUser charges a flushed bucket to the user, or to their organization
+// pool when they belong to one. Plan requests are used first; otherwise the
+// credits are debited through the ledger under batchID. Balances may go
+// negative for pools that allow overspend, for everyone else the shortfall is
+// written off so the balance floors at zero without losing the charge
+func ChargeUser(ctx context.Context, tx *sql.Tx, userID uint64, requestsUsed uint, creditsUsed uint64, batchID string) error {
+	var organizationID sql.NullInt64
+	err := tx.QueryRowContext(ctx, "SELECT organization_id FROM user WHERE id = ?", userID).Scan(&organizationID)
+	if err != nil {
+		return fmt.Errorf("failed to get user organization: %w", err)
+	}
+
+	// Members of an organization spend from the shared organization pool
+	table, poolID := "user", userID
+	var orgID *uint64
+	if organizationID.Valid {
+		id := uint64(organizationID.Int64)
+		table, poolID, orgID = "organization", id, &id
+	}
+
+	var pool PoolState
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(plan_requests, 0), credits, allow_overspend FROM "+table+" WHERE id = ? FOR UPDATE", poolID).Scan(&pool.PlanRequests, &pool.Credits, &pool.AllowOverspend)
+	if err != nil {
+		return fmt.Errorf("failed to get %s plan data: %w", table, err)
+	}
+
+	settlement := SettleCharge(pool, requestsUsed, creditsUsed)
+	if settlement.UsedPlan {
+		_, err = tx.ExecContext(ctx, "UPDATE "+table+" SET plan_requests = ? WHERE id = ?", settlement.PlanRequestsAfter, poolID)
 		if err != nil {
-			return fmt.Errorf("failed to update user plan requests: %w", err)
+			return fmt.Errorf("failed to update %s plan requests: %w", table, err)
 		}
 		return nil
-	default:
-		balance := uint64(0)
-		if credits > creditsUsed {
-			balance = credits - creditsUsed
-		}
-		_, err = tx.ExecContext(ctx, "UPDATE user SET credits = ? WHERE id = ?", balance, userID)
-		if err != nil {
-			return fmt.Errorf("failed to update user credits: %w", err)
-		}
+	}
+
+	charge := &LedgerEntry{
+		UserID:         userID,
+		OrganizationID: orgID,
+		Kind:           LedgerKindCharge,
+		Delta:          -settlement.Charged,
+		BatchID:        &batchID,
+		Reason:         fmt.Sprintf("%d requests", requestsUsed),
+	}
+	if err := ApplyLedgerEntry(ctx, tx, charge); err != nil {
+		return err
+	}
+	if settlement.WrittenOff == 0 {
 		return nil
 	}
+
+	writeOff := &LedgerEntry{
+		UserID:         userID,
+		OrganizationID: orgID,
+		Kind:           LedgerKindWriteOff,
+		Delta:          settlement.WrittenOff,
+		BatchID:        &batchID,
+		Reason:         "balance exhausted without overspend",
+	}
+	return ApplyLedgerEntry(ctx, tx, writeOff)
+}
+
+// UsageBatch is what a flushed bucket charged
+type UsageBatch struct {
+	Requests uint
+	Credits  uint64
+}
+
+// ClaimUsageBatch records that batchID is being charged in this transaction,
+// along with what it charges. It returns false when the batch was charged
+// before, in which case the caller must not charge it again
+func ClaimUsageBatch(ctx context.Context, tx *sql.Tx, batchID string, userID uint64, batch UsageBatch) (bool, error) {
+	res, err := tx.ExecContext(ctx, "INSERT IGNORE INTO usage_batch (batch_id, user_id, requests, credits) VALUES (?, ?, ?, ?)", batchID, userID, batch.Requests, batch.Credits)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim usage batch: %w", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim usage batch: %w", err)
+	}
+	return rows == 1, nil
+}
+
+// GetUsageBatch returns what batchID charged when it was claimed
+func GetUsageBatch(ctx context.Context, db *sql.DB, batchID string) (*UsageBatch, error) {
+	var batch UsageBatch
+	err := db.QueryRowContext(ctx, "SELECT requests, credits FROM usage_batch WHERE batch_id = ?", batchID).Scan(&batch.Requests, &batch.Credits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage batch: %w", err)
+	}
+	return &batch, nil
 }
 
 // ExecuteTransaction executes one transaction with one or multiple database executions.
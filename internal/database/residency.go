@@ -0,0 +1,59 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"sybil-api/internal/tracing"
+)
+
+// ResidencyDBs maps a data residency region to the database that stores user
+// content for accounts pinned to that region
+type ResidencyDBs map[string]*sql.DB
+
+// OpenResidencyDBs opens one database per region from a comma separated list
+// of region=dsn pairs, e.g. "eu=user:pass@tcp(eu-db)/sybil,us=..."
+func OpenResidencyDBs(spec string) (ResidencyDBs, error) {
+	dbs := ResidencyDBs{}
+	if strings.TrimSpace(spec) == "" {
+		return dbs, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		region, dsn, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		region = strings.ToLower(strings.TrimSpace(region))
+		if !ok || region == "" || dsn == "" {
+			dbs.Close()
+			return nil, fmt.Errorf("invalid residency dsn entry %q, expected region=dsn", pair)
+		}
+		db, err := tracing.OpenMySQL(dsn)
+		if err != nil {
+			dbs.Close()
+			return nil, fmt.Errorf("failed opening %s residency db: %w", region, err)
+		}
+		if err := db.Ping(); err != nil {
+			_ = db.Close()
+			dbs.Close()
+			return nil, fmt.Errorf("failed ping to %s residency db: %w", region, err)
+		}
+		dbs[region] = db
+	}
+	return dbs, nil
+}
+
+// For returns the database for region, or fallback when the account has no
+// residency requirement. ok is false when region is set but not configured,
+// in which case nothing should be written
+func (r ResidencyDBs) For(region string, fallback *sql.DB) (db *sql.DB, ok bool) {
+	if region == "" {
+		return fallback, true
+	}
+	db, ok = r[strings.ToLower(region)]
+	return db, ok
+}
+
+func (r ResidencyDBs) Close() {
+	for _, db := range r {
+		_ = db.Close()
+	}
+}
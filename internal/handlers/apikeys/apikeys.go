@@ -0,0 +1,450 @@
+// Package apikeys manages the named, scoped api keys of a user
+package apikeys
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"sybil-api/internal/shared"
+
+	"github.com/aidarkhanov/nanoid"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type APIKeyHandler struct {
+	Log         *zap.SugaredLogger
+	WDB         *sql.DB
+	RDB         *sql.DB
+	RedisClient *redis.Client
+}
+
+func NewAPIKeyHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger) *APIKeyHandler {
+	return &APIKeyHandler{Log: log, WDB: wdb, RDB: rdb, RedisClient: redisClient}
+}
+
+// APIKey is the public view of a key. Key is only set when the key is created
+// or rotated, it cannot be read back afterwards
+type APIKey struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Key        string   `json:"key,omitempty"`
+	Hint       string   `json:"hint"`
+	Scopes     []string `json:"scopes"`
+	LastUsedAt *int64   `json:"last_used_at"`
+	ExpiresAt  *int64   `json:"expires_at"`
+	CreatedAt  int64    `json:"created_at"`
+	// Per minute limits lower than the users tier, nil uses the tier limit
+	RateLimitRPM *uint64 `json:"rate_limit_rpm"`
+	RateLimitTPM *uint64 `json:"rate_limit_tpm"`
+	// CIDRs and origins the key can be used from, empty allows any
+	AllowedIPs     []string `json:"allowed_ips"`
+	AllowedOrigins []string `json:"allowed_origins"`
+	HideReasoning  bool     `json:"hide_reasoning"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Unix timestamp, keys never expire when unset
+	ExpiresAt *int64 `json:"expires_at,omitempty"`
+	// Limits above the users tier have no effect
+	RateLimitRPM *uint64 `json:"rate_limit_rpm,omitempty"`
+	RateLimitTPM *uint64 `json:"rate_limit_tpm,omitempty"`
+	KeyRestrictions
+}
+
+// KeyRestrictions limit where a key can be used from. AllowedIPs takes CIDRs
+// or single addresses and AllowedOrigins takes scheme://host[:port] origins,
+// which browsers send in the Origin header. Empty lists allow any.
+// HideReasoning strips the reasoning of reasoning models from every response
+// the key gets, for keys handed to end users
+type KeyRestrictions struct {
+	AllowedIPs     []string `json:"allowed_ips,omitempty"`
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	HideReasoning  bool     `json:"hide_reasoning,omitempty"`
+}
+
+// APIKeyInput contains all data needed for api key business logic
+type APIKeyInput struct {
+	Ctx    context.Context
+	UserID uint64
+	// The key the request was authenticated with and its scopes
+	CallerKey    string
+	CallerScopes []string
+	// Public id of the key being rotated or revoked
+	KeyID string
+	Req   *CreateAPIKeyRequest
+	// Restrictions to set on the key, and whether staff are setting them on
+	// a key of any user
+	Restrictions *KeyRestrictions
+	Override     bool
+}
+
+func validateCreateAPIKey(req *CreateAPIKeyRequest, callerScopes []string) error {
+	if req == nil {
+		return errors.Join(errors.New("request body is required"), shared.ErrBadRequest)
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return errors.Join(errors.New("name is required"), shared.ErrBadRequest)
+	}
+	if len(req.Name) > shared.APIKeyNameMaxLength {
+		return errors.Join(fmt.Errorf("name cannot exceed %d characters", shared.APIKeyNameMaxLength), shared.ErrBadRequest)
+	}
+	if len(req.Scopes) == 0 {
+		return errors.Join(errors.New("scopes cannot be empty"), shared.ErrBadRequest)
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(shared.APIKeyScopes, scope) {
+			return errors.Join(fmt.Errorf("unknown scope: %s", scope), shared.ErrBadRequest)
+		}
+	}
+	if err := checkGrantable(req.Scopes, callerScopes); err != nil {
+		return err
+	}
+	if req.ExpiresAt != nil && *req.ExpiresAt <= time.Now().Unix() {
+		return errors.Join(errors.New("expires_at must be in the future"), shared.ErrBadRequest)
+	}
+	if (req.RateLimitRPM != nil && *req.RateLimitRPM == 0) || (req.RateLimitTPM != nil && *req.RateLimitTPM == 0) {
+		return errors.Join(errors.New("rate limits must be greater than 0"), shared.ErrBadRequest)
+	}
+	return validateKeyRestrictions(&req.KeyRestrictions)
+}
+
+// validateKeyRestrictions normalizes the allowlists in place so the
+// middleware can compare them directly against the request
+func validateKeyRestrictions(r *KeyRestrictions) error {
+	if r == nil {
+		return errors.Join(errors.New("request body is required"), shared.ErrBadRequest)
+	}
+	if len(r.AllowedIPs) > shared.APIKeyMaxAllowlistEntries || len(r.AllowedOrigins) > shared.APIKeyMaxAllowlistEntries {
+		return errors.Join(fmt.Errorf("allowlists cannot exceed %d entries", shared.APIKeyMaxAllowlistEntries), shared.ErrBadRequest)
+	}
+	ips := []string{}
+	for _, entry := range r.AllowedIPs {
+		prefix, err := shared.ParseAllowedIP(entry)
+		if err != nil {
+			return errors.Join(fmt.Errorf("invalid ip or cidr: %s", entry), shared.ErrBadRequest)
+		}
+		if !slices.Contains(ips, prefix.String()) {
+			ips = append(ips, prefix.String())
+		}
+	}
+	origins := []string{}
+	for _, entry := range r.AllowedOrigins {
+		origin, err := shared.NormalizeOrigin(entry)
+		if err != nil {
+			return errors.Join(fmt.Errorf("invalid origin %s", entry), err, shared.ErrBadRequest)
+		}
+		if !slices.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+	r.AllowedIPs, r.AllowedOrigins = ips, origins
+	return nil
+}
+
+// allowlistJSON stores empty allowlists as NULL so unrestricted keys skip the
+// check entirely
+func allowlistJSON(entries []string) (*string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	v := string(b)
+	return &v, nil
+}
+
+// checkGrantable rejects scopes the caller does not hold. Keys can only hand
+// out scopes they hold themselves, a nil callerScopes is a session with full
+// access
+func checkGrantable(scopes []string, callerScopes []string) error {
+	if callerScopes == nil {
+		return nil
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(callerScopes, scope) {
+			return errors.Join(fmt.Errorf("cannot grant scope %s", scope), shared.ErrBadRequest)
+		}
+	}
+	return nil
+}
+
+func generateAPIKey() (string, string, error) {
+	key, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ", shared.APIKeyLength)
+	if err != nil {
+		return "", "", err
+	}
+	keyNano, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 16)
+	if err != nil {
+		return "", "", err
+	}
+	return key, "key-" + keyNano, nil
+}
+
+// CreateAPIKeyLogic issues a new key for the user
+func (a *APIKeyHandler) CreateAPIKeyLogic(input APIKeyInput) (*APIKey, error) {
+	if err := validateCreateAPIKey(input.Req, input.CallerScopes); err != nil {
+		return nil, err
+	}
+
+	var count int
+	err := a.RDB.QueryRowContext(input.Ctx, `
+		SELECT COUNT(*) FROM api_key WHERE user_id = ? AND revoked_at IS NULL
+	`, input.UserID).Scan(&count)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to count api keys"), err, shared.ErrInternalServerError)
+	}
+	if count >= shared.APIKeyMaxPerUser {
+		return nil, errors.Join(fmt.Errorf("cannot have more than %d api keys", shared.APIKeyMaxPerUser), shared.ErrBadRequest)
+	}
+
+	scopesJSON, err := json.Marshal(input.Req.Scopes)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal scopes"), err, shared.ErrInternalServerError)
+	}
+	allowedIPs, err := allowlistJSON(input.Req.AllowedIPs)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal allowed ips"), err, shared.ErrInternalServerError)
+	}
+	allowedOrigins, err := allowlistJSON(input.Req.AllowedOrigins)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal allowed origins"), err, shared.ErrInternalServerError)
+	}
+	key, keyID, err := generateAPIKey()
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to generate api key"), err, shared.ErrInternalServerError)
+	}
+
+	_, err = a.WDB.ExecContext(input.Ctx, `
+		INSERT INTO api_key (id, public_id, user_id, name, scopes, expires_at, rate_limit_rpm, rate_limit_tpm, allowed_ips, allowed_origins, hide_reasoning)
+		VALUES (?, ?, ?, ?, ?, FROM_UNIXTIME(?), ?, ?, ?, ?, ?)
+	`, key, keyID, input.UserID, input.Req.Name, string(scopesJSON), input.Req.ExpiresAt, input.Req.RateLimitRPM, input.Req.RateLimitTPM,
+		allowedIPs, allowedOrigins, input.Req.HideReasoning)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to insert api key"), err, shared.ErrInternalServerError)
+	}
+
+	created, err := a.getAPIKey(input.Ctx, a.WDB, input.UserID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	created.Key = key
+	return created, nil
+}
+
+// ListAPIKeysLogic returns the users active keys
+func (a *APIKeyHandler) ListAPIKeysLogic(input APIKeyInput) ([]APIKey, error) {
+	log := shared.LoggerFromContext(input.Ctx, a.Log)
+	rows, err := a.RDB.QueryContext(input.Ctx, `
+		SELECT public_id, name, RIGHT(id, 4), scopes, UNIX_TIMESTAMP(last_used_at), UNIX_TIMESTAMP(expires_at), UNIX_TIMESTAMP(created_at), rate_limit_rpm, rate_limit_tpm,
+			allowed_ips, allowed_origins, hide_reasoning
+		FROM api_key
+		WHERE user_id = ? AND revoked_at IS NULL
+		ORDER BY created_at ASC
+	`, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query api keys"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			log.Warnw("Failed to scan api key row", "error", err)
+			continue
+		}
+		keys = append(keys, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating api key rows"), err, shared.ErrInternalServerError)
+	}
+	return keys, nil
+}
+
+// RotateAPIKeyLogic replaces the secret of a key. The public id stays the same
+// so the name, scopes, limits, allowlists, policies and budgets carry over.
+// The old secret stops working immediately
+func (a *APIKeyHandler) RotateAPIKeyLogic(input APIKeyInput) (*APIKey, error) {
+	oldKey, err := a.getSecret(input.Ctx, input.UserID, input.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	// Rotating hands the caller a usable secret, so it needs the same scopes
+	// as creating the key would
+	target, err := a.getAPIKey(input.Ctx, a.WDB, input.UserID, input.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGrantable(target.Scopes, input.CallerScopes); err != nil {
+		return nil, err
+	}
+	newKey, _, err := generateAPIKey()
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to generate api key"), err, shared.ErrInternalServerError)
+	}
+
+	res, err := a.WDB.ExecContext(input.Ctx, `
+		UPDATE api_key SET id = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`, newKey, oldKey, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to rotate api key"), err, shared.ErrInternalServerError)
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return nil, errors.Join(errors.New("api key not found"), shared.ErrNotFound)
+	}
+	a.clearKeyCache(input.Ctx, input.UserID, oldKey, input.KeyID)
+
+	rotated, err := a.getAPIKey(input.Ctx, a.WDB, input.UserID, input.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	rotated.Key = newKey
+	return rotated, nil
+}
+
+// SetKeyRestrictionsLogic replaces the ip and origin allowlists and the
+// reasoning policy of a key.
+// With Override set staff can change the key of any user, for example to
+// unlock an owner who restricted themselves out
+func (a *APIKeyHandler) SetKeyRestrictionsLogic(input APIKeyInput) (*APIKey, error) {
+	if err := validateKeyRestrictions(input.Restrictions); err != nil {
+		return nil, err
+	}
+	allowedIPs, err := allowlistJSON(input.Restrictions.AllowedIPs)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal allowed ips"), err, shared.ErrInternalServerError)
+	}
+	allowedOrigins, err := allowlistJSON(input.Restrictions.AllowedOrigins)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal allowed origins"), err, shared.ErrInternalServerError)
+	}
+
+	userID := input.UserID
+	if input.Override {
+		err = a.WDB.QueryRowContext(input.Ctx, `
+			SELECT user_id FROM api_key WHERE public_id = ? AND revoked_at IS NULL
+		`, input.KeyID).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return nil, errors.Join(errors.New("api key not found"), shared.ErrNotFound)
+		}
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to query api key"), err, shared.ErrInternalServerError)
+		}
+	}
+	key, err := a.getSecret(input.Ctx, userID, input.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = a.WDB.ExecContext(input.Ctx, `
+		UPDATE api_key SET allowed_ips = ?, allowed_origins = ?, hide_reasoning = ? WHERE id = ?
+	`, allowedIPs, allowedOrigins, input.Restrictions.HideReasoning, key)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to update api key restrictions"), err, shared.ErrInternalServerError)
+	}
+	a.clearKeyCache(input.Ctx, userID, key, input.KeyID)
+	return a.getAPIKey(input.Ctx, a.WDB, userID, input.KeyID)
+}
+
+// RevokeAPIKeyLogic permanently disables a key
+func (a *APIKeyHandler) RevokeAPIKeyLogic(input APIKeyInput) error {
+	key, err := a.getSecret(input.Ctx, input.UserID, input.KeyID)
+	if err != nil {
+		return err
+	}
+	if key == input.CallerKey {
+		return errors.Join(errors.New("cannot revoke the key used for this request"), shared.ErrBadRequest)
+	}
+	_, err = a.WDB.ExecContext(input.Ctx, "UPDATE api_key SET revoked_at = NOW() WHERE id = ?", key)
+	if err != nil {
+		return errors.Join(errors.New("failed to revoke api key"), err, shared.ErrInternalServerError)
+	}
+	a.clearKeyCache(input.Ctx, input.UserID, key, input.KeyID)
+	return nil
+}
+
+func (a *APIKeyHandler) getSecret(ctx context.Context, userID uint64, keyID string) (string, error) {
+	var key string
+	err := a.WDB.QueryRowContext(ctx, `
+		SELECT id FROM api_key WHERE public_id = ? AND user_id = ? AND revoked_at IS NULL
+	`, keyID, userID).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", errors.Join(errors.New("api key not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return "", errors.Join(errors.New("failed to query api key"), err, shared.ErrInternalServerError)
+	}
+	return key, nil
+}
+
+func (a *APIKeyHandler) getAPIKey(ctx context.Context, db *sql.DB, userID uint64, keyID string) (*APIKey, error) {
+	row := db.QueryRowContext(ctx, `
+		SELECT public_id, name, RIGHT(id, 4), scopes, UNIX_TIMESTAMP(last_used_at), UNIX_TIMESTAMP(expires_at), UNIX_TIMESTAMP(created_at), rate_limit_rpm, rate_limit_tpm,
+			allowed_ips, allowed_origins, hide_reasoning
+		FROM api_key
+		WHERE public_id = ? AND user_id = ?
+	`, keyID, userID)
+	key, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("api key not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query api key"), err, shared.ErrInternalServerError)
+	}
+	return key, nil
+}
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var key APIKey
+	var scopesJSON, allowedIPsJSON, allowedOriginsJSON *string
+	if err := row.Scan(&key.ID, &key.Name, &key.Hint, &scopesJSON, &key.LastUsedAt, &key.ExpiresAt, &key.CreatedAt,
+		&key.RateLimitRPM, &key.RateLimitTPM, &allowedIPsJSON, &allowedOriginsJSON, &key.HideReasoning); err != nil {
+		return nil, err
+	}
+	key.AllowedIPs, key.AllowedOrigins = []string{}, []string{}
+	if allowedIPsJSON != nil {
+		if err := json.Unmarshal([]byte(*allowedIPsJSON), &key.AllowedIPs); err != nil {
+			return nil, err
+		}
+	}
+	if allowedOriginsJSON != nil {
+		if err := json.Unmarshal([]byte(*allowedOriginsJSON), &key.AllowedOrigins); err != nil {
+			return nil, err
+		}
+	}
+	// Keys from before scopes existed have full access
+	key.Scopes = shared.APIKeyScopes
+	if scopesJSON != nil {
+		if err := json.Unmarshal([]byte(*scopesJSON), &key.Scopes); err != nil {
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// clearKeyCache drops every cache entry derived from the key so revocation
+// takes effect on the next request
+func (a *APIKeyHandler) clearKeyCache(ctx context.Context, userID uint64, apiKey string, keyID string) {
+	keys := []string{
+		shared.APIKeyCacheKey(apiKey),
+		fmt.Sprintf("sybil:v1:policy:%d:%s", userID, keyID),
+		fmt.Sprintf("sybil:v1:budget:%d:%s", userID, keyID),
+	}
+	if err := a.RedisClient.Del(ctx, keys...).Err(); err != nil {
+		a.Log.Warnw("Failed to clear api key cache", "error", err, "user_id", userID)
+	}
+}
@@ -0,0 +1,183 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"sybil-api/internal/shared"
+)
+
+// AutoRechargeSettings tops the balance up by Amount credits when it drops
+// below Threshold. The card charged is the users saved Stripe payment method
+type AutoRechargeSettings struct {
+	Enabled   bool   `json:"enabled"`
+	Threshold uint64 `json:"threshold"`
+	Amount    uint64 `json:"amount"`
+	HasCard   bool   `json:"has_card"`
+}
+
+type AutoRechargeInput struct {
+	Ctx      context.Context
+	UserID   uint64
+	Settings AutoRechargeSettings
+}
+
+func (b *BillingHandler) GetAutoRechargeLogic(input AutoRechargeInput) (*AutoRechargeSettings, error) {
+	var threshold, amount *uint64
+	var hasCard bool
+	err := b.RDB.QueryRowContext(input.Ctx, `
+		SELECT auto_recharge_threshold, auto_recharge_amount,
+			stripe_customer_id IS NOT NULL AND stripe_payment_method_id IS NOT NULL
+		FROM user WHERE id = ?
+	`, input.UserID).Scan(&threshold, &amount, &hasCard)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query auto recharge settings"), err, shared.ErrInternalServerError)
+	}
+	settings := &AutoRechargeSettings{HasCard: hasCard}
+	if threshold != nil && amount != nil {
+		settings.Enabled = true
+		settings.Threshold = *threshold
+		settings.Amount = *amount
+	}
+	return settings, nil
+}
+
+func (b *BillingHandler) SetAutoRechargeLogic(input AutoRechargeInput) (*AutoRechargeSettings, error) {
+	settings := input.Settings
+	var threshold, amount *uint64
+	if settings.Enabled {
+		if settings.Amount == 0 {
+			return nil, errors.Join(errors.New("amount must be greater than 0"), shared.ErrBadRequest)
+		}
+		if creditsToCents(settings.Amount) < shared.MinAutoRechargeCents {
+			return nil, errors.Join(fmt.Errorf("amount must be at least $%.2f", float64(shared.MinAutoRechargeCents)/100), shared.ErrBadRequest)
+		}
+		threshold, amount = &settings.Threshold, &settings.Amount
+	}
+
+	_, err := b.WDB.ExecContext(input.Ctx, `
+		UPDATE user SET auto_recharge_threshold = ?, auto_recharge_amount = ? WHERE id = ?
+	`, threshold, amount, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to update auto recharge settings"), err, shared.ErrInternalServerError)
+	}
+	return b.GetAutoRechargeLogic(input)
+}
+
+// RunAutoRecharge charges the saved card of users whose balance dropped below
+// their auto recharge threshold, once every shared.AutoRechargeInterval until
+// ctx is done. Credits are granted by the webhook once the payment succeeds
+func (b *BillingHandler) RunAutoRecharge(ctx context.Context) {
+	if b.Stripe == nil || b.Stripe.SecretKey == "" {
+		return
+	}
+	ticker := time.NewTicker(shared.AutoRechargeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.autoRecharge(ctx)
+		}
+	}
+}
+
+func (b *BillingHandler) autoRecharge(ctx context.Context) {
+	// Organization pools are not topped up automatically yet
+	rows, err := b.WDB.QueryContext(ctx, `
+		SELECT id, auto_recharge_amount, stripe_customer_id, stripe_payment_method_id
+		FROM user
+		WHERE organization_id IS NULL
+		AND auto_recharge_threshold IS NOT NULL
+		AND credits < auto_recharge_threshold
+		AND auto_recharge_amount > 0
+		AND stripe_customer_id IS NOT NULL
+		AND stripe_payment_method_id IS NOT NULL
+		AND (auto_recharge_pending_at IS NULL OR auto_recharge_pending_at < NOW() - INTERVAL 1 HOUR)
+	`)
+	if err != nil {
+		b.Log.Errorw("Failed to query users for auto recharge", "error", err)
+		return
+	}
+	type recharge struct {
+		userID        uint64
+		credits       uint64
+		customerID    string
+		paymentMethod string
+	}
+	var due []recharge
+	for rows.Next() {
+		var r recharge
+		if err := rows.Scan(&r.userID, &r.credits, &r.customerID, &r.paymentMethod); err != nil {
+			continue
+		}
+		due = append(due, r)
+	}
+	_ = rows.Close()
+
+	for _, r := range due {
+		// Claim the recharge so only one instance charges the card
+		res, err := b.WDB.ExecContext(ctx, `
+			UPDATE user SET auto_recharge_pending_at = NOW()
+			WHERE id = ? AND (auto_recharge_pending_at IS NULL OR auto_recharge_pending_at < NOW() - INTERVAL 1 HOUR)
+		`, r.userID)
+		if err != nil {
+			b.Log.Errorw("Failed to claim auto recharge", "error", err, "user_id", r.userID)
+			continue
+		}
+		if claimed, _ := res.RowsAffected(); claimed == 0 {
+			continue
+		}
+		if err := b.createPaymentIntent(ctx, r.userID, r.credits, r.customerID, r.paymentMethod); err != nil {
+			b.Log.Errorw("Failed to create auto recharge payment", "error", err, "user_id", r.userID)
+		}
+	}
+}
+
+func creditsToCents(credits uint64) int64 {
+	return int64(float64(credits) * shared.CreditsToUSD * 100)
+}
+
+func (b *BillingHandler) createPaymentIntent(ctx context.Context, userID uint64, credits uint64, customerID string, paymentMethod string) error {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(creditsToCents(credits), 10))
+	form.Set("currency", "usd")
+	form.Set("customer", customerID)
+	form.Set("payment_method", paymentMethod)
+	form.Set("off_session", "true")
+	form.Set("confirm", "true")
+	form.Set("metadata[user_id]", strconv.FormatUint(userID, 10))
+	form.Set("metadata[auto_recharge]", "true")
+
+	reqCtx, cancel := context.WithTimeout(ctx, shared.StripeRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, "POST", "https://api.stripe.com/v1/payment_intents", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(b.Stripe.SecretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// Retries within the same hour reuse the payment instead of charging twice
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("auto-recharge-%d-%s", userID, time.Now().UTC().Format("2006010215")))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("stripe returned error: [%d: %s]", res.StatusCode, string(body))
+	}
+	return nil
+}
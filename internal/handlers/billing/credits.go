@@ -0,0 +1,214 @@
+// Package billing handles credit purchases and manual credit changes made by
+// staff. Every change writes a credit_ledger row so balances can be audited
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/lifecycle"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type BillingHandler struct {
+	Log         *zap.SugaredLogger
+	WDB         *sql.DB
+	RDB         *sql.DB
+	RedisClient *redis.Client
+	// Nil when payments are not enabled
+	Stripe *StripeConfig
+	// Customers are told of automatic refunds here, nil tells no one
+	Lifecycle *lifecycle.Bus
+}
+
+func NewBillingHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger, stripe *StripeConfig) *BillingHandler {
+	return &BillingHandler{Log: log, WDB: wdb, RDB: rdb, RedisClient: redisClient, Stripe: stripe}
+}
+
+// AdjustCreditsRequest grants credits when Credits is positive and deducts
+// them when negative
+type AdjustCreditsRequest struct {
+	Credits int64  `json:"credits"`
+	Reason  string `json:"reason"`
+}
+
+type RefundRequest struct {
+	Reason string `json:"reason"`
+}
+
+// CreditsInput contains all data needed for credit business logic
+type CreditsInput struct {
+	Ctx       context.Context
+	AdminID   uint64
+	UserID    uint64
+	RequestID string
+	Limit     int
+	Adjust    AdjustCreditsRequest
+	Refund    RefundRequest
+}
+
+// AdjustCreditsLogic grants or deducts credits from the pool a user is charged
+// from. Deducting more than the balance is rejected
+func (b *BillingHandler) AdjustCreditsLogic(input CreditsInput) (*database.LedgerEntry, error) {
+	if input.Adjust.Credits == 0 {
+		return nil, errors.Join(errors.New("credits cannot be 0"), shared.ErrBadRequest)
+	}
+	if strings.TrimSpace(input.Adjust.Reason) == "" {
+		return nil, errors.Join(errors.New("reason is required"), shared.ErrBadRequest)
+	}
+
+	entry := &database.LedgerEntry{
+		UserID:    input.UserID,
+		Kind:      database.LedgerKindGrant,
+		Delta:     input.Adjust.Credits,
+		Reason:    input.Adjust.Reason,
+		CreatedBy: &input.AdminID,
+	}
+	if entry.Delta < 0 {
+		entry.Kind = database.LedgerKindDeduct
+	}
+
+	err := database.ExecuteTransaction(input.Ctx, b.WDB, []func(*sql.Tx) error{
+		func(tx *sql.Tx) error {
+			return lockPool(input.Ctx, tx, entry)
+		},
+		func(tx *sql.Tx) error {
+			balance, err := database.PoolBalance(input.Ctx, tx, entry)
+			if err != nil {
+				return err
+			}
+			if entry.Delta < 0 && balance+entry.Delta < 0 {
+				return errors.Join(errors.New("cannot deduct more than the current balance"), shared.ErrBadRequest)
+			}
+			return database.ApplyLedgerEntry(input.Ctx, tx, entry)
+		},
+	})
+	if err != nil {
+		return nil, ledgerError(err, "failed to adjust credits")
+	}
+
+	if err := database.ClearPoolCache(input.Ctx, b.WDB, b.RedisClient, input.UserID); err != nil {
+		shared.LoggerFromContext(input.Ctx, b.Log).Warnw("Failed to clear user cache", "error", err)
+	}
+	return entry, nil
+}
+
+// RefundRequestLogic returns the credits a request actually took from the
+// pool it was charged from, its share of what its batch debited. Requests paid
+// from plan requests cannot be refunded. Each request can only be refunded once
+func (b *BillingHandler) RefundRequestLogic(input CreditsInput) (*database.LedgerEntry, error) {
+	if strings.TrimSpace(input.Refund.Reason) == "" {
+		return nil, errors.Join(errors.New("reason is required"), shared.ErrBadRequest)
+	}
+
+	var credits uint64
+	var userID uint64
+	var batchID sql.NullString
+	err := b.WDB.QueryRowContext(input.Ctx, `
+		SELECT user_id, COALESCE(credits, 0), batch_id FROM request WHERE request_id = ?
+	`, input.RequestID).Scan(&userID, &credits, &batchID)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("request not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query request"), err, shared.ErrInternalServerError)
+	}
+	if credits == 0 || !batchID.Valid {
+		return nil, errors.Join(errors.New("request was not charged any credits"), shared.ErrBadRequest)
+	}
+
+	requestID := input.RequestID
+	entry := &database.LedgerEntry{
+		UserID:    userID,
+		Kind:      database.LedgerKindRefund,
+		RequestID: &requestID,
+		Reason:    input.Refund.Reason,
+	}
+	// Refunds made by the system have no admin
+	if input.AdminID != 0 {
+		entry.CreatedBy = &input.AdminID
+	}
+
+	err = database.ExecuteTransaction(input.Ctx, b.WDB, []func(*sql.Tx) error{
+		func(tx *sql.Tx) error {
+			return lockPool(input.Ctx, tx, entry)
+		},
+		func(tx *sql.Tx) error {
+			var refunds int
+			err := tx.QueryRowContext(input.Ctx, `
+				SELECT COUNT(*) FROM credit_ledger WHERE request_id = ? AND kind = ?
+			`, requestID, database.LedgerKindRefund).Scan(&refunds)
+			if err != nil {
+				return err
+			}
+			if refunds > 0 {
+				return errors.Join(errors.New("request has already been refunded"), shared.ErrBadRequest)
+			}
+			return nil
+		},
+		func(tx *sql.Tx) error {
+			debited, paidInCredits, err := database.RequestDebit(input.Ctx, tx, batchID.String, credits)
+			if err != nil {
+				return err
+			}
+			if !paidInCredits {
+				return errors.Join(errors.New("request was paid from plan requests and cannot be refunded"), shared.ErrBadRequest)
+			}
+			if debited == 0 {
+				return errors.Join(errors.New("request was not charged any credits"), shared.ErrBadRequest)
+			}
+			entry.Delta = int64(debited)
+			return nil
+		},
+		func(tx *sql.Tx) error {
+			return database.ApplyLedgerEntry(input.Ctx, tx, entry)
+		},
+	})
+	if err != nil {
+		return nil, ledgerError(err, "failed to refund request")
+	}
+
+	if err := database.ClearPoolCache(input.Ctx, b.WDB, b.RedisClient, userID); err != nil {
+		shared.LoggerFromContext(input.Ctx, b.Log).Warnw("Failed to clear user cache", "error", err)
+	}
+	return entry, nil
+}
+
+// lockPool locks the user row for the rest of the transaction and points
+// entry at the pool the user is charged from, their organizations when they
+// belong to one
+func lockPool(ctx context.Context, tx *sql.Tx, entry *database.LedgerEntry) error {
+	var organizationID sql.NullInt64
+	err := tx.QueryRowContext(ctx, "SELECT organization_id FROM user WHERE id = ? FOR UPDATE", entry.UserID).Scan(&organizationID)
+	if err != nil {
+		return err
+	}
+	if organizationID.Valid {
+		id := uint64(organizationID.Int64)
+		entry.OrganizationID = &id
+	}
+	return nil
+}
+
+// ledgerError keeps bad request and not found errors raised inside a ledger
+// transaction, everything else is an internal error
+func ledgerError(err error, msg string) error {
+	switch {
+	case errors.Is(err, shared.ErrBadRequest):
+		// Drop the transaction wrapping so the message reaches the client
+		if inner := errors.Unwrap(err); inner != nil {
+			return inner
+		}
+		return err
+	case errors.Is(err, sql.ErrNoRows):
+		return errors.Join(errors.New("user not found"), shared.ErrNotFound)
+	default:
+		return errors.Join(errors.New(msg), err, shared.ErrInternalServerError)
+	}
+}
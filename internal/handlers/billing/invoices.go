@@ -0,0 +1,63 @@
+package billing
+
+import (
+	"context"
+	"errors"
+
+	"sybil-api/internal/shared"
+)
+
+// Invoice summarizes one calendar month of spend from daily_stats
+type Invoice struct {
+	Month        string  `json:"month"`
+	Requests     uint64  `json:"requests"`
+	InputTokens  uint64  `json:"input_tokens"`
+	OutputTokens uint64  `json:"output_tokens"`
+	Credits      uint64  `json:"credits"`
+	Cost         float64 `json:"cost"`
+	// Share of Requests and Credits served on reserved capacity
+	ReservedRequests uint64 `json:"reserved_requests"`
+	ReservedCredits  uint64 `json:"reserved_credits"`
+}
+
+type InvoicesInput struct {
+	Ctx  context.Context
+	User shared.UserMetadata
+}
+
+// InvoicesLogic returns monthly spend, newest first. Organization owners see
+// the spend of every member since they share the credit pool
+func (b *BillingHandler) InvoicesLogic(input InvoicesInput) ([]Invoice, error) {
+	filter, args := "user_id = ?", []any{input.User.UserID}
+	if input.User.OrganizationID != 0 && input.User.OrganizationRole == shared.OrganizationRoleOwner {
+		filter, args = "user_id IN (SELECT id FROM user WHERE organization_id = ?)", []any{input.User.OrganizationID}
+	}
+
+	rows, err := b.RDB.QueryContext(input.Ctx, `
+		SELECT DATE_FORMAT(date, '%Y-%m') AS month, SUM(request_count), SUM(input_tokens), SUM(output_tokens), SUM(total_spend),
+			SUM(reserved_requests), SUM(reserved_spend)
+		FROM daily_stats
+		WHERE `+filter+`
+		GROUP BY month
+		ORDER BY month DESC
+		LIMIT ?
+	`, append(args, shared.MaxInvoiceMonths)...)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query invoices"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	invoices := []Invoice{}
+	for rows.Next() {
+		var invoice Invoice
+		if err := rows.Scan(&invoice.Month, &invoice.Requests, &invoice.InputTokens, &invoice.OutputTokens, &invoice.Credits,
+			&invoice.ReservedRequests, &invoice.ReservedCredits); err != nil {
+			return nil, errors.Join(errors.New("failed to scan invoice"), err, shared.ErrInternalServerError)
+		}
+		invoice.Cost = float64(invoice.Credits) * shared.CreditsToUSD
+		invoices = append(invoices, invoice)
+	}
+	return invoices, nil
+}
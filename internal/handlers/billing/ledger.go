@@ -0,0 +1,83 @@
+package billing
+
+import (
+	"database/sql"
+	"errors"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/shared"
+)
+
+// LedgerReport is a users recent ledger history along with a reconciliation of
+// their materialized balance against the ledger total
+type LedgerReport struct {
+	UserID         uint64                 `json:"user_id"`
+	OrganizationID *uint64                `json:"organization_id,omitempty"`
+	Balance        int64                  `json:"balance"`
+	LedgerTotal    int64                  `json:"ledger_total"`
+	Drift          int64                  `json:"drift"`
+	Entries        []database.LedgerEntry `json:"entries"`
+}
+
+// LedgerLogic returns the latest ledger entries for a user and compares the
+// balance of the pool they spend from with the sum of its ledger. Drift is the
+// part of the balance the ledger does not explain, such as credits granted
+// before the ledger existed
+func (b *BillingHandler) LedgerLogic(input CreditsInput) (*LedgerReport, error) {
+	limit := input.Limit
+	if limit <= 0 || limit > shared.MaxLedgerEntries {
+		limit = shared.MaxLedgerEntries
+	}
+
+	var organizationID sql.NullInt64
+	err := b.WDB.QueryRowContext(input.Ctx, "SELECT organization_id FROM user WHERE id = ?", input.UserID).Scan(&organizationID)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("user not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query user"), err, shared.ErrInternalServerError)
+	}
+
+	report := &LedgerReport{UserID: input.UserID, Entries: []database.LedgerEntry{}}
+	pool, poolFilter, poolID := "user", "user_id = ? AND organization_id IS NULL", int64(input.UserID)
+	if organizationID.Valid {
+		id := uint64(organizationID.Int64)
+		report.OrganizationID = &id
+		pool, poolFilter, poolID = "organization", "organization_id = ?", organizationID.Int64
+	}
+
+	err = b.WDB.QueryRowContext(input.Ctx, "SELECT credits FROM "+pool+" WHERE id = ?", poolID).Scan(&report.Balance)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query balance"), err, shared.ErrInternalServerError)
+	}
+	err = b.WDB.QueryRowContext(input.Ctx, "SELECT COALESCE(SUM(delta), 0) FROM credit_ledger WHERE "+poolFilter, poolID).Scan(&report.LedgerTotal)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to sum ledger"), err, shared.ErrInternalServerError)
+	}
+	report.Drift = report.Balance - report.LedgerTotal
+
+	rows, err := b.WDB.QueryContext(input.Ctx, `
+		SELECT id, user_id, organization_id, kind, delta, balance_after, request_id, batch_id, external_id, reason, created_by,
+			DATE_FORMAT(created_at, '%Y-%m-%dT%H:%i:%sZ')
+		FROM credit_ledger
+		WHERE `+poolFilter+`
+		ORDER BY id DESC
+		LIMIT ?
+	`, poolID, limit)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query ledger"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var entry database.LedgerEntry
+		if err := rows.Scan(&entry.ID, &entry.UserID, &entry.OrganizationID, &entry.Kind, &entry.Delta, &entry.BalanceAfter,
+			&entry.RequestID, &entry.BatchID, &entry.ExternalID, &entry.Reason, &entry.CreatedBy, &entry.CreatedAt); err != nil {
+			return nil, errors.Join(errors.New("failed to scan ledger entry"), err, shared.ErrInternalServerError)
+		}
+		report.Entries = append(report.Entries, entry)
+	}
+	return report, nil
+}
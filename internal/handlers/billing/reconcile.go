@@ -0,0 +1,130 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/lifecycle"
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// AutoRefundAuditAction is the admin_audit_log action of each reconciliation
+// run that refunded requests
+const AutoRefundAuditAction = "credits.auto_refund"
+
+// RunRefundReconciliation refunds billed requests the model did not complete,
+// once every shared.RefundReconcileInterval until ctx is done. Requests are
+// picked up once they are shared.RefundReconcileDelay old so the usage bucket
+// that charged them has been flushed
+func (b *BillingHandler) RunRefundReconciliation(ctx context.Context) {
+	ticker := time.NewTicker(shared.RefundReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.reconcileRefunds(ctx)
+		}
+	}
+}
+
+type failedRequest struct {
+	requestID string
+	userID    uint64
+	modelID   uint64
+	endpoint  string
+}
+
+func (b *BillingHandler) reconcileRefunds(ctx context.Context) {
+	ok, err := b.RedisClient.SetNX(ctx, "sybil:v1:billing:reconcile", 1, shared.RefundReconcileInterval/2).Result()
+	if err != nil || !ok {
+		return
+	}
+
+	// Canceled requests are billed for what they used and never saved as
+	// rows, so every incomplete row failed on our side. Only batches that
+	// debited credits past any write off have anything to give back, plan
+	// paid batches are left alone
+	rows, err := b.WDB.QueryContext(ctx, `
+		SELECT request.request_id, request.user_id, request.model_id, request.endpoint
+		FROM request
+		WHERE request.completed = false AND request.credits > 0 AND request.byok = false
+			AND request.created_at >= NOW() - INTERVAL ? SECOND
+			AND request.created_at < NOW() - INTERVAL ? SECOND
+			AND NOT EXISTS (
+				SELECT 1 FROM credit_ledger
+				WHERE credit_ledger.request_id = request.request_id AND credit_ledger.kind = ?
+			)
+			AND (
+				SELECT COALESCE(SUM(-credit_ledger.delta), 0) FROM credit_ledger
+				WHERE credit_ledger.batch_id = request.batch_id AND credit_ledger.kind IN (?, ?)
+			) > 0
+		ORDER BY request.created_at ASC
+		LIMIT ?
+	`, int64(shared.RefundReconcileLookback.Seconds()), int64(shared.RefundReconcileDelay.Seconds()),
+		database.LedgerKindRefund, database.LedgerKindCharge, database.LedgerKindWriteOff, shared.RefundReconcileBatchSize)
+	if err != nil {
+		b.Log.Errorw("Failed to query failed requests for refund", "error", err)
+		return
+	}
+	var failed []failedRequest
+	for rows.Next() {
+		var r failedRequest
+		if err := rows.Scan(&r.requestID, &r.userID, &r.modelID, &r.endpoint); err != nil {
+			continue
+		}
+		failed = append(failed, r)
+	}
+	_ = rows.Close()
+	if len(failed) == 0 {
+		return
+	}
+
+	var refunded, credits uint64
+	for _, r := range failed {
+		entry, err := b.RefundRequestLogic(CreditsInput{
+			Ctx:       ctx,
+			RequestID: r.requestID,
+			Refund:    RefundRequest{Reason: "Automatic refund: the model did not complete the request"},
+		})
+		if err != nil {
+			// Refunded by staff since the query, or the debited share rounds
+			// down to nothing
+			if errors.Is(err, shared.ErrBadRequest) {
+				continue
+			}
+			metrics.AutoRefunds.WithLabelValues("error").Inc()
+			b.Log.Warnw("Failed to refund failed request", "error", err, "request_id", r.requestID)
+			continue
+		}
+		metrics.AutoRefunds.WithLabelValues("refunded").Inc()
+		refunded++
+		credits += uint64(entry.Delta)
+		b.Lifecycle.Emit(lifecycle.Event{
+			Type:      lifecycle.TypeRefunded,
+			RequestID: r.requestID,
+			UserID:    r.userID,
+			ModelID:   r.modelID,
+			Endpoint:  r.endpoint,
+			Credits:   uint64(entry.Delta),
+		})
+	}
+	if refunded == 0 {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]uint64{"requests": refunded, "credits": credits})
+	_, err = b.WDB.ExecContext(ctx, `
+		INSERT INTO admin_audit_log (user_id, role, action, params, body, request_id, status_code)
+		VALUES (NULL, 'SYSTEM', ?, '{}', ?, '', 200)
+	`, AutoRefundAuditAction, string(body))
+	if err != nil {
+		b.Log.Errorw("Failed to write auto refund audit log", "error", err)
+	}
+	b.Log.Infow("Refunded failed requests", "requests", refunded, "credits", credits)
+}
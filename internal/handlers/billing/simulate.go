@@ -0,0 +1,176 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/shared"
+)
+
+// SimulateRequest is the usage to bill in a simulation. Pricing is looked up
+// for Model as it was at At, and any of ICPT, OCPT and CRC override it
+type SimulateRequest struct {
+	Model            string     `json:"model"`
+	UserID           uint64     `json:"user_id,omitempty"`
+	PromptTokens     uint64     `json:"prompt_tokens"`
+	CompletionTokens uint64     `json:"completion_tokens"`
+	Canceled         bool       `json:"canceled"`
+	BYOK             bool       `json:"byok"`
+	At               *time.Time `json:"at,omitempty"`
+	ICPT             *uint64    `json:"icpt,omitempty"`
+	OCPT             *uint64    `json:"ocpt,omitempty"`
+	CRC              *uint64    `json:"crc,omitempty"`
+	// Requests in the bucket the usage is flushed with, 1 when unset
+	Requests uint               `json:"requests"`
+	Pool     database.PoolState `json:"pool"`
+}
+
+// Simulation is how a request with the simulated usage is billed
+type Simulation struct {
+	Model            string              `json:"model"`
+	ModelID          uint64              `json:"model_id"`
+	At               time.Time           `json:"at"`
+	ICPT             uint64              `json:"icpt"`
+	OCPT             uint64              `json:"ocpt"`
+	CRC              uint64              `json:"crc"`
+	PriceMultiplier  float64             `json:"price_multiplier"`
+	Credits          uint64              `json:"credits"`
+	CreditsToUSD     float64             `json:"credits_usd"`
+	BYOKRoutingFee   uint64              `json:"byok_routing_fee,omitempty"`
+	RequestsFlushed  uint                `json:"requests_flushed"`
+	Settlement       database.Settlement `json:"settlement"`
+	PricingOverrides []string            `json:"pricing_overrides,omitempty"`
+}
+
+type SimulateInput struct {
+	Ctx context.Context
+	Req SimulateRequest
+}
+
+type simulatedPricing struct {
+	modelID        uint64
+	icpt           uint64
+	ocpt           uint64
+	crc            uint64
+	offPeak        []shared.OffPeakWindow
+	byokRoutingFee uint64
+}
+
+// SimulateLogic bills the usage in input the way a finished request and the
+// flush of its bucket would, through shared.CalculateCredits and
+// database.SettleCharge. Nothing is written
+func (b *BillingHandler) SimulateLogic(input SimulateInput) (*Simulation, error) {
+	req := input.Req
+	if req.Model == "" {
+		return nil, errors.Join(errors.New("model is required"), shared.ErrBadRequest)
+	}
+	at := time.Now()
+	if req.At != nil {
+		at = *req.At
+	}
+	requests := req.Requests
+	if requests == 0 {
+		requests = 1
+	}
+
+	pricing, err := b.simulatedPricing(input.Ctx, req.Model, req.UserID, at)
+	if err != nil {
+		return nil, err
+	}
+	sim := &Simulation{
+		Model:           req.Model,
+		ModelID:         pricing.modelID,
+		At:              at,
+		ICPT:            pricing.icpt,
+		OCPT:            pricing.ocpt,
+		CRC:             pricing.crc,
+		RequestsFlushed: requests,
+	}
+	if req.ICPT != nil {
+		sim.ICPT = *req.ICPT
+		sim.PricingOverrides = append(sim.PricingOverrides, "icpt")
+	}
+	if req.OCPT != nil {
+		sim.OCPT = *req.OCPT
+		sim.PricingOverrides = append(sim.PricingOverrides, "ocpt")
+	}
+	if req.CRC != nil {
+		sim.CRC = *req.CRC
+		sim.PricingOverrides = append(sim.PricingOverrides, "crc")
+	}
+
+	usage := &shared.Usage{
+		PromptTokens:     req.PromptTokens,
+		CompletionTokens: req.CompletionTokens,
+		TotalTokens:      req.PromptTokens + req.CompletionTokens,
+		IsCanceled:       req.Canceled,
+	}
+	sim.PriceMultiplier = shared.OffPeakMultiplier(pricing.offPeak, at)
+	sim.Credits = shared.CalculateCredits(usage, sim.ICPT, sim.OCPT, sim.CRC, sim.PriceMultiplier)
+	if req.BYOK {
+		sim.BYOKRoutingFee = pricing.byokRoutingFee
+		if sim.BYOKRoutingFee == 0 {
+			sim.BYOKRoutingFee = shared.DefaultBYOKRoutingFee
+		}
+		sim.Credits = sim.BYOKRoutingFee
+	}
+	sim.CreditsToUSD = float64(sim.Credits) * shared.CreditsToUSD
+
+	// Every request of the bucket is assumed to cost the same
+	sim.Settlement = database.SettleCharge(req.Pool, requests, sim.Credits*uint64(requests))
+	return sim, nil
+}
+
+// simulatedPricing is the pricing discovery would have served for model at
+// at, including LoRA overrides and scheduled prices
+func (b *BillingHandler) simulatedPricing(ctx context.Context, model string, userID uint64, at time.Time) (*simulatedPricing, error) {
+	var pricing simulatedPricing
+	var metadataJSON sql.NullString
+	err := b.RDB.QueryRowContext(ctx, `
+		SELECT
+			model.id,
+			COALESCE(lora_adapter.icpt, model_price.icpt, model.icpt),
+			COALESCE(lora_adapter.ocpt, model_price.ocpt, model.ocpt),
+			COALESCE(lora_adapter.crc, model_price.crc, model.crc),
+			model.metadata
+		FROM model_registry
+		INNER JOIN model ON model_registry.model_id = model.id
+		LEFT JOIN lora_adapter ON lora_adapter.model_id = model.id
+			AND lora_adapter.name = model_registry.model_name
+			AND lora_adapter.active = true
+		LEFT JOIN model_price ON model_price.id = (
+			SELECT scheduled.id FROM model_price AS scheduled
+			WHERE scheduled.model_id = model.id AND scheduled.canceled_at IS NULL AND scheduled.effective_at <= ?
+			ORDER BY scheduled.effective_at DESC, scheduled.id DESC
+			LIMIT 1
+		)
+		WHERE model_registry.model_name = ?
+		AND (model.allowed_user_id = ? OR model.allowed_user_id IS NULL)
+		AND (lora_adapter.allowed_user_id = ? OR lora_adapter.allowed_user_id IS NULL)
+		ORDER BY model.allowed_user_id DESC
+		LIMIT 1
+	`, at, model, userID, userID).Scan(&pricing.modelID, &pricing.icpt, &pricing.ocpt, &pricing.crc, &metadataJSON)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("model not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query model pricing"), err, shared.ErrInternalServerError)
+	}
+
+	if metadataJSON.Valid && metadataJSON.String != "" {
+		var metadata struct {
+			BYOKRoutingFee uint64                 `json:"byok_routing_fee"`
+			OffPeak        []shared.OffPeakWindow `json:"off_peak"`
+		}
+		if err := json.Unmarshal([]byte(metadataJSON.String), &metadata); err != nil {
+			b.Log.Warnw("Failed to unmarshal model metadata", "error", err, "model_name", model)
+		}
+		pricing.byokRoutingFee = metadata.BYOKRoutingFee
+		pricing.offPeak = metadata.OffPeak
+	}
+	return &pricing, nil
+}
@@ -0,0 +1,204 @@
+package billing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/shared"
+)
+
+type StripeConfig struct {
+	SecretKey     string
+	WebhookSecret string
+}
+
+type stripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object stripePaymentIntent `json:"object"`
+	} `json:"data"`
+}
+
+type stripePaymentIntent struct {
+	ID             string            `json:"id"`
+	Amount         int64             `json:"amount"`
+	AmountReceived int64             `json:"amount_received"`
+	Currency       string            `json:"currency"`
+	Customer       string            `json:"customer"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+type StripeWebhookInput struct {
+	Ctx       context.Context
+	Payload   []byte
+	Signature string
+}
+
+// StripeWebhookLogic verifies a Stripe webhook and grants credits for
+// successful payments. Stripe retries deliveries, so a payment that already
+// has a ledger entry is acknowledged without granting again
+func (b *BillingHandler) StripeWebhookLogic(input StripeWebhookInput) (*database.LedgerEntry, error) {
+	log := shared.LoggerFromContext(input.Ctx, b.Log)
+	if b.Stripe == nil || b.Stripe.WebhookSecret == "" {
+		return nil, errors.Join(errors.New("stripe is not configured"), shared.ErrNotFound)
+	}
+	if err := verifyStripeSignature(input.Payload, input.Signature, b.Stripe.WebhookSecret, time.Now()); err != nil {
+		return nil, errors.Join(errors.New("invalid stripe signature"), err, shared.ErrBadRequest)
+	}
+
+	var event stripeEvent
+	if err := json.Unmarshal(input.Payload, &event); err != nil {
+		return nil, errors.Join(errors.New("invalid stripe event"), err, shared.ErrBadRequest)
+	}
+	// Checkout sessions also emit payment_intent.succeeded, so only that
+	// event grants credits
+	if event.Type != "payment_intent.succeeded" {
+		return nil, nil
+	}
+
+	intent := event.Data.Object
+	if !strings.EqualFold(intent.Currency, "usd") {
+		log.Warnw("Ignoring stripe payment in unsupported currency", "payment_intent", intent.ID, "currency", intent.Currency)
+		return nil, nil
+	}
+	userID, err := b.stripeUserID(input.Ctx, intent)
+	if err != nil {
+		return nil, err
+	}
+
+	paymentID := intent.ID
+	reason := "stripe payment"
+	if intent.Metadata["auto_recharge"] == "true" {
+		reason = "stripe auto recharge"
+	}
+	entry := &database.LedgerEntry{
+		UserID:     userID,
+		Kind:       database.LedgerKindPurchase,
+		Delta:      centsToCredits(intent.AmountReceived),
+		ExternalID: &paymentID,
+		Reason:     reason,
+	}
+
+	duplicate := false
+	err = database.ExecuteTransaction(input.Ctx, b.WDB, []func(*sql.Tx) error{
+		// Concurrent deliveries of the same payment wait on the user row
+		// here, so the later one sees the earlier grant
+		func(tx *sql.Tx) error {
+			return lockPool(input.Ctx, tx, entry)
+		},
+		func(tx *sql.Tx) error {
+			var existing int
+			err := tx.QueryRowContext(input.Ctx, "SELECT COUNT(*) FROM credit_ledger WHERE external_id = ?", paymentID).Scan(&existing)
+			if err != nil {
+				return err
+			}
+			duplicate = existing > 0
+			return nil
+		},
+		func(tx *sql.Tx) error {
+			if duplicate {
+				return nil
+			}
+			return database.ApplyLedgerEntry(input.Ctx, tx, entry)
+		},
+		func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(input.Ctx, "UPDATE user SET auto_recharge_pending_at = NULL WHERE id = ?", userID)
+			return err
+		},
+	})
+	// With a unique key on credit_ledger.external_id, a duplicate that got
+	// past the check is also treated as already granted
+	if database.IsDuplicateKey(err) {
+		duplicate, err = true, nil
+	}
+	if err != nil {
+		return nil, ledgerError(err, "failed to grant stripe payment")
+	}
+	if duplicate {
+		log.Infow("Stripe payment already granted", "payment_intent", paymentID)
+		return nil, nil
+	}
+
+	if err := database.ClearPoolCache(input.Ctx, b.WDB, b.RedisClient, userID); err != nil {
+		log.Warnw("Failed to clear user cache", "error", err)
+	}
+	log.Infow("Granted credits for stripe payment", "payment_intent", paymentID, "user_id", userID, "credits", entry.Delta)
+	return entry, nil
+}
+
+// stripeUserID finds the user a payment belongs to, from the payment metadata
+// or the stripe customer linked to the user
+func (b *BillingHandler) stripeUserID(ctx context.Context, intent stripePaymentIntent) (uint64, error) {
+	if raw := intent.Metadata["user_id"]; raw != "" {
+		userID, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return 0, errors.Join(errors.New("invalid user_id in payment metadata"), shared.ErrBadRequest)
+		}
+		return userID, nil
+	}
+	if intent.Customer == "" {
+		return 0, errors.Join(errors.New("payment has no user or customer"), shared.ErrBadRequest)
+	}
+	var userID uint64
+	err := b.WDB.QueryRowContext(ctx, "SELECT id FROM user WHERE stripe_customer_id = ?", intent.Customer).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errors.Join(errors.New("no user for stripe customer"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return 0, errors.Join(errors.New("failed to query stripe customer"), err, shared.ErrInternalServerError)
+	}
+	return userID, nil
+}
+
+// verifyStripeSignature checks the Stripe-Signature header, which holds a
+// timestamp and one or more v1 HMAC signatures of "timestamp.payload"
+func verifyStripeSignature(payload []byte, header string, secret string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return errors.New("missing timestamp or signature")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	if now.Sub(time.Unix(ts, 0)).Abs() > shared.StripeWebhookTolerance {
+		return errors.New("timestamp outside tolerance")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, sig := range signatures {
+		decoded, err := hex.DecodeString(sig)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return errors.New("no matching signature")
+}
+
+func centsToCredits(cents int64) int64 {
+	return int64(float64(cents) / 100 / shared.CreditsToUSD)
+}
@@ -0,0 +1,231 @@
+// Package budget manages spend caps and alert thresholds for users and api
+// keys
+package budget
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type BudgetHandler struct {
+	Log         *zap.SugaredLogger
+	WDB         *sql.DB
+	RDB         *sql.DB
+	RedisClient *redis.Client
+}
+
+func NewBudgetHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger) *BudgetHandler {
+	return &BudgetHandler{Log: log, WDB: wdb, RDB: rdb, RedisClient: redisClient}
+}
+
+type Budget struct {
+	ID              uint64   `json:"id"`
+	APIKeyID        *string  `json:"api_key_id"`
+	Period          string   `json:"period"`
+	CapCredits      uint64   `json:"cap_credits"`
+	AlertThresholds []uint64 `json:"alert_thresholds"`
+	WebhookURL      *string  `json:"webhook_url"`
+	SpentCredits    uint64   `json:"spent_credits"`
+	PeriodStart     string   `json:"period_start"`
+}
+
+// SetBudgetRequest creates or replaces the budget for a period. Budgets apply
+// to all of the users keys unless APIKeyID, the public id of one of the keys,
+// is set. A cap of 0 only alerts
+type SetBudgetRequest struct {
+	APIKeyID        *string  `json:"api_key_id,omitempty"`
+	Period          string   `json:"period"`
+	CapCredits      uint64   `json:"cap_credits"`
+	AlertThresholds []uint64 `json:"alert_thresholds"`
+	WebhookURL      *string  `json:"webhook_url,omitempty"`
+}
+
+// BudgetInput contains all data needed for budget business logic
+type BudgetInput struct {
+	Ctx      context.Context
+	UserID   uint64
+	BudgetID uint64
+	Req      *SetBudgetRequest
+}
+
+func validateBudget(ctx context.Context, req *SetBudgetRequest) error {
+	if req == nil {
+		return errors.Join(errors.New("request body is required"), shared.ErrBadRequest)
+	}
+	if req.Period != shared.BudgetPeriodMonthly && req.Period != shared.BudgetPeriodWeekly {
+		return errors.Join(errors.New("period must be MONTHLY or WEEKLY"), shared.ErrBadRequest)
+	}
+	if len(req.AlertThresholds) > shared.BudgetMaxThresholds {
+		return errors.Join(fmt.Errorf("alert_thresholds cannot have more than %d entries", shared.BudgetMaxThresholds), shared.ErrBadRequest)
+	}
+	for _, threshold := range req.AlertThresholds {
+		if threshold == 0 || threshold > 100 {
+			return errors.Join(errors.New("alert_thresholds must be percentages between 1 and 100"), shared.ErrBadRequest)
+		}
+	}
+	if len(req.AlertThresholds) > 0 && req.CapCredits == 0 {
+		return errors.Join(errors.New("cap_credits is required for alert_thresholds"), shared.ErrBadRequest)
+	}
+	if req.WebhookURL != nil {
+		if err := shared.ValidateWebhookURL(ctx, *req.WebhookURL); err != nil {
+			return errors.Join(err, shared.ErrBadRequest)
+		}
+	}
+	return nil
+}
+
+// SetBudgetLogic creates or replaces the budget for the scope and period.
+// Spend so far in the current period is kept
+func (b *BudgetHandler) SetBudgetLogic(input BudgetInput) (*Budget, error) {
+	if err := validateBudget(input.Ctx, input.Req); err != nil {
+		return nil, err
+	}
+	req := input.Req
+	if req.APIKeyID != nil {
+		var keyUserID uint64
+		err := b.RDB.QueryRowContext(input.Ctx, "SELECT user_id FROM api_key WHERE public_id = ?", *req.APIKeyID).Scan(&keyUserID)
+		if err != nil || keyUserID != input.UserID {
+			return nil, errors.Join(errors.New("api key not found"), shared.ErrNotFound)
+		}
+	}
+	if req.AlertThresholds == nil {
+		req.AlertThresholds = []uint64{}
+	}
+	thresholdsJSON, err := json.Marshal(req.AlertThresholds)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal alert thresholds"), err, shared.ErrInternalServerError)
+	}
+
+	var budgetID uint64
+	err = b.WDB.QueryRowContext(input.Ctx, `
+		SELECT id FROM budget
+		WHERE user_id = ? AND api_key_id <=> ? AND period = ? AND active = true
+	`, input.UserID, req.APIKeyID, req.Period).Scan(&budgetID)
+	switch err {
+	case nil:
+		_, err = b.WDB.ExecContext(input.Ctx, `
+			UPDATE budget SET cap_credits = ?, alert_thresholds = ?, webhook_url = ?, last_alert_threshold = 0
+			WHERE id = ?
+		`, req.CapCredits, string(thresholdsJSON), req.WebhookURL, budgetID)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to update budget"), err, shared.ErrInternalServerError)
+		}
+	case sql.ErrNoRows:
+		res, err := b.WDB.ExecContext(input.Ctx, `
+			INSERT INTO budget (user_id, api_key_id, period, cap_credits, alert_thresholds, webhook_url, spent_credits, period_start, last_alert_threshold, active)
+			VALUES (?, ?, ?, ?, ?, ?, 0, ?, 0, true)
+		`, input.UserID, req.APIKeyID, req.Period, req.CapCredits, string(thresholdsJSON), req.WebhookURL,
+			shared.BudgetPeriodStart(req.Period, time.Now()).Format(time.DateOnly))
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to insert budget"), err, shared.ErrInternalServerError)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to get budget id"), err, shared.ErrInternalServerError)
+		}
+		budgetID = uint64(id)
+	default:
+		return nil, errors.Join(errors.New("failed to query budget"), err, shared.ErrInternalServerError)
+	}
+
+	b.clearBudgetCache(input.Ctx, input.UserID)
+	return b.getBudget(input.Ctx, input.UserID, budgetID)
+}
+
+// ListBudgetsLogic returns the users active budgets
+func (b *BudgetHandler) ListBudgetsLogic(input BudgetInput) ([]Budget, error) {
+	log := shared.LoggerFromContext(input.Ctx, b.Log)
+	rows, err := b.RDB.QueryContext(input.Ctx, `
+		SELECT id, api_key_id, period, cap_credits, alert_thresholds, webhook_url, spent_credits, DATE_FORMAT(period_start, '%Y-%m-%d')
+		FROM budget
+		WHERE user_id = ? AND active = true
+		ORDER BY id ASC
+	`, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query budgets"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	budgets := []Budget{}
+	for rows.Next() {
+		budget, err := scanBudget(rows)
+		if err != nil {
+			log.Warnw("Failed to scan budget row", "error", err)
+			continue
+		}
+		budgets = append(budgets, *budget)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating budget rows"), err, shared.ErrInternalServerError)
+	}
+	return budgets, nil
+}
+
+// DeleteBudgetLogic stops a budget from being enforced
+func (b *BudgetHandler) DeleteBudgetLogic(input BudgetInput) error {
+	res, err := b.WDB.ExecContext(input.Ctx, `
+		UPDATE budget SET active = false WHERE id = ? AND user_id = ? AND active = true
+	`, input.BudgetID, input.UserID)
+	if err != nil {
+		return errors.Join(errors.New("failed to delete budget"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return errors.Join(errors.New("budget not found"), shared.ErrNotFound)
+	}
+	b.clearBudgetCache(input.Ctx, input.UserID)
+	return nil
+}
+
+func (b *BudgetHandler) getBudget(ctx context.Context, userID uint64, budgetID uint64) (*Budget, error) {
+	row := b.WDB.QueryRowContext(ctx, `
+		SELECT id, api_key_id, period, cap_credits, alert_thresholds, webhook_url, spent_credits, DATE_FORMAT(period_start, '%Y-%m-%d')
+		FROM budget
+		WHERE id = ? AND user_id = ?
+	`, budgetID, userID)
+	budget, err := scanBudget(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("budget not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query budget"), err, shared.ErrInternalServerError)
+	}
+	return budget, nil
+}
+
+func scanBudget(row interface{ Scan(...any) error }) (*Budget, error) {
+	var budget Budget
+	var thresholdsJSON string
+	if err := row.Scan(&budget.ID, &budget.APIKeyID, &budget.Period, &budget.CapCredits, &thresholdsJSON,
+		&budget.WebhookURL, &budget.SpentCredits, &budget.PeriodStart); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(thresholdsJSON), &budget.AlertThresholds); err != nil {
+		return nil, err
+	}
+	return &budget, nil
+}
+
+// clearBudgetCache drops the cached budgets for every api key of the user
+func (b *BudgetHandler) clearBudgetCache(ctx context.Context, userID uint64) {
+	pattern := fmt.Sprintf("sybil:v1:budget:%d:*", userID)
+	iter := b.RedisClient.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		if err := b.RedisClient.Del(ctx, iter.Val()).Err(); err != nil {
+			b.Log.Warnw("Failed to clear budget cache", "error", err, "key", iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		b.Log.Warnw("Failed to scan budget cache", "error", err, "user_id", userID)
+	}
+}
@@ -0,0 +1,227 @@
+// Package capacity manages committed use reservations, where a customer pays
+// a monthly fee to hold concurrent slots on a model
+package capacity
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type CapacityHandler struct {
+	Log         *zap.SugaredLogger
+	WDB         *sql.DB
+	RDB         *sql.DB
+	RedisClient *redis.Client
+}
+
+func NewCapacityHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger) *CapacityHandler {
+	return &CapacityHandler{Log: log, WDB: wdb, RDB: rdb, RedisClient: redisClient}
+}
+
+type Reservation struct {
+	ID      uint64 `json:"id"`
+	UserID  uint64 `json:"user_id"`
+	ModelID uint64 `json:"model_id"`
+	Model   string `json:"model"`
+	Slots   uint64 `json:"slots"`
+	// Credits invoiced per month, independent of usage
+	MonthlyFee uint64  `json:"monthly_fee"`
+	StartsAt   int64   `json:"starts_at"`
+	EndsAt     *int64  `json:"ends_at"`
+	CreatedBy  uint64  `json:"created_by"`
+	CreatedAt  int64   `json:"created_at"`
+	CanceledAt *int64  `json:"canceled_at"`
+	Active     bool    `json:"active"`
+	MonthlyUSD float64 `json:"monthly_usd"`
+}
+
+// CreateReservationRequest reserves Slots concurrent requests on Model for
+// UserID. StartsAt and EndsAt are unix timestamps, an unset start takes effect
+// immediately and an unset end runs until canceled
+type CreateReservationRequest struct {
+	UserID     uint64 `json:"user_id"`
+	Model      string `json:"model"`
+	Slots      uint64 `json:"slots"`
+	MonthlyFee uint64 `json:"monthly_fee"`
+	StartsAt   *int64 `json:"starts_at,omitempty"`
+	EndsAt     *int64 `json:"ends_at,omitempty"`
+}
+
+// ReservationInput contains all data needed for the reservation business
+// logic
+type ReservationInput struct {
+	Ctx           context.Context
+	AdminID       uint64
+	UserID        uint64
+	ReservationID uint64
+	Req           CreateReservationRequest
+}
+
+const reservationColumns = `capacity_reservation.id, capacity_reservation.user_id, capacity_reservation.model_id, model.name,
+	capacity_reservation.slots, capacity_reservation.monthly_fee,
+	UNIX_TIMESTAMP(capacity_reservation.starts_at), UNIX_TIMESTAMP(capacity_reservation.ends_at),
+	capacity_reservation.created_by, UNIX_TIMESTAMP(capacity_reservation.created_at),
+	UNIX_TIMESTAMP(capacity_reservation.canceled_at)`
+
+// CreateReservationLogic records a reservation. Models with a known
+// concurrency limit cannot have more slots reserved than they serve, counting
+// every reservation that overlaps the new one
+func (h *CapacityHandler) CreateReservationLogic(input ReservationInput) (*Reservation, error) {
+	req := input.Req
+	if req.UserID == 0 {
+		return nil, errors.Join(errors.New("user_id is required"), shared.ErrBadRequest)
+	}
+	if req.Slots == 0 {
+		return nil, errors.Join(errors.New("slots must be positive"), shared.ErrBadRequest)
+	}
+	now := time.Now().Unix()
+	startsAt := now
+	if req.StartsAt != nil {
+		startsAt = max(*req.StartsAt, now)
+	}
+	if req.EndsAt != nil && *req.EndsAt <= startsAt {
+		return nil, errors.Join(errors.New("ends_at must be after starts_at"), shared.ErrBadRequest)
+	}
+
+	var modelID uint64
+	var maxConcurrency sql.NullInt64
+	err := h.RDB.QueryRowContext(input.Ctx, `
+		SELECT id, CAST(JSON_EXTRACT(metadata, '$.max_concurrency') AS UNSIGNED)
+		FROM model WHERE name = ? AND enabled = true
+	`, req.Model).Scan(&modelID, &maxConcurrency)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("model not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find model"), err, shared.ErrInternalServerError)
+	}
+
+	var reserved uint64
+	err = h.WDB.QueryRowContext(input.Ctx, `
+		SELECT COALESCE(SUM(slots), 0) FROM capacity_reservation
+		WHERE model_id = ? AND canceled_at IS NULL
+		AND (ends_at IS NULL OR ends_at > FROM_UNIXTIME(?))
+		AND (? IS NULL OR starts_at < FROM_UNIXTIME(?))
+	`, modelID, startsAt, req.EndsAt, req.EndsAt).Scan(&reserved)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query reservations"), err, shared.ErrInternalServerError)
+	}
+	if maxConcurrency.Valid && maxConcurrency.Int64 > 0 && reserved+req.Slots > uint64(maxConcurrency.Int64) {
+		return nil, errors.Join(fmt.Errorf("model serves %d concurrent requests and %d are already reserved", maxConcurrency.Int64, reserved), shared.ErrConflict)
+	}
+
+	res, err := h.WDB.ExecContext(input.Ctx, `
+		INSERT INTO capacity_reservation (user_id, model_id, slots, monthly_fee, starts_at, ends_at, created_by)
+		VALUES (?, ?, ?, ?, FROM_UNIXTIME(?), FROM_UNIXTIME(?), ?)
+	`, req.UserID, modelID, req.Slots, req.MonthlyFee, startsAt, req.EndsAt, input.AdminID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create reservation"), err, shared.ErrInternalServerError)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create reservation"), err, shared.ErrInternalServerError)
+	}
+
+	h.clearReservationCache(input.Ctx, modelID)
+	return h.getReservation(input.Ctx, uint64(id))
+}
+
+// ListReservationsLogic returns the reservations of a user, or of everyone
+// when UserID is 0, newest first
+func (h *CapacityHandler) ListReservationsLogic(input ReservationInput) ([]Reservation, error) {
+	log := shared.LoggerFromContext(input.Ctx, h.Log)
+	query := `SELECT ` + reservationColumns + `
+		FROM capacity_reservation
+		INNER JOIN model ON model.id = capacity_reservation.model_id`
+	args := []any{}
+	if input.UserID != 0 {
+		query += ` WHERE capacity_reservation.user_id = ?`
+		args = append(args, input.UserID)
+	}
+	query += ` ORDER BY capacity_reservation.id DESC`
+
+	rows, err := h.RDB.QueryContext(input.Ctx, query, args...)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query reservations"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	reservations := []Reservation{}
+	for rows.Next() {
+		reservation, err := scanReservation(rows)
+		if err != nil {
+			log.Warnw("Failed to scan reservation row", "error", err)
+			continue
+		}
+		reservations = append(reservations, *reservation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating reservation rows"), err, shared.ErrInternalServerError)
+	}
+	return reservations, nil
+}
+
+// CancelReservationLogic ends a reservation immediately. Requests already
+// holding one of its slots finish normally
+func (h *CapacityHandler) CancelReservationLogic(input ReservationInput) (*Reservation, error) {
+	reservation, err := h.getReservation(input.Ctx, input.ReservationID)
+	if err != nil {
+		return nil, err
+	}
+	res, err := h.WDB.ExecContext(input.Ctx,
+		"UPDATE capacity_reservation SET canceled_at = NOW() WHERE id = ? AND canceled_at IS NULL", input.ReservationID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to cancel reservation"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil, errors.Join(errors.New("reservation already canceled"), shared.ErrBadRequest)
+	}
+
+	h.clearReservationCache(input.Ctx, reservation.ModelID)
+	return h.getReservation(input.Ctx, input.ReservationID)
+}
+
+func (h *CapacityHandler) getReservation(ctx context.Context, id uint64) (*Reservation, error) {
+	row := h.WDB.QueryRowContext(ctx, `SELECT `+reservationColumns+`
+		FROM capacity_reservation
+		INNER JOIN model ON model.id = capacity_reservation.model_id
+		WHERE capacity_reservation.id = ?`, id)
+	reservation, err := scanReservation(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("reservation not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query reservation"), err, shared.ErrInternalServerError)
+	}
+	return reservation, nil
+}
+
+func scanReservation(row interface{ Scan(...any) error }) (*Reservation, error) {
+	var r Reservation
+	if err := row.Scan(&r.ID, &r.UserID, &r.ModelID, &r.Model, &r.Slots, &r.MonthlyFee,
+		&r.StartsAt, &r.EndsAt, &r.CreatedBy, &r.CreatedAt, &r.CanceledAt); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	r.Active = r.CanceledAt == nil && r.StartsAt <= now && (r.EndsAt == nil || *r.EndsAt > now)
+	r.MonthlyUSD = float64(r.MonthlyFee) * shared.CreditsToUSD
+	return &r, nil
+}
+
+// clearReservationCache makes admission control pick up the change on the
+// next request instead of when the cached reservations expire
+func (h *CapacityHandler) clearReservationCache(ctx context.Context, modelID uint64) {
+	if err := h.RedisClient.Del(ctx, shared.ReservationCacheKey(modelID)).Err(); err != nil {
+		h.Log.Warnw("Failed to clear reservation cache", "error", err, "model_id", modelID)
+	}
+}
@@ -0,0 +1,63 @@
+// Package finetune proxies fine-tuning jobs to the training backend and
+// registers trained adapters once jobs complete
+package finetune
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"sybil-api/internal/tracing"
+
+	"go.uber.org/zap"
+)
+
+// RegisterAdapterFunc registers a trained adapter on top of the deployment
+// serving baseModel, restricted to userID
+type RegisterAdapterFunc func(ctx context.Context, baseModel, adapterName, adapterPath string, userID uint64) error
+
+type FineTuneHandler struct {
+	Log              *zap.SugaredLogger
+	TrainingAPIKey   string
+	TrainingEndpoint string
+	WDB              *sql.DB
+	RDB              *sql.DB
+	HTTPClient       *http.Client
+	RegisterAdapter  RegisterAdapterFunc
+}
+
+func NewFineTuneHandler(wdb *sql.DB, rdb *sql.DB, apiKey, url string, registerAdapter RegisterAdapterFunc, log *zap.SugaredLogger) (*FineTuneHandler, error) {
+	err := wdb.Ping()
+	if err != nil {
+		return nil, errors.New("failed to ping write db")
+	}
+
+	err = rdb.Ping()
+	if err != nil {
+		return nil, errors.New("failed to ping read replica db")
+	}
+
+	tr := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout: 2 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 2 * time.Second,
+		DisableKeepAlives:   false,
+	}
+	// Uploads of training files can be large, so allow more time than the
+	// targon control plane client
+	httpClient := http.Client{Transport: tracing.Transport(tr), Timeout: 10 * time.Minute}
+
+	return &FineTuneHandler{
+		Log:              log,
+		TrainingAPIKey:   apiKey,
+		TrainingEndpoint: url,
+		WDB:              wdb,
+		RDB:              rdb,
+		HTTPClient:       &httpClient,
+		RegisterAdapter:  registerAdapter,
+	}, nil
+}
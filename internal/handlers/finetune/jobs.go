@@ -0,0 +1,414 @@
+package finetune
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"time"
+
+	"sybil-api/internal/shared"
+
+	"github.com/aidarkhanov/nanoid"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+var validSuffix = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+type Job struct {
+	ID        string  `json:"id"`
+	Object    string  `json:"object"`
+	Model     string  `json:"model"`
+	Suffix    string  `json:"suffix,omitempty"`
+	Status    string  `json:"status"`
+	FineTuned *string `json:"fine_tuned_model"`
+	Error     *string `json:"error"`
+	CreatedAt int64   `json:"created_at"`
+	UpdatedAt int64   `json:"updated_at"`
+
+	trainingID string
+	userID     uint64
+}
+
+type JobEvent struct {
+	Object    string `json:"object"`
+	CreatedAt int64  `json:"created_at"`
+	Level     string `json:"level"`
+	Message   string `json:"message"`
+}
+
+// trainingJob is the job representation returned by the training backend
+type trainingJob struct {
+	ID          string  `json:"id"`
+	Status      string  `json:"status"`
+	AdapterPath *string `json:"adapter_path,omitempty"`
+	Error       *string `json:"error,omitempty"`
+}
+
+// CreateJobInput contains all data needed for CreateJob business logic
+type CreateJobInput struct {
+	Ctx             context.Context
+	UserID          uint64
+	Model           string
+	Suffix          string
+	Hyperparameters map[string]any
+	FileName        string
+	File            io.Reader
+}
+
+// JobInput is used for all single job lookups
+type JobInput struct {
+	Ctx    context.Context
+	UserID uint64
+	JobID  string
+}
+
+func (f *FineTuneHandler) CreateJobLogic(input CreateJobInput) (*Job, error) {
+	if input.Model == "" {
+		return nil, errors.Join(errors.New("model is required"), shared.ErrBadRequest)
+	}
+	if input.Suffix != "" && !validSuffix.MatchString(input.Suffix) {
+		return nil, errors.Join(errors.New("suffix must be 1-32 lowercase alphanumeric characters or dashes"), shared.ErrBadRequest)
+	}
+	if input.File == nil {
+		return nil, errors.Join(errors.New("training file is required"), shared.ErrBadRequest)
+	}
+	if err := f.checkBaseModel(input.Ctx, input.Model, input.UserID); err != nil {
+		return nil, err
+	}
+
+	fileBytes, err := io.ReadAll(io.LimitReader(input.File, shared.FineTuneMaxFileSize+1))
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to read training file"), err, shared.ErrBadRequest)
+	}
+	if len(fileBytes) > shared.FineTuneMaxFileSize {
+		return nil, errors.Join(fmt.Errorf("training file exceeds %d bytes", shared.FineTuneMaxFileSize), shared.ErrBadRequest)
+	}
+	if err := validateTrainingFile(fileBytes); err != nil {
+		return nil, errors.Join(errors.New("invalid training file"), err, shared.ErrBadRequest)
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	_ = writer.WriteField("base_model", input.Model)
+	if input.Hyperparameters != nil {
+		hyperparametersJSON, err := json.Marshal(input.Hyperparameters)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to marshal hyperparameters"), err, shared.ErrBadRequest)
+		}
+		_ = writer.WriteField("hyperparameters", string(hyperparametersJSON))
+	}
+	part, err := writer.CreateFormFile("file", input.FileName)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create form file"), err, shared.ErrInternalServerError)
+	}
+	if _, err := part.Write(fileBytes); err != nil {
+		return nil, errors.Join(errors.New("failed to write form file"), err, shared.ErrInternalServerError)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, errors.Join(errors.New("failed to close multipart writer"), err, shared.ErrInternalServerError)
+	}
+
+	var tj trainingJob
+	err = f.doTrainingRequest(input.Ctx, "POST", "/v1/jobs", &body, writer.FormDataContentType(), &tj)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create training job"), err, shared.ErrInternalServerError)
+	}
+
+	jobNano, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 24)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to generate job id"), err, shared.ErrInternalServerError)
+	}
+	jobID := "ftjob-" + jobNano
+
+	_, err = f.WDB.ExecContext(input.Ctx, `
+		INSERT INTO fine_tuning_job (id, user_id, training_job_id, base_model, suffix, status)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, jobID, input.UserID, tj.ID, input.Model, input.Suffix, JobStatusQueued)
+	if err != nil {
+		// Dont leave an untracked job burning GPU time
+		if cancelErr := f.doTrainingRequest(context.Background(), "POST", "/v1/jobs/"+tj.ID+"/cancel", nil, "", nil); cancelErr != nil {
+			err = errors.Join(cancelErr, err)
+		}
+		return nil, errors.Join(errors.New("failed to insert fine tuning job"), err, shared.ErrInternalServerError)
+	}
+
+	go f.pollJob(jobID)
+
+	now := time.Now().Unix()
+	return &Job{
+		ID:        jobID,
+		Object:    "fine_tuning.job",
+		Model:     input.Model,
+		Suffix:    input.Suffix,
+		Status:    JobStatusQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+// checkBaseModel makes sure the user can run model, the same rule
+// DiscoverModels routes requests by, so private models and adapters of other
+// users cannot be trained on
+func (f *FineTuneHandler) checkBaseModel(ctx context.Context, model string, userID uint64) error {
+	var modelID uint64
+	err := f.RDB.QueryRowContext(ctx, `
+		SELECT model.id
+		FROM model_registry
+		INNER JOIN model ON model_registry.model_id = model.id
+		LEFT JOIN lora_adapter ON lora_adapter.model_id = model.id
+			AND lora_adapter.name = model_registry.model_name
+			AND lora_adapter.active = true
+		WHERE model_registry.model_name = ?
+		AND model.enabled = true
+		AND (model.allowed_user_id = ? OR model.allowed_user_id IS NULL)
+		AND (lora_adapter.allowed_user_id = ? OR lora_adapter.allowed_user_id IS NULL)
+		LIMIT 1
+	`, model, userID, userID).Scan(&modelID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return errors.Join(fmt.Errorf("model %s does not exist or you do not have access to it", model), shared.ErrBadRequest)
+	case err != nil:
+		return errors.Join(errors.New("failed to look up base model"), err, shared.ErrInternalServerError)
+	}
+	return nil
+}
+
+func (f *FineTuneHandler) GetJobLogic(input JobInput) (*Job, error) {
+	return f.getJob(input.Ctx, f.RDB, input.JobID, input.UserID)
+}
+
+func (f *FineTuneHandler) CancelJobLogic(input JobInput) (*Job, error) {
+	job, err := f.getJob(input.Ctx, f.WDB, input.JobID, input.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if isTerminal(job.Status) {
+		return nil, errors.Join(fmt.Errorf("job is already %s", job.Status), shared.ErrBadRequest)
+	}
+
+	err = f.doTrainingRequest(input.Ctx, "POST", "/v1/jobs/"+job.trainingID+"/cancel", nil, "", nil)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to cancel training job"), err, shared.ErrInternalServerError)
+	}
+
+	_, err = f.WDB.ExecContext(input.Ctx, "UPDATE fine_tuning_job SET status = ?, updated_at = NOW() WHERE id = ?", JobStatusCancelled, job.ID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to update job status"), err, shared.ErrPartialSuccess)
+	}
+	job.Status = JobStatusCancelled
+	job.UpdatedAt = time.Now().Unix()
+	return job, nil
+}
+
+func (f *FineTuneHandler) ListJobEventsLogic(input JobInput) ([]JobEvent, error) {
+	job, err := f.getJob(input.Ctx, f.RDB, input.JobID, input.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Data []JobEvent `json:"data"`
+	}
+	err = f.doTrainingRequest(input.Ctx, "GET", "/v1/jobs/"+job.trainingID+"/events", nil, "", &res)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to get training job events"), err, shared.ErrInternalServerError)
+	}
+	for i := range res.Data {
+		res.Data[i].Object = "fine_tuning.job.event"
+	}
+	if res.Data == nil {
+		res.Data = []JobEvent{}
+	}
+	return res.Data, nil
+}
+
+// ResumePolling restarts polling for jobs that were in progress when the
+// process last stopped
+func (f *FineTuneHandler) ResumePolling() {
+	rows, err := f.RDB.Query("SELECT id FROM fine_tuning_job WHERE status IN (?, ?)", JobStatusQueued, JobStatusRunning)
+	if err != nil {
+		f.Log.Errorw("Failed to query in progress fine tuning jobs", "error", err)
+		return
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var jobID string
+		if err := rows.Scan(&jobID); err != nil {
+			f.Log.Warnw("Failed to scan fine tuning job row", "error", err)
+			continue
+		}
+		go f.pollJob(jobID)
+	}
+}
+
+func (f *FineTuneHandler) pollJob(jobID string) {
+	ticker := time.NewTicker(shared.FineTunePollingInterval)
+	defer ticker.Stop()
+	ctx := context.Background()
+
+	for range ticker.C {
+		job, err := f.getJob(ctx, f.WDB, jobID, 0)
+		if err != nil {
+			f.Log.Errorw("Failed to load fine tuning job, stopping polling", "error", err, "job_id", jobID)
+			return
+		}
+		if isTerminal(job.Status) {
+			return
+		}
+		if time.Since(time.Unix(job.CreatedAt, 0)) > shared.FineTunePollingMaxWait {
+			f.Log.Errorw("Polling timeout for fine tuning job", "job_id", jobID)
+			return
+		}
+
+		var tj trainingJob
+		if err := f.doTrainingRequest(ctx, "GET", "/v1/jobs/"+job.trainingID, nil, "", &tj); err != nil {
+			f.Log.Warnw("Failed to poll training job", "error", err, "job_id", jobID)
+			continue
+		}
+		if tj.Status == job.Status {
+			continue
+		}
+
+		var adapterName *string
+		if tj.Status == JobStatusSucceeded {
+			if tj.AdapterPath == nil || *tj.AdapterPath == "" {
+				msg := "training completed without an adapter"
+				tj.Status = JobStatusFailed
+				tj.Error = &msg
+			} else {
+				name := fineTunedModelName(job)
+				if err := f.RegisterAdapter(ctx, job.Model, name, *tj.AdapterPath, job.userID); err != nil {
+					// Keep polling, registration will be retried on the next tick
+					f.Log.Errorw("Failed to register fine tuned adapter", "error", err, "job_id", jobID)
+					continue
+				}
+				adapterName = &name
+			}
+		}
+
+		_, err = f.WDB.ExecContext(ctx, `
+			UPDATE fine_tuning_job
+			SET status = ?, adapter_name = ?, error = ?, updated_at = NOW()
+			WHERE id = ?
+		`, tj.Status, adapterName, tj.Error, jobID)
+		if err != nil {
+			f.Log.Errorw("Failed to update fine tuning job", "error", err, "job_id", jobID)
+			continue
+		}
+		f.Log.Infow("Fine tuning job status changed", "job_id", jobID, "status", tj.Status)
+	}
+}
+
+func (f *FineTuneHandler) getJob(ctx context.Context, db *sql.DB, jobID string, userID uint64) (*Job, error) {
+	job := Job{ID: jobID, Object: "fine_tuning.job"}
+	var suffix sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT user_id, training_job_id, base_model, suffix, status, adapter_name, error,
+			UNIX_TIMESTAMP(created_at), UNIX_TIMESTAMP(updated_at)
+		FROM fine_tuning_job
+		WHERE id = ?
+	`, jobID).Scan(&job.userID, &job.trainingID, &job.Model, &suffix, &job.Status, &job.FineTuned, &job.Error, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find fine tuning job"), err, shared.ErrNotFound)
+	}
+	// userID 0 is only used internally by the poller
+	if userID != 0 && job.userID != userID {
+		return nil, errors.Join(errors.New("job belongs to another user"), shared.ErrNotFound)
+	}
+	job.Suffix = suffix.String
+	return &job, nil
+}
+
+func (f *FineTuneHandler) doTrainingRequest(ctx context.Context, method, route string, body io.Reader, contentType string, out any) error {
+	httpReq, err := http.NewRequestWithContext(ctx, method, f.TrainingEndpoint+route, body)
+	if err != nil {
+		return errors.Join(errors.New("failed to create http request"), err)
+	}
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", f.TrainingAPIKey))
+	if contentType != "" {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := f.HTTPClient.Do(httpReq)
+	if err != nil {
+		return errors.Join(errors.New("failed to send http request"), err)
+	}
+	defer func() {
+		if closeErr := res.Body.Close(); closeErr != nil {
+			f.Log.Warnw("Failed to close response body", "error", closeErr)
+		}
+	}()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return errors.Join(errors.New("failed to read response body"), err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("training backend returned error: [%d: %s]", res.StatusCode, string(resBody))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resBody, out); err != nil {
+		return errors.Join(errors.New("failed to parse training backend response"), err)
+	}
+	return nil
+}
+
+// validateTrainingFile checks every line of the JSONL file is a chat example
+func validateTrainingFile(file []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(file)+1)
+	lines := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		lines++
+		var example struct {
+			Messages []shared.ChatMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(line, &example); err != nil {
+			return fmt.Errorf("line %d is not valid json: %w", lines, err)
+		}
+		if len(example.Messages) == 0 {
+			return fmt.Errorf("line %d is missing messages", lines)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if lines == 0 {
+		return errors.New("training file is empty")
+	}
+	return nil
+}
+
+func fineTunedModelName(job *Job) string {
+	if job.Suffix != "" {
+		return fmt.Sprintf("ft:%s:%s:%s", job.Model, job.Suffix, job.ID)
+	}
+	return fmt.Sprintf("ft:%s:%s", job.Model, job.ID)
+}
+
+func isTerminal(status string) bool {
+	return status == JobStatusSucceeded || status == JobStatusFailed || status == JobStatusCancelled
+}
@@ -0,0 +1,326 @@
+// Package incidents lets staff mark the time windows a model was degraded.
+// Customers see them next to their usage, and requests that failed during an
+// incident can be refunded through the ledger
+package incidents
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"sybil-api/internal/handlers/billing"
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+)
+
+type IncidentHandler struct {
+	Log     *zap.SugaredLogger
+	WDB     *sql.DB
+	RDB     *sql.DB
+	Billing *billing.BillingHandler
+}
+
+func NewIncidentHandler(wdb *sql.DB, rdb *sql.DB, billingHandler *billing.BillingHandler, log *zap.SugaredLogger) *IncidentHandler {
+	return &IncidentHandler{Log: log, WDB: wdb, RDB: rdb, Billing: billingHandler}
+}
+
+type Incident struct {
+	ID          uint64 `json:"id"`
+	ModelID     uint64 `json:"model_id"`
+	Model       string `json:"model"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	StartsAt    int64  `json:"starts_at"`
+	// Nil while the incident is ongoing
+	EndsAt *int64 `json:"ends_at"`
+	// Failed requests in the window are refunded once the incident ends
+	AutoRefund       bool   `json:"auto_refund"`
+	RefundedAt       *int64 `json:"refunded_at"`
+	RefundedRequests uint64 `json:"refunded_requests"`
+	RefundedCredits  uint64 `json:"refunded_credits"`
+	CreatedBy        uint64 `json:"created_by"`
+	CreatedAt        int64  `json:"created_at"`
+}
+
+// CreateIncidentRequest marks a window of a model as incident affected. The
+// title and description are shown to customers
+type CreateIncidentRequest struct {
+	Model       string `json:"model"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	StartsAt    int64  `json:"starts_at"`
+	EndsAt      *int64 `json:"ends_at,omitempty"`
+	AutoRefund  bool   `json:"auto_refund"`
+}
+
+type ResolveIncidentRequest struct {
+	// Defaults to now
+	EndsAt *int64 `json:"ends_at,omitempty"`
+}
+
+// IncidentInput contains all data needed for incident business logic
+type IncidentInput struct {
+	Ctx        context.Context
+	AdminID    uint64
+	IncidentID uint64
+	// Filter for listing, empty lists every model
+	Model   string
+	Req     CreateIncidentRequest
+	Resolve ResolveIncidentRequest
+}
+
+const incidentColumns = `model_incident.id, model_incident.model_id, model.name, model_incident.title, model_incident.description,
+	UNIX_TIMESTAMP(model_incident.starts_at), UNIX_TIMESTAMP(model_incident.ends_at), model_incident.auto_refund,
+	UNIX_TIMESTAMP(model_incident.refunded_at), model_incident.refunded_requests, model_incident.refunded_credits,
+	model_incident.created_by, UNIX_TIMESTAMP(model_incident.created_at)`
+
+func scanIncident(row interface{ Scan(...any) error }) (*Incident, error) {
+	var incident Incident
+	var endsAt, refundedAt sql.NullInt64
+	err := row.Scan(&incident.ID, &incident.ModelID, &incident.Model, &incident.Title, &incident.Description,
+		&incident.StartsAt, &endsAt, &incident.AutoRefund,
+		&refundedAt, &incident.RefundedRequests, &incident.RefundedCredits,
+		&incident.CreatedBy, &incident.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if endsAt.Valid {
+		incident.EndsAt = &endsAt.Int64
+	}
+	if refundedAt.Valid {
+		incident.RefundedAt = &refundedAt.Int64
+	}
+	return &incident, nil
+}
+
+// CreateIncidentLogic records an incident. Incidents created already ended
+// are refunded right away when AutoRefund is set
+func (h *IncidentHandler) CreateIncidentLogic(input IncidentInput) (*Incident, error) {
+	req := input.Req
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		return nil, errors.Join(errors.New("title is required"), shared.ErrBadRequest)
+	}
+	now := time.Now().Unix()
+	if req.StartsAt <= 0 || req.StartsAt > now {
+		return nil, errors.Join(errors.New("starts_at must be a unix time in the past"), shared.ErrBadRequest)
+	}
+	if req.EndsAt != nil && (*req.EndsAt <= req.StartsAt || *req.EndsAt > now) {
+		return nil, errors.Join(errors.New("ends_at must be after starts_at and not in the future"), shared.ErrBadRequest)
+	}
+	if req.EndsAt != nil && time.Duration(*req.EndsAt-req.StartsAt)*time.Second > shared.IncidentMaxWindow {
+		return nil, errors.Join(fmt.Errorf("incidents cannot be longer than %s", shared.IncidentMaxWindow), shared.ErrBadRequest)
+	}
+
+	var modelID uint64
+	err := h.RDB.QueryRowContext(input.Ctx, "SELECT id FROM model WHERE name = ?", req.Model).Scan(&modelID)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("model not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find model"), err, shared.ErrInternalServerError)
+	}
+
+	res, err := h.WDB.ExecContext(input.Ctx, `
+		INSERT INTO model_incident (model_id, title, description, starts_at, ends_at, auto_refund, created_by, active)
+		VALUES (?, ?, ?, FROM_UNIXTIME(?), FROM_UNIXTIME(?), ?, ?, true)
+	`, modelID, req.Title, req.Description, req.StartsAt, req.EndsAt, req.AutoRefund, input.AdminID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create incident"), err, shared.ErrInternalServerError)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to create incident"), err, shared.ErrInternalServerError)
+	}
+
+	incident, err := h.getIncident(input.Ctx, uint64(id))
+	if err != nil {
+		return nil, err
+	}
+	if incident.AutoRefund && incident.EndsAt != nil {
+		go h.refundIncident(incident, input.AdminID)
+	}
+	return incident, nil
+}
+
+// ListIncidentsLogic returns the incidents of a model, or of every model when
+// Model is empty, newest first
+func (h *IncidentHandler) ListIncidentsLogic(input IncidentInput) ([]Incident, error) {
+	log := shared.LoggerFromContext(input.Ctx, h.Log)
+	query := `SELECT ` + incidentColumns + `
+		FROM model_incident
+		INNER JOIN model ON model.id = model_incident.model_id
+		WHERE model_incident.active = true`
+	args := []any{}
+	if input.Model != "" {
+		query += ` AND model.name = ?`
+		args = append(args, input.Model)
+	}
+	query += ` ORDER BY model_incident.starts_at DESC LIMIT ?`
+	args = append(args, shared.MaxPageSize)
+
+	rows, err := h.RDB.QueryContext(input.Ctx, query, args...)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query incidents"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	incidents := []Incident{}
+	for rows.Next() {
+		incident, err := scanIncident(rows)
+		if err != nil {
+			log.Warnw("Failed to scan incident row", "error", err)
+			continue
+		}
+		incidents = append(incidents, *incident)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating incident rows"), err, shared.ErrInternalServerError)
+	}
+	return incidents, nil
+}
+
+// ResolveIncidentLogic ends an ongoing incident, starting its refunds when
+// AutoRefund is set
+func (h *IncidentHandler) ResolveIncidentLogic(input IncidentInput) (*Incident, error) {
+	incident, err := h.getIncident(input.Ctx, input.IncidentID)
+	if err != nil {
+		return nil, err
+	}
+	if incident.EndsAt != nil {
+		return nil, errors.Join(errors.New("incident already resolved"), shared.ErrBadRequest)
+	}
+	now := time.Now().Unix()
+	endsAt := now
+	if input.Resolve.EndsAt != nil {
+		endsAt = *input.Resolve.EndsAt
+	}
+	if endsAt <= incident.StartsAt || endsAt > now {
+		return nil, errors.Join(errors.New("ends_at must be after starts_at and not in the future"), shared.ErrBadRequest)
+	}
+	if time.Duration(endsAt-incident.StartsAt)*time.Second > shared.IncidentMaxWindow {
+		return nil, errors.Join(fmt.Errorf("incidents cannot be longer than %s", shared.IncidentMaxWindow), shared.ErrBadRequest)
+	}
+
+	res, err := h.WDB.ExecContext(input.Ctx,
+		"UPDATE model_incident SET ends_at = FROM_UNIXTIME(?) WHERE id = ? AND ends_at IS NULL", endsAt, input.IncidentID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to resolve incident"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil, errors.Join(errors.New("incident already resolved"), shared.ErrBadRequest)
+	}
+
+	incident, err = h.getIncident(input.Ctx, input.IncidentID)
+	if err != nil {
+		return nil, err
+	}
+	if incident.AutoRefund {
+		go h.refundIncident(incident, input.AdminID)
+	}
+	return incident, nil
+}
+
+// DeleteIncidentLogic hides an incident marked by mistake. Refunds already
+// made are kept
+func (h *IncidentHandler) DeleteIncidentLogic(input IncidentInput) error {
+	if _, err := h.getIncident(input.Ctx, input.IncidentID); err != nil {
+		return err
+	}
+	_, err := h.WDB.ExecContext(input.Ctx, "UPDATE model_incident SET active = false WHERE id = ?", input.IncidentID)
+	if err != nil {
+		return errors.Join(errors.New("failed to delete incident"), err, shared.ErrInternalServerError)
+	}
+	return nil
+}
+
+func (h *IncidentHandler) getIncident(ctx context.Context, id uint64) (*Incident, error) {
+	row := h.WDB.QueryRowContext(ctx, `SELECT `+incidentColumns+`
+		FROM model_incident
+		INNER JOIN model ON model.id = model_incident.model_id
+		WHERE model_incident.id = ? AND model_incident.active = true`, id)
+	incident, err := scanIncident(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("incident not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query incident"), err, shared.ErrInternalServerError)
+	}
+	return incident, nil
+}
+
+// refundIncident refunds every billed request of the model in the window that
+// did not complete. Requests refunded before, by hand or by an overlapping
+// incident, are skipped by the ledger
+func (h *IncidentHandler) refundIncident(incident *Incident, adminID uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), shared.IncidentRefundTimeout)
+	defer cancel()
+	log := h.Log.With("incident_id", incident.ID, "model_id", incident.ModelID)
+
+	// Claimed first so two resolves cannot refund the same incident
+	res, err := h.WDB.ExecContext(ctx,
+		"UPDATE model_incident SET refunded_at = NOW() WHERE id = ? AND refunded_at IS NULL", incident.ID)
+	if err != nil {
+		log.Errorw("Failed to claim incident refunds", "error", err)
+		return
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return
+	}
+
+	rows, err := h.RDB.QueryContext(ctx, `
+		SELECT request_id FROM request
+		WHERE model_id = ? AND created_at >= FROM_UNIXTIME(?) AND created_at < FROM_UNIXTIME(?)
+			AND completed = false AND credits > 0 AND byok = false
+	`, incident.ModelID, incident.StartsAt, *incident.EndsAt)
+	if err != nil {
+		log.Errorw("Failed to query incident requests", "error", err)
+		return
+	}
+	requestIDs := []string{}
+	for rows.Next() {
+		var requestID string
+		if err := rows.Scan(&requestID); err != nil {
+			continue
+		}
+		requestIDs = append(requestIDs, requestID)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		log.Errorw("Failed iterating incident requests", "error", err)
+		return
+	}
+
+	var refunded, credits uint64
+	reason := fmt.Sprintf("Incident %d: %s", incident.ID, incident.Title)
+	for _, requestID := range requestIDs {
+		entry, err := h.Billing.RefundRequestLogic(billing.CreditsInput{
+			Ctx:       ctx,
+			AdminID:   adminID,
+			RequestID: requestID,
+			Refund:    billing.RefundRequest{Reason: reason},
+		})
+		if err != nil {
+			if !errors.Is(err, shared.ErrBadRequest) {
+				log.Warnw("Failed to refund incident request", "error", err, "request_id", requestID)
+			}
+			continue
+		}
+		refunded++
+		credits += uint64(entry.Delta)
+	}
+
+	_, err = h.WDB.ExecContext(ctx,
+		"UPDATE model_incident SET refunded_requests = ?, refunded_credits = ? WHERE id = ?", refunded, credits, incident.ID)
+	if err != nil {
+		log.Errorw("Failed to record incident refunds", "error", err)
+	}
+	log.Infow("Refunded incident requests", "requests", refunded, "credits", credits)
+}
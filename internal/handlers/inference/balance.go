@@ -0,0 +1,98 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"sybil-api/internal/shared"
+)
+
+// Balance is what the user, or their organization pool, has left once usage
+// that is still waiting in the usage buckets is charged
+type Balance struct {
+	// Balance charged so far, in the database
+	Credits      int64 `json:"credits"`
+	PlanRequests uint  `json:"plan_requests"`
+	// Usage that is not charged yet
+	UnflushedCredits  uint64 `json:"unflushed_credits"`
+	UnflushedRequests int64  `json:"unflushed_requests"`
+	// Balance once the unflushed usage is charged. Plan requests are used
+	// first, like the flush does
+	AvailableCredits      int64 `json:"available_credits"`
+	AvailablePlanRequests uint  `json:"available_plan_requests"`
+	// Set when the balance is the organization pool, whose unflushed usage
+	// includes every member
+	OrganizationID uint64 `json:"organization_id,omitempty"`
+}
+
+// GetBalance returns the users balance including usage since the last flush.
+// The balance is read like the credit check reads it, so it is current
+// unless the replica lags
+func (im *InferenceHandler) GetBalance(ctx context.Context, user shared.UserMetadata) (*Balance, error) {
+	db := im.RDB
+	if im.Lag != nil {
+		db = im.Lag.ReadDB("balance")
+	}
+
+	balance := &Balance{OrganizationID: user.OrganizationID}
+	var allowOverspend bool
+	table, poolID := "user", user.UserID
+	if user.OrganizationID != 0 {
+		table, poolID = "organization", user.OrganizationID
+	}
+	err := db.QueryRowContext(ctx,
+		"SELECT credits, COALESCE(plan_requests, 0), allow_overspend FROM "+table+" WHERE id = ?", poolID,
+	).Scan(&balance.Credits, &balance.PlanRequests, &allowOverspend)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query balance"), err, shared.ErrInternalServerError)
+	}
+
+	userIDs := []uint64{user.UserID}
+	if user.OrganizationID != 0 {
+		userIDs, err = organizationMembers(ctx, db, user.OrganizationID)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to query organization members"), err, shared.ErrInternalServerError)
+		}
+	}
+	unflushed, err := im.usageCache.Unflushed(ctx, userIDs...)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to read unflushed usage"), err, shared.ErrInternalServerError)
+	}
+	balance.UnflushedCredits = unflushed.Credits
+	balance.UnflushedRequests = unflushed.Requests
+
+	// Each flush charges either plan requests or credits, see ChargeUser
+	balance.AvailableCredits = balance.Credits
+	balance.AvailablePlanRequests = balance.PlanRequests
+	switch {
+	case balance.PlanRequests >= 1:
+		balance.AvailablePlanRequests = uint(max(int64(balance.PlanRequests)-unflushed.Requests, 0))
+	default:
+		balance.AvailableCredits -= int64(unflushed.Credits)
+		if !allowOverspend {
+			balance.AvailableCredits = max(balance.AvailableCredits, 0)
+		}
+	}
+	return balance, nil
+}
+
+func organizationMembers(ctx context.Context, db *sql.DB, organizationID uint64) ([]uint64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM user WHERE organization_id = ?", organizationID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var userIDs []uint64
+	for rows.Next() {
+		var userID uint64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
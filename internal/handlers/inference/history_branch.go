@@ -0,0 +1,148 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/shared"
+
+	"github.com/aidarkhanov/nanoid"
+)
+
+// ChatBranch is a history forked from another one
+type ChatBranch struct {
+	ID string `json:"id"`
+	// Position in the parents messages the branch was forked after
+	BranchedFrom int   `json:"branched_from"`
+	CreatedAt    int64 `json:"created_at"`
+}
+
+type BranchChatHistoryInput struct {
+	GetChatHistoryInput
+	// Position of the last message to carry over, as returned by
+	// GetChatHistory
+	FromMessage int
+}
+
+// BranchChatHistory forks a users history after a message into a new history
+// holding a copy of the messages up to and including it. The branch records
+// its parent so the conversation tree can be rebuilt. Encrypted messages are
+// copied as stored
+func (im *InferenceHandler) BranchChatHistory(input BranchChatHistoryInput) (*ChatBranch, error) {
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return nil, err
+	}
+	historyDB := store.Writer()
+	if input.FromMessage < 0 {
+		return nil, errors.Join(errors.New("from_message must not be negative"), shared.ErrBadRequest)
+	}
+
+	branchNano, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 11)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to generate history id"), err, shared.ErrInternalServerError)
+	}
+	branch := &ChatBranch{ID: "chat-" + branchNano, BranchedFrom: input.FromMessage}
+
+	// Errors meant for the client are kept apart from the transaction wrapping
+	var clientErr error
+
+	err = database.ExecuteTransaction(input.Ctx, historyDB, []func(*sql.Tx) error{
+		func(tx *sql.Tx) error {
+			var owner uint64
+			err := tx.QueryRowContext(input.Ctx, `
+				SELECT user_id FROM chat_history WHERE history_id = ? AND deleted_at IS NULL
+			`, input.HistoryID).Scan(&owner)
+			if err == sql.ErrNoRows || (err == nil && owner != input.User.UserID) {
+				clientErr = errors.Join(errors.New("history not found"), shared.ErrNotFound)
+				return clientErr
+			}
+			return err
+		},
+		func(tx *sql.Tx) error {
+			// Locks the parent and moves a legacy blob to chat_message so its
+			// rows can be copied
+			return im.appendChatMessages(input.Ctx, tx, input.HistoryID, nil, input.User.EncryptHistory)
+		},
+		func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(input.Ctx, `
+				INSERT INTO chat_history (user_id, history_id, messages, title, icon, settings, parent_history_id, branched_from)
+				SELECT user_id, ?, '[]', title, icon, settings, history_id, ?
+				FROM chat_history WHERE history_id = ?
+			`, branch.ID, input.FromMessage, input.HistoryID)
+			return err
+		},
+		func(tx *sql.Tx) error {
+			err := copyChatMessages(input.Ctx, tx, input.HistoryID, branch.ID, input.FromMessage+1)
+			if errors.Is(err, shared.ErrBadRequest) {
+				clientErr = err
+			}
+			return err
+		},
+	})
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to branch history"), err, shared.ErrInternalServerError)
+	}
+	store.Wrote(input.Ctx, input.User.UserID)
+
+	err = historyDB.QueryRowContext(input.Ctx, `
+		SELECT UNIX_TIMESTAMP(created_at) FROM chat_history WHERE history_id = ?
+	`, branch.ID).Scan(&branch.CreatedAt)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query branch"), err, shared.ErrInternalServerError)
+	}
+	return branch, nil
+}
+
+// copyChatMessages copies the first count current messages of a history to
+// another, renumbering them from zero
+func copyChatMessages(ctx context.Context, tx *sql.Tx, fromID, toID string, count int) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT role, message, encryption_key_id, encrypted_data_key
+		FROM chat_message
+		WHERE history_id = ? AND superseded_at IS NULL
+		ORDER BY seq ASC
+		LIMIT ?
+	`, fromID, count)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	type storedMessage struct {
+		role, message  string
+		keyID, dataKey sql.NullString
+	}
+	messages := []storedMessage{}
+	for rows.Next() {
+		var msg storedMessage
+		if err := rows.Scan(&msg.role, &msg.message, &msg.keyID, &msg.dataKey); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return fmt.Errorf("failed iterating messages: %w", err)
+	}
+	if len(messages) < count {
+		return errors.Join(fmt.Errorf("from_message must be below %d", len(messages)), shared.ErrBadRequest)
+	}
+
+	for seq, msg := range messages {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO chat_message (history_id, seq, role, message, encryption_key_id, encrypted_data_key)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, toID, seq, msg.role, msg.message, msg.keyID, msg.dataKey)
+		if err != nil {
+			return fmt.Errorf("failed to copy message: %w", err)
+		}
+	}
+	return nil
+}
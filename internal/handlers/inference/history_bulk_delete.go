@@ -0,0 +1,407 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"sybil-api/internal/database"
+	websearch "sybil-api/internal/search"
+	"sybil-api/internal/shared"
+
+	"github.com/aidarkhanov/nanoid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Clearing all of a users histories, or all of their stored content, is a two
+// step call. The first returns a confirmation token, repeating the call with
+// it starts a deletion job that runs in the background and can be polled for
+// progress. Unlike deleting one history this removes the rows, including
+// histories deleted before
+
+const (
+	DeletionJobRunning  = "RUNNING"
+	DeletionJobComplete = "COMPLETE"
+	DeletionJobFailed   = "FAILED"
+
+	DeletionKindChatHistory = "CHAT_HISTORY"
+	// Histories, share links, saved searches, review samples and request
+	// metadata
+	DeletionKindUserData = "USER_DATA"
+)
+
+type DeletionJob struct {
+	ID         string  `json:"id"`
+	Kind       string  `json:"kind"`
+	Status     string  `json:"status"`
+	Total      uint64  `json:"total"`
+	Deleted    uint64  `json:"deleted"`
+	CreatedAt  int64   `json:"created_at"`
+	FinishedAt *int64  `json:"finished_at"`
+	Error      *string `json:"error,omitempty"`
+}
+
+// DeletionConfirmation is returned by the first call. Nothing is deleted
+// until the call is repeated with the token before it expires
+type DeletionConfirmation struct {
+	ConfirmationToken string `json:"confirmation_token"`
+	Total             uint64 `json:"total"`
+	ExpiresAt         int64  `json:"expires_at"`
+}
+
+type BulkDeleteInput struct {
+	Ctx          context.Context
+	User         shared.UserMetadata
+	Confirmation string
+}
+
+// DeleteAllChatHistories returns a confirmation without one, and with a valid
+// one starts the job deleting every history of the user
+func (im *InferenceHandler) DeleteAllChatHistories(input BulkDeleteInput) (*DeletionConfirmation, *DeletionJob, error) {
+	return im.bulkDelete(input, DeletionKindChatHistory)
+}
+
+// DeleteUserData is DeleteAllChatHistories for everything stored about the
+// users requests, for privacy requests. Billing records are kept, only the
+// metadata sent with requests is cleared from them
+func (im *InferenceHandler) DeleteUserData(input BulkDeleteInput) (*DeletionConfirmation, *DeletionJob, error) {
+	return im.bulkDelete(input, DeletionKindUserData)
+}
+
+func (im *InferenceHandler) bulkDelete(input BulkDeleteInput, kind string) (*DeletionConfirmation, *DeletionJob, error) {
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Counts are taken on the primary so they match what the job deletes
+	historyDB := store.Writer()
+	confirmKey := fmt.Sprintf("sybil:v1:bulk-delete:confirm:%d:%s", input.User.UserID, kind)
+
+	if input.Confirmation == "" {
+		total, err := im.deletionTotal(input.Ctx, historyDB, input.User.UserID, kind)
+		if err != nil {
+			return nil, nil, err
+		}
+		token, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 24)
+		if err != nil {
+			return nil, nil, errors.Join(errors.New("failed to generate confirmation token"), err, shared.ErrInternalServerError)
+		}
+		if err := im.RedisClient.Set(input.Ctx, confirmKey, token, shared.BulkDeleteConfirmTTL).Err(); err != nil {
+			return nil, nil, errors.Join(errors.New("failed to store confirmation token"), err, shared.ErrInternalServerError)
+		}
+		return &DeletionConfirmation{
+			ConfirmationToken: token,
+			Total:             total,
+			ExpiresAt:         time.Now().Add(shared.BulkDeleteConfirmTTL).Unix(),
+		}, nil, nil
+	}
+
+	// The token is single use
+	stored, err := im.RedisClient.GetDel(input.Ctx, confirmKey).Result()
+	if err == redis.Nil || (err == nil && stored != input.Confirmation) {
+		return nil, nil, errors.Join(errors.New("confirmation token is invalid or expired"), shared.ErrBadRequest)
+	}
+	if err != nil {
+		return nil, nil, errors.Join(errors.New("failed to check confirmation token"), err, shared.ErrInternalServerError)
+	}
+
+	// A job without progress for a while died with its replica and is replaced
+	var running string
+	err = im.WDB.QueryRowContext(input.Ctx, `
+		SELECT id FROM data_deletion_job
+		WHERE user_id = ? AND kind = ? AND status = ? AND updated_at > NOW() - INTERVAL ? SECOND
+	`, input.User.UserID, kind, DeletionJobRunning, int(shared.BulkDeleteStaleAfter.Seconds())).Scan(&running)
+	if err == nil {
+		return nil, im.deletionJob(input.Ctx, running, input.User.UserID), nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, nil, errors.Join(errors.New("failed to query deletion jobs"), err, shared.ErrInternalServerError)
+	}
+
+	total, err := im.deletionTotal(input.Ctx, historyDB, input.User.UserID, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	jobNano, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 16)
+	if err != nil {
+		return nil, nil, errors.Join(errors.New("failed to generate job id"), err, shared.ErrInternalServerError)
+	}
+	jobID := "del-" + jobNano
+	_, err = im.WDB.ExecContext(input.Ctx, `
+		INSERT INTO data_deletion_job (id, user_id, kind, status, total, deleted)
+		VALUES (?, ?, ?, ?, ?, 0)
+	`, jobID, input.User.UserID, kind, DeletionJobRunning, total)
+	if err != nil {
+		return nil, nil, errors.Join(errors.New("failed to insert deletion job"), err, shared.ErrInternalServerError)
+	}
+
+	go im.runDeletion(jobID, kind, input.User.UserID, store)
+	return nil, im.deletionJob(input.Ctx, jobID, input.User.UserID), nil
+}
+
+// deletionTotal counts the histories, and for user data the saved searches,
+// review samples and requests with metadata, a job of kind will delete
+func (im *InferenceHandler) deletionTotal(ctx context.Context, historyDB *sql.DB, userID uint64, kind string) (uint64, error) {
+	var total uint64
+	err := historyDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM chat_history WHERE user_id = ?", userID).Scan(&total)
+	if err != nil {
+		return 0, errors.Join(errors.New("failed to count histories"), err, shared.ErrInternalServerError)
+	}
+	if kind != DeletionKindUserData {
+		return total, nil
+	}
+	var searches uint64
+	err = historyDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM search WHERE user_id = ?", userID).Scan(&searches)
+	if err != nil {
+		return 0, errors.Join(errors.New("failed to count searches"), err, shared.ErrInternalServerError)
+	}
+	var samples uint64
+	err = im.WDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM review_sample WHERE user_id = ?", userID).Scan(&samples)
+	if err != nil {
+		return 0, errors.Join(errors.New("failed to count review samples"), err, shared.ErrInternalServerError)
+	}
+	var requests uint64
+	err = im.WDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM request WHERE user_id = ? AND metadata IS NOT NULL", userID).Scan(&requests)
+	if err != nil {
+		return 0, errors.Join(errors.New("failed to count requests"), err, shared.ErrInternalServerError)
+	}
+	return total + searches + samples + requests, nil
+}
+
+// runDeletion runs a deletion job, recording progress after every batch
+func (im *InferenceHandler) runDeletion(jobID, kind string, userID uint64, store *HistoryStore) {
+	log := im.Log.With("job_id", jobID, "user_id", userID, "kind", kind)
+	ctx := context.Background()
+
+	fail := func(err error) {
+		log.Errorw("Chat history deletion failed", "error", err)
+		_, err = im.WDB.ExecContext(ctx, `
+			UPDATE data_deletion_job SET status = ?, error = ?, finished_at = NOW() WHERE id = ?
+		`, DeletionJobFailed, err.Error(), jobID)
+		if err != nil {
+			log.Errorw("Failed to mark deletion job failed", "error", err)
+		}
+	}
+
+	// Share links stop resolving before the histories behind them go
+	_, err := im.WDB.ExecContext(ctx, `
+		UPDATE chat_share SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		fail(fmt.Errorf("failed to revoke chat shares: %w", err))
+		return
+	}
+
+	progress := func(deleted int64) {
+		_, err := im.WDB.ExecContext(ctx, "UPDATE data_deletion_job SET deleted = deleted + ? WHERE id = ?", deleted, jobID)
+		if err != nil {
+			log.Warnw("Failed to record deletion progress", "error", err)
+		}
+	}
+	_, err = purgeChatHistories(ctx, store.Writer(), userID, nil, progress)
+	store.Wrote(ctx, userID)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if kind == DeletionKindUserData {
+		_, err := purgeSearches(ctx, store.Writer(), userID, progress)
+		store.Wrote(ctx, userID)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if err := websearch.ForgetRecentQueries(ctx, im.RedisClient, userID); err != nil {
+			fail(fmt.Errorf("failed to forget recent queries: %w", err))
+			return
+		}
+		if _, err := purgeReviewSamples(ctx, im.WDB, userID, progress); err != nil {
+			fail(err)
+			return
+		}
+		if _, err := im.purgeRequestMetadata(ctx, userID, nil, progress); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	_, err = im.WDB.ExecContext(ctx, `
+		UPDATE data_deletion_job SET status = ?, finished_at = NOW() WHERE id = ?
+	`, DeletionJobComplete, jobID)
+	if err != nil {
+		log.Errorw("Failed to mark deletion job complete", "error", err)
+		return
+	}
+	log.Infow("Deletion job complete")
+}
+
+// purgeChatHistories deletes the users histories last updated before, or all
+// of them when before is nil, shared.BulkDeleteBatchSize at a time. Messages go
+// in the same transaction as their history. progress is called after every
+// batch with the histories it deleted
+func purgeChatHistories(ctx context.Context, historyDB *sql.DB, userID uint64, before *time.Time, progress func(int64)) (int64, error) {
+	query := "SELECT history_id FROM chat_history WHERE user_id = ? LIMIT ?"
+	args := []any{userID, shared.BulkDeleteBatchSize}
+	if before != nil {
+		query = "SELECT history_id FROM chat_history WHERE user_id = ? AND COALESCE(updated_at, created_at) < ? LIMIT ?"
+		args = []any{userID, *before, shared.BulkDeleteBatchSize}
+	}
+
+	var purged int64
+	for {
+		rows, err := historyDB.QueryContext(ctx, query, args...)
+		if err != nil {
+			return purged, fmt.Errorf("failed to query histories: %w", err)
+		}
+		ids := []any{}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				_ = rows.Close()
+				return purged, fmt.Errorf("failed to scan history id: %w", err)
+			}
+			ids = append(ids, id)
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return purged, fmt.Errorf("failed iterating histories: %w", err)
+		}
+		if len(ids) == 0 {
+			return purged, nil
+		}
+
+		placeholders := "?" + strings.Repeat(", ?", len(ids)-1)
+		err = database.ExecuteTransaction(ctx, historyDB, []func(*sql.Tx) error{
+			func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, "DELETE FROM chat_message WHERE history_id IN ("+placeholders+")", ids...)
+				return err
+			},
+			func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, "DELETE FROM chat_history WHERE user_id = ? AND history_id IN ("+placeholders+")", append([]any{userID}, ids...)...)
+				return err
+			},
+		})
+		if err != nil {
+			return purged, fmt.Errorf("failed to delete histories: %w", err)
+		}
+		purged += int64(len(ids))
+		if progress != nil {
+			progress(int64(len(ids)))
+		}
+	}
+}
+
+// purgeSearches deletes every saved search of the user, including deleted
+// ones, shared.BulkDeleteBatchSize at a time
+func purgeSearches(ctx context.Context, historyDB *sql.DB, userID uint64, progress func(int64)) (int64, error) {
+	var purged int64
+	for {
+		res, err := historyDB.ExecContext(ctx, "DELETE FROM search WHERE user_id = ? LIMIT ?", userID, shared.BulkDeleteBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("failed to delete searches: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return purged, fmt.Errorf("failed to delete searches: %w", err)
+		}
+		if affected == 0 {
+			return purged, nil
+		}
+		purged += affected
+		if progress != nil {
+			progress(affected)
+		}
+	}
+}
+
+// purgeReviewSamples deletes the review samples taken from the users requests,
+// shared.BulkDeleteBatchSize at a time
+func purgeReviewSamples(ctx context.Context, db *sql.DB, userID uint64, progress func(int64)) (int64, error) {
+	var purged int64
+	for {
+		res, err := db.ExecContext(ctx, "DELETE FROM review_sample WHERE user_id = ? LIMIT ?", userID, shared.BulkDeleteBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("failed to delete review samples: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return purged, fmt.Errorf("failed to delete review samples: %w", err)
+		}
+		if affected == 0 {
+			return purged, nil
+		}
+		purged += affected
+		if progress != nil {
+			progress(affected)
+		}
+	}
+}
+
+// purgeRequestMetadata clears the metadata of the users requests made before,
+// or all of them when before is nil. The rows stay for billing and usage
+func (im *InferenceHandler) purgeRequestMetadata(ctx context.Context, userID uint64, before *time.Time, progress func(int64)) (int64, error) {
+	query := "UPDATE request SET metadata = NULL WHERE user_id = ? AND metadata IS NOT NULL LIMIT ?"
+	args := []any{userID, shared.BulkDeleteBatchSize}
+	if before != nil {
+		query = "UPDATE request SET metadata = NULL WHERE user_id = ? AND metadata IS NOT NULL AND created_at < ? LIMIT ?"
+		args = []any{userID, *before, shared.BulkDeleteBatchSize}
+	}
+
+	var purged int64
+	for {
+		res, err := im.WDB.ExecContext(ctx, query, args...)
+		if err != nil {
+			return purged, fmt.Errorf("failed to clear request metadata: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return purged, fmt.Errorf("failed to clear request metadata: %w", err)
+		}
+		if affected == 0 {
+			return purged, nil
+		}
+		purged += affected
+		if progress != nil {
+			progress(affected)
+		}
+	}
+}
+
+type GetDeletionJobInput struct {
+	Ctx    context.Context
+	UserID uint64
+	JobID  string
+}
+
+// GetDeletionJob returns the progress of one of the users deletion jobs
+func (im *InferenceHandler) GetDeletionJob(input GetDeletionJobInput) (*DeletionJob, error) {
+	job := &DeletionJob{ID: input.JobID}
+	// Read from the write database so progress is never behind
+	err := im.WDB.QueryRowContext(input.Ctx, `
+		SELECT kind, status, total, deleted, UNIX_TIMESTAMP(created_at), UNIX_TIMESTAMP(finished_at), error
+		FROM data_deletion_job
+		WHERE id = ? AND user_id = ?
+	`, input.JobID, input.UserID).Scan(&job.Kind, &job.Status, &job.Total, &job.Deleted, &job.CreatedAt, &job.FinishedAt, &job.Error)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("deletion job not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query deletion job"), err, shared.ErrInternalServerError)
+	}
+	return job, nil
+}
+
+// deletionJob reads a job that was just created or found, falling back to
+// its id when the read fails so the client can still poll it
+func (im *InferenceHandler) deletionJob(ctx context.Context, jobID string, userID uint64) *DeletionJob {
+	job, err := im.GetDeletionJob(GetDeletionJobInput{Ctx: ctx, UserID: userID, JobID: jobID})
+	if err != nil {
+		im.Log.Warnw("Failed to read deletion job", "error", err, "job_id", jobID)
+		return &DeletionJob{ID: jobID, Status: DeletionJobRunning}
+	}
+	return job
+}
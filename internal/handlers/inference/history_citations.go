@@ -0,0 +1,59 @@
+package inference
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sybil-api/internal/shared"
+)
+
+// Citation ties an inline marker like [2] in a search grounded answer to the
+// search result it refers to
+type Citation struct {
+	// The number inside the marker, the 1 based index of the source
+	Marker  int     `json:"marker"`
+	URL     *string `json:"url,omitempty"`
+	Title   *string `json:"title,omitempty"`
+	Website *string `json:"website,omitempty"`
+}
+
+// citationMarker matches [1] and grouped markers like [1, 3]
+var citationMarker = regexp.MustCompile(`\[(\d{1,3}(?:\s*,\s*\d{1,3})*)\]`)
+
+// extractCitations returns the sources cited in content in the order they are
+// first cited. Markers past the number of sources are ignored, models
+// sometimes invent them
+func extractCitations(content string, sources []shared.SearchResults) []Citation {
+	citations := []Citation{}
+	seen := map[int]bool{}
+	for _, match := range citationMarker.FindAllStringSubmatch(content, -1) {
+		for part := range strings.SplitSeq(match[1], ",") {
+			marker, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || marker < 1 || marker > len(sources) || seen[marker] {
+				continue
+			}
+			seen[marker] = true
+			source := sources[marker-1]
+			citations = append(citations, Citation{
+				Marker:  marker,
+				URL:     source.URL,
+				Title:   source.Title,
+				Website: source.Website,
+			})
+		}
+	}
+	return citations
+}
+
+// sendCitations ends a search grounded answer with the citations event, sent
+// even when nothing was cited so clients know the answer is final
+func sendCitations(streamWriter func(string) error, content string, sources []shared.SearchResults) {
+	if streamWriter == nil {
+		return
+	}
+	citationsJSON, _ := json.Marshal(map[string]any{"type": "citations", "citations": extractCitations(content, sources)})
+	_ = streamWriter(fmt.Sprintf("data: %s", citationsJSON))
+}
@@ -0,0 +1,197 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"sybil-api/internal/shared"
+	"sybil-api/internal/tokenizer"
+)
+
+type ContinueChatInput struct {
+	HistoryID string
+	// The users next message, unused when regenerating
+	Content string
+	// Replaces the stored settings when set
+	Settings     *shared.ChatSettings
+	User         shared.UserMetadata
+	RequestID    string
+	Ctx          context.Context
+	StreamWriter func(string) error
+	SearchLocale *shared.SearchLocale
+	SearchClient *shared.SearchClient
+}
+
+// ContinueChat adds a user message to a stored history and runs it through
+// Chat, so clients only send the new message instead of the whole
+// conversation. The oldest turns are left out of the prompt when the history
+// no longer fits the models context window, they stay in the history
+func (im *InferenceHandler) ContinueChat(input *ContinueChatInput) (*ChatOutput, error) {
+	history, err := im.storedChat(input)
+	if err != nil {
+		return nil, err
+	}
+	userMsg := shared.ChatMessage{Role: "user", Content: input.Content}
+	messages := append(promptMessages(history.Messages), userMsg)
+	return im.chatOnHistory(input, history, messages, []shared.ChatMessage{userMsg}, false)
+}
+
+// RegenerateChat replaces the last assistant reply of a stored history with a
+// new one for the same conversation. Content is not used
+func (im *InferenceHandler) RegenerateChat(input *ContinueChatInput) (*ChatOutput, error) {
+	history, err := im.storedChat(input)
+	if err != nil {
+		return nil, err
+	}
+	last := len(history.Messages) - 1
+	if last < 1 || history.Messages[last].Role != "assistant" {
+		return nil, &shared.RequestError{StatusCode: 400, Err: errors.New("history does not end with an assistant reply")}
+	}
+	messages := promptMessages(history.Messages[:last])
+	return im.chatOnHistory(input, history, messages, []shared.ChatMessage{}, true)
+}
+
+func (im *InferenceHandler) storedChat(input *ContinueChatInput) (*ChatHistoryRecord, error) {
+	history, err := im.GetChatHistory(GetChatHistoryInput{
+		Ctx:       input.Ctx,
+		User:      input.User,
+		HistoryID: input.HistoryID,
+	})
+	if err != nil {
+		if errors.Is(err, shared.ErrNotFound) {
+			return nil, &shared.RequestError{StatusCode: 404, Err: errors.New("history not found")}
+		}
+		return nil, err
+	}
+	return history, nil
+}
+
+// promptMessages strips the stored messages down to what the model needs.
+// Sources and models are stored for display only
+func promptMessages(stored []shared.ChatMessage) []shared.ChatMessage {
+	messages := make([]shared.ChatMessage, 0, len(stored)+1)
+	for _, msg := range stored {
+		messages = append(messages, shared.ChatMessage{Role: msg.Role, Content: msg.Content, Name: msg.Name})
+	}
+	return messages
+}
+
+// chatOnHistory trims messages to the models context window and runs them
+// through Chat, storing newMessages and the reply on the history
+func (im *InferenceHandler) chatOnHistory(input *ContinueChatInput, history *ChatHistoryRecord, messages []shared.ChatMessage, newMessages []shared.ChatMessage, replaceLastReply bool) (*ChatOutput, error) {
+	settings := input.Settings
+	if settings == nil {
+		settings = history.Settings
+	}
+	if settings == nil || settings.Model == "" {
+		return nil, &shared.RequestError{StatusCode: 400, Err: errors.New("settings.model is required, the history has no stored model")}
+	}
+
+	service, err := im.DiscoverModels(input.Ctx, input.User.UserID, settings.Model)
+	if err != nil {
+		return nil, errors.Join(&shared.RequestError{StatusCode: 404, Err: errors.New("model not found")}, err)
+	}
+	maxTokens := settings.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = shared.DefaultMaxTokens
+	}
+	messages, dropped, err := trimToContext(im.tokenizerFor(service), messages, service.ContextLength, maxTokens)
+	if err != nil {
+		return nil, &shared.RequestError{StatusCode: 400, Err: err}
+	}
+	if dropped > 0 && input.StreamWriter != nil {
+		trimmedJSON, _ := json.Marshal(map[string]any{"type": "trimmed", "dropped": dropped})
+		_ = input.StreamWriter(fmt.Sprintf("data: %s", trimmedJSON))
+	}
+
+	return im.Chat(&ChatInput{
+		ChatID:           input.HistoryID,
+		Messages:         messages,
+		NewMessages:      newMessages,
+		ReplaceLastReply: replaceLastReply,
+		Settings:         settings,
+		User:             input.User,
+		RequestID:        input.RequestID,
+		Ctx:              input.Ctx,
+		StreamWriter:     input.StreamWriter,
+		SearchLocale:     input.SearchLocale,
+		SearchClient:     input.SearchClient,
+	})
+}
+
+// trimToContext drops the oldest messages until the conversation, with room
+// for maxTokens of completion, fits the context length. System messages and
+// the last message are always kept, and a trimmed prompt never starts on an
+// assistant reply. Tokens are counted with the models local tokenizer so no
+// backend round trip is needed per message. Returns how many messages were
+// dropped
+func trimToContext(tok tokenizer.Tokenizer, messages []shared.ChatMessage, contextLength int, maxTokens int) ([]shared.ChatMessage, int, error) {
+	if contextLength <= 0 || len(messages) == 0 {
+		return messages, 0, nil
+	}
+
+	budget := uint64(contextLength)
+	reserved := uint64(max(maxTokens, 0))
+	if reserved >= budget {
+		return nil, 0, fmt.Errorf("max_tokens %d does not fit the context length %d", maxTokens, contextLength)
+	}
+	budget -= reserved
+
+	last := len(messages) - 1
+	var used uint64
+	for i, msg := range messages {
+		if msg.Role == "system" || i == last {
+			used += estimateTokens(tok, tokenizeRequest{Messages: []shared.ChatMessage{msg}})
+		}
+	}
+	if used > budget {
+		return nil, 0, fmt.Errorf("the message does not fit the context length %d", contextLength)
+	}
+
+	// Walk back from the newest message, keeping turns while they fit
+	keep := make([]bool, len(messages))
+	keep[last] = true
+	for i := last - 1; i >= 0; i-- {
+		if messages[i].Role == "system" {
+			keep[i] = true
+			continue
+		}
+		tokens := estimateTokens(tok, tokenizeRequest{Messages: []shared.ChatMessage{messages[i]}})
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		keep[i] = true
+	}
+	// Older system messages are still kept when the walk stopped early
+	for i, msg := range messages {
+		if msg.Role == "system" {
+			keep[i] = true
+		}
+	}
+
+	// Once turns are dropped the first one kept must be the users
+	leading := false
+	for i := range keep {
+		if !keep[i] {
+			leading = true
+			break
+		}
+	}
+	trimmed := make([]shared.ChatMessage, 0, len(messages))
+	for i, msg := range messages {
+		if !keep[i] {
+			continue
+		}
+		if leading && msg.Role == "assistant" && i != last {
+			continue
+		}
+		if msg.Role != "system" {
+			leading = false
+		}
+		trimmed = append(trimmed, msg)
+	}
+	return trimmed, len(messages) - len(trimmed), nil
+}
@@ -0,0 +1,262 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/shared"
+
+	"github.com/aidarkhanov/nanoid"
+)
+
+// Imports accept a ChatGPT data export conversations.json as is, or a simple
+// transcript of {"title", "messages": [{"role", "content"}]} conversations,
+// either as a top level array or under "conversations". Both kinds can be
+// mixed, conversations with a mapping are read as ChatGPT exports
+
+type importConversation struct {
+	Title      string               `json:"title"`
+	CreateTime *float64             `json:"create_time"`
+	UpdateTime *float64             `json:"update_time"`
+	Messages   []shared.ChatMessage `json:"messages"`
+
+	// ChatGPT export tree, walked back from the current node
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+	CurrentNode string                 `json:"current_node"`
+}
+
+type chatGPTNode struct {
+	Parent  *string `json:"parent"`
+	Message *struct {
+		Author struct {
+			Role string `json:"role"`
+		} `json:"author"`
+		Content struct {
+			ContentType string `json:"content_type"`
+			Parts       []any  `json:"parts"`
+		} `json:"content"`
+	} `json:"message"`
+}
+
+// ImportError points at a conversation that could not be imported
+type ImportError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+type ImportedHistory struct {
+	ID       string  `json:"id"`
+	Title    *string `json:"title"`
+	Messages int     `json:"messages"`
+}
+
+type ImportChatHistoriesInput struct {
+	Ctx  context.Context
+	User shared.UserMetadata
+	Body []byte
+}
+
+type ImportChatHistoriesOutput struct {
+	Data   []ImportedHistory `json:"data"`
+	Errors []ImportError     `json:"errors,omitempty"`
+}
+
+// ImportChatHistories creates a history for every conversation in the body.
+// Everything is validated before anything is written, so an import with an
+// invalid conversation creates nothing and reports each one that failed.
+// Each history is then written in its own transaction
+func (im *InferenceHandler) ImportChatHistories(input ImportChatHistoriesInput) (*ImportChatHistoriesOutput, error) {
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return nil, err
+	}
+	if input.User.EncryptHistory && im.HistoryKeyring == nil {
+		return nil, errors.Join(errors.New("chat history encryption is not available"), shared.ErrInternalServerError)
+	}
+
+	conversations, err := parseImport(input.Body)
+	if err != nil {
+		return nil, errors.Join(err, shared.ErrBadRequest)
+	}
+	if len(conversations) == 0 {
+		return nil, errors.Join(errors.New("no conversations to import"), shared.ErrBadRequest)
+	}
+	if len(conversations) > shared.ChatImportMaxConversations {
+		return nil, errors.Join(fmt.Errorf("at most %d conversations can be imported at once", shared.ChatImportMaxConversations), shared.ErrBadRequest)
+	}
+
+	output := &ImportChatHistoriesOutput{Data: []ImportedHistory{}}
+	messages := make([][]shared.ChatMessage, len(conversations))
+	for i, conversation := range conversations {
+		messages[i], err = conversation.chatMessages()
+		if err != nil {
+			output.Errors = append(output.Errors, ImportError{Index: i, Error: err.Error()})
+		}
+	}
+	if len(output.Errors) > 0 {
+		return output, errors.Join(errors.New("invalid conversations"), shared.ErrBadRequest)
+	}
+
+	redactor := im.redactor(input.User, "import")
+	for i, conversation := range conversations {
+		messages[i] = im.redactMessages(input.Ctx, redactor, messages[i])
+		historyNano, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 11)
+		if err != nil {
+			return output, errors.Join(errors.New("failed to generate history id"), err, shared.ErrInternalServerError)
+		}
+		imported := ImportedHistory{ID: "chat-" + historyNano, Messages: len(messages[i])}
+		if title := truncateRunes(strings.TrimSpace(im.redactText(input.Ctx, redactor, "chat_title", conversation.Title)), shared.ChatTitleMaxLength); title != "" {
+			imported.Title = &title
+		}
+		createdAt, updatedAt := importTime(conversation.CreateTime), importTime(conversation.UpdateTime)
+		if updatedAt == nil {
+			updatedAt = createdAt
+		}
+
+		err = database.ExecuteTransaction(input.Ctx, store.Writer(), []func(*sql.Tx) error{
+			func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(input.Ctx, `
+					INSERT INTO chat_history (user_id, history_id, messages, title, created_at, updated_at)
+					VALUES (?, ?, '[]', ?, COALESCE(?, NOW()), ?)
+				`, input.User.UserID, imported.ID, imported.Title, createdAt, updatedAt)
+				return err
+			},
+			func(tx *sql.Tx) error {
+				return im.appendChatMessages(input.Ctx, tx, imported.ID, messages[i], input.User.EncryptHistory)
+			},
+		})
+		if err != nil {
+			// Histories imported so far are kept, the client can retry the rest
+			return output, errors.Join(fmt.Errorf("failed to import conversation %d", i), err, shared.ErrInternalServerError)
+		}
+		output.Data = append(output.Data, imported)
+		store.Wrote(input.Ctx, input.User.UserID)
+	}
+	return output, nil
+}
+
+func parseImport(body []byte) ([]importConversation, error) {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") {
+		var conversations []importConversation
+		if err := json.Unmarshal(body, &conversations); err != nil {
+			return nil, errors.New("invalid conversations json")
+		}
+		return conversations, nil
+	}
+	var wrapped struct {
+		Conversations []importConversation `json:"conversations"`
+	}
+	if err := json.Unmarshal(body, &wrapped); err != nil {
+		return nil, errors.New("invalid conversations json")
+	}
+	return wrapped.Conversations, nil
+}
+
+// chatMessages returns the conversation as history messages. Only user,
+// assistant and system text is kept, tool calls and attachments in ChatGPT
+// exports are dropped
+func (c importConversation) chatMessages() ([]shared.ChatMessage, error) {
+	messages := c.Messages
+	if c.Mapping != nil {
+		var err error
+		messages, err = c.chatGPTMessages()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for i, msg := range messages {
+			if msg.Role != "user" && msg.Role != "assistant" && msg.Role != "system" {
+				return nil, fmt.Errorf("message %d has unsupported role %q", i, msg.Role)
+			}
+		}
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("conversation has no messages")
+	}
+	if len(messages) > shared.ChatImportMaxMessages {
+		return nil, fmt.Errorf("conversation has more than %d messages", shared.ChatImportMaxMessages)
+	}
+	return messages, nil
+}
+
+func (c importConversation) chatGPTMessages() ([]shared.ChatMessage, error) {
+	current := c.CurrentNode
+	if current == "" {
+		// Exports without a current node fall back to the first leaf
+		parents := map[string]bool{}
+		for _, node := range c.Mapping {
+			if node.Parent != nil {
+				parents[*node.Parent] = true
+			}
+		}
+		leaves := []string{}
+		for id := range c.Mapping {
+			if !parents[id] {
+				leaves = append(leaves, id)
+			}
+		}
+		sort.Strings(leaves)
+		if len(leaves) > 0 {
+			current = leaves[0]
+		}
+	}
+
+	messages := []shared.ChatMessage{}
+	seen := map[string]bool{}
+	for id := current; id != ""; {
+		if seen[id] {
+			return nil, errors.New("conversation mapping has a cycle")
+		}
+		seen[id] = true
+		node, ok := c.Mapping[id]
+		if !ok {
+			return nil, fmt.Errorf("conversation mapping is missing node %s", id)
+		}
+		if msg := node.Message; msg != nil && msg.Content.ContentType == "text" {
+			role := msg.Author.Role
+			var parts []string
+			for _, part := range msg.Content.Parts {
+				if text, ok := part.(string); ok && text != "" {
+					parts = append(parts, text)
+				}
+			}
+			if (role == "user" || role == "assistant" || role == "system") && len(parts) > 0 {
+				messages = append(messages, shared.ChatMessage{Role: role, Content: strings.Join(parts, "\n")})
+			}
+		}
+		if len(seen) > shared.ChatImportMaxMessages*4 {
+			return nil, fmt.Errorf("conversation has more than %d messages", shared.ChatImportMaxMessages)
+		}
+		id = ""
+		if node.Parent != nil {
+			id = *node.Parent
+		}
+	}
+
+	// Walked from the newest message back to the root
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// importTime converts export unix seconds to a time, nil when unset or not
+// plausible
+func importTime(seconds *float64) *time.Time {
+	if seconds == nil || *seconds <= 0 {
+		return nil
+	}
+	t := time.Unix(int64(*seconds), 0).UTC()
+	if t.After(time.Now()) {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,268 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+)
+
+// Histories store one chat_message row per message, ordered by seq, so turns
+// are appended instead of rewriting the whole conversation. Histories written
+// before chat_message existed keep their messages in the chat_history.messages
+// blob until they are next appended to or backfilled. Regenerated replies
+// mark the reply they replace superseded rather than deleting it
+
+// turnMessages returns the messages a chat request adds to an existing
+// history, the ones after the last assistant reply the client sent back.
+// Earlier messages are already stored, so edits to them are not persisted
+func turnMessages(messages []shared.ChatMessage) []shared.ChatMessage {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "assistant" {
+			return messages[i+1:]
+		}
+	}
+	return messages
+}
+
+// appendChatMessages appends messages to a history in tx. The history row is
+// locked first so concurrent turns are appended one after the other rather
+// than racing for the same seq. Legacy blob histories are moved to
+// chat_message before appending
+func (im *InferenceHandler) appendChatMessages(ctx context.Context, tx *sql.Tx, historyID string, messages []shared.ChatMessage, encrypt bool) error {
+	var blob sql.NullString
+	var blobKeyID, blobDataKey sql.NullString
+	err := tx.QueryRowContext(ctx, `
+		SELECT messages, encryption_key_id, encrypted_data_key FROM chat_history WHERE history_id = ? FOR UPDATE
+	`, historyID).Scan(&blob, &blobKeyID, &blobDataKey)
+	if err != nil {
+		return fmt.Errorf("failed to lock history: %w", err)
+	}
+
+	var next int64
+	var stored int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(seq) + 1, 0), COUNT(*) FROM chat_message WHERE history_id = ?
+	`, historyID).Scan(&next, &stored)
+	if err != nil {
+		return fmt.Errorf("failed to query message sequence: %w", err)
+	}
+
+	if stored == 0 && blob.Valid && blob.String != "" {
+		legacy, err := im.openLegacyMessages(blob.String, blobKeyID, blobDataKey)
+		if err != nil {
+			return fmt.Errorf("failed to read legacy history: %w", err)
+		}
+		// Legacy encrypted histories stay encrypted when moved
+		messages = append(legacy, messages...)
+		encrypt = encrypt || blobKeyID.Valid
+	}
+
+	for _, msg := range messages {
+		messageJSON, keyID, dataKey, err := im.sealMessage(msg, encrypt)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO chat_message (history_id, seq, role, message, encryption_key_id, encrypted_data_key)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, historyID, next, msg.Role, messageJSON, keyID, dataKey)
+		if err != nil {
+			return fmt.Errorf("failed to append message: %w", err)
+		}
+		next++
+	}
+	return nil
+}
+
+// supersedeLastReply marks the last assistant message of a history superseded
+// so a regenerated reply takes its place. The history must already be locked
+// by appendChatMessages in tx
+func supersedeLastReply(ctx context.Context, tx *sql.Tx, historyID string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE chat_message SET superseded_at = NOW()
+		WHERE history_id = ? AND role = 'assistant' AND superseded_at IS NULL
+		ORDER BY seq DESC
+		LIMIT 1
+	`, historyID)
+	if err != nil {
+		return fmt.Errorf("failed to supersede reply: %w", err)
+	}
+	return nil
+}
+
+// readChatMessages returns the messages of a history in order, falling back to
+// the legacy blob when the history has no chat_message rows. encrypted
+// reports whether any of them were stored encrypted
+func (im *InferenceHandler) readChatMessages(ctx context.Context, db *sql.DB, historyID string, blob string, blobKeyID, blobDataKey sql.NullString) ([]shared.ChatMessage, bool, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT message, encryption_key_id, encrypted_data_key
+		FROM chat_message
+		WHERE history_id = ? AND superseded_at IS NULL
+		ORDER BY seq ASC
+	`, historyID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	messages := []shared.ChatMessage{}
+	encrypted := false
+	for rows.Next() {
+		var messageJSON string
+		var keyID, dataKey sql.NullString
+		if err := rows.Scan(&messageJSON, &keyID, &dataKey); err != nil {
+			return nil, false, fmt.Errorf("failed to scan message: %w", err)
+		}
+		msg, err := im.openMessage(messageJSON, keyID, dataKey)
+		if err != nil {
+			return nil, false, err
+		}
+		encrypted = encrypted || keyID.Valid
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("failed iterating messages: %w", err)
+	}
+	if len(messages) > 0 || blob == "" {
+		return messages, encrypted, nil
+	}
+
+	messages, err = im.openLegacyMessages(blob, blobKeyID, blobDataKey)
+	if err != nil {
+		return nil, false, err
+	}
+	return messages, blobKeyID.Valid, nil
+}
+
+// sealMessage returns the stored form of a message. Encrypted messages store
+// the ciphertext as a json string, with the key id and wrapped data key
+// alongside
+func (im *InferenceHandler) sealMessage(msg shared.ChatMessage, encrypt bool) (string, *string, *string, error) {
+	messageJSON, err := json.Marshal(msg)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	if !encrypt {
+		return string(messageJSON), nil, nil, nil
+	}
+	if im.HistoryKeyring == nil {
+		return "", nil, nil, errors.New("history encryption is not configured")
+	}
+	sealed, err := im.HistoryKeyring.Seal(messageJSON)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to encrypt message: %w", err)
+	}
+	ciphertextJSON, err := json.Marshal(sealed.Ciphertext)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to marshal encrypted message: %w", err)
+	}
+	return string(ciphertextJSON), &sealed.KeyID, &sealed.DataKey, nil
+}
+
+func (im *InferenceHandler) openMessage(messageJSON string, keyID, dataKey sql.NullString) (shared.ChatMessage, error) {
+	var msg shared.ChatMessage
+	plaintext, err := im.openStored(messageJSON, keyID, dataKey)
+	if err != nil {
+		return msg, err
+	}
+	if err := json.Unmarshal(plaintext, &msg); err != nil {
+		return msg, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	return msg, nil
+}
+
+func (im *InferenceHandler) openLegacyMessages(blob string, keyID, dataKey sql.NullString) ([]shared.ChatMessage, error) {
+	plaintext, err := im.openStored(blob, keyID, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	var messages []shared.ChatMessage
+	if err := json.Unmarshal(plaintext, &messages); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal history messages: %w", err)
+	}
+	return messages, nil
+}
+
+// openStored decrypts a stored json value when it was written encrypted
+func (im *InferenceHandler) openStored(stored string, keyID, dataKey sql.NullString) ([]byte, error) {
+	if !keyID.Valid {
+		return []byte(stored), nil
+	}
+	if im.HistoryKeyring == nil {
+		return nil, errors.New("history encryption is not configured")
+	}
+	var ciphertext string
+	if err := json.Unmarshal([]byte(stored), &ciphertext); err != nil {
+		return nil, fmt.Errorf("failed to read encrypted history: %w", err)
+	}
+	plaintext, err := im.HistoryKeyring.Open(shared.SealedPayload{KeyID: keyID.String, DataKey: dataKey.String, Ciphertext: ciphertext})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt history: %w", err)
+	}
+	return plaintext, nil
+}
+
+// BackfillChatMessages moves legacy blob histories in db to chat_message and
+// returns how many were moved. Histories are read batchSize at a time and each
+// is moved in its own transaction. The blob is left in place so the move can
+// be rolled back by deleting the rows
+func BackfillChatMessages(ctx context.Context, db *sql.DB, keyring *shared.Keyring, log *zap.SugaredLogger, batchSize int) (int, error) {
+	im := &InferenceHandler{HistoryKeyring: keyring, Log: log}
+	moved := 0
+	cursor := ""
+	for {
+		rows, err := db.QueryContext(ctx, `
+			SELECT chat_history.history_id FROM chat_history
+			WHERE chat_history.history_id > ? AND chat_history.messages IS NOT NULL AND chat_history.messages != '[]'
+			AND NOT EXISTS (SELECT 1 FROM chat_message WHERE chat_message.history_id = chat_history.history_id)
+			ORDER BY chat_history.history_id ASC
+			LIMIT ?
+		`, cursor, batchSize)
+		if err != nil {
+			return moved, fmt.Errorf("failed to query legacy histories: %w", err)
+		}
+		ids := []string{}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				_ = rows.Close()
+				return moved, fmt.Errorf("failed to scan history id: %w", err)
+			}
+			ids = append(ids, id)
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return moved, fmt.Errorf("failed iterating legacy histories: %w", err)
+		}
+		if len(ids) == 0 {
+			return moved, nil
+		}
+
+		for _, id := range ids {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return moved, fmt.Errorf("failed to begin transaction: %w", err)
+			}
+			if err := im.appendChatMessages(ctx, tx, id, nil, false); err != nil {
+				_ = tx.Rollback()
+				log.Warnw("Failed to backfill history, skipping", "error", err, "history_id", id)
+				continue
+			}
+			if err := tx.Commit(); err != nil {
+				return moved, fmt.Errorf("failed to commit backfill: %w", err)
+			}
+			moved++
+		}
+		cursor = ids[len(ids)-1]
+		log.Infow("Backfilled chat histories", "moved", moved, "cursor", cursor)
+	}
+}
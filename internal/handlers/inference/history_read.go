@@ -0,0 +1,215 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"sybil-api/internal/shared"
+)
+
+type ChatHistoryRecord struct {
+	ID        string               `json:"id"`
+	Title     *string              `json:"title"`
+	Messages  []shared.ChatMessage `json:"messages"`
+	Settings  *shared.ChatSettings `json:"settings,omitempty"`
+	Encrypted bool                 `json:"encrypted"`
+	// Lineage of branched histories. ParentID and BranchedFrom are set on
+	// branches, Branches lists the histories forked from this one
+	ParentID     *string      `json:"parent_id"`
+	BranchedFrom *int         `json:"branched_from"`
+	Branches     []ChatBranch `json:"branches"`
+}
+
+// ChatHistorySummary is a history as listed, without its messages
+type ChatHistorySummary struct {
+	ID    string  `json:"id"`
+	Title *string `json:"title"`
+	Icon  *string `json:"icon"`
+	// Start of the last message. Encrypted histories are listed without one so
+	// listing never decrypts
+	Preview   *string `json:"preview"`
+	Encrypted bool    `json:"encrypted"`
+	ParentID  *string `json:"parent_id"`
+	CreatedAt int64   `json:"created_at"`
+	UpdatedAt int64   `json:"updated_at"`
+}
+
+type ListChatHistoriesInput struct {
+	Ctx    context.Context
+	User   shared.UserMetadata
+	Limit  int
+	Offset int
+}
+
+type ListChatHistoriesOutput struct {
+	Data    []ChatHistorySummary `json:"data"`
+	HasMore bool                 `json:"has_more"`
+}
+
+type GetChatHistoryInput struct {
+	Ctx       context.Context
+	User      shared.UserMetadata
+	HistoryID string
+}
+
+// ListChatHistories returns a page of the users histories, most recently
+// updated first
+func (im *InferenceHandler) ListChatHistories(input ListChatHistoriesInput) (*ListChatHistoriesOutput, error) {
+	log := shared.LoggerFromContext(input.Ctx, im.Log)
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return nil, err
+	}
+	limit := input.Limit
+	if limit <= 0 || limit > shared.MaxPageSize {
+		limit = shared.DefaultPageSize
+	}
+	offset := max(input.Offset, 0)
+
+	// The preview comes from the last chat_message row, or the legacy blob for
+	// histories that have none. Fetch one extra row to know if there is
+	// another page
+	output := &ListChatHistoriesOutput{}
+	err = store.Read(input.Ctx, input.User.UserID, func(db *sql.DB) error {
+		output.Data = []ChatHistorySummary{}
+		rows, err := db.QueryContext(input.Ctx, `
+		SELECT chat_history.history_id, chat_history.title, chat_history.icon, chat_history.parent_history_id,
+			IF(last_message.id IS NULL,
+				IF(chat_history.encryption_key_id IS NULL, LEFT(JSON_UNQUOTE(JSON_EXTRACT(chat_history.messages, '$[last].content')), ?), NULL),
+				IF(last_message.encryption_key_id IS NULL, LEFT(JSON_UNQUOTE(JSON_EXTRACT(last_message.message, '$.content')), ?), NULL)),
+			IF(last_message.id IS NULL, chat_history.encryption_key_id IS NOT NULL, last_message.encryption_key_id IS NOT NULL),
+			UNIX_TIMESTAMP(chat_history.created_at), UNIX_TIMESTAMP(COALESCE(chat_history.updated_at, chat_history.created_at))
+		FROM chat_history
+		LEFT JOIN chat_message AS last_message ON last_message.history_id = chat_history.history_id
+			AND last_message.seq = (SELECT MAX(seq) FROM chat_message WHERE chat_message.history_id = chat_history.history_id AND chat_message.superseded_at IS NULL)
+		WHERE chat_history.user_id = ? AND chat_history.deleted_at IS NULL
+		ORDER BY COALESCE(chat_history.updated_at, chat_history.created_at) DESC, chat_history.history_id ASC
+		LIMIT ? OFFSET ?
+	`, shared.ChatHistoryPreviewLength, shared.ChatHistoryPreviewLength, input.User.UserID, limit+1, offset)
+		if err != nil {
+			return errors.Join(errors.New("failed to query histories"), err)
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+
+		for rows.Next() {
+			var summary ChatHistorySummary
+			if err := rows.Scan(&summary.ID, &summary.Title, &summary.Icon, &summary.ParentID, &summary.Preview, &summary.Encrypted,
+				&summary.CreatedAt, &summary.UpdatedAt); err != nil {
+				log.Warnw("Failed to scan history row", "error", err)
+				continue
+			}
+			output.Data = append(output.Data, summary)
+		}
+		if err := rows.Err(); err != nil {
+			return errors.Join(errors.New("failed iterating history rows"), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(err, shared.ErrInternalServerError)
+	}
+	if len(output.Data) > limit {
+		output.Data = output.Data[:limit]
+		output.HasMore = true
+	}
+	return output, nil
+}
+
+// DeleteChatHistory soft deletes a users history. Deleted histories can no
+// longer be read, listed or continued
+func (im *InferenceHandler) DeleteChatHistory(input GetChatHistoryInput) error {
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return err
+	}
+	res, err := store.Writer().ExecContext(input.Ctx, `
+		UPDATE chat_history SET deleted_at = NOW()
+		WHERE history_id = ? AND user_id = ? AND deleted_at IS NULL
+	`, input.HistoryID, input.User.UserID)
+	if err != nil {
+		return errors.Join(errors.New("failed to delete history"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return errors.Join(errors.New("history not found"), shared.ErrNotFound)
+	}
+	store.Wrote(input.Ctx, input.User.UserID)
+	return nil
+}
+
+// GetChatHistory returns a users chat history, decrypting the messages when the
+// row was written with history encryption
+func (im *InferenceHandler) GetChatHistory(input GetChatHistoryInput) (*ChatHistoryRecord, error) {
+	log := shared.LoggerFromContext(input.Ctx, im.Log)
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return nil, err
+	}
+
+	// The history, its messages and branches are read from the same database
+	// so they agree with each other
+	record := &ChatHistoryRecord{ID: input.HistoryID}
+	var settings sql.NullString
+	err = store.Read(input.Ctx, input.User.UserID, func(db *sql.DB) error {
+		var messages, keyID, dataKey sql.NullString
+		err := db.QueryRowContext(input.Ctx, `
+			SELECT title, messages, settings, encryption_key_id, encrypted_data_key, parent_history_id, branched_from
+			FROM chat_history
+			WHERE history_id = ? AND user_id = ? AND deleted_at IS NULL
+		`, input.HistoryID, input.User.UserID).Scan(&record.Title, &messages, &settings, &keyID, &dataKey, &record.ParentID, &record.BranchedFrom)
+		if err != nil {
+			return err
+		}
+
+		record.Messages, record.Encrypted, err = im.readChatMessages(input.Ctx, db, input.HistoryID, messages.String, keyID, dataKey)
+		if err != nil {
+			return errors.Join(errors.New("failed to read history messages"), err)
+		}
+		record.Branches, err = im.chatBranches(input.Ctx, db, input.HistoryID, input.User.UserID)
+		if err != nil {
+			return errors.Join(errors.New("failed to read history branches"), err)
+		}
+		return nil
+	})
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("history not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query history"), err, shared.ErrInternalServerError)
+	}
+	if settings.Valid && settings.String != "" {
+		if err := json.Unmarshal([]byte(settings.String), &record.Settings); err != nil {
+			log.Warnw("Failed to unmarshal history settings", "error", err, "history_id", input.HistoryID)
+		}
+	}
+	return record, nil
+}
+
+// chatBranches lists the histories forked from a history, oldest first
+func (im *InferenceHandler) chatBranches(ctx context.Context, db *sql.DB, historyID string, userID uint64) ([]ChatBranch, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT history_id, branched_from, UNIX_TIMESTAMP(created_at)
+		FROM chat_history
+		WHERE parent_history_id = ? AND user_id = ? AND deleted_at IS NULL
+		ORDER BY created_at ASC, history_id ASC
+	`, historyID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	branches := []ChatBranch{}
+	for rows.Next() {
+		var branch ChatBranch
+		if err := rows.Scan(&branch.ID, &branch.BranchedFrom, &branch.CreatedAt); err != nil {
+			return nil, err
+		}
+		branches = append(branches, branch)
+	}
+	return branches, rows.Err()
+}
@@ -0,0 +1,182 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"sybil-api/internal/shared"
+
+	"github.com/aidarkhanov/nanoid"
+)
+
+// Shared histories are read by anyone holding the token, without an account.
+// The chat_share row lives in the default database so a token resolves
+// without knowing the owners region, the transcript is read from wherever the
+// history is stored
+
+// ChatShare is an active share link of a history
+type ChatShare struct {
+	Token     string `json:"token"`
+	HistoryID string `json:"history_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// SharedChat is the transcript shown to share link visitors. Only the
+// conversation is included, never the owner, settings or system messages
+type SharedChat struct {
+	Title     *string         `json:"title"`
+	Messages  []SharedMessage `json:"messages"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+type SharedMessage struct {
+	Role    string                 `json:"role"`
+	Content string                 `json:"content"`
+	Model   string                 `json:"model,omitempty"`
+	Sources []shared.SearchResults `json:"sources,omitempty"`
+}
+
+// ShareChatHistory returns the active share link of a users history, creating
+// one when there is none so sharing twice hands out the same link
+func (im *InferenceHandler) ShareChatHistory(input GetChatHistoryInput) (*ChatShare, error) {
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return nil, err
+	}
+	var exists bool
+	err = store.Read(input.Ctx, input.User.UserID, func(db *sql.DB) error {
+		return db.QueryRowContext(input.Ctx, `
+			SELECT true FROM chat_history WHERE history_id = ? AND user_id = ? AND deleted_at IS NULL
+		`, input.HistoryID, input.User.UserID).Scan(&exists)
+	})
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("history not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query history"), err, shared.ErrInternalServerError)
+	}
+
+	share, err := im.activeChatShare(input.Ctx, input.HistoryID, input.User.UserID)
+	if err != nil || share != nil {
+		return share, err
+	}
+
+	tokenNano, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ", shared.ChatShareTokenLength)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to generate share token"), err, shared.ErrInternalServerError)
+	}
+	_, err = im.WDB.ExecContext(input.Ctx, `
+		INSERT INTO chat_share (token, history_id, user_id, data_residency)
+		VALUES (?, ?, ?, ?)
+	`, "sh_"+tokenNano, input.HistoryID, input.User.UserID, input.User.DataResidency)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to insert chat share"), err, shared.ErrInternalServerError)
+	}
+	share, err = im.activeChatShare(input.Ctx, input.HistoryID, input.User.UserID)
+	if err == nil && share == nil {
+		err = errors.Join(errors.New("chat share missing after insert"), shared.ErrInternalServerError)
+	}
+	return share, err
+}
+
+// activeChatShare reads from the write database so a share made a moment
+// ago is found. Concurrent shares of one history can each insert a token,
+// the oldest is the one handed out
+func (im *InferenceHandler) activeChatShare(ctx context.Context, historyID string, userID uint64) (*ChatShare, error) {
+	share := &ChatShare{HistoryID: historyID}
+	err := im.WDB.QueryRowContext(ctx, `
+		SELECT token, UNIX_TIMESTAMP(created_at) FROM chat_share
+		WHERE history_id = ? AND user_id = ? AND revoked_at IS NULL
+		ORDER BY created_at ASC, token ASC
+		LIMIT 1
+	`, historyID, userID).Scan(&share.Token, &share.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query chat share"), err, shared.ErrInternalServerError)
+	}
+	return share, nil
+}
+
+// RevokeChatShare disables every share link of a users history. Visitors get
+// a not found from then on
+func (im *InferenceHandler) RevokeChatShare(input GetChatHistoryInput) error {
+	res, err := im.WDB.ExecContext(input.Ctx, `
+		UPDATE chat_share SET revoked_at = NOW()
+		WHERE history_id = ? AND user_id = ? AND revoked_at IS NULL
+	`, input.HistoryID, input.User.UserID)
+	if err != nil {
+		return errors.Join(errors.New("failed to revoke chat share"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return errors.Join(errors.New("chat share not found"), shared.ErrNotFound)
+	}
+	return nil
+}
+
+type GetSharedChatInput struct {
+	Ctx   context.Context
+	Token string
+}
+
+// GetSharedChat returns the sanitized transcript behind a share token. Revoked
+// tokens and deleted histories are not found. Encrypted histories are
+// decrypted, the owner chose to make them public by sharing
+func (im *InferenceHandler) GetSharedChat(input GetSharedChatInput) (*SharedChat, error) {
+	var historyID, region string
+	var userID uint64
+	err := im.RDB.QueryRowContext(input.Ctx, `
+		SELECT history_id, user_id, data_residency FROM chat_share
+		WHERE token = ? AND revoked_at IS NULL
+	`, input.Token).Scan(&historyID, &userID, &region)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("chat share not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query chat share"), err, shared.ErrInternalServerError)
+	}
+
+	store, err := im.regionHistoryStore(region)
+	if err != nil {
+		return nil, err
+	}
+	// Read as the owner, so a chat shared right after it was written is found
+	chat := &SharedChat{Messages: []SharedMessage{}}
+	var stored []shared.ChatMessage
+	err = store.Read(input.Ctx, userID, func(db *sql.DB) error {
+		var messages, keyID, dataKey sql.NullString
+		err := db.QueryRowContext(input.Ctx, `
+			SELECT title, messages, encryption_key_id, encrypted_data_key, UNIX_TIMESTAMP(created_at)
+			FROM chat_history
+			WHERE history_id = ? AND user_id = ? AND deleted_at IS NULL
+		`, historyID, userID).Scan(&chat.Title, &messages, &keyID, &dataKey, &chat.CreatedAt)
+		if err != nil {
+			return err
+		}
+		stored, _, err = im.readChatMessages(input.Ctx, db, historyID, messages.String, keyID, dataKey)
+		if err != nil {
+			return errors.Join(errors.New("failed to read history messages"), err)
+		}
+		return nil
+	})
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("chat share not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query history"), err, shared.ErrInternalServerError)
+	}
+	for _, msg := range stored {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			continue
+		}
+		chat.Messages = append(chat.Messages, SharedMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+			Model:   msg.Model,
+			Sources: msg.Sources,
+		})
+	}
+	return chat, nil
+}
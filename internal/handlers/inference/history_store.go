@@ -0,0 +1,118 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// HistoryStore is where the chat histories of one region are written and
+// read. Writes go to the primary and reads to the replica, except for users
+// who wrote within shared.HistoryReadYourWritesWindow while the replica lags,
+// whose reads go to the primary so a history they just created or changed
+// reads back as written. Regional databases have no replica and always use
+// the primary
+type HistoryStore struct {
+	primary *sql.DB
+	replica *sql.DB
+	redis   *redis.Client
+	log     *zap.SugaredLogger
+	// Nil treats the replica as always lagging for recent writers
+	lag *database.LagMonitor
+}
+
+// historyStore returns the store of the region the users history lives in
+func (im *InferenceHandler) historyStore(user shared.UserMetadata) (*HistoryStore, error) {
+	return im.regionHistoryStore(user.DataResidency)
+}
+
+// regionHistoryStore returns the store of region, empty for the default
+// databases
+func (im *InferenceHandler) regionHistoryStore(region string) (*HistoryStore, error) {
+	historyDB, ok := im.ResidencyDBs.For(region, im.WDB)
+	if !ok {
+		return nil, errors.Join(fmt.Errorf("chat history storage for region %s is not available", region), shared.ErrInternalServerError)
+	}
+	store := &HistoryStore{primary: historyDB, replica: im.RDB, redis: im.RedisClient, log: im.Log, lag: im.Lag}
+	if region != "" {
+		store.replica = historyDB
+	}
+	return store, nil
+}
+
+// Writer is the database to write and run transactions on. Call Wrote once
+// the write succeeded
+func (s *HistoryStore) Writer() *sql.DB {
+	return s.primary
+}
+
+// Wrote sends the users reads to the primary until the replica has caught up
+// with what they just wrote
+func (s *HistoryStore) Wrote(ctx context.Context, userID uint64) {
+	if s.replica == s.primary {
+		return
+	}
+	if err := s.redis.Set(ctx, historyWroteKey(userID), 1, shared.HistoryReadYourWritesWindow).Err(); err != nil {
+		s.log.Warnw("Failed to record history write", "error", err, "user_id", userID)
+	}
+}
+
+// Read runs read against the database the users histories should be read
+// from. Replica reads that find no row or fail on replication lag are retried
+// on the primary, the row may only exist there yet
+func (s *HistoryStore) Read(ctx context.Context, userID uint64, read func(db *sql.DB) error) error {
+	db := s.reader(ctx, userID)
+	err := read(db)
+	if db == s.primary || !(errors.Is(err, sql.ErrNoRows) || isReplicaLagError(err)) {
+		return err
+	}
+	metrics.HistoryReads.WithLabelValues("retry_primary").Inc()
+	return read(s.primary)
+}
+
+func (s *HistoryStore) reader(ctx context.Context, userID uint64) *sql.DB {
+	if s.replica == s.primary {
+		metrics.HistoryReads.WithLabelValues("primary").Inc()
+		return s.primary
+	}
+	// A replica within the lag threshold is close enough, Read retries rows it
+	// does not have yet on the primary
+	if s.lag != nil && !s.lag.Lagging() {
+		metrics.HistoryReads.WithLabelValues("replica").Inc()
+		return s.replica
+	}
+	// Redis errors read the primary, a slower read beats a missing history
+	wrote, err := s.redis.Exists(ctx, historyWroteKey(userID)).Result()
+	if err != nil || wrote > 0 {
+		if s.lag != nil {
+			metrics.ReplicaFallbacks.WithLabelValues("history").Inc()
+		}
+		metrics.HistoryReads.WithLabelValues("primary").Inc()
+		return s.primary
+	}
+	metrics.HistoryReads.WithLabelValues("replica").Inc()
+	return s.replica
+}
+
+func historyWroteKey(userID uint64) string {
+	return fmt.Sprintf("sybil:v1:history:wrote:%d", userID)
+}
+
+// isReplicaLagError reports whether the replica refused a read because it is
+// too far behind the primary
+func isReplicaLagError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "replication lag") || strings.Contains(msg, "replica lag") || strings.Contains(msg, "lagging")
+}
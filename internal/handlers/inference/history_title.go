@@ -0,0 +1,116 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"sybil-api/internal/shared"
+)
+
+const titlePrompt = `Write a short title for the conversation below and pick one emoji that fits its topic.
+Reply with only a JSON object like {"title": "Debugging a Go race condition", "icon": "🐛"}.
+The title is at most 6 words, in the language of the conversation, without quotes or a trailing period.`
+
+type ChatTitle struct {
+	Title string `json:"title"`
+	Icon  string `json:"icon"`
+}
+
+type titleInput struct {
+	User      shared.UserMetadata
+	HistoryID string
+	RequestID string
+	Prompt    string
+	Reply     string
+}
+
+// titleHistory generates a title and icon for a new history with the title
+// model and stores them over the truncated first message. It is best effort,
+// on failure the history keeps its placeholder title
+func (im *InferenceHandler) titleHistory(ctx context.Context, input titleInput) (*ChatTitle, error) {
+	title, err := im.generateTitle(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	title.Title = im.redactText(ctx, im.redactor(input.User, input.RequestID), "chat_title", title.Title)
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return nil, err
+	}
+	_, err = store.Writer().ExecContext(ctx,
+		"UPDATE chat_history SET title = ?, icon = ? WHERE history_id = ? AND user_id = ?",
+		title.Title, title.Icon, input.HistoryID, input.User.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store title: %w", err)
+	}
+	store.Wrote(ctx, input.User.UserID)
+	return title, nil
+}
+
+func (im *InferenceHandler) generateTitle(ctx context.Context, input titleInput) (*ChatTitle, error) {
+	body, err := json.Marshal(shared.InferenceBody{
+		Model: im.TitleModel,
+		Messages: []shared.ChatMessage{
+			{Role: "system", Content: titlePrompt},
+			{Role: "user", Content: fmt.Sprintf("User: %s\n\nAssistant: %s", truncateRunes(input.Prompt, 2000), truncateRunes(input.Reply, 2000))},
+		},
+		MaxTokens: shared.ChatTitleMaxTokens,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqInfo, err := im.Preprocess(ctx, PreprocessInput{
+		Body:      body,
+		User:      input.User,
+		Endpoint:  shared.ENDPOINTS.CHAT,
+		RequestID: input.RequestID + "-title",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to preprocess title request: %w", err)
+	}
+	out, err := im.DoInference(InferenceInput{Req: reqInfo, User: input.User, Ctx: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("title inference failed: %w", err)
+	}
+	content := extractContentFromFinalResponse(out.FinalResponse)
+	if reqInfo.Stream {
+		content = extractContentFromInferenceOutput(out)
+	}
+	return parseChatTitle(content)
+}
+
+// parseChatTitle reads the title model reply, tolerating text or code fences
+// around the JSON object
+func parseChatTitle(content string) (*ChatTitle, error) {
+	start := strings.Index(content, "{")
+	end := strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("title reply has no json object")
+	}
+	var title ChatTitle
+	if err := json.Unmarshal([]byte(content[start:end+1]), &title); err != nil {
+		return nil, fmt.Errorf("failed to parse title reply: %w", err)
+	}
+	title.Title = strings.Trim(strings.TrimSpace(title.Title), `"'.`)
+	if title.Title == "" {
+		return nil, errors.New("title reply has an empty title")
+	}
+	title.Title = truncateRunes(title.Title, shared.ChatTitleMaxLength)
+	// An icon is a single emoji, anything longer is dropped
+	title.Icon = strings.TrimSpace(title.Icon)
+	if utf8.RuneCountInString(title.Icon) > 4 {
+		title.Icon = ""
+	}
+	return &title, nil
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -9,21 +9,24 @@ import (
 	"time"
 
 	"sybil-api/internal/metrics"
-
 	"sybil-api/internal/shared"
+	"sybil-api/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type InferenceInput struct {
 	Req          *RequestInfo
 	User         shared.UserMetadata
 	Ctx          context.Context
-	LogFields    map[string]string
 	StreamWriter func(token string) error // callback for real-time streaming
 }
 
 type InferenceMetadata struct {
 	Completed        bool
 	Canceled         bool
+	Cached           bool
 	TotalTime        time.Duration
 	TimeToFirstToken time.Duration
 }
@@ -40,7 +43,7 @@ type InferenceOutput struct {
 // A partial stream for instance would not return an error directly but be baked inside of
 // InferenceOutput. The difference is that if we get an error back from DoInference,
 // we can assume no http status code was sent and the router should send them accordingly
-func (im *InferenceHandler) DoInference(input InferenceInput) (*InferenceOutput, error) {
+func (im *InferenceHandler) DoInference(input InferenceInput) (_ *InferenceOutput, err error) {
 	if input.Req == nil {
 		return nil, &shared.RequestError{
 			StatusCode: 400,
@@ -48,23 +51,128 @@ func (im *InferenceHandler) DoInference(input InferenceInput) (*InferenceOutput,
 		}
 	}
 	reqInfo := input.Req
+	var span trace.Span
+	input.Ctx, span = tracing.Start(input.Ctx, "inference.DoInference",
+		attribute.String("sybil.model", reqInfo.Model),
+		attribute.String("sybil.endpoint", reqInfo.Endpoint),
+		attribute.Bool("sybil.stream", reqInfo.Stream),
+	)
+	defer func() { tracing.End(span, err) }()
+	im.emitStarted(reqInfo)
+
+	// Cache hits are free and never touch the model or the usage buckets. The
+	// cache lives in the primary region, so accounts pinned to a region never
+	// read or write it
+	if reqInfo.CacheKey != "" && reqInfo.DataResidency == "" {
+		if cached := im.getCachedResponse(input.Ctx, reqInfo); cached != nil {
+			if reqInfo.HideReasoning {
+				cached.FinalResponse = stripReasoningBody(cached.FinalResponse)
+			}
+			cached.FinalResponse = im.transformResponse(input.Ctx, reqInfo, cached.FinalResponse)
+			im.emitCompleted(reqInfo, cached, nil, 0)
+			return cached, nil
+		}
+	}
+
+	// Reserved slots are honored before on-demand traffic is admitted
+	slot, err := im.acquireCapacity(input.Ctx, reqInfo, input.StreamWriter)
+	if err != nil {
+		im.emitFailed(reqInfo, err)
+		return nil, err
+	}
+	defer im.releaseCapacity(slot)
+	reqInfo.Reserved = slot != nil && slot.reserved
 
 	// Make sure to remove in flights if they arent going to be picked up by
 	// AddRequestToBucket
 	im.usageCache.AddInFlightToBucket(reqInfo.UserID)
 
-	resInfo, qerr := im.QueryModels(input.Ctx, reqInfo, input.StreamWriter)
+	// Requests that reach a model scaled to zero wait on its cold start
+	cold := im.modelIsCold(input.Ctx, reqInfo.ModelMetadata.ModelID)
+
+	var resInfo *InferenceOutput
+	var qerr error
+	switch {
+	// Batches are sent with a single key, so requests on the customers own
+	// provider key are sent on their own
+	case reqInfo.Endpoint == shared.ENDPOINTS.EMBEDDING && !reqInfo.Stream && !reqInfo.BYOK:
+		resInfo, qerr = im.embeddings.Query(input.Ctx, reqInfo)
+	case reqInfo.ResponseSchema != nil && !reqInfo.Stream:
+		resInfo, qerr = im.queryStructured(input)
+	default:
+		resInfo, qerr = im.QueryModels(input.Ctx, reqInfo, input.StreamWriter)
+	}
+	var coldWait time.Duration
+	if cold && qerr == nil && resInfo != nil && resInfo.Metadata != nil {
+		coldWait = resInfo.Metadata.TimeToFirstToken
+	}
+	go im.recordModelStats(reqInfo.ModelMetadata.ModelID, qerr, coldWait)
 	if qerr != nil {
-		im.usageCache.RemoveInFlightFromBucket(reqInfo.UserID)
+		// Structured outputs rejected by the schema still used the model
+		if resInfo != nil {
+			go im.chargeUsage(reqInfo, resInfo)
+		} else {
+			im.usageCache.RemoveInFlightFromBucket(reqInfo.UserID)
+		}
+		im.emitFailed(reqInfo, qerr)
 		return nil, qerr
 	}
 
+	// Streams are stripped chunk by chunk in QueryModels
+	if reqInfo.HideReasoning && !reqInfo.Stream {
+		resInfo.FinalResponse = stripReasoningBody(resInfo.FinalResponse)
+	}
+	if !reqInfo.Stream {
+		resInfo.FinalResponse = im.transformResponse(input.Ctx, reqInfo, resInfo.FinalResponse)
+	}
+
 	go im.PostProcess(reqInfo, resInfo)
+	if shouldSampleForReview(reqInfo) {
+		go im.sampleForReview(input.User, reqInfo, resInfo)
+	}
+	// Cached responses are served to anyone in the same organization sending
+	// the same request, so only users who allow their content to be kept
+	// populate the cache. Stripped or transformed responses would change the
+	// answer for everyone else
+	if reqInfo.CacheKey != "" && reqInfo.DataResidency == "" && reqInfo.keepsContent() && !reqInfo.HideReasoning && reqInfo.Transforms == nil {
+		go im.cacheResponse(reqInfo, resInfo)
+	}
 	return resInfo, nil
 }
 
 // PostProcess deducts user credits and saves metadata to the db / metrics ( for now )
 func (im *InferenceHandler) PostProcess(req *RequestInfo, res *InferenceOutput) {
+	usage, totalCredits := im.chargeUsage(req, res)
+	im.emitCompleted(req, res, usage, totalCredits)
+	im.takeRateLimitTokens(req, usage)
+
+	// Streamed output has already been sent, so only record schema violations
+	if req.ResponseSchema != nil && req.Stream && res.Metadata.Completed {
+		_ = im.checkStructuredOutput(req, res, "stream")
+	}
+
+	modelLabel := fmt.Sprintf("%d-%s", req.ModelMetadata.ModelID, req.Model)
+
+	metrics.RequestDuration.WithLabelValues(modelLabel, req.Endpoint).Observe(res.Metadata.TotalTime.Seconds())
+	if res.Metadata.TimeToFirstToken != time.Duration(0) {
+		metrics.TimeToFirstToken.WithLabelValues(modelLabel, req.Endpoint).Observe(res.Metadata.TimeToFirstToken.Seconds())
+	}
+	metrics.CreditUsage.WithLabelValues(modelLabel, req.Endpoint, "total").Add(float64(totalCredits))
+	metrics.RequestCount.WithLabelValues(modelLabel, req.Endpoint, "success").Inc()
+	if usage != nil {
+		metrics.TokensPerSecond.WithLabelValues(modelLabel, req.Endpoint).Observe(float64(usage.CompletionTokens) / res.Metadata.TotalTime.Seconds())
+		metrics.PromptTokens.WithLabelValues(modelLabel, req.Endpoint).Add(float64(usage.PromptTokens))
+		metrics.CompletionTokens.WithLabelValues(modelLabel, req.Endpoint).Add(float64(usage.CompletionTokens))
+		metrics.TotalTokens.WithLabelValues(modelLabel, req.Endpoint).Add(float64(usage.TotalTokens))
+		if usage.IsCanceled {
+			metrics.CanceledRequests.WithLabelValues(modelLabel, fmt.Sprintf("%d", req.UserID)).Inc()
+		}
+	}
+}
+
+// chargeUsage adds the usage reported in res to the users bucket and returns
+// it with the credits it cost
+func (im *InferenceHandler) chargeUsage(req *RequestInfo, res *InferenceOutput) (*shared.Usage, uint64) {
 	var usage *shared.Usage
 	switch req.Stream {
 	case true:
@@ -76,7 +184,7 @@ func (im *InferenceHandler) PostProcess(req *RequestInfo, res *InferenceOutput)
 				"error",
 				err,
 				"raw_response_content",
-				string(res.FinalResponse),
+				loggableContent(req, res.FinalResponse),
 			)
 			break
 		}
@@ -104,7 +212,7 @@ func (im *InferenceHandler) PostProcess(req *RequestInfo, res *InferenceOutput)
 				"error",
 				err,
 				"raw_response_content",
-				string(res.FinalResponse),
+				loggableContent(req, res.FinalResponse),
 			)
 			break
 		}
@@ -128,7 +236,14 @@ func (im *InferenceHandler) PostProcess(req *RequestInfo, res *InferenceOutput)
 	// Always set canceled state from metadata
 	usage.IsCanceled = res.Metadata.Canceled
 
-	totalCredits := shared.CalculateCredits(usage, req.ModelMetadata.ICPT, req.ModelMetadata.OCPT, req.ModelMetadata.CRC)
+	multiplier := shared.OffPeakMultiplier(req.ModelMetadata.OffPeak, req.StartTime)
+	totalCredits := shared.CalculateCredits(usage, req.ModelMetadata.ICPT, req.ModelMetadata.OCPT, req.ModelMetadata.CRC, multiplier)
+	if req.BYOK {
+		totalCredits = req.ModelMetadata.BYOKRoutingFee
+		if totalCredits == 0 {
+			totalCredits = shared.DefaultBYOKRoutingFee
+		}
+	}
 
 	pqi := &shared.ProcessedQueryInfo{
 		UserID:           req.UserID,
@@ -139,26 +254,30 @@ func (im *InferenceHandler) PostProcess(req *RequestInfo, res *InferenceOutput)
 		TotalTime:        res.Metadata.TotalTime,
 		Usage:            usage,
 		TotalCredits:     totalCredits,
+		ICPT:             req.ModelMetadata.ICPT,
+		OCPT:             req.ModelMetadata.OCPT,
+		CRC:              req.ModelMetadata.CRC,
+		PriceMultiplier:  multiplier,
+		Reserved:         req.Reserved,
 		CreatedAt:        time.Now(),
+		Seed:             req.Seed,
+		Metadata:         im.redactMetadata(context.Background(), req.PIIRedaction, req.Metadata),
+		KeyID:            req.KeyID,
+		BYOK:             req.BYOK,
+		StoreData:        req.StoreData,
+		Ephemeral:        req.Ephemeral,
+		Completed:        res.Metadata.Completed,
 	}
 
 	im.usageCache.AddRequestToBucket(req.UserID, pqi, req.ID)
+	return usage, totalCredits
+}
 
-	modelLabel := fmt.Sprintf("%d-%s", req.ModelMetadata.ModelID, req.Model)
-
-	metrics.RequestDuration.WithLabelValues(modelLabel, req.Endpoint).Observe(res.Metadata.TotalTime.Seconds())
-	if res.Metadata.TimeToFirstToken != time.Duration(0) {
-		metrics.TimeToFirstToken.WithLabelValues(modelLabel, req.Endpoint).Observe(res.Metadata.TimeToFirstToken.Seconds())
-	}
-	metrics.CreditUsage.WithLabelValues(modelLabel, req.Endpoint, "total").Add(float64(totalCredits))
-	metrics.RequestCount.WithLabelValues(modelLabel, req.Endpoint, "success").Inc()
-	if usage != nil {
-		metrics.TokensPerSecond.WithLabelValues(modelLabel, req.Endpoint).Observe(float64(usage.CompletionTokens) / res.Metadata.TotalTime.Seconds())
-		metrics.PromptTokens.WithLabelValues(modelLabel, req.Endpoint).Add(float64(usage.PromptTokens))
-		metrics.CompletionTokens.WithLabelValues(modelLabel, req.Endpoint).Add(float64(usage.CompletionTokens))
-		metrics.TotalTokens.WithLabelValues(modelLabel, req.Endpoint).Add(float64(usage.TotalTokens))
-		if usage.IsCanceled {
-			metrics.CanceledRequests.WithLabelValues(modelLabel, fmt.Sprintf("%d", req.UserID)).Inc()
-		}
+// loggableContent is the content to log for a request, only its size when its
+// content may not be kept
+func loggableContent(req *RequestInfo, content []byte) string {
+	if req.keepsContent() {
+		return string(content)
 	}
+	return fmt.Sprintf("<%d bytes omitted>", len(content))
 }
@@ -0,0 +1,101 @@
+package inference
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"sybil-api/internal/shared"
+)
+
+// defaultBodyLimits are the largest request bodies each endpoint reads
+var defaultBodyLimits = map[string]int64{
+	shared.ENDPOINTS.CHAT:       shared.MaxChatBodyBytes,
+	shared.ENDPOINTS.COMPLETION: shared.MaxCompletionBodyBytes,
+	shared.ENDPOINTS.EMBEDDING:  shared.MaxEmbeddingBodyBytes,
+	shared.ENDPOINTS.RESPONSES:  shared.MaxResponsesBodyBytes,
+}
+
+// ParseBodyLimits parses comma separated endpoint=bytes pairs, like
+// chat=20971520. Endpoints left out keep their default
+func ParseBodyLimits(spec string) (map[string]int64, error) {
+	limits := map[string]int64{}
+	if strings.TrimSpace(spec) == "" {
+		return limits, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		endpoint, raw, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		endpoint = strings.ToUpper(strings.TrimSpace(endpoint))
+		if !ok {
+			return nil, fmt.Errorf("invalid body limit entry %q, expected endpoint=bytes", pair)
+		}
+		if _, known := defaultBodyLimits[endpoint]; !known {
+			return nil, fmt.Errorf("unknown endpoint %q in body limits", strings.ToLower(endpoint))
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid body limit for %s: %q", strings.ToLower(endpoint), raw)
+		}
+		limits[endpoint] = limit
+	}
+	return limits, nil
+}
+
+// MaxBodyBytes is the largest request body read for endpoint
+func (im *InferenceHandler) MaxBodyBytes(endpoint string) int64 {
+	if limit, ok := im.BodyLimits[endpoint]; ok {
+		return limit
+	}
+	if limit, ok := defaultBodyLimits[endpoint]; ok {
+		return limit
+	}
+	return shared.MaxChatBodyBytes
+}
+
+// encodeBody builds the body sent to the model from the preprocessed payload.
+// Top level fields that are not in changed keep their bytes from the original
+// body, so the messages of a request are only encoded again when something
+// rewrote them. Fields deleted from payload are left out
+func encodeBody(original []byte, payload map[string]any, changed map[string]bool) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(original, &raw); err != nil {
+		return json.Marshal(payload)
+	}
+
+	keys := make([]string, 0, len(payload))
+	for key := range payload {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var buf bytes.Buffer
+	buf.Grow(len(original))
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		if value, ok := raw[key]; ok && !changed[key] {
+			if err := json.Compact(&buf, value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		value, err := json.Marshal(payload[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/shared"
+)
+
+type budgetState struct {
+	ID           uint64 `json:"id"`
+	Period       string `json:"period"`
+	CapCredits   uint64 `json:"cap_credits"`
+	SpentCredits uint64 `json:"spent_credits"`
+	PeriodStart  string `json:"period_start"`
+}
+
+// getBudgets returns the active budgets covering the api key, both user wide
+// and key specific. Spend lags by up to one bucket flush
+func (im *InferenceHandler) getBudgets(ctx context.Context, user shared.UserMetadata) ([]budgetState, error) {
+	cacheKey := fmt.Sprintf("sybil:v1:budget:%d:%s", user.UserID, user.KeyID)
+	cached, err := im.RedisClient.Get(ctx, cacheKey).Result()
+	if err == nil && cached != "" {
+		var budgets []budgetState
+		if err := json.Unmarshal([]byte(cached), &budgets); err == nil {
+			return budgets, nil
+		}
+		im.Log.Warnw("Failed to unmarshal cached budgets", "error", err, "user_id", user.UserID)
+	}
+
+	budgetDB := im.RDB
+	if im.Lag != nil {
+		budgetDB = im.Lag.ReadDB("budgets")
+	}
+	rows, err := budgetDB.QueryContext(ctx, `
+		SELECT id, period, cap_credits, spent_credits, DATE_FORMAT(period_start, '%Y-%m-%d')
+		FROM budget
+		WHERE active = true
+		AND user_id = ?
+		AND (api_key_id = ? OR api_key_id IS NULL)
+	`, user.UserID, user.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	budgets := []budgetState{}
+	for rows.Next() {
+		var budget budgetState
+		if err := rows.Scan(&budget.ID, &budget.Period, &budget.CapCredits, &budget.SpentCredits, &budget.PeriodStart); err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, budget)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Cache empty results too so users without budgets dont hit the db every
+	// request
+	go func() {
+		cacheCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		budgetsJSON, err := json.Marshal(budgets)
+		if err != nil {
+			return
+		}
+		if err := im.RedisClient.Set(cacheCtx, cacheKey, budgetsJSON, shared.BudgetCacheTTL).Err(); err != nil {
+			im.Log.Warnw("Failed to cache budgets", "error", err, "user_id", user.UserID)
+		}
+	}()
+	return budgets, nil
+}
+
+// exceededBudget returns the first budget whose cap has been reached in the
+// current period, or nil
+func exceededBudget(budgets []budgetState, now time.Time) *budgetState {
+	for i, budget := range budgets {
+		if budget.CapCredits == 0 {
+			continue
+		}
+		// Spend from a previous period no longer counts
+		if budget.PeriodStart != shared.BudgetPeriodStart(budget.Period, now).Format(time.DateOnly) {
+			continue
+		}
+		if budget.SpentCredits >= budget.CapCredits {
+			return &budgets[i]
+		}
+	}
+	return nil
+}
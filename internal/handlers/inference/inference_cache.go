@@ -0,0 +1,61 @@
+package inference
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// responseCacheKey hashes the repackaged request body. Bodies are marshaled
+// from a map so keys are always sorted, making the hash stable regardless of
+// client field ordering. Responses are only shared within an organization, or
+// kept to the user outside of one, so nobody can read back another customers
+// response by sending the same body
+func responseCacheKey(user shared.UserMetadata, modelID uint64, endpoint string, body []byte) string {
+	scope := fmt.Sprintf("user:%d", user.UserID)
+	if user.OrganizationID != 0 {
+		scope = fmt.Sprintf("org:%d", user.OrganizationID)
+	}
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf("sybil:v1:response:cache:%s:%d:%s:%s", scope, modelID, endpoint, hex.EncodeToString(sum[:]))
+}
+
+func (im *InferenceHandler) getCachedResponse(ctx context.Context, req *RequestInfo) *InferenceOutput {
+	modelLabel := fmt.Sprintf("%d-%s", req.ModelMetadata.ModelID, req.Model)
+	cached, err := im.RedisClient.Get(ctx, req.CacheKey).Bytes()
+	if err != nil || len(cached) == 0 {
+		metrics.ResponseCacheCount.WithLabelValues(modelLabel, req.Endpoint, "miss").Inc()
+		return nil
+	}
+	metrics.ResponseCacheCount.WithLabelValues(modelLabel, req.Endpoint, "hit").Inc()
+	return &InferenceOutput{
+		FinalResponse: cached,
+		Metadata: &InferenceMetadata{
+			Completed:        true,
+			Cached:           true,
+			TotalTime:        time.Since(req.StartTime),
+			TimeToFirstToken: time.Since(req.StartTime),
+		},
+	}
+}
+
+func (im *InferenceHandler) cacheResponse(req *RequestInfo, res *InferenceOutput) {
+	if res.Metadata == nil || !res.Metadata.Completed || len(res.FinalResponse) == 0 {
+		return
+	}
+	ttl := shared.DefaultResponseCacheTTL
+	if req.ModelMetadata.ResponseCacheTTL > 0 {
+		ttl = time.Duration(req.ModelMetadata.ResponseCacheTTL) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := im.RedisClient.Set(ctx, req.CacheKey, res.FinalResponse, ttl).Err(); err != nil {
+		im.Log.Warnw("Failed to cache response", "error", err, "model", req.Model, "request_id", req.ID)
+	}
+}
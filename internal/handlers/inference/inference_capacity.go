@@ -0,0 +1,230 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// acquireSlotScript admits a request to a model. A user with a reservation
+// takes one of their reserved slots while any are free. Everyone else, and
+// reserved users beyond their slots, share what capacity is left after every
+// reservation, first come first served: a request is only admitted when there
+// is a free slot for it and every request queued ahead of it. Requests that
+// are not admitted join the queue. Slots are members of a sorted set scored by
+// when they expire, so a slot a dead replica never released is dropped once it
+// expires instead of being kept alive by later admissions. Returns the result,
+// 1 for a reserved slot, 2 for on-demand and 0 when queued, and how many
+// requests are queued ahead
+var acquireSlotScript = redis.NewScript(`
+local now = tonumber(ARGV[6])
+local expires = now + tonumber(ARGV[4])
+local reserved = tonumber(ARGV[1])
+if reserved > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+	if redis.call('ZCARD', KEYS[1]) < reserved then
+		redis.call('ZADD', KEYS[1], expires, ARGV[5])
+		redis.call('PEXPIRE', KEYS[1], ARGV[4])
+		redis.call('ZREM', KEYS[3], ARGV[5])
+		return {1, 0}
+	end
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+local capacity = tonumber(ARGV[2])
+if capacity > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', now - tonumber(ARGV[7]))
+	local ahead = redis.call('ZRANK', KEYS[3], ARGV[5])
+	if not ahead then
+		ahead = redis.call('ZCARD', KEYS[3])
+	end
+	local used = redis.call('ZCARD', KEYS[2])
+	if used + ahead >= capacity - tonumber(ARGV[3]) then
+		redis.call('ZADD', KEYS[3], 'NX', now, ARGV[5])
+		redis.call('PEXPIRE', KEYS[3], ARGV[7])
+		return {0, ahead}
+	end
+	redis.call('ZREM', KEYS[3], ARGV[5])
+end
+redis.call('ZADD', KEYS[2], expires, ARGV[5])
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+return {2, 0}
+`)
+
+// capacitySlot is held for the duration of a request. A nil slot holds
+// nothing
+type capacitySlot struct {
+	key       string
+	requestID string
+	reserved  bool
+}
+
+func reservedSlotsKey(modelID, userID uint64) string {
+	return fmt.Sprintf("sybil:v1:capacity:%d:reserved_slots:%d", modelID, userID)
+}
+
+func onDemandSlotsKey(modelID uint64) string {
+	return fmt.Sprintf("sybil:v1:capacity:%d:on_demand_slots", modelID)
+}
+
+// acquireCapacity applies admission control for models with a concurrency
+// limit or reservations. Requests that do not fit wait in the models queue up
+// to shared.CapacityQueueTimeout, streaming requests are sent a queued event
+// whenever their position changes. Redis failures admit the request untracked
+// rather than failing traffic
+func (im *InferenceHandler) acquireCapacity(ctx context.Context, req *RequestInfo, streamWriter func(string) error) (*capacitySlot, error) {
+	modelID := req.ModelMetadata.ModelID
+	reservations, err := im.getReservations(ctx, modelID)
+	if err != nil {
+		im.Log.Warnw("Failed to load capacity reservations", "error", err, "model_id", modelID)
+		return nil, nil
+	}
+	capacity := req.ModelMetadata.MaxConcurrency
+	if capacity <= 0 && len(reservations) == 0 {
+		return nil, nil
+	}
+	var totalReserved int
+	for _, slots := range reservations {
+		totalReserved += slots
+	}
+
+	reservedKey := reservedSlotsKey(modelID, req.UserID)
+	onDemandKey := onDemandSlotsKey(modelID)
+	queueKey := shared.CapacityQueueKey(modelID)
+	deadline := time.Now().Add(shared.CapacityQueueTimeout)
+	lastPosition := int64(-1)
+	for {
+		runCtx, cancel := context.WithTimeout(ctx, shared.RateLimitTimeout)
+		result, err := acquireSlotScript.Run(runCtx, im.RedisClient, []string{reservedKey, onDemandKey, queueKey},
+			reservations[req.UserID], capacity, totalReserved, shared.CapacitySlotTTL.Milliseconds(),
+			req.ID, time.Now().UnixMilli(), shared.CapacityQueueTimeout.Milliseconds()).Int64Slice()
+		cancel()
+		if err != nil || len(result) != 2 {
+			im.Log.Warnw("Failed to acquire capacity slot", "error", err, "model_id", modelID)
+			return nil, nil
+		}
+		switch result[0] {
+		case 1:
+			return &capacitySlot{key: reservedKey, requestID: req.ID, reserved: true}, nil
+		case 2:
+			return &capacitySlot{key: onDemandKey, requestID: req.ID}, nil
+		}
+
+		position := result[1] + 1
+		if time.Now().After(deadline) {
+			im.leaveCapacityQueue(queueKey, req.ID)
+			metrics.CapacityRejected.WithLabelValues(strconv.FormatUint(modelID, 10)).Inc()
+			return nil, &shared.RequestError{
+				StatusCode: 429,
+				Err:        errors.New("model is at capacity, try again shortly"),
+			}
+		}
+		if streamWriter != nil && position != lastPosition {
+			lastPosition = position
+			im.sendQueuedEvent(ctx, streamWriter, modelID, position)
+		}
+
+		select {
+		case <-ctx.Done():
+			im.leaveCapacityQueue(queueKey, req.ID)
+			return nil, ctx.Err()
+		case <-time.After(shared.CapacityQueuePollInterval):
+		}
+	}
+}
+
+// sendQueuedEvent tells a streaming client where it is in the queue. The eta
+// assumes the model keeps completing requests at last minutes rate and is
+// left out when there is no recent traffic to go by
+func (im *InferenceHandler) sendQueuedEvent(ctx context.Context, streamWriter func(string) error, modelID uint64, position int64) {
+	event := map[string]any{"type": "queued", "position": position}
+	lastMinute := time.Now().Unix()/60 - 1
+	completed, err := im.RedisClient.HGet(ctx, fmt.Sprintf("sybil:v1:model-stats:%d:%d", modelID, lastMinute), "requests").Int64()
+	if err == nil && completed > 0 {
+		event["eta_seconds"] = int64(math.Ceil(float64(position) * 60 / float64(completed)))
+	}
+	eventJSON, _ := json.Marshal(event)
+	_ = streamWriter(fmt.Sprintf("event: queued\ndata: %s", eventJSON))
+}
+
+func (im *InferenceHandler) leaveCapacityQueue(queueKey, requestID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), shared.RateLimitTimeout)
+	defer cancel()
+	if err := im.RedisClient.ZRem(ctx, queueKey, requestID).Err(); err != nil {
+		im.Log.Warnw("Failed to leave capacity queue", "error", err, "key", queueKey)
+	}
+}
+
+func (im *InferenceHandler) releaseCapacity(slot *capacitySlot) {
+	if slot == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shared.RateLimitTimeout)
+	defer cancel()
+	if err := im.RedisClient.ZRem(ctx, slot.key, slot.requestID).Err(); err != nil {
+		im.Log.Warnw("Failed to release capacity slot", "error", err, "key", slot.key)
+	}
+}
+
+// getReservations returns the reserved slots per user of the reservations
+// active on a model right now
+func (im *InferenceHandler) getReservations(ctx context.Context, modelID uint64) (map[uint64]int, error) {
+	cacheKey := shared.ReservationCacheKey(modelID)
+	cached, err := im.RedisClient.Get(ctx, cacheKey).Result()
+	if err == nil && cached != "" {
+		var reservations map[uint64]int
+		if err := json.Unmarshal([]byte(cached), &reservations); err == nil {
+			return reservations, nil
+		}
+		im.Log.Warnw("Failed to unmarshal cached reservations", "error", err, "model_id", modelID)
+	}
+
+	rows, err := im.RDB.QueryContext(ctx, `
+		SELECT user_id, SUM(slots)
+		FROM capacity_reservation
+		WHERE model_id = ? AND canceled_at IS NULL
+		AND starts_at <= NOW() AND (ends_at IS NULL OR ends_at > NOW())
+		GROUP BY user_id
+	`, modelID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	reservations := map[uint64]int{}
+	for rows.Next() {
+		var userID uint64
+		var slots int
+		if err := rows.Scan(&userID, &slots); err != nil {
+			return nil, err
+		}
+		reservations[userID] = slots
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Cache models without reservations too so they dont hit the db every
+	// request
+	go func() {
+		cacheCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		reservationsJSON, err := json.Marshal(reservations)
+		if err != nil {
+			return
+		}
+		if err := im.RedisClient.Set(cacheCtx, cacheKey, reservationsJSON, shared.ReservationCacheTTL).Err(); err != nil {
+			im.Log.Warnw("Failed to cache reservations", "error", err, "model_id", modelID)
+		}
+	}()
+	return reservations, nil
+}
@@ -9,8 +9,27 @@ import (
 	"time"
 
 	"sybil-api/internal/shared"
+	"sybil-api/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// effectivePriceJoin joins the latest scheduled model_price row already in
+// effect for model, if any, as model_price
+const effectivePriceJoin = `LEFT JOIN model_price ON model_price.id = (
+			SELECT scheduled.id FROM model_price AS scheduled
+			WHERE scheduled.model_id = model.id AND scheduled.canceled_at IS NULL AND scheduled.effective_at <= NOW()
+			ORDER BY scheduled.effective_at DESC, scheduled.id DESC
+			LIMIT 1
+		)`
+
+// nextPriceChangeColumn selects the unix time the next scheduled price of
+// model takes effect, or NULL when none is scheduled
+const nextPriceChangeColumn = `UNIX_TIMESTAMP((
+			SELECT MIN(scheduled.effective_at) FROM model_price AS scheduled
+			WHERE scheduled.model_id = model.id AND scheduled.canceled_at IS NULL AND scheduled.effective_at > NOW()
+		))`
+
 type InferenceService struct {
 	ModelID  uint64 `json:"model_id"`
 	URL      string `json:"url"`
@@ -18,9 +37,45 @@ type InferenceService struct {
 	OCPT     uint64 `json:"ocpt"`
 	CRC      uint64 `json:"crc"`
 	Modality string `json:"modality"`
+
+	// Seconds to keep opt-in cached responses, 0 uses the default
+	ResponseCacheTTL int64 `json:"response_cache_ttl"`
+	// Fraction of requests sampled into the review queue
+	ReviewSampleRate float64 `json:"review_sample_rate"`
+	// Sampling params filled in when the client omits them
+	DefaultParams map[string]any `json:"default_params"`
+	// Maximum prompt plus completion tokens, 0 when unknown
+	ContextLength int `json:"context_length"`
+	// Set for passthrough models served by an external provider
+	ExternalProvider string `json:"external_provider"`
+	// Credits per request when the customer brings their own provider key
+	BYOKRoutingFee uint64 `json:"byok_routing_fee"`
+	// Discounted hours, applied at request start
+	OffPeak []shared.OffPeakWindow `json:"off_peak"`
+	// Concurrent requests the deployment serves, 0 when unlimited
+	MaxConcurrency int `json:"max_concurrency"`
+	// Hugging Face repo or tokenizer.json url for local token counts, empty
+	// estimates them
+	Tokenizer string `json:"tokenizer"`
+}
+
+// serviceMetadata is the subset of model metadata needed at request time
+type serviceMetadata struct {
+	ResponseCacheTTL int64                  `json:"response_cache_ttl"`
+	ReviewSampleRate float64                `json:"review_sample_rate"`
+	DefaultParams    map[string]any         `json:"default_params"`
+	ContextLength    int                    `json:"context_length"`
+	ExternalProvider string                 `json:"external_provider"`
+	BYOKRoutingFee   uint64                 `json:"byok_routing_fee"`
+	OffPeak          []shared.OffPeakWindow `json:"off_peak"`
+	MaxConcurrency   int                    `json:"max_concurrency"`
+	Tokenizer        string                 `json:"tokenizer"`
 }
 
-func (im *InferenceHandler) DiscoverModels(ctx context.Context, userID uint64, modelName string) (*InferenceService, error) {
+func (im *InferenceHandler) DiscoverModels(ctx context.Context, userID uint64, modelName string) (_ *InferenceService, err error) {
+	ctx, span := tracing.Start(ctx, "inference.DiscoverModels", attribute.String("sybil.model", modelName))
+	defer func() { tracing.End(span, err) }()
+
 	cacheKey := fmt.Sprintf("sybil:v1:model:service:%d:%s", userID, modelName)
 	cached, err := im.RedisClient.Get(ctx, cacheKey).Result()
 	if err == nil && cached != "" {
@@ -37,6 +92,44 @@ func (im *InferenceHandler) DiscoverModels(ctx context.Context, userID uint64, m
 				CRC:      uint64(serviceCache["crc"].(float64)),
 				Modality: serviceCache["modality"].(string),
 			}
+			if ttl, ok := serviceCache["response_cache_ttl"].(float64); ok {
+				service.ResponseCacheTTL = int64(ttl)
+			}
+			if rate, ok := serviceCache["review_sample_rate"].(float64); ok {
+				service.ReviewSampleRate = rate
+			}
+			if params, ok := serviceCache["default_params"].(map[string]any); ok {
+				service.DefaultParams = params
+			}
+			if contextLength, ok := serviceCache["context_length"].(float64); ok {
+				service.ContextLength = int(contextLength)
+			}
+			if provider, ok := serviceCache["external_provider"].(string); ok {
+				service.ExternalProvider = provider
+			}
+			if fee, ok := serviceCache["byok_routing_fee"].(float64); ok {
+				service.BYOKRoutingFee = uint64(fee)
+			}
+			if maxConcurrency, ok := serviceCache["max_concurrency"].(float64); ok {
+				service.MaxConcurrency = int(maxConcurrency)
+			}
+			if tokenizer, ok := serviceCache["tokenizer"].(string); ok {
+				service.Tokenizer = tokenizer
+			}
+			if windows, ok := serviceCache["off_peak"].([]any); ok {
+				for _, raw := range windows {
+					window, ok := raw.(map[string]any)
+					if !ok {
+						continue
+					}
+					start, _ := window["start_hour"].(float64)
+					end, _ := window["end_hour"].(float64)
+					multiplier, _ := window["multiplier"].(float64)
+					service.OffPeak = append(service.OffPeak, shared.OffPeakWindow{
+						StartHour: int(start), EndHour: int(end), Multiplier: multiplier,
+					})
+				}
+			}
 
 			im.Log.Debugw("Model service retrieved from cache",
 				"model_name", modelName,
@@ -49,27 +142,39 @@ func (im *InferenceHandler) DiscoverModels(ctx context.Context, userID uint64, m
 
 	im.Log.Debugw("Cache miss, querying database", "model_name", modelName)
 
+	// LoRA adapters are registered under their own name pointing at the base
+	// model, and may override the base model pricing. Otherwise the latest
+	// scheduled price in effect applies, falling back to the models own
 	query := `
 		SELECT 
 			model_registry.url,
 			model.id,
-			model.icpt,
-			model.ocpt,
-			model.crc,
+			COALESCE(lora_adapter.icpt, model_price.icpt, model.icpt),
+			COALESCE(lora_adapter.ocpt, model_price.ocpt, model.ocpt),
+			COALESCE(lora_adapter.crc, model_price.crc, model.crc),
 			model.modality,
-			model.allowed_user_id
+			model.allowed_user_id,
+			model.metadata,
+			` + nextPriceChangeColumn + `
 		FROM model_registry
 		INNER JOIN model ON model_registry.model_id = model.id
+		LEFT JOIN lora_adapter ON lora_adapter.model_id = model.id
+			AND lora_adapter.name = model_registry.model_name
+			AND lora_adapter.active = true
+		` + effectivePriceJoin + `
 		WHERE model_registry.model_name = ? 
 		AND model.enabled = true
 		AND (model.allowed_user_id = ? OR model.allowed_user_id IS NULL)
+		AND (lora_adapter.allowed_user_id = ? OR lora_adapter.allowed_user_id IS NULL)
 		ORDER BY model.allowed_user_id DESC
 		LIMIT 1
 	`
 
 	var service InferenceService
 	var allowedUserID *uint64
-	err = im.RDB.QueryRowContext(ctx, query, modelName, userID).Scan(
+	var metadataJSON sql.NullString
+	var nextPriceChange sql.NullInt64
+	err = im.RDB.QueryRowContext(ctx, query, modelName, userID, userID).Scan(
 		&service.URL,
 		&service.ModelID,
 		&service.ICPT,
@@ -77,6 +182,8 @@ func (im *InferenceHandler) DiscoverModels(ctx context.Context, userID uint64, m
 		&service.CRC,
 		&service.Modality,
 		&allowedUserID,
+		&metadataJSON,
+		&nextPriceChange,
 	)
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("model not found or not enabled: %s", modelName)
@@ -85,6 +192,22 @@ func (im *InferenceHandler) DiscoverModels(ctx context.Context, userID uint64, m
 		return nil, fmt.Errorf("database error: %w", err)
 	}
 
+	if metadataJSON.Valid && metadataJSON.String != "" {
+		var metadata serviceMetadata
+		if err := json.Unmarshal([]byte(metadataJSON.String), &metadata); err != nil {
+			im.Log.Warnw("Failed to unmarshal model metadata", "error", err, "model_name", modelName)
+		}
+		service.ResponseCacheTTL = metadata.ResponseCacheTTL
+		service.ReviewSampleRate = metadata.ReviewSampleRate
+		service.DefaultParams = metadata.DefaultParams
+		service.ContextLength = metadata.ContextLength
+		service.ExternalProvider = metadata.ExternalProvider
+		service.BYOKRoutingFee = metadata.BYOKRoutingFee
+		service.OffPeak = metadata.OffPeak
+		service.MaxConcurrency = metadata.MaxConcurrency
+		service.Tokenizer = metadata.Tokenizer
+	}
+
 	// Check permissions for private models
 	if allowedUserID != nil {
 		if *allowedUserID != userID {
@@ -104,6 +227,16 @@ func (im *InferenceHandler) DiscoverModels(ctx context.Context, userID uint64, m
 			"ocpt":     service.OCPT,
 			"crc":      service.CRC,
 			"modality": service.Modality,
+
+			"response_cache_ttl": service.ResponseCacheTTL,
+			"review_sample_rate": service.ReviewSampleRate,
+			"default_params":     service.DefaultParams,
+			"context_length":     service.ContextLength,
+			"external_provider":  service.ExternalProvider,
+			"byok_routing_fee":   service.BYOKRoutingFee,
+			"off_peak":           service.OffPeak,
+			"max_concurrency":    service.MaxConcurrency,
+			"tokenizer":          service.Tokenizer,
 		}
 		cacheJSON, err := json.Marshal(serviceCache)
 		if err != nil {
@@ -113,7 +246,12 @@ func (im *InferenceHandler) DiscoverModels(ctx context.Context, userID uint64, m
 			return
 		}
 
-		if err := im.RedisClient.Set(cacheCtx, cacheKey, cacheJSON, shared.ModelServiceCacheTTL).Err(); err != nil {
+		// Expire with the current price so the next one is picked up on time
+		ttl := shared.ModelServiceCacheTTL
+		if nextPriceChange.Valid {
+			ttl = min(ttl, max(time.Until(time.Unix(nextPriceChange.Int64, 0)), time.Second))
+		}
+		if err := im.RedisClient.Set(cacheCtx, cacheKey, cacheJSON, ttl).Err(); err != nil {
 			im.Log.Warnw("Failed to cache model service",
 				"error", err,
 				"model_name", modelName,
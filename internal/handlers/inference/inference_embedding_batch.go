@@ -0,0 +1,318 @@
+package inference
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// embeddingBatcher coalesces embedding requests for the same model and
+// parameters that arrive within shared.EmbeddingBatchWindow into a single
+// upstream call. Identical inputs inside a batch are only embedded once
+type embeddingBatcher struct {
+	im      *InferenceHandler
+	mu      sync.Mutex
+	pending map[string]*embeddingBatch
+}
+
+type embeddingBatch struct {
+	url     string
+	model   string
+	payload map[string]any
+	inputs  []string
+	index   map[string]int
+	callers []*embeddingCaller
+	timer   *time.Timer
+}
+
+type embeddingCaller struct {
+	// index of each of the callers inputs inside the batch inputs
+	indices []int
+	result  chan embeddingResult
+}
+
+type embeddingResult struct {
+	body []byte
+	err  error
+}
+
+type embeddingData struct {
+	Object    string          `json:"object"`
+	Embedding json.RawMessage `json:"embedding"`
+	Index     int             `json:"index"`
+}
+
+type embeddingUsage struct {
+	PromptTokens uint64 `json:"prompt_tokens"`
+	TotalTokens  uint64 `json:"total_tokens"`
+}
+
+type embeddingBatchResponse struct {
+	Object string          `json:"object"`
+	Model  string          `json:"model"`
+	Data   []embeddingData `json:"data"`
+	Usage  embeddingUsage  `json:"usage"`
+}
+
+func newEmbeddingBatcher(im *InferenceHandler) *embeddingBatcher {
+	return &embeddingBatcher{
+		im:      im,
+		pending: map[string]*embeddingBatch{},
+	}
+}
+
+// Query embeds the request inputs as part of a batch. Requests that cant be
+// batched (token array inputs) are sent directly
+func (eb *embeddingBatcher) Query(ctx context.Context, req *RequestInfo) (*InferenceOutput, error) {
+	var payload map[string]any
+	if err := json.Unmarshal(req.Body, &payload); err != nil {
+		return nil, errors.Join(shared.ErrBadRequest, err)
+	}
+	inputs, ok := stringInputs(payload["input"])
+	if !ok {
+		return eb.im.QueryModels(ctx, req, nil)
+	}
+	delete(payload, "input")
+
+	// Only requests with identical parameters can share an upstream call
+	paramsJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Join(shared.ErrInternalServerError, err)
+	}
+	key := fmt.Sprintf("%s|%s", req.ModelMetadata.URL, paramsJSON)
+
+	caller := &embeddingCaller{result: make(chan embeddingResult, 1)}
+
+	eb.mu.Lock()
+	batch := eb.pending[key]
+	if batch != nil && len(batch.inputs)+len(inputs) > shared.EmbeddingMaxBatchSize {
+		eb.detach(key, batch)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &embeddingBatch{
+			url:     req.ModelMetadata.URL,
+			model:   req.Model,
+			payload: payload,
+			index:   map[string]int{},
+		}
+		eb.pending[key] = batch
+		batch.timer = time.AfterFunc(shared.EmbeddingBatchWindow, func() {
+			eb.mu.Lock()
+			if eb.pending[key] == batch {
+				delete(eb.pending, key)
+			}
+			eb.mu.Unlock()
+			eb.flush(batch)
+		})
+	}
+	for _, input := range inputs {
+		idx, ok := batch.index[input]
+		if !ok {
+			idx = len(batch.inputs)
+			batch.index[input] = idx
+			batch.inputs = append(batch.inputs, input)
+		}
+		caller.indices = append(caller.indices, idx)
+	}
+	batch.callers = append(batch.callers, caller)
+	if len(batch.inputs) >= shared.EmbeddingMaxBatchSize {
+		eb.detach(key, batch)
+	}
+	eb.mu.Unlock()
+
+	// Same as non streaming requests, the upstream call is not tied to the
+	// client context so usage is still recorded for canceled requests
+	res := <-caller.result
+	if res.err != nil {
+		return nil, res.err
+	}
+	return &InferenceOutput{
+		FinalResponse: res.body,
+		Metadata: &InferenceMetadata{
+			Canceled:         ctx.Err() == context.Canceled,
+			Completed:        true,
+			TotalTime:        time.Since(req.StartTime),
+			TimeToFirstToken: time.Since(req.StartTime),
+		},
+	}, nil
+}
+
+// detach removes a batch from pending and flushes it immediately. Must be
+// called with eb.mu held
+func (eb *embeddingBatcher) detach(key string, batch *embeddingBatch) {
+	delete(eb.pending, key)
+	if batch.timer.Stop() {
+		go eb.flush(batch)
+	}
+}
+
+func (eb *embeddingBatcher) flush(batch *embeddingBatch) {
+	metrics.EmbeddingBatchSize.WithLabelValues(batch.model).Observe(float64(len(batch.inputs)))
+	res, err := eb.send(batch)
+	if err != nil && len(batch.callers) > 1 {
+		// One callers bad input fails the upstream call for everyone in the
+		// batch, so each caller is retried on their own and only the ones
+		// whose inputs fail again see an error
+		eb.im.Log.Warnw("Embedding batch failed, retrying callers separately", "error", err, "model", batch.model, "callers", len(batch.callers))
+		for _, single := range batch.split() {
+			go eb.flush(single)
+		}
+		return
+	}
+	if err != nil {
+		for _, caller := range batch.callers {
+			caller.result <- embeddingResult{err: err}
+		}
+		return
+	}
+
+	for _, caller := range batch.callers {
+		data := make([]embeddingData, len(caller.indices))
+		for i, idx := range caller.indices {
+			data[i] = res.Data[idx]
+			data[i].Index = i
+		}
+		promptTokens := apportionTokens(res.Usage.PromptTokens, batch.inputs, caller.indices)
+		body, err := json.Marshal(embeddingBatchResponse{
+			Object: res.Object,
+			Model:  res.Model,
+			Data:   data,
+			Usage:  embeddingUsage{PromptTokens: promptTokens, TotalTokens: promptTokens},
+		})
+		if err != nil {
+			caller.result <- embeddingResult{err: errors.Join(shared.ErrInternalServerError, err)}
+			continue
+		}
+		caller.result <- embeddingResult{body: body}
+	}
+}
+
+// split returns a batch of its own for each caller, holding only their inputs
+func (batch *embeddingBatch) split() []*embeddingBatch {
+	batches := make([]*embeddingBatch, 0, len(batch.callers))
+	for _, caller := range batch.callers {
+		single := &embeddingBatch{
+			url:     batch.url,
+			model:   batch.model,
+			payload: batch.payload,
+			index:   map[string]int{},
+		}
+		solo := &embeddingCaller{result: caller.result}
+		for _, idx := range caller.indices {
+			input := batch.inputs[idx]
+			i, ok := single.index[input]
+			if !ok {
+				i = len(single.inputs)
+				single.index[input] = i
+				single.inputs = append(single.inputs, input)
+			}
+			solo.indices = append(solo.indices, i)
+		}
+		single.callers = []*embeddingCaller{solo}
+		batches = append(batches, single)
+	}
+	return batches
+}
+
+func (eb *embeddingBatcher) send(batch *embeddingBatch) (*embeddingBatchResponse, error) {
+	payload := make(map[string]any, len(batch.payload)+1)
+	for k, v := range batch.payload {
+		payload[k] = v
+	}
+	payload["input"] = batch.inputs
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Join(shared.ErrInternalServerError, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eb.im.requestTimeout(batch.model))
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, "POST", batch.url+shared.ROUTES[shared.ENDPOINTS.EMBEDDING], bytes.NewBuffer(body))
+	if err != nil {
+		return nil, errors.Join(shared.ErrInternalServerError, err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Connection", "keep-alive")
+
+	httpRes, err := eb.im.getHTTPClient(batch.url).Do(r)
+	if err != nil {
+		return nil, errors.Join(shared.ErrInternalServerError, shared.ErrFailedModelReq, err)
+	}
+	defer func() {
+		if closeErr := httpRes.Body.Close(); closeErr != nil {
+			eb.im.Log.Warnw("Failed to close response body", "error", closeErr)
+		}
+	}()
+	if httpRes.StatusCode != http.StatusOK {
+		return nil, errors.Join(&shared.RequestError{StatusCode: httpRes.StatusCode, Err: errors.New("downstream request failed")}, shared.ErrFailedModelReqFromCode)
+	}
+
+	resBody, err := io.ReadAll(httpRes.Body)
+	if err != nil {
+		return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("failed to read response body")}, shared.ErrFailedReadingResponse, err)
+	}
+	var res embeddingBatchResponse
+	if err := json.Unmarshal(resBody, &res); err != nil {
+		return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("failed to read response body")}, shared.ErrFailedReadingResponse, err)
+	}
+	if len(res.Data) != len(batch.inputs) {
+		return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("embedding count mismatch")}, shared.ErrFailedReadingResponse)
+	}
+
+	// Backends may return data out of order
+	ordered := make([]embeddingData, len(res.Data))
+	for _, d := range res.Data {
+		if d.Index < 0 || d.Index >= len(ordered) {
+			return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("embedding index out of range")}, shared.ErrFailedReadingResponse)
+		}
+		ordered[d.Index] = d
+	}
+	res.Data = ordered
+	return &res, nil
+}
+
+// apportionTokens splits the batch prompt tokens between callers weighted by
+// input length. Callers are billed for every input they sent, even if it was
+// deduped against another callers input
+func apportionTokens(total uint64, inputs []string, indices []int) uint64 {
+	var batchWeight, callerWeight uint64
+	for _, input := range inputs {
+		batchWeight += uint64(len(input)) + 1
+	}
+	for _, idx := range indices {
+		callerWeight += uint64(len(inputs[idx])) + 1
+	}
+	if batchWeight == 0 {
+		return 0
+	}
+	return (total*callerWeight + batchWeight - 1) / batchWeight
+}
+
+func stringInputs(input any) ([]string, bool) {
+	switch v := input.(type) {
+	case string:
+		return []string{v}, true
+	case []any:
+		inputs := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			inputs = append(inputs, s)
+		}
+		return inputs, true
+	default:
+		return nil, false
+	}
+}
@@ -4,26 +4,52 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"net"
 	"net/http"
-	"net/url"
 	"sync"
 	"time"
 
 	"sybil-api/internal/buckets"
+	"sybil-api/internal/database"
+	"sybil-api/internal/herocard"
+	"sybil-api/internal/lifecycle"
+	"sybil-api/internal/searchabuse"
 	"sybil-api/internal/shared"
+	"sybil-api/internal/tokenizer"
 
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
-type ClassifyFunc func(ctx context.Context, query string, apiKey string) bool
+type ClassifyFunc func(ctx context.Context, query string, apiKey string) Classification
 
-type SearchFunc func(query string) (*shared.SearchResponseBody, error)
+// Classification is whether a chat message needs a web search, sent to the
+// client in the classification event
+type Classification struct {
+	NeedsSearch bool `json:"needs_search"`
+	// One of the ClassifiedBy values
+	By string `json:"by"`
+}
+
+const (
+	// The search setting was on, nothing was classified
+	ClassifiedBySetting    = "setting"
+	ClassifiedByHeuristics = "heuristics"
+	ClassifiedByEmbeddings = "embeddings"
+	// The embeddings could not be fetched, the message is answered without
+	// search
+	ClassifiedByFallback = "fallback"
+)
+
+// SearchFunc searches for query, trying provider first when it is set
+type SearchFunc func(query string, locale *shared.SearchLocale, provider string) (*shared.SearchResponseBody, error)
 
 type SearchConfig struct {
 	ClassifyQuery ClassifyFunc
 	DoSearch      SearchFunc
+	// Scores searches for abuse, nil runs every search
+	Abuse *searchabuse.Detector
+	// Builds the hero card for searched queries, nil sends none
+	HeroCards *herocard.Enricher
 }
 
 type InferenceHandler struct {
@@ -36,9 +62,43 @@ type InferenceHandler struct {
 	clientsMutex sync.RWMutex
 	usageCache   *buckets.UsageCache
 	SearchConfig *SearchConfig
+	embeddings   *embeddingBatcher
+
+	// Per region databases for chat history of accounts with a data
+	// residency requirement
+	ResidencyDBs database.ResidencyDBs
+	// Nil when chat history encryption is not configured
+	HistoryKeyring *shared.Keyring
+	// Nil when customers cannot bring their own provider keys
+	ProviderKeyring *shared.Keyring
+	// Small model that titles new chat histories, empty keeps the truncated
+	// first message as the title
+	TitleModel string
+	// Small model that suggests follow-up questions after a search answer,
+	// empty sends none
+	FollowupModel string
+	// Model that redacts personal information for users in the model
+	// redaction mode, empty leaves them on the patterns only
+	RedactionModel string
+	// Embedding model that reranks chat search results by similarity to the
+	// query, empty keeps the provider order
+	RerankModel string
+	// How long reranking may take, zero uses shared.SearchRerankBudget
+	RerankBudget time.Duration
+	// Replica lag, nil reads the replica regardless of lag
+	Lag *database.LagMonitor
+	// Request lifecycle events, nil publishes none
+	Lifecycle *lifecycle.Bus
+	// Local tokenizers of models, nil estimates every count
+	Tokenizers *tokenizer.Registry
+	// Pool and protocol settings of the model clients, set before the first
+	// request
+	Upstream UpstreamConfig
+	// Request body limits per endpoint, see MaxBodyBytes
+	BodyLimits map[string]int64
 }
 
-func NewInferenceHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger, debug bool, searchConfig *SearchConfig) (*InferenceHandler, error) {
+func NewInferenceHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger, debug bool, searchConfig *SearchConfig, usageSettings buckets.Settings, usageJournalDir string) (*InferenceHandler, error) {
 	// check if the databases are connected
 	err := wdb.Ping()
 	if err != nil {
@@ -55,9 +115,12 @@ func NewInferenceHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, lo
 		return nil, errors.New("failed ping to redis db")
 	}
 
-	usageCache := buckets.NewUsageCache(log, wdb)
+	usageCache, err := buckets.NewUsageCache(log, wdb, redisClient, usageSettings, usageJournalDir)
+	if err != nil {
+		return nil, err
+	}
 
-	return &InferenceHandler{
+	im := &InferenceHandler{
 		WDB:          wdb,
 		RDB:          rdb,
 		RedisClient:  redisClient,
@@ -66,43 +129,9 @@ func NewInferenceHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, lo
 		httpClients:  make(map[string]*http.Client),
 		usageCache:   usageCache,
 		SearchConfig: searchConfig,
-	}, nil
-}
-
-func (im *InferenceHandler) getHTTPClient(modelURL string) *http.Client {
-	parsedURL, err := url.Parse(modelURL)
-	if err != nil {
-		im.Log.Warnw("failed to parse model URL, using full URL as key", "url", modelURL, "error", err)
-		parsedURL = &url.URL{Host: modelURL}
 	}
-	host := parsedURL.Host
-
-	im.clientsMutex.RLock()
-	if client, exists := im.httpClients[host]; exists {
-		im.clientsMutex.RUnlock()
-		return client
-	}
-	im.clientsMutex.RUnlock()
-
-	im.clientsMutex.Lock()
-	defer im.clientsMutex.Unlock()
-
-	if client, exists := im.httpClients[host]; exists {
-		return client
-	}
-
-	tr := &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout: 2 * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout: 2 * time.Second,
-		DisableKeepAlives:   false,
-	}
-	client := &http.Client{Transport: tr, Timeout: 10 * time.Minute}
-
-	im.httpClients[host] = client
-
-	return client
+	im.embeddings = newEmbeddingBatcher(im)
+	return im, nil
 }
 
 func (im *InferenceHandler) ShutDown() {
@@ -0,0 +1,155 @@
+package inference
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+	"sybil-api/internal/tracing"
+)
+
+// UpstreamConfig tunes the http clients models are queried with. Zero fields
+// keep the built in defaults
+type UpstreamConfig struct {
+	MaxIdleConnsPerHost int
+	// Connections per backend including those in use, 0 for unlimited
+	MaxConnsPerHost int
+	IdleConnTimeout time.Duration
+	// Host suffixes spoken to over HTTP/2 with prior knowledge, for backends
+	// inside the cluster that serve cleartext h2
+	H2CHosts []string
+	// Request timeouts of models that answer slower or faster than
+	// shared.DefaultStreamRequestTimeout
+	ModelTimeouts map[string]time.Duration
+	// Longest stream line and most chunk bytes kept per streamed response
+	MaxStreamLineBytes   int
+	MaxStreamBufferBytes int
+}
+
+// ParseModelTimeouts parses comma separated model=duration pairs
+func ParseModelTimeouts(spec string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	if strings.TrimSpace(spec) == "" {
+		return timeouts, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		model, raw, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid model timeout entry %q, expected model=duration", pair)
+		}
+		timeout, err := time.ParseDuration(raw)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout for model %s: %q", model, raw)
+		}
+		if timeout > shared.UpstreamClientTimeout {
+			return nil, fmt.Errorf("timeout for model %s cannot exceed %s", model, shared.UpstreamClientTimeout)
+		}
+		timeouts[model] = timeout
+	}
+	return timeouts, nil
+}
+
+// requestTimeout is how long a request to model may take before it is
+// treated as a cold start
+func (im *InferenceHandler) requestTimeout(model string) time.Duration {
+	if timeout, ok := im.Upstream.ModelTimeouts[model]; ok {
+		return timeout
+	}
+	return shared.DefaultStreamRequestTimeout
+}
+
+// getHTTPClient returns the client of the models host, one per host so each
+// backend gets its own connection pool
+func (im *InferenceHandler) getHTTPClient(modelURL string) *http.Client {
+	parsedURL, err := url.Parse(modelURL)
+	if err != nil {
+		im.Log.Warnw("failed to parse model URL, using full URL as key", "url", modelURL, "error", err)
+		parsedURL = &url.URL{Host: modelURL}
+	}
+	host := parsedURL.Host
+
+	im.clientsMutex.RLock()
+	if client, exists := im.httpClients[host]; exists {
+		im.clientsMutex.RUnlock()
+		return client
+	}
+	im.clientsMutex.RUnlock()
+
+	im.clientsMutex.Lock()
+	defer im.clientsMutex.Unlock()
+
+	if client, exists := im.httpClients[host]; exists {
+		return client
+	}
+
+	// Traced so model backends get the traceparent of the request
+	client := &http.Client{Transport: tracing.Transport(im.newTransport(host)), Timeout: shared.UpstreamClientTimeout}
+	im.httpClients[host] = client
+
+	return client
+}
+
+func (im *InferenceHandler) newTransport(host string) *http.Transport {
+	maxIdle := im.Upstream.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = shared.UpstreamMaxIdleConnsPerHost
+	}
+	idleTimeout := im.Upstream.IdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = shared.UpstreamIdleConnTimeout
+	}
+
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			metrics.UpstreamConnections.WithLabelValues(host).Inc()
+			return &countedConn{Conn: conn, host: host}, nil
+		},
+		TLSHandshakeTimeout: 2 * time.Second,
+		DisableKeepAlives:   false,
+		MaxIdleConnsPerHost: maxIdle,
+		MaxConnsPerHost:     im.Upstream.MaxConnsPerHost,
+		IdleConnTimeout:     idleTimeout,
+	}
+
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, suffix := range im.Upstream.H2CHosts {
+		if suffix != "" && strings.HasSuffix(hostname, suffix) {
+			// h2 only, requests are multiplexed over a few connections
+			tr.Protocols = new(http.Protocols)
+			tr.Protocols.SetHTTP2(true)
+			tr.Protocols.SetUnencryptedHTTP2(true)
+			break
+		}
+	}
+	return tr
+}
+
+// countedConn keeps metrics.UpstreamConnections in step with the connections
+// open to a backend
+type countedConn struct {
+	net.Conn
+	host string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		metrics.UpstreamConnections.WithLabelValues(c.host).Dec()
+	})
+	return c.Conn.Close()
+}
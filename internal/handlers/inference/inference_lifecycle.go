@@ -0,0 +1,80 @@
+package inference
+
+import (
+	"errors"
+	"time"
+
+	"sybil-api/internal/lifecycle"
+	"sybil-api/internal/shared"
+)
+
+// lifecycleEvent is the base event for a request. Ephemeral requests promise
+// nothing is kept beyond billing aggregates, so they publish no events
+func (im *InferenceHandler) lifecycleEvent(eventType string, req *RequestInfo) (lifecycle.Event, bool) {
+	if im.Lifecycle == nil || req.Ephemeral {
+		return lifecycle.Event{}, false
+	}
+	event := lifecycle.Event{
+		Type:      eventType,
+		RequestID: req.ID,
+		UserID:    req.UserID,
+		KeyID:     req.KeyID,
+		Model:     req.Model,
+		Endpoint:  req.Endpoint,
+		Stream:    req.Stream,
+		BYOK:      req.BYOK,
+		Reserved:  req.Reserved,
+		Time:      time.Now(),
+	}
+	if req.ModelMetadata != nil {
+		event.ModelID = req.ModelMetadata.ModelID
+	}
+	return event, true
+}
+
+func (im *InferenceHandler) emitStarted(req *RequestInfo) {
+	if event, ok := im.lifecycleEvent(lifecycle.TypeStarted, req); ok {
+		im.Lifecycle.Emit(event)
+	}
+}
+
+func (im *InferenceHandler) emitCompleted(req *RequestInfo, res *InferenceOutput, usage *shared.Usage, credits uint64) {
+	event, ok := im.lifecycleEvent(lifecycle.TypeCompleted, req)
+	if !ok {
+		return
+	}
+	if usage != nil {
+		event.Usage = &lifecycle.Usage{
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+			TotalTokens:      usage.TotalTokens,
+			Canceled:         usage.IsCanceled,
+		}
+	}
+	event.Credits = credits
+	if res != nil && res.Metadata != nil {
+		event.TimeToFirstToken = res.Metadata.TimeToFirstToken.Milliseconds()
+		event.TotalTime = res.Metadata.TotalTime.Milliseconds()
+		event.Cached = res.Metadata.Cached
+	}
+	im.Lifecycle.Emit(event)
+}
+
+// emitFailed publishes the status and message the client is sent, the rest
+// of the error chain stays in the logs
+func (im *InferenceHandler) emitFailed(req *RequestInfo, err error) {
+	event, ok := im.lifecycleEvent(lifecycle.TypeFailed, req)
+	if !ok {
+		return
+	}
+	event.StatusCode = 500
+	event.Error = "internal server error"
+	var reqErr *shared.RequestError
+	if errors.As(err, &reqErr) {
+		event.StatusCode = reqErr.StatusCode
+		if reqErr.Err != nil {
+			event.Error = reqErr.Err.Error()
+		}
+	}
+	im.Lifecycle.Emit(event)
+}
@@ -0,0 +1,49 @@
+package inference
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// recordModelStats counts the request and whether it failed in per minute
+// buckets, which model owner alerts read to watch error rates and traffic.
+// Requests that waited on a cold start add how long they waited. Requests the
+// client canceled are not counted against the model
+func (im *InferenceHandler) recordModelStats(modelID uint64, qerr error, coldWait time.Duration) {
+	if qerr != nil && errors.Is(qerr, context.Canceled) {
+		return
+	}
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	key := fmt.Sprintf("sybil:v1:model-stats:%d:%d", modelID, now.Unix()/60)
+	pipe := im.RedisClient.Pipeline()
+	pipe.HIncrBy(ctx, key, "requests", 1)
+	if qerr != nil {
+		pipe.HIncrBy(ctx, key, "errors", 1)
+	}
+	if coldWait > 0 {
+		pipe.HIncrBy(ctx, key, "cold_requests", 1)
+		pipe.HIncrBy(ctx, key, "cold_wait_ms", coldWait.Milliseconds())
+		metrics.ColdStartWait.WithLabelValues(strconv.FormatUint(modelID, 10)).Observe(coldWait.Seconds())
+	}
+	pipe.Expire(ctx, key, shared.ModelStatsTTL)
+	pipe.Set(ctx, fmt.Sprintf("sybil:v1:model-stats:%d:last", modelID), now.Unix(), shared.ModelStatsTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		im.Log.Warnw("Failed to record model stats", "error", err, "model_id", modelID)
+	}
+}
+
+// modelIsCold reports whether targon last saw the model scaled to zero.
+// Models without a recent replica count are assumed warm
+func (im *InferenceHandler) modelIsCold(ctx context.Context, modelID uint64) bool {
+	replicas, err := im.RedisClient.HGet(ctx, shared.ModelWarmKey(modelID), "replicas").Int64()
+	return err == nil && replicas == 0
+}
@@ -0,0 +1,106 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/shared"
+)
+
+type systemPolicy struct {
+	ID      uint64 `json:"id"`
+	Version uint64 `json:"version"`
+	Content string `json:"content"`
+}
+
+// getSystemPolicy returns the active policy for the api key, falling back to
+// the users policy. Returns nil when neither has one. Key policies are keyed on
+// the public id, web sessions have none and get the users policy
+func (im *InferenceHandler) getSystemPolicy(ctx context.Context, user shared.UserMetadata) (*systemPolicy, error) {
+	cacheKey := fmt.Sprintf("sybil:v1:policy:%d:%s", user.UserID, user.KeyID)
+	cached, err := im.RedisClient.Get(ctx, cacheKey).Result()
+	if err == nil && cached != "" {
+		var policy systemPolicy
+		if err := json.Unmarshal([]byte(cached), &policy); err == nil {
+			if policy.ID == 0 {
+				return nil, nil
+			}
+			return &policy, nil
+		}
+		im.Log.Warnw("Failed to unmarshal cached system policy", "error", err, "user_id", user.UserID)
+	}
+
+	var policy systemPolicy
+	err = im.RDB.QueryRowContext(ctx, `
+		SELECT id, version, content
+		FROM system_prompt_policy
+		WHERE active = true
+		AND user_id = ?
+		AND (api_key_id = ? OR api_key_id IS NULL)
+		ORDER BY api_key_id IS NULL ASC
+		LIMIT 1
+	`, user.UserID, user.KeyID).Scan(&policy.ID, &policy.Version, &policy.Content)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Cache misses too so users without a policy dont hit the db every request
+	go func() {
+		cacheCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		policyJSON, err := json.Marshal(policy)
+		if err != nil {
+			return
+		}
+		if err := im.RedisClient.Set(cacheCtx, cacheKey, policyJSON, shared.SystemPolicyCacheTTL).Err(); err != nil {
+			im.Log.Warnw("Failed to cache system policy", "error", err, "user_id", user.UserID)
+		}
+	}()
+
+	if policy.ID == 0 {
+		return nil, nil
+	}
+	return &policy, nil
+}
+
+// applySystemPolicy injects the policy ahead of any client supplied
+// instructions
+func applySystemPolicy(payload map[string]any, endpoint string, policy *systemPolicy) error {
+	switch endpoint {
+	case shared.ENDPOINTS.CHAT:
+		messages, _ := payload["messages"].([]any)
+		payload["messages"] = append([]any{map[string]any{
+			"role":    "system",
+			"content": policy.Content,
+		}}, messages...)
+	case shared.ENDPOINTS.COMPLETION:
+		switch prompt := payload["prompt"].(type) {
+		case string:
+			payload["prompt"] = policy.Content + "\n\n" + prompt
+		case []any:
+			prompts := make([]any, 0, len(prompt))
+			for _, p := range prompt {
+				s, ok := p.(string)
+				if !ok {
+					return errors.New("prompt must be a string or array of strings")
+				}
+				prompts = append(prompts, policy.Content+"\n\n"+s)
+			}
+			payload["prompt"] = prompts
+		default:
+			return errors.New("prompt must be a string or array of strings")
+		}
+	case shared.ENDPOINTS.RESPONSES:
+		instructions, _ := payload["instructions"].(string)
+		if instructions == "" {
+			payload["instructions"] = policy.Content
+		} else {
+			payload["instructions"] = policy.Content + "\n\n" + instructions
+		}
+	}
+	return nil
+}
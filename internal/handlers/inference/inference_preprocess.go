@@ -4,9 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strings"
 	"time"
 
+	"sybil-api/internal/metrics"
 	"sybil-api/internal/shared"
+	"sybil-api/internal/transform"
 )
 
 type PreprocessInput struct {
@@ -19,6 +25,8 @@ type PreprocessInput struct {
 type RequestInfo struct {
 	Body          []byte
 	UserID        uint64
+	APIKey        string
+	KeyID         string
 	Credits       uint64
 	ID            string
 	StartTime     time.Time
@@ -27,6 +35,59 @@ type RequestInfo struct {
 	Stream        bool
 	URL           string
 	ModelMetadata *InferenceService
+
+	// Set when the client opted into response caching
+	CacheKey string
+
+	// Set when the client asked for a running token and cost count while the
+	// response streams, see usageMeter
+	UsageMeter bool
+
+	// Set for chat requests with a json_schema response_format
+	ResponseSchema map[string]any
+
+	// Sampling seed sent to the model, either from the client or generated
+	Seed          *int64
+	SeedGenerated bool
+
+	// Client metadata stored with the request, never sent to the model
+	Metadata map[string]string
+
+	// System prompt policy applied to the request, if any
+	PolicyID      uint64
+	PolicyVersion uint64
+
+	// Region the users content must stay in, empty for no requirement
+	DataResidency string
+	// The user allows their request and response content to be kept. When
+	// false nothing beyond usage is written to the review queue, response
+	// cache or logs
+	StoreData bool
+	// Set by the client with "ephemeral": true. Nothing about the request is
+	// kept beyond the billing aggregates, see keepsContent
+	Ephemeral bool
+	// Redaction mode of the user, applied to metadata before it is stored
+	PIIRedaction string
+
+	// Customers own key for external provider models. The provider bills the
+	// customer and we only charge the routing fee
+	ProviderAPIKey string
+	BYOK           bool
+
+	// Tokens per minute of the api key, taken once usage is known
+	TokensPerMinute uint64
+	RateLimitKey    string
+
+	// Admitted on one of the users reserved capacity slots
+	Reserved bool
+
+	// The api key does not get the reasoning of reasoning models, see
+	// stripReasoningToken
+	HideReasoning bool
+
+	// Payload transforms of the model and api key, nil when there are none.
+	// Responses run through them before reaching the client
+	Transforms *transform.Pipeline
 }
 
 func (im *InferenceHandler) Preprocess(ctx context.Context, input PreprocessInput) (*RequestInfo, error) {
@@ -47,6 +108,9 @@ func (im *InferenceHandler) Preprocess(ctx context.Context, input PreprocessInpu
 
 	modelName := model.(string)
 	stream := false
+	// Top level fields rewritten below, the rest are sent as the client sent
+	// them, see encodeBody
+	changed := map[string]bool{}
 
 	switch input.Endpoint {
 	case shared.ENDPOINTS.EMBEDDING:
@@ -110,10 +174,75 @@ func (im *InferenceHandler) Preprocess(ctx context.Context, input PreprocessInpu
 		// Set stream default if not specified
 		if val, ok := payload["stream"]; !ok || val == nil {
 			payload["stream"] = shared.DefaultStreamOption
+			changed["stream"] = true
 		}
 		stream = payload["stream"].(bool)
 	}
 
+	// Render prompt templates before anything else reads the messages
+	if input.Endpoint == shared.ENDPOINTS.CHAT {
+		if payload["template_id"] != nil {
+			changed["messages"] = true
+		}
+		if err := im.applyPromptTemplate(ctx, input.User.UserID, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	// Mandatory policies are applied after templates so they always come first
+	var policy *systemPolicy
+	if input.Endpoint != shared.ENDPOINTS.EMBEDDING {
+		policy, err = im.getSystemPolicy(ctx, input.User)
+		if err != nil {
+			return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("internal server error")}, err)
+		}
+		if policy != nil {
+			if err := applySystemPolicy(payload, input.Endpoint, policy); err != nil {
+				return nil, &shared.RequestError{StatusCode: 400, Err: err}
+			}
+			changed["messages"], changed["prompt"], changed["instructions"] = true, true, true
+		}
+	}
+
+	// Response caching is opt-in and never forwarded to the model
+	cacheRequested, _ := payload["cache"].(bool)
+	delete(payload, "cache")
+
+	ephemeral, _ := payload["ephemeral"].(bool)
+	delete(payload, "ephemeral")
+
+	usageMeter, _ := payload["usage_meter"].(bool)
+	delete(payload, "usage_meter")
+
+	metadata, err := parseRequestMetadata(payload["metadata"])
+	if err != nil {
+		return nil, &shared.RequestError{StatusCode: 400, Err: err}
+	}
+	delete(payload, "metadata")
+
+	var seed *int64
+	var seedGenerated bool
+	if input.Endpoint == shared.ENDPOINTS.CHAT || input.Endpoint == shared.ENDPOINTS.COMPLETION {
+		switch v := payload["seed"].(type) {
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, &shared.RequestError{StatusCode: 400, Err: errors.New("seed must be an integer")}
+			}
+			s := int64(v)
+			seed = &s
+		case nil:
+			// Generated seeds would make every request a cache miss
+			if !cacheRequested {
+				s := rand.Int64N(math.MaxInt32)
+				seed, seedGenerated = &s, true
+				payload["seed"] = s
+				changed["seed"] = true
+			}
+		default:
+			return nil, &shared.RequestError{StatusCode: 400, Err: errors.New("seed must be an integer")}
+		}
+	}
+
 	if (input.User.Credits == 0 && input.User.PlanRequests == 0) && !input.User.AllowOverspend {
 		return nil, &shared.RequestError{
 			StatusCode: 402,
@@ -121,17 +250,24 @@ func (im *InferenceHandler) Preprocess(ctx context.Context, input PreprocessInpu
 		}
 	}
 
+	budgets, err := im.getBudgets(ctx, input.User)
+	if err != nil {
+		return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("internal server error")}, err)
+	}
+	if budget := exceededBudget(budgets, time.Now()); budget != nil {
+		metrics.BudgetRejections.Inc()
+		return nil, &shared.RequestError{
+			StatusCode: 402,
+			Err:        fmt.Errorf("%s budget cap reached", strings.ToLower(budget.Period)),
+		}
+	}
+
 	// If streaming is enabled (either by default or explicitly), include usage data
 	if stream {
 		payload["stream_options"] = map[string]any{
 			"include_usage": true,
 		}
-	}
-
-	// repackage body
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("internal server error")}, err)
+		changed["stream_options"] = true
 	}
 
 	modelMetadata, err := im.DiscoverModels(ctx, input.User.UserID, modelName)
@@ -142,9 +278,56 @@ func (im *InferenceHandler) Preprocess(ctx context.Context, input PreprocessInpu
 		}, err)
 	}
 
+	if input.Endpoint == shared.ENDPOINTS.CHAT || input.Endpoint == shared.ENDPOINTS.COMPLETION {
+		applyDefaultParams(payload, modelMetadata.DefaultParams)
+		for _, param := range defaultableParams {
+			changed[param] = true
+		}
+	}
+
+	// Transforms see the request as the model will, defaults included
+	var transforms *transform.Pipeline
+	if input.Endpoint != shared.ENDPOINTS.EMBEDDING {
+		transforms, err = im.getTransforms(ctx, modelName, input.User.APIKey)
+		if err != nil {
+			return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("internal server error")}, err)
+		}
+		payload, err = transforms.TransformRequest(ctx, input.Endpoint, modelName, payload)
+		if err != nil {
+			return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("request transform failed")}, err)
+		}
+	}
+
+	var providerAPIKey string
+	if modelMetadata.ExternalProvider != "" {
+		providerAPIKey, err = im.getProviderKey(ctx, input.User.UserID, modelMetadata.ExternalProvider)
+		if err != nil {
+			return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("internal server error")}, err)
+		}
+	}
+
+	// Transforms may rewrite any field. Cached requests are encoded in full
+	// so the cache key does not depend on how the client formatted the body
+	var body []byte
+	if transforms != nil || cacheRequested {
+		body, err = json.Marshal(payload)
+	} else {
+		body, err = encodeBody(input.Body, payload, changed)
+	}
+	if err != nil {
+		return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("internal server error")}, err)
+	}
+
+	cacheKey := ""
+	if cacheRequested && !stream && input.Endpoint != shared.ENDPOINTS.RESPONSES {
+		cacheKey = responseCacheKey(input.User, modelMetadata.ModelID, input.Endpoint, body)
+	}
+
 	reqInfo := &RequestInfo{
 		Body:          body,
 		UserID:        input.User.UserID,
+		APIKey:        input.User.APIKey,
+		KeyID:         input.User.KeyID,
 		Credits:       input.User.Credits,
 		ID:            input.RequestID,
 		StartTime:     startTime,
@@ -152,7 +335,90 @@ func (im *InferenceHandler) Preprocess(ctx context.Context, input PreprocessInpu
 		Model:         modelName,
 		Stream:        stream,
 		ModelMetadata: modelMetadata,
+		CacheKey:      cacheKey,
+		UsageMeter:    usageMeter && stream,
+		Seed:          seed,
+		SeedGenerated: seedGenerated,
+		Metadata:      metadata,
+		DataResidency: input.User.DataResidency,
+		StoreData:     input.User.StoreData,
+		Ephemeral:     ephemeral,
+		PIIRedaction:  input.User.PIIRedaction,
+		HideReasoning: input.User.HideReasoning,
+
+		ProviderAPIKey: providerAPIKey,
+		BYOK:           providerAPIKey != "",
+
+		TokensPerMinute: input.User.RateLimit().TokensPerMinute,
+		RateLimitKey:    input.User.RateLimitKey(),
+
+		Transforms: transforms,
+	}
+	if policy != nil {
+		reqInfo.PolicyID = policy.ID
+		reqInfo.PolicyVersion = policy.Version
+	}
+	if input.Endpoint == shared.ENDPOINTS.CHAT {
+		reqInfo.ResponseSchema = responseSchema(payload)
 	}
 
 	return reqInfo, nil
 }
+
+// keepsContent reports whether the requests content may be written anywhere
+// beyond the model, the review queue, response cache and logs included
+func (r *RequestInfo) keepsContent() bool {
+	return r.StoreData && !r.Ephemeral
+}
+
+// defaultableParams are the sampling params model owners can set defaults for
+var defaultableParams = []string{"temperature", "top_p", "max_tokens"}
+
+// applyDefaultParams fills in model default sampling params the client did
+// not set
+func applyDefaultParams(payload map[string]any, defaults map[string]any) {
+	for _, param := range defaultableParams {
+		value, ok := defaults[param]
+		if !ok || value == nil {
+			continue
+		}
+		if current, ok := payload[param]; ok && current != nil {
+			continue
+		}
+		// Chat clients may cap output with the newer field name instead
+		if param == "max_tokens" && payload["max_completion_tokens"] != nil {
+			continue
+		}
+		payload[param] = value
+	}
+}
+
+// parseRequestMetadata validates the client metadata object, which must be a
+// small map of string keys to string values
+func parseRequestMetadata(value any) (map[string]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	raw, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("metadata must be an object")
+	}
+	if len(raw) > shared.RequestMetadataMaxKeys {
+		return nil, fmt.Errorf("metadata cannot have more than %d keys", shared.RequestMetadataMaxKeys)
+	}
+	metadata := make(map[string]string, len(raw))
+	for k, v := range raw {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("metadata.%s must be a string", k)
+		}
+		if len(k) > shared.RequestMetadataMaxKeyLength {
+			return nil, fmt.Errorf("metadata keys cannot exceed %d characters", shared.RequestMetadataMaxKeyLength)
+		}
+		if len(s) > shared.RequestMetadataMaxValueLength {
+			return nil, fmt.Errorf("metadata.%s cannot exceed %d characters", k, shared.RequestMetadataMaxValueLength)
+		}
+		metadata[k] = s
+	}
+	return metadata, nil
+}
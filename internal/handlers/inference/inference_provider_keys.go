@@ -0,0 +1,36 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"sybil-api/internal/shared"
+)
+
+// getProviderKey returns the users own key for an external provider, or an
+// empty string when they have not stored one and we should bill as usual
+func (im *InferenceHandler) getProviderKey(ctx context.Context, userID uint64, provider string) (string, error) {
+	if im.ProviderKeyring == nil {
+		return "", nil
+	}
+
+	var sealed shared.SealedPayload
+	err := im.RDB.QueryRowContext(ctx, `
+		SELECT encrypted_key, encryption_key_id, encrypted_data_key
+		FROM provider_key
+		WHERE user_id = ? AND provider = ?
+	`, userID, provider).Scan(&sealed.Ciphertext, &sealed.KeyID, &sealed.DataKey)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Join(errors.New("failed to query provider key"), err)
+	}
+
+	apiKey, err := im.ProviderKeyring.Open(sealed)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to decrypt provider key"), err)
+	}
+	return string(apiKey), nil
+}
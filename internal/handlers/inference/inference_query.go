@@ -6,6 +6,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -13,6 +14,9 @@ import (
 	"time"
 
 	"sybil-api/internal/shared"
+	"sybil-api/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type QueryInput struct {
@@ -22,7 +26,13 @@ type QueryInput struct {
 }
 
 // QueryModels forwards the request to the appropriate model
-func (im *InferenceHandler) QueryModels(ctx context.Context, req *RequestInfo, streamWriter func(token string) error) (*InferenceOutput, error) {
+func (im *InferenceHandler) QueryModels(ctx context.Context, req *RequestInfo, streamWriter func(token string) error) (_ *InferenceOutput, err error) {
+	ctx, span := tracing.Start(ctx, "inference.QueryModels",
+		attribute.String("sybil.model", req.Model),
+		attribute.Int64("sybil.model_id", int64(req.ModelMetadata.ModelID)),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	// Initialize http request
 	route := shared.ROUTES[req.Endpoint]
 	r, err := http.NewRequest("POST", req.ModelMetadata.URL+route, bytes.NewBuffer(req.Body))
@@ -40,14 +50,21 @@ func (im *InferenceHandler) QueryModels(ctx context.Context, req *RequestInfo, s
 		"X-Request-ID": req.ID,
 	}
 
+	// External providers bill the customer directly on their own key
+	if req.ProviderAPIKey != "" {
+		headers["Authorization"] = "Bearer " + req.ProviderAPIKey
+	}
+
 	// Set headers
 	for key, value := range headers {
 		r.Header.Set(key, value)
 	}
 	// Handle cold starts - models scaling from 0 can take time to load
 	var timeoutOccurred atomic.Bool
-	rctx, cancel := context.WithTimeout(context.Background(), shared.DefaultStreamRequestTimeout)
-	timer := time.AfterFunc(shared.DefaultStreamRequestTimeout, func() {
+	timeout := im.requestTimeout(req.Model)
+	// The model request outlives a disconnected client but stays in its trace
+	rctx, cancel := context.WithTimeout(tracing.Detach(ctx), timeout)
+	timer := time.AfterFunc(timeout, func() {
 		// Timer is redundant for non streaming requests
 		if req.Stream {
 			timeoutOccurred.Store(true)
@@ -110,29 +127,53 @@ func (im *InferenceHandler) QueryModels(ctx context.Context, req *RequestInfo, s
 
 	// Stream back response
 	var ttft time.Duration
-	var responses []json.RawMessage
 	var ttftRecorded bool
 	hasDone := false
 
-	reader := bufio.NewScanner(res.Body)
+	// Lines are read as they are forwarded, so a slow client slows the read
+	// from the model rather than growing a buffer
+	maxLine, maxBuffer := im.streamLimits()
+	reader := bufio.NewReaderSize(res.Body, shared.StreamReadBufferSize)
+	buffer := newStreamBuffer(maxBuffer)
+	var readErr, limitErr error
+	var limitMessage string
 	var currentEvent string
+	meter := newUsageMeter(req, im.tokenizerFor(req.ModelMetadata), streamWriter)
 
-scanner:
-	for reader.Scan() {
+lines:
+	for {
 		select {
 		case <-rctx.Done():
-			break scanner
+			break lines
 		default:
-			token := reader.Text()
+			token, err := readStreamLine(reader, maxLine)
+			if errors.Is(err, shared.ErrStreamLineTooLong) {
+				limitErr = err
+				limitMessage = fmt.Sprintf("model sent an event larger than %d bytes", maxLine)
+				break lines
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				break lines
+			}
 
 			// Skip empty lines
 			if token == "" {
 				continue
 			}
 
+			// Reasoning only chunks are held back from the client but still
+			// counted below
+			send := true
+			if req.HideReasoning {
+				token, send = stripReasoningToken(token)
+			}
+
 			// Stream token to client immediately via callback (if provided and client still connected)
-			if streamWriter != nil && ctx.Err() == nil {
-				_ = streamWriter(token)
+			if send && streamWriter != nil && ctx.Err() == nil {
+				_ = streamWriter(im.transformChunk(ctx, req, token))
 			}
 
 			// Handle Responses API event format
@@ -159,20 +200,27 @@ scanner:
 
 			if jsonData == "[DONE]" {
 				hasDone = true
-				break scanner
+				break lines
 			}
 
 			var rawMessage json.RawMessage
-			err := json.Unmarshal([]byte(jsonData), &rawMessage)
+			err = json.Unmarshal([]byte(jsonData), &rawMessage)
 			if err != nil {
 				continue
 			}
-			responses = append(responses, rawMessage)
+			if err := buffer.add(rawMessage); err != nil {
+				limitErr = err
+				limitMessage = fmt.Sprintf("response is larger than the %d byte stream limit", maxBuffer/2)
+				break lines
+			}
+			if ctx.Err() == nil {
+				meter.Observe(rawMessage)
+			}
 		}
 	}
 
-	// shouldnt be able to error since responses is already well formatted json
-	responseBytes, _ := json.Marshal(responses)
+	// shouldnt be able to error since the chunks are already well formatted json
+	responseBytes, _ := json.Marshal(buffer.chunks)
 	if rctx.Err() != nil {
 		errs = errors.Join(errs, shared.ErrModelContext, rctx.Err())
 	}
@@ -180,11 +228,18 @@ scanner:
 		errs = errors.Join(errs, shared.ErrMissingDoneToken)
 	}
 
-	if reader.Err() != nil && !errors.Is(err, context.Canceled) {
-		errs = errors.Join(shared.ErrFailedReadingResponse, err)
+	if readErr != nil && !errors.Is(readErr, context.Canceled) {
+		errs = errors.Join(errs, shared.ErrFailedReadingResponse, readErr)
+	}
+
+	if limitErr != nil {
+		errs = errors.Join(errs, limitErr)
+		if streamWriter != nil && ctx.Err() == nil {
+			_ = streamWriter(streamErrorFrame(limitMessage))
+		}
 	}
 
-	if len(responses) == 0 {
+	if len(buffer.chunks) == 0 {
 		return nil, errors.Join(&shared.RequestError{Err: errors.New("no response from model"), StatusCode: 500}, errs)
 	}
 
@@ -0,0 +1,23 @@
+package inference
+
+import (
+	"context"
+
+	"sybil-api/internal/ratelimit"
+	"sybil-api/internal/shared"
+)
+
+// takeRateLimitTokens takes the requests usage from the api keys token bucket.
+// The bucket may go negative, which holds back the keys next requests until it
+// refills
+func (im *InferenceHandler) takeRateLimitTokens(req *RequestInfo, usage *shared.Usage) {
+	tokens := usage.PromptTokens + usage.CompletionTokens
+	if req.TokensPerMinute == 0 || tokens == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shared.RateLimitTimeout)
+	defer cancel()
+	if _, err := ratelimit.Take(ctx, im.RedisClient, ratelimit.TokensKey(req.RateLimitKey), req.TokensPerMinute, tokens, true); err != nil {
+		im.Log.Warnw("Failed to take rate limit tokens", "error", err, "user_id", req.UserID)
+	}
+}
@@ -0,0 +1,144 @@
+package inference
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Reasoning models (DeepSeek-R1 style) send their chain of thought next to
+// the answer, as reasoning_content or reasoning on the delta or message.
+// Responses API streams send it as response.reasoning events. Keys with the
+// hide reasoning policy never see it, everyone else gets it passed through
+var reasoningFields = []string{"reasoning_content", "reasoning"}
+
+// stripReasoningToken removes reasoning from one line of a stream. send is
+// false when the line carried nothing but reasoning and should not reach the
+// client, the stripped line is still returned so usage counts it
+func stripReasoningToken(token string) (string, bool) {
+	if event, ok := strings.CutPrefix(token, "event: "); ok {
+		return token, !strings.HasPrefix(event, "response.reasoning")
+	}
+	data, ok := strings.CutPrefix(token, "data: ")
+	if !ok || data == "[DONE]" {
+		return token, true
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return token, true
+	}
+	if eventType, _ := chunk["type"].(string); strings.HasPrefix(eventType, "response.reasoning") {
+		return token, false
+	}
+	stripped, onlyReasoning := stripChoicesReasoning(chunk, "delta")
+	if !stripped {
+		return token, true
+	}
+	b, err := json.Marshal(chunk)
+	if err != nil {
+		return token, true
+	}
+	return "data: " + string(b), !onlyReasoning
+}
+
+// stripReasoningBody removes reasoning from a non streaming response, or from
+// the chunks of a finished stream
+func stripReasoningBody(body []byte) []byte {
+	var chunks []map[string]any
+	if err := json.Unmarshal(body, &chunks); err == nil {
+		for _, chunk := range chunks {
+			stripChoicesReasoning(chunk, "delta")
+		}
+		if b, err := json.Marshal(chunks); err == nil {
+			return b
+		}
+		return body
+	}
+	var response map[string]any
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body
+	}
+	if stripped, _ := stripChoicesReasoning(response, "message"); !stripped {
+		return body
+	}
+	if b, err := json.Marshal(response); err == nil {
+		return b
+	}
+	return body
+}
+
+// stripChoicesReasoning deletes the reasoning fields from the delta or
+// message of every choice. onlyReasoning reports that nothing the client
+// needs is left, no content, tool calls, finish reason or usage
+func stripChoicesReasoning(body map[string]any, key string) (stripped bool, onlyReasoning bool) {
+	choices, _ := body["choices"].([]any)
+	onlyReasoning = len(choices) > 0 && body["usage"] == nil
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		part, _ := choice[key].(map[string]any)
+		for _, field := range reasoningFields {
+			if _, ok := part[field]; ok {
+				delete(part, field)
+				stripped = true
+			}
+		}
+		content, _ := part["content"].(string)
+		if content != "" || part["tool_calls"] != nil || choice["finish_reason"] != nil {
+			onlyReasoning = false
+		}
+	}
+	return stripped, stripped && onlyReasoning
+}
+
+// extractReasoningFromInferenceOutput joins the reasoning of a streamed
+// response, the counterpart of extractContentFromInferenceOutput
+func extractReasoningFromInferenceOutput(out *InferenceOutput) string {
+	if out == nil || len(out.FinalResponse) == 0 {
+		return ""
+	}
+	var chunks []struct {
+		Choices []struct {
+			Delta *struct {
+				ReasoningContent string `json:"reasoning_content"`
+				Reasoning        string `json:"reasoning"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(out.FinalResponse, &chunks); err != nil {
+		return ""
+	}
+	var reasoning strings.Builder
+	for _, chunk := range chunks {
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta == nil {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+		if delta.ReasoningContent != "" {
+			reasoning.WriteString(delta.ReasoningContent)
+		} else {
+			reasoning.WriteString(delta.Reasoning)
+		}
+	}
+	return reasoning.String()
+}
+
+func extractReasoningFromFinalResponse(finalResponse []byte) string {
+	var response struct {
+		Choices []struct {
+			Message *struct {
+				ReasoningContent string `json:"reasoning_content"`
+				Reasoning        string `json:"reasoning"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(finalResponse, &response); err != nil {
+		return ""
+	}
+	if len(response.Choices) == 0 || response.Choices[0].Message == nil {
+		return ""
+	}
+	message := response.Choices[0].Message
+	if message.ReasoningContent != "" {
+		return message.ReasoningContent
+	}
+	return message.Reasoning
+}
@@ -0,0 +1,100 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"sybil-api/internal/shared"
+)
+
+type RequestRecord struct {
+	ID               string  `json:"id"`
+	Model            string  `json:"model"`
+	Endpoint         string  `json:"endpoint"`
+	PromptTokens     uint64  `json:"prompt_tokens"`
+	CompletionTokens uint64  `json:"completion_tokens"`
+	TimeToFirstToken int64   `json:"time_to_first_token_ms"`
+	TotalTime        int64   `json:"total_time_ms"`
+	Credits          uint64  `json:"credits"`
+	Cost             float64 `json:"cost"`
+	Seed             *int64  `json:"seed,omitempty"`
+	BYOK             bool    `json:"byok"`
+	// Rates billed at, unset for requests recorded before rates were kept
+	ICPT            *uint64           `json:"icpt,omitempty"`
+	OCPT            *uint64           `json:"ocpt,omitempty"`
+	CRC             *uint64           `json:"crc,omitempty"`
+	PriceMultiplier *float64          `json:"price_multiplier,omitempty"`
+	Metadata        map[string]string `json:"metadata"`
+	CreatedAt       int64             `json:"created_at"`
+}
+
+// GetRequestInput contains all data needed for GetRequest business logic
+type GetRequestInput struct {
+	Ctx       context.Context
+	UserID    uint64
+	RequestID string
+}
+
+// GetRequest looks up a completed request owned by the user. Requests are
+// written when usage buckets flush, so they are not visible immediately
+func (im *InferenceHandler) GetRequest(input GetRequestInput) (*RequestRecord, error) {
+	log := shared.LoggerFromContext(input.Ctx, im.Log)
+	var record RequestRecord
+	var metadataJSON sql.NullString
+	err := im.RDB.QueryRowContext(input.Ctx, `
+		SELECT
+			request.request_id,
+			model.name,
+			request.endpoint,
+			request.prompt_tokens,
+			request.completion_tokens,
+			request.time_to_first_token,
+			request.total_time,
+			request.credits,
+			request.seed,
+			request.metadata,
+			request.byok,
+			request.icpt,
+			request.ocpt,
+			request.crc,
+			request.price_multiplier,
+			UNIX_TIMESTAMP(request.created_at)
+		FROM request
+		INNER JOIN model ON request.model_id = model.id
+		WHERE request.request_id = ? AND request.user_id = ?
+	`, input.RequestID, input.UserID).Scan(
+		&record.ID,
+		&record.Model,
+		&record.Endpoint,
+		&record.PromptTokens,
+		&record.CompletionTokens,
+		&record.TimeToFirstToken,
+		&record.TotalTime,
+		&record.Credits,
+		&record.Seed,
+		&metadataJSON,
+		&record.BYOK,
+		&record.ICPT,
+		&record.OCPT,
+		&record.CRC,
+		&record.PriceMultiplier,
+		&record.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("request not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query request"), err, shared.ErrInternalServerError)
+	}
+
+	record.Cost = float64(record.Credits) * shared.CreditsToUSD
+	record.Metadata = map[string]string{}
+	if metadataJSON.Valid && metadataJSON.String != "" {
+		if err := json.Unmarshal([]byte(metadataJSON.String), &record.Metadata); err != nil {
+			log.Warnw("Failed to unmarshal request metadata", "error", err, "request_id", input.RequestID)
+		}
+	}
+	return &record, nil
+}
@@ -0,0 +1,100 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+
+	"sybil-api/internal/redact"
+	"sybil-api/internal/shared"
+)
+
+// identifyingFields are removed from sampled request bodies
+var identifyingFields = []string{"user", "metadata", "safety_identifier", "prompt_cache_key"}
+
+func shouldSampleForReview(req *RequestInfo) bool {
+	// The review queue lives in the primary region, so content from accounts
+	// pinned to a region is never copied there
+	if req.Endpoint == shared.ENDPOINTS.EMBEDDING || req.DataResidency != "" || !req.keepsContent() {
+		return false
+	}
+	rate := req.ModelMetadata.ReviewSampleRate
+	return rate > 0 && rand.Float64() < rate
+}
+
+// sampleForReview stores an anonymized copy of the request and response in the
+// review queue, with the users redaction applied. The owner is kept only so
+// DeleteUserData can purge their samples, reviewers never see it
+func (im *InferenceHandler) sampleForReview(user shared.UserMetadata, req *RequestInfo, res *InferenceOutput) {
+	var payload map[string]any
+	if err := json.Unmarshal(req.Body, &payload); err != nil {
+		im.Log.Warnw("Failed to unmarshal request body for review sample", "error", err)
+		return
+	}
+	for _, field := range identifyingFields {
+		delete(payload, field)
+	}
+	delete(payload, "stream_options")
+
+	var response string
+	switch {
+	case req.Endpoint == shared.ENDPOINTS.CHAT && req.Stream:
+		response = extractContentFromInferenceOutput(res)
+	case req.Endpoint == shared.ENDPOINTS.CHAT:
+		response = extractContentFromFinalResponse(res.FinalResponse)
+	default:
+		response = string(res.FinalResponse)
+	}
+
+	ctx := context.Background()
+	redactor := im.redactor(user, req.ID)
+	if redactor != nil {
+		im.redactSamplePayload(ctx, redactor, payload)
+		response = im.redactText(ctx, redactor, "review_sample", response)
+	}
+	requestJSON, err := json.Marshal(payload)
+	if err != nil {
+		im.Log.Warnw("Failed to marshal review sample request", "error", err)
+		return
+	}
+	if len(requestJSON) > shared.ReviewMaxContentBytes || len(response) > shared.ReviewMaxContentBytes {
+		return
+	}
+
+	_, err = im.WDB.Exec(`
+		INSERT INTO review_sample (user_id, model_id, model, endpoint, request, response, completed)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, req.UserID, req.ModelMetadata.ModelID, req.Model, req.Endpoint, string(requestJSON), response, res.Metadata.Completed)
+	if err != nil {
+		im.Log.Warnw("Failed to insert review sample", "error", err, "model", req.Model)
+	}
+}
+
+// redactSamplePayload redacts the prompt and message text of a sampled
+// request body in place, both plain string content and text parts
+func (im *InferenceHandler) redactSamplePayload(ctx context.Context, r redact.Redactor, payload map[string]any) {
+	if prompt, ok := payload["prompt"].(string); ok {
+		payload["prompt"] = im.redactText(ctx, r, "review_sample", prompt)
+	}
+	messages, _ := payload["messages"].([]any)
+	for _, m := range messages {
+		msg, ok := m.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch content := msg["content"].(type) {
+		case string:
+			msg["content"] = im.redactText(ctx, r, "review_sample", content)
+		case []any:
+			for _, p := range content {
+				part, ok := p.(map[string]any)
+				if !ok {
+					continue
+				}
+				if text, ok := part["text"].(string); ok {
+					part["text"] = im.redactText(ctx, r, "review_sample", text)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package inference
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"strings"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// responseSchema returns the json schema from a chat requests response_format,
+// or nil if the request did not ask for structured output
+func responseSchema(payload map[string]any) map[string]any {
+	format, ok := payload["response_format"].(map[string]any)
+	if !ok || format["type"] != "json_schema" {
+		return nil
+	}
+	jsonSchema, ok := format["json_schema"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	schema, ok := jsonSchema["schema"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	return schema
+}
+
+// checkStructuredOutput validates the response content against the requests
+// schema and records the result
+func (im *InferenceHandler) checkStructuredOutput(req *RequestInfo, res *InferenceOutput, attempt string) error {
+	var content string
+	if req.Stream {
+		content = extractContentFromInferenceOutput(res)
+	} else {
+		content = extractContentFromFinalResponse(res.FinalResponse)
+	}
+
+	var value any
+	err := json.Unmarshal([]byte(content), &value)
+	if err != nil {
+		err = fmt.Errorf("output is not valid json: %w", err)
+	} else {
+		err = validateSchema(value, req.ResponseSchema, "$")
+	}
+
+	result := "valid"
+	if err != nil {
+		result = "invalid"
+	}
+	metrics.SchemaValidationCount.WithLabelValues(req.Model, attempt, result).Inc()
+	return err
+}
+
+// queryStructured runs a non streaming structured output request, retrying
+// once if the model returns output that does not match the schema. One
+// attempt is billed, the retry is on us. When both are rejected the last
+// output is returned with the 422 so the caller bills it
+func (im *InferenceHandler) queryStructured(input InferenceInput) (*InferenceOutput, error) {
+	req := input.Req
+	res, err := im.QueryModels(input.Ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil || !res.Metadata.Completed {
+		return res, nil
+	}
+	verr := im.checkStructuredOutput(req, res, "first")
+	if verr == nil {
+		return res, nil
+	}
+	shared.LoggerFromContext(input.Ctx, im.Log).Infow("Structured output failed schema validation, retrying", "model", req.Model, "error", verr)
+
+	// The same seed would likely sample the same invalid output again. Seeds
+	// the client chose are kept
+	if req.SeedGenerated {
+		if err := reseed(req); err != nil {
+			return nil, errors.Join(&shared.RequestError{StatusCode: 500, Err: errors.New("internal server error")}, err)
+		}
+	}
+	res, err = im.QueryModels(input.Ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil || !res.Metadata.Completed {
+		return res, nil
+	}
+	verr = im.checkStructuredOutput(req, res, "retry")
+	if verr == nil {
+		return res, nil
+	}
+	return res, &shared.RequestError{
+		StatusCode: 422,
+		Err:        fmt.Errorf("model output did not match response_format schema: %w", verr),
+	}
+}
+
+// reseed replaces the generated seed of req with a new one
+func reseed(req *RequestInfo) error {
+	var payload map[string]any
+	if err := json.Unmarshal(req.Body, &payload); err != nil {
+		return err
+	}
+	seed := rand.Int64N(math.MaxInt32)
+	payload["seed"] = seed
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req.Body, req.Seed = body, &seed
+	return nil
+}
+
+// validateSchema checks value against the subset of json schema used for
+// structured outputs. Unsupported keywords such as $ref are ignored
+func validateSchema(value any, schema map[string]any, path string) error {
+	if t, ok := schema["type"]; ok && !matchesType(value, t) {
+		return fmt.Errorf("%s: expected type %v", path, t)
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		var matched bool
+		for _, sub := range anyOf {
+			subSchema, ok := sub.(map[string]any)
+			if ok && validateSchema(value, subSchema, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value does not match any schema in anyOf", path)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, r := range required {
+				key, _ := r.(string)
+				if _, ok := v[key]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, key)
+				}
+			}
+		}
+		for key, propValue := range v {
+			propSchema, ok := properties[key].(map[string]any)
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s: unexpected property %q", path, key)
+				}
+				continue
+			}
+			if err := validateSchema(propValue, propSchema, path+"."+key); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if minItems, ok := schema["minItems"].(float64); ok && float64(len(v)) < minItems {
+			return fmt.Errorf("%s: expected at least %v items", path, minItems)
+		}
+		if maxItems, ok := schema["maxItems"].(float64); ok && float64(len(v)) > maxItems {
+			return fmt.Errorf("%s: expected at most %v items", path, maxItems)
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validateSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if minLength, ok := schema["minLength"].(float64); ok && length < minLength {
+			return fmt.Errorf("%s: expected at least %v characters", path, minLength)
+		}
+		if maxLength, ok := schema["maxLength"].(float64); ok && length > maxLength {
+			return fmt.Errorf("%s: expected at most %v characters", path, maxLength)
+		}
+	case float64:
+		if minimum, ok := schema["minimum"].(float64); ok && v < minimum {
+			return fmt.Errorf("%s: expected value >= %v", path, minimum)
+		}
+		if maximum, ok := schema["maximum"].(float64); ok && v > maximum {
+			return fmt.Errorf("%s: expected value <= %v", path, maximum)
+		}
+	}
+	return nil
+}
+
+func matchesType(value any, t any) bool {
+	switch types := t.(type) {
+	case string:
+		return matchesSingleType(value, types)
+	case []any:
+		for _, single := range types {
+			name, _ := single.(string)
+			if matchesSingleType(value, name) {
+				return true
+			}
+		}
+		return false
+	default:
+		// Malformed type keyword, let the model output through
+		return true
+	}
+}
+
+func matchesSingleType(value any, t string) bool {
+	switch strings.ToLower(t) {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	default:
+		return false
+	}
+}
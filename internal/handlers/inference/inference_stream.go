@@ -0,0 +1,272 @@
+package inference
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"sybil-api/internal/shared"
+)
+
+// streamLimits returns the longest line a model may send in a stream and the
+// most chunk bytes kept for a single response
+func (im *InferenceHandler) streamLimits() (int, int) {
+	maxLine := im.Upstream.MaxStreamLineBytes
+	if maxLine <= 0 {
+		maxLine = shared.StreamMaxLineBytes
+	}
+	maxBuffer := im.Upstream.MaxStreamBufferBytes
+	if maxBuffer <= 0 {
+		maxBuffer = shared.StreamMaxBufferBytes
+	}
+	return maxLine, maxBuffer
+}
+
+// readStreamLine returns the next line without its line ending. Lines longer
+// than maxBytes are read to their end and rejected, so nothing past the limit
+// is held in memory
+func readStreamLine(r *bufio.Reader, maxBytes int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		fragment, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if !tooLong && len(line)+len(fragment) > maxBytes {
+			tooLong = true
+			line = nil
+		}
+		if !tooLong {
+			line = append(line, fragment...)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if tooLong {
+		return "", shared.ErrStreamLineTooLong
+	}
+	return string(line), nil
+}
+
+// streamErrorFrame is the last event sent to a client whose stream was cut
+// short by a limit
+func streamErrorFrame(message string) string {
+	frame, _ := json.Marshal(map[string]any{"error": shared.OpenAIError{
+		Message: message,
+		Object:  "error",
+		Type:    "server_error",
+		Code:    500,
+	}})
+	return "data: " + string(frame)
+}
+
+// streamBuffer holds the chunks of a streamed response for billing, history
+// and the cache. Once they pass maxBytes, runs of plain text chunks are merged
+// into one chunk each. Their text and the usage are kept, the per chunk
+// envelopes are not
+type streamBuffer struct {
+	chunks   []json.RawMessage
+	size     int
+	maxBytes int
+}
+
+func newStreamBuffer(maxBytes int) *streamBuffer {
+	return &streamBuffer{maxBytes: maxBytes}
+}
+
+// add keeps chunk, failing with shared.ErrStreamBufferFull when the response
+// is still over half the limit after merging
+func (b *streamBuffer) add(chunk json.RawMessage) error {
+	b.chunks = append(b.chunks, chunk)
+	b.size += len(chunk)
+	if b.size <= b.maxBytes {
+		return nil
+	}
+	b.chunks = compactChunks(b.chunks)
+	b.size = 0
+	for _, c := range b.chunks {
+		b.size += len(c)
+	}
+	if b.size > b.maxBytes/2 {
+		return shared.ErrStreamBufferFull
+	}
+	return nil
+}
+
+// compactChunks merges consecutive chunks with the same merge key, leaving
+// every other chunk as it was
+func compactChunks(chunks []json.RawMessage) []json.RawMessage {
+	out := make([]json.RawMessage, 0, len(chunks))
+	var run []map[string]any
+	var runRaw []json.RawMessage
+	runKey := ""
+	flush := func() {
+		if len(run) > 1 {
+			if raw, err := json.Marshal(mergeChunks(run)); err == nil {
+				runRaw = []json.RawMessage{raw}
+			}
+		}
+		out = append(out, runRaw...)
+		run, runRaw = nil, nil
+	}
+	for _, raw := range chunks {
+		var chunk map[string]any
+		if err := json.Unmarshal(raw, &chunk); err != nil {
+			flush()
+			out = append(out, raw)
+			continue
+		}
+		key := mergeKey(chunk)
+		if key == "" {
+			flush()
+			out = append(out, raw)
+			continue
+		}
+		if key != runKey {
+			flush()
+			runKey = key
+		}
+		run = append(run, chunk)
+		runRaw = append(runRaw, raw)
+	}
+	flush()
+	return out
+}
+
+// deltaTextFields are the fields of a chat delta that are concatenated
+var deltaTextFields = []string{"content", "reasoning_content", "reasoning"}
+
+// mergeKey is what a chunk can be merged with, empty when it cannot. Chat and
+// completion chunks carrying only text merge with each other, Responses text
+// deltas merge within the same content part. Chunks with usage, tool calls,
+// logprobs or a finish reason are kept whole
+func mergeKey(chunk map[string]any) string {
+	if usage, ok := chunk["usage"]; ok && usage != nil {
+		return ""
+	}
+	if eventType, ok := chunk["type"].(string); ok {
+		if !strings.HasSuffix(eventType, "_text.delta") {
+			return ""
+		}
+		if _, ok := chunk["delta"].(string); !ok {
+			return ""
+		}
+		return fmt.Sprintf("%s|%v|%v|%v", eventType, chunk["item_id"], chunk["output_index"], chunk["content_index"])
+	}
+
+	choices, ok := chunk["choices"].([]any)
+	if !ok || len(choices) == 0 {
+		return ""
+	}
+	for _, raw := range choices {
+		choice, ok := raw.(map[string]any)
+		if !ok {
+			return ""
+		}
+		for key, value := range choice {
+			switch key {
+			case "index":
+			case "text":
+				if _, ok := value.(string); !ok {
+					return ""
+				}
+			case "delta":
+				delta, ok := value.(map[string]any)
+				if !ok {
+					return ""
+				}
+				for field, v := range delta {
+					if v == nil || field == "role" {
+						continue
+					}
+					if _, ok := v.(string); !ok || !slices.Contains(deltaTextFields, field) {
+						return ""
+					}
+				}
+			default:
+				if value != nil {
+					return ""
+				}
+			}
+		}
+	}
+	return "choices"
+}
+
+// mergeChunks joins the text of a run of chunks sharing a merge key into the
+// first of them
+func mergeChunks(run []map[string]any) map[string]any {
+	merged := run[0]
+	if _, ok := merged["type"].(string); ok {
+		var delta strings.Builder
+		for _, chunk := range run {
+			delta.WriteString(chunk["delta"].(string))
+		}
+		merged["delta"] = delta.String()
+		return merged
+	}
+
+	type choiceText struct {
+		choice map[string]any
+		text   map[string]*strings.Builder
+	}
+	write := func(ct *choiceText, field, text string) {
+		b, ok := ct.text[field]
+		if !ok {
+			b = &strings.Builder{}
+			ct.text[field] = b
+		}
+		b.WriteString(text)
+	}
+	order := []float64{}
+	byIndex := map[float64]*choiceText{}
+	for _, chunk := range run {
+		for _, raw := range chunk["choices"].([]any) {
+			choice := raw.(map[string]any)
+			index, _ := choice["index"].(float64)
+			ct, ok := byIndex[index]
+			if !ok {
+				ct = &choiceText{choice: choice, text: map[string]*strings.Builder{}}
+				byIndex[index] = ct
+				order = append(order, index)
+			}
+			if text, ok := choice["text"].(string); ok {
+				write(ct, "text", text)
+			}
+			if delta, ok := choice["delta"].(map[string]any); ok {
+				for _, field := range deltaTextFields {
+					if text, ok := delta[field].(string); ok {
+						write(ct, "delta."+field, text)
+					}
+				}
+			}
+		}
+	}
+
+	choices := make([]any, 0, len(order))
+	for _, index := range order {
+		ct := byIndex[index]
+		if b, ok := ct.text["text"]; ok {
+			ct.choice["text"] = b.String()
+		}
+		delta, _ := ct.choice["delta"].(map[string]any)
+		if delta == nil {
+			delta = map[string]any{}
+		}
+		for _, field := range deltaTextFields {
+			if b, ok := ct.text["delta."+field]; ok {
+				delta[field] = b.String()
+			}
+		}
+		if len(delta) > 0 {
+			ct.choice["delta"] = delta
+		}
+		choices = append(choices, ct.choice)
+	}
+	merged["choices"] = choices
+	return merged
+}
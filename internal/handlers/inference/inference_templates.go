@@ -0,0 +1,280 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"sybil-api/internal/shared"
+
+	"github.com/aidarkhanov/nanoid"
+)
+
+// templateVariable matches {{ name }} placeholders in template messages
+var templateVariable = regexp.MustCompile(`\{\{\s*([a-zA-Z0-9_]+)\s*\}\}`)
+
+type PromptTemplate struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Messages  []map[string]any `json:"messages"`
+	Variables []string         `json:"variables"`
+	CreatedAt int64            `json:"created_at"`
+	UpdatedAt int64            `json:"updated_at"`
+}
+
+type PromptTemplateRequest struct {
+	Name     string           `json:"name"`
+	Messages []map[string]any `json:"messages"`
+}
+
+// PromptTemplateInput contains all data needed for prompt template business logic
+type PromptTemplateInput struct {
+	Ctx        context.Context
+	UserID     uint64
+	TemplateID string
+	Req        *PromptTemplateRequest
+}
+
+func validatePromptTemplate(req *PromptTemplateRequest) error {
+	if req == nil {
+		return errors.Join(errors.New("request body is required"), shared.ErrBadRequest)
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return errors.Join(errors.New("name is required"), shared.ErrBadRequest)
+	}
+	if len(req.Messages) == 0 {
+		return errors.Join(errors.New("messages cannot be empty"), shared.ErrBadRequest)
+	}
+	for i, message := range req.Messages {
+		if role, _ := message["role"].(string); role == "" {
+			return errors.Join(fmt.Errorf("messages[%d].role is required", i), shared.ErrBadRequest)
+		}
+		if _, ok := message["content"]; !ok {
+			return errors.Join(fmt.Errorf("messages[%d].content is required", i), shared.ErrBadRequest)
+		}
+	}
+	return nil
+}
+
+func (im *InferenceHandler) CreatePromptTemplate(input PromptTemplateInput) (*PromptTemplate, error) {
+	if err := validatePromptTemplate(input.Req); err != nil {
+		return nil, err
+	}
+	messagesJSON, err := json.Marshal(input.Req.Messages)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal messages"), err, shared.ErrInternalServerError)
+	}
+	if len(messagesJSON) > shared.PromptTemplateMaxBytes {
+		return nil, errors.Join(fmt.Errorf("template cannot exceed %d bytes", shared.PromptTemplateMaxBytes), shared.ErrBadRequest)
+	}
+
+	templateNano, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 16)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to generate template id"), err, shared.ErrInternalServerError)
+	}
+	templateID := "tmpl-" + templateNano
+
+	_, err = im.WDB.ExecContext(input.Ctx, `
+		INSERT INTO prompt_template (id, user_id, name, messages)
+		VALUES (?, ?, ?, ?)
+	`, templateID, input.UserID, input.Req.Name, string(messagesJSON))
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to insert prompt template"), err, shared.ErrInternalServerError)
+	}
+	return im.GetPromptTemplate(PromptTemplateInput{Ctx: input.Ctx, UserID: input.UserID, TemplateID: templateID})
+}
+
+func (im *InferenceHandler) UpdatePromptTemplate(input PromptTemplateInput) (*PromptTemplate, error) {
+	if err := validatePromptTemplate(input.Req); err != nil {
+		return nil, err
+	}
+	messagesJSON, err := json.Marshal(input.Req.Messages)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal messages"), err, shared.ErrInternalServerError)
+	}
+	if len(messagesJSON) > shared.PromptTemplateMaxBytes {
+		return nil, errors.Join(fmt.Errorf("template cannot exceed %d bytes", shared.PromptTemplateMaxBytes), shared.ErrBadRequest)
+	}
+
+	// Make sure the template exists and is owned by the user before updating,
+	// RowsAffected is 0 for unchanged rows
+	if _, err := im.GetPromptTemplate(input); err != nil {
+		return nil, err
+	}
+	_, err = im.WDB.ExecContext(input.Ctx, `
+		UPDATE prompt_template SET name = ?, messages = ?, updated_at = NOW()
+		WHERE id = ? AND user_id = ?
+	`, input.Req.Name, string(messagesJSON), input.TemplateID, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to update prompt template"), err, shared.ErrInternalServerError)
+	}
+	return im.GetPromptTemplate(input)
+}
+
+func (im *InferenceHandler) DeletePromptTemplate(input PromptTemplateInput) error {
+	res, err := im.WDB.ExecContext(input.Ctx, `
+		DELETE FROM prompt_template WHERE id = ? AND user_id = ?
+	`, input.TemplateID, input.UserID)
+	if err != nil {
+		return errors.Join(errors.New("failed to delete prompt template"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return errors.Join(errors.New("prompt template not found"), shared.ErrNotFound)
+	}
+	return nil
+}
+
+func (im *InferenceHandler) GetPromptTemplate(input PromptTemplateInput) (*PromptTemplate, error) {
+	var template PromptTemplate
+	var messagesJSON string
+	err := im.RDB.QueryRowContext(input.Ctx, `
+		SELECT id, name, messages, UNIX_TIMESTAMP(created_at), UNIX_TIMESTAMP(updated_at)
+		FROM prompt_template
+		WHERE id = ? AND user_id = ?
+	`, input.TemplateID, input.UserID).Scan(&template.ID, &template.Name, &messagesJSON, &template.CreatedAt, &template.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("prompt template not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query prompt template"), err, shared.ErrInternalServerError)
+	}
+	if err := json.Unmarshal([]byte(messagesJSON), &template.Messages); err != nil {
+		return nil, errors.Join(errors.New("failed to unmarshal template messages"), err, shared.ErrInternalServerError)
+	}
+	template.Variables = templateVariables(messagesJSON)
+	return &template, nil
+}
+
+func (im *InferenceHandler) ListPromptTemplates(input PromptTemplateInput) ([]PromptTemplate, error) {
+	log := shared.LoggerFromContext(input.Ctx, im.Log)
+	rows, err := im.RDB.QueryContext(input.Ctx, `
+		SELECT id, name, messages, UNIX_TIMESTAMP(created_at), UNIX_TIMESTAMP(updated_at)
+		FROM prompt_template
+		WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query prompt templates"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	templates := []PromptTemplate{}
+	for rows.Next() {
+		var template PromptTemplate
+		var messagesJSON string
+		if err := rows.Scan(&template.ID, &template.Name, &messagesJSON, &template.CreatedAt, &template.UpdatedAt); err != nil {
+			log.Warnw("Failed to scan prompt template row", "error", err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(messagesJSON), &template.Messages); err != nil {
+			log.Warnw("Failed to unmarshal template messages", "error", err, "template_id", template.ID)
+			continue
+		}
+		template.Variables = templateVariables(messagesJSON)
+		templates = append(templates, template)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating prompt template rows"), err, shared.ErrInternalServerError)
+	}
+	return templates, nil
+}
+
+// applyPromptTemplate renders the template referenced by template_id into the
+// payload messages. Template messages come before any messages the client sent
+func (im *InferenceHandler) applyPromptTemplate(ctx context.Context, userID uint64, payload map[string]any) error {
+	templateID, _ := payload["template_id"].(string)
+	variables, _ := payload["variables"].(map[string]any)
+	delete(payload, "template_id")
+	delete(payload, "variables")
+	if templateID == "" {
+		return nil
+	}
+
+	template, err := im.GetPromptTemplate(PromptTemplateInput{Ctx: ctx, UserID: userID, TemplateID: templateID})
+	if err != nil {
+		if errors.Is(err, shared.ErrNotFound) {
+			return &shared.RequestError{StatusCode: 404, Err: errors.New("prompt template not found")}
+		}
+		return err
+	}
+
+	values := make(map[string]string, len(variables))
+	for name, value := range variables {
+		switch v := value.(type) {
+		case string:
+			values[name] = v
+		default:
+			encoded, _ := json.Marshal(v)
+			values[name] = string(encoded)
+		}
+	}
+	for _, name := range template.Variables {
+		if _, ok := values[name]; !ok {
+			return &shared.RequestError{StatusCode: 400, Err: fmt.Errorf("missing template variable: %s", name)}
+		}
+	}
+
+	messages := make([]any, 0, len(template.Messages))
+	for _, message := range template.Messages {
+		messages = append(messages, renderTemplateMessage(message, values))
+	}
+	if clientMessages, ok := payload["messages"].([]any); ok {
+		messages = append(messages, clientMessages...)
+	}
+	payload["messages"] = messages
+	return nil
+}
+
+func renderTemplateMessage(message map[string]any, values map[string]string) map[string]any {
+	render := func(s string) string {
+		return templateVariable.ReplaceAllStringFunc(s, func(match string) string {
+			name := templateVariable.FindStringSubmatch(match)[1]
+			return values[name]
+		})
+	}
+
+	rendered := make(map[string]any, len(message))
+	for k, v := range message {
+		rendered[k] = v
+	}
+	switch content := message["content"].(type) {
+	case string:
+		rendered["content"] = render(content)
+	case []any:
+		parts := make([]any, 0, len(content))
+		for _, part := range content {
+			p, ok := part.(map[string]any)
+			if text, isText := p["text"].(string); ok && isText {
+				renderedPart := make(map[string]any, len(p))
+				for k, v := range p {
+					renderedPart[k] = v
+				}
+				renderedPart["text"] = render(text)
+				parts = append(parts, renderedPart)
+				continue
+			}
+			parts = append(parts, part)
+		}
+		rendered["content"] = parts
+	}
+	return rendered
+}
+
+// templateVariables returns the unique variable names used in a template
+func templateVariables(messagesJSON string) []string {
+	seen := map[string]bool{}
+	variables := []string{}
+	for _, match := range templateVariable.FindAllStringSubmatch(messagesJSON, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			variables = append(variables, match[1])
+		}
+	}
+	return variables
+}
@@ -0,0 +1,174 @@
+package inference
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"sybil-api/internal/shared"
+	"sybil-api/internal/tokenizer"
+)
+
+// Local counts add a rough chat template overhead per message
+const (
+	tokensPerMessage  = 4
+	tokenizeTimeout   = 10 * time.Second
+	backendTokenRoute = "/tokenize"
+)
+
+type TokenizeInput struct {
+	Ctx  context.Context
+	User shared.UserMetadata
+	Body []byte
+}
+
+type TokenizeOutput struct {
+	Model            string `json:"model"`
+	PromptTokens     uint64 `json:"prompt_tokens"`
+	MaxModelLength   uint64 `json:"max_model_len,omitempty"`
+	Estimated        bool   `json:"estimated"`
+	EstimatedCredits uint64 `json:"estimated_credits"`
+	EstimatedUSD     string `json:"estimated_usd"`
+}
+
+type tokenizeRequest struct {
+	Model    string               `json:"model"`
+	Messages []shared.ChatMessage `json:"messages,omitempty"`
+	Prompt   string               `json:"prompt,omitempty"`
+}
+
+type backendTokenizeResponse struct {
+	Count       uint64 `json:"count"`
+	MaxModelLen uint64 `json:"max_model_len"`
+}
+
+// Tokenize returns the prompt token count for a chat or completion payload.
+// The model backend is asked first, and the models local tokenizer is used
+// when it cannot answer
+func (im *InferenceHandler) Tokenize(input TokenizeInput) (*TokenizeOutput, error) {
+	log := shared.LoggerFromContext(input.Ctx, im.Log)
+	var req tokenizeRequest
+	if err := json.Unmarshal(input.Body, &req); err != nil {
+		return nil, errors.Join(shared.ErrBadRequest, err)
+	}
+	if req.Model == "" {
+		return nil, &shared.RequestError{StatusCode: 400, Err: errors.New("model is required")}
+	}
+	if len(req.Messages) == 0 && req.Prompt == "" {
+		return nil, &shared.RequestError{StatusCode: 400, Err: errors.New("messages or prompt is required")}
+	}
+
+	modelMetadata, err := im.DiscoverModels(input.Ctx, input.User.UserID, req.Model)
+	if err != nil {
+		return nil, errors.Join(&shared.RequestError{
+			StatusCode: 404,
+			Err:        errors.New("model not found"),
+		}, err)
+	}
+
+	out := &TokenizeOutput{Model: req.Model}
+	backendRes, err := im.tokenizeWithBackend(input.Ctx, modelMetadata.URL, req)
+	if err != nil {
+		log.Debugw("Backend tokenize unavailable, counting locally", "error", err, "model", req.Model)
+		tok := im.tokenizerFor(modelMetadata)
+		out.PromptTokens = estimateTokens(tok, req)
+		out.Estimated = !tok.Exact()
+	} else {
+		out.PromptTokens = backendRes.Count
+		out.MaxModelLength = backendRes.MaxModelLen
+	}
+
+	out.EstimatedCredits = shared.CalculateCredits(&shared.Usage{PromptTokens: out.PromptTokens}, modelMetadata.ICPT, modelMetadata.OCPT, modelMetadata.CRC,
+		shared.OffPeakMultiplier(modelMetadata.OffPeak, time.Now()))
+	out.EstimatedUSD = fmt.Sprintf("%.8f", float64(out.EstimatedCredits)*shared.CreditsToUSD)
+	return out, nil
+}
+
+func (im *InferenceHandler) tokenizeWithBackend(ctx context.Context, modelURL string, req tokenizeRequest) (*backendTokenizeResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tokenizeTimeout)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, "POST", modelURL+backendTokenRoute, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	res, err := im.getHTTPClient(modelURL).Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := res.Body.Close(); closeErr != nil {
+			im.Log.Warnw("Failed to close response body", "error", closeErr)
+		}
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		resBody, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("backend tokenize returned error: [%d: %s]", res.StatusCode, string(resBody))
+	}
+
+	var tokenizeRes backendTokenizeResponse
+	if err := json.NewDecoder(res.Body).Decode(&tokenizeRes); err != nil {
+		return nil, err
+	}
+	return &tokenizeRes, nil
+}
+
+// tokenizerFor returns the local tokenizer of the model, the character
+// estimate until it is loaded or when the model names none
+func (im *InferenceHandler) tokenizerFor(service *InferenceService) tokenizer.Tokenizer {
+	if service == nil {
+		return tokenizer.Estimate{}
+	}
+	return im.Tokenizers.Get(service.Tokenizer)
+}
+
+// estimateTokens counts prompt tokens locally. The chat template is only
+// approximated, so it can drift from the backend count by a few tokens per
+// message
+func estimateTokens(tok tokenizer.Tokenizer, req tokenizeRequest) uint64 {
+	if req.Prompt != "" {
+		return uint64(tok.Count(req.Prompt))
+	}
+	var total uint64
+	for _, msg := range req.Messages {
+		total += tokensPerMessage + uint64(tok.Count(msg.Content))
+	}
+	return total
+}
+
+// checkContextLength rejects chat messages that, with room for maxTokens of
+// completion, do not fit the models context length. Models without a known
+// context length are not checked
+func (im *InferenceHandler) checkContextLength(ctx context.Context, req *RequestInfo, messages []shared.ChatMessage, maxTokens int) error {
+	if req.ModelMetadata == nil || req.ModelMetadata.ContextLength <= 0 {
+		return nil
+	}
+
+	tokenReq := tokenizeRequest{Model: req.Model, Messages: messages}
+	promptTokens := estimateTokens(im.tokenizerFor(req.ModelMetadata), tokenReq)
+	if backendRes, err := im.tokenizeWithBackend(ctx, req.ModelMetadata.URL, tokenReq); err == nil {
+		promptTokens = backendRes.Count
+	}
+
+	needed := promptTokens + uint64(max(maxTokens, 0))
+	if needed > uint64(req.ModelMetadata.ContextLength) {
+		return &shared.RequestError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("conversation needs %d tokens but %s supports %d", needed, req.Model, req.ModelMetadata.ContextLength),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"sybil-api/internal/shared"
+	"sybil-api/internal/transform"
+)
+
+// getTransforms returns the transforms attached to the model, the api key, or
+// that key on that model, in the order they run
+func (im *InferenceHandler) getTransforms(ctx context.Context, model, apiKey string) (*transform.Pipeline, error) {
+	cacheKey := fmt.Sprintf("sybil:v1:transforms:%s:%s", model, apiKey)
+	cached, err := im.RedisClient.Get(ctx, cacheKey).Result()
+	if err == nil && cached != "" {
+		var configs []transform.Config
+		if err := json.Unmarshal([]byte(cached), &configs); err == nil {
+			return transform.NewPipeline(configs)
+		}
+		im.Log.Warnw("Failed to unmarshal cached transforms", "error", err, "model", model)
+	}
+
+	rows, err := im.RDB.QueryContext(ctx, `
+		SELECT id, plugin, config, fail_open
+		FROM payload_transform
+		WHERE active = true
+		AND (model_name = ? OR model_name IS NULL)
+		AND (api_key_id = ? OR api_key_id IS NULL)
+		ORDER BY position ASC, id ASC
+	`, model, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	configs := []transform.Config{}
+	for rows.Next() {
+		var c transform.Config
+		var config string
+		if err := rows.Scan(&c.ID, &c.Plugin, &config, &c.FailOpen); err != nil {
+			return nil, err
+		}
+		c.Config = json.RawMessage(config)
+		configs = append(configs, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Cache misses too, almost no request has a transform
+	go func() {
+		cacheCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		configsJSON, err := json.Marshal(configs)
+		if err != nil {
+			return
+		}
+		if err := im.RedisClient.Set(cacheCtx, cacheKey, configsJSON, shared.TransformCacheTTL).Err(); err != nil {
+			im.Log.Warnw("Failed to cache transforms", "error", err, "model", model)
+		}
+	}()
+
+	return transform.NewPipeline(configs)
+}
+
+// transformResponse runs the response transforms over a non streaming body.
+// A failing transform that is not fail open leaves the body as the model
+// sent it, the answer is already paid for
+func (im *InferenceHandler) transformResponse(ctx context.Context, reqInfo *RequestInfo, body []byte) []byte {
+	if reqInfo.Transforms == nil {
+		return body
+	}
+	var parsed map[string]any
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return body
+	}
+	out, err := reqInfo.Transforms.TransformResponse(ctx, reqInfo.Endpoint, reqInfo.Model, false, parsed)
+	if err != nil {
+		shared.LoggerFromContext(ctx, im.Log).Warnw("Failed to transform response", "error", err, "model", reqInfo.Model)
+		return body
+	}
+	transformed, err := json.Marshal(out)
+	if err != nil {
+		return body
+	}
+	return transformed
+}
+
+// transformChunk runs the response transforms over one streamed line, leaving
+// anything but a json data line as is
+func (im *InferenceHandler) transformChunk(ctx context.Context, reqInfo *RequestInfo, line string) string {
+	if reqInfo.Transforms == nil {
+		return line
+	}
+	data, ok := strings.CutPrefix(line, "data: ")
+	if !ok || data == "[DONE]" {
+		return line
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return line
+	}
+	out, err := reqInfo.Transforms.TransformResponse(ctx, reqInfo.Endpoint, reqInfo.Model, true, chunk)
+	if err != nil {
+		shared.LoggerFromContext(ctx, im.Log).Warnw("Failed to transform stream chunk", "error", err, "model", reqInfo.Model)
+		return line
+	}
+	transformed, err := json.Marshal(out)
+	if err != nil {
+		return line
+	}
+	return "data: " + string(transformed)
+}
@@ -0,0 +1,120 @@
+package inference
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/shared"
+	"sybil-api/internal/tokenizer"
+)
+
+// usageMeter sends clients that opted in with "usage_meter": true a running
+// token count and cost estimate while their response streams. The meter is
+// an SSE comment frame, so clients that do not read it are unaffected:
+//
+//	: usage_meter {"completion_tokens":42,"prompt_tokens":118,"estimated_credits":5040}
+//
+// Completion tokens are counted from the streamed content chunks and prompt
+// tokens with the models local tokenizer, the usage chunk at the end of the stream has
+// the billed figures
+type usageMeter struct {
+	req          *RequestInfo
+	write        func(token string) error
+	promptTokens uint64
+	tokens       uint64
+	lastSent     time.Time
+}
+
+type usageMeterFrame struct {
+	CompletionTokens uint64 `json:"completion_tokens"`
+	PromptTokens     uint64 `json:"prompt_tokens"`
+	EstimatedCredits uint64 `json:"estimated_credits"`
+}
+
+// newUsageMeter returns nil when the request did not ask for a meter or is
+// not streamed to the client
+func newUsageMeter(req *RequestInfo, tok tokenizer.Tokenizer, streamWriter func(token string) error) *usageMeter {
+	if !req.UsageMeter || !req.Stream || streamWriter == nil {
+		return nil
+	}
+	var prompt tokenizeRequest
+	var promptTokens uint64
+	if err := json.Unmarshal(req.Body, &prompt); err == nil {
+		promptTokens = estimateTokens(tok, prompt)
+	}
+	return &usageMeter{
+		req:          req,
+		write:        streamWriter,
+		promptTokens: promptTokens,
+		lastSent:     time.Now(),
+	}
+}
+
+// Observe counts the tokens of a streamed chunk and sends the meter when
+// shared.UsageMeterInterval has passed since it was last sent
+func (m *usageMeter) Observe(chunk []byte) {
+	if m == nil {
+		return
+	}
+	m.tokens += chunkTokens(chunk)
+	if time.Since(m.lastSent) < shared.UsageMeterInterval {
+		return
+	}
+	m.lastSent = time.Now()
+	frame, err := json.Marshal(m.frame())
+	if err != nil {
+		return
+	}
+	_ = m.write(fmt.Sprintf(": usage_meter %s", frame))
+}
+
+func (m *usageMeter) frame() usageMeterFrame {
+	metadata := m.req.ModelMetadata
+	usage := &shared.Usage{PromptTokens: m.promptTokens, CompletionTokens: m.tokens}
+	credits := shared.CalculateCredits(usage, metadata.ICPT, metadata.OCPT, metadata.CRC, shared.OffPeakMultiplier(metadata.OffPeak, m.req.StartTime))
+	// Bring your own key requests only pay the routing fee, like PostProcess
+	if m.req.BYOK {
+		credits = metadata.BYOKRoutingFee
+		if credits == 0 {
+			credits = shared.DefaultBYOKRoutingFee
+		}
+	}
+	return usageMeterFrame{
+		CompletionTokens: m.tokens,
+		PromptTokens:     m.promptTokens,
+		EstimatedCredits: credits,
+	}
+}
+
+// streamedChunk holds the fields of chat, completion and responses stream
+// chunks that carry generated text
+type streamedChunk struct {
+	Type    string `json:"type"`
+	Choices []struct {
+		Text  string `json:"text"`
+		Delta *struct {
+			Content          string `json:"content"`
+			ReasoningContent string `json:"reasoning_content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+// chunkTokens is the number of generated tokens in a chunk. Backends stream
+// one token per content chunk, so every choice with text counts as one
+func chunkTokens(chunk []byte) uint64 {
+	var parsed streamedChunk
+	if err := json.Unmarshal(chunk, &parsed); err != nil {
+		return 0
+	}
+	if parsed.Type == "response.output_text.delta" {
+		return 1
+	}
+	var tokens uint64
+	for _, choice := range parsed.Choices {
+		if choice.Text != "" || (choice.Delta != nil && (choice.Delta.Content != "" || choice.Delta.ReasoningContent != "")) {
+			tokens++
+		}
+	}
+	return tokens
+}
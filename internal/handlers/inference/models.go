@@ -5,9 +5,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/manifold-inc/manifold-sdk/lib/utils"
+	"github.com/redis/go-redis/v9"
 	"sybil-api/internal/shared"
 )
 
@@ -29,6 +31,12 @@ type Model struct {
 	Normalized                  *bool    `json:"normalized,omitempty"`
 	EmbeddingType               string   `json:"embedding_type,omitempty"`
 	MaxInputLength              *int     `json:"max_input_length,omitempty"`
+	// False when the deployment is scaled to zero and the next request waits
+	// on a cold start. External models are always warm
+	Warm bool `json:"warm"`
+
+	modelID  uint64
+	deployed bool
 }
 
 type Pricing struct {
@@ -39,6 +47,17 @@ type Pricing struct {
 	Request          string  `json:"request"`
 	InputCacheReads  string  `json:"input_cache_reads"`
 	InputCacheWrites string  `json:"input_cache_writes"`
+	// Prompt and completion above are the rates right now. Models with
+	// off-peak hours list every window and when the current rate ends
+	OffPeak   []OffPeakPricing `json:"off_peak,omitempty"`
+	ChangesAt *int64           `json:"changes_at,omitempty"`
+}
+
+type OffPeakPricing struct {
+	StartHour  int    `json:"start_hour"`
+	EndHour    int    `json:"end_hour"`
+	Prompt     string `json:"prompt"`
+	Completion string `json:"completion"`
 }
 
 type ModelList struct {
@@ -59,16 +78,20 @@ type ModelMetadata struct {
 	Normalized                  *bool    `json:"normalized,omitempty"`
 	EmbeddingType               string   `json:"embedding_type,omitempty"`
 	MaxInputLength              *int     `json:"max_input_length,omitempty"`
+
+	OffPeak []shared.OffPeakWindow `json:"off_peak,omitempty"`
 }
 
 func (im *InferenceHandler) ListModels(ctx context.Context, userID *uint64) ([]Model, error) {
 	if userID != nil {
 		userModels, _ := im.queryModels(ctx, `
-			SELECT name, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s') as created,
-				icpt, ocpt, crc, metadata, modality, supported_endpoints
-			FROM model 
-			WHERE enabled = true AND allowed_user_id = ?
-			ORDER BY name ASC`, *userID)
+			SELECT model.name, DATE_FORMAT(model.created_at, '%Y-%m-%d %H:%i:%s') as created,
+				COALESCE(model_price.icpt, model.icpt), COALESCE(model_price.ocpt, model.ocpt), COALESCE(model_price.crc, model.crc),
+				model.metadata, model.modality, model.supported_endpoints, model.id, model.targon_uid IS NOT NULL
+			FROM model
+			`+effectivePriceJoin+`
+			WHERE model.enabled = true AND model.allowed_user_id = ?
+			ORDER BY model.name ASC`, *userID)
 
 		if len(userModels) > 0 {
 			return userModels, nil
@@ -76,11 +99,13 @@ func (im *InferenceHandler) ListModels(ctx context.Context, userID *uint64) ([]M
 	}
 
 	return im.queryModels(ctx, `
-		SELECT name, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s') as created,
-			icpt, ocpt, crc, metadata, modality, supported_endpoints
-		FROM model 
-		WHERE enabled = true AND allowed_user_id is NULL
-		ORDER BY name ASC`)
+		SELECT model.name, DATE_FORMAT(model.created_at, '%Y-%m-%d %H:%i:%s') as created,
+			COALESCE(model_price.icpt, model.icpt), COALESCE(model_price.ocpt, model.ocpt), COALESCE(model_price.crc, model.crc),
+			model.metadata, model.modality, model.supported_endpoints, model.id, model.targon_uid IS NOT NULL
+		FROM model
+		`+effectivePriceJoin+`
+		WHERE model.enabled = true AND model.allowed_user_id is NULL
+		ORDER BY model.name ASC`)
 }
 
 func (im *InferenceHandler) queryModels(ctx context.Context, query string, args ...any) ([]Model, error) {
@@ -105,9 +130,52 @@ func (im *InferenceHandler) queryModels(ctx context.Context, query string, args
 	if err := rows.Err(); err != nil {
 		return nil, utils.Wrap("Error iterating over queryModels rows", err)
 	}
+	im.setWarmState(ctx, models)
 	return models, nil
 }
 
+// setWarmState marks deployments warm while targon reports replicas for them.
+// A deployment that served a request within shared.ModelWarmWindow is warm
+// too, unless targon has seen it at zero replicas since
+func (im *InferenceHandler) setWarmState(ctx context.Context, models []Model) {
+	pipe := im.RedisClient.Pipeline()
+	stateCmds := make([]*redis.SliceCmd, len(models))
+	lastCmds := make([]*redis.StringCmd, len(models))
+	for i, model := range models {
+		models[i].Warm = true
+		if !model.deployed {
+			continue
+		}
+		stateCmds[i] = pipe.HMGet(ctx, shared.ModelWarmKey(model.modelID), "replicas", "checked_at")
+		lastCmds[i] = pipe.Get(ctx, fmt.Sprintf("sybil:v1:model-stats:%d:last", model.modelID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		// Without state every model is listed warm rather than failing the list
+		im.Log.Warnw("Failed to read model warm state", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range models {
+		if stateCmds[i] == nil {
+			continue
+		}
+		lastRequest, _ := lastCmds[i].Int64()
+		recent := lastRequest > 0 && now.Sub(time.Unix(lastRequest, 0)) < shared.ModelWarmWindow
+
+		state := stateCmds[i].Val()
+		replicasStr, known := state[0].(string)
+		if !known {
+			models[i].Warm = recent
+			continue
+		}
+		replicas, _ := strconv.ParseInt(replicasStr, 10, 64)
+		checkedStr, _ := state[1].(string)
+		checkedAt, _ := strconv.ParseInt(checkedStr, 10, 64)
+		models[i].Warm = replicas > 0 || (recent && lastRequest > checkedAt)
+	}
+}
+
 func scanModel(rows *sql.Rows) (Model, error) {
 	var model Model
 	var createdAtStr string
@@ -119,7 +187,7 @@ func scanModel(rows *sql.Rows) (Model, error) {
 	var modality string
 	var supportedEndpointsJSON sql.NullString
 
-	if err := rows.Scan(&name, &createdAtStr, &icpt, &ocpt, &crc, &metadataJSON, &modality, &supportedEndpointsJSON); err != nil {
+	if err := rows.Scan(&name, &createdAtStr, &icpt, &ocpt, &crc, &metadataJSON, &modality, &supportedEndpointsJSON, &model.modelID, &model.deployed); err != nil {
 		return Model{}, err
 	}
 
@@ -169,9 +237,11 @@ func scanModel(rows *sql.Rows) (Model, error) {
 	model.ContextLength = metadata.ContextLength
 	model.MaxOutputLength = metadata.MaxOutputLength
 
-	promptUSD := float64(icpt) * shared.CreditsToUSD
-	completionUSD := float64(ocpt) * shared.CreditsToUSD
-	cancelledUSD := float64(crc) * shared.CreditsToUSD
+	now := time.Now()
+	multiplier := shared.OffPeakMultiplier(metadata.OffPeak, now)
+	promptUSD := float64(icpt) * multiplier * shared.CreditsToUSD
+	completionUSD := float64(ocpt) * multiplier * shared.CreditsToUSD
+	cancelledUSD := float64(crc) * multiplier * shared.CreditsToUSD
 
 	pricing := Pricing{
 		Prompt:           fmt.Sprintf("%.8f", promptUSD),
@@ -187,6 +257,22 @@ func scanModel(rows *sql.Rows) (Model, error) {
 		pricing.CancelledRequest = &cancelledRequestStr
 	}
 
+	for _, window := range metadata.OffPeak {
+		if !window.Valid() {
+			continue
+		}
+		pricing.OffPeak = append(pricing.OffPeak, OffPeakPricing{
+			StartHour:  window.StartHour,
+			EndHour:    window.EndHour,
+			Prompt:     fmt.Sprintf("%.8f", float64(icpt)*window.Multiplier*shared.CreditsToUSD),
+			Completion: fmt.Sprintf("%.8f", float64(ocpt)*window.Multiplier*shared.CreditsToUSD),
+		})
+	}
+	if next := shared.NextOffPeakChange(metadata.OffPeak, now); next != nil {
+		changesAt := next.Unix()
+		pricing.ChangesAt = &changesAt
+	}
+
 	model.Pricing = pricing
 
 	model.SupportedSamplingParameters = []string{}
@@ -0,0 +1,165 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/redact"
+	"sybil-api/internal/shared"
+)
+
+// Users choose whether personal information is redacted from what is stored
+// of their chats. The built in patterns catch structured values like emails
+// and card numbers, the model mode also runs the redaction model over the
+// pattern output to catch names and addresses. Only stored copies are
+// redacted, the model answering the chat sees the original
+
+const redactionPrompt = `Replace every piece of personal information in the text from the user with a placeholder naming its type, like [NAME], [ADDRESS], [EMAIL], [PHONE], [DATE_OF_BIRTH] or [ID_NUMBER].
+Leave existing placeholders and everything else exactly as it is, including whitespace and formatting.
+Reply with only the redacted text.`
+
+// modelRedactor redacts with the redaction model, billed to the user like
+// generated titles
+type modelRedactor struct {
+	im        *InferenceHandler
+	user      shared.UserMetadata
+	requestID string
+}
+
+func (m modelRedactor) Redact(ctx context.Context, text string) (string, redact.Counts, error) {
+	body, err := json.Marshal(shared.InferenceBody{
+		Model: m.im.RedactionModel,
+		Messages: []shared.ChatMessage{
+			{Role: "system", Content: redactionPrompt},
+			{Role: "user", Content: text},
+		},
+	})
+	if err != nil {
+		return text, nil, err
+	}
+	reqInfo, err := m.im.Preprocess(ctx, PreprocessInput{
+		Body:      body,
+		User:      m.user,
+		Endpoint:  shared.ENDPOINTS.CHAT,
+		RequestID: m.requestID + "-redact",
+	})
+	if err != nil {
+		return text, nil, fmt.Errorf("failed to preprocess redaction request: %w", err)
+	}
+	// The text being redacted must not be kept by the redaction request itself
+	reqInfo.Ephemeral = true
+	out, err := m.im.DoInference(InferenceInput{Req: reqInfo, User: m.user, Ctx: ctx})
+	if err != nil {
+		return text, nil, fmt.Errorf("redaction inference failed: %w", err)
+	}
+	redacted := extractContentFromFinalResponse(out.FinalResponse)
+	if reqInfo.Stream {
+		redacted = extractContentFromInferenceOutput(out)
+	}
+	if redacted == "" {
+		return text, nil, errors.New("redaction reply is empty")
+	}
+	return redacted, redact.Diff(redact.Placeholders(text), redact.Placeholders(redacted)), nil
+}
+
+// redactor returns the redaction the user configured, nil when off
+func (im *InferenceHandler) redactor(user shared.UserMetadata, requestID string) redact.Redactor {
+	switch user.PIIRedaction {
+	case shared.PIIRedactionRegex:
+		return redact.Regex{}
+	case shared.PIIRedactionModel:
+		if im.RedactionModel == "" {
+			return redact.Regex{}
+		}
+		return redact.Chain(redact.Regex{}, modelRedactor{im: im, user: user, requestID: requestID})
+	default:
+		return nil
+	}
+}
+
+// redactText redacts text stored for target. A failed model redaction keeps
+// the pattern redaction made before it
+func (im *InferenceHandler) redactText(ctx context.Context, r redact.Redactor, target string, text string) string {
+	if r == nil || text == "" {
+		return text
+	}
+	redacted, counts, err := r.Redact(ctx, text)
+	if err != nil {
+		im.Log.Warnw("Failed to redact with model, keeping pattern redaction", "error", err, "target", target)
+	}
+	for kind, n := range counts {
+		metrics.PIIRedactions.WithLabelValues(target, kind).Add(float64(n))
+	}
+	return redacted
+}
+
+// redactMessages returns a copy of messages with their content redacted
+func (im *InferenceHandler) redactMessages(ctx context.Context, r redact.Redactor, messages []shared.ChatMessage) []shared.ChatMessage {
+	if r == nil {
+		return messages
+	}
+	redacted := make([]shared.ChatMessage, len(messages))
+	for i, msg := range messages {
+		msg.Content = im.redactText(ctx, r, "chat_history", msg.Content)
+		if msg.Reasoning != "" {
+			msg.Reasoning = im.redactText(ctx, r, "chat_history", msg.Reasoning)
+		}
+		redacted[i] = msg
+	}
+	return redacted
+}
+
+// redactMetadata returns a copy of request metadata with its values redacted.
+// Metadata is short labels so only the patterns are run
+func (im *InferenceHandler) redactMetadata(ctx context.Context, mode string, metadata map[string]string) map[string]string {
+	if mode == "" || len(metadata) == 0 {
+		return metadata
+	}
+	redacted := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		redacted[key] = im.redactText(ctx, redact.Regex{}, "request_metadata", value)
+	}
+	return redacted
+}
+
+// GetPIIRedaction reads from the write database so a setting saved a moment
+// ago is returned
+func (im *InferenceHandler) GetPIIRedaction(ctx context.Context, userID uint64) (string, error) {
+	var mode string
+	err := im.WDB.QueryRowContext(ctx, "SELECT COALESCE(pii_redaction, '') FROM user WHERE id = ?", userID).Scan(&mode)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to query pii redaction"), err, shared.ErrInternalServerError)
+	}
+	return mode, nil
+}
+
+type SetPIIRedactionInput struct {
+	Ctx    context.Context
+	UserID uint64
+	// Empty turns redaction off
+	Mode string
+}
+
+// SetPIIRedaction sets how the users stored content is redacted. Only content
+// stored from then on is redacted
+func (im *InferenceHandler) SetPIIRedaction(input SetPIIRedactionInput) error {
+	if input.Mode != "" && input.Mode != shared.PIIRedactionRegex && input.Mode != shared.PIIRedactionModel {
+		return errors.Join(fmt.Errorf("mode must be one of %q, %q or empty", shared.PIIRedactionRegex, shared.PIIRedactionModel), shared.ErrBadRequest)
+	}
+	var mode *string
+	if input.Mode != "" {
+		mode = &input.Mode
+	}
+	_, err := im.WDB.ExecContext(input.Ctx, "UPDATE user SET pii_redaction = ? WHERE id = ?", mode, input.UserID)
+	if err != nil {
+		return errors.Join(errors.New("failed to update pii redaction"), err, shared.ErrInternalServerError)
+	}
+	if err := database.ClearUserCache(input.Ctx, im.WDB, im.RedisClient, input.UserID); err != nil {
+		im.Log.Warnw("Failed to clear user cache", "error", err)
+	}
+	return nil
+}
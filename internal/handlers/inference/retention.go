@@ -0,0 +1,145 @@
+package inference
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// DataRetention is how many days a users content is kept, nil keeps it until
+// the user deletes it
+type DataRetention struct {
+	// Histories are purged once they were last updated this many days ago
+	ChatHistoryDays *uint `json:"chat_history_days"`
+	// Metadata sent with requests is cleared after this many days
+	RequestDays *uint `json:"request_days"`
+}
+
+// GetDataRetention reads from the write database so a setting saved a moment
+// ago is returned
+func (im *InferenceHandler) GetDataRetention(ctx context.Context, userID uint64) (*DataRetention, error) {
+	retention := &DataRetention{}
+	err := im.WDB.QueryRowContext(ctx, `
+		SELECT history_retention_days, request_retention_days FROM user WHERE id = ?
+	`, userID).Scan(&retention.ChatHistoryDays, &retention.RequestDays)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query data retention"), err, shared.ErrInternalServerError)
+	}
+	return retention, nil
+}
+
+type SetDataRetentionInput struct {
+	Ctx       context.Context
+	UserID    uint64
+	Retention DataRetention
+}
+
+// SetDataRetention replaces the users retention settings. Content already past
+// the new retention is purged by the next cleanup run
+func (im *InferenceHandler) SetDataRetention(input SetDataRetentionInput) (*DataRetention, error) {
+	for name, days := range map[string]*uint{
+		"chat_history_days": input.Retention.ChatHistoryDays,
+		"request_days":      input.Retention.RequestDays,
+	} {
+		if days != nil && (*days < 1 || *days > shared.RetentionMaxDays) {
+			return nil, errors.Join(fmt.Errorf("%s must be between 1 and %d", name, shared.RetentionMaxDays), shared.ErrBadRequest)
+		}
+	}
+	_, err := im.WDB.ExecContext(input.Ctx, `
+		UPDATE user SET history_retention_days = ?, request_retention_days = ? WHERE id = ?
+	`, input.Retention.ChatHistoryDays, input.Retention.RequestDays, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to update data retention"), err, shared.ErrInternalServerError)
+	}
+	return im.GetDataRetention(input.Ctx, input.UserID)
+}
+
+// RunRetentionCleanup purges content past each users retention every
+// shared.RetentionCleanupInterval until ctx is done
+func (im *InferenceHandler) RunRetentionCleanup(ctx context.Context) {
+	ticker := time.NewTicker(shared.RetentionCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			im.cleanupRetention(ctx)
+		}
+	}
+}
+
+func (im *InferenceHandler) cleanupRetention(ctx context.Context) {
+	// One replica cleans up per interval
+	ok, err := im.RedisClient.SetNX(ctx, "sybil:v1:retention:cleanup", 1, shared.RetentionCleanupInterval/2).Result()
+	if err != nil || !ok {
+		return
+	}
+
+	rows, err := im.RDB.QueryContext(ctx, `
+		SELECT user.id,
+			COALESCE(IF(organization.id IS NULL, user.data_residency, organization.data_residency), ''),
+			user.history_retention_days,
+			user.request_retention_days
+		FROM user
+		LEFT JOIN organization ON user.organization_id = organization.id
+		WHERE user.history_retention_days IS NOT NULL OR user.request_retention_days IS NOT NULL
+	`)
+	if err != nil {
+		im.Log.Errorw("Failed to query data retention settings", "error", err)
+		return
+	}
+	type userRetention struct {
+		userID uint64
+		region string
+		DataRetention
+	}
+	users := []userRetention{}
+	for rows.Next() {
+		var u userRetention
+		if err := rows.Scan(&u.userID, &u.region, &u.ChatHistoryDays, &u.RequestDays); err != nil {
+			im.Log.Warnw("Failed to scan data retention row", "error", err)
+			continue
+		}
+		users = append(users, u)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		im.Log.Errorw("Failed iterating data retention rows", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, u := range users {
+		if ctx.Err() != nil {
+			return
+		}
+		log := im.Log.With("user_id", u.userID)
+		if u.ChatHistoryDays != nil {
+			store, err := im.regionHistoryStore(u.region)
+			if err != nil {
+				log.Warnw("No history database for retention cleanup", "region", u.region)
+			} else {
+				before := now.AddDate(0, 0, -int(*u.ChatHistoryDays))
+				purged, err := purgeChatHistories(ctx, store.Writer(), u.userID, &before, nil)
+				metrics.RetentionPurged.WithLabelValues("chat_history").Add(float64(purged))
+				if err != nil {
+					log.Errorw("Failed to purge expired chat histories", "error", err)
+				}
+			}
+		}
+		if u.RequestDays != nil {
+			before := now.AddDate(0, 0, -int(*u.RequestDays))
+			purged, err := im.purgeRequestMetadata(ctx, u.userID, &before, nil)
+			metrics.RetentionPurged.WithLabelValues("request_metadata").Add(float64(purged))
+			if err != nil {
+				log.Errorw("Failed to clear expired request metadata", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"sybil-api/internal/database"
+	websearch "sybil-api/internal/search"
+	"sybil-api/internal/shared"
+
+	"github.com/aidarkhanov/nanoid"
+)
+
+type SearchAnswerInput struct {
+	Query string
+	// Model, sampling and search provider, search is always on
+	Settings     *shared.ChatSettings
+	User         shared.UserMetadata
+	RequestID    string
+	Ctx          context.Context
+	StreamWriter func(string) error
+	// Region and language for web search, nil for provider defaults
+	SearchLocale *shared.SearchLocale
+	// Who the search is run for, nil skips abuse scoring
+	SearchClient *shared.SearchClient
+	// Stores the query and completed answer as a new chat history the user
+	// can continue from
+	SaveToHistory bool
+}
+
+type SearchAnswerOutput struct {
+	// The search the answer is grounded in, nil when it was refused or failed
+	Results     *shared.SearchResponseBody
+	InfMetadata *InferenceMetadata
+	Req         *RequestInfo
+	// The history the answer was saved to, empty when it was not saved
+	HistoryID string
+}
+
+// SearchAnswer searches the web for the query and streams an answer grounded
+// in the results. Events are the same as a searching chat turn: status,
+// sources, heroCard, the answer chunks, citations and followups. The answer is
+// billed like any other chat completion and is only stored to a history when
+// SaveToHistory is set
+func (im *InferenceHandler) SearchAnswer(input *SearchAnswerInput) (*SearchAnswerOutput, error) {
+	if im.SearchConfig == nil || im.SearchConfig.DoSearch == nil {
+		return nil, &shared.RequestError{StatusCode: http.StatusServiceUnavailable, Err: errors.New("search is not available")}
+	}
+	if !input.User.HasScope(shared.ScopeSearch) {
+		return nil, &shared.RequestError{StatusCode: http.StatusForbidden, Err: errors.New("api key is missing the search scope")}
+	}
+
+	writeEvent := func(event map[string]any) {
+		eventJSON, _ := json.Marshal(event)
+		_ = input.StreamWriter(fmt.Sprintf("data: %s", eventJSON))
+	}
+
+	var results *shared.SearchResponseBody
+	var sources []shared.SearchResults
+	if reason := im.searchAbuseReason(input.Ctx, input.SearchClient, input.Query); reason != "" {
+		writeEvent(map[string]any{"type": "sources", "sources": []shared.SearchResults{}, "reason": reason})
+	} else {
+		writeEvent(map[string]any{"type": "status", "status": "searching"})
+		sendHeroCard := im.startHeroCard(input.Ctx, input.Query, input.SearchLocale, input.StreamWriter)
+		var err error
+		results, err = im.SearchConfig.DoSearch(input.Query, input.SearchLocale, input.Settings.SearchProvider)
+		switch {
+		case err != nil:
+			im.Log.Warnw("search failed, answering without search context", "error", err, "request_id", input.RequestID)
+			results = nil
+			writeEvent(map[string]any{"type": "sources", "sources": []shared.SearchResults{}, "reason": shared.SearchReasonUnavailable})
+		case len(results.Results) == 0:
+			writeEvent(map[string]any{"type": "sources", "sources": []shared.SearchResults{}, "reason": shared.SearchReasonNoResults})
+		default:
+			sources = im.rerankSearchResults(input.Ctx, rerankInput{
+				User:      input.User,
+				RequestID: input.RequestID,
+				Query:     input.Query,
+				Results:   results.Results,
+			})
+			writeEvent(map[string]any{"type": "sources", "sources": sources})
+		}
+		sendHeroCard()
+	}
+
+	messages := []shared.ChatMessage{{Role: "user", Content: input.Query}}
+	if len(sources) > 0 {
+		promptResults, injections := websearch.StripInjections(sources)
+		im.recordSearchInjections(input.RequestID, injections)
+		if searchContext := formatSearchContext(promptResults); searchContext != "" {
+			messages = append([]shared.ChatMessage{searchSystemMessage(searchContext)}, messages...)
+		}
+	}
+
+	bodyBytes, err := json.Marshal(shared.InferenceBody{
+		Model:       input.Settings.Model,
+		Messages:    messages,
+		Stream:      true,
+		MaxTokens:   input.Settings.MaxTokens,
+		Temperature: input.Settings.Temperature,
+	})
+	if err != nil {
+		return nil, errors.Join(shared.ErrInternalServerError, errors.New("failed to marshal inference body"), err)
+	}
+	reqInfo, preErr := im.Preprocess(input.Ctx, PreprocessInput{
+		Body:      bodyBytes,
+		User:      input.User,
+		Endpoint:  shared.ENDPOINTS.CHAT,
+		RequestID: input.RequestID,
+	})
+	if preErr != nil {
+		return nil, preErr
+	}
+
+	writeEvent(map[string]any{"type": "status", "status": "generating"})
+	out, reqErr := im.DoInference(InferenceInput{
+		Req:          reqInfo,
+		User:         input.User,
+		Ctx:          input.Ctx,
+		StreamWriter: input.StreamWriter,
+	})
+	if reqErr != nil {
+		return nil, errors.Join(reqErr, errors.New("inference error"))
+	}
+
+	output := &SearchAnswerOutput{Results: results, Req: reqInfo}
+	if out == nil {
+		return output, nil
+	}
+	output.InfMetadata = out.Metadata
+	answer := extractContentFromInferenceOutput(out)
+	if len(sources) > 0 {
+		sendCitations(input.StreamWriter, answer, sources)
+	}
+	if out.Metadata != nil && out.Metadata.Completed {
+		im.sendFollowups(input, answer)
+		if input.SaveToHistory && answer != "" {
+			historyID, err := im.saveSearchAnswer(input, reqInfo.Model, answer, sources)
+			if err != nil {
+				return output, err
+			}
+			output.HistoryID = historyID
+		}
+	}
+	return output, nil
+}
+
+// saveSearchAnswer starts a chat history with the query and its answer, the
+// answer keeps its sources so citations still resolve when the chat is
+// continued
+func (im *InferenceHandler) saveSearchAnswer(input *SearchAnswerInput, model, answer string, sources []shared.SearchResults) (string, error) {
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return "", err
+	}
+	historyIDNano, _ := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 11)
+	historyID := "chat-" + historyIDNano
+
+	assistantMsg := shared.ChatMessage{Role: "assistant", Content: answer, Model: model}
+	if len(sources) > 0 {
+		assistantMsg.Sources = sources
+	}
+	redactor := im.redactor(input.User, input.RequestID)
+	messages := im.redactMessages(input.Ctx, redactor, []shared.ChatMessage{
+		{Role: "user", Content: input.Query},
+		assistantMsg,
+	})
+	title := im.redactText(input.Ctx, redactor, "chat_title", input.Query)
+	if len(title) > 32 {
+		title = title[:32]
+	}
+
+	// Continuing the chat keeps searching with the same settings
+	settings := *input.Settings
+	settings.Search = "on"
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return "", errors.Join(shared.ErrInternalServerError, errors.New("failed to marshal settings"), err)
+	}
+
+	err = database.ExecuteTransaction(input.Ctx, store.Writer(), []func(*sql.Tx) error{
+		func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(input.Ctx, `
+				INSERT INTO chat_history (user_id, history_id, messages, title, settings)
+				VALUES (?, ?, '[]', ?, ?)
+			`, input.User.UserID, historyID, title, string(settingsJSON))
+			return err
+		},
+		func(tx *sql.Tx) error {
+			return im.appendChatMessages(input.Ctx, tx, historyID, messages, input.User.EncryptHistory)
+		},
+	})
+	if err != nil {
+		return "", errors.Join(shared.ErrInternalServerError, errors.New("failed to insert search answer history"), err)
+	}
+	store.Wrote(input.Ctx, input.User.UserID)
+	return historyID, nil
+}
@@ -0,0 +1,54 @@
+package inference
+
+import (
+	"context"
+	"errors"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/shared"
+)
+
+// SearchDefaults apply to the users searches that do not set their own
+// locale or safe search level. Empty fields keep the client locale and the
+// provider safe search
+type SearchDefaults struct {
+	Region   string `json:"region"`
+	Language string `json:"lang"`
+	Safe     string `json:"safe"`
+}
+
+// GetSearchDefaults reads from the write database so defaults saved a moment
+// ago are returned
+func (im *InferenceHandler) GetSearchDefaults(ctx context.Context, userID uint64) (*SearchDefaults, error) {
+	var defaults SearchDefaults
+	err := im.WDB.QueryRowContext(ctx, `
+		SELECT COALESCE(search_region, ''), COALESCE(search_language, ''), COALESCE(search_safe, '')
+		FROM user WHERE id = ?
+	`, userID).Scan(&defaults.Region, &defaults.Language, &defaults.Safe)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query search defaults"), err, shared.ErrInternalServerError)
+	}
+	return &defaults, nil
+}
+
+type SetSearchDefaultsInput struct {
+	Ctx      context.Context
+	UserID   uint64
+	Defaults SearchDefaults
+}
+
+// SetSearchDefaults replaces the users search defaults. The router validates
+// them, like it does the same values on a search
+func (im *InferenceHandler) SetSearchDefaults(input SetSearchDefaultsInput) error {
+	_, err := im.WDB.ExecContext(input.Ctx, `
+		UPDATE user SET search_region = NULLIF(?, ''), search_language = NULLIF(?, ''), search_safe = NULLIF(?, '')
+		WHERE id = ?
+	`, input.Defaults.Region, input.Defaults.Language, input.Defaults.Safe, input.UserID)
+	if err != nil {
+		return errors.Join(errors.New("failed to update search defaults"), err, shared.ErrInternalServerError)
+	}
+	if err := database.ClearUserCache(input.Ctx, im.WDB, im.RedisClient, input.UserID); err != nil {
+		im.Log.Warnw("Failed to clear user cache", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"sybil-api/internal/shared"
+)
+
+const followupPrompt = `Suggest follow-up questions the user could ask next about the search below.
+Every question must be answerable from the topics in the answer, short, and in the language of the question.
+Reply with only a JSON array of 3 to 5 strings like ["What is the capital of France?", "How big is Paris?"].`
+
+// sendFollowups generates follow-up questions for a finished answer with the
+// follow-up model and sends them as a followups event. It is best effort, no
+// event is sent when the model is not set or fails
+func (im *InferenceHandler) sendFollowups(input *SearchAnswerInput, answer string) {
+	if im.FollowupModel == "" || answer == "" || input.Ctx.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(input.Ctx, shared.FollowupTimeout)
+	defer cancel()
+	followups, err := im.generateFollowups(ctx, input.User, input.RequestID, input.Query, answer)
+	if err != nil {
+		im.Log.Warnw("failed to generate follow-up questions", "error", err, "request_id", input.RequestID)
+		return
+	}
+	eventJSON, _ := json.Marshal(map[string]any{"type": "followups", "followups": followups})
+	_ = input.StreamWriter(fmt.Sprintf("data: %s", eventJSON))
+}
+
+func (im *InferenceHandler) generateFollowups(ctx context.Context, user shared.UserMetadata, requestID, query, answer string) ([]string, error) {
+	body, err := json.Marshal(shared.InferenceBody{
+		Model: im.FollowupModel,
+		Messages: []shared.ChatMessage{
+			{Role: "system", Content: followupPrompt},
+			{Role: "user", Content: fmt.Sprintf("Question: %s\n\nAnswer: %s", truncateRunes(query, 1000), truncateRunes(answer, 4000))},
+		},
+		MaxTokens: shared.FollowupMaxTokens,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqInfo, err := im.Preprocess(ctx, PreprocessInput{
+		Body:      body,
+		User:      user,
+		Endpoint:  shared.ENDPOINTS.CHAT,
+		RequestID: requestID + "-followups",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to preprocess follow-up request: %w", err)
+	}
+	out, err := im.DoInference(InferenceInput{Req: reqInfo, User: user, Ctx: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("follow-up inference failed: %w", err)
+	}
+	content := extractContentFromFinalResponse(out.FinalResponse)
+	if reqInfo.Stream {
+		content = extractContentFromInferenceOutput(out)
+	}
+	return parseFollowups(content, query)
+}
+
+// parseFollowups reads the follow-up model reply, tolerating text or code
+// fences around the JSON array. Repeats of the original question are dropped
+func parseFollowups(content, query string) ([]string, error) {
+	start := strings.Index(content, "[")
+	end := strings.LastIndex(content, "]")
+	if start < 0 || end < start {
+		return nil, errors.New("follow-up reply has no json array")
+	}
+	var questions []string
+	if err := json.Unmarshal([]byte(content[start:end+1]), &questions); err != nil {
+		return nil, fmt.Errorf("failed to parse follow-up reply: %w", err)
+	}
+	followups := []string{}
+	for _, question := range questions {
+		question = strings.TrimSpace(question)
+		if question == "" || strings.EqualFold(question, strings.TrimSpace(query)) {
+			continue
+		}
+		followups = append(followups, truncateRunes(question, shared.FollowupMaxLength))
+		if len(followups) == shared.FollowupMaxQuestions {
+			break
+		}
+	}
+	if len(followups) < shared.FollowupMinQuestions {
+		return nil, fmt.Errorf("follow-up reply has %d usable questions", len(followups))
+	}
+	return followups, nil
+}
@@ -0,0 +1,31 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"sybil-api/internal/herocard"
+	"sybil-api/internal/shared"
+)
+
+// startHeroCard looks up the hero card for the query while the search runs.
+// The returned func waits for it and sends it as the heroCard event, after the
+// sources so clients can lay both out together
+func (im *InferenceHandler) startHeroCard(ctx context.Context, query string, locale *shared.SearchLocale, streamWriter func(string) error) func() {
+	if streamWriter == nil || im.SearchConfig == nil || im.SearchConfig.HeroCards == nil {
+		return func() {}
+	}
+	cards := make(chan *herocard.Card, 1)
+	go func() {
+		cards <- im.SearchConfig.HeroCards.Enrich(ctx, query, locale)
+	}()
+	return func() {
+		card := <-cards
+		if card == nil {
+			return
+		}
+		cardJSON, _ := json.Marshal(map[string]any{"type": "heroCard", "card": card})
+		_ = streamWriter(fmt.Sprintf("data: %s", cardJSON))
+	}
+}
@@ -0,0 +1,239 @@
+package inference
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	websearch "sybil-api/internal/search"
+	"sybil-api/internal/shared"
+
+	"github.com/aidarkhanov/nanoid"
+)
+
+// Searches of users who allow their content to be kept are saved to the
+// search table of the region their history lives in. The public id is the
+// link to a saved search, anyone holding it can read the query and results
+// until the owner deletes it
+
+// SavedSearch is a search as read back, never including the owner
+type SavedSearch struct {
+	ID        string                     `json:"id"`
+	Type      string                     `json:"type"`
+	Query     string                     `json:"query"`
+	Results   *shared.SearchResponseBody `json:"results,omitempty"`
+	CreatedAt int64                      `json:"created_at"`
+	// The chat history the answer was saved to, only listed to the owner
+	HistoryID string `json:"history_id,omitempty"`
+}
+
+type SaveSearchInput struct {
+	Ctx       context.Context
+	User      shared.UserMetadata
+	RequestID string
+	Type      string
+	Results   *shared.SearchResponseBody
+	// The chat history the search was answered in, empty for none
+	HistoryID string
+}
+
+type ListSearchesInput struct {
+	Ctx    context.Context
+	User   shared.UserMetadata
+	Limit  int
+	Offset int
+}
+
+type ListSearchesOutput struct {
+	Data    []SavedSearch `json:"data"`
+	HasMore bool          `json:"has_more"`
+}
+
+type GetSearchInput struct {
+	Ctx      context.Context
+	User     shared.UserMetadata
+	SearchID string
+}
+
+// SaveSearch stores a search and returns its public id, empty when the user
+// does not allow their content to be kept
+func (im *InferenceHandler) SaveSearch(input SaveSearchInput) (string, error) {
+	if !input.User.StoreData || input.Results == nil {
+		return "", nil
+	}
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return "", err
+	}
+	idNano, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ", shared.SearchPublicIDLength)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to generate search id"), err, shared.ErrInternalServerError)
+	}
+	publicID := "srch_" + idNano
+
+	// Results are web content, only the query the user typed is redacted
+	results := *input.Results
+	results.Query = im.redactText(input.Ctx, im.redactor(input.User, input.RequestID), "search_query", results.Query)
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		return "", errors.Join(errors.New("failed to marshal search results"), err, shared.ErrInternalServerError)
+	}
+	_, err = store.Writer().ExecContext(input.Ctx, `
+		INSERT INTO search (public_id, user_id, search_type, query, results, history_id)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, publicID, input.User.UserID, input.Type, results.Query, string(resultsJSON), sql.NullString{String: input.HistoryID, Valid: input.HistoryID != ""})
+	if err != nil {
+		return "", errors.Join(errors.New("failed to insert search"), err, shared.ErrInternalServerError)
+	}
+	store.Wrote(input.Ctx, input.User.UserID)
+	return publicID, nil
+}
+
+// ListSearches returns a page of the users saved searches, newest first and
+// without their results
+func (im *InferenceHandler) ListSearches(input ListSearchesInput) (*ListSearchesOutput, error) {
+	log := shared.LoggerFromContext(input.Ctx, im.Log)
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return nil, err
+	}
+	limit := input.Limit
+	if limit <= 0 || limit > shared.MaxPageSize {
+		limit = shared.DefaultPageSize
+	}
+	offset := max(input.Offset, 0)
+
+	output := &ListSearchesOutput{}
+	err = store.Read(input.Ctx, input.User.UserID, func(db *sql.DB) error {
+		output.Data = []SavedSearch{}
+		rows, err := db.QueryContext(input.Ctx, `
+			SELECT public_id, search_type, query, history_id, UNIX_TIMESTAMP(created_at)
+			FROM search
+			WHERE user_id = ? AND deleted_at IS NULL
+			ORDER BY created_at DESC, public_id ASC
+			LIMIT ? OFFSET ?
+		`, input.User.UserID, limit+1, offset)
+		if err != nil {
+			return errors.Join(errors.New("failed to query searches"), err)
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+
+		for rows.Next() {
+			var search SavedSearch
+			var historyID sql.NullString
+			if err := rows.Scan(&search.ID, &search.Type, &search.Query, &historyID, &search.CreatedAt); err != nil {
+				log.Warnw("Failed to scan search row", "error", err)
+				continue
+			}
+			search.HistoryID = historyID.String
+			output.Data = append(output.Data, search)
+		}
+		if err := rows.Err(); err != nil {
+			return errors.Join(errors.New("failed iterating search rows"), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(err, shared.ErrInternalServerError)
+	}
+	if len(output.Data) > limit {
+		output.Data = output.Data[:limit]
+		output.HasMore = true
+	}
+	return output, nil
+}
+
+// GetSearch returns a saved search by its public id to anyone holding it.
+// The id does not say which region the search is stored in, so the default
+// databases are read first and then each residency database
+func (im *InferenceHandler) GetSearch(input GetSearchInput) (*SavedSearch, error) {
+	regions := []string{""}
+	for region := range im.ResidencyDBs {
+		regions = append(regions, region)
+	}
+	for _, region := range regions {
+		store, err := im.regionHistoryStore(region)
+		if err != nil {
+			return nil, err
+		}
+		search, err := im.readSearch(input.Ctx, store, input.SearchID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to query search in region %q", region), err, shared.ErrInternalServerError)
+		}
+		return search, nil
+	}
+	return nil, errors.Join(errors.New("search not found"), shared.ErrNotFound)
+}
+
+// readSearch does not know the owner, replica misses are retried on the
+// primary so a search shared right after it ran is found
+func (im *InferenceHandler) readSearch(ctx context.Context, store *HistoryStore, publicID string) (*SavedSearch, error) {
+	search := &SavedSearch{ID: publicID}
+	var results sql.NullString
+	err := store.Read(ctx, 0, func(db *sql.DB) error {
+		return db.QueryRowContext(ctx, `
+			SELECT search_type, query, results, UNIX_TIMESTAMP(created_at)
+			FROM search
+			WHERE public_id = ? AND deleted_at IS NULL
+		`, publicID).Scan(&search.Type, &search.Query, &results, &search.CreatedAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if results.Valid && results.String != "" {
+		if err := json.Unmarshal([]byte(results.String), &search.Results); err != nil {
+			im.Log.Warnw("Failed to unmarshal saved search results", "error", err, "search_id", publicID)
+		}
+	}
+	return search, nil
+}
+
+// DeleteSearch soft deletes one of the users saved searches, its link stops
+// resolving
+func (im *InferenceHandler) DeleteSearch(input GetSearchInput) error {
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return err
+	}
+	res, err := store.Writer().ExecContext(input.Ctx, `
+		UPDATE search SET deleted_at = NOW()
+		WHERE public_id = ? AND user_id = ? AND deleted_at IS NULL
+	`, input.SearchID, input.User.UserID)
+	if err != nil {
+		return errors.Join(errors.New("failed to delete search"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return errors.Join(errors.New("search not found"), shared.ErrNotFound)
+	}
+	store.Wrote(input.Ctx, input.User.UserID)
+	return nil
+}
+
+// DeleteAllSearches soft deletes every saved search of the user and returns
+// how many there were. Their recent queries stop showing up in autocomplete
+func (im *InferenceHandler) DeleteAllSearches(input ListSearchesInput) (int64, error) {
+	store, err := im.historyStore(input.User)
+	if err != nil {
+		return 0, err
+	}
+	if err := websearch.ForgetRecentQueries(input.Ctx, im.RedisClient, input.User.UserID); err != nil {
+		return 0, errors.Join(errors.New("failed to forget recent queries"), err, shared.ErrInternalServerError)
+	}
+	res, err := store.Writer().ExecContext(input.Ctx, `
+		UPDATE search SET deleted_at = NOW()
+		WHERE user_id = ? AND deleted_at IS NULL
+	`, input.User.UserID)
+	if err != nil {
+		return 0, errors.Join(errors.New("failed to delete searches"), err, shared.ErrInternalServerError)
+	}
+	store.Wrote(input.Ctx, input.User.UserID)
+	deleted, _ := res.RowsAffected()
+	return deleted, nil
+}
@@ -0,0 +1,116 @@
+package inference
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/search"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// cseQuotaLocation is where the Google CSE daily quota resets
+var cseQuotaLocation = func() *time.Location {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}()
+
+// SearchQuota tracks Google CSE queries against the daily quota across all
+// instances. Once the projected daily usage would exceed the quota, Google is
+// skipped and the next provider answers
+type SearchQuota struct {
+	redis *redis.Client
+	log   *zap.SugaredLogger
+	quota int64
+}
+
+func NewSearchQuota(redisClient *redis.Client, log *zap.SugaredLogger, dailyQuota int64) *SearchQuota {
+	return &SearchQuota{redis: redisClient, log: log, quota: dailyQuota}
+}
+
+// Limit returns provider with its searches counted against the daily quota.
+// Over quota searches fail as rate limited so the next provider is tried
+func (sq *SearchQuota) Limit(provider search.Provider) search.Provider {
+	return &quotaProvider{Provider: provider, sq: sq}
+}
+
+type quotaProvider struct {
+	search.Provider
+	sq *SearchQuota
+}
+
+func (qp *quotaProvider) Search(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	if !qp.sq.allow(ctx) {
+		metrics.SearchQueries.WithLabelValues("quota_skipped").Inc()
+		return nil, fmt.Errorf("%w: daily quota used", search.ErrRateLimited)
+	}
+	return qp.Provider.Search(ctx, query, locale)
+}
+
+func (qp *quotaProvider) Images(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	if !qp.sq.allow(ctx) {
+		metrics.SearchQueries.WithLabelValues("quota_skipped").Inc()
+		return nil, fmt.Errorf("%w: daily quota used", search.ErrRateLimited)
+	}
+	return qp.Provider.Images(ctx, query, locale)
+}
+
+// allow counts the query against todays quota and reports whether it should
+// be sent. Denied queries are taken back off the count so they do not use up
+// quota. Redis errors fail open so search keeps working without the counter
+func (sq *SearchQuota) allow(ctx context.Context) bool {
+	now := time.Now().In(cseQuotaLocation)
+	countKey := fmt.Sprintf("sybil:v1:cse:count:%s", now.Format(time.DateOnly))
+	count, err := sq.redis.Incr(ctx, countKey).Result()
+	if err != nil {
+		sq.log.Warnw("Failed to increment search quota counter", "error", err)
+		return true
+	}
+	if count == 1 {
+		sq.redis.Expire(ctx, countKey, 48*time.Hour)
+	}
+	if sq.withinQuota(now, count) {
+		metrics.SearchQuotaUsed.Set(float64(count))
+		return true
+	}
+
+	count, err = sq.redis.Decr(ctx, countKey).Result()
+	if err != nil {
+		sq.log.Warnw("Failed to decrement search quota counter", "error", err)
+		return false
+	}
+	metrics.SearchQuotaUsed.Set(float64(count))
+	metrics.SearchQuotaRemaining.Set(float64(max(sq.quota-count, 0)))
+	return false
+}
+
+// withinQuota reports whether count queries so far today leave room for the
+// query just counted
+func (sq *SearchQuota) withinQuota(now time.Time, count int64) bool {
+	if sq.quota <= 0 {
+		return true
+	}
+	metrics.SearchQuotaRemaining.Set(float64(max(sq.quota-count, 0)))
+
+	if count > sq.quota {
+		return false
+	}
+
+	// Project todays usage from the rate so far. Early in the day the
+	// projection is noisy, so it only applies after the first hour
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, cseQuotaLocation)
+	elapsed := now.Sub(startOfDay)
+	if elapsed < time.Hour {
+		return true
+	}
+	projected := float64(count) / elapsed.Hours() * 24
+	metrics.SearchQuotaProjected.Set(projected)
+	return projected <= float64(sq.quota)
+}
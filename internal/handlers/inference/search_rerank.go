@@ -0,0 +1,135 @@
+package inference
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// rerankInput is a search to reorder by how close each result is to the
+// query
+type rerankInput struct {
+	User      shared.UserMetadata
+	RequestID string
+	Query     string
+	Results   []shared.SearchResults
+}
+
+// rerankSearchResults orders results by the cosine similarity of their
+// snippet to the query, embedded with the rerank model. It is best effort,
+// when the embeddings fail or take longer than the rerank budget the results
+// are returned in provider order
+func (im *InferenceHandler) rerankSearchResults(ctx context.Context, input rerankInput) []shared.SearchResults {
+	if im.RerankModel == "" || len(input.Results) < 2 {
+		return input.Results
+	}
+	budget := im.RerankBudget
+	if budget <= 0 {
+		budget = shared.SearchRerankBudget
+	}
+	rerankCtx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	start := time.Now()
+	reranked, err := im.rerank(rerankCtx, input)
+	metrics.SearchRerankDuration.Observe(time.Since(start).Seconds())
+	switch {
+	case errors.Is(rerankCtx.Err(), context.DeadlineExceeded):
+		metrics.SearchReranks.WithLabelValues("timeout").Inc()
+		im.Log.Warnw("Search rerank exceeded its budget, keeping provider order", "budget", budget, "request_id", input.RequestID)
+		return input.Results
+	case err != nil:
+		metrics.SearchReranks.WithLabelValues("error").Inc()
+		im.Log.Warnw("Failed to rerank search results, keeping provider order", "error", err, "request_id", input.RequestID)
+		return input.Results
+	}
+	metrics.SearchReranks.WithLabelValues("reranked").Inc()
+	return reranked
+}
+
+func (im *InferenceHandler) rerank(ctx context.Context, input rerankInput) ([]shared.SearchResults, error) {
+	texts := make([]string, 0, len(input.Results)+1)
+	texts = append(texts, input.Query)
+	for _, result := range input.Results {
+		texts = append(texts, rerankSnippet(result))
+	}
+	body, err := json.Marshal(map[string]any{
+		"model": im.RerankModel,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqInfo, err := im.Preprocess(ctx, PreprocessInput{
+		Body:      body,
+		User:      input.User,
+		Endpoint:  shared.ENDPOINTS.EMBEDDING,
+		RequestID: input.RequestID + "-rerank",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to preprocess rerank request: %w", err)
+	}
+	// The query and snippets are already part of the chat request
+	reqInfo.Ephemeral = true
+	out, err := im.DoInference(InferenceInput{Req: reqInfo, User: input.User, Ctx: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("rerank inference failed: %w", err)
+	}
+
+	var embResp embeddingsResponse
+	if err := json.Unmarshal(out.FinalResponse, &embResp); err != nil {
+		return nil, fmt.Errorf("failed to parse rerank embeddings: %w", err)
+	}
+	embeddings := make([][]float64, len(texts))
+	for _, d := range embResp.Data {
+		if d.Index < 0 || d.Index >= len(embeddings) {
+			return nil, fmt.Errorf("rerank embedding index %d out of range", d.Index)
+		}
+		embeddings[d.Index] = d.Embedding
+	}
+	for i, embedding := range embeddings {
+		if len(embedding) == 0 {
+			return nil, fmt.Errorf("rerank embedding %d missing", i)
+		}
+	}
+
+	type scored struct {
+		result shared.SearchResults
+		score  float64
+	}
+	scores := make([]scored, len(input.Results))
+	for i, result := range input.Results {
+		scores[i] = scored{result: result, score: cosineSimilarity(embeddings[0], embeddings[i+1])}
+	}
+	// Stable so results the model cant tell apart keep the provider order
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].score > scores[j].score
+	})
+	reranked := make([]shared.SearchResults, len(scores))
+	for i, s := range scores {
+		reranked[i] = s.result
+	}
+	return reranked, nil
+}
+
+// rerankSnippet is the text of a result compared against the query
+func rerankSnippet(result shared.SearchResults) string {
+	var parts []string
+	if result.Title != nil && *result.Title != "" {
+		parts = append(parts, *result.Title)
+	}
+	if result.Content != nil && *result.Content != "" {
+		parts = append(parts, *result.Content)
+	}
+	if len(parts) == 0 && result.URL != nil {
+		parts = append(parts, *result.URL)
+	}
+	return truncateRunes(strings.Join(parts, "\n"), shared.SearchRerankMaxSnippetRunes)
+}
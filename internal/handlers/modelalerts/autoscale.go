@@ -0,0 +1,197 @@
+package modelalerts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"sybil-api/internal/handlers/targon"
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// AutoscaleAuditAction is the admin_audit_log action of automatic max replica
+// changes. The rows have no user and the SYSTEM role
+const AutoscaleAuditAction = "model.autoscale"
+
+type autoscaleModel struct {
+	id        uint64
+	targonUID string
+	config    string
+	// Highest maxReplicas the model may be raised to, set by staff in the
+	// models autoscale_max_replicas metadata
+	ceiling int32
+}
+
+// RunAutoscaler raises the targon maxReplicas of models whose admission queue
+// stays backed up, and lowers it again once the queue has been quiet, every
+// shared.AutoscaleCheckInterval. Only models with autoscale_max_replicas in
+// their metadata are scaled
+func (h *ModelAlertHandler) RunAutoscaler(ctx context.Context) {
+	ticker := time.NewTicker(shared.AutoscaleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.autoscale(ctx)
+		}
+	}
+}
+
+func (h *ModelAlertHandler) autoscale(ctx context.Context) {
+	if h.Targon == nil {
+		return
+	}
+	// One replica samples per interval so streaks count minutes
+	ok, err := h.RedisClient.SetNX(ctx, "sybil:v1:autoscale:check", 1, shared.AutoscaleCheckInterval/2).Result()
+	if err != nil || !ok {
+		return
+	}
+
+	rows, err := h.RDB.QueryContext(ctx, `
+		SELECT id, targon_uid, config, CAST(JSON_EXTRACT(metadata, '$.autoscale_max_replicas') AS UNSIGNED)
+		FROM model
+		WHERE targon_uid IS NOT NULL AND enabled = true
+			AND JSON_EXTRACT(metadata, '$.autoscale_max_replicas') IS NOT NULL
+	`)
+	if err != nil {
+		h.Log.Errorw("Failed to query autoscaled models", "error", err)
+		return
+	}
+	models := []autoscaleModel{}
+	for rows.Next() {
+		var m autoscaleModel
+		if err := rows.Scan(&m.id, &m.targonUID, &m.config, &m.ceiling); err != nil {
+			h.Log.Warnw("Failed to scan autoscaled model row", "error", err)
+			continue
+		}
+		models = append(models, m)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		h.Log.Errorw("Failed iterating autoscaled model rows", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, m := range models {
+		h.autoscaleModel(ctx, m, now)
+	}
+}
+
+// autoscaleModel samples the models queue depth and changes its maxReplicas by
+// shared.AutoscaleReplicaStep when the queue has been backed up or quiet long
+// enough. Scale downs never go below the maxReplicas the model had before the
+// first scale up, which is kept until the model is back at it
+func (h *ModelAlertHandler) autoscaleModel(ctx context.Context, m autoscaleModel, now time.Time) {
+	log := h.Log.With("model_id", m.id, "targon_uid", m.targonUID)
+
+	// Entries older than the queue timeout belong to requests that are gone
+	depth, err := h.RedisClient.ZCount(ctx, shared.CapacityQueueKey(m.id),
+		strconv.FormatInt(now.Add(-shared.CapacityQueueTimeout).UnixMilli(), 10), "+inf").Result()
+	if err != nil {
+		log.Warnw("Failed to read admission queue depth", "error", err)
+		return
+	}
+
+	hotKey := fmt.Sprintf("sybil:v1:autoscale:%d:hot", m.id)
+	quietKey := fmt.Sprintf("sybil:v1:autoscale:%d:quiet", m.id)
+	streakKey, resetKey := quietKey, hotKey
+	if depth >= shared.AutoscaleQueueThreshold {
+		streakKey, resetKey = hotKey, quietKey
+	}
+	// Streaks expire when sampling stops so a gap starts them over
+	pipe := h.RedisClient.TxPipeline()
+	streakCmd := pipe.Incr(ctx, streakKey)
+	pipe.Expire(ctx, streakKey, 3*shared.AutoscaleCheckInterval)
+	pipe.Del(ctx, resetKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Warnw("Failed to record autoscale streak", "error", err)
+		return
+	}
+	streak := streakCmd.Val()
+
+	var config targon.TargonCreateRequest
+	if err := json.Unmarshal([]byte(m.config), &config); err != nil {
+		log.Warnw("Failed to parse model config for autoscale", "error", err)
+		return
+	}
+	current := config.Predictor.MaxReplicas
+
+	baselineKey := fmt.Sprintf("sybil:v1:autoscale:%d:baseline", m.id)
+	baseline, err := h.RedisClient.Get(ctx, baselineKey).Int64()
+	hasBaseline := err == nil
+	if hasBaseline && current <= int32(baseline) {
+		// Staff lowered it by hand, there is nothing left to scale back
+		h.RedisClient.Del(ctx, baselineKey)
+		hasBaseline = false
+	}
+
+	direction, target := "", current
+	switch {
+	case streakKey == hotKey && streak >= shared.AutoscaleSustainedMinutes && current < m.ceiling:
+		direction, target = "up", min(current+shared.AutoscaleReplicaStep, m.ceiling)
+	case streakKey == quietKey && streak >= shared.AutoscaleQuietMinutes && hasBaseline:
+		direction, target = "down", max(current-shared.AutoscaleReplicaStep, int32(baseline))
+	default:
+		return
+	}
+
+	cooldownKey := fmt.Sprintf("sybil:v1:autoscale:%d:cooldown", m.id)
+	ok, err := h.RedisClient.SetNX(ctx, cooldownKey, now.Unix(), shared.AutoscaleCooldown).Result()
+	if err != nil || !ok {
+		return
+	}
+	if direction == "up" {
+		h.RedisClient.SetNX(ctx, baselineKey, current, 0)
+	}
+
+	_, err = h.Targon.UpdateModelLogic(targon.UpdateModelInput{
+		Ctx: ctx,
+		Req: targon.UpdateModelRequest{
+			TargonUID: m.targonUID,
+			Predictor: &targon.PredictorUpdate{MaxReplicas: &target},
+		},
+	})
+	status := 200
+	if err != nil {
+		status = 502
+		metrics.ModelAutoscale.WithLabelValues(strconv.FormatUint(m.id, 10), direction, "error").Inc()
+		log.Errorw("Failed to autoscale model", "error", err, "direction", direction)
+	} else {
+		metrics.ModelAutoscale.WithLabelValues(strconv.FormatUint(m.id, 10), direction, "ok").Inc()
+		log.Infow("Autoscaled model", "direction", direction, "previous_max_replicas", current, "max_replicas", target, "queue_depth", depth)
+		// The next change needs a full streak of its own
+		h.RedisClient.Del(ctx, streakKey)
+		if direction == "down" && int32(baseline) == target {
+			h.RedisClient.Del(ctx, baselineKey)
+		}
+	}
+	h.auditAutoscale(ctx, m, direction, current, target, depth, status)
+}
+
+// auditAutoscale records the change, successful or not, alongside the staff
+// actions in admin_audit_log
+func (h *ModelAlertHandler) auditAutoscale(ctx context.Context, m autoscaleModel, direction string, previous, target int32, depth int64, status int) {
+	params, _ := json.Marshal(map[string]string{"model_id": strconv.FormatUint(m.id, 10)})
+	body, _ := json.Marshal(map[string]any{
+		"targon_uid":            m.targonUID,
+		"direction":             direction,
+		"previous_max_replicas": previous,
+		"max_replicas":          target,
+		"ceiling":               m.ceiling,
+		"queue_depth":           depth,
+	})
+	_, err := h.WDB.ExecContext(ctx, `
+		INSERT INTO admin_audit_log (user_id, role, action, params, body, request_id, status_code)
+		VALUES (NULL, 'SYSTEM', ?, ?, ?, '', ?)
+	`, AutoscaleAuditAction, string(params), string(body), status)
+	if err != nil {
+		h.Log.Errorw("Failed to write autoscale audit log", "error", err, "model_id", m.id)
+	}
+}
@@ -0,0 +1,211 @@
+// Package modelalerts lets model owners subscribe to webhook alerts on the
+// traffic and health of their deployments
+package modelalerts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"sybil-api/internal/handlers/targon"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	KindErrorRate = "ERROR_RATE"
+	KindNoTraffic = "NO_TRAFFIC"
+	KindColdStart = "COLD_START"
+	KindScaling   = "SCALING"
+)
+
+type ModelAlertHandler struct {
+	Log         *zap.SugaredLogger
+	WDB         *sql.DB
+	RDB         *sql.DB
+	RedisClient *redis.Client
+	Targon      *targon.TargonHandler
+}
+
+func NewModelAlertHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger, th *targon.TargonHandler) *ModelAlertHandler {
+	return &ModelAlertHandler{Log: log, WDB: wdb, RDB: rdb, RedisClient: redisClient, Targon: th}
+}
+
+type ModelAlert struct {
+	ID            uint64  `json:"id"`
+	ModelID       uint64  `json:"model_id"`
+	Kind          string  `json:"kind"`
+	Threshold     uint64  `json:"threshold"`
+	WindowMinutes uint64  `json:"window_minutes"`
+	WebhookURL    string  `json:"webhook_url"`
+	LastFiredAt   *string `json:"last_fired_at"`
+}
+
+// SetModelAlertRequest creates or replaces the owners alert of a kind on a
+// model. Threshold is a percentage for ERROR_RATE and a count of cold starts
+// for COLD_START. NO_TRAFFIC fires after WindowMinutes without requests and
+// SCALING fires on every replica count change
+type SetModelAlertRequest struct {
+	ModelID       uint64 `json:"model_id"`
+	Kind          string `json:"kind"`
+	Threshold     uint64 `json:"threshold"`
+	WindowMinutes uint64 `json:"window_minutes"`
+	WebhookURL    string `json:"webhook_url"`
+}
+
+// ModelAlertInput contains all data needed for model alert business logic
+type ModelAlertInput struct {
+	Ctx     context.Context
+	UserID  uint64
+	AlertID uint64
+	Req     *SetModelAlertRequest
+}
+
+func validateModelAlert(req *SetModelAlertRequest) error {
+	if req == nil {
+		return errors.Join(errors.New("request body is required"), shared.ErrBadRequest)
+	}
+	if req.ModelID == 0 {
+		return errors.Join(errors.New("model_id is required"), shared.ErrBadRequest)
+	}
+	if req.WindowMinutes == 0 {
+		req.WindowMinutes = shared.ModelAlertDefaultWindowMinutes
+	}
+	if req.WindowMinutes > shared.ModelAlertMaxWindowMinutes {
+		return errors.Join(fmt.Errorf("window_minutes cannot exceed %d", shared.ModelAlertMaxWindowMinutes), shared.ErrBadRequest)
+	}
+	switch req.Kind {
+	case KindErrorRate:
+		if req.Threshold == 0 || req.Threshold > 100 {
+			return errors.Join(errors.New("threshold must be a percentage between 1 and 100"), shared.ErrBadRequest)
+		}
+	case KindColdStart:
+		if req.Threshold == 0 {
+			return errors.Join(errors.New("threshold must be at least 1 cold start"), shared.ErrBadRequest)
+		}
+	case KindNoTraffic, KindScaling:
+		req.Threshold = 0
+	default:
+		return errors.Join(errors.New("kind must be ERROR_RATE, NO_TRAFFIC, COLD_START or SCALING"), shared.ErrBadRequest)
+	}
+	parsed, err := url.Parse(req.WebhookURL)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return errors.Join(errors.New("webhook_url must be an https url"), shared.ErrBadRequest)
+	}
+	return nil
+}
+
+// SetModelAlertLogic creates or replaces the alert for the model and kind.
+// Only the owner of a private deployment can subscribe to its alerts
+func (h *ModelAlertHandler) SetModelAlertLogic(input ModelAlertInput) (*ModelAlert, error) {
+	if err := validateModelAlert(input.Req); err != nil {
+		return nil, err
+	}
+	req := input.Req
+
+	var modelID uint64
+	err := h.RDB.QueryRowContext(input.Ctx, "SELECT id FROM model WHERE id = ? AND allowed_user_id = ?", req.ModelID, input.UserID).Scan(&modelID)
+	if err != nil {
+		return nil, errors.Join(errors.New("model not found"), err, shared.ErrNotFound)
+	}
+
+	var alertID uint64
+	err = h.WDB.QueryRowContext(input.Ctx, `
+		SELECT id FROM model_alert
+		WHERE user_id = ? AND model_id = ? AND kind = ? AND active = true
+	`, input.UserID, req.ModelID, req.Kind).Scan(&alertID)
+	switch err {
+	case nil:
+		_, err = h.WDB.ExecContext(input.Ctx, `
+			UPDATE model_alert SET threshold = ?, window_minutes = ?, webhook_url = ?, last_fired_at = NULL
+			WHERE id = ?
+		`, req.Threshold, req.WindowMinutes, req.WebhookURL, alertID)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to update model alert"), err, shared.ErrInternalServerError)
+		}
+	case sql.ErrNoRows:
+		res, err := h.WDB.ExecContext(input.Ctx, `
+			INSERT INTO model_alert (user_id, model_id, kind, threshold, window_minutes, webhook_url, active)
+			VALUES (?, ?, ?, ?, ?, ?, true)
+		`, input.UserID, req.ModelID, req.Kind, req.Threshold, req.WindowMinutes, req.WebhookURL)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to insert model alert"), err, shared.ErrInternalServerError)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to get model alert id"), err, shared.ErrInternalServerError)
+		}
+		alertID = uint64(id)
+	default:
+		return nil, errors.Join(errors.New("failed to query model alert"), err, shared.ErrInternalServerError)
+	}
+
+	row := h.WDB.QueryRowContext(input.Ctx, `
+		SELECT id, model_id, kind, threshold, window_minutes, webhook_url, DATE_FORMAT(last_fired_at, '%Y-%m-%dT%H:%i:%sZ')
+		FROM model_alert
+		WHERE id = ?
+	`, alertID)
+	alert, err := scanModelAlert(row)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query model alert"), err, shared.ErrInternalServerError)
+	}
+	return alert, nil
+}
+
+// ListModelAlertsLogic returns the owners active model alerts
+func (h *ModelAlertHandler) ListModelAlertsLogic(input ModelAlertInput) ([]ModelAlert, error) {
+	log := shared.LoggerFromContext(input.Ctx, h.Log)
+	rows, err := h.RDB.QueryContext(input.Ctx, `
+		SELECT id, model_id, kind, threshold, window_minutes, webhook_url, DATE_FORMAT(last_fired_at, '%Y-%m-%dT%H:%i:%sZ')
+		FROM model_alert
+		WHERE user_id = ? AND active = true
+		ORDER BY id ASC
+	`, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query model alerts"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	alerts := []ModelAlert{}
+	for rows.Next() {
+		alert, err := scanModelAlert(rows)
+		if err != nil {
+			log.Warnw("Failed to scan model alert row", "error", err)
+			continue
+		}
+		alerts = append(alerts, *alert)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating model alert rows"), err, shared.ErrInternalServerError)
+	}
+	return alerts, nil
+}
+
+// DeleteModelAlertLogic unsubscribes the owner from an alert
+func (h *ModelAlertHandler) DeleteModelAlertLogic(input ModelAlertInput) error {
+	res, err := h.WDB.ExecContext(input.Ctx, `
+		UPDATE model_alert SET active = false WHERE id = ? AND user_id = ? AND active = true
+	`, input.AlertID, input.UserID)
+	if err != nil {
+		return errors.Join(errors.New("failed to delete model alert"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return errors.Join(errors.New("model alert not found"), shared.ErrNotFound)
+	}
+	return nil
+}
+
+func scanModelAlert(row interface{ Scan(...any) error }) (*ModelAlert, error) {
+	var alert ModelAlert
+	if err := row.Scan(&alert.ID, &alert.ModelID, &alert.Kind, &alert.Threshold, &alert.WindowMinutes,
+		&alert.WebhookURL, &alert.LastFiredAt); err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
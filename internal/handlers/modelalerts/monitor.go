@@ -0,0 +1,269 @@
+package modelalerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var alertClient = &http.Client{Timeout: shared.ModelAlertTimeout}
+
+// AlertEvent is posted to the subscribers webhook when an alert fires
+type AlertEvent struct {
+	AlertID       uint64  `json:"alert_id"`
+	ModelID       uint64  `json:"model_id"`
+	Model         string  `json:"model"`
+	Kind          string  `json:"kind"`
+	Threshold     uint64  `json:"threshold,omitempty"`
+	WindowMinutes uint64  `json:"window_minutes"`
+	Requests      uint64  `json:"requests,omitempty"`
+	Errors        uint64  `json:"errors,omitempty"`
+	ErrorRate     float64 `json:"error_rate,omitempty"`
+	LastRequestAt *string `json:"last_request_at,omitempty"`
+	ColdStarts    uint64  `json:"cold_starts,omitempty"`
+	PrevReplicas  *int32  `json:"previous_replicas,omitempty"`
+	Replicas      *int32  `json:"replicas,omitempty"`
+	WebhookURL    string  `json:"-"`
+	FiredAt       string  `json:"fired_at"`
+}
+
+type subscription struct {
+	id            uint64
+	modelID       uint64
+	model         string
+	kind          string
+	threshold     uint64
+	windowMinutes uint64
+	webhookURL    string
+}
+
+// modelState is what one check observed about a model, shared by all of its
+// subscriptions
+type modelState struct {
+	lastRequest  time.Time
+	prevReplicas *int32
+	replicas     *int32
+}
+
+// RunMonitor tracks deployment replica counts and checks every active model
+// alert each shared.ModelAlertCheckInterval
+func (h *ModelAlertHandler) RunMonitor(ctx context.Context) {
+	ticker := time.NewTicker(shared.ModelAlertCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.check(ctx)
+		}
+	}
+}
+
+func (h *ModelAlertHandler) check(ctx context.Context) {
+	// One replica checks per interval so subscribers are not alerted twice
+	ok, err := h.RedisClient.SetNX(ctx, "sybil:v1:model-alerts:check", 1, shared.ModelAlertCheckInterval/2).Result()
+	if err != nil || !ok {
+		return
+	}
+
+	now := time.Now()
+	replicas := h.trackReplicas(ctx, now)
+
+	rows, err := h.RDB.QueryContext(ctx, `
+		SELECT model_alert.id, model_alert.model_id, model.name, model_alert.kind,
+			model_alert.threshold, model_alert.window_minutes, model_alert.webhook_url
+		FROM model_alert
+		JOIN model ON model.id = model_alert.model_id
+		WHERE model_alert.active = true
+	`)
+	if err != nil {
+		h.Log.Errorw("Failed to query model alerts", "error", err)
+		return
+	}
+	byModel := map[uint64][]subscription{}
+	for rows.Next() {
+		var s subscription
+		if err := rows.Scan(&s.id, &s.modelID, &s.model, &s.kind, &s.threshold, &s.windowMinutes, &s.webhookURL); err != nil {
+			h.Log.Warnw("Failed to scan model alert row", "error", err)
+			continue
+		}
+		byModel[s.modelID] = append(byModel[s.modelID], s)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		h.Log.Errorw("Failed iterating model alert rows", "error", err)
+		return
+	}
+
+	for modelID, subs := range byModel {
+		state := h.observe(ctx, modelID, replicas[modelID])
+		for _, s := range subs {
+			event, since := h.evaluate(ctx, s, state, now)
+			if event == nil || !h.claim(ctx, s.id, since, now) {
+				continue
+			}
+			go h.sendAlert(*event)
+		}
+	}
+}
+
+// observe reads the models last request time and the replica change this
+// check saw, shared by all of its subscriptions
+func (h *ModelAlertHandler) observe(ctx context.Context, modelID uint64, change replicaChange) modelState {
+	state := modelState{prevReplicas: change.prev, replicas: change.current}
+	last, err := h.RedisClient.Get(ctx, fmt.Sprintf("sybil:v1:model-stats:%d:last", modelID)).Int64()
+	if err == nil {
+		state.lastRequest = time.Unix(last, 0)
+	}
+	return state
+}
+
+// evaluate returns the event to send for the subscription, if any, and the
+// time its last alert must be older than for this one to fire
+func (h *ModelAlertHandler) evaluate(ctx context.Context, s subscription, state modelState, now time.Time) (*AlertEvent, time.Time) {
+	event := &AlertEvent{
+		AlertID:       s.id,
+		ModelID:       s.modelID,
+		Model:         s.model,
+		Kind:          s.kind,
+		Threshold:     s.threshold,
+		WindowMinutes: s.windowMinutes,
+		WebhookURL:    s.webhookURL,
+		FiredAt:       now.UTC().Format(time.RFC3339),
+	}
+	window := time.Duration(s.windowMinutes) * time.Minute
+	cooldown := now.Add(-shared.ModelAlertCooldown)
+
+	switch s.kind {
+	case KindErrorRate:
+		traffic := h.sumModelStats(ctx, s.modelID, window, now, "requests", "errors")
+		requests, errs := traffic[0], traffic[1]
+		if requests < shared.ModelAlertMinRequests {
+			return nil, cooldown
+		}
+		rate := float64(errs) / float64(requests) * 100
+		if rate < float64(s.threshold) {
+			return nil, cooldown
+		}
+		event.Requests, event.Errors, event.ErrorRate = requests, errs, rate
+		return event, cooldown
+	case KindNoTraffic:
+		if !state.lastRequest.IsZero() && now.Sub(state.lastRequest) < window {
+			return nil, now
+		}
+		if !state.lastRequest.IsZero() {
+			last := state.lastRequest.UTC().Format(time.RFC3339)
+			event.LastRequestAt = &last
+		}
+		// Fire once per idle stretch, until traffic comes back
+		return event, state.lastRequest
+	case KindColdStart:
+		count, err := h.RedisClient.ZCount(ctx, fmt.Sprintf("sybil:v1:model-alerts:cold-starts:%d", s.modelID),
+			strconv.FormatInt(now.Add(-window).Unix(), 10), "+inf").Result()
+		if err != nil || uint64(count) < s.threshold {
+			return nil, cooldown
+		}
+		event.ColdStarts = uint64(count)
+		return event, cooldown
+	case KindScaling:
+		if state.prevReplicas == nil || state.replicas == nil || *state.prevReplicas == *state.replicas {
+			return nil, now
+		}
+		event.PrevReplicas, event.Replicas = state.prevReplicas, state.replicas
+		return event, now.Add(time.Second)
+	}
+	return nil, now
+}
+
+// sumModelStats sums fields of the per minute model stats recorded by the
+// inference handler over the window, in the order given
+func (h *ModelAlertHandler) sumModelStats(ctx context.Context, modelID uint64, window time.Duration, now time.Time, fields ...string) []uint64 {
+	sums := make([]uint64, len(fields))
+	pipe := h.RedisClient.Pipeline()
+	cmds := []*redis.SliceCmd{}
+	for minute := now.Add(-window).Unix() / 60; minute <= now.Unix()/60; minute++ {
+		cmds = append(cmds, pipe.HMGet(ctx, fmt.Sprintf("sybil:v1:model-stats:%d:%d", modelID, minute), fields...))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		h.Log.Warnw("Failed to read model stats", "error", err, "model_id", modelID)
+		return sums
+	}
+	for _, cmd := range cmds {
+		values := cmd.Val()
+		if len(values) != len(fields) {
+			continue
+		}
+		for i, value := range values {
+			if v, ok := value.(string); ok {
+				n, _ := strconv.ParseUint(v, 10, 64)
+				sums[i] += n
+			}
+		}
+	}
+	return sums
+}
+
+// claim marks the alert as fired unless it already fired after since, so
+// each condition is only reported once per cooldown
+func (h *ModelAlertHandler) claim(ctx context.Context, alertID uint64, since time.Time, now time.Time) bool {
+	res, err := h.WDB.ExecContext(ctx, `
+		UPDATE model_alert SET last_fired_at = ?
+		WHERE id = ? AND (last_fired_at IS NULL OR last_fired_at < ?)
+	`, now.UTC(), alertID, since.UTC())
+	if err != nil {
+		h.Log.Errorw("Failed to claim model alert", "error", err, "alert_id", alertID)
+		return false
+	}
+	affected, err := res.RowsAffected()
+	return err == nil && affected == 1
+}
+
+// sendAlert posts the event to the subscribers webhook. Delivery is best
+// effort, a failed delivery is logged and not retried
+func (h *ModelAlertHandler) sendAlert(event AlertEvent) {
+	log := h.Log.With("alert_id", event.AlertID, "model_id", event.ModelID, "kind", event.Kind)
+	log.Infow("Model alert fired")
+
+	body, err := json.Marshal(map[string]any{
+		"type":  "model." + strings.ToLower(event.Kind),
+		"alert": event,
+	})
+	if err != nil {
+		log.Errorw("Failed to marshal model alert", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shared.ModelAlertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", event.WebhookURL, bytes.NewBuffer(body))
+	if err != nil {
+		log.Warnw("Failed to build model alert request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := alertClient.Do(req)
+	if err != nil {
+		metrics.ModelAlerts.WithLabelValues(event.Kind, "error").Inc()
+		log.Warnw("Failed to send model alert", "error", err)
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 300 {
+		metrics.ModelAlerts.WithLabelValues(event.Kind, fmt.Sprintf("%d", res.StatusCode)).Inc()
+		log.Warnw("Model alert webhook returned non 2xx", "status", res.StatusCode)
+		return
+	}
+	metrics.ModelAlerts.WithLabelValues(event.Kind, "ok").Inc()
+}
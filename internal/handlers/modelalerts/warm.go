@@ -0,0 +1,157 @@
+package modelalerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// replicaChange is the replica count of a model at this check and the one
+// before it, nil when unknown
+type replicaChange struct {
+	prev    *int32
+	current *int32
+}
+
+// trackReplicas asks targon for the replica count of every enabled deployment
+// and stores it under shared.ModelWarmKey, which /v1/models reads to flag warm
+// models and the inference handler reads to spot cold start requests. Scale
+// ups from zero are recorded as cold starts. Changes between two checks are
+// only seen as one event
+func (h *ModelAlertHandler) trackReplicas(ctx context.Context, now time.Time) map[uint64]replicaChange {
+	changes := map[uint64]replicaChange{}
+	if h.Targon == nil {
+		return changes
+	}
+
+	rows, err := h.RDB.QueryContext(ctx, `
+		SELECT id, targon_uid FROM model WHERE enabled = true AND targon_uid IS NOT NULL
+	`)
+	if err != nil {
+		h.Log.Errorw("Failed to query deployments for replica tracking", "error", err)
+		return changes
+	}
+	deployments := map[uint64]string{}
+	for rows.Next() {
+		var modelID uint64
+		var targonUID string
+		if err := rows.Scan(&modelID, &targonUID); err != nil {
+			h.Log.Warnw("Failed to scan deployment row", "error", err)
+			continue
+		}
+		deployments[modelID] = targonUID
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		h.Log.Errorw("Failed iterating deployment rows", "error", err)
+		return changes
+	}
+
+	for modelID, targonUID := range deployments {
+		status, err := h.Targon.GetServiceStatus(ctx, targonUID)
+		if err != nil || status.Status == nil || status.Status.Replicas == nil {
+			if err != nil {
+				h.Log.Warnw("Failed to get targon status for replica tracking", "error", err, "model_id", modelID)
+			}
+			continue
+		}
+		replicas := *status.Status.Replicas
+		change := replicaChange{current: &replicas}
+
+		warmKey := shared.ModelWarmKey(modelID)
+		pipe := h.RedisClient.Pipeline()
+		pipe.HSet(ctx, warmKey, "replicas", replicas, "checked_at", now.Unix())
+		pipe.Expire(ctx, warmKey, shared.ModelWarmStateTTL)
+		prevCmd := pipe.GetSet(ctx, fmt.Sprintf("sybil:v1:model-alerts:replicas:%d", modelID), replicas)
+		_, _ = pipe.Exec(ctx)
+
+		// No previous count on the first observation, nothing to compare against
+		if prev, err := prevCmd.Int64(); err == nil {
+			prevReplicas := int32(prev)
+			change.prev = &prevReplicas
+			if prevReplicas == 0 && replicas > 0 {
+				h.recordColdStart(ctx, modelID, now)
+			}
+		}
+		changes[modelID] = change
+	}
+	return changes
+}
+
+func (h *ModelAlertHandler) recordColdStart(ctx context.Context, modelID uint64, now time.Time) {
+	coldStartsKey := fmt.Sprintf("sybil:v1:model-alerts:cold-starts:%d", modelID)
+	pipe := h.RedisClient.Pipeline()
+	pipe.ZAdd(ctx, coldStartsKey, redis.Z{Score: float64(now.Unix()), Member: now.UnixNano()})
+	pipe.ZRemRangeByScore(ctx, coldStartsKey, "-inf", strconv.FormatInt(now.Add(-shared.ModelStatsTTL).Unix(), 10))
+	pipe.Expire(ctx, coldStartsKey, shared.ModelStatsTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		h.Log.Warnw("Failed to record cold start", "error", err, "model_id", modelID)
+	}
+}
+
+// ColdStartStats summarizes how often a deployment started from zero replicas
+// and how long requests waited on it
+type ColdStartStats struct {
+	ModelID       uint64 `json:"model_id"`
+	WindowMinutes uint64 `json:"window_minutes"`
+	ColdStarts    uint64 `json:"cold_starts"`
+	// Requests that arrived while the model was at zero replicas
+	ColdRequests  uint64  `json:"cold_requests"`
+	AvgWaitMillis *uint64 `json:"avg_wait_ms"`
+	Replicas      *int32  `json:"replicas"`
+}
+
+type ColdStartStatsInput struct {
+	Ctx           context.Context
+	UserID        uint64
+	ModelID       uint64
+	WindowMinutes uint64
+}
+
+// ColdStartStatsLogic returns the cold starts of the owners deployment over
+// the window, shared.ModelAlertDefaultWindowMinutes by default
+func (h *ModelAlertHandler) ColdStartStatsLogic(input ColdStartStatsInput) (*ColdStartStats, error) {
+	if input.WindowMinutes == 0 {
+		input.WindowMinutes = shared.ModelAlertDefaultWindowMinutes
+	}
+	if input.WindowMinutes > shared.ModelAlertMaxWindowMinutes {
+		return nil, errors.Join(fmt.Errorf("window_minutes cannot exceed %d", shared.ModelAlertMaxWindowMinutes), shared.ErrBadRequest)
+	}
+
+	var modelID uint64
+	err := h.RDB.QueryRowContext(input.Ctx, "SELECT id FROM model WHERE id = ? AND allowed_user_id = ?", input.ModelID, input.UserID).Scan(&modelID)
+	if err != nil {
+		return nil, errors.Join(errors.New("model not found"), err, shared.ErrNotFound)
+	}
+
+	now := time.Now()
+	window := time.Duration(input.WindowMinutes) * time.Minute
+	stats := &ColdStartStats{ModelID: modelID, WindowMinutes: input.WindowMinutes}
+
+	coldStarts, err := h.RedisClient.ZCount(input.Ctx, fmt.Sprintf("sybil:v1:model-alerts:cold-starts:%d", modelID),
+		strconv.FormatInt(now.Add(-window).Unix(), 10), "+inf").Result()
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to read cold starts"), err, shared.ErrInternalServerError)
+	}
+	stats.ColdStarts = uint64(coldStarts)
+
+	cold := h.sumModelStats(input.Ctx, modelID, window, now, "cold_requests", "cold_wait_ms")
+	stats.ColdRequests = cold[0]
+	if cold[0] > 0 {
+		avg := cold[1] / cold[0]
+		stats.AvgWaitMillis = &avg
+	}
+
+	if replicas, err := h.RedisClient.HGet(input.Ctx, shared.ModelWarmKey(modelID), "replicas").Int64(); err == nil {
+		r := int32(replicas)
+		stats.Replicas = &r
+	}
+	return stats, nil
+}
@@ -0,0 +1,393 @@
+package modelalerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"sybil-api/internal/handlers/targon"
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// WarmPoolAuditAction is the admin_audit_log action of forecast min replica
+// changes. The rows have no user and the SYSTEM role
+const WarmPoolAuditAction = "model.warm_pool"
+
+type warmPoolModel struct {
+	id        uint64
+	name      string
+	targonUID string
+	config    string
+	// minReplicas held through forecast peaks, set by staff in the models
+	// warm_pool_min_replicas metadata
+	warm int32
+}
+
+// WarmPoolForecast is the expected requests of a model for every hour of the
+// week in UTC, Sunday 00:00 first. Volume per weekday comes from daily_stats,
+// the shape of the day from the requests of the last shared.WarmPoolShapeDays
+type WarmPoolForecast struct {
+	Hourly [168]float64 `json:"hourly"`
+	// Hours of the week the model is held warm
+	PeakHours  []int `json:"peak_hours"`
+	ComputedAt int64 `json:"computed_at"`
+}
+
+func hourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+func (f *WarmPoolForecast) isPeak(t time.Time) bool {
+	hour := hourOfWeek(t)
+	for _, peak := range f.PeakHours {
+		if peak == hour {
+			return true
+		}
+	}
+	return false
+}
+
+// RunWarmPool raises the targon minReplicas of models ahead of their forecast
+// daily peaks and lowers it again once the peak has passed, every
+// shared.WarmPoolCheckInterval. Only models with warm_pool_min_replicas in
+// their metadata are scheduled
+func (h *ModelAlertHandler) RunWarmPool(ctx context.Context) {
+	ticker := time.NewTicker(shared.WarmPoolCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.warmPool(ctx)
+		}
+	}
+}
+
+func (h *ModelAlertHandler) warmPool(ctx context.Context) {
+	if h.Targon == nil {
+		return
+	}
+	ok, err := h.RedisClient.SetNX(ctx, "sybil:v1:warm-pool:check", 1, shared.WarmPoolCheckInterval/2).Result()
+	if err != nil || !ok {
+		return
+	}
+
+	models, err := h.warmPoolModels(ctx)
+	if err != nil {
+		h.Log.Errorw("Failed to query warm pool models", "error", err)
+		return
+	}
+	now := time.Now()
+	for _, m := range models {
+		h.warmPoolModel(ctx, m, now)
+	}
+}
+
+func (h *ModelAlertHandler) warmPoolModels(ctx context.Context) ([]warmPoolModel, error) {
+	rows, err := h.RDB.QueryContext(ctx, `
+		SELECT id, name, targon_uid, config, CAST(JSON_EXTRACT(metadata, '$.warm_pool_min_replicas') AS UNSIGNED)
+		FROM model
+		WHERE targon_uid IS NOT NULL AND enabled = true
+			AND JSON_EXTRACT(metadata, '$.warm_pool_min_replicas') IS NOT NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	models := []warmPoolModel{}
+	for rows.Next() {
+		var m warmPoolModel
+		if err := rows.Scan(&m.id, &m.name, &m.targonUID, &m.config, &m.warm); err != nil {
+			h.Log.Warnw("Failed to scan warm pool model row", "error", err)
+			continue
+		}
+		models = append(models, m)
+	}
+	return models, rows.Err()
+}
+
+// warmPoolModel holds the model at its warm minReplicas from
+// shared.WarmPoolLeadTime before a peak hour until the peak is over. The
+// minReplicas it had before is restored afterwards, unless staff changed it
+// by hand in between
+func (h *ModelAlertHandler) warmPoolModel(ctx context.Context, m warmPoolModel, now time.Time) {
+	log := h.Log.With("model_id", m.id, "targon_uid", m.targonUID)
+
+	forecast, err := h.warmPoolForecast(ctx, m.id, now)
+	if err != nil {
+		log.Warnw("Failed to forecast model traffic", "error", err)
+		return
+	}
+
+	var config targon.TargonCreateRequest
+	if err := json.Unmarshal([]byte(m.config), &config); err != nil {
+		log.Warnw("Failed to parse model config for warm pool", "error", err)
+		return
+	}
+	current := int32(0)
+	if config.Predictor.MinReplicas != nil {
+		current = *config.Predictor.MinReplicas
+	}
+	warm := m.warm
+	if config.Predictor.MaxReplicas > 0 {
+		warm = min(warm, config.Predictor.MaxReplicas)
+	}
+
+	stateKey := fmt.Sprintf("sybil:v1:warm-pool:%d", m.id)
+	state, err := h.RedisClient.HGetAll(ctx, stateKey).Result()
+	if err != nil {
+		log.Warnw("Failed to read warm pool state", "error", err)
+		return
+	}
+	baseline, hasState := state["baseline"]
+	applied := state["applied"]
+
+	peak := forecast.isPeak(now) || forecast.isPeak(now.Add(shared.WarmPoolLeadTime))
+	direction, target := "", current
+	switch {
+	case peak && current < warm:
+		direction, target = "up", warm
+	case !peak && hasState:
+		if applied != strconv.FormatInt(int64(current), 10) {
+			// Staff changed it by hand, their value stays
+			h.RedisClient.Del(ctx, stateKey)
+			return
+		}
+		b, _ := strconv.ParseInt(baseline, 10, 32)
+		direction, target = "down", int32(b)
+	default:
+		return
+	}
+
+	_, err = h.Targon.UpdateModelLogic(targon.UpdateModelInput{
+		Ctx: ctx,
+		Req: targon.UpdateModelRequest{
+			TargonUID: m.targonUID,
+			Predictor: &targon.PredictorUpdate{MinReplicas: &target},
+		},
+	})
+	status := 200
+	if err != nil {
+		status = 502
+		metrics.WarmPool.WithLabelValues(strconv.FormatUint(m.id, 10), direction, "error").Inc()
+		log.Errorw("Failed to change warm pool replicas", "error", err, "direction", direction)
+	} else {
+		metrics.WarmPool.WithLabelValues(strconv.FormatUint(m.id, 10), direction, "ok").Inc()
+		log.Infow("Changed warm pool replicas", "direction", direction, "previous_min_replicas", current, "min_replicas", target)
+		if direction == "up" {
+			pipe := h.RedisClient.TxPipeline()
+			pipe.HSetNX(ctx, stateKey, "baseline", current)
+			pipe.HSet(ctx, stateKey, "applied", target)
+			if _, err := pipe.Exec(ctx); err != nil {
+				log.Warnw("Failed to save warm pool state", "error", err)
+			}
+		} else {
+			h.RedisClient.Del(ctx, stateKey)
+		}
+	}
+	h.auditWarmPool(ctx, m, direction, current, target, forecast.Hourly[hourOfWeek(now.Add(shared.WarmPoolLeadTime))], status)
+}
+
+// warmPoolForecast returns the cached forecast of the model, computing it
+// again once it is shared.WarmPoolForecastTTL old
+func (h *ModelAlertHandler) warmPoolForecast(ctx context.Context, modelID uint64, now time.Time) (*WarmPoolForecast, error) {
+	cacheKey := fmt.Sprintf("sybil:v1:warm-pool:forecast:%d", modelID)
+	if cached, err := h.RedisClient.Get(ctx, cacheKey).Bytes(); err == nil {
+		var forecast WarmPoolForecast
+		if err := json.Unmarshal(cached, &forecast); err == nil {
+			return &forecast, nil
+		}
+	}
+
+	forecast := &WarmPoolForecast{ComputedAt: now.Unix()}
+
+	var days [7]float64
+	rows, err := h.RDB.QueryContext(ctx, `
+		SELECT DAYOFWEEK(date) - 1, SUM(request_count)
+		FROM daily_stats
+		WHERE model_id = ? AND date >= ? AND date < ?
+		GROUP BY DAYOFWEEK(date)
+	`, modelID, now.UTC().AddDate(0, 0, -7*shared.WarmPoolLookbackWeeks).Format("2006-01-02"), now.UTC().Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var weekday int
+		var requests uint64
+		if err := rows.Scan(&weekday, &requests); err != nil || weekday < 0 || weekday > 6 {
+			continue
+		}
+		// Days without traffic have no row, so divide by the weeks looked back
+		days[weekday] = float64(requests) / shared.WarmPoolLookbackWeeks
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var shape [24]float64
+	var total float64
+	rows, err = h.RDB.QueryContext(ctx, `
+		SELECT HOUR(created_at), COUNT(*)
+		FROM request
+		WHERE model_id = ? AND created_at >= ?
+		GROUP BY HOUR(created_at)
+	`, modelID, now.UTC().AddDate(0, 0, -shared.WarmPoolShapeDays))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var hour int
+		var requests uint64
+		if err := rows.Scan(&hour, &requests); err != nil || hour < 0 || hour > 23 {
+			continue
+		}
+		shape[hour] = float64(requests)
+		total += float64(requests)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var week float64
+	for hour := range forecast.Hourly {
+		share := 1.0 / 24
+		if total > 0 {
+			share = shape[hour%24] / total
+		}
+		forecast.Hourly[hour] = days[hour/24] * share
+		week += forecast.Hourly[hour]
+	}
+	average := week / float64(len(forecast.Hourly))
+	forecast.PeakHours = []int{}
+	for hour, requests := range forecast.Hourly {
+		if requests >= shared.WarmPoolPeakFactor*average && requests >= shared.WarmPoolMinHourlyRequests {
+			forecast.PeakHours = append(forecast.PeakHours, hour)
+		}
+	}
+
+	if forecastJSON, err := json.Marshal(forecast); err == nil {
+		if err := h.RedisClient.Set(ctx, cacheKey, forecastJSON, shared.WarmPoolForecastTTL).Err(); err != nil {
+			h.Log.Warnw("Failed to cache warm pool forecast", "error", err, "model_id", modelID)
+		}
+	}
+	return forecast, nil
+}
+
+// auditWarmPool records the change, successful or not, alongside the staff
+// actions in admin_audit_log
+func (h *ModelAlertHandler) auditWarmPool(ctx context.Context, m warmPoolModel, direction string, previous, target int32, forecast float64, status int) {
+	params, _ := json.Marshal(map[string]string{"model_id": strconv.FormatUint(m.id, 10)})
+	body, _ := json.Marshal(map[string]any{
+		"targon_uid":            m.targonUID,
+		"direction":             direction,
+		"previous_min_replicas": previous,
+		"min_replicas":          target,
+		"forecast_requests":     int64(forecast),
+	})
+	_, err := h.WDB.ExecContext(ctx, `
+		INSERT INTO admin_audit_log (user_id, role, action, params, body, request_id, status_code)
+		VALUES (NULL, 'SYSTEM', ?, ?, ?, '', ?)
+	`, WarmPoolAuditAction, string(params), string(body), status)
+	if err != nil {
+		h.Log.Errorw("Failed to write warm pool audit log", "error", err, "model_id", m.id)
+	}
+}
+
+type WarmPoolAction struct {
+	ModelID    uint64          `json:"model_id"`
+	Change     json.RawMessage `json:"change"`
+	StatusCode int             `json:"status_code"`
+	CreatedAt  int64           `json:"created_at"`
+}
+
+type WarmPoolModelReport struct {
+	ModelID      uint64 `json:"model_id"`
+	Name         string `json:"name"`
+	MinReplicas  int32  `json:"min_replicas"`
+	WarmReplicas int32  `json:"warm_replicas"`
+	// Set while the model is held warm
+	Warm     bool              `json:"warm"`
+	Forecast *WarmPoolForecast `json:"forecast"`
+	// Replica hours a week saved against holding the warm replicas all week
+	SavedReplicaHours int64 `json:"saved_replica_hours_per_week"`
+}
+
+type WarmPoolReport struct {
+	Models []WarmPoolModelReport `json:"models"`
+	// Changes made over the last shared.WarmPoolReportDays, newest first
+	Actions []WarmPoolAction `json:"actions"`
+}
+
+// WarmPoolReportLogic returns the forecast and savings estimate of every
+// scheduled model with the changes made recently
+func (h *ModelAlertHandler) WarmPoolReportLogic(ctx context.Context) (*WarmPoolReport, error) {
+	models, err := h.warmPoolModels(ctx)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query warm pool models"), err, shared.ErrInternalServerError)
+	}
+	now := time.Now()
+	report := &WarmPoolReport{Models: []WarmPoolModelReport{}, Actions: []WarmPoolAction{}}
+	for _, m := range models {
+		forecast, err := h.warmPoolForecast(ctx, m.id, now)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to forecast model traffic"), err, shared.ErrInternalServerError)
+		}
+		var config targon.TargonCreateRequest
+		_ = json.Unmarshal([]byte(m.config), &config)
+		modelReport := WarmPoolModelReport{ModelID: m.id, Name: m.name, WarmReplicas: m.warm, Forecast: forecast}
+		if config.Predictor.MinReplicas != nil {
+			modelReport.MinReplicas = *config.Predictor.MinReplicas
+		}
+
+		baseline := modelReport.MinReplicas
+		if b, err := h.RedisClient.HGet(ctx, fmt.Sprintf("sybil:v1:warm-pool:%d", m.id), "baseline").Int64(); err == nil {
+			modelReport.Warm = true
+			baseline = int32(b)
+		}
+		if m.warm > baseline {
+			offPeakHours := int64(len(forecast.Hourly) - len(forecast.PeakHours))
+			modelReport.SavedReplicaHours = offPeakHours * int64(m.warm-baseline)
+		}
+		report.Models = append(report.Models, modelReport)
+	}
+
+	rows, err := h.RDB.QueryContext(ctx, `
+		SELECT JSON_UNQUOTE(JSON_EXTRACT(params, '$.model_id')), body, status_code, UNIX_TIMESTAMP(created_at)
+		FROM admin_audit_log
+		WHERE action = ? AND created_at >= ?
+		ORDER BY created_at DESC
+	`, WarmPoolAuditAction, now.UTC().AddDate(0, 0, -shared.WarmPoolReportDays))
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query warm pool actions"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var action WarmPoolAction
+		var modelID, body string
+		if err := rows.Scan(&modelID, &body, &action.StatusCode, &action.CreatedAt); err != nil {
+			h.Log.Warnw("Failed to scan warm pool action row", "error", err)
+			continue
+		}
+		action.ModelID, _ = strconv.ParseUint(modelID, 10, 64)
+		action.Change = json.RawMessage(body)
+		report.Actions = append(report.Actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating warm pool action rows"), err, shared.ErrInternalServerError)
+	}
+	return report, nil
+}
@@ -0,0 +1,195 @@
+// Package policy manages mandatory system prompt policies attached to users
+// and api keys
+package policy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type PolicyHandler struct {
+	Log         *zap.SugaredLogger
+	WDB         *sql.DB
+	RDB         *sql.DB
+	RedisClient *redis.Client
+}
+
+func NewPolicyHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger) *PolicyHandler {
+	return &PolicyHandler{Log: log, WDB: wdb, RDB: rdb, RedisClient: redisClient}
+}
+
+type Policy struct {
+	ID        uint64  `json:"id"`
+	UserID    uint64  `json:"user_id"`
+	APIKeyID  *string `json:"api_key_id"`
+	Version   uint64  `json:"version"`
+	Content   string  `json:"content"`
+	CreatedBy uint64  `json:"created_by"`
+	CreatedAt int64   `json:"created_at"`
+}
+
+// SetPolicyRequest attaches a policy to a user, or to a single api key when
+// APIKeyID, the public id of the key, is set. Key policies take precedence
+// over user policies
+type SetPolicyRequest struct {
+	UserID   uint64  `json:"user_id"`
+	APIKeyID *string `json:"api_key_id,omitempty"`
+	Content  string  `json:"content"`
+}
+
+// SetPolicyInput contains all data needed for SetPolicy business logic
+type SetPolicyInput struct {
+	Ctx     context.Context
+	AdminID uint64
+	Req     SetPolicyRequest
+}
+
+// PolicyInput contains all data needed for list and deactivate business logic
+type PolicyInput struct {
+	Ctx      context.Context
+	UserID   uint64
+	PolicyID uint64
+}
+
+// SetPolicyLogic stores a new version of the policy for the scope and
+// deactivates the previous one
+func (p *PolicyHandler) SetPolicyLogic(input SetPolicyInput) (*Policy, error) {
+	req := input.Req
+	if req.UserID == 0 {
+		return nil, errors.Join(errors.New("user_id is required"), shared.ErrBadRequest)
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		return nil, errors.Join(errors.New("content is required"), shared.ErrBadRequest)
+	}
+	if len(req.Content) > shared.SystemPolicyMaxBytes {
+		return nil, errors.Join(fmt.Errorf("content cannot exceed %d bytes", shared.SystemPolicyMaxBytes), shared.ErrBadRequest)
+	}
+
+	if req.APIKeyID != nil {
+		var keyUserID uint64
+		err := p.RDB.QueryRowContext(input.Ctx, "SELECT user_id FROM api_key WHERE public_id = ?", *req.APIKeyID).Scan(&keyUserID)
+		if err != nil || keyUserID != req.UserID {
+			return nil, errors.Join(errors.New("api key not found for user"), shared.ErrNotFound)
+		}
+	}
+
+	var version uint64
+	var policyID int64
+	err := database.ExecuteTransaction(input.Ctx, p.WDB, []func(*sql.Tx) error{
+		func(tx *sql.Tx) error {
+			return tx.QueryRowContext(input.Ctx, `
+				SELECT COALESCE(MAX(version), 0) FROM system_prompt_policy
+				WHERE user_id = ? AND api_key_id <=> ?
+				FOR UPDATE
+			`, req.UserID, req.APIKeyID).Scan(&version)
+		},
+		func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(input.Ctx, `
+				UPDATE system_prompt_policy SET active = false
+				WHERE user_id = ? AND api_key_id <=> ? AND active = true
+			`, req.UserID, req.APIKeyID)
+			return err
+		},
+		func(tx *sql.Tx) error {
+			res, err := tx.ExecContext(input.Ctx, `
+				INSERT INTO system_prompt_policy (user_id, api_key_id, version, content, created_by, active)
+				VALUES (?, ?, ?, ?, ?, true)
+			`, req.UserID, req.APIKeyID, version+1, req.Content, input.AdminID)
+			if err != nil {
+				return err
+			}
+			policyID, err = res.LastInsertId()
+			return err
+		},
+	})
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to save policy"), err, shared.ErrInternalServerError)
+	}
+
+	p.clearPolicyCache(input.Ctx, req.UserID)
+	return p.getPolicy(input.Ctx, uint64(policyID))
+}
+
+// ListPoliciesLogic returns the active policies for a user
+func (p *PolicyHandler) ListPoliciesLogic(input PolicyInput) ([]Policy, error) {
+	log := shared.LoggerFromContext(input.Ctx, p.Log)
+	rows, err := p.RDB.QueryContext(input.Ctx, `
+		SELECT id, user_id, api_key_id, version, content, created_by, UNIX_TIMESTAMP(created_at)
+		FROM system_prompt_policy
+		WHERE user_id = ? AND active = true
+		ORDER BY id ASC
+	`, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query policies"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	policies := []Policy{}
+	for rows.Next() {
+		var policy Policy
+		if err := rows.Scan(&policy.ID, &policy.UserID, &policy.APIKeyID, &policy.Version, &policy.Content, &policy.CreatedBy, &policy.CreatedAt); err != nil {
+			log.Warnw("Failed to scan policy row", "error", err)
+			continue
+		}
+		policies = append(policies, policy)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating policy rows"), err, shared.ErrInternalServerError)
+	}
+	return policies, nil
+}
+
+// DeactivatePolicyLogic stops a policy from being applied
+func (p *PolicyHandler) DeactivatePolicyLogic(input PolicyInput) error {
+	policy, err := p.getPolicy(input.Ctx, input.PolicyID)
+	if err != nil {
+		return err
+	}
+	_, err = p.WDB.ExecContext(input.Ctx, "UPDATE system_prompt_policy SET active = false WHERE id = ?", input.PolicyID)
+	if err != nil {
+		return errors.Join(errors.New("failed to deactivate policy"), err, shared.ErrInternalServerError)
+	}
+	p.clearPolicyCache(input.Ctx, policy.UserID)
+	return nil
+}
+
+func (p *PolicyHandler) getPolicy(ctx context.Context, policyID uint64) (*Policy, error) {
+	var policy Policy
+	err := p.WDB.QueryRowContext(ctx, `
+		SELECT id, user_id, api_key_id, version, content, created_by, UNIX_TIMESTAMP(created_at)
+		FROM system_prompt_policy
+		WHERE id = ?
+	`, policyID).Scan(&policy.ID, &policy.UserID, &policy.APIKeyID, &policy.Version, &policy.Content, &policy.CreatedBy, &policy.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("policy not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query policy"), err, shared.ErrInternalServerError)
+	}
+	return &policy, nil
+}
+
+// clearPolicyCache drops the cached policy for every api key of the user
+func (p *PolicyHandler) clearPolicyCache(ctx context.Context, userID uint64) {
+	pattern := fmt.Sprintf("sybil:v1:policy:%d:*", userID)
+	iter := p.RedisClient.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		if err := p.RedisClient.Del(ctx, iter.Val()).Err(); err != nil {
+			p.Log.Warnw("Failed to clear policy cache", "error", err, "key", iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		p.Log.Warnw("Failed to scan policy cache", "error", err, "user_id", userID)
+	}
+}
@@ -0,0 +1,137 @@
+// Package providerkeys stores the api keys customers bring for external
+// provider models. Keys are envelope encrypted and never returned
+package providerkeys
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+)
+
+type ProviderKeyHandler struct {
+	Log     *zap.SugaredLogger
+	WDB     *sql.DB
+	RDB     *sql.DB
+	Keyring *shared.Keyring
+}
+
+func NewProviderKeyHandler(wdb *sql.DB, rdb *sql.DB, keyring *shared.Keyring, log *zap.SugaredLogger) *ProviderKeyHandler {
+	return &ProviderKeyHandler{Log: log, WDB: wdb, RDB: rdb, Keyring: keyring}
+}
+
+type ProviderKey struct {
+	Provider  string `json:"provider"`
+	Hint      string `json:"hint"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type SetProviderKeyRequest struct {
+	Provider string `json:"provider"`
+	APIKey   string `json:"api_key"`
+}
+
+// ProviderKeyInput contains all data needed for provider key business logic
+type ProviderKeyInput struct {
+	Ctx      context.Context
+	UserID   uint64
+	Provider string
+	Req      *SetProviderKeyRequest
+}
+
+// SetProviderKeyLogic stores or replaces the users key for a provider
+func (p *ProviderKeyHandler) SetProviderKeyLogic(input ProviderKeyInput) (*ProviderKey, error) {
+	if p.Keyring == nil {
+		return nil, errors.Join(errors.New("provider keys are not enabled"), shared.ErrBadRequest)
+	}
+	if input.Req == nil {
+		return nil, errors.Join(errors.New("request body is required"), shared.ErrBadRequest)
+	}
+	provider := strings.ToLower(strings.TrimSpace(input.Req.Provider))
+	if !slices.Contains(shared.BYOKProviders, provider) {
+		return nil, errors.Join(fmt.Errorf("unknown provider: %s", input.Req.Provider), shared.ErrBadRequest)
+	}
+	apiKey := strings.TrimSpace(input.Req.APIKey)
+	if len(apiKey) < 8 {
+		return nil, errors.Join(errors.New("api_key is required"), shared.ErrBadRequest)
+	}
+
+	sealed, err := p.Keyring.Seal([]byte(apiKey))
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to encrypt provider key"), err, shared.ErrInternalServerError)
+	}
+	hint := apiKey[len(apiKey)-4:]
+	_, err = p.WDB.ExecContext(input.Ctx, `
+		INSERT INTO provider_key (user_id, provider, encrypted_key, encryption_key_id, encrypted_data_key, hint)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			encrypted_key = VALUES(encrypted_key),
+			encryption_key_id = VALUES(encryption_key_id),
+			encrypted_data_key = VALUES(encrypted_data_key),
+			hint = VALUES(hint),
+			created_at = NOW()
+	`, input.UserID, provider, sealed.Ciphertext, sealed.KeyID, sealed.DataKey, hint)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to store provider key"), err, shared.ErrInternalServerError)
+	}
+	return p.getProviderKey(input.Ctx, input.UserID, provider)
+}
+
+// ListProviderKeysLogic returns the providers the user has keys for
+func (p *ProviderKeyHandler) ListProviderKeysLogic(input ProviderKeyInput) ([]ProviderKey, error) {
+	rows, err := p.RDB.QueryContext(input.Ctx, `
+		SELECT provider, hint, UNIX_TIMESTAMP(created_at)
+		FROM provider_key
+		WHERE user_id = ?
+		ORDER BY provider ASC
+	`, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query provider keys"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	keys := []ProviderKey{}
+	for rows.Next() {
+		var key ProviderKey
+		if err := rows.Scan(&key.Provider, &key.Hint, &key.CreatedAt); err != nil {
+			return nil, errors.Join(errors.New("failed to scan provider key"), err, shared.ErrInternalServerError)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// DeleteProviderKeyLogic removes the users key, their requests go back to
+// being billed by us
+func (p *ProviderKeyHandler) DeleteProviderKeyLogic(input ProviderKeyInput) error {
+	res, err := p.WDB.ExecContext(input.Ctx, "DELETE FROM provider_key WHERE user_id = ? AND provider = ?", input.UserID, input.Provider)
+	if err != nil {
+		return errors.Join(errors.New("failed to delete provider key"), err, shared.ErrInternalServerError)
+	}
+	if deleted, _ := res.RowsAffected(); deleted == 0 {
+		return errors.Join(errors.New("provider key not found"), shared.ErrNotFound)
+	}
+	return nil
+}
+
+func (p *ProviderKeyHandler) getProviderKey(ctx context.Context, userID uint64, provider string) (*ProviderKey, error) {
+	var key ProviderKey
+	err := p.WDB.QueryRowContext(ctx, `
+		SELECT provider, hint, UNIX_TIMESTAMP(created_at) FROM provider_key WHERE user_id = ? AND provider = ?
+	`, userID, provider).Scan(&key.Provider, &key.Hint, &key.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("provider key not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query provider key"), err, shared.ErrInternalServerError)
+	}
+	return &key, nil
+}
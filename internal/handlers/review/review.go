@@ -0,0 +1,148 @@
+// Package review exposes the sampled request/response review queue for
+// labeling
+package review
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+)
+
+type ReviewHandler struct {
+	Log *zap.SugaredLogger
+	WDB *sql.DB
+	RDB *sql.DB
+}
+
+func NewReviewHandler(wdb *sql.DB, rdb *sql.DB, log *zap.SugaredLogger) *ReviewHandler {
+	return &ReviewHandler{Log: log, WDB: wdb, RDB: rdb}
+}
+
+type Sample struct {
+	ID        uint64  `json:"id"`
+	ModelID   uint64  `json:"model_id"`
+	Model     string  `json:"model"`
+	Endpoint  string  `json:"endpoint"`
+	Request   string  `json:"request"`
+	Response  string  `json:"response"`
+	Completed bool    `json:"completed"`
+	Label     *string `json:"label"`
+	Score     *int    `json:"score"`
+	Notes     *string `json:"notes"`
+	CreatedAt int64   `json:"created_at"`
+}
+
+type LabelRequest struct {
+	Label string `json:"label"`
+	Score *int   `json:"score,omitempty"`
+	Notes string `json:"notes,omitempty"`
+}
+
+var validLabels = map[string]bool{
+	"good":      true,
+	"bad":       true,
+	"harmful":   true,
+	"incorrect": true,
+	"refusal":   true,
+	"skip":      true,
+}
+
+// ListSamplesInput contains all data needed for ListSamples business logic
+type ListSamplesInput struct {
+	Ctx       context.Context
+	ModelID   uint64
+	Unlabeled bool
+	AfterID   uint64
+	Limit     int
+}
+
+// LabelSampleInput contains all data needed for LabelSample business logic
+type LabelSampleInput struct {
+	Ctx      context.Context
+	UserID   uint64
+	SampleID uint64
+	Req      LabelRequest
+}
+
+func (r *ReviewHandler) ListSamplesLogic(input ListSamplesInput) ([]Sample, error) {
+	log := shared.LoggerFromContext(input.Ctx, r.Log)
+	limit := input.Limit
+	if limit <= 0 || limit > shared.MaxPageSize {
+		limit = shared.DefaultPageSize
+	}
+
+	var where []string
+	var args []any
+	where = append(where, "id > ?")
+	args = append(args, input.AfterID)
+	if input.ModelID != 0 {
+		where = append(where, "model_id = ?")
+		args = append(args, input.ModelID)
+	}
+	if input.Unlabeled {
+		where = append(where, "label IS NULL")
+	}
+	args = append(args, limit)
+
+	rows, err := r.RDB.QueryContext(input.Ctx, `
+		SELECT id, model_id, model, endpoint, request, response, completed, label, score, notes, UNIX_TIMESTAMP(created_at)
+		FROM review_sample
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY id ASC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query review samples"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	samples := []Sample{}
+	for rows.Next() {
+		var s Sample
+		if err := rows.Scan(&s.ID, &s.ModelID, &s.Model, &s.Endpoint, &s.Request, &s.Response, &s.Completed, &s.Label, &s.Score, &s.Notes, &s.CreatedAt); err != nil {
+			log.Warnw("Failed to scan review sample row", "error", err)
+			continue
+		}
+		samples = append(samples, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating review sample rows"), err, shared.ErrInternalServerError)
+	}
+	return samples, nil
+}
+
+func (r *ReviewHandler) LabelSampleLogic(input LabelSampleInput) error {
+	if !validLabels[input.Req.Label] {
+		return errors.Join(errors.New("label must be one of good, bad, harmful, incorrect, refusal, skip"), shared.ErrBadRequest)
+	}
+	if input.Req.Score != nil && (*input.Req.Score < 1 || *input.Req.Score > 5) {
+		return errors.Join(errors.New("score must be between 1 and 5"), shared.ErrBadRequest)
+	}
+
+	var sampleID uint64
+	err := r.WDB.QueryRowContext(input.Ctx, "SELECT id FROM review_sample WHERE id = ?", input.SampleID).Scan(&sampleID)
+	if err != nil {
+		return errors.Join(errors.New("failed to find review sample"), err, shared.ErrNotFound)
+	}
+
+	var notes *string
+	if input.Req.Notes != "" {
+		notes = &input.Req.Notes
+	}
+	_, err = r.WDB.ExecContext(input.Ctx, `
+		UPDATE review_sample
+		SET label = ?, score = ?, notes = ?, labeled_by = ?, labeled_at = NOW()
+		WHERE id = ?
+	`, input.Req.Label, input.Req.Score, notes, input.UserID, input.SampleID)
+	if err != nil {
+		return errors.Join(errors.New("failed to label review sample"), err, shared.ErrInternalServerError)
+	}
+	return nil
+}
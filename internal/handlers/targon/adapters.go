@@ -0,0 +1,341 @@
+package targon
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/shared"
+)
+
+type RegisterAdapterRequest struct {
+	Name          string   `json:"name"`
+	Path          string   `json:"path"`
+	AllowedUserID uint64   `json:"allowed_user_id,omitempty"`
+	Pricing       *Pricing `json:"pricing,omitempty"`
+}
+
+type Adapter struct {
+	Name    string   `json:"name"`
+	Path    string   `json:"path"`
+	Active  bool     `json:"active"`
+	Pricing *Pricing `json:"pricing,omitempty"`
+}
+
+// AdapterInput contains all data needed for the adapter business logic
+type AdapterInput struct {
+	Ctx         context.Context
+	UserID      uint64
+	ModelUID    string
+	AdapterName string
+	Req         RegisterAdapterRequest
+}
+
+type AdapterOutput struct {
+	ModelID   uint64
+	TargonUID string
+	Adapters  []Adapter
+	Message   string
+}
+
+// RegisterAdapterLogic loads a LoRA adapter onto a deployed base model and
+// registers the adapter name so requests using it as the model are routed to
+// the base model's backend. Names already served, by a model or an active
+// adapter, or held by another model's adapter are a conflict. Only a
+// deactivated adapter of the same model can be registered again
+func (t *TargonHandler) RegisterAdapterLogic(input AdapterInput) (*AdapterOutput, error) {
+	if input.Req.Name == "" || input.Req.Path == "" {
+		return nil, errors.Join(errors.New("name and path are required"), shared.ErrBadRequest)
+	}
+
+	modelID, modelURL, err := t.getAdapterBaseModel(input.Ctx, input.ModelUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.checkAdapterName(input.Ctx, modelID, input.Req.Name); err != nil {
+		return nil, err
+	}
+
+	err = t.sendAdapterRequest(input.Ctx, modelURL+"/v1/load_lora_adapter", map[string]string{
+		"lora_name": input.Req.Name,
+		"lora_path": input.Req.Path,
+	})
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to load adapter on backend"), err, shared.ErrInternalServerError)
+	}
+
+	var allowedUserID *uint64
+	if input.Req.AllowedUserID > 0 {
+		allowedUserID = &input.Req.AllowedUserID
+	}
+
+	var icpt, ocpt, crc *uint64
+	if input.Req.Pricing != nil {
+		icpt = &input.Req.Pricing.ICPT
+		ocpt = &input.Req.Pricing.OCPT
+		crc = &input.Req.Pricing.CRC
+	}
+
+	err = database.ExecuteTransaction(input.Ctx, t.WDB, []func(*sql.Tx) error{
+		func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(input.Ctx, `
+				INSERT INTO lora_adapter (model_id, name, path, allowed_user_id, icpt, ocpt, crc, active)
+				VALUES (?, ?, ?, ?, ?, ?, ?, true)
+				ON DUPLICATE KEY UPDATE path = VALUES(path), allowed_user_id = VALUES(allowed_user_id),
+					icpt = VALUES(icpt), ocpt = VALUES(ocpt), crc = VALUES(crc), active = true
+			`, modelID, input.Req.Name, input.Req.Path, allowedUserID, icpt, ocpt, crc)
+			return err
+		},
+		func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(input.Ctx, `
+				INSERT INTO model_registry (model_id, model_name, url)
+				VALUES (?, ?, ?)
+				ON DUPLICATE KEY UPDATE url = VALUES(url)
+			`, modelID, input.Req.Name, modelURL)
+			return err
+		},
+	})
+	if err != nil {
+		// Backend already has the adapter loaded, unload it so we dont serve an
+		// unbilled adapter
+		if unloadErr := t.sendAdapterRequest(context.Background(), modelURL+"/v1/unload_lora_adapter", map[string]string{
+			"lora_name": input.Req.Name,
+		}); unloadErr != nil {
+			err = errors.Join(unloadErr, err)
+		}
+		return nil, errors.Join(errors.New("failed to register adapter"), err, shared.ErrInternalServerError)
+	}
+
+	go t.clearModelServiceCache(input.Req.Name)
+
+	return &AdapterOutput{
+		ModelID:   modelID,
+		TargonUID: input.ModelUID,
+		Adapters: []Adapter{{
+			Name:    input.Req.Name,
+			Path:    input.Req.Path,
+			Active:  true,
+			Pricing: input.Req.Pricing,
+		}},
+		Message: "Adapter registered successfully",
+	}, nil
+}
+
+// checkAdapterName reads the primary, a name registered moments ago may not
+// be on the replica yet
+func (t *TargonHandler) checkAdapterName(ctx context.Context, modelID uint64, name string) error {
+	var conflictID uint64
+	err := t.WDB.QueryRowContext(ctx, "SELECT model_id FROM model_registry WHERE model_name = ? LIMIT 1", name).Scan(&conflictID)
+	switch {
+	case err == nil:
+		return errors.Join(fmt.Errorf("name %s is already registered to model %d", name, conflictID), shared.ErrConflict)
+	case err != sql.ErrNoRows:
+		return errors.Join(errors.New("failed to check model registry"), err, shared.ErrInternalServerError)
+	}
+
+	err = t.WDB.QueryRowContext(ctx, "SELECT model_id FROM lora_adapter WHERE name = ? AND model_id != ? LIMIT 1", name, modelID).Scan(&conflictID)
+	switch {
+	case err == nil:
+		return errors.Join(fmt.Errorf("adapter name %s is already used by model %d", name, conflictID), shared.ErrConflict)
+	case err != sql.ErrNoRows:
+		return errors.Join(errors.New("failed to check adapters"), err, shared.ErrInternalServerError)
+	}
+	return nil
+}
+
+// ListAdaptersLogic lists all active adapters for a base model
+func (t *TargonHandler) ListAdaptersLogic(input AdapterInput) (*AdapterOutput, error) {
+	log := shared.LoggerFromContext(input.Ctx, t.Log)
+	var modelID uint64
+	err := t.RDB.QueryRowContext(input.Ctx, "SELECT id FROM model WHERE targon_uid = ?", input.ModelUID).Scan(&modelID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find model"), err, shared.ErrNotFound)
+	}
+
+	rows, err := t.RDB.QueryContext(input.Ctx, `
+		SELECT name, path, icpt, ocpt, crc
+		FROM lora_adapter
+		WHERE model_id = ? AND active = true
+		ORDER BY name ASC
+	`, modelID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query adapters"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	adapters := []Adapter{}
+	for rows.Next() {
+		var adapter Adapter
+		var icpt, ocpt, crc sql.NullInt64
+		if err := rows.Scan(&adapter.Name, &adapter.Path, &icpt, &ocpt, &crc); err != nil {
+			log.Warnw("Failed to scan adapter row", "error", err, "model_id", modelID)
+			continue
+		}
+		adapter.Active = true
+		if icpt.Valid && ocpt.Valid && crc.Valid {
+			adapter.Pricing = &Pricing{ICPT: uint64(icpt.Int64), OCPT: uint64(ocpt.Int64), CRC: uint64(crc.Int64)}
+		}
+		adapters = append(adapters, adapter)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating adapter rows"), err, shared.ErrInternalServerError)
+	}
+
+	return &AdapterOutput{
+		ModelID:   modelID,
+		TargonUID: input.ModelUID,
+		Adapters:  adapters,
+	}, nil
+}
+
+// DeactivateAdapterLogic unloads an adapter from the backend and removes its
+// routing entry. The adapter row is kept for auditing
+func (t *TargonHandler) DeactivateAdapterLogic(input AdapterInput) (*AdapterOutput, error) {
+	log := shared.LoggerFromContext(input.Ctx, t.Log)
+	modelID, modelURL, err := t.getAdapterBaseModel(input.Ctx, input.ModelUID)
+	if err != nil {
+		return nil, err
+	}
+
+	var adapterPath string
+	err = t.RDB.QueryRowContext(input.Ctx,
+		"SELECT path FROM lora_adapter WHERE model_id = ? AND name = ? AND active = true",
+		modelID, input.AdapterName).Scan(&adapterPath)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find adapter"), err, shared.ErrNotFound)
+	}
+
+	err = t.sendAdapterRequest(input.Ctx, modelURL+"/v1/unload_lora_adapter", map[string]string{
+		"lora_name": input.AdapterName,
+	})
+	if err != nil {
+		log.Warnw("Failed to unload adapter from backend, continuing with local cleanup",
+			"error", err,
+			"adapter", input.AdapterName,
+			"targon_uid", input.ModelUID)
+	}
+
+	err = database.ExecuteTransaction(input.Ctx, t.WDB, []func(*sql.Tx) error{
+		func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(input.Ctx,
+				"UPDATE lora_adapter SET active = false WHERE model_id = ? AND name = ?", modelID, input.AdapterName)
+			return err
+		},
+		func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(input.Ctx,
+				"DELETE FROM model_registry WHERE model_id = ? AND model_name = ?", modelID, input.AdapterName)
+			return err
+		},
+	})
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to deactivate adapter"), err, shared.ErrInternalServerError)
+	}
+
+	go t.clearModelServiceCache(input.AdapterName)
+
+	return &AdapterOutput{
+		ModelID:   modelID,
+		TargonUID: input.ModelUID,
+		Adapters:  []Adapter{{Name: input.AdapterName, Path: adapterPath, Active: false}},
+		Message:   "Adapter deactivated successfully",
+	}, nil
+}
+
+// GetTargonUIDForModelName resolves the deployment backing a served model name
+func (t *TargonHandler) GetTargonUIDForModelName(ctx context.Context, modelName string) (string, error) {
+	var targonUID string
+	err := t.RDB.QueryRowContext(ctx, `
+		SELECT model.targon_uid
+		FROM model_registry
+		INNER JOIN model ON model_registry.model_id = model.id
+		WHERE model_registry.model_name = ? AND model.enabled = true
+		LIMIT 1
+	`, modelName).Scan(&targonUID)
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("failed to find deployment for model %s", modelName), err, shared.ErrNotFound)
+	}
+	return targonUID, nil
+}
+
+// getAdapterBaseModel returns the model id and serving url for a ready model
+func (t *TargonHandler) getAdapterBaseModel(ctx context.Context, targonUID string) (uint64, string, error) {
+	var modelID uint64
+	var modelURL string
+	err := t.RDB.QueryRowContext(ctx, `
+		SELECT model.id, model_registry.url
+		FROM model
+		INNER JOIN model_registry ON model_registry.model_id = model.id
+		WHERE model.targon_uid = ? AND model.enabled = true
+		LIMIT 1
+	`, targonUID).Scan(&modelID, &modelURL)
+	if err != nil {
+		return 0, "", errors.Join(errors.New("failed to find enabled model"), err, shared.ErrNotFound)
+	}
+	return modelID, modelURL, nil
+}
+
+func (t *TargonHandler) sendAdapterRequest(ctx context.Context, url string, body map[string]string) error {
+	reqJSON, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, shared.TargonCleanupTimeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqJSON))
+	if err != nil {
+		return errors.Join(errors.New("failed to create http request"), err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, err := t.HTTPClient.Do(httpReq)
+	if err != nil {
+		return errors.Join(errors.New("failed to send http request"), err)
+	}
+	defer func() {
+		if closeErr := res.Body.Close(); closeErr != nil {
+			t.Log.Warnw("Failed to close response body", "error", closeErr)
+		}
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		resBody, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("backend returned error: [%d: %s]", res.StatusCode, string(resBody))
+	}
+	return nil
+}
+
+// clearModelServiceCache removes every per-user cached service entry for a
+// model name
+func (t *TargonHandler) clearModelServiceCache(modelName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pattern := fmt.Sprintf("sybil:v1:model:service:*:%s", modelName)
+	iter := t.RedisClient.Scan(ctx, 0, pattern, 100).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		t.Log.Warnw("failed to scan model service cache", "error", err, "model_name", modelName)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err := t.RedisClient.Del(ctx, keys...).Err(); err != nil {
+		t.Log.Warnw("failed to clear model service cache", "error", err, "model_name", modelName)
+	}
+}
@@ -0,0 +1,195 @@
+package targon
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"sybil-api/internal/database"
+	"sybil-api/internal/shared"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type AliasesRequest struct {
+	Names []string `json:"names"`
+}
+
+// AliasInput contains all data needed for the alias business logic
+type AliasInput struct {
+	Ctx      context.Context
+	UserID   uint64
+	ModelUID string
+	Alias    string
+	Req      AliasesRequest
+}
+
+type AliasOutput struct {
+	ModelID   uint64
+	TargonUID string
+	BaseModel string
+	Aliases   []string
+	Message   string
+}
+
+// AddAliasesLogic exposes an enabled deployment under additional model names.
+// Every name is registered in one transaction, so either all of them route to
+// the deployment or none do
+func (t *TargonHandler) AddAliasesLogic(input AliasInput) (*AliasOutput, error) {
+	names, err := validateAliasNames(input.Req.Names)
+	if err != nil {
+		return nil, err
+	}
+
+	modelID, modelURL, err := t.getAdapterBaseModel(input.Ctx, input.ModelUID)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkModelNameConflicts(input.Ctx, names); err != nil {
+		return nil, err
+	}
+
+	fns := []func(*sql.Tx) error{}
+	for _, name := range names {
+		fns = append(fns, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(input.Ctx,
+				"INSERT INTO model_registry (model_id, model_name, url) VALUES (?, ?, ?)", modelID, name, modelURL)
+			return err
+		})
+	}
+	err = database.ExecuteTransaction(input.Ctx, t.WDB, fns)
+	if err != nil {
+		// Lost a race with another registration of the same name
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return nil, errors.Join(errors.New("model name registered concurrently"), err, shared.ErrConflict)
+		}
+		return nil, errors.Join(errors.New("failed to add aliases"), err, shared.ErrInternalServerError)
+	}
+
+	// Clears cached lookups that resolved the names to nothing before
+	for _, name := range names {
+		go t.clearModelServiceCache(name)
+	}
+
+	output, err := t.listAliases(input.Ctx, modelID)
+	if err != nil {
+		return nil, err
+	}
+	output.TargonUID = input.ModelUID
+	output.Message = "Aliases added successfully"
+	return output, nil
+}
+
+// RemoveAliasLogic stops routing an alias to the deployment. The base model
+// name and adapter names cannot be removed this way
+func (t *TargonHandler) RemoveAliasLogic(input AliasInput) (*AliasOutput, error) {
+	var modelID uint64
+	var baseModel string
+	err := t.RDB.QueryRowContext(input.Ctx, "SELECT id, name FROM model WHERE targon_uid = ?", input.ModelUID).Scan(&modelID, &baseModel)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find model"), err, shared.ErrNotFound)
+	}
+	if input.Alias == baseModel {
+		return nil, errors.Join(errors.New("cannot remove the base model name"), shared.ErrBadRequest)
+	}
+	var adapters int
+	err = t.RDB.QueryRowContext(input.Ctx,
+		"SELECT COUNT(*) FROM lora_adapter WHERE model_id = ? AND name = ? AND active = true", modelID, input.Alias).Scan(&adapters)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query adapters"), err, shared.ErrInternalServerError)
+	}
+	if adapters > 0 {
+		return nil, errors.Join(errors.New("name belongs to an adapter, deactivate the adapter instead"), shared.ErrBadRequest)
+	}
+
+	res, err := t.WDB.ExecContext(input.Ctx,
+		"DELETE FROM model_registry WHERE model_id = ? AND model_name = ?", modelID, input.Alias)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to remove alias"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil, errors.Join(fmt.Errorf("alias %s not found", input.Alias), shared.ErrNotFound)
+	}
+
+	go t.clearModelServiceCache(input.Alias)
+
+	output, err := t.listAliases(input.Ctx, modelID)
+	if err != nil {
+		return nil, err
+	}
+	output.TargonUID = input.ModelUID
+	output.Message = "Alias removed successfully"
+	return output, nil
+}
+
+// ListAliasesLogic returns the names a deployment is served under, other than
+// its base model name and adapters
+func (t *TargonHandler) ListAliasesLogic(input AliasInput) (*AliasOutput, error) {
+	var modelID uint64
+	err := t.RDB.QueryRowContext(input.Ctx, "SELECT id FROM model WHERE targon_uid = ?", input.ModelUID).Scan(&modelID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find model"), err, shared.ErrNotFound)
+	}
+	output, err := t.listAliases(input.Ctx, modelID)
+	if err != nil {
+		return nil, err
+	}
+	output.TargonUID = input.ModelUID
+	return output, nil
+}
+
+func (t *TargonHandler) listAliases(ctx context.Context, modelID uint64) (*AliasOutput, error) {
+	output := &AliasOutput{ModelID: modelID, Aliases: []string{}}
+	err := t.WDB.QueryRowContext(ctx, "SELECT name FROM model WHERE id = ?", modelID).Scan(&output.BaseModel)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find model"), err, shared.ErrNotFound)
+	}
+
+	rows, err := t.WDB.QueryContext(ctx, `
+		SELECT model_registry.model_name
+		FROM model_registry
+		LEFT JOIN lora_adapter ON lora_adapter.model_id = model_registry.model_id
+			AND lora_adapter.name = model_registry.model_name
+			AND lora_adapter.active = true
+		WHERE model_registry.model_id = ? AND model_registry.model_name != ? AND lora_adapter.name IS NULL
+		ORDER BY model_registry.model_name ASC
+	`, modelID, output.BaseModel)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query aliases"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Join(errors.New("failed to scan alias"), err, shared.ErrInternalServerError)
+		}
+		output.Aliases = append(output.Aliases, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating alias rows"), err, shared.ErrInternalServerError)
+	}
+	return output, nil
+}
+
+func validateAliasNames(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, errors.Join(errors.New("names cannot be empty"), shared.ErrBadRequest)
+	}
+	deduped := []string{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, errors.Join(errors.New("names cannot be blank"), shared.ErrBadRequest)
+		}
+		if !slices.Contains(deduped, name) {
+			deduped = append(deduped, name)
+		}
+	}
+	return deduped, nil
+}
@@ -8,10 +8,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"sybil-api/internal/shared"
+	"sybil-api/internal/tokenizer"
+	"sybil-api/internal/tracing"
 
 	"github.com/aidarkhanov/nanoid"
 )
@@ -102,12 +105,24 @@ type TargonInferenceScalingConfig struct {
 }
 
 type ModelMetadata struct {
-	Name                        string   `json:"name"`
-	Quantization                string   `json:"quantization,omitempty"`
-	ContextLength               int      `json:"context_length,omitempty"`
-	MaxOutputLength             int      `json:"max_output_length,omitempty"`
-	SupportedSamplingParameters []string `json:"supported_sampling_parameters,omitempty"`
-	SupportedFeatures           []string `json:"supported_features,omitempty"`
+	Name                        string            `json:"name"`
+	Quantization                string            `json:"quantization,omitempty"`
+	ContextLength               int               `json:"context_length,omitempty"`
+	MaxOutputLength             int               `json:"max_output_length,omitempty"`
+	SupportedSamplingParameters []string          `json:"supported_sampling_parameters,omitempty"`
+	SupportedFeatures           []string          `json:"supported_features,omitempty"`
+	ResponseCacheTTL            int64             `json:"response_cache_ttl,omitempty"`
+	ReviewSampleRate            float64           `json:"review_sample_rate,omitempty"`
+	DefaultParams               *SamplingDefaults `json:"default_params,omitempty"`
+	// Hugging Face repo or https url of the tokenizer.json, see tokenizer.SourceURL
+	Tokenizer string `json:"tokenizer,omitempty"`
+}
+
+// SamplingDefaults are applied to requests that do not set them
+type SamplingDefaults struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
 }
 
 type TargonServiceResponse struct {
@@ -124,6 +139,8 @@ type TargonServiceStatusResponse struct {
 	Status  *struct {
 		URL   string `json:"url"`
 		Ready bool   `json:"ready"`
+		// Replicas currently serving, zero when scaled to zero
+		Replicas *int32 `json:"replicas,omitempty"`
 	} `json:"status"`
 }
 
@@ -143,10 +160,17 @@ type CreateModelOutput struct {
 }
 
 func (t *TargonHandler) CreateModelLogic(input CreateModelInput) (*CreateModelOutput, error) {
+	log := shared.LoggerFromContext(input.Ctx, t.Log)
 	if err := validateCreateModelRequest(input.Req); err != nil {
 		return nil, errors.Join(errors.New("failed validating request"), err, shared.ErrBadRequest)
 	}
 
+	// Names are checked before the service is created so a conflict never
+	// leaves an orphaned targon service behind
+	if err := t.checkModelNameConflicts(input.Ctx, append([]string{input.Req.BaseModel}, input.Req.SupportedModelNames...)); err != nil {
+		return nil, err
+	}
+
 	targonReq, err := buildTargonRequest(input.Req)
 	if err != nil {
 		return nil, errors.Join(errors.New("failed to build targon request"), err, shared.ErrInternalServerError)
@@ -157,7 +181,8 @@ func (t *TargonHandler) CreateModelLogic(input CreateModelInput) (*CreateModelOu
 	}
 
 	url := fmt.Sprintf("%s/v1/inference", t.TargonEndpoint)
-	httpReq, err := http.NewRequest("POST", url, bytes.NewBuffer(targonReqJSON))
+	// Finishes even when the admin disconnects, only the trace is kept
+	httpReq, err := http.NewRequestWithContext(tracing.Detach(input.Ctx), "POST", url, bytes.NewBuffer(targonReqJSON))
 	if err != nil {
 		return nil, errors.Join(errors.New("failed to create http request"), err, shared.ErrInternalServerError)
 	}
@@ -170,7 +195,7 @@ func (t *TargonHandler) CreateModelLogic(input CreateModelInput) (*CreateModelOu
 	}
 	defer func() {
 		if closeErr := res.Body.Close(); closeErr != nil {
-			t.Log.Warnw("Failed to close response body", "error", closeErr)
+			log.Warnw("Failed to close response body", "error", closeErr)
 		}
 	}()
 
@@ -258,6 +283,58 @@ func (t *TargonHandler) CreateModelLogic(input CreateModelInput) (*CreateModelOu
 	}, nil
 }
 
+// ModelNameConflictError lists requested model names that are already taken by
+// another model or adapter
+type ModelNameConflictError struct {
+	Names []string
+}
+
+func (e *ModelNameConflictError) Error() string {
+	return fmt.Sprintf("model names already exist: %s", strings.Join(e.Names, ", "))
+}
+
+// checkModelNameConflicts returns a ModelNameConflictError joined with
+// shared.ErrConflict if any of names is already registered, since registering
+// it again would silently repoint the existing name at the new model
+func (t *TargonHandler) checkModelNameConflicts(ctx context.Context, names []string) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(names)), ",")
+	args := make([]any, 0, len(names)*2)
+	for _, name := range names {
+		args = append(args, name)
+	}
+	for _, name := range names {
+		args = append(args, name)
+	}
+	rows, err := t.WDB.QueryContext(ctx, `
+		SELECT model_name FROM model_registry WHERE model_name IN (`+placeholders+`)
+		UNION
+		SELECT name FROM model WHERE name IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return errors.Join(errors.New("failed to check model names"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	conflicts := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return errors.Join(errors.New("failed to scan model name"), err, shared.ErrInternalServerError)
+		}
+		conflicts = append(conflicts, name)
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Join(errors.New("failed iterating model names"), err, shared.ErrInternalServerError)
+	}
+	if len(conflicts) > 0 {
+		slices.Sort(conflicts)
+		return errors.Join(&ModelNameConflictError{Names: conflicts}, shared.ErrConflict)
+	}
+	return nil
+}
+
 func validateCreateModelRequest(req CreateModelRequest) error {
 	if req.BaseModel == "" {
 		return errors.New("name is required")
@@ -311,6 +388,21 @@ func validateCreateModelRequest(req CreateModelRequest) error {
 
 	// Validate metadata
 	if req.Metadata != nil {
+		if req.Metadata.ResponseCacheTTL < 0 {
+			return errors.New("response_cache_ttl cannot be negative")
+		}
+		if req.Metadata.ReviewSampleRate < 0 || req.Metadata.ReviewSampleRate > shared.MaxReviewSampleRate {
+			return fmt.Errorf("review_sample_rate must be between 0 and %.2f", shared.MaxReviewSampleRate)
+		}
+		if req.Metadata.Tokenizer != "" {
+			if _, err := tokenizer.SourceURL(req.Metadata.Tokenizer); err != nil {
+				return err
+			}
+		}
+		if err := validateSamplingDefaults(req.Metadata.DefaultParams, req.Metadata.MaxOutputLength); err != nil {
+			return err
+		}
+
 		validSamplingParams := map[string]bool{
 			"temperature":        true,
 			"top_p":              true,
@@ -347,6 +439,27 @@ func validateCreateModelRequest(req CreateModelRequest) error {
 	return nil
 }
 
+// validateSamplingDefaults checks default params against the ranges requests
+// are held to. A nil defaults is valid
+func validateSamplingDefaults(defaults *SamplingDefaults, maxOutputLength int) error {
+	if defaults == nil {
+		return nil
+	}
+	if defaults.Temperature != nil && (*defaults.Temperature < 0 || *defaults.Temperature > 2) {
+		return errors.New("default temperature must be between 0 and 2")
+	}
+	if defaults.TopP != nil && (*defaults.TopP <= 0 || *defaults.TopP > 1) {
+		return errors.New("default top_p must be between 0 and 1")
+	}
+	if defaults.MaxTokens != nil && *defaults.MaxTokens <= 0 {
+		return errors.New("default max_tokens must be positive")
+	}
+	if defaults.MaxTokens != nil && maxOutputLength > 0 && *defaults.MaxTokens > maxOutputLength {
+		return errors.New("default max_tokens cannot exceed max_output_length")
+	}
+	return nil
+}
+
 func buildTargonRequest(req CreateModelRequest) (TargonCreateRequest, error) {
 	// Build image
 	version := req.FrameworkVersion
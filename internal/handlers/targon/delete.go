@@ -26,6 +26,7 @@ type DeleteModelOutput struct {
 }
 
 func (t *TargonHandler) DeleteModelLogic(input DeleteModelInput) (*DeleteModelOutput, error) {
+	log := shared.LoggerFromContext(input.Ctx, t.Log)
 	checkQuery := `SELECT id FROM model WHERE targon_uid = ?`
 	var modelID uint64
 	err := t.RDB.QueryRowContext(input.Ctx, checkQuery, input.ModelUID).Scan(&modelID)
@@ -37,7 +38,7 @@ func (t *TargonHandler) DeleteModelLogic(input DeleteModelInput) (*DeleteModelOu
 	rows, err := t.RDB.Query("SELECT model_name FROM model_registry WHERE model_id = ?", modelID)
 	if err != nil {
 		// can safely fail, only used for clearing redis cache
-		t.Log.Warnw("failed to get model names", "error", err, "model_id", modelID)
+		log.Warnw("failed to get model names", "error", err, "model_id", modelID)
 	}
 
 	var modelNames []string
@@ -54,7 +55,7 @@ func (t *TargonHandler) DeleteModelLogic(input DeleteModelInput) (*DeleteModelOu
 	// delete from targon
 	err = t.cleanupTargonService(input.ModelUID)
 	if err != nil {
-		t.Log.Warnw("Failed to delete from Targon, continuing with local cleanup",
+		log.Warnw("Failed to delete from Targon, continuing with local cleanup",
 			"error", err,
 			"targon_uid", input.ModelUID)
 	}
@@ -82,7 +83,7 @@ func (t *TargonHandler) DeleteModelLogic(input DeleteModelInput) (*DeleteModelOu
 
 		if len(cacheKeys) > 0 {
 			if err := t.RedisClient.Del(ctx, cacheKeys...).Err(); err != nil {
-				t.Log.Warnw("failed to clear cache for deleted model", "error", err, "model_id", mid)
+				log.Warnw("failed to clear cache for deleted model", "error", err, "model_id", mid)
 			}
 		}
 	}(modelNames, modelID)
@@ -0,0 +1,400 @@
+package targon
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"sybil-api/internal/shared"
+)
+
+type EvalCase struct {
+	Messages []shared.ChatMessage `json:"messages"`
+	Expect   EvalExpectation      `json:"expect"`
+}
+
+// EvalExpectation lists properties the model response must satisfy. All set
+// properties must hold for the case to pass
+type EvalExpectation struct {
+	Contains     []string `json:"contains,omitempty"`
+	NotContains  []string `json:"not_contains,omitempty"`
+	Regex        string   `json:"regex,omitempty"`
+	ValidJSON    bool     `json:"valid_json,omitempty"`
+	MaxLatencyMS int64    `json:"max_latency_ms,omitempty"`
+}
+
+type EvalSetRequest struct {
+	Name  string     `json:"name"`
+	Cases []EvalCase `json:"cases"`
+}
+
+type EvalThresholds struct {
+	MinPassRate     float64 `json:"min_pass_rate"`
+	MaxP95LatencyMS int64   `json:"max_p95_latency_ms,omitempty"`
+}
+
+type EvaluateRequest struct {
+	EvalSet    string         `json:"eval_set"`
+	Model      string         `json:"model,omitempty"`
+	MaxTokens  int            `json:"max_tokens,omitempty"`
+	Thresholds EvalThresholds `json:"thresholds"`
+}
+
+type EvalCaseResult struct {
+	Index     int      `json:"index"`
+	Passed    bool     `json:"passed"`
+	LatencyMS int64    `json:"latency_ms"`
+	Failures  []string `json:"failures,omitempty"`
+}
+
+type EvalMetrics struct {
+	Cases            int     `json:"cases"`
+	Passed           int     `json:"passed"`
+	PassRate         float64 `json:"pass_rate"`
+	AvgLatencyMS     int64   `json:"avg_latency_ms"`
+	P50LatencyMS     int64   `json:"p50_latency_ms"`
+	P95LatencyMS     int64   `json:"p95_latency_ms"`
+	CompletionTokens uint64  `json:"completion_tokens"`
+	TokensPerSecond  float64 `json:"tokens_per_second"`
+}
+
+// EvalSetInput contains all data needed for storing an eval set
+type EvalSetInput struct {
+	Ctx    context.Context
+	UserID uint64
+	Req    EvalSetRequest
+}
+
+// EvaluateInput contains all data needed for Evaluate business logic
+type EvaluateInput struct {
+	Ctx      context.Context
+	UserID   uint64
+	ModelUID string
+	Req      EvaluateRequest
+}
+
+type EvaluateOutput struct {
+	ModelID        uint64           `json:"model_id"`
+	TargonUID      string           `json:"targon_uid"`
+	ConfigRevision string           `json:"config_revision"`
+	EvalSet        string           `json:"eval_set"`
+	Metrics        EvalMetrics      `json:"metrics"`
+	Thresholds     EvalThresholds   `json:"thresholds"`
+	Passed         bool             `json:"passed"`
+	Results        []EvalCaseResult `json:"results"`
+}
+
+// SaveEvalSetLogic creates or replaces a named eval set
+func (t *TargonHandler) SaveEvalSetLogic(input EvalSetInput) error {
+	if input.Req.Name == "" {
+		return errors.Join(errors.New("name is required"), shared.ErrBadRequest)
+	}
+	if len(input.Req.Cases) == 0 || len(input.Req.Cases) > shared.EvalMaxCases {
+		return errors.Join(fmt.Errorf("eval sets must have between 1 and %d cases", shared.EvalMaxCases), shared.ErrBadRequest)
+	}
+	for i, c := range input.Req.Cases {
+		if len(c.Messages) == 0 {
+			return errors.Join(fmt.Errorf("case %d has no messages", i), shared.ErrBadRequest)
+		}
+		if c.Expect.Regex != "" {
+			if _, err := regexp.Compile(c.Expect.Regex); err != nil {
+				return errors.Join(fmt.Errorf("case %d has invalid regex", i), err, shared.ErrBadRequest)
+			}
+		}
+	}
+
+	casesJSON, err := json.Marshal(input.Req.Cases)
+	if err != nil {
+		return errors.Join(errors.New("failed to marshal cases"), err, shared.ErrInternalServerError)
+	}
+	_, err = t.WDB.ExecContext(input.Ctx, `
+		INSERT INTO eval_set (name, cases, created_by)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE cases = VALUES(cases), created_by = VALUES(created_by)
+	`, input.Req.Name, string(casesJSON), input.UserID)
+	if err != nil {
+		return errors.Join(errors.New("failed to save eval set"), err, shared.ErrInternalServerError)
+	}
+	return nil
+}
+
+// EvaluateLogic runs a stored eval set against a model and records the result
+// against the models current config revision. Updates that move a model to a
+// new revision need the latest result for that revision to have passed, so a
+// new container is evaluated on a canary model before it is promoted
+func (t *TargonHandler) EvaluateLogic(input EvaluateInput) (*EvaluateOutput, error) {
+	if input.Req.EvalSet == "" {
+		return nil, errors.Join(errors.New("eval_set is required"), shared.ErrBadRequest)
+	}
+	if input.Req.Thresholds.MinPassRate < 0 || input.Req.Thresholds.MinPassRate > 1 {
+		return nil, errors.Join(errors.New("min_pass_rate must be between 0 and 1"), shared.ErrBadRequest)
+	}
+
+	var modelID uint64
+	var baseModel, configJSON string
+	err := t.RDB.QueryRowContext(input.Ctx, "SELECT id, name, config FROM model WHERE targon_uid = ?", input.ModelUID).Scan(&modelID, &baseModel, &configJSON)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find model"), err, shared.ErrNotFound)
+	}
+	var config TargonCreateRequest
+	if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+		return nil, errors.Join(errors.New("failed to parse model config"), err, shared.ErrInternalServerError)
+	}
+	revision, err := configRevision(config)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to compute config revision"), err, shared.ErrInternalServerError)
+	}
+
+	var modelURL string
+	err = t.RDB.QueryRowContext(input.Ctx, "SELECT url FROM model_registry WHERE model_id = ? LIMIT 1", modelID).Scan(&modelURL)
+	if err != nil {
+		return nil, errors.Join(errors.New("model is not serving"), err, shared.ErrBadRequest)
+	}
+
+	var evalSetID uint64
+	var casesJSON string
+	err = t.RDB.QueryRowContext(input.Ctx, "SELECT id, cases FROM eval_set WHERE name = ?", input.Req.EvalSet).Scan(&evalSetID, &casesJSON)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find eval set"), err, shared.ErrNotFound)
+	}
+	var cases []EvalCase
+	if err := json.Unmarshal([]byte(casesJSON), &cases); err != nil {
+		return nil, errors.Join(errors.New("failed to parse eval set"), err, shared.ErrInternalServerError)
+	}
+
+	modelName := input.Req.Model
+	if modelName == "" {
+		modelName = baseModel
+	}
+	maxTokens := input.Req.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = shared.DefaultMaxTokens
+	}
+
+	results := make([]EvalCaseResult, len(cases))
+	completionTokens := make([]uint64, len(cases))
+	sem := make(chan struct{}, shared.EvalConcurrency)
+	wg := sync.WaitGroup{}
+	for i, c := range cases {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i], completionTokens[i] = t.runEvalCase(input.Ctx, modelURL, modelName, maxTokens, i, c)
+		}()
+	}
+	wg.Wait()
+
+	metrics := summarizeEval(results, completionTokens)
+	passed := metrics.PassRate >= input.Req.Thresholds.MinPassRate
+	if input.Req.Thresholds.MaxP95LatencyMS > 0 && metrics.P95LatencyMS > input.Req.Thresholds.MaxP95LatencyMS {
+		passed = false
+	}
+
+	metricsJSON, err := json.Marshal(metrics)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal eval metrics"), err, shared.ErrInternalServerError)
+	}
+	thresholdsJSON, err := json.Marshal(input.Req.Thresholds)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to marshal eval thresholds"), err, shared.ErrInternalServerError)
+	}
+	_, err = t.WDB.ExecContext(input.Ctx, `
+		INSERT INTO eval_result (model_id, eval_set_id, config_revision, metrics, thresholds, passed, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, modelID, evalSetID, revision, string(metricsJSON), string(thresholdsJSON), passed, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to save eval result"), err, shared.ErrInternalServerError)
+	}
+
+	t.Log.Infow("Model evaluation finished",
+		"model_id", modelID,
+		"targon_uid", input.ModelUID,
+		"config_revision", revision,
+		"eval_set", input.Req.EvalSet,
+		"pass_rate", metrics.PassRate,
+		"passed", passed)
+
+	return &EvaluateOutput{
+		ModelID:        modelID,
+		TargonUID:      input.ModelUID,
+		ConfigRevision: revision,
+		EvalSet:        input.Req.EvalSet,
+		Metrics:        metrics,
+		Thresholds:     input.Req.Thresholds,
+		Passed:         passed,
+		Results:        results,
+	}, nil
+}
+
+// configRevision identifies what a model serves, the container it runs.
+// Replica and scaling changes keep the revision so they never need an eval
+func configRevision(config TargonCreateRequest) (string, error) {
+	containerJSON, err := json.Marshal(config.Predictor.Container)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(containerJSON)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// requirePassingEval rejects moving a model from current to next when next is
+// a new revision whose latest eval, on any model, did not pass
+func (t *TargonHandler) requirePassingEval(ctx context.Context, current, next TargonCreateRequest) error {
+	currentRevision, err := configRevision(current)
+	if err != nil {
+		return errors.Join(errors.New("failed to compute config revision"), err, shared.ErrInternalServerError)
+	}
+	nextRevision, err := configRevision(next)
+	if err != nil {
+		return errors.Join(errors.New("failed to compute config revision"), err, shared.ErrInternalServerError)
+	}
+	if nextRevision == currentRevision {
+		return nil
+	}
+
+	var passed bool
+	err = t.WDB.QueryRowContext(ctx, `
+		SELECT passed FROM eval_result WHERE config_revision = ? ORDER BY id DESC LIMIT 1
+	`, nextRevision).Scan(&passed)
+	if err == sql.ErrNoRows {
+		return errors.Join(fmt.Errorf("config revision %s has not been evaluated", nextRevision), shared.ErrConflict)
+	}
+	if err != nil {
+		return errors.Join(errors.New("failed to query eval results"), err, shared.ErrInternalServerError)
+	}
+	if !passed {
+		return errors.Join(fmt.Errorf("latest eval of config revision %s failed", nextRevision), shared.ErrConflict)
+	}
+	return nil
+}
+
+func (t *TargonHandler) runEvalCase(ctx context.Context, modelURL, modelName string, maxTokens int, index int, c EvalCase) (EvalCaseResult, uint64) {
+	result := EvalCaseResult{Index: index}
+
+	body, err := json.Marshal(map[string]any{
+		"model":       modelName,
+		"messages":    c.Messages,
+		"max_tokens":  maxTokens,
+		"temperature": 0,
+		"stream":      false,
+	})
+	if err != nil {
+		result.Failures = append(result.Failures, "failed to marshal request")
+		return result, 0
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, shared.EvalCaseTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", modelURL+shared.ROUTES[shared.ENDPOINTS.CHAT], bytes.NewBuffer(body))
+	if err != nil {
+		result.Failures = append(result.Failures, "failed to create request")
+		return result, 0
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	res, err := t.HTTPClient.Do(httpReq)
+	if err != nil {
+		result.LatencyMS = time.Since(start).Milliseconds()
+		result.Failures = append(result.Failures, fmt.Sprintf("request failed: %s", err))
+		return result, 0
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	resBody, err := io.ReadAll(res.Body)
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil || res.StatusCode != http.StatusOK {
+		result.Failures = append(result.Failures, fmt.Sprintf("model returned status %d", res.StatusCode))
+		return result, 0
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message shared.Message `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			CompletionTokens uint64 `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(resBody, &completion); err != nil || len(completion.Choices) == 0 {
+		result.Failures = append(result.Failures, "invalid completion response")
+		return result, 0
+	}
+
+	result.Failures = checkEvalExpectation(completion.Choices[0].Message.Content, result.LatencyMS, c.Expect)
+	result.Passed = len(result.Failures) == 0
+	return result, completion.Usage.CompletionTokens
+}
+
+func checkEvalExpectation(content string, latencyMS int64, expect EvalExpectation) []string {
+	var failures []string
+	lower := strings.ToLower(content)
+	for _, s := range expect.Contains {
+		if !strings.Contains(lower, strings.ToLower(s)) {
+			failures = append(failures, fmt.Sprintf("missing %q", s))
+		}
+	}
+	for _, s := range expect.NotContains {
+		if strings.Contains(lower, strings.ToLower(s)) {
+			failures = append(failures, fmt.Sprintf("contains %q", s))
+		}
+	}
+	if expect.Regex != "" {
+		re, err := regexp.Compile(expect.Regex)
+		if err != nil || !re.MatchString(content) {
+			failures = append(failures, fmt.Sprintf("does not match %q", expect.Regex))
+		}
+	}
+	if expect.ValidJSON && !json.Valid([]byte(strings.TrimSpace(content))) {
+		failures = append(failures, "invalid json")
+	}
+	if expect.MaxLatencyMS > 0 && latencyMS > expect.MaxLatencyMS {
+		failures = append(failures, fmt.Sprintf("latency %dms over %dms", latencyMS, expect.MaxLatencyMS))
+	}
+	return failures
+}
+
+func summarizeEval(results []EvalCaseResult, completionTokens []uint64) EvalMetrics {
+	metrics := EvalMetrics{Cases: len(results)}
+	if len(results) == 0 {
+		return metrics
+	}
+
+	latencies := make([]int64, len(results))
+	var totalLatency int64
+	for i, r := range results {
+		if r.Passed {
+			metrics.Passed++
+		}
+		latencies[i] = r.LatencyMS
+		totalLatency += r.LatencyMS
+		metrics.CompletionTokens += completionTokens[i]
+	}
+	slices.Sort(latencies)
+
+	metrics.PassRate = float64(metrics.Passed) / float64(len(results))
+	metrics.AvgLatencyMS = totalLatency / int64(len(results))
+	metrics.P50LatencyMS = latencies[len(latencies)/2]
+	metrics.P95LatencyMS = latencies[min(len(latencies)-1, len(latencies)*95/100)]
+	if totalLatency > 0 {
+		metrics.TokensPerSecond = float64(metrics.CompletionTokens) / (float64(totalLatency) / 1000)
+	}
+	return metrics
+}
@@ -0,0 +1,207 @@
+package targon
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"sybil-api/internal/shared"
+)
+
+// SchedulePriceRequest changes the pricing of a model from EffectiveAt, a unix
+// timestamp. Unset takes effect immediately
+type SchedulePriceRequest struct {
+	Pricing
+	EffectiveAt *int64 `json:"effective_at,omitempty"`
+}
+
+type ScheduledPrice struct {
+	ID          uint64 `json:"id"`
+	ICPT        uint64 `json:"icpt"`
+	OCPT        uint64 `json:"ocpt"`
+	CRC         uint64 `json:"crc"`
+	EffectiveAt int64  `json:"effective_at"`
+	CreatedBy   uint64 `json:"created_by"`
+	// The price currently billed, at most one entry is current
+	Current bool `json:"current"`
+}
+
+// PricingInput contains all data needed for the pricing business logic
+type PricingInput struct {
+	Ctx      context.Context
+	UserID   uint64
+	ModelUID string
+	PriceID  uint64
+	Req      SchedulePriceRequest
+}
+
+type PricingOutput struct {
+	ModelID   uint64
+	TargonUID string
+	// Price on the model row, billed until the first scheduled price
+	BasePricing Pricing
+	Schedule    []ScheduledPrice
+	Message     string
+}
+
+// SchedulePriceLogic records a price change for a model. Requests are billed
+// at the price in effect when they are discovered, so a change never alters
+// requests already in flight or billed
+func (t *TargonHandler) SchedulePriceLogic(input PricingInput) (*PricingOutput, error) {
+	now := time.Now()
+	effectiveAt := now.Unix()
+	if input.Req.EffectiveAt != nil {
+		if *input.Req.EffectiveAt < now.Add(-time.Minute).Unix() {
+			return nil, errors.Join(errors.New("effective_at cannot be in the past"), shared.ErrBadRequest)
+		}
+		effectiveAt = max(*input.Req.EffectiveAt, effectiveAt)
+	}
+
+	modelID, err := t.getModelID(input.Ctx, input.ModelUID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.WDB.ExecContext(input.Ctx, `
+		INSERT INTO model_price (model_id, icpt, ocpt, crc, effective_at, created_by)
+		VALUES (?, ?, ?, ?, FROM_UNIXTIME(?), ?)
+	`, modelID, input.Req.ICPT, input.Req.OCPT, input.Req.CRC, effectiveAt, input.UserID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to schedule price"), err, shared.ErrInternalServerError)
+	}
+
+	// Cached services expire when the next price takes effect, entries cached
+	// before this schedule existed do not know about it
+	go t.clearModelServiceCaches(modelID)
+
+	output, err := t.listPrices(input.Ctx, modelID)
+	if err != nil {
+		return nil, err
+	}
+	output.TargonUID = input.ModelUID
+	output.Message = "Price scheduled successfully"
+	return output, nil
+}
+
+// ListPricesLogic returns the base pricing of a model and every scheduled
+// price, oldest first
+func (t *TargonHandler) ListPricesLogic(input PricingInput) (*PricingOutput, error) {
+	modelID, err := t.getModelID(input.Ctx, input.ModelUID)
+	if err != nil {
+		return nil, err
+	}
+	output, err := t.listPrices(input.Ctx, modelID)
+	if err != nil {
+		return nil, err
+	}
+	output.TargonUID = input.ModelUID
+	return output, nil
+}
+
+// CancelPriceLogic cancels a price that has not taken effect yet. Prices
+// already in effect are replaced by scheduling a new one instead, so billing
+// history always matches the schedule
+func (t *TargonHandler) CancelPriceLogic(input PricingInput) (*PricingOutput, error) {
+	modelID, err := t.getModelID(input.Ctx, input.ModelUID)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.WDB.ExecContext(input.Ctx, `
+		UPDATE model_price SET canceled_at = NOW()
+		WHERE id = ? AND model_id = ? AND canceled_at IS NULL AND effective_at > NOW()
+	`, input.PriceID, modelID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to cancel price"), err, shared.ErrInternalServerError)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return nil, errors.Join(errors.New("no pending price with that id"), shared.ErrNotFound)
+	}
+
+	go t.clearModelServiceCaches(modelID)
+
+	output, err := t.listPrices(input.Ctx, modelID)
+	if err != nil {
+		return nil, err
+	}
+	output.TargonUID = input.ModelUID
+	output.Message = "Price canceled successfully"
+	return output, nil
+}
+
+func (t *TargonHandler) listPrices(ctx context.Context, modelID uint64) (*PricingOutput, error) {
+	output := &PricingOutput{ModelID: modelID, Schedule: []ScheduledPrice{}}
+	err := t.WDB.QueryRowContext(ctx, "SELECT icpt, ocpt, crc FROM model WHERE id = ?", modelID).
+		Scan(&output.BasePricing.ICPT, &output.BasePricing.OCPT, &output.BasePricing.CRC)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to find model"), err, shared.ErrNotFound)
+	}
+
+	rows, err := t.WDB.QueryContext(ctx, `
+		SELECT id, icpt, ocpt, crc, UNIX_TIMESTAMP(effective_at), created_by
+		FROM model_price
+		WHERE model_id = ? AND canceled_at IS NULL
+		ORDER BY effective_at ASC, id ASC
+	`, modelID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query prices"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	now := time.Now().Unix()
+	current := -1
+	for rows.Next() {
+		var price ScheduledPrice
+		if err := rows.Scan(&price.ID, &price.ICPT, &price.OCPT, &price.CRC, &price.EffectiveAt, &price.CreatedBy); err != nil {
+			return nil, errors.Join(errors.New("failed to scan price"), err, shared.ErrInternalServerError)
+		}
+		if price.EffectiveAt <= now {
+			current = len(output.Schedule)
+		}
+		output.Schedule = append(output.Schedule, price)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating price rows"), err, shared.ErrInternalServerError)
+	}
+	if current >= 0 {
+		output.Schedule[current].Current = true
+	}
+	return output, nil
+}
+
+func (t *TargonHandler) getModelID(ctx context.Context, targonUID string) (uint64, error) {
+	var modelID uint64
+	err := t.RDB.QueryRowContext(ctx, "SELECT id FROM model WHERE targon_uid = ?", targonUID).Scan(&modelID)
+	if err == sql.ErrNoRows {
+		return 0, errors.Join(errors.New("model not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return 0, errors.Join(errors.New("failed to find model"), err, shared.ErrInternalServerError)
+	}
+	return modelID, nil
+}
+
+// clearModelServiceCaches clears the cached services of every name the model
+// is served under
+func (t *TargonHandler) clearModelServiceCaches(modelID uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := t.WDB.QueryContext(ctx, "SELECT model_name FROM model_registry WHERE model_id = ?", modelID)
+	if err != nil {
+		t.Log.Warnw("failed to query model names for cache clear", "error", err, "model_id", modelID)
+		return
+	}
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil {
+			names = append(names, name)
+		}
+	}
+	_ = rows.Close()
+	for _, name := range names {
+		t.clearModelServiceCache(name)
+	}
+}
@@ -4,11 +4,18 @@ package targon
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	neturl "net/url"
 	"time"
 
+	"sybil-api/internal/signing"
+	"sybil-api/internal/tracing"
+
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
@@ -23,7 +30,9 @@ type TargonHandler struct {
 	HTTPClient     *http.Client
 }
 
-func NewTargonHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, apiKey, url string, log *zap.SugaredLogger) (*TargonHandler, error) {
+// NewTargonHandler creates the handler for the targon control plane at url.
+// When signingSecret is set every request to it is HMAC signed as well
+func NewTargonHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, apiKey, url, signingSecret string, log *zap.SugaredLogger) (*TargonHandler, error) {
 	err := wdb.Ping()
 	if err != nil {
 		return nil, errors.New("failed to ping write db")
@@ -46,7 +55,15 @@ func NewTargonHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, apiKe
 		TLSHandshakeTimeout: 2 * time.Second,
 		DisableKeepAlives:   false,
 	}
-	httpClient := http.Client{Transport: tr, Timeout: 2 * time.Minute}
+	var transport http.RoundTripper = tr
+	if signingSecret != "" {
+		endpoint, err := neturl.Parse(url)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to parse targon endpoint"), err)
+		}
+		transport = &signing.Transport{Base: tr, Secret: signingSecret, Host: endpoint.Host}
+	}
+	httpClient := http.Client{Transport: tracing.Transport(transport), Timeout: 2 * time.Minute}
 
 	return &TargonHandler{
 		Log:            log,
@@ -58,3 +75,35 @@ func NewTargonHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, apiKe
 		HTTPClient:     &httpClient,
 	}, nil
 }
+
+// GetServiceStatus fetches the current status of a targon service
+func (t *TargonHandler) GetServiceStatus(ctx context.Context, targonUID string) (*TargonServiceStatusResponse, error) {
+	url := fmt.Sprintf("%s/v1/inference/%s", t.TargonEndpoint, targonUID)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.TargonAPIKey))
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, err := t.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("targon returned status %d: %s", res.StatusCode, string(body))
+	}
+
+	var status TargonServiceStatusResponse
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
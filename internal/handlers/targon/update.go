@@ -3,6 +3,7 @@ package targon
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"sybil-api/internal/shared"
+	"sybil-api/internal/tracing"
 )
 
 type UpdateModelRequest struct {
@@ -20,6 +22,9 @@ type UpdateModelRequest struct {
 	ResourceName *string          `json:"resource_name,omitempty"`
 	Predictor    *PredictorUpdate `json:"predictor,omitempty"`
 	Scaling      *ScalingConfig   `json:"scaling,omitempty"`
+	// Replaces the models default sampling params, an empty object clears
+	// them. Only stored with the model, Targon is not called for it
+	DefaultParams *SamplingDefaults `json:"default_params,omitempty"`
 }
 
 type PredictorUpdate struct {
@@ -73,6 +78,7 @@ type UpdateModelOutput struct {
 }
 
 func (t *TargonHandler) UpdateModelLogic(input UpdateModelInput) (*UpdateModelOutput, error) {
+	log := shared.LoggerFromContext(input.Ctx, t.Log)
 	if err := validateUpdateModelRequest(input.Req); err != nil {
 		return nil, errors.Join(errors.New("failed to validate request"), err, shared.ErrBadRequest)
 	}
@@ -81,64 +87,81 @@ func (t *TargonHandler) UpdateModelLogic(input UpdateModelInput) (*UpdateModelOu
 	var modelID uint64
 	var currentTargonUID string
 	var currentConfigJSON string
-	checkQuery := `SELECT id, targon_uid, config FROM model WHERE targon_uid = ?`
-	err := t.WDB.QueryRowContext(input.Ctx, checkQuery, input.Req.TargonUID).Scan(&modelID, &currentTargonUID, &currentConfigJSON)
+	var metadataJSON sql.NullString
+	checkQuery := `SELECT id, targon_uid, config, metadata FROM model WHERE targon_uid = ?`
+	err := t.WDB.QueryRowContext(input.Ctx, checkQuery, input.Req.TargonUID).Scan(&modelID, &currentTargonUID, &currentConfigJSON, &metadataJSON)
 	if err != nil {
 		return nil, shared.ErrNotFound
 	}
 
+	var metadata ModelMetadata
+	if metadataJSON.Valid && metadataJSON.String != "" {
+		if err := json.Unmarshal([]byte(metadataJSON.String), &metadata); err != nil {
+			return nil, errors.Join(errors.New("failed to parse current metadata"), err, shared.ErrInternalServerError)
+		}
+	}
+	if input.Req.DefaultParams != nil {
+		if err := validateSamplingDefaults(input.Req.DefaultParams, metadata.MaxOutputLength); err != nil {
+			return nil, errors.Join(errors.New("failed to validate request"), err, shared.ErrBadRequest)
+		}
+	}
+
 	// Parse current config
 	var currentConfig TargonCreateRequest
 	if err := json.Unmarshal([]byte(currentConfigJSON), &currentConfig); err != nil {
 		return nil, errors.Join(errors.New("failed to parse current config"), err, shared.ErrInternalServerError)
 	}
 
-	// Build the Targon update request
-	targonReq := buildTargonUpdateRequest(input.Req)
-	targonReqJSON, err := json.Marshal(targonReq)
-	if err != nil {
-		return nil, errors.Join(errors.New("failed to marshal targon request"), err, shared.ErrInternalServerError)
+	// Merge updates into current config to maintain full configuration
+	mergedConfig := mergeConfigs(currentConfig, input.Req)
+	if err := t.requirePassingEval(input.Ctx, currentConfig, mergedConfig); err != nil {
+		return nil, err
 	}
 
-	// Send update request to Targon
-	url := fmt.Sprintf("%s/v1/inference", t.TargonEndpoint)
-	httpReq, err := http.NewRequest("PATCH", url, bytes.NewBuffer(targonReqJSON))
-	if err != nil {
-		return nil, errors.Join(errors.New("failed creating http request"), err, shared.ErrInternalServerError)
-	}
-	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.TargonAPIKey))
-	httpReq.Header.Set("Content-Type", "application/json")
+	if targonChanged(input.Req) {
+		// Build the Targon update request
+		targonReq := buildTargonUpdateRequest(input.Req)
+		targonReqJSON, err := json.Marshal(targonReq)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to marshal targon request"), err, shared.ErrInternalServerError)
+		}
 
-	res, err := t.HTTPClient.Do(httpReq)
-	if err != nil {
-		return nil, errors.Join(errors.New("failed to do http request"), err, shared.ErrInternalServerError)
-	}
-	defer func() {
+		// Send update request to Targon
+		url := fmt.Sprintf("%s/v1/inference", t.TargonEndpoint)
+		// Finishes even when the admin disconnects, only the trace is kept
+		httpReq, err := http.NewRequestWithContext(tracing.Detach(input.Ctx), "PATCH", url, bytes.NewBuffer(targonReqJSON))
+		if err != nil {
+			return nil, errors.Join(errors.New("failed creating http request"), err, shared.ErrInternalServerError)
+		}
+		httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.TargonAPIKey))
+		httpReq.Header.Set("Content-Type", "application/json")
+
+		res, err := t.HTTPClient.Do(httpReq)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to do http request"), err, shared.ErrInternalServerError)
+		}
+		resBody, err := io.ReadAll(res.Body)
 		if closeErr := res.Body.Close(); closeErr != nil {
-			t.Log.Warnw("failed to close response body", "error", closeErr)
+			log.Warnw("failed to close response body", "error", closeErr)
+		}
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to read response body"), err, shared.ErrInternalServerError)
 		}
-	}()
 
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, errors.Join(errors.New("failed to read response body"), err, shared.ErrInternalServerError)
-	}
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.Join(fmt.Errorf("targon returned error: [%d: %s]", res.StatusCode, string(resBody)), err, shared.ErrInternalServerError)
+		}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.Join(fmt.Errorf("targon returned error: [%d: %s]", res.StatusCode, string(resBody)), err, shared.ErrInternalServerError)
-	}
+		var targonResp map[string]any
+		if err := json.Unmarshal(resBody, &targonResp); err != nil {
+			return nil, errors.Join(errors.New("failed to parse targon response"), err, shared.ErrInternalServerError)
+		}
 
-	var targonResp map[string]any
-	if err := json.Unmarshal(resBody, &targonResp); err != nil {
-		return nil, errors.Join(errors.New("failed to parse targon response"), err, shared.ErrInternalServerError)
+		log.Infow("Targon service updated successfully",
+			"targon_uid", input.Req.TargonUID,
+			"model_id", modelID)
 	}
 
-	t.Log.Infow("Targon service updated successfully",
-		"targon_uid", input.Req.TargonUID,
-		"model_id", modelID)
-
-	// Merge updates into current config to maintain full configuration
-	mergedConfig := mergeConfigs(currentConfig, input.Req)
 	mergedConfigJSON, err := json.Marshal(mergedConfig)
 	if err != nil {
 		return nil, errors.Join(errors.New("failed to marshal merged config"), err, shared.ErrInternalServerError)
@@ -157,6 +180,19 @@ func (t *TargonHandler) UpdateModelLogic(input UpdateModelInput) (*UpdateModelOu
 		args = append(args, *input.Req.Name)
 	}
 
+	if input.Req.DefaultParams != nil {
+		metadata.DefaultParams = input.Req.DefaultParams
+		if *metadata.DefaultParams == (SamplingDefaults{}) {
+			metadata.DefaultParams = nil
+		}
+		updatedMetadataJSON, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to marshal metadata"), err, shared.ErrInternalServerError)
+		}
+		setFields = append(setFields, "metadata = ?")
+		args = append(args, string(updatedMetadataJSON))
+	}
+
 	args = append(args, input.Req.TargonUID)
 
 	updateQuery := fmt.Sprintf(`
@@ -170,6 +206,11 @@ func (t *TargonHandler) UpdateModelLogic(input UpdateModelInput) (*UpdateModelOu
 		return nil, errors.Join(fmt.Errorf("failed to update model database record: [%s:%d]", input.Req.TargonUID, modelID), err, shared.ErrPartialSuccess)
 	}
 
+	// Cached services carry the defaults applied to requests
+	if input.Req.DefaultParams != nil {
+		go t.clearModelServiceCaches(modelID)
+	}
+
 	response := map[string]any{
 		"message":    "Successfully updated model",
 		"targon_uid": input.Req.TargonUID,
@@ -188,6 +229,11 @@ func (t *TargonHandler) UpdateModelLogic(input UpdateModelInput) (*UpdateModelOu
 	}, nil
 }
 
+// targonChanged reports whether the update changes anything Targon serves
+func targonChanged(req UpdateModelRequest) bool {
+	return req.Name != nil || req.ResourceName != nil || req.Predictor != nil || req.Scaling != nil
+}
+
 func validateUpdateModelRequest(req UpdateModelRequest) error {
 	if req.TargonUID == "" {
 		return errors.New("targon_uid is required")
@@ -0,0 +1,224 @@
+// Package transforms manages the payload transforms operators attach to
+// models and api keys, see the transform package for the plugins
+package transforms
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"sybil-api/internal/shared"
+	"sybil-api/internal/transform"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type TransformHandler struct {
+	Log         *zap.SugaredLogger
+	WDB         *sql.DB
+	RDB         *sql.DB
+	RedisClient *redis.Client
+}
+
+func NewTransformHandler(wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger) *TransformHandler {
+	return &TransformHandler{Log: log, WDB: wdb, RDB: rdb, RedisClient: redisClient}
+}
+
+type Transform struct {
+	ID       uint64          `json:"id"`
+	Model    *string         `json:"model"`
+	APIKeyID *string         `json:"api_key_id"`
+	Plugin   string          `json:"plugin"`
+	Config   json.RawMessage `json:"config"`
+	FailOpen bool            `json:"fail_open"`
+	// Transforms run in ascending position, then creation order
+	Position  int    `json:"position"`
+	CreatedBy uint64 `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// CreateTransformRequest attaches a plugin to a model, an api key, or the
+// requests of that key to that model when both are set
+type CreateTransformRequest struct {
+	Model    *string         `json:"model,omitempty"`
+	APIKeyID *string         `json:"api_key_id,omitempty"`
+	Plugin   string          `json:"plugin"`
+	Config   json.RawMessage `json:"config"`
+	FailOpen bool            `json:"fail_open"`
+	Position int             `json:"position"`
+}
+
+// TransformInput contains all data needed for transform business logic
+type TransformInput struct {
+	Ctx         context.Context
+	AdminID     uint64
+	Req         *CreateTransformRequest
+	TransformID uint64
+	// Filters for listing, empty lists every active transform
+	Model    string
+	APIKeyID string
+}
+
+// CreateTransformLogic validates the config by building its plugin and stores
+// the transform. It applies to new requests within shared.TransformCacheTTL
+func (t *TransformHandler) CreateTransformLogic(input TransformInput) (*Transform, error) {
+	req := input.Req
+	if req == nil {
+		return nil, errors.Join(errors.New("request body is required"), shared.ErrBadRequest)
+	}
+	if req.Model != nil {
+		*req.Model = strings.TrimSpace(*req.Model)
+		if *req.Model == "" {
+			req.Model = nil
+		}
+	}
+	if req.Model == nil && req.APIKeyID == nil {
+		return nil, errors.Join(errors.New("model or api_key_id is required"), shared.ErrBadRequest)
+	}
+	if len(req.Config) == 0 {
+		req.Config = json.RawMessage("{}")
+	}
+	if len(req.Config) > shared.TransformConfigMaxBytes {
+		return nil, errors.Join(fmt.Errorf("config cannot exceed %d bytes", shared.TransformConfigMaxBytes), shared.ErrBadRequest)
+	}
+	if _, err := transform.Build(transform.Config{Plugin: req.Plugin, Config: req.Config}); err != nil {
+		return nil, errors.Join(err, shared.ErrBadRequest)
+	}
+	if req.APIKeyID != nil {
+		var exists bool
+		err := t.RDB.QueryRowContext(input.Ctx, "SELECT EXISTS(SELECT 1 FROM api_key WHERE id = ? AND revoked_at IS NULL)", *req.APIKeyID).Scan(&exists)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to query api key"), err, shared.ErrInternalServerError)
+		}
+		if !exists {
+			return nil, errors.Join(errors.New("api key not found"), shared.ErrNotFound)
+		}
+	}
+
+	var count int
+	err := t.WDB.QueryRowContext(input.Ctx, `
+		SELECT COUNT(*) FROM payload_transform
+		WHERE model_name <=> ? AND api_key_id <=> ? AND active = true
+	`, req.Model, req.APIKeyID).Scan(&count)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to count transforms"), err, shared.ErrInternalServerError)
+	}
+	if count >= shared.TransformMaxPerScope {
+		return nil, errors.Join(fmt.Errorf("at most %d transforms can be attached to the same model and key", shared.TransformMaxPerScope), shared.ErrBadRequest)
+	}
+
+	res, err := t.WDB.ExecContext(input.Ctx, `
+		INSERT INTO payload_transform (model_name, api_key_id, plugin, config, fail_open, position, created_by, active)
+		VALUES (?, ?, ?, ?, ?, ?, ?, true)
+	`, req.Model, req.APIKeyID, req.Plugin, string(req.Config), req.FailOpen, req.Position, input.AdminID)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to insert transform"), err, shared.ErrInternalServerError)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to read transform id"), err, shared.ErrInternalServerError)
+	}
+	t.clearTransformCache(input.Ctx)
+	return t.getTransform(input.Ctx, uint64(id))
+}
+
+// ListTransformsLogic returns the active transforms, optionally only those of
+// a model or api key
+func (t *TransformHandler) ListTransformsLogic(input TransformInput) ([]Transform, error) {
+	log := shared.LoggerFromContext(input.Ctx, t.Log)
+	query := `
+		SELECT ` + transformColumns + `
+		FROM payload_transform
+		WHERE active = true`
+	var args []any
+	if input.Model != "" {
+		query += " AND model_name = ?"
+		args = append(args, input.Model)
+	}
+	if input.APIKeyID != "" {
+		query += " AND api_key_id = ?"
+		args = append(args, input.APIKeyID)
+	}
+	query += " ORDER BY position ASC, id ASC"
+
+	rows, err := t.RDB.QueryContext(input.Ctx, query, args...)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query transforms"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	transforms := []Transform{}
+	for rows.Next() {
+		tr, err := scanTransform(rows)
+		if err != nil {
+			log.Warnw("Failed to scan transform row", "error", err)
+			continue
+		}
+		transforms = append(transforms, *tr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating transform rows"), err, shared.ErrInternalServerError)
+	}
+	return transforms, nil
+}
+
+// DeactivateTransformLogic stops a transform from being applied
+func (t *TransformHandler) DeactivateTransformLogic(input TransformInput) error {
+	if _, err := t.getTransform(input.Ctx, input.TransformID); err != nil {
+		return err
+	}
+	_, err := t.WDB.ExecContext(input.Ctx, "UPDATE payload_transform SET active = false WHERE id = ?", input.TransformID)
+	if err != nil {
+		return errors.Join(errors.New("failed to deactivate transform"), err, shared.ErrInternalServerError)
+	}
+	t.clearTransformCache(input.Ctx)
+	return nil
+}
+
+const transformColumns = `id, model_name, api_key_id, plugin, config, fail_open, position, created_by, UNIX_TIMESTAMP(created_at)`
+
+func scanTransform(row interface{ Scan(...any) error }) (*Transform, error) {
+	var tr Transform
+	var config string
+	if err := row.Scan(&tr.ID, &tr.Model, &tr.APIKeyID, &tr.Plugin, &config, &tr.FailOpen, &tr.Position, &tr.CreatedBy, &tr.CreatedAt); err != nil {
+		return nil, err
+	}
+	tr.Config = json.RawMessage(config)
+	return &tr, nil
+}
+
+func (t *TransformHandler) getTransform(ctx context.Context, id uint64) (*Transform, error) {
+	row := t.WDB.QueryRowContext(ctx, `
+		SELECT `+transformColumns+`
+		FROM payload_transform
+		WHERE id = ?
+	`, id)
+	tr, err := scanTransform(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.Join(errors.New("transform not found"), shared.ErrNotFound)
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query transform"), err, shared.ErrInternalServerError)
+	}
+	return tr, nil
+}
+
+// clearTransformCache drops every cached transform lookup. Transforms change
+// rarely and a model transform touches every user, so nothing finer is kept
+func (t *TransformHandler) clearTransformCache(ctx context.Context) {
+	iter := t.RedisClient.Scan(ctx, 0, "sybil:v1:transforms:*", 100).Iterator()
+	for iter.Next(ctx) {
+		if err := t.RedisClient.Del(ctx, iter.Val()).Err(); err != nil {
+			t.Log.Warnw("Failed to clear transform cache", "error", err, "key", iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Log.Warnw("Failed to scan transform cache", "error", err)
+	}
+}
@@ -0,0 +1,185 @@
+package usage
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+
+	"sybil-api/internal/shared"
+)
+
+const (
+	ExportFormatCSV   = "csv"
+	ExportFormatJSONL = "jsonl"
+)
+
+type exportRow struct {
+	RequestID        string  `json:"request_id"`
+	CreatedAt        string  `json:"created_at"`
+	Model            string  `json:"model"`
+	Endpoint         string  `json:"endpoint"`
+	PromptTokens     uint64  `json:"prompt_tokens"`
+	CompletionTokens uint64  `json:"completion_tokens"`
+	Credits          uint64  `json:"credits"`
+	Cost             float64 `json:"cost"`
+	TimeToFirstToken int64   `json:"time_to_first_token_ms"`
+	TotalTime        int64   `json:"total_time_ms"`
+	BYOK             bool    `json:"byok"`
+	// Rates billed at, unset for requests recorded before rates were kept
+	ICPT *uint64 `json:"icpt"`
+	OCPT *uint64 `json:"ocpt"`
+	CRC  *uint64 `json:"crc"`
+	// Off-peak multiplier applied to the rates
+	PriceMultiplier *float64 `json:"price_multiplier"`
+}
+
+var exportHeader = []string{
+	"request_id", "created_at", "model", "endpoint", "prompt_tokens", "completion_tokens",
+	"credits", "cost", "time_to_first_token_ms", "total_time_ms", "byok", "icpt", "ocpt", "crc", "price_multiplier",
+}
+
+func (r exportRow) csvRecord() []string {
+	return []string{
+		r.RequestID,
+		r.CreatedAt,
+		r.Model,
+		r.Endpoint,
+		strconv.FormatUint(r.PromptTokens, 10),
+		strconv.FormatUint(r.CompletionTokens, 10),
+		strconv.FormatUint(r.Credits, 10),
+		strconv.FormatFloat(r.Cost, 'f', -1, 64),
+		strconv.FormatInt(r.TimeToFirstToken, 10),
+		strconv.FormatInt(r.TotalTime, 10),
+		strconv.FormatBool(r.BYOK),
+		formatRate(r.ICPT),
+		formatRate(r.OCPT),
+		formatRate(r.CRC),
+		formatMultiplier(r.PriceMultiplier),
+	}
+}
+
+func formatRate(rate *uint64) string {
+	if rate == nil {
+		return ""
+	}
+	return strconv.FormatUint(*rate, 10)
+}
+
+func formatMultiplier(multiplier *float64) string {
+	if multiplier == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*multiplier, 'f', -1, 64)
+}
+
+// ExportInput contains all data needed for Export business logic
+type ExportInput struct {
+	Ctx       context.Context
+	Scope     UsageScope
+	Format    string
+	StartDate string
+	EndDate   string
+	Writer    io.Writer
+	// Called after every chunk so rows reach the client as they are read
+	Flush func()
+}
+
+// ValidateExport checks the export params and access before any response is
+// written
+func (u *UsageHandler) ValidateExport(input ExportInput) error {
+	if input.Format != ExportFormatCSV && input.Format != ExportFormatJSONL {
+		return errors.Join(errors.New("format must be csv or jsonl"), shared.ErrBadRequest)
+	}
+	if _, _, err := parseDateRange(input.StartDate, input.EndDate); err != nil {
+		return err
+	}
+	return u.authorize(input.Ctx, input.Scope)
+}
+
+// ExportLogic streams the users request history in id order, reading
+// shared.UsageExportChunkSize rows at a time so memory stays flat regardless
+// of export size
+func (u *UsageHandler) ExportLogic(input ExportInput) error {
+	if err := u.ValidateExport(input); err != nil {
+		return err
+	}
+	start, end, _ := parseDateRange(input.StartDate, input.EndDate)
+	filter, filterArgs := input.Scope.filter("request")
+
+	var csvWriter *csv.Writer
+	var jsonEncoder *json.Encoder
+	switch input.Format {
+	case ExportFormatCSV:
+		csvWriter = csv.NewWriter(input.Writer)
+		if err := csvWriter.Write(exportHeader); err != nil {
+			return err
+		}
+	case ExportFormatJSONL:
+		jsonEncoder = json.NewEncoder(input.Writer)
+	}
+
+	var cursor uint64
+	for {
+		if err := input.Ctx.Err(); err != nil {
+			return err
+		}
+		rows, err := u.RDB.QueryContext(input.Ctx, `
+			SELECT request.id, request.request_id, DATE_FORMAT(request.created_at, '%Y-%m-%dT%H:%i:%sZ'), COALESCE(model.name, ''), request.endpoint,
+				request.prompt_tokens, request.completion_tokens, COALESCE(request.credits, 0),
+				request.time_to_first_token, request.total_time, request.byok,
+				request.icpt, request.ocpt, request.crc, request.price_multiplier
+			FROM request
+			LEFT JOIN model ON request.model_id = model.id
+			WHERE `+filter+` AND request.created_at >= ? AND request.created_at < ? AND request.id > ?
+			ORDER BY request.id ASC
+			LIMIT ?
+		`, append(filterArgs, start, end.AddDate(0, 0, 1), cursor, shared.UsageExportChunkSize)...)
+		if err != nil {
+			return errors.Join(errors.New("failed to query requests for export"), err)
+		}
+
+		count := 0
+		for rows.Next() {
+			var row exportRow
+			if err := rows.Scan(&cursor, &row.RequestID, &row.CreatedAt, &row.Model, &row.Endpoint,
+				&row.PromptTokens, &row.CompletionTokens, &row.Credits, &row.TimeToFirstToken, &row.TotalTime, &row.BYOK,
+				&row.ICPT, &row.OCPT, &row.CRC, &row.PriceMultiplier); err != nil {
+				_ = rows.Close()
+				return errors.Join(errors.New("failed to scan export row"), err)
+			}
+			count++
+			row.Cost = float64(row.Credits) * shared.CreditsToUSD
+			switch input.Format {
+			case ExportFormatCSV:
+				err = csvWriter.Write(row.csvRecord())
+			case ExportFormatJSONL:
+				err = jsonEncoder.Encode(row)
+			}
+			if err != nil {
+				_ = rows.Close()
+				return err
+			}
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return errors.Join(errors.New("failed iterating export rows"), err)
+		}
+
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err := csvWriter.Error(); err != nil {
+				return err
+			}
+		}
+		if input.Flush != nil {
+			input.Flush()
+		}
+		if count < shared.UsageExportChunkSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Package usage exposes a users own usage and spend
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+)
+
+type UsageHandler struct {
+	Log *zap.SugaredLogger
+	RDB *sql.DB
+}
+
+func NewUsageHandler(rdb *sql.DB, log *zap.SugaredLogger) *UsageHandler {
+	return &UsageHandler{Log: log, RDB: rdb}
+}
+
+const (
+	GroupByModel    = "model"
+	GroupByEndpoint = "endpoint"
+	GroupByDay      = "day"
+)
+
+type UsageRow struct {
+	Key           string  `json:"key"`
+	Requests      uint64  `json:"requests"`
+	InputTokens   uint64  `json:"input_tokens"`
+	OutputTokens  uint64  `json:"output_tokens"`
+	TotalTokens   uint64  `json:"total_tokens"`
+	Credits       uint64  `json:"credits"`
+	Cost          float64 `json:"cost"`
+	AvgTTFTMillis float64 `json:"avg_ttft_ms"`
+	// Split of Requests and Credits between reserved capacity and on-demand
+	Reserved UsageSplit `json:"reserved"`
+	OnDemand UsageSplit `json:"on_demand"`
+	// Incidents that affected this model or day
+	IncidentIDs []uint64 `json:"incident_ids,omitempty"`
+}
+
+type UsageSplit struct {
+	Requests uint64  `json:"requests"`
+	Credits  uint64  `json:"credits"`
+	Cost     float64 `json:"cost"`
+}
+
+type UsageOutput struct {
+	GroupBy   string     `json:"group_by"`
+	StartDate string     `json:"start_date"`
+	EndDate   string     `json:"end_date"`
+	Data      []UsageRow `json:"data"`
+	HasMore   bool       `json:"has_more"`
+	// Incidents on the models used in the range
+	Incidents []UsageIncident `json:"incidents"`
+}
+
+// UsageIncident is a window staff marked a model as degraded in
+type UsageIncident struct {
+	ID          uint64 `json:"id"`
+	Model       string `json:"model"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	StartsAt    int64  `json:"starts_at"`
+	// Nil while the incident is ongoing
+	EndsAt *int64 `json:"ends_at"`
+}
+
+const (
+	ScopeUser         = "user"
+	ScopeOrganization = "organization"
+)
+
+// UsageScope selects whose usage is reported. Organization owners can report
+// on the whole organization or on a single member
+type UsageScope struct {
+	UserID           uint64
+	OrganizationID   uint64
+	OrganizationRole string
+	// ScopeUser or ScopeOrganization, defaults to ScopeUser
+	Scope string
+	// Member to report on instead of the caller, only with ScopeUser
+	MemberID uint64
+}
+
+// filter returns the where clause matching the scoped users, qualified with
+// table. Callers must have already checked access with authorize
+func (s UsageScope) filter(table string) (string, []any) {
+	if s.Scope == ScopeOrganization {
+		return table + ".user_id IN (SELECT id FROM user WHERE organization_id = ?)", []any{s.OrganizationID}
+	}
+	if s.MemberID != 0 {
+		return table + ".user_id = ?", []any{s.MemberID}
+	}
+	return table + ".user_id = ?", []any{s.UserID}
+}
+
+func (u *UsageHandler) authorize(ctx context.Context, s UsageScope) error {
+	switch s.Scope {
+	case ScopeUser, "":
+	case ScopeOrganization:
+		if s.OrganizationID == 0 {
+			return errors.Join(errors.New("user is not in an organization"), shared.ErrBadRequest)
+		}
+		if s.MemberID != 0 {
+			return errors.Join(errors.New("member_id cannot be used with organization scope"), shared.ErrBadRequest)
+		}
+	default:
+		return errors.Join(errors.New("scope must be user or organization"), shared.ErrBadRequest)
+	}
+	if s.Scope != ScopeOrganization && (s.MemberID == 0 || s.MemberID == s.UserID) {
+		return nil
+	}
+	if s.OrganizationRole != shared.OrganizationRoleOwner {
+		return errors.Join(errors.New("only organization owners can view organization usage"), shared.ErrForbidden)
+	}
+	if s.MemberID != 0 {
+		var organizationID sql.NullInt64
+		err := u.RDB.QueryRowContext(ctx, "SELECT organization_id FROM user WHERE id = ?", s.MemberID).Scan(&organizationID)
+		if err != nil && err != sql.ErrNoRows {
+			return errors.Join(errors.New("failed to query member"), err, shared.ErrInternalServerError)
+		}
+		if !organizationID.Valid || uint64(organizationID.Int64) != s.OrganizationID {
+			return errors.Join(errors.New("member not found"), shared.ErrNotFound)
+		}
+	}
+	return nil
+}
+
+// UsageInput contains all data needed for GetUsage business logic
+type UsageInput struct {
+	Ctx       context.Context
+	Scope     UsageScope
+	GroupBy   string
+	StartDate string
+	EndDate   string
+	Limit     int
+	Offset    int
+}
+
+// parseDateRange validates an inclusive YYYY-MM-DD range, defaulting to the
+// last shared.UsageDefaultRangeDays days
+func parseDateRange(startDate, endDate string) (time.Time, time.Time, error) {
+	end := time.Now().UTC().Truncate(24 * time.Hour)
+	if endDate != "" {
+		parsed, err := time.Parse(time.DateOnly, endDate)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Join(errors.New("end_date must be YYYY-MM-DD"), shared.ErrBadRequest)
+		}
+		end = parsed
+	}
+	start := end.AddDate(0, 0, -(shared.UsageDefaultRangeDays - 1))
+	if startDate != "" {
+		parsed, err := time.Parse(time.DateOnly, startDate)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Join(errors.New("start_date must be YYYY-MM-DD"), shared.ErrBadRequest)
+		}
+		start = parsed
+	}
+	if start.After(end) {
+		return time.Time{}, time.Time{}, errors.Join(errors.New("start_date must be before end_date"), shared.ErrBadRequest)
+	}
+	if end.Sub(start) > time.Duration(shared.UsageMaxRangeDays)*24*time.Hour {
+		return time.Time{}, time.Time{}, errors.Join(fmt.Errorf("date range cannot exceed %d days", shared.UsageMaxRangeDays), shared.ErrBadRequest)
+	}
+	return start, end, nil
+}
+
+func (u *UsageHandler) GetUsageLogic(input UsageInput) (*UsageOutput, error) {
+	log := shared.LoggerFromContext(input.Ctx, u.Log)
+	start, end, err := parseDateRange(input.StartDate, input.EndDate)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.authorize(input.Ctx, input.Scope); err != nil {
+		return nil, err
+	}
+	limit := input.Limit
+	if limit <= 0 || limit > shared.MaxPageSize {
+		limit = shared.DefaultPageSize
+	}
+	offset := max(input.Offset, 0)
+
+	// daily_stats has no endpoint column, so endpoint grouping reads the
+	// request rows instead. Canceled requests are only counted in daily_stats
+	var query string
+	var args []any
+	dailyFilter, dailyArgs := input.Scope.filter("daily_stats")
+	requestFilter, requestArgs := input.Scope.filter("request")
+	switch input.GroupBy {
+	case GroupByModel, "":
+		input.GroupBy = GroupByModel
+		query = `
+			SELECT model, SUM(request_count), SUM(input_tokens), SUM(output_tokens), SUM(total_spend),
+				COALESCE(SUM(time_to_first_token) / NULLIF(SUM(request_count) - SUM(canceled_requests), 0), 0),
+				SUM(reserved_requests), SUM(reserved_spend)
+			FROM daily_stats
+			WHERE ` + dailyFilter + ` AND date BETWEEN ? AND ?
+			GROUP BY model_id, model
+			ORDER BY SUM(total_spend) DESC, model ASC
+			LIMIT ? OFFSET ?`
+		args = append(dailyArgs, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	case GroupByDay:
+		query = `
+			SELECT DATE_FORMAT(date, '%Y-%m-%d'), SUM(request_count), SUM(input_tokens), SUM(output_tokens), SUM(total_spend),
+				COALESCE(SUM(time_to_first_token) / NULLIF(SUM(request_count) - SUM(canceled_requests), 0), 0),
+				SUM(reserved_requests), SUM(reserved_spend)
+			FROM daily_stats
+			WHERE ` + dailyFilter + ` AND date BETWEEN ? AND ?
+			GROUP BY date
+			ORDER BY date DESC
+			LIMIT ? OFFSET ?`
+		args = append(dailyArgs, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	case GroupByEndpoint:
+		query = `
+			SELECT endpoint, COUNT(*), SUM(prompt_tokens), SUM(completion_tokens), COALESCE(SUM(credits), 0),
+				COALESCE(AVG(time_to_first_token), 0),
+				SUM(reserved), COALESCE(SUM(IF(reserved, credits, 0)), 0)
+			FROM request
+			WHERE ` + requestFilter + ` AND created_at >= ? AND created_at < ?
+			GROUP BY endpoint
+			ORDER BY COUNT(*) DESC
+			LIMIT ? OFFSET ?`
+		args = append(requestArgs, start, end.AddDate(0, 0, 1))
+	default:
+		return nil, errors.Join(errors.New("group_by must be one of model, endpoint, day"), shared.ErrBadRequest)
+	}
+	// Fetch one extra row to know if there is another page
+	args = append(args, limit+1, offset)
+
+	rows, err := u.RDB.QueryContext(input.Ctx, query, args...)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to query usage"), err, shared.ErrInternalServerError)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	output := &UsageOutput{
+		GroupBy:   input.GroupBy,
+		StartDate: start.Format(time.DateOnly),
+		EndDate:   end.Format(time.DateOnly),
+		Data:      []UsageRow{},
+		Incidents: []UsageIncident{},
+	}
+	for rows.Next() {
+		var row UsageRow
+		if err := rows.Scan(&row.Key, &row.Requests, &row.InputTokens, &row.OutputTokens, &row.Credits, &row.AvgTTFTMillis,
+			&row.Reserved.Requests, &row.Reserved.Credits); err != nil {
+			log.Warnw("Failed to scan usage row", "error", err)
+			continue
+		}
+		row.TotalTokens = row.InputTokens + row.OutputTokens
+		row.Cost = float64(row.Credits) * shared.CreditsToUSD
+		row.OnDemand.Requests = row.Requests - min(row.Reserved.Requests, row.Requests)
+		row.OnDemand.Credits = row.Credits - min(row.Reserved.Credits, row.Credits)
+		row.Reserved.Cost = float64(row.Reserved.Credits) * shared.CreditsToUSD
+		row.OnDemand.Cost = float64(row.OnDemand.Credits) * shared.CreditsToUSD
+		output.Data = append(output.Data, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Join(errors.New("failed iterating usage rows"), err, shared.ErrInternalServerError)
+	}
+	if len(output.Data) > limit {
+		output.Data = output.Data[:limit]
+		output.HasMore = true
+	}
+
+	// Usage is still returned when the annotations cannot be loaded
+	incidents, err := u.usageIncidents(input.Ctx, input.Scope, start, end)
+	if err != nil {
+		log.Warnw("Failed to query usage incidents", "error", err)
+		return output, nil
+	}
+	output.Incidents = incidents
+	annotateIncidents(output)
+	return output, nil
+}
+
+// usageIncidents returns the incidents overlapping the range on models the
+// scoped users sent requests to in it
+func (u *UsageHandler) usageIncidents(ctx context.Context, scope UsageScope, start, end time.Time) ([]UsageIncident, error) {
+	dailyFilter, dailyArgs := scope.filter("daily_stats")
+	args := append([]any{end.AddDate(0, 0, 1), start}, dailyArgs...)
+	args = append(args, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	rows, err := u.RDB.QueryContext(ctx, `
+		SELECT model_incident.id, model.name, model_incident.title, model_incident.description,
+			UNIX_TIMESTAMP(model_incident.starts_at), UNIX_TIMESTAMP(model_incident.ends_at)
+		FROM model_incident
+		INNER JOIN model ON model.id = model_incident.model_id
+		WHERE model_incident.active = true
+			AND model_incident.starts_at < ? AND (model_incident.ends_at IS NULL OR model_incident.ends_at > ?)
+			AND model_incident.model_id IN (
+				SELECT DISTINCT model_id FROM daily_stats WHERE `+dailyFilter+` AND date BETWEEN ? AND ?
+			)
+		ORDER BY model_incident.starts_at ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	incidents := []UsageIncident{}
+	for rows.Next() {
+		var incident UsageIncident
+		var endsAt sql.NullInt64
+		if err := rows.Scan(&incident.ID, &incident.Model, &incident.Title, &incident.Description, &incident.StartsAt, &endsAt); err != nil {
+			return nil, err
+		}
+		if endsAt.Valid {
+			incident.EndsAt = &endsAt.Int64
+		}
+		incidents = append(incidents, incident)
+	}
+	return incidents, rows.Err()
+}
+
+// annotateIncidents marks the model and day rows the incidents affected. Days
+// are UTC, like daily_stats
+func annotateIncidents(output *UsageOutput) {
+	if len(output.Incidents) == 0 {
+		return
+	}
+	for i := range output.Data {
+		row := &output.Data[i]
+		for _, incident := range output.Incidents {
+			switch output.GroupBy {
+			case GroupByModel:
+				if row.Key == incident.Model {
+					row.IncidentIDs = append(row.IncidentIDs, incident.ID)
+				}
+			case GroupByDay:
+				day, err := time.Parse(time.DateOnly, row.Key)
+				if err != nil {
+					continue
+				}
+				endsAt := time.Now().Unix()
+				if incident.EndsAt != nil {
+					endsAt = *incident.EndsAt
+				}
+				if incident.StartsAt < day.AddDate(0, 0, 1).Unix() && endsAt > day.Unix() {
+					row.IncidentIDs = append(row.IncidentIDs, incident.ID)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package herocard
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"sybil-api/internal/shared"
+)
+
+const dictionaryAPIURL = "https://api.dictionaryapi.dev/api/v2/entries/en/"
+
+// Dictionary builds definition cards from the free dictionary api, english
+// words only
+type Dictionary struct {
+	client *http.Client
+}
+
+func NewDictionary() *Dictionary {
+	return &Dictionary{client: &http.Client{}}
+}
+
+func (d *Dictionary) Intent() string {
+	return IntentDefinition
+}
+
+type Definition struct {
+	Word     string    `json:"word"`
+	Phonetic string    `json:"phonetic,omitempty"`
+	Meanings []Meaning `json:"meanings"`
+}
+
+type Meaning struct {
+	PartOfSpeech string   `json:"part_of_speech"`
+	Definitions  []string `json:"definitions"`
+	Example      string   `json:"example,omitempty"`
+}
+
+type dictionaryEntry struct {
+	Word     string `json:"word"`
+	Phonetic string `json:"phonetic"`
+	Meanings []struct {
+		PartOfSpeech string `json:"partOfSpeech"`
+		Definitions  []struct {
+			Definition string `json:"definition"`
+			Example    string `json:"example"`
+		} `json:"definitions"`
+	} `json:"meanings"`
+}
+
+func (d *Dictionary) Card(ctx context.Context, intent Intent, _ *shared.SearchLocale) (*Card, error) {
+	var entries []dictionaryEntry
+	if err := getJSON(ctx, d.client, dictionaryAPIURL+url.PathEscape(intent.Subject), &entries); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || len(entries[0].Meanings) == 0 {
+		return nil, ErrNotFound
+	}
+	entry := entries[0]
+	definition := Definition{Word: entry.Word, Phonetic: entry.Phonetic, Meanings: []Meaning{}}
+	for _, m := range entry.Meanings {
+		meaning := Meaning{PartOfSpeech: m.PartOfSpeech, Definitions: []string{}}
+		for _, def := range m.Definitions {
+			if len(meaning.Definitions) == shared.HeroCardMaxDefinitions {
+				break
+			}
+			meaning.Definitions = append(meaning.Definitions, def.Definition)
+			if meaning.Example == "" {
+				meaning.Example = def.Example
+			}
+		}
+		definition.Meanings = append(definition.Meanings, meaning)
+	}
+	return &Card{
+		Type:      IntentDefinition,
+		Subject:   intent.Subject,
+		Data:      definition,
+		Source:    "Free Dictionary API",
+		SourceURL: "https://dictionaryapi.dev",
+	}, nil
+}
@@ -0,0 +1,115 @@
+// Package herocard enriches a search with a structured card shown above the
+// results, like the forecast for a weather query or the quote for a ticker.
+// The query intent is detected first and only the adapter for that intent is
+// called, queries without a known intent get no card
+package herocard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+)
+
+// ErrNotFound is returned by adapters that have no data for the subject
+var ErrNotFound = errors.New("no hero card data for subject")
+
+// Card is sent to clients as the heroCard event. Data holds the intent
+// specific card, like Weather or Stock
+type Card struct {
+	Type    string `json:"type"`
+	Subject string `json:"subject"`
+	Data    any    `json:"data"`
+	// Who the data is from, to attribute it
+	Source    string `json:"source"`
+	SourceURL string `json:"source_url,omitempty"`
+}
+
+// Adapter builds cards for one intent from a data api
+type Adapter interface {
+	Intent() string
+	Card(ctx context.Context, intent Intent, locale *shared.SearchLocale) (*Card, error)
+}
+
+type Enricher struct {
+	log      *zap.SugaredLogger
+	adapters map[string]Adapter
+	timeout  time.Duration
+}
+
+// NewEnricher uses the adapters by their intent, a later adapter for the same
+// intent replaces the earlier one
+func NewEnricher(log *zap.SugaredLogger, timeout time.Duration, adapters ...Adapter) *Enricher {
+	e := &Enricher{log: log, adapters: map[string]Adapter{}, timeout: timeout}
+	for _, adapter := range adapters {
+		e.adapters[adapter.Intent()] = adapter
+	}
+	return e
+}
+
+// Enrich returns the card for the query, nil when the intent is unknown, has
+// no adapter or the adapter failed or took too long. Cards are an extra, so
+// failures are only logged
+func (e *Enricher) Enrich(ctx context.Context, query string, locale *shared.SearchLocale) *Card {
+	if e == nil {
+		return nil
+	}
+	intent, ok := Detect(query)
+	if !ok {
+		return nil
+	}
+	adapter, ok := e.adapters[intent.Type]
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	card, err := adapter.Card(ctx, intent, locale)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		metrics.HeroCards.WithLabelValues(intent.Type, "not_found").Inc()
+		return nil
+	case err != nil:
+		metrics.HeroCards.WithLabelValues(intent.Type, "error").Inc()
+		e.log.Warnw("Failed to build hero card", "intent", intent.Type, "error", err)
+		return nil
+	}
+	metrics.HeroCards.WithLabelValues(intent.Type, "ok").Inc()
+	return card
+}
+
+// getJSON sends a GET to a data api and decodes the reply into dest, 404 is
+// ErrNotFound
+func getJSON(ctx context.Context, client *http.Client, endpoint string, dest any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case res.StatusCode >= 300:
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("hero card api returned status %d: %s", res.StatusCode, body)
+	}
+	return json.NewDecoder(res.Body).Decode(dest)
+}
@@ -0,0 +1,58 @@
+package herocard
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	IntentWeather    = "weather"
+	IntentStocks     = "stocks"
+	IntentDefinition = "definition"
+	IntentSports     = "sports"
+)
+
+// Intent is what the query asks for and about what, like the city of a
+// weather query or the ticker of a stock query
+type Intent struct {
+	Type    string
+	Subject string
+}
+
+// intentPatterns are tried in order against the lowercased query, the first
+// group is the subject
+var intentPatterns = []struct {
+	intent  string
+	pattern *regexp.Regexp
+}{
+	{IntentWeather, regexp.MustCompile(`^(?:what(?:'s| is) the )?(?:weather|forecast|temperature) (?:in|for|at) (.+?)(?: today| tomorrow| now| this week)?$`)},
+	{IntentWeather, regexp.MustCompile(`^(.+?) (?:weather|forecast)(?: today| tomorrow| now| this week)?$`)},
+	{IntentStocks, regexp.MustCompile(`^\$([a-z][a-z.]{0,5})$`)},
+	{IntentStocks, regexp.MustCompile(`^([a-z][a-z.]{0,5}) (?:stock|stock price|share price|shares|quote)$`)},
+	{IntentStocks, regexp.MustCompile(`^(?:stock price|share price|quote) (?:of|for) ([a-z][a-z.]{0,5})$`)},
+	{IntentDefinition, regexp.MustCompile(`^(?:define|definition of|meaning of) ([a-z][a-z'-]*)$`)},
+	{IntentDefinition, regexp.MustCompile(`^what does ([a-z][a-z'-]*) mean$`)},
+	{IntentSports, regexp.MustCompile(`^(.+?) (?:score|scores|game|match|result|results)(?: today| tonight| last night)?$`)},
+	{IntentSports, regexp.MustCompile(`^(.+?) vs\.? .+$`)},
+}
+
+// Detect finds the intent of a search query
+func Detect(query string) (Intent, bool) {
+	query = strings.Join(strings.Fields(strings.ToLower(query)), " ")
+	query = strings.TrimRight(query, "?!. ")
+	for _, p := range intentPatterns {
+		match := p.pattern.FindStringSubmatch(query)
+		if match == nil {
+			continue
+		}
+		subject := strings.TrimSpace(match[1])
+		if subject == "" {
+			continue
+		}
+		if p.intent == IntentStocks {
+			subject = strings.ToUpper(subject)
+		}
+		return Intent{Type: p.intent, Subject: subject}, true
+	}
+	return Intent{}, false
+}
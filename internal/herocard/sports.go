@@ -0,0 +1,112 @@
+package herocard
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"sybil-api/internal/shared"
+)
+
+const theSportsDBURL = "https://www.thesportsdb.com/api/v1/json/"
+
+// TheSportsDB builds sports cards with the latest game of a team
+type TheSportsDB struct {
+	apiKey string
+	client *http.Client
+}
+
+func NewTheSportsDB(apiKey string) *TheSportsDB {
+	return &TheSportsDB{apiKey: apiKey, client: &http.Client{}}
+}
+
+func (t *TheSportsDB) Intent() string {
+	return IntentSports
+}
+
+type Sports struct {
+	Team     string `json:"team"`
+	League   string `json:"league,omitempty"`
+	Badge    string `json:"badge,omitempty"`
+	LastGame *Game  `json:"last_game,omitempty"`
+	NextGame *Game  `json:"next_game,omitempty"`
+}
+
+type Game struct {
+	Event    string `json:"event"`
+	Date     string `json:"date"`
+	HomeTeam string `json:"home_team"`
+	AwayTeam string `json:"away_team"`
+	// Nil before the game is played
+	HomeScore *int `json:"home_score,omitempty"`
+	AwayScore *int `json:"away_score,omitempty"`
+}
+
+type theSportsDBTeamsResponse struct {
+	Teams []struct {
+		ID     string `json:"idTeam"`
+		Name   string `json:"strTeam"`
+		League string `json:"strLeague"`
+		Badge  string `json:"strBadge"`
+	} `json:"teams"`
+}
+
+type theSportsDBEvent struct {
+	Event     string  `json:"strEvent"`
+	Date      string  `json:"dateEvent"`
+	HomeTeam  string  `json:"strHomeTeam"`
+	AwayTeam  string  `json:"strAwayTeam"`
+	HomeScore *string `json:"intHomeScore"`
+	AwayScore *string `json:"intAwayScore"`
+}
+
+func (t *TheSportsDB) Card(ctx context.Context, intent Intent, _ *shared.SearchLocale) (*Card, error) {
+	base := theSportsDBURL + url.PathEscape(t.apiKey)
+	var teams theSportsDBTeamsResponse
+	if err := getJSON(ctx, t.client, base+"/searchteams.php?t="+url.QueryEscape(intent.Subject), &teams); err != nil {
+		return nil, err
+	}
+	if len(teams.Teams) == 0 {
+		return nil, ErrNotFound
+	}
+	team := teams.Teams[0]
+	sports := Sports{Team: team.Name, League: team.League, Badge: team.Badge}
+
+	var last struct {
+		Results []theSportsDBEvent `json:"results"`
+	}
+	if err := getJSON(ctx, t.client, base+"/eventslast.php?id="+url.QueryEscape(team.ID), &last); err != nil {
+		return nil, err
+	}
+	if len(last.Results) > 0 {
+		sports.LastGame = newGame(last.Results[0])
+	}
+	// The next game is a nice to have, the card is sent without it
+	var next struct {
+		Events []theSportsDBEvent `json:"events"`
+	}
+	if err := getJSON(ctx, t.client, base+"/eventsnext.php?id="+url.QueryEscape(team.ID), &next); err == nil && len(next.Events) > 0 {
+		sports.NextGame = newGame(next.Events[0])
+	}
+	return &Card{
+		Type:      IntentSports,
+		Subject:   intent.Subject,
+		Data:      sports,
+		Source:    "TheSportsDB",
+		SourceURL: "https://www.thesportsdb.com",
+	}, nil
+}
+
+func newGame(event theSportsDBEvent) *Game {
+	game := &Game{Event: event.Event, Date: event.Date, HomeTeam: event.HomeTeam, AwayTeam: event.AwayTeam}
+	if event.HomeScore != nil && event.AwayScore != nil {
+		home, homeErr := strconv.Atoi(*event.HomeScore)
+		away, awayErr := strconv.Atoi(*event.AwayScore)
+		if homeErr == nil && awayErr == nil {
+			game.HomeScore = &home
+			game.AwayScore = &away
+		}
+	}
+	return game
+}
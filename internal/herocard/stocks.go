@@ -0,0 +1,81 @@
+package herocard
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"sybil-api/internal/shared"
+)
+
+const alphaVantageURL = "https://www.alphavantage.co/query"
+
+// AlphaVantage builds stock cards from the Alpha Vantage quote api
+type AlphaVantage struct {
+	apiKey string
+	client *http.Client
+}
+
+func NewAlphaVantage(apiKey string) *AlphaVantage {
+	return &AlphaVantage{apiKey: apiKey, client: &http.Client{}}
+}
+
+func (a *AlphaVantage) Intent() string {
+	return IntentStocks
+}
+
+type Stock struct {
+	Symbol        string  `json:"symbol"`
+	Price         float64 `json:"price"`
+	Change        float64 `json:"change"`
+	ChangePercent float64 `json:"change_percent"`
+	PreviousClose float64 `json:"previous_close"`
+	TradingDay    string  `json:"trading_day"`
+}
+
+type alphaVantageQuoteResponse struct {
+	Quote struct {
+		Symbol        string `json:"01. symbol"`
+		Price         string `json:"05. price"`
+		TradingDay    string `json:"07. latest trading day"`
+		PreviousClose string `json:"08. previous close"`
+		Change        string `json:"09. change"`
+		ChangePercent string `json:"10. change percent"`
+	} `json:"Global Quote"`
+}
+
+func (a *AlphaVantage) Card(ctx context.Context, intent Intent, _ *shared.SearchLocale) (*Card, error) {
+	params := url.Values{}
+	params.Set("function", "GLOBAL_QUOTE")
+	params.Set("symbol", intent.Subject)
+	params.Set("apikey", a.apiKey)
+	var res alphaVantageQuoteResponse
+	if err := getJSON(ctx, a.client, alphaVantageURL+"?"+params.Encode(), &res); err != nil {
+		return nil, err
+	}
+	// Unknown symbols come back as an empty quote
+	quote := res.Quote
+	if quote.Symbol == "" {
+		return nil, ErrNotFound
+	}
+	price, _ := strconv.ParseFloat(quote.Price, 64)
+	change, _ := strconv.ParseFloat(quote.Change, 64)
+	changePercent, _ := strconv.ParseFloat(strings.TrimSuffix(quote.ChangePercent, "%"), 64)
+	previousClose, _ := strconv.ParseFloat(quote.PreviousClose, 64)
+	return &Card{
+		Type:    IntentStocks,
+		Subject: intent.Subject,
+		Data: Stock{
+			Symbol:        quote.Symbol,
+			Price:         price,
+			Change:        change,
+			ChangePercent: changePercent,
+			PreviousClose: previousClose,
+			TradingDay:    quote.TradingDay,
+		},
+		Source:    "Alpha Vantage",
+		SourceURL: "https://www.alphavantage.co",
+	}, nil
+}
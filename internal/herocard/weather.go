@@ -0,0 +1,139 @@
+package herocard
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"sybil-api/internal/shared"
+)
+
+const (
+	openMeteoGeocodingURL = "https://geocoding-api.open-meteo.com/v1/search"
+	openMeteoForecastURL  = "https://api.open-meteo.com/v1/forecast"
+)
+
+// OpenMeteo builds weather cards from Open-Meteo, which needs no key
+type OpenMeteo struct {
+	client *http.Client
+}
+
+func NewOpenMeteo() *OpenMeteo {
+	return &OpenMeteo{client: &http.Client{}}
+}
+
+func (o *OpenMeteo) Intent() string {
+	return IntentWeather
+}
+
+type Weather struct {
+	Location    string  `json:"location"`
+	Country     string  `json:"country,omitempty"`
+	Unit        string  `json:"unit"`
+	Temperature float64 `json:"temperature"`
+	// WMO weather interpretation code
+	WeatherCode int            `json:"weather_code"`
+	Humidity    float64        `json:"humidity"`
+	WindSpeed   float64        `json:"wind_speed"`
+	Daily       []WeatherDaily `json:"daily"`
+}
+
+type WeatherDaily struct {
+	Date        string  `json:"date"`
+	High        float64 `json:"high"`
+	Low         float64 `json:"low"`
+	WeatherCode int     `json:"weather_code"`
+}
+
+type openMeteoGeocodingResponse struct {
+	Results []struct {
+		Name      string  `json:"name"`
+		Country   string  `json:"country"`
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	} `json:"results"`
+}
+
+type openMeteoForecastResponse struct {
+	Current struct {
+		Temperature float64 `json:"temperature_2m"`
+		Humidity    float64 `json:"relative_humidity_2m"`
+		WindSpeed   float64 `json:"wind_speed_10m"`
+		WeatherCode int     `json:"weather_code"`
+	} `json:"current"`
+	Daily struct {
+		Time        []string  `json:"time"`
+		High        []float64 `json:"temperature_2m_max"`
+		Low         []float64 `json:"temperature_2m_min"`
+		WeatherCode []int     `json:"weather_code"`
+	} `json:"daily"`
+}
+
+func (o *OpenMeteo) Card(ctx context.Context, intent Intent, locale *shared.SearchLocale) (*Card, error) {
+	params := url.Values{}
+	params.Set("name", intent.Subject)
+	params.Set("count", "1")
+	params.Set("format", "json")
+	if locale != nil && locale.Language != "" {
+		lang, _, _ := strings.Cut(locale.Language, "-")
+		params.Set("language", strings.ToLower(lang))
+	}
+	var places openMeteoGeocodingResponse
+	if err := getJSON(ctx, o.client, openMeteoGeocodingURL+"?"+params.Encode(), &places); err != nil {
+		return nil, err
+	}
+	if len(places.Results) == 0 {
+		return nil, ErrNotFound
+	}
+	place := places.Results[0]
+
+	// Only the US still reads temperatures in fahrenheit
+	unit := "celsius"
+	if locale != nil && strings.EqualFold(locale.Region, "us") {
+		unit = "fahrenheit"
+	}
+	params = url.Values{}
+	params.Set("latitude", fmt.Sprint(place.Latitude))
+	params.Set("longitude", fmt.Sprint(place.Longitude))
+	params.Set("current", "temperature_2m,relative_humidity_2m,wind_speed_10m,weather_code")
+	params.Set("daily", "temperature_2m_max,temperature_2m_min,weather_code")
+	params.Set("forecast_days", fmt.Sprint(shared.HeroCardForecastDays))
+	params.Set("temperature_unit", unit)
+	params.Set("timezone", "auto")
+	var forecast openMeteoForecastResponse
+	if err := getJSON(ctx, o.client, openMeteoForecastURL+"?"+params.Encode(), &forecast); err != nil {
+		return nil, err
+	}
+
+	weather := Weather{
+		Location:    place.Name,
+		Country:     place.Country,
+		Unit:        unit,
+		Temperature: forecast.Current.Temperature,
+		WeatherCode: forecast.Current.WeatherCode,
+		Humidity:    forecast.Current.Humidity,
+		WindSpeed:   forecast.Current.WindSpeed,
+		Daily:       []WeatherDaily{},
+	}
+	daily := forecast.Daily
+	for i := range daily.Time {
+		if i >= len(daily.High) || i >= len(daily.Low) || i >= len(daily.WeatherCode) {
+			break
+		}
+		weather.Daily = append(weather.Daily, WeatherDaily{
+			Date:        daily.Time[i],
+			High:        daily.High[i],
+			Low:         daily.Low[i],
+			WeatherCode: daily.WeatherCode[i],
+		})
+	}
+	return &Card{
+		Type:      IntentWeather,
+		Subject:   intent.Subject,
+		Data:      weather,
+		Source:    "Open-Meteo",
+		SourceURL: "https://open-meteo.com",
+	}, nil
+}
@@ -0,0 +1,348 @@
+// Package jwtauth verifies the session tokens the Sybil web frontend signs,
+// using the public keys it publishes as a JWKS
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"sybil-api/internal/shared"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrUnknownKey       = errors.New("token signed by unknown key")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrInvalidClaims    = errors.New("invalid token claims")
+)
+
+// Claims are the registered claims a session token must carry. Scope is an
+// optional space separated list of api key scopes the session is limited to
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	ID        string   `json:"jti"`
+	Scope     *string  `json:"scope"`
+}
+
+// audience accepts the aud claim as either a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// algorithms maps the supported alg header values to their hash. Symmetric
+// and none algorithms are never accepted
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+}
+
+// Verifier checks token signatures against a JWKS it fetches and caches. Keys
+// are refetched every shared.JWKSRefreshInterval, or sooner when a token names
+// a key that is not cached, at most once per shared.JWKSMinRefreshInterval
+type Verifier struct {
+	jwksURL  string
+	issuer   string
+	audience string
+	client   *http.Client
+
+	// Concurrent refreshes share one fetch
+	refreshes singleflight.Group
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// Last fetch whether it failed or not, so an unreachable JWKS is retried
+	// at most once per shared.JWKSMinRefreshInterval
+	attemptedAt time.Time
+}
+
+func NewVerifier(jwksURL, issuer, audience string) *Verifier {
+	return &Verifier{
+		jwksURL:  jwksURL,
+		issuer:   issuer,
+		audience: audience,
+		client:   &http.Client{Timeout: shared.JWKSFetchTimeout},
+		keys:     map[string]crypto.PublicKey{},
+	}
+}
+
+// LooksLikeJWT reports whether a bearer token has the shape of a JWT rather
+// than an api key, which never contains dots
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the tokens signature, expiry, issuer and audience and returns
+// its claims
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errors.Join(ErrMalformed, err)
+	}
+	hash, ok := algorithms[h.Alg]
+	if !ok {
+		return nil, errors.Join(ErrMalformed, fmt.Errorf("unsupported alg %q", h.Alg))
+	}
+	key, err := v.key(ctx, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Join(ErrMalformed, err)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(h.Alg, key, hash, hasher.Sum(nil), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Join(ErrMalformed, err)
+	}
+	if err := v.validateClaims(&claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (v *Verifier) validateClaims(c *Claims, now time.Time) error {
+	leeway := int64(shared.JWTLeeway / time.Second)
+	switch {
+	case c.Subject == "":
+		return errors.Join(ErrInvalidClaims, errors.New("missing sub"))
+	case c.ExpiresAt == 0 || now.Unix() >= c.ExpiresAt+leeway:
+		return errors.Join(ErrInvalidClaims, errors.New("token expired"))
+	case c.NotBefore != 0 && now.Unix()+leeway < c.NotBefore:
+		return errors.Join(ErrInvalidClaims, errors.New("token not yet valid"))
+	case v.issuer != "" && c.Issuer != v.issuer:
+		return errors.Join(ErrInvalidClaims, fmt.Errorf("unexpected issuer %q", c.Issuer))
+	case v.audience != "" && !slices.Contains(c.Audience, v.audience):
+		return errors.Join(ErrInvalidClaims, errors.New("token not issued for this audience"))
+	}
+	return nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest []byte, sig []byte) error {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrInvalidSignature
+}
+
+// key returns the cached public key for kid, refreshing the JWKS when it is
+// stale or does not have the key yet. The lock is not held during the fetch
+func (v *Verifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	age := time.Since(v.fetchedAt)
+	sinceAttempt := time.Since(v.attemptedAt)
+	v.mu.Unlock()
+
+	if ok && age < shared.JWKSRefreshInterval {
+		return key, nil
+	}
+	if sinceAttempt < shared.JWKSMinRefreshInterval {
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		return key, nil
+	}
+
+	// The fetch is shared, so one caller going away must not cancel it for
+	// the rest
+	fetched, err, _ := v.refreshes.Do("jwks", func() (any, error) {
+		return v.refresh(context.WithoutCancel(ctx))
+	})
+	if err != nil {
+		// Keep serving the keys we have until the JWKS is reachable again
+		if ok {
+			return key, nil
+		}
+		return nil, errors.Join(ErrUnknownKey, err)
+	}
+	if key, ok = fetched.(map[string]crypto.PublicKey)[kid]; !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// refresh fetches the JWKS and replaces the cached keys when it succeeds
+func (v *Verifier) refresh(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	keys, err := v.fetch(ctx)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.attemptedAt = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetchedAt = keys, v.attemptedAt
+	return keys, nil
+}
+
+func (v *Verifier) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, shared.JWKSFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", v.jwksURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build jwks request: %w", err)
+	}
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks returned status %d", res.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("rsa exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) > size || len(y) > size {
+			return nil, errors.New("ec coordinates too large")
+		}
+		// Uncompressed point encoding, which also checks the point is on the
+		// curve
+		point := make([]byte, 1+2*size)
+		point[0] = 4
+		copy(point[1+size-len(x):1+size], x)
+		copy(point[1+2*size-len(y):], y)
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,159 @@
+// Package lifecycle publishes an event when an inference request starts,
+// completes or fails, so fraud, analytics and billing reconciliation can
+// follow requests without polling the database. Events are handed to a Bus,
+// which publishes them in the background to any Publisher. Events are
+// dropped when the publisher falls behind, requests never wait on the bus
+package lifecycle
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+)
+
+const (
+	TypeStarted   = "request.started"
+	TypeCompleted = "request.completed"
+	TypeFailed    = "request.failed"
+	// A billed request was refunded because the model did not complete it
+	TypeRefunded = "request.refunded"
+)
+
+// Event is one step of a request. Content is never part of an event
+type Event struct {
+	Type      string    `json:"type"`
+	RequestID string    `json:"request_id"`
+	UserID    uint64    `json:"user_id"`
+	KeyID     string    `json:"key_id,omitempty"`
+	Model     string    `json:"model"`
+	ModelID   uint64    `json:"model_id"`
+	Endpoint  string    `json:"endpoint"`
+	Stream    bool      `json:"stream"`
+	BYOK      bool      `json:"byok,omitempty"`
+	Reserved  bool      `json:"reserved,omitempty"`
+	Time      time.Time `json:"time"`
+
+	// Set on completed and refunded events
+	Usage            *Usage `json:"usage,omitempty"`
+	Credits          uint64 `json:"credits,omitempty"`
+	TimeToFirstToken int64  `json:"time_to_first_token_ms,omitempty"`
+	TotalTime        int64  `json:"total_time_ms,omitempty"`
+	// Answered from the response cache, free and never sent to the model
+	Cached bool `json:"cached,omitempty"`
+
+	// Set on failed events
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     uint64 `json:"prompt_tokens"`
+	CompletionTokens uint64 `json:"completion_tokens"`
+	TotalTokens      uint64 `json:"total_tokens"`
+	Canceled         bool   `json:"canceled,omitempty"`
+}
+
+// Publisher sends events to a message bus. Implementations for other buses,
+// like NATS or Kafka, only need to provide this
+type Publisher interface {
+	Name() string
+	// Publish sends events in order, an error means none of them can be
+	// assumed to have arrived
+	Publish(ctx context.Context, events []Event) error
+}
+
+// Bus queues events for a publisher and publishes them in batches
+type Bus struct {
+	publisher Publisher
+	log       *zap.SugaredLogger
+	events    chan Event
+	done      chan struct{}
+	once      sync.Once
+}
+
+// NewBus starts publishing to publisher, nil publisher returns a nil bus
+// which drops every event
+func NewBus(publisher Publisher, log *zap.SugaredLogger) *Bus {
+	if publisher == nil {
+		return nil
+	}
+	b := &Bus{
+		publisher: publisher,
+		log:       log,
+		events:    make(chan Event, shared.LifecycleQueueSize),
+		done:      make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Emit queues an event without blocking
+func (b *Bus) Emit(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	select {
+	case b.events <- event:
+	default:
+		metrics.LifecycleEvents.WithLabelValues(event.Type, "dropped").Inc()
+	}
+}
+
+// Shutdown publishes the queued events and stops the bus
+func (b *Bus) Shutdown() {
+	if b == nil {
+		return
+	}
+	b.once.Do(func() {
+		close(b.events)
+		<-b.done
+	})
+}
+
+func (b *Bus) run() {
+	defer close(b.done)
+	batch := make([]Event, 0, shared.LifecycleBatchSize)
+	ticker := time.NewTicker(shared.LifecycleFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-b.events:
+			if !ok {
+				b.publish(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= shared.LifecycleBatchSize {
+				b.publish(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			b.publish(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (b *Bus) publish(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shared.LifecyclePublishTimeout)
+	defer cancel()
+	result := "published"
+	if err := b.publisher.Publish(ctx, batch); err != nil {
+		result = "failed"
+		b.log.Warnw("Failed to publish lifecycle events", "publisher", b.publisher.Name(), "events", len(batch), "error", err)
+	}
+	for _, event := range batch {
+		metrics.LifecycleEvents.WithLabelValues(event.Type, result).Inc()
+	}
+}
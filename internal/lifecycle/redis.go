@@ -0,0 +1,43 @@
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStream publishes events to a Redis stream, one entry per event with
+// the type and the event JSON. Consumers read it with consumer groups. The
+// stream is trimmed to about maxLen entries
+type RedisStream struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+}
+
+func NewRedisStream(client *redis.Client, stream string, maxLen int64) *RedisStream {
+	return &RedisStream{client: client, stream: stream, maxLen: maxLen}
+}
+
+func (r *RedisStream) Name() string {
+	return "redis"
+}
+
+func (r *RedisStream) Publish(ctx context.Context, events []Event) error {
+	pipe := r.client.Pipeline()
+	for _, event := range events {
+		eventJSON, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: r.stream,
+			MaxLen: r.maxLen,
+			Approx: true,
+			Values: map[string]any{"type": event.Type, "event": string(eventJSON)},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -101,6 +101,295 @@ var (
 		)
 	*/
 
+	ResponseCacheCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_response_cache_total",
+			Help: "Opt-in response cache lookups by result",
+		},
+		[]string{"model", "endpoint", "result"},
+	)
+
+	EmbeddingBatchSize = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sybil_api_embedding_batch_size",
+			Help:    "Unique inputs per upstream embedding call",
+			Buckets: []float64{1, 2, 4, 8, 16, 32, 64, 128, 256},
+		},
+		[]string{"model"},
+	)
+
+	SchemaValidationCount = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_schema_validation_total",
+			Help: "Structured output schema validations by attempt and result",
+		},
+		[]string{"model", "attempt", "result"},
+	)
+
+	SearchQueries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_search_queries_total",
+			Help: "Web searches by result",
+		},
+		[]string{"result"},
+	)
+
+	SearchCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_search_cache_requests_total",
+			Help: "Search cache lookups by search type and result",
+		},
+		[]string{"type", "result"},
+	)
+
+	SearchProviderRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_search_provider_requests_total",
+			Help: "Search provider calls by provider, method and result",
+		},
+		[]string{"provider", "method", "result"},
+	)
+
+	SearchQuotaUsed = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sybil_api_search_quota_used",
+			Help: "Google CSE queries sent today",
+		},
+	)
+
+	SearchQuotaRemaining = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sybil_api_search_quota_remaining",
+			Help: "Google CSE queries left in todays quota",
+		},
+	)
+
+	SearchQuotaProjected = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sybil_api_search_quota_projected",
+			Help: "Projected Google CSE queries for today at the current rate",
+		},
+	)
+
+	SearchAbuseScore = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "sybil_api_search_abuse_score",
+			Help:    "Abuse score of web searches",
+			Buckets: []float64{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100},
+		},
+	)
+
+	SearchAbuseSignals = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_search_abuse_signals_total",
+			Help: "Abuse signals seen on web searches by signal",
+		},
+		[]string{"signal"},
+	)
+
+	SearchAbuseVerdicts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_search_abuse_verdicts_total",
+			Help: "Web search abuse verdicts by action",
+		},
+		[]string{"action"},
+	)
+
+	ReplicaLag = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sybil_api_replica_lag_seconds",
+			Help: "Read replica lag measured from the heartbeat row",
+		},
+	)
+
+	ReplicaFallbacks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_replica_fallbacks_total",
+			Help: "Reads sent to the primary because the replica was lagging by purpose",
+		},
+		[]string{"purpose"},
+	)
+
+	HistoryReads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_history_reads_total",
+			Help: "Chat history reads by the database they went to",
+		},
+		[]string{"source"},
+	)
+
+	SearchClassifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_search_classifications_total",
+			Help: "Chat messages in auto search mode by how they were classified and the result",
+		},
+		[]string{"by", "result"},
+	)
+
+	SearchInjections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_search_injections_total",
+			Help: "Search results with prompt injection text removed by kind",
+		},
+		[]string{"kind"},
+	)
+
+	SearchReranks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_search_reranks_total",
+			Help: "Chat search result reranks by result",
+		},
+		[]string{"result"},
+	)
+
+	SearchRerankDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "sybil_api_search_rerank_duration_seconds",
+			Help:    "Time spent embedding and reranking chat search results",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 0.75, 1, 2, 5},
+		},
+	)
+
+	LifecycleEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_lifecycle_events_total",
+			Help: "Request lifecycle events by type and whether they were published, failed or dropped",
+		},
+		[]string{"type", "result"},
+	)
+
+	PIIRedactions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_pii_redactions_total",
+			Help: "Personal information redacted before storage by target and type",
+		},
+		[]string{"target", "type"},
+	)
+
+	BudgetAlerts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_budget_alerts_total",
+			Help: "Budget alert webhook deliveries by result",
+		},
+		[]string{"result"},
+	)
+
+	ModelAlerts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_model_alerts_total",
+			Help: "Model owner alert webhook deliveries by kind and result",
+		},
+		[]string{"kind", "result"},
+	)
+
+	RateLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_rate_limited_total",
+			Help: "Requests rejected by the per api key rate limits",
+		},
+		[]string{"limit"},
+	)
+	APIKeyRestricted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_api_key_restricted_total",
+			Help: "Requests rejected by api key ip or origin allowlists",
+		},
+		[]string{"reason"},
+	)
+
+	CapacityRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_capacity_rejected_total",
+			Help: "Requests rejected after waiting in the queue for an on-demand slot",
+		},
+		[]string{"model_id"},
+	)
+
+	ColdStartWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sybil_api_cold_start_wait_seconds",
+			Help:    "Time to first token of requests sent to a model scaled to zero",
+			Buckets: []float64{1, 5, 10, 20, 30, 45, 60, 90, 120, 180, 300, 600},
+		},
+		[]string{"model_id"},
+	)
+
+	ModelAutoscale = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_model_autoscale_total",
+			Help: "Automatic targon max replica changes by model, direction and result",
+		},
+		[]string{"model_id", "direction", "result"},
+	)
+	WarmPool = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_warm_pool_total",
+			Help: "Forecast targon min replica changes by model, direction and result",
+		},
+		[]string{"model_id", "direction", "result"},
+	)
+
+	RetentionPurged = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_retention_purged_total",
+			Help: "Histories deleted and request metadata cleared by retention cleanup",
+		},
+		[]string{"kind"},
+	)
+
+	Transforms = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_transforms_total",
+			Help: "Payload transform runs by plugin, phase and result",
+		},
+		[]string{"plugin", "phase", "result"},
+	)
+
+	BudgetRejections = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sybil_api_budget_rejections_total",
+			Help: "Requests rejected for exceeding a budget cap",
+		},
+	)
+
+	UsageBucketErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sybil_api_usage_bucket_errors_total",
+			Help: "Charges that could not be added to a redis usage bucket and were charged directly",
+		},
+	)
+	UsageJournalErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sybil_api_usage_journal_errors_total",
+			Help: "Direct charges that could not be written to the usage journal",
+		},
+	)
+	UsageJournalReplayed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sybil_api_usage_journal_replayed_total",
+			Help: "Journaled direct charges retried after failing or a restart",
+		},
+	)
+	UsageFlushDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "sybil_api_usage_flush_duration_seconds",
+			Help:    "Time taken to charge and save a usage bucket",
+			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+	)
+	UsageFlushBatchSize = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "sybil_api_usage_flush_batch_size",
+			Help:    "Requests charged per usage bucket flush",
+			Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+		},
+	)
+	UsageFlushLeader = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sybil_api_usage_flush_leader",
+			Help: "Whether this instance holds the usage bucket flusher lease",
+		},
+	)
 	ErrorCount = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "sybil_api_error_count",
@@ -108,6 +397,27 @@ var (
 		},
 		[]string{"model", "endpoint", "user_id", "from"},
 	)
+	HeroCards = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_hero_cards_total",
+			Help: "Hero card lookups by intent and result",
+		},
+		[]string{"intent", "result"},
+	)
+	TokenizerLoads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_tokenizer_loads_total",
+			Help: "Tokenizer loads by where they were loaded from and result",
+		},
+		[]string{"from", "result"},
+	)
+	APIVersionRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_version_requests_total",
+			Help: "Requests per api version and route",
+		},
+		[]string{"version", "route"},
+	)
 	ResponseCodes = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "sybil_api_status_code",
@@ -116,4 +426,25 @@ var (
 		[]string{"path", "status_code"},
 		// we don't need model here because we know what models are being failed from error count
 	)
+	CompressionBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_compression_bytes_total",
+			Help: "Body bytes of compressed responses before and after compression by path and encoding",
+		},
+		[]string{"path", "encoding", "size"},
+	)
+	UpstreamConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sybil_api_upstream_connections",
+			Help: "Connections open to each model backend host",
+		},
+		[]string{"host"},
+	)
+	AutoRefunds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sybil_api_auto_refunds_total",
+			Help: "Incomplete billed requests refunded by reconciliation by result",
+		},
+		[]string{"result"},
+	)
 )
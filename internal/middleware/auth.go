@@ -4,9 +4,13 @@ package middleware
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"sybil-api/internal/ctx"
+	"sybil-api/internal/database"
+	"sybil-api/internal/jwtauth"
 	"sybil-api/internal/shared"
 
 	"github.com/labstack/echo/v4"
@@ -17,7 +21,12 @@ import (
 type UserMiddleware struct {
 	redis *redis.Client
 	rdb   *sql.DB
+	wdb   *sql.DB
 	log   *zap.SugaredLogger
+	// Verifies web session tokens, nil when sessions are not accepted
+	sessions *jwtauth.Verifier
+	// Sends credit reads to the primary while the replica lags
+	lag *database.LagMonitor
 }
 
 var (
@@ -25,10 +34,10 @@ var (
 	userManagerMutex sync.Mutex
 )
 
-func InitUserMiddleware(r *redis.Client, rdb *sql.DB, log *zap.SugaredLogger) {
+func InitUserMiddleware(r *redis.Client, rdb *sql.DB, wdb *sql.DB, log *zap.SugaredLogger, sessions *jwtauth.Verifier, lag *database.LagMonitor) {
 	userManagerMutex.Lock()
 	defer userManagerMutex.Unlock()
-	um := NewUserMiddleware(r, rdb, log)
+	um := NewUserMiddleware(r, rdb, wdb, log, sessions, lag)
 	userManager = um
 }
 
@@ -41,11 +50,14 @@ func GetUserMiddleware() (*UserMiddleware, error) {
 	return userManager, nil
 }
 
-func NewUserMiddleware(r *redis.Client, rdb *sql.DB, log *zap.SugaredLogger) *UserMiddleware {
+func NewUserMiddleware(r *redis.Client, rdb *sql.DB, wdb *sql.DB, log *zap.SugaredLogger, sessions *jwtauth.Verifier, lag *database.LagMonitor) *UserMiddleware {
 	return &UserMiddleware{
-		redis: r,
-		rdb:   rdb,
-		log:   log,
+		redis:    r,
+		rdb:      rdb,
+		wdb:      wdb,
+		log:      log,
+		sessions: sessions,
+		lag:      lag,
 	}
 }
 
@@ -58,22 +70,55 @@ func (u *UserMiddleware) ExtractUser(next echo.HandlerFunc) echo.HandlerFunc {
 		if err != nil {
 			return next(c)
 		}
+		if u.sessions != nil && jwtauth.LooksLikeJWT(apiKey) {
+			return u.extractSession(c, apiKey, next)
+		}
 		user, err := u.getUserMetadataFromKey(apiKey, c.Request().Context())
 		if err != nil {
 			return next(c)
 		}
-		c.User = user
-		c.Log = c.Log.With("user_id", c.User.UserID)
-		c.LogValues.UserID = user.UserID
-		c.LogValues.Credits = user.Credits
-		c.LogValues.PlanRequests = user.PlanRequests
-		c.LogValues.AllowOverspend = user.AllowOverspend
-		c.LogValues.StoreData = user.StoreData
-		c.LogValues.Role = user.Role
+		// Cached metadata can outlive the key by up to UserInfoCacheTTL
+		if user.ExpiresAt != nil && time.Now().Unix() >= *user.ExpiresAt {
+			return next(c)
+		}
+		// Checked before the request does any database work of its own
+		if reason := keyRestrictionViolation(user, c.RealIP(), c.Request().Header.Get("Origin")); reason != "" {
+			return u.rejectRestrictedKey(c, user, reason)
+		}
+		go u.touchAPIKey(apiKey)
+		setUser(c, user)
 		return next(c)
 	}
 }
 
+// extractSession authenticates a web session token signed by the frontend.
+// Invalid tokens are treated like a missing api key
+func (u *UserMiddleware) extractSession(c *ctx.Context, token string, next echo.HandlerFunc) error {
+	claims, err := u.sessions.Verify(c.Request().Context(), token)
+	if err != nil {
+		c.Log.Debugw("Invalid session token", "error", err)
+		return next(c)
+	}
+	user, err := u.getUserMetadataFromSession(claims, token, c.Request().Context())
+	if err != nil {
+		return next(c)
+	}
+	setUser(c, user)
+	return next(c)
+}
+
+func setUser(c *ctx.Context, user *shared.UserMetadata) {
+	c.User = user
+	c.SetLog(c.Log.With("user_id", c.User.UserID))
+	c.LogValues.UserID = user.UserID
+	c.LogValues.Credits = user.Credits
+	c.LogValues.PlanRequests = user.PlanRequests
+	c.LogValues.AllowOverspend = user.AllowOverspend
+	c.LogValues.StoreData = user.StoreData
+	c.LogValues.Role = user.Role
+	c.LogValues.OrganizationID = user.OrganizationID
+}
+
 func (u *UserMiddleware) RequireUser(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(cc echo.Context) error {
 		c := cc.(*ctx.Context)
@@ -84,12 +129,16 @@ func (u *UserMiddleware) RequireUser(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-func (u *UserMiddleware) RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(cc echo.Context) error {
-		c := cc.(*ctx.Context)
-		if c.User == nil || c.User.Role != "ADMIN" {
-			return c.String(401, "unauthorized")
+// RequireScope rejects requests whose api key was not granted scope. Must run
+// after RequireUser
+func (u *UserMiddleware) RequireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(cc echo.Context) error {
+			c := cc.(*ctx.Context)
+			if c.User == nil || !c.User.HasScope(scope) {
+				return c.JSON(403, map[string]string{"error": fmt.Sprintf("api key is missing the %s scope", scope)})
+			}
+			return next(c)
 		}
-		return next(c)
 	}
 }
@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+	emw "github.com/labstack/echo/v4/middleware"
+)
+
+// compressedRoutes are the reads that can run to hundreds of KB, without
+// their version prefix
+var compressedRoutes = []string{
+	"/models",
+	"/usage",
+	"/usage/export",
+	"/chat/history",
+	"/chat/history/:id",
+	"/search/history",
+}
+
+// NewCompressMiddleware compresses the responses of compressedRoutes with
+// brotli for clients that accept it and gzip otherwise. Event streams are
+// never compressed, proxies would hold back their frames. The original and
+// sent sizes are counted per route and encoding
+func NewCompressMiddleware() echo.MiddlewareFunc {
+	gzip := emw.GzipWithConfig(emw.GzipConfig{
+		Skipper:   func(echo.Context) bool { return false },
+		MinLength: shared.CompressMinBytes,
+	})
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if skipCompression(c) {
+				return next(c)
+			}
+			compress := gzip
+			if acceptsBrotli(c.Request().Header.Get(echo.HeaderAcceptEncoding)) {
+				compress = brotliCompress
+			}
+			// Counted on both sides of the compressing writer
+			sent := &countingWriter{ResponseWriter: c.Response().Writer}
+			original := &countingWriter{}
+			c.Response().Writer = sent
+			err := compress(func(c echo.Context) error {
+				original.ResponseWriter = c.Response().Writer
+				c.Response().Writer = original
+				return next(c)
+			})(c)
+			c.Response().Writer = sent.ResponseWriter
+
+			if encoding := c.Response().Header().Get(echo.HeaderContentEncoding); encoding == "gzip" || encoding == "br" {
+				metrics.CompressionBytes.WithLabelValues(c.Path(), encoding, "original").Add(float64(original.n))
+				metrics.CompressionBytes.WithLabelValues(c.Path(), encoding, "sent").Add(float64(sent.n))
+			}
+			return err
+		}
+	}
+}
+
+// acceptsBrotli reports whether an Accept-Encoding header lists br without a
+// zero quality
+func acceptsBrotli(acceptEncoding string) bool {
+	for part := range strings.SplitSeq(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "br") {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		quality, err := strconv.ParseFloat(q, 64)
+		return err == nil && quality > 0
+	}
+	return false
+}
+
+// brotliCompress sends the response brotli encoded once it reaches
+// shared.CompressMinBytes, smaller responses go out as is
+func brotliCompress(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		res := c.Response()
+		res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+		w := &brotliWriter{ResponseWriter: res.Writer}
+		res.Writer = w
+		defer func() {
+			w.close()
+			res.Writer = w.ResponseWriter
+		}()
+		return next(c)
+	}
+}
+
+// brotliWriter holds back the status and body until the body is large enough
+// to be worth compressing, or the handler flushes or finishes
+type brotliWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     bytes.Buffer
+	br      *brotli.Writer
+	written bool
+}
+
+func (w *brotliWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *brotliWriter) Write(b []byte) (int, error) {
+	if w.written {
+		if w.br == nil {
+			return w.ResponseWriter.Write(b)
+		}
+		return w.br.Write(b)
+	}
+	w.buf.Write(b)
+	if w.buf.Len() >= shared.CompressMinBytes {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start sends the held back status and body, compressed when compress is
+// set and the handler did not encode the body itself
+func (w *brotliWriter) start(compress bool) error {
+	w.written = true
+	header := w.Header()
+	if compress && header.Get(echo.HeaderContentEncoding) == "" {
+		header.Set(echo.HeaderContentEncoding, "br")
+		header.Del(echo.HeaderContentLength)
+		w.br = brotli.NewWriterLevel(w.ResponseWriter, brotli.DefaultCompression)
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.br != nil {
+		_, err = w.br.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+// Flush commits to compressing, a flushing handler is streaming a body of
+// unknown size
+func (w *brotliWriter) Flush() {
+	if !w.written {
+		_ = w.start(true)
+	}
+	if w.br != nil {
+		_ = w.br.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *brotliWriter) close() {
+	if !w.written {
+		_ = w.start(false)
+	}
+	if w.br != nil {
+		_ = w.br.Close()
+	}
+}
+
+func (w *brotliWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func skipCompression(c echo.Context) bool {
+	req := c.Request()
+	if req.Method != http.MethodGet || strings.Contains(req.Header.Get(echo.HeaderAccept), "text/event-stream") {
+		return true
+	}
+	path := c.Path()
+	if rest, ok := strings.CutPrefix(path, "/v"); ok {
+		if i := strings.IndexByte(rest, '/'); i > 0 {
+			path = rest[i:]
+		}
+	}
+	return !slices.Contains(compressedRoutes, path)
+}
+
+// countingWriter counts the body bytes written through it
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
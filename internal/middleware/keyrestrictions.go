@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+const (
+	restrictionIP     = "ip"
+	restrictionOrigin = "origin"
+)
+
+// keyRestrictionViolation returns which allowlist of the api key the request
+// fails, or an empty string when it passes. Keys restricted to origins reject
+// requests without an Origin header
+func keyRestrictionViolation(user *shared.UserMetadata, ip string, origin string) string {
+	if len(user.AllowedIPs) > 0 && !ipAllowed(user.AllowedIPs, ip) {
+		return restrictionIP
+	}
+	if len(user.AllowedOrigins) > 0 {
+		normalized, err := shared.NormalizeOrigin(origin)
+		if err != nil || !slices.Contains(user.AllowedOrigins, normalized) {
+			return restrictionOrigin
+		}
+	}
+	return ""
+}
+
+func ipAllowed(allowed []string, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, entry := range allowed {
+		prefix, err := shared.ParseAllowedIP(entry)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectRestrictedKey responds 403 to a request from outside the keys
+// allowlist and records the attempt in api_key_rejection
+func (u *UserMiddleware) rejectRestrictedKey(c *ctx.Context, user *shared.UserMetadata, reason string) error {
+	metrics.APIKeyRestricted.WithLabelValues(reason).Inc()
+	ip, origin := c.RealIP(), c.Request().Header.Get("Origin")
+	c.Log.Warnw("Rejected request outside api key allowlist", "user_id", user.UserID, "key_id", user.KeyID, "reason", reason, "ip", ip, "origin", origin)
+	go u.logKeyRejection(user.UserID, user.KeyID, ip, origin, reason)
+	return c.JSON(403, map[string]string{"error": fmt.Sprintf("api key cannot be used from this %s", reason)})
+}
+
+// logKeyRejection writes the rejected attempt to the audit table. Writes are
+// throttled through redis so a blocked client retrying in a loop only adds one
+// row per key, address and reason every APIKeyRejectionLogInterval
+func (u *UserMiddleware) logKeyRejection(userID uint64, keyID string, ip string, origin string, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	throttleKey := fmt.Sprintf("sybil:v1:apikey:rejected:%s:%s:%s", keyID, reason, ip)
+	ok, err := u.redis.SetNX(ctx, throttleKey, 1, shared.APIKeyRejectionLogInterval).Result()
+	if err != nil || !ok {
+		return
+	}
+	var originValue *string
+	if origin != "" {
+		originValue = &origin
+	}
+	_, err = u.wdb.ExecContext(ctx, `
+		INSERT INTO api_key_rejection (user_id, api_key_public_id, reason, ip, origin)
+		VALUES (?, ?, ?, ?, ?)
+	`, userID, keyID, reason, ip, originValue)
+	if err != nil {
+		u.log.Warnw("Failed to log api key rejection", "error", err, "key_id", keyID)
+	}
+}
@@ -19,14 +19,16 @@ func NewTrackMiddleware(log *zap.SugaredLogger) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			reqID, _ := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 28)
+			externalID := c.Request().Header.Get("X-External-Request-Id")
 			logger := log.With(
 				"request_id", "req_"+reqID,
+				"externalid", externalID,
+				"route", c.Path(),
 			)
-			externalID := c.Request().Header.Get("X-External-Request-Id")
-			logger = logger.With("externalid", externalID)
 
 			start := time.Now()
-			cc := &ctx.Context{Context: c, Log: logger, Reqid: reqID, LogValues: &ctx.ContextLogValues{RequestID: reqID, ExternalID: externalID, StartTime: start, Path: c.Path()}}
+			cc := &ctx.Context{Context: c, Reqid: reqID, LogValues: &ctx.ContextLogValues{RequestID: reqID, ExternalID: externalID, StartTime: start, Path: c.Path()}}
+			cc.SetLog(logger)
 			err := next(cc)
 			cc.LogValues.RequestDuration = time.Since(start)
 			status := cc.Response().Status
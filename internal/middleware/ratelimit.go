@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/ratelimit"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RateLimit enforces the requests and tokens per minute of the api key. Tokens
+// are only known once a request finishes, so a request is let through while
+// the token bucket is not empty and its usage is taken afterwards by the
+// inference handler. Limits fail open when redis is unavailable. Must run
+// after RequireUser
+func (u *UserMiddleware) RateLimit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(cc echo.Context) error {
+		c := cc.(*ctx.Context)
+		limit := c.User.RateLimit()
+		rctx, cancel := context.WithTimeout(c.Request().Context(), shared.RateLimitTimeout)
+		defer cancel()
+
+		header := c.Response().Header()
+		if limit.RequestsPerMinute > 0 {
+			res, err := ratelimit.Take(rctx, u.redis, ratelimit.RequestsKey(c.User.RateLimitKey()), limit.RequestsPerMinute, 1, false)
+			if err != nil {
+				c.Log.Warnw("Failed to check request rate limit", "error", err)
+			} else {
+				setRateLimitHeaders(header, "Requests", res)
+				if !res.Allowed {
+					return rateLimited(c, "requests", res)
+				}
+			}
+		}
+		if limit.TokensPerMinute > 0 {
+			res, err := ratelimit.Take(rctx, u.redis, ratelimit.TokensKey(c.User.RateLimitKey()), limit.TokensPerMinute, 0, false)
+			if err != nil {
+				c.Log.Warnw("Failed to check token rate limit", "error", err)
+			} else {
+				setRateLimitHeaders(header, "Tokens", res)
+				if !res.Allowed {
+					return rateLimited(c, "tokens", res)
+				}
+			}
+		}
+		return next(c)
+	}
+}
+
+// rateLimitKinds are the limits RateLimit reports headers for
+var rateLimitKinds = []string{"Requests", "Tokens"}
+
+// RateLimitHeaders lists the headers RateLimit may set
+func RateLimitHeaders() []string {
+	headers := []string{}
+	for _, kind := range rateLimitKinds {
+		headers = append(headers, "X-RateLimit-Limit-"+kind, "X-RateLimit-Remaining-"+kind, "X-RateLimit-Reset-"+kind)
+	}
+	return append(headers, "Retry-After")
+}
+
+func setRateLimitHeaders(header http.Header, kind string, res ratelimit.Result) {
+	header.Set("X-RateLimit-Limit-"+kind, strconv.FormatUint(res.Limit, 10))
+	header.Set("X-RateLimit-Remaining-"+kind, strconv.FormatInt(max(res.Remaining, 0), 10))
+	header.Set("X-RateLimit-Reset-"+kind, formatSeconds(res.Reset))
+}
+
+func rateLimited(c *ctx.Context, kind string, res ratelimit.Result) error {
+	metrics.RateLimited.WithLabelValues(kind).Inc()
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(res.RetryAfter().Seconds())), 10))
+	return c.JSON(http.StatusTooManyRequests, shared.OpenAIError{
+		Message: fmt.Sprintf("rate limit reached for %s per minute, retry after %s", kind, formatSeconds(res.RetryAfter())),
+		Object:  "error",
+		Type:    "RateLimitExceeded",
+		Code:    http.StatusTooManyRequests,
+	})
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(math.Ceil(d.Seconds()*1000)/1000, 'f', -1, 64) + "s"
+}
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	PermModelsRead     = "models:read"
+	PermModelsWrite    = "models:write"
+	PermReviewRead     = "review:read"
+	PermReviewWrite    = "review:write"
+	PermPoliciesRead   = "policies:read"
+	PermPoliciesWrite  = "policies:write"
+	PermCreditsRead    = "credits:read"
+	PermCreditsWrite   = "credits:write"
+	PermKeysWrite      = "keys:write"
+	PermPricingWrite   = "pricing:write"
+	PermCapacityWrite  = "capacity:write"
+	PermSearchWrite    = "search:write"
+	permissionWildcard = "*"
+)
+
+// rolePermissions maps the user role column to what it can do on admin
+// routes. Roles not listed here have no admin access
+var rolePermissions = map[string][]string{
+	shared.RoleAdmin: {permissionWildcard},
+	shared.RoleOperator: {
+		PermModelsRead, PermModelsWrite,
+		PermReviewRead, PermReviewWrite,
+		PermPoliciesRead, PermPoliciesWrite,
+		PermSearchWrite,
+	},
+	shared.RoleBilling: {PermCreditsRead, PermCreditsWrite, PermModelsRead, PermPricingWrite, PermCapacityWrite},
+	shared.RoleViewer:  {PermModelsRead, PermReviewRead, PermPoliciesRead, PermCreditsRead},
+}
+
+// HasPermission reports whether role grants permission
+func HasPermission(role string, permission string) bool {
+	perms := rolePermissions[role]
+	return slices.Contains(perms, permissionWildcard) || slices.Contains(perms, permission)
+}
+
+// RequirePermission rejects requests from users whose role does not grant
+// permission. The api key must also carry the admin scope
+func (u *UserMiddleware) RequirePermission(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(cc echo.Context) error {
+			c := cc.(*ctx.Context)
+			if c.User == nil || !c.User.HasScope(shared.ScopeAdmin) {
+				return c.String(401, "unauthorized")
+			}
+			if !HasPermission(c.User.Role, permission) {
+				return c.JSON(403, map[string]string{"error": "role " + strings.ToLower(c.User.Role) + " is missing the " + permission + " permission"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Audit records an admin_audit_log row for every successful request through
+// the route. The row is written before the handler returns, so a change
+// is not acknowledged without its entry unless every attempt failed
+func (u *UserMiddleware) Audit(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(cc echo.Context) error {
+			c := cc.(*ctx.Context)
+
+			// Keep a copy of the start of the body so the entry shows what was
+			// changed, the handler still reads all of it
+			var body []byte
+			if c.Request().Body != nil {
+				original := c.Request().Body
+				body, _ = io.ReadAll(io.LimitReader(original, shared.AuditLogMaxBodyBytes))
+				c.Request().Body = readCloser{io.MultiReader(bytes.NewReader(body), original), original}
+			}
+
+			err := next(c)
+			status := responseStatus(c, err)
+			if c.User == nil || status >= 400 {
+				return err
+			}
+
+			params := map[string]string{}
+			for _, name := range c.ParamNames() {
+				params[name] = c.Param(name)
+			}
+			paramsJSON, _ := json.Marshal(params)
+			auditCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for attempt := 1; ; attempt++ {
+				_, auditErr := u.wdb.ExecContext(auditCtx, `
+					INSERT INTO admin_audit_log (user_id, role, action, params, body, request_id, status_code)
+					VALUES (?, ?, ?, ?, ?, ?, ?)
+				`, c.User.UserID, c.User.Role, action, string(paramsJSON), string(body), c.Reqid, status)
+				if auditErr == nil {
+					break
+				}
+				if attempt == auditWriteAttempts || auditCtx.Err() != nil {
+					c.Log.Errorw("Failed to write admin audit log", "error", auditErr, "action", action, "attempts", attempt)
+					break
+				}
+				select {
+				case <-auditCtx.Done():
+				case <-time.After(time.Duration(attempt) * 200 * time.Millisecond):
+				}
+			}
+			return err
+		}
+	}
+}
+
+// Times an audit row is tried before the failure is only logged
+const auditWriteAttempts = 3
+
+// responseStatus is the status the client gets for a handler that returned
+// err. Returned errors are only written by echos error handler after the
+// middleware, so Response().Status does not have it yet
+func responseStatus(c echo.Context, err error) int {
+	if err == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	var rerr *shared.RequestError
+	if errors.As(err, &rerr) {
+		return rerr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// readCloser reads from Reader and closes the original request body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
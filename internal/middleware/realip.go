@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NewIPExtractor returns how c.RealIP finds the client address. X-Forwarded-For
+// is only read from peers in trustedProxies, comma separated CIDRs like
+// 10.0.0.0/8, and only its hops added by those proxies are skipped. Without
+// trusted proxies the peer address is used, so clients cannot pick the ip
+// that key allowlists and abuse scoring see
+func NewIPExtractor(trustedProxies string) (echo.IPExtractor, error) {
+	ranges, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, ipRange := range ranges {
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+func parseTrustedProxies(trustedProxies string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, entry := range strings.Split(trustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		_, ipRange, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %w", entry, err)
+		}
+		ranges = append(ranges, ipRange)
+	}
+	return ranges, nil
+}
+
+// fromTrustedProxy reports whether the peer of req is in ranges
+func fromTrustedProxy(req *http.Request, ranges []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipRange := range ranges {
+		if ipRange.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"sybil-api/internal/shared"
+	"sybil-api/internal/signing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// NewSignatureMiddleware requires requests to be signed with secret, on top
+// of their bearer token. Each nonce is accepted once, tracked in redis for
+// twice the allowed clock skew. Without a secret requests pass unchecked
+func NewSignatureMiddleware(secret string, redisClient *redis.Client, log *zap.SugaredLogger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if secret == "" {
+			return next
+		}
+		return func(c echo.Context) error {
+			var body []byte
+			if c.Request().Body != nil {
+				var err error
+				body, err = io.ReadAll(c.Request().Body)
+				if err != nil {
+					return c.JSON(400, map[string]string{"error": "failed to read body"})
+				}
+				c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			}
+
+			nonce, err := signing.Verify(secret, c.Request().Header, c.Request().Method, c.Request().URL.RequestURI(), body, time.Now(), shared.SignatureMaxSkew)
+			if err != nil {
+				log.Warnw("Rejected unsigned admin request", "error", err, "path", c.Path(), "ip", c.RealIP())
+				return c.JSON(401, map[string]string{"error": err.Error()})
+			}
+
+			ctx, cancel := context.WithTimeout(c.Request().Context(), shared.RateLimitTimeout)
+			defer cancel()
+			fresh, err := redisClient.SetNX(ctx, "sybil:v1:signing:nonce:"+nonce, 1, 2*shared.SignatureMaxSkew).Result()
+			if err != nil {
+				// Replays cannot be ruled out, fail closed on the control plane
+				log.Errorw("Failed to record signature nonce", "error", err)
+				return c.JSON(503, map[string]string{"error": "service unavailable"})
+			}
+			if !fresh {
+				log.Warnw("Rejected replayed admin request", "path", c.Path(), "ip", c.RealIP())
+				return c.JSON(401, map[string]string{"error": "signature nonce already used"})
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTraceMiddleware starts a server span per request. Only requests from
+// trustedProxies, comma separated CIDRs like for NewIPExtractor, continue the
+// trace of their traceparent header. Anyone else starts a new trace with a
+// link to theirs, so clients cannot force sampling or join our traces. Only
+// the route is recorded, paths can hold share tokens and search ids. It runs
+// after NewTrackMiddleware so the span carries the request id and the request
+// logger carries the trace id
+func NewTraceMiddleware(trustedProxies string) (echo.MiddlewareFunc, error) {
+	ranges, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	tracer := otel.Tracer(shared.TraceServiceName)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			options := []trace.SpanStartOption{
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", req.Method),
+					attribute.String("http.route", c.Path()),
+				),
+			}
+			parent := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			if !fromTrustedProxy(req, ranges) {
+				if remote := trace.SpanContextFromContext(parent); remote.IsValid() {
+					options = append(options, trace.WithLinks(trace.Link{SpanContext: remote}))
+				}
+				parent = req.Context()
+				options = append(options, trace.WithNewRoot())
+			}
+			spanCtx, span := tracer.Start(parent, req.Method+" "+c.Path(), options...)
+			defer span.End()
+			c.SetRequest(req.WithContext(spanCtx))
+
+			if cc, ok := c.(*ctx.Context); ok {
+				span.SetAttributes(attribute.String("sybil.request_id", "req_"+cc.Reqid))
+				if span.SpanContext().IsValid() {
+					cc.SetLog(cc.Log.With("trace_id", span.SpanContext().TraceID().String()))
+				}
+			}
+
+			err := next(c)
+			status := c.Response().Status
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, fmt.Sprintf("status %d", status))
+			}
+			if err != nil {
+				span.RecordError(err)
+			}
+			return err
+		}
+	}, nil
+}
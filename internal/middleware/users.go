@@ -5,15 +5,70 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"sybil-api/internal/jwtauth"
 	"sybil-api/internal/shared"
 )
 
+// userMetadataColumns are the user and organization columns shared by api key
+// and session lookups, scanned by userMetadataDest
+const userMetadataColumns = `
+		user.id,
+		user.email,
+		GREATEST(IF(organization.id IS NULL, user.credits, organization.credits), 0),
+		IF(organization.id IS NULL, user.plan_requests, organization.plan_requests),
+		IF(organization.id IS NULL, user.allow_overspend, organization.allow_overspend),
+		user.role,
+		COALESCE(organization.id, 0),
+		COALESCE(user.organization_role, ''),
+		COALESCE(IF(organization.id IS NULL, user.data_residency, organization.data_residency), ''),
+		user.encrypt_history,
+		user.store_data,
+		COALESCE(user.pii_redaction, ''),
+		COALESCE(user.rate_limit_tier, ''),
+		COALESCE(user.search_region, ''),
+		COALESCE(user.search_language, ''),
+		COALESCE(user.search_safe, '')`
+
+func userMetadataDest(m *shared.UserMetadata) []any {
+	return []any{
+		&m.UserID,
+		&m.Email,
+		&m.Credits,
+		&m.PlanRequests,
+		&m.AllowOverspend,
+		&m.Role,
+		&m.OrganizationID,
+		&m.OrganizationRole,
+		&m.DataResidency,
+		&m.EncryptHistory,
+		&m.StoreData,
+		&m.PIIRedaction,
+		&m.RateLimitTier,
+		&m.SearchRegion,
+		&m.SearchLanguage,
+		&m.SearchSafe,
+	}
+}
+
+// userDB is where user metadata is loaded from. It carries the credit balance
+// requests are checked against, so a lagging replica is skipped
+func (u *UserMiddleware) userDB() *sql.DB {
+	if u.lag == nil {
+		return u.rdb
+	}
+	return u.lag.ReadDB("credits")
+}
+
 func (u *UserMiddleware) getUserMetadataFromKey(apiKey string, ctx context.Context) (*shared.UserMetadata, error) {
 	var userMetadata shared.UserMetadata
 	userMetadata.APIKey = apiKey
 
-	userInfoCacheKey := fmt.Sprintf("sybil:v4:user:apikey:%s", apiKey)
+	userInfoCacheKey := shared.APIKeyCacheKey(apiKey)
 	userInfoCache, err := u.redis.Get(ctx, userInfoCacheKey).Result()
 	switch err {
 	case nil:
@@ -26,25 +81,34 @@ func (u *UserMiddleware) getUserMetadataFromKey(apiKey string, ctx context.Conte
 	default:
 		u.log.Debugw("User cache miss", "key", userInfoCacheKey)
 
-		err = u.rdb.QueryRowContext(ctx, `
-		SELECT
-		user.id,
-		user.email,
-		user.credits,
-		user.plan_requests,
-		user.allow_overspend,
-		user.role
+		var scopesJSON, allowedIPsJSON, allowedOriginsJSON *string
+
+		err = u.userDB().QueryRowContext(ctx, `
+		SELECT `+userMetadataColumns+`,
+		api_key.scopes,
+		UNIX_TIMESTAMP(api_key.expires_at),
+		api_key.rate_limit_rpm,
+		api_key.rate_limit_tpm,
+		api_key.public_id,
+		api_key.allowed_ips,
+		api_key.allowed_origins,
+		api_key.hide_reasoning
 		FROM user
 		INNER JOIN api_key ON user.id = api_key.user_id
+		LEFT JOIN organization ON user.organization_id = organization.id
 		WHERE api_key.id = ?
-		`, apiKey).Scan(
-			&userMetadata.UserID,
-			&userMetadata.Email,
-			&userMetadata.Credits,
-			&userMetadata.PlanRequests,
-			&userMetadata.AllowOverspend,
-			&userMetadata.Role,
-		)
+		AND api_key.revoked_at IS NULL
+		AND (api_key.expires_at IS NULL OR api_key.expires_at > NOW())
+		`, apiKey).Scan(append(userMetadataDest(&userMetadata),
+			&scopesJSON,
+			&userMetadata.ExpiresAt,
+			&userMetadata.KeyRPM,
+			&userMetadata.KeyTPM,
+			&userMetadata.KeyID,
+			&allowedIPsJSON,
+			&allowedOriginsJSON,
+			&userMetadata.HideReasoning,
+		)...)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				u.log.Warnw("Invalid API key or inactive plan", "key", apiKey)
@@ -53,6 +117,25 @@ func (u *UserMiddleware) getUserMetadataFromKey(apiKey string, ctx context.Conte
 			u.log.Errorw("Database error during API key validation", "error", err)
 			return nil, shared.ErrUnauthorized
 		}
+		if scopesJSON != nil {
+			if err := json.Unmarshal([]byte(*scopesJSON), &userMetadata.Scopes); err != nil {
+				u.log.Errorw("Invalid api key scopes", "error", err, "user_id", userMetadata.UserID)
+				return nil, shared.ErrUnauthorized
+			}
+		}
+		// Fail closed, a key whose allowlist cannot be read is not usable
+		if allowedIPsJSON != nil {
+			if err := json.Unmarshal([]byte(*allowedIPsJSON), &userMetadata.AllowedIPs); err != nil {
+				u.log.Errorw("Invalid api key ip allowlist", "error", err, "user_id", userMetadata.UserID)
+				return nil, shared.ErrUnauthorized
+			}
+		}
+		if allowedOriginsJSON != nil {
+			if err := json.Unmarshal([]byte(*allowedOriginsJSON), &userMetadata.AllowedOrigins); err != nil {
+				u.log.Errorw("Invalid api key origin allowlist", "error", err, "user_id", userMetadata.UserID)
+				return nil, shared.ErrUnauthorized
+			}
+		}
 		go func() {
 			userInfoCache, err := json.Marshal(userMetadata)
 			if err != nil {
@@ -64,3 +147,77 @@ func (u *UserMiddleware) getUserMetadataFromKey(apiKey string, ctx context.Conte
 		return &userMetadata, nil
 	}
 }
+
+// touchAPIKey records when the key was last used. Writes are throttled through
+// redis so busy keys only update the row once per APIKeyLastUsedInterval
+func (u *UserMiddleware) touchAPIKey(apiKey string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	throttleKey := fmt.Sprintf("sybil:v1:apikey:lastused:%s", apiKey)
+	ok, err := u.redis.SetNX(ctx, throttleKey, 1, shared.APIKeyLastUsedInterval).Result()
+	if err != nil || !ok {
+		return
+	}
+	if _, err := u.wdb.ExecContext(ctx, "UPDATE api_key SET last_used_at = NOW() WHERE id = ?", apiKey); err != nil {
+		u.log.Warnw("Failed to update api key last used", "error", err)
+	}
+}
+
+// getUserMetadataFromSession loads the user a verified session token was
+// issued to. The cache only holds the user, scopes and expiry come from the
+// token itself
+func (u *UserMiddleware) getUserMetadataFromSession(claims *jwtauth.Claims, token string, ctx context.Context) (*shared.UserMetadata, error) {
+	userID, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		u.log.Warnw("Session token subject is not a user id", "sub", claims.Subject)
+		return nil, shared.ErrUnauthorized
+	}
+
+	var userMetadata shared.UserMetadata
+	cacheKey := shared.SessionCacheKey(userID)
+	cached, err := u.redis.Get(ctx, cacheKey).Result()
+	if err == nil && json.Unmarshal([]byte(cached), &userMetadata) == nil {
+		return applySessionClaims(&userMetadata, claims, token), nil
+	}
+
+	err = u.userDB().QueryRowContext(ctx, `
+		SELECT `+userMetadataColumns+`
+		FROM user
+		LEFT JOIN organization ON user.organization_id = organization.id
+		WHERE user.id = ?
+	`, userID).Scan(userMetadataDest(&userMetadata)...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			u.log.Warnw("Session token for unknown user", "user_id", userID)
+			return nil, shared.ErrUnauthorized
+		}
+		u.log.Errorw("Database error during session validation", "error", err)
+		return nil, shared.ErrUnauthorized
+	}
+	// Marshalled before the claims are applied so they never leak into the
+	// cache shared by the users other sessions
+	userInfoCache, err := json.Marshal(userMetadata)
+	if err != nil {
+		u.log.Errorw("Error marshalling user info", "error", err)
+	} else {
+		go u.redis.Set(ctx, cacheKey, userInfoCache, shared.UserInfoCacheTTL)
+	}
+	return applySessionClaims(&userMetadata, claims, token), nil
+}
+
+// applySessionClaims limits the session to the scopes in its token. Sessions
+// without a scope claim act with the full access of the signed in user
+func applySessionClaims(m *shared.UserMetadata, claims *jwtauth.Claims, token string) *shared.UserMetadata {
+	m.SessionToken = token
+	m.ExpiresAt = &claims.ExpiresAt
+	if claims.Scope != nil {
+		m.Scopes = []string{}
+		for _, scope := range strings.Fields(*claims.Scope) {
+			if slices.Contains(shared.APIKeyScopes, scope) {
+				m.Scopes = append(m.Scopes, scope)
+			}
+		}
+	}
+	return m
+}
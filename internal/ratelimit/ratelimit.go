@@ -0,0 +1,89 @@
+// Package ratelimit implements token buckets in redis so limits are shared
+// across every replica
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript refills the bucket for the time since it was last used and takes
+// cost tokens. Buckets refill from empty to capacity over one minute. A cost of
+// zero only checks the bucket is not empty, and force takes the tokens even if
+// it leaves the bucket negative, for usage only known once a request is done.
+// Returns whether the take was allowed, the tokens left and the milliseconds
+// until the bucket is full again
+var takeScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local force = ARGV[4] == '1'
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * capacity / 60000)
+
+local allowed = 0
+if force or (cost == 0 and tokens > 0) or (cost > 0 and tokens >= cost) then
+	tokens = tokens - cost
+	allowed = 1
+end
+
+local full = math.ceil((capacity - tokens) * 60000 / capacity)
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], full + 1000)
+return {allowed, math.floor(tokens), full}
+`)
+
+// Result is the state of a bucket after a take
+type Result struct {
+	Allowed   bool
+	Limit     uint64
+	Remaining int64
+	// Time until the bucket is full again
+	Reset time.Duration
+}
+
+// RetryAfter is how long until the bucket has at least one token
+func (r Result) RetryAfter() time.Duration {
+	if r.Remaining > 0 || r.Limit == 0 {
+		return 0
+	}
+	return time.Duration(1-r.Remaining) * time.Minute / time.Duration(r.Limit)
+}
+
+// Take takes cost tokens from the bucket at key, which holds up to limit
+// tokens and refills completely every minute
+func Take(ctx context.Context, client *redis.Client, key string, limit uint64, cost uint64, force bool) (Result, error) {
+	forceArg := "0"
+	if force {
+		forceArg = "1"
+	}
+	values, err := takeScript.Run(ctx, client, []string{key}, limit, time.Now().UnixMilli(), cost, forceArg).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(values) != 3 {
+		return Result{}, fmt.Errorf("unexpected rate limit script result %v", values)
+	}
+	return Result{
+		Allowed:   values[0] == 1,
+		Limit:     limit,
+		Remaining: values[1],
+		Reset:     time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
+
+// RequestsKey is the bucket of requests per minute for an api key
+func RequestsKey(apiKey string) string {
+	return fmt.Sprintf("sybil:v1:ratelimit:%s:requests", apiKey)
+}
+
+// TokensKey is the bucket of tokens per minute for an api key
+func TokensKey(apiKey string) string {
+	return fmt.Sprintf("sybil:v1:ratelimit:%s:tokens", apiKey)
+}
@@ -0,0 +1,123 @@
+// Package redact replaces personal information in text with typed
+// placeholders like [EMAIL] before it is stored. Redactors can be chained, so
+// the built in patterns can run ahead of a model that catches what patterns
+// cannot, like names and addresses
+package redact
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// Counts are the redactions made by type
+type Counts map[string]int
+
+func (c Counts) add(other Counts) {
+	for kind, n := range other {
+		c[kind] += n
+	}
+}
+
+type Redactor interface {
+	// Redact returns text with personal information replaced. On error the
+	// text returned is the best redaction made so far
+	Redact(ctx context.Context, text string) (string, Counts, error)
+}
+
+type pattern struct {
+	kind  string
+	re    *regexp.Regexp
+	valid func(match string) bool
+}
+
+// Patterns run in order, so card numbers are taken before the phone pattern
+// can match part of one
+var patterns = []pattern{
+	{kind: "EMAIL", re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{kind: "CARD", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhn},
+	{kind: "SSN", re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	{kind: "IBAN", re: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,4})?\b`)},
+	{kind: "PHONE", re: regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?\(?\b\d{3}\)?[ .-]?\d{3}[ .-]?\d{4}\b`)},
+	{kind: "IP", re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`)},
+}
+
+// Regex redacts emails, card numbers, US social security numbers, IBANs,
+// phone numbers and IPv4 addresses
+type Regex struct{}
+
+func (Regex) Redact(_ context.Context, text string) (string, Counts, error) {
+	counts := Counts{}
+	for _, p := range patterns {
+		text = p.re.ReplaceAllStringFunc(text, func(match string) string {
+			if p.valid != nil && !p.valid(match) {
+				return match
+			}
+			counts[p.kind]++
+			return "[" + p.kind + "]"
+		})
+	}
+	return text, counts, nil
+}
+
+// Chain runs redactors one after the other on the output of the previous one.
+// It stops at the first error, returning what was redacted up to it
+func Chain(redactors ...Redactor) Redactor {
+	return chain(redactors)
+}
+
+type chain []Redactor
+
+func (c chain) Redact(ctx context.Context, text string) (string, Counts, error) {
+	counts := Counts{}
+	for _, r := range c {
+		redacted, n, err := r.Redact(ctx, text)
+		if err != nil {
+			return text, counts, err
+		}
+		text = redacted
+		counts.add(n)
+	}
+	return text, counts, nil
+}
+
+// Placeholders counts the placeholders in text by type, for redactors that
+// only return the redacted text
+func Placeholders(text string) Counts {
+	counts := Counts{}
+	for _, m := range placeholder.FindAllStringSubmatch(text, -1) {
+		counts[m[1]]++
+	}
+	return counts
+}
+
+var placeholder = regexp.MustCompile(`\[([A-Z_]{2,20})\]`)
+
+// Diff is the redactions in after that were not already in before
+func Diff(before, after Counts) Counts {
+	diff := Counts{}
+	for kind, n := range after {
+		if n > before[kind] {
+			diff[kind] = n - before[kind]
+		}
+	}
+	return diff
+}
+
+func luhn(match string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(match)
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -3,16 +3,28 @@ package routers
 import (
 	"database/sql"
 
+	"sybil-api/internal/handlers/apikeys"
+	"sybil-api/internal/handlers/billing"
+	"sybil-api/internal/handlers/capacity"
+	"sybil-api/internal/handlers/incidents"
+	"sybil-api/internal/handlers/modelalerts"
+	"sybil-api/internal/handlers/policy"
+	"sybil-api/internal/handlers/review"
 	"sybil-api/internal/handlers/targon"
+	"sybil-api/internal/handlers/transforms"
 	"sybil-api/internal/middleware"
+	"sybil-api/internal/search"
+	"sybil-api/internal/tokenizer"
 
 	"github.com/labstack/echo/v4"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
-func RegisterAdminRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, targonAPIKey, targonURL string, log *zap.SugaredLogger) error {
-	targonHandler, err := targon.NewTargonHandler(wdb, rdb, redisClient, targonAPIKey, targonURL, log)
+// RegisterAdminRoutes registers the staff routes. When adminSigningSecret is
+// set they must also be HMAC signed, see signing.SignRequest
+func RegisterAdminRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, targonAPIKey, targonURL, targonSigningSecret, adminSigningSecret string, tokenizers *tokenizer.Registry, log *zap.SugaredLogger) error {
+	targonHandler, err := targon.NewTargonHandler(wdb, rdb, redisClient, targonAPIKey, targonURL, targonSigningSecret, log)
 	if err != nil {
 		return err
 	}
@@ -25,12 +37,79 @@ func RegisterAdminRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, redisClient *r
 		return err
 	}
 
-	requireAdmin := e.Group("", umw.ExtractUser, umw.RequireAdmin)
+	// Every admin route checks the users role for the permission it needs,
+	// and mutations are written to the audit log
+	staff := e.Group("", middleware.NewSignatureMiddleware(adminSigningSecret, redisClient, log), umw.ExtractUser, umw.RequireUser)
+	perm := umw.RequirePermission
+	audit := umw.Audit
 
 	// Use router methods (which have correct echo.Context signature)
-	requireAdmin.POST("/models", targonRouter.CreateModel)
-	requireAdmin.DELETE("/models/:uid", targonRouter.DeleteModel)
-	requireAdmin.PATCH("/models", targonRouter.UpdateModel)
+	staff.POST("/models", targonRouter.CreateModel, perm(middleware.PermModelsWrite), audit("model.create"))
+	staff.DELETE("/models/:uid", targonRouter.DeleteModel, perm(middleware.PermModelsWrite), audit("model.delete"))
+	staff.PATCH("/models", targonRouter.UpdateModel, perm(middleware.PermModelsWrite), audit("model.update"))
+	staff.GET("/models/:uid/adapters", targonRouter.ListAdapters, perm(middleware.PermModelsRead))
+	staff.POST("/models/:uid/adapters", targonRouter.RegisterAdapter, perm(middleware.PermModelsWrite), audit("adapter.register"))
+	staff.DELETE("/models/:uid/adapters/:name", targonRouter.DeactivateAdapter, perm(middleware.PermModelsWrite), audit("adapter.deactivate"))
+	staff.GET("/models/:uid/aliases", targonRouter.ListAliases, perm(middleware.PermModelsRead))
+	staff.POST("/models/:uid/aliases", targonRouter.AddAliases, perm(middleware.PermModelsWrite), audit("alias.add"))
+	staff.DELETE("/models/:uid/aliases/:name", targonRouter.RemoveAlias, perm(middleware.PermModelsWrite), audit("alias.remove"))
+	staff.GET("/models/:uid/pricing", targonRouter.ListPrices, perm(middleware.PermModelsRead))
+	staff.POST("/models/:uid/pricing", targonRouter.SchedulePrice, perm(middleware.PermPricingWrite), audit("pricing.schedule"))
+	staff.DELETE("/models/:uid/pricing/:id", targonRouter.CancelPrice, perm(middleware.PermPricingWrite), audit("pricing.cancel"))
+	staff.POST("/models/:uid/evaluate", targonRouter.EvaluateModel, perm(middleware.PermModelsWrite), audit("model.evaluate"))
+	staff.PUT("/eval-sets", targonRouter.SaveEvalSet, perm(middleware.PermModelsWrite), audit("eval_set.save"))
+
+	warmPoolRouter := ModelAlertRouter{mh: modelalerts.NewModelAlertHandler(wdb, rdb, redisClient, log, targonHandler)}
+	staff.GET("/v1/admin/warm-pool", warmPoolRouter.GetWarmPoolReport, perm(middleware.PermModelsRead))
+
+	tokenizerRouter := NewTokenizerRouter(tokenizers)
+	staff.POST("/v1/admin/tokenizers/refresh", tokenizerRouter.Refresh, perm(middleware.PermModelsWrite), audit("tokenizer.refresh"))
+
+	reviewRouter := NewReviewRouter(review.NewReviewHandler(wdb, rdb, log))
+	staff.GET("/review/samples", reviewRouter.ListSamples, perm(middleware.PermReviewRead))
+	staff.POST("/review/samples/:id/label", reviewRouter.LabelSample, perm(middleware.PermReviewWrite), audit("review_sample.label"))
+
+	policyRouter := NewPolicyRouter(policy.NewPolicyHandler(wdb, rdb, redisClient, log))
+	staff.GET("/policies", policyRouter.ListPolicies, perm(middleware.PermPoliciesRead))
+	staff.PUT("/policies", policyRouter.SetPolicy, perm(middleware.PermPoliciesWrite), audit("policy.set"))
+	staff.DELETE("/policies/:id", policyRouter.DeactivatePolicy, perm(middleware.PermPoliciesWrite), audit("policy.deactivate"))
+
+	transformRouter := NewTransformRouter(transforms.NewTransformHandler(wdb, rdb, redisClient, log))
+	staff.GET("/v1/admin/transforms", transformRouter.ListTransforms, perm(middleware.PermPoliciesRead))
+	staff.GET("/v1/admin/transforms/plugins", transformRouter.ListPlugins, perm(middleware.PermPoliciesRead))
+	staff.POST("/v1/admin/transforms", transformRouter.CreateTransform, perm(middleware.PermPoliciesWrite), audit("transform.create"))
+	staff.DELETE("/v1/admin/transforms/:id", transformRouter.DeactivateTransform, perm(middleware.PermPoliciesWrite), audit("transform.deactivate"))
+
+	billingHandler := billing.NewBillingHandler(wdb, rdb, redisClient, log, nil)
+	billingRouter := NewBillingRouter(billingHandler)
+	staff.GET("/v1/admin/users/:id/ledger", billingRouter.Ledger, perm(middleware.PermCreditsRead))
+	staff.POST("/v1/admin/users/:id/credits", billingRouter.AdjustCredits, perm(middleware.PermCreditsWrite), audit("credits.adjust"))
+	staff.POST("/v1/admin/requests/:request_id/refund", billingRouter.RefundRequest, perm(middleware.PermCreditsWrite), audit("credits.refund"))
+	staff.POST("/v1/admin/billing/simulate", billingRouter.Simulate, perm(middleware.PermCreditsRead))
+
+	capacityRouter := NewCapacityRouter(capacity.NewCapacityHandler(wdb, rdb, redisClient, log))
+	staff.GET("/v1/admin/reservations", capacityRouter.ListReservations, perm(middleware.PermCreditsRead))
+	staff.POST("/v1/admin/reservations", capacityRouter.CreateReservation, perm(middleware.PermCapacityWrite), audit("reservation.create"))
+	staff.DELETE("/v1/admin/reservations/:id", capacityRouter.CancelReservation, perm(middleware.PermCapacityWrite), audit("reservation.cancel"))
+
+	// Incidents with auto refund also need credits:write, checked by the router
+	incidentRouter := NewIncidentRouter(incidents.NewIncidentHandler(wdb, rdb, billingHandler, log))
+	staff.GET("/v1/admin/incidents", incidentRouter.ListIncidents, perm(middleware.PermModelsRead))
+	staff.POST("/v1/admin/incidents", incidentRouter.CreateIncident, perm(middleware.PermModelsWrite), audit("incident.create"))
+	staff.POST("/v1/admin/incidents/:id/resolve", incidentRouter.ResolveIncident, perm(middleware.PermModelsWrite), audit("incident.resolve"))
+	staff.DELETE("/v1/admin/incidents/:id", incidentRouter.DeleteIncident, perm(middleware.PermModelsWrite), audit("incident.delete"))
+
+	searchRouter := NewSearchRouter(nil, search.NewCache(redisClient, log), nil, nil, "", nil)
+	staff.DELETE("/v1/admin/search-cache", searchRouter.PurgeCache, perm(middleware.PermSearchWrite), audit("search_cache.purge"))
+
+	usageSettingsRouter := NewUsageSettingsRouter(redisClient)
+	staff.GET("/v1/admin/usage-settings", usageSettingsRouter.GetSettings, perm(middleware.PermCreditsRead))
+	staff.PUT("/v1/admin/usage-settings", usageSettingsRouter.SetSettings, perm(middleware.PermCreditsWrite), audit("usage_settings.set"))
+
+	// Only admins hold keys:write, it can unlock a key its owner restricted
+	// themselves out of
+	apiKeyRouter := APIKeyRouter{ah: apikeys.NewAPIKeyHandler(wdb, rdb, redisClient, log)}
+	staff.PUT("/v1/admin/keys/:id/restrictions", apiKeyRouter.OverrideKeyRestrictions, perm(middleware.PermKeysWrite), audit("api_key.restrictions"))
 
 	return nil
 }
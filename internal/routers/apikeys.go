@@ -0,0 +1,160 @@
+package routers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/apikeys"
+	"sybil-api/internal/middleware"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type APIKeyRouter struct {
+	ah *apikeys.APIKeyHandler
+}
+
+func RegisterAPIKeyRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger) error {
+	umw, err := middleware.GetUserMiddleware()
+	if err != nil {
+		return err
+	}
+
+	ar := APIKeyRouter{ah: apikeys.NewAPIKeyHandler(wdb, rdb, redisClient, log)}
+	for _, requireAdminScope := range versionGroups(e, "", umw.ExtractUser, umw.RequireUser, umw.RequireScope(shared.ScopeAdmin)) {
+		requireAdminScope.GET("/keys", ar.ListKeys)
+		requireAdminScope.POST("/keys", ar.CreateKey)
+		requireAdminScope.POST("/keys/:id/rotate", ar.RotateKey)
+		requireAdminScope.PUT("/keys/:id/restrictions", ar.SetKeyRestrictions)
+		requireAdminScope.DELETE("/keys/:id", ar.RevokeKey)
+	}
+	return nil
+}
+
+func (ar *APIKeyRouter) CreateKey(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req apikeys.CreateAPIKeyRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	key, err := ar.ah.CreateAPIKeyLogic(apikeys.APIKeyInput{
+		Ctx:          c.Request().Context(),
+		UserID:       c.User.UserID,
+		CallerKey:    c.User.APIKey,
+		CallerScopes: c.User.Scopes,
+		Req:          &req,
+	})
+	if err != nil {
+		return apiKeyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, key)
+}
+
+func (ar *APIKeyRouter) ListKeys(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	keys, err := ar.ah.ListAPIKeysLogic(apikeys.APIKeyInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+	})
+	if err != nil {
+		return apiKeyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": keys})
+}
+
+func (ar *APIKeyRouter) RotateKey(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	key, err := ar.ah.RotateAPIKeyLogic(apikeys.APIKeyInput{
+		Ctx:          c.Request().Context(),
+		UserID:       c.User.UserID,
+		CallerKey:    c.User.APIKey,
+		CallerScopes: c.User.Scopes,
+		KeyID:        c.Param("id"),
+	})
+	if err != nil {
+		return apiKeyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, key)
+}
+
+func (ar *APIKeyRouter) SetKeyRestrictions(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	return ar.setKeyRestrictions(c, c.User.UserID, false)
+}
+
+// OverrideKeyRestrictions lets staff replace the allowlists on a key of any
+// user
+func (ar *APIKeyRouter) OverrideKeyRestrictions(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	return ar.setKeyRestrictions(c, 0, true)
+}
+
+func (ar *APIKeyRouter) setKeyRestrictions(c *ctx.Context, userID uint64, override bool) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req apikeys.KeyRestrictions
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	key, err := ar.ah.SetKeyRestrictionsLogic(apikeys.APIKeyInput{
+		Ctx:          c.Request().Context(),
+		UserID:       userID,
+		KeyID:        c.Param("id"),
+		Restrictions: &req,
+		Override:     override,
+	})
+	if err != nil {
+		return apiKeyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, key)
+}
+
+func (ar *APIKeyRouter) RevokeKey(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	err := ar.ah.RevokeAPIKeyLogic(apikeys.APIKeyInput{
+		Ctx:       c.Request().Context(),
+		UserID:    c.User.UserID,
+		CallerKey: c.User.APIKey,
+		KeyID:     c.Param("id"),
+	})
+	if err != nil {
+		return apiKeyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "API key revoked",
+		"id":      c.Param("id"),
+	})
+}
+
+func apiKeyErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
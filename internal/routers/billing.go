@@ -0,0 +1,236 @@
+package routers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/billing"
+	"sybil-api/internal/lifecycle"
+	"sybil-api/internal/middleware"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type BillingRouter struct {
+	bh *billing.BillingHandler
+}
+
+func NewBillingRouter(bh *billing.BillingHandler) *BillingRouter {
+	return &BillingRouter{bh: bh}
+}
+
+// RegisterBillingRoutes adds the customer facing billing routes. The returned
+// func stops the auto recharge loop
+func RegisterBillingRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger, stripe *billing.StripeConfig, lifecycleBus *lifecycle.Bus) (func(), error) {
+	umw, err := middleware.GetUserMiddleware()
+	if err != nil {
+		return nil, err
+	}
+
+	bh := billing.NewBillingHandler(wdb, rdb, redisClient, log, stripe)
+	bh.Lifecycle = lifecycleBus
+	br := NewBillingRouter(bh)
+	for _, requireAdminScope := range versionGroups(e, "", umw.ExtractUser, umw.RequireUser, umw.RequireScope(shared.ScopeAdmin)) {
+		requireAdminScope.GET("/billing/invoices", br.Invoices)
+		requireAdminScope.GET("/billing/auto-recharge", br.GetAutoRecharge)
+		requireAdminScope.PUT("/billing/auto-recharge", br.SetAutoRecharge)
+	}
+
+	jobsCtx, cancel := context.WithCancel(context.Background())
+	if stripe != nil && stripe.WebhookSecret != "" {
+		// Stripe authenticates with the signature header instead of an api key.
+		// The webhook url is set in Stripe, so it stays on v1 only
+		e.Group("v1").POST("/billing/stripe/webhook", br.StripeWebhook)
+		go br.bh.RunAutoRecharge(jobsCtx)
+	}
+	go br.bh.RunRefundReconciliation(jobsCtx)
+	return cancel, nil
+}
+
+func (br *BillingRouter) StripeWebhook(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	entry, err := br.bh.StripeWebhookLogic(billing.StripeWebhookInput{
+		Ctx:       c.Request().Context(),
+		Payload:   body,
+		Signature: c.Request().Header.Get("Stripe-Signature"),
+	})
+	if err != nil {
+		return billingErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"received": true, "entry": entry})
+}
+
+func (br *BillingRouter) Invoices(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	invoices, err := br.bh.InvoicesLogic(billing.InvoicesInput{
+		Ctx:  c.Request().Context(),
+		User: *c.User,
+	})
+	if err != nil {
+		return billingErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": invoices})
+}
+
+func (br *BillingRouter) GetAutoRecharge(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	settings, err := br.bh.GetAutoRechargeLogic(billing.AutoRechargeInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+	})
+	if err != nil {
+		return billingErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, settings)
+}
+
+func (br *BillingRouter) SetAutoRecharge(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req billing.AutoRechargeSettings
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	settings, err := br.bh.SetAutoRechargeLogic(billing.AutoRechargeInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		Settings: req,
+	})
+	if err != nil {
+		return billingErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, settings)
+}
+
+func (br *BillingRouter) AdjustCredits(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req billing.AdjustCreditsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	entry, err := br.bh.AdjustCreditsLogic(billing.CreditsInput{
+		Ctx:     c.Request().Context(),
+		AdminID: c.User.UserID,
+		UserID:  userID,
+		Adjust:  req,
+	})
+	if err != nil {
+		return billingErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, entry)
+}
+
+func (br *BillingRouter) RefundRequest(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req billing.RefundRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	entry, err := br.bh.RefundRequestLogic(billing.CreditsInput{
+		Ctx:       c.Request().Context(),
+		AdminID:   c.User.UserID,
+		RequestID: c.Param("request_id"),
+		Refund:    req,
+	})
+	if err != nil {
+		return billingErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, entry)
+}
+
+func (br *BillingRouter) Simulate(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req billing.SimulateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	sim, err := br.bh.SimulateLogic(billing.SimulateInput{
+		Ctx: c.Request().Context(),
+		Req: req,
+	})
+	if err != nil {
+		return billingErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, sim)
+}
+
+func (br *BillingRouter) Ledger(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid user id"})
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+
+	report, err := br.bh.LedgerLogic(billing.CreditsInput{
+		Ctx:    c.Request().Context(),
+		UserID: userID,
+		Limit:  limit,
+	})
+	if err != nil {
+		return billingErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+func billingErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
@@ -0,0 +1,61 @@
+package routers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"sybil-api/internal/buckets"
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+type UsageSettingsRouter struct {
+	redis *redis.Client
+}
+
+func NewUsageSettingsRouter(redisClient *redis.Client) *UsageSettingsRouter {
+	return &UsageSettingsRouter{redis: redisClient}
+}
+
+// GetSettings returns the runtime override of the bucket flush settings.
+// Fields that are not set use the deployment defaults
+func (ur *UsageSettingsRouter) GetSettings(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	override, err := buckets.GetSettingsOverride(c.Request().Context(), ur.redis)
+	if err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to get usage settings"), err))
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+	return c.JSON(http.StatusOK, override)
+}
+
+// SetSettings replaces the runtime override, every replica applies it within
+// shared.BucketSettingsReloadInterval. An empty body goes back to the defaults
+func (ur *UsageSettingsRouter) SetSettings(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var override buckets.Settings
+	if err := json.Unmarshal(body, &override); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+	if err := override.Validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	if err := buckets.SetSettingsOverride(c.Request().Context(), ur.redis, override); err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to set usage settings"), err))
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+	return c.JSON(http.StatusOK, override)
+}
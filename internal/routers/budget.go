@@ -0,0 +1,109 @@
+package routers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/budget"
+	"sybil-api/internal/middleware"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type BudgetRouter struct {
+	bh *budget.BudgetHandler
+}
+
+func RegisterBudgetRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger) error {
+	umw, err := middleware.GetUserMiddleware()
+	if err != nil {
+		return err
+	}
+
+	br := BudgetRouter{bh: budget.NewBudgetHandler(wdb, rdb, redisClient, log)}
+	for _, requireAdminScope := range versionGroups(e, "", umw.ExtractUser, umw.RequireUser, umw.RequireScope(shared.ScopeAdmin)) {
+		requireAdminScope.GET("/budgets", br.ListBudgets)
+		requireAdminScope.PUT("/budgets", br.SetBudget)
+		requireAdminScope.DELETE("/budgets/:id", br.DeleteBudget)
+	}
+	return nil
+}
+
+func (br *BudgetRouter) SetBudget(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req budget.SetBudgetRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	b, err := br.bh.SetBudgetLogic(budget.BudgetInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		Req:    &req,
+	})
+	if err != nil {
+		return budgetErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, b)
+}
+
+func (br *BudgetRouter) ListBudgets(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	budgets, err := br.bh.ListBudgetsLogic(budget.BudgetInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+	})
+	if err != nil {
+		return budgetErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": budgets})
+}
+
+func (br *BudgetRouter) DeleteBudget(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	budgetID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid budget id"})
+	}
+
+	err = br.bh.DeleteBudgetLogic(budget.BudgetInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		BudgetID: budgetID,
+	})
+	if err != nil {
+		return budgetErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Budget deleted",
+		"id":      budgetID,
+	})
+}
+
+func budgetErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
@@ -0,0 +1,101 @@
+package routers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/capacity"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CapacityRouter struct {
+	ch *capacity.CapacityHandler
+}
+
+func NewCapacityRouter(ch *capacity.CapacityHandler) *CapacityRouter {
+	return &CapacityRouter{ch: ch}
+}
+
+func (cr *CapacityRouter) CreateReservation(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req capacity.CreateReservationRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	reservation, err := cr.ch.CreateReservationLogic(capacity.ReservationInput{
+		Ctx:     c.Request().Context(),
+		AdminID: c.User.UserID,
+		Req:     req,
+	})
+	if err != nil {
+		return capacityErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, reservation)
+}
+
+func (cr *CapacityRouter) ListReservations(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	var userID uint64
+	if raw := c.QueryParam("user_id"); raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid user_id"})
+		}
+		userID = parsed
+	}
+
+	reservations, err := cr.ch.ListReservationsLogic(capacity.ReservationInput{
+		Ctx:    c.Request().Context(),
+		UserID: userID,
+	})
+	if err != nil {
+		return capacityErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": reservations})
+}
+
+func (cr *CapacityRouter) CancelReservation(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	reservationID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid reservation id"})
+	}
+
+	reservation, err := cr.ch.CancelReservationLogic(capacity.ReservationInput{
+		Ctx:           c.Request().Context(),
+		ReservationID: reservationID,
+	})
+	if err != nil {
+		return capacityErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, reservation)
+}
+
+func capacityErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrConflict):
+		return c.JSON(shared.ErrConflict.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
@@ -0,0 +1,192 @@
+package routers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/finetune"
+	"sybil-api/internal/handlers/targon"
+	"sybil-api/internal/middleware"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type FineTuneRouter struct {
+	fh *finetune.FineTuneHandler
+}
+
+type FineTuneRouterConfig struct {
+	TargonAPIKey   string
+	TargonEndpoint string
+	// Optional HMAC secret for requests to targon
+	TargonSigningSecret string
+	TrainingAPIKey      string
+	TrainingEndpoint    string
+}
+
+func RegisterFineTuneRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger, config *FineTuneRouterConfig) error {
+	targonHandler, err := targon.NewTargonHandler(wdb, rdb, redisClient, config.TargonAPIKey, config.TargonEndpoint, config.TargonSigningSecret, log)
+	if err != nil {
+		return err
+	}
+
+	// Trained adapters are loaded onto the deployment serving the base model
+	// and are only visible to the user that trained them
+	registerAdapter := func(ctx context.Context, baseModel, adapterName, adapterPath string, userID uint64) error {
+		targonUID, err := targonHandler.GetTargonUIDForModelName(ctx, baseModel)
+		if err != nil {
+			return err
+		}
+		_, err = targonHandler.RegisterAdapterLogic(targon.AdapterInput{
+			Ctx:      ctx,
+			UserID:   userID,
+			ModelUID: targonUID,
+			Req: targon.RegisterAdapterRequest{
+				Name:          adapterName,
+				Path:          adapterPath,
+				AllowedUserID: userID,
+			},
+		})
+		if !errors.Is(err, shared.ErrConflict) {
+			return err
+		}
+		// A retry after the job update failed finds its own adapter registered
+		existing, listErr := targonHandler.ListAdaptersLogic(targon.AdapterInput{Ctx: ctx, ModelUID: targonUID})
+		if listErr != nil {
+			return errors.Join(err, listErr)
+		}
+		for _, adapter := range existing.Adapters {
+			if adapter.Name == adapterName && adapter.Path == adapterPath {
+				return nil
+			}
+		}
+		return err
+	}
+
+	fineTuneHandler, err := finetune.NewFineTuneHandler(wdb, rdb, config.TrainingAPIKey, config.TrainingEndpoint, registerAdapter, log)
+	if err != nil {
+		return err
+	}
+	go fineTuneHandler.ResumePolling()
+
+	umw, err := middleware.GetUserMiddleware()
+	if err != nil {
+		return err
+	}
+
+	fr := FineTuneRouter{fh: fineTuneHandler}
+	for _, requireUser := range versionGroups(e, "/fine_tuning", umw.ExtractUser, umw.RequireUser) {
+		requireUser.POST("/jobs", fr.CreateJob)
+		requireUser.GET("/jobs/:id", fr.GetJob)
+		requireUser.POST("/jobs/:id/cancel", fr.CancelJob)
+		requireUser.GET("/jobs/:id/events", fr.ListJobEvents)
+	}
+	return nil
+}
+
+func (fr *FineTuneRouter) CreateJob(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "training file is required"})
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var hyperparameters map[string]any
+	if hp := c.FormValue("hyperparameters"); hp != "" {
+		if err := json.Unmarshal([]byte(hp), &hyperparameters); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid hyperparameters JSON format"})
+		}
+	}
+
+	job, err := fr.fh.CreateJobLogic(finetune.CreateJobInput{
+		Ctx:             c.Request().Context(),
+		UserID:          c.User.UserID,
+		Model:           c.FormValue("model"),
+		Suffix:          c.FormValue("suffix"),
+		Hyperparameters: hyperparameters,
+		FileName:        fileHeader.Filename,
+		File:            file,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return fineTuneErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func (fr *FineTuneRouter) GetJob(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	job, err := fr.fh.GetJobLogic(finetune.JobInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		JobID:  c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return fineTuneErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func (fr *FineTuneRouter) CancelJob(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	job, err := fr.fh.CancelJobLogic(finetune.JobInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		JobID:  c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return fineTuneErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+func (fr *FineTuneRouter) ListJobEvents(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	events, err := fr.fh.ListJobEventsLogic(finetune.JobInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		JobID:  c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return fineTuneErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"object": "list",
+		"data":   events,
+	})
+}
+
+func fineTuneErrorResponse(c *ctx.Context, err error) error {
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "fine tuning job not found"})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrPartialSuccess):
+		return c.JSON(shared.ErrPartialSuccess.StatusCode, map[string]string{"error": "partial success; job may be in unknown state"})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"regexp"
+	"slices"
+	"strings"
 
 	"sybil-api/internal/ctx"
 	inferenceRoute "sybil-api/internal/handlers/inference"
+	"sybil-api/internal/searchabuse"
 	"sybil-api/internal/shared"
 
 	"github.com/labstack/echo/v4"
@@ -20,12 +23,19 @@ type ChatHistoryRequest struct {
 	Settings *shared.ChatSettings `json:"settings,omitempty"`
 }
 
+// ContinueChatHistoryRequest is the next user message of a history. Settings
+// default to the ones stored with the history
+type ContinueChatHistoryRequest struct {
+	Content  string               `json:"content"`
+	Settings *shared.ChatSettings `json:"settings,omitempty"`
+}
+
 func (ir *InferenceRouter) ChatHistory(cc echo.Context) error {
 	c := cc.(*ctx.Context)
 
-	body, err := io.ReadAll(c.Request().Body)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "failed to read request body"})
+	body, ok, err := ir.readBody(c, shared.ENDPOINTS.CHAT)
+	if !ok {
+		return err
 	}
 
 	var req ChatHistoryRequest
@@ -43,12 +53,20 @@ func (ir *InferenceRouter) ChatHistory(cc echo.Context) error {
 		settings = &shared.ChatSettings{}
 	}
 
-	if !settings.Stream {
-		settings.Stream = true
+	if !validSearchProvider(settings) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": searchProviderError})
+	}
+
+	searchLocale := requestSearchLocale(c, settings, ir.geoCountryHeader)
+	if searchLocale != nil {
+		c.LogValues.SearchRegion = searchLocale.Region
+		c.LogValues.SearchLanguage = searchLocale.Language
+		c.LogValues.SearchLocaleSource = searchLocale.Source
 	}
 
-	setupSSEHeaders(c)
-	streamCallback := createStreamCallback(c)
+	// History responses are always streamed
+	responder := newResponder(c, true)
+	responder.Start()
 
 	output, err := ir.ih.Chat(&inferenceRoute.ChatInput{
 		ChatID:       req.ChatID,
@@ -57,21 +75,122 @@ func (ir *InferenceRouter) ChatHistory(cc echo.Context) error {
 		User:         *c.User,
 		RequestID:    c.Reqid,
 		Ctx:          c.Request().Context(),
-		StreamWriter: streamCallback,
+		StreamWriter: responder.StreamWriter(),
+		SearchLocale: searchLocale,
+		SearchClient: searchClient(c),
 	})
+	return finishChatHistory(c, responder, output, err)
+}
+
+// ContinueChatHistory runs the next user message of a stored history. Only the
+// new message is sent, the conversation is loaded server side
+func (ir *InferenceRouter) ContinueChatHistory(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, ok, err := ir.readBody(c, shared.ENDPOINTS.CHAT)
+	if !ok {
+		return err
+	}
+
+	var req ContinueChatHistoryRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to unmarshal request body"), err))
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "content cannot be empty"})
+	}
+
+	localeSettings := req.Settings
+	if localeSettings == nil {
+		localeSettings = &shared.ChatSettings{}
+	}
+	if !validSearchProvider(localeSettings) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": searchProviderError})
+	}
+
+	searchLocale := requestSearchLocale(c, localeSettings, ir.geoCountryHeader)
+	if searchLocale != nil {
+		c.LogValues.SearchRegion = searchLocale.Region
+		c.LogValues.SearchLanguage = searchLocale.Language
+		c.LogValues.SearchLocaleSource = searchLocale.Source
+	}
+
+	responder := newResponder(c, true)
+	responder.Start()
+
+	output, err := ir.ih.ContinueChat(&inferenceRoute.ContinueChatInput{
+		HistoryID:    c.Param("id"),
+		Content:      req.Content,
+		Settings:     req.Settings,
+		User:         *c.User,
+		RequestID:    c.Reqid,
+		Ctx:          c.Request().Context(),
+		StreamWriter: responder.StreamWriter(),
+		SearchLocale: searchLocale,
+		SearchClient: searchClient(c),
+	})
+	return finishChatHistory(c, responder, output, err)
+}
+
+// RegenerateChatHistory replaces the last assistant reply of a stored history.
+// The body is optional and can only override the settings
+func (ir *InferenceRouter) RegenerateChatHistory(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, ok, err := ir.readBody(c, shared.ENDPOINTS.CHAT)
+	if !ok {
+		return err
+	}
+	var req ContinueChatHistoryRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			c.LogValues.AddError(errors.Join(errors.New("failed to unmarshal request body"), err))
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+		}
+	}
+
+	localeSettings := req.Settings
+	if localeSettings == nil {
+		localeSettings = &shared.ChatSettings{}
+	}
+	if !validSearchProvider(localeSettings) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": searchProviderError})
+	}
+
+	searchLocale := requestSearchLocale(c, localeSettings, ir.geoCountryHeader)
+
+	responder := newResponder(c, true)
+	responder.Start()
+
+	output, err := ir.ih.RegenerateChat(&inferenceRoute.ContinueChatInput{
+		HistoryID:    c.Param("id"),
+		Settings:     req.Settings,
+		User:         *c.User,
+		RequestID:    c.Reqid,
+		Ctx:          c.Request().Context(),
+		StreamWriter: responder.StreamWriter(),
+		SearchLocale: searchLocale,
+		SearchClient: searchClient(c),
+	})
+	return finishChatHistory(c, responder, output, err)
+}
+
+// finishChatHistory ends a history stream with the error or the history id
+func finishChatHistory(c *ctx.Context, responder Responder, output *inferenceRoute.ChatOutput, err error) error {
 	if err != nil {
 		c.LogValues.AddError(err)
 		c.LogValues.LogLevel = "ERROR"
 		var rerr *shared.RequestError
 		if errors.As(err, &rerr) {
-			return c.JSON(rerr.StatusCode, shared.OpenAIError{
+			return responder.Error(rerr.StatusCode, shared.OpenAIError{
 				Message: rerr.Error(),
 				Object:  "error",
 				Type:    "RequestError",
 				Code:    rerr.StatusCode,
 			})
 		}
-		return c.JSON(http.StatusInternalServerError, shared.OpenAIError{
+		return responder.Error(http.StatusInternalServerError, shared.OpenAIError{
 			Message: "internal server error",
 			Object:  "error",
 			Type:    "InternalError",
@@ -79,12 +198,9 @@ func (ir *InferenceRouter) ChatHistory(cc echo.Context) error {
 		})
 	}
 
-	c.LogValues.InferenceInfo = &ctx.InferenceInfo{
-		ModelName:   output.ModelName,
-		ModelURL:    output.ModelURL,
-		ModelID:     output.ModelID,
-		Stream:      true,
-		InfMetadata: output.InfMetadata,
+	if output.Req != nil {
+		c.LogValues.InferenceInfo = newInferenceInfo(output.Req)
+		c.LogValues.InferenceInfo.InfMetadata = output.InfMetadata
 	}
 	c.LogValues.HistoryID = output.HistoryID
 
@@ -93,8 +209,98 @@ func (ir *InferenceRouter) ChatHistory(cc echo.Context) error {
 		"id":   output.HistoryID,
 	}
 	historyJSON, _ := json.Marshal(historyEvent)
-	_, _ = fmt.Fprintf(c.Response(), "data: %s\n\n", historyJSON)
-	c.Response().Flush()
+	_ = responder.StreamWriter()(fmt.Sprintf("data: %s", historyJSON))
+	return responder.Finish(nil)
+}
+
+var (
+	regionCode   = regexp.MustCompile(`^[a-zA-Z]{2}$`)
+	languageCode = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})?$`)
+)
+
+var searchProviderError = "search_provider must be one of " + strings.Join(shared.SearchProviders, ", ")
+
+// validSearchProvider reports whether the settings leave the provider unset
+// or name a known one. Known providers without a key are skipped at search
+func validSearchProvider(settings *shared.ChatSettings) bool {
+	return settings.SearchProvider == "" || slices.Contains(shared.SearchProviders, settings.SearchProvider)
+}
+
+// searchDefaultsError describes the first of region, lang and safe that is set
+// but not valid, empty when they all are
+func searchDefaultsError(region string, language string, safe string) string {
+	switch {
+	case region != "" && !regionCode.MatchString(region):
+		return "region must be a two letter country code"
+	case language != "" && !languageCode.MatchString(language):
+		return "lang must be a language tag like en or pt-BR"
+	case safe != "" && !slices.Contains(shared.SearchSafeLevels, safe):
+		return "safe must be one of " + strings.Join(shared.SearchSafeLevels, ", ")
+	}
+	return ""
+}
+
+// searchClient identifies the client for search abuse scoring. The ip comes
+// from the servers IPExtractor, which only honours forwarding headers from
+// trusted proxies. Clients challenged before send the solved CAPTCHA in
+// X-Sybil-Challenge-Token
+func searchClient(c *ctx.Context) *shared.SearchClient {
+	header := c.Request().Header
+	return &shared.SearchClient{
+		IP:             c.RealIP(),
+		Fingerprint:    searchabuse.Fingerprint(header),
+		UserAgent:      header.Get("User-Agent"),
+		ChallengeToken: header.Get("X-Sybil-Challenge-Token"),
+	}
+}
+
+// requestSearchLocale picks the search region, language and safe search level.
+// Values in the request settings win, then the users defaults. Otherwise the
+// region comes from the edge geolocation header and the language from
+// Accept-Language
+func requestSearchLocale(c *ctx.Context, settings *shared.ChatSettings, geoCountryHeader string) *shared.SearchLocale {
+	safe := settings.SearchSafe
+	region, language, source := settings.SearchRegion, settings.SearchLanguage, shared.SearchLocaleSourceSettings
+	if c.User != nil {
+		if safe == "" {
+			safe = c.User.SearchSafe
+		}
+		if region == "" && language == "" {
+			region, language, source = c.User.SearchRegion, c.User.SearchLanguage, shared.SearchLocaleSourceUser
+		}
+	}
+	if !slices.Contains(shared.SearchSafeLevels, safe) {
+		safe = ""
+	}
 
-	return nil
+	if region != "" || language != "" {
+		locale := &shared.SearchLocale{Source: source, SafeSearch: safe}
+		if regionCode.MatchString(region) {
+			locale.Region = strings.ToLower(region)
+		}
+		if languageCode.MatchString(language) {
+			locale.Language = language
+		}
+		return locale
+	}
+
+	locale := &shared.SearchLocale{Source: shared.SearchLocaleSourceEdge, SafeSearch: safe}
+	if geoCountryHeader != "" {
+		// XX and T1 are used by edges for unknown and tor clients
+		country := c.Request().Header.Get(geoCountryHeader)
+		if regionCode.MatchString(country) && !strings.EqualFold(country, "XX") && !strings.EqualFold(country, "T1") {
+			locale.Region = strings.ToLower(country)
+		}
+	}
+	acceptLanguage := c.Request().Header.Get("Accept-Language")
+	if first, _, _ := strings.Cut(acceptLanguage, ","); first != "" {
+		tag, _, _ := strings.Cut(strings.TrimSpace(first), ";")
+		if languageCode.MatchString(tag) {
+			locale.Language = tag
+		}
+	}
+	if locale.Region == "" && locale.Language == "" && locale.SafeSearch == "" {
+		return nil
+	}
+	return locale
 }
@@ -0,0 +1,114 @@
+package routers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/incidents"
+	"sybil-api/internal/middleware"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+)
+
+type IncidentRouter struct {
+	ih *incidents.IncidentHandler
+}
+
+func NewIncidentRouter(ih *incidents.IncidentHandler) *IncidentRouter {
+	return &IncidentRouter{ih: ih}
+}
+
+func (ir *IncidentRouter) CreateIncident(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req incidents.CreateIncidentRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+	// Auto refunds move credits, so they need the same permission as a refund
+	if req.AutoRefund && !middleware.HasPermission(c.User.Role, middleware.PermCreditsWrite) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "role " + strings.ToLower(c.User.Role) + " is missing the " + middleware.PermCreditsWrite + " permission"})
+	}
+
+	incident, err := ir.ih.CreateIncidentLogic(incidents.IncidentInput{
+		Ctx:     c.Request().Context(),
+		AdminID: c.User.UserID,
+		Req:     req,
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, incident)
+}
+
+func (ir *IncidentRouter) ListIncidents(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	list, err := ir.ih.ListIncidentsLogic(incidents.IncidentInput{
+		Ctx:   c.Request().Context(),
+		Model: c.QueryParam("model"),
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": list})
+}
+
+func (ir *IncidentRouter) ResolveIncident(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	incidentID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid incident id"})
+	}
+
+	var req incidents.ResolveIncidentRequest
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+		}
+	}
+
+	incident, err := ir.ih.ResolveIncidentLogic(incidents.IncidentInput{
+		Ctx:        c.Request().Context(),
+		AdminID:    c.User.UserID,
+		IncidentID: incidentID,
+		Resolve:    req,
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, incident)
+}
+
+func (ir *IncidentRouter) DeleteIncident(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	incidentID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid incident id"})
+	}
+
+	err = ir.ih.DeleteIncidentLogic(incidents.IncidentInput{
+		Ctx:        c.Request().Context(),
+		IncidentID: incidentID,
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Incident deleted"})
+}
@@ -0,0 +1,105 @@
+package routers
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"sybil-api/internal/middleware"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+)
+
+type IndexEndpoint struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+}
+
+type IndexAuth struct {
+	Scheme string   `json:"scheme"`
+	Header string   `json:"header"`
+	Format string   `json:"format"`
+	Scopes []string `json:"scopes"`
+	// Browser sessions may send a frontend signed token instead of a key
+	SessionTokens bool `json:"session_tokens"`
+}
+
+type IndexLinks struct {
+	OpenAPI string `json:"openapi,omitempty"`
+	Docs    string `json:"docs,omitempty"`
+}
+
+type IndexResponse struct {
+	Object           string          `json:"object"`
+	Version          string          `json:"version"`
+	Versions         []string        `json:"versions"`
+	Revision         string          `json:"revision"`
+	Auth             IndexAuth       `json:"auth"`
+	RateLimitHeaders []string        `json:"rate_limit_headers"`
+	Endpoints        []IndexEndpoint `json:"endpoints"`
+	Links            IndexLinks      `json:"links"`
+}
+
+type IndexConfig struct {
+	OpenAPIURL    string
+	DocsURL       string
+	SessionTokens bool
+}
+
+// RegisterIndexRoutes serves GET /v1 and /v2, describing that version of the
+// api for SDK auto configuration and smoke checks. They list the routes
+// registered so far, so they are registered after every other router. Admin
+// routes are left out
+func RegisterIndexRoutes(e *echo.Echo, base *echo.Group, config *IndexConfig) {
+	for _, version := range APIVersions {
+		index := IndexResponse{
+			Object:   "api",
+			Version:  version,
+			Versions: APIVersions,
+			Revision: shared.APIRevision,
+			Auth: IndexAuth{
+				Scheme:        "bearer",
+				Header:        "Authorization",
+				Format:        "Bearer <api key>",
+				Scopes:        []string{shared.ScopeInference, shared.ScopeSearch, shared.ScopeHistoryRead, shared.ScopeAdmin},
+				SessionTokens: config.SessionTokens,
+			},
+			RateLimitHeaders: middleware.RateLimitHeaders(),
+			Endpoints:        indexEndpoints(e, "/"+version+"/"),
+			Links: IndexLinks{
+				OpenAPI: config.OpenAPIURL,
+				Docs:    config.DocsURL,
+			},
+		}
+		base.GET("/"+version, func(c echo.Context) error {
+			return c.JSON(http.StatusOK, index)
+		})
+	}
+}
+
+func indexEndpoints(e *echo.Echo, prefix string) []IndexEndpoint {
+	methods := map[string][]string{}
+	for _, route := range e.Routes() {
+		if !strings.HasPrefix(route.Path, prefix) || strings.HasPrefix(route.Path, prefix+"admin") {
+			continue
+		}
+		// Echo registers echo.RouteNotFound and similar with methods of its own
+		if !slices.Contains([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}, route.Method) {
+			continue
+		}
+		if !slices.Contains(methods[route.Path], route.Method) {
+			methods[route.Path] = append(methods[route.Path], route.Method)
+		}
+	}
+	endpoints := make([]IndexEndpoint, 0, len(methods))
+	for path, pathMethods := range methods {
+		sort.Strings(pathMethods)
+		endpoints = append(endpoints, IndexEndpoint{Path: path, Methods: pathMethods})
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Path < endpoints[j].Path
+	})
+	return endpoints
+}
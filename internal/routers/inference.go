@@ -8,68 +8,199 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"sybil-api/internal/buckets"
 	"sybil-api/internal/ctx"
+	"sybil-api/internal/database"
 	"sybil-api/internal/handlers/inference"
+	"sybil-api/internal/herocard"
+	"sybil-api/internal/lifecycle"
 	"sybil-api/internal/middleware"
+	"sybil-api/internal/search"
+	"sybil-api/internal/searchabuse"
 	"sybil-api/internal/shared"
+	"sybil-api/internal/tokenizer"
 
 	"github.com/labstack/echo/v4"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
-	"google.golang.org/api/customsearch/v1"
-	"google.golang.org/api/option"
 )
 
 type InferenceRouter struct {
 	ih *inference.InferenceHandler
+	// Header the edge sets with the client country, empty to disable
+	geoCountryHeader string
 }
 
 type InferenceRouterConfig struct {
 	GoogleSearchEngineID string
 	GoogleAPIKey         string
+	// Daily Google CSE query quota, 0 disables quota enforcement
+	GoogleCSEDailyQuota int64
+	BraveAPIKey         string
+	BingAPIKey          string
+	// Comma separated order search providers are tried in, providers without
+	// a key are left out
+	SearchProviders string
+	// Header set by the edge proxy with the ISO country code of the client ip
+	GeoCountryHeader string
+	// Chat history databases for accounts with a data residency requirement
+	ResidencyDBs database.ResidencyDBs
+	// Comma separated id:base64 keys for chat history encryption, the first
+	// encrypts new rows
+	HistoryEncryptionKeys string
+	// Keyring for customer provider keys, nil disables bring your own key
+	ProviderKeyring *shared.Keyring
+	// Model used to title new chat histories, empty disables generated titles
+	TitleModel string
+	// Model that suggests follow-up questions after search answers, empty
+	// sends none
+	FollowupModel string
+	// Model used for model based pii redaction, empty falls back to patterns
+	RedactionModel string
+	// Embedding model that reranks chat search results, empty disables
+	// reranking
+	SearchRerankModel string
+	// Time allowed for reranking before results are used in provider order
+	SearchRerankBudget time.Duration
+	// Replica lag, nil reads the replica regardless of lag
+	LagMonitor *database.LagMonitor
+	// Hero cards for searched queries with a known intent. Weather and
+	// definitions need no key, stocks and sports only run with theirs
+	HeroCards          bool
+	AlphaVantageAPIKey string
+	TheSportsDBAPIKey  string
+	// Request lifecycle events, nil publishes none
+	Lifecycle *lifecycle.Bus
+	// Bucket flush settings of this environment, zero fields keep the
+	// built in defaults
+	UsageSettings buckets.Settings
+	// Directory direct charges are journaled in while redis is down, empty
+	// leaves them unjournaled
+	UsageJournalDir string
+	// Local tokenizers of models, nil estimates token counts
+	Tokenizers *tokenizer.Registry
+	// Connection pool settings of the model clients
+	Upstream inference.UpstreamConfig
+	// Request body limits per endpoint, endpoints left out keep the default
+	BodyLimits map[string]int64
 }
 
 func RegisterInferenceRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger, debug bool, config *InferenceRouterConfig) (func(), error) {
 	var searchConfig *inference.SearchConfig
-	if config != nil && config.GoogleAPIKey != "" && config.GoogleSearchEngineID != "" {
-		googleService, err := customsearch.NewService(context.Background(), option.WithAPIKey(config.GoogleAPIKey))
-		if err == nil {
-			searchConfig = &inference.SearchConfig{
-				ClassifyQuery: func(ctx context.Context, query string, apiKey string) bool {
-					return classifyQueryForChat(ctx, query, apiKey)
-				},
-				DoSearch: func(query string) (*shared.SearchResponseBody, error) {
-					return queryGoogleSearchForChat(googleService, log, config.GoogleSearchEngineID, query)
-				},
-			}
+	searchQuota := inference.NewSearchQuota(redisClient, log, config.GoogleCSEDailyQuota)
+	searchCache := search.NewCache(redisClient, log)
+	providers := newSearchProviders(config, searchQuota, log)
+	if providers != nil {
+		searchConfig = &inference.SearchConfig{
+			ClassifyQuery: func(ctx context.Context, query string, apiKey string) inference.Classification {
+				return classifyQueryForChat(ctx, query, apiKey)
+			},
+			DoSearch: func(query string, locale *shared.SearchLocale, provider string) (*shared.SearchResponseBody, error) {
+				key := search.CacheKey{Type: search.TypeWeb, Provider: provider, Query: query, Locale: locale}
+				return searchCache.Search(context.Background(), key, func(ctx context.Context) (*shared.SearchResponseBody, error) {
+					return providers.Search(ctx, provider, query, locale)
+				})
+			},
+			Abuse:     searchabuse.NewDetector(redisClient, log),
+			HeroCards: newHeroCards(config, log),
 		}
 	}
 
-	inferenceManager, inferenceErr := inference.NewInferenceHandler(wdb, rdb, redisClient, log, debug, searchConfig)
+	inferenceManager, inferenceErr := inference.NewInferenceHandler(wdb, rdb, redisClient, log, debug, searchConfig, config.UsageSettings, config.UsageJournalDir)
 	if inferenceErr != nil {
 		return nil, inferenceErr
 	}
 	defer inferenceManager.ShutDown()
+	inferenceManager.ResidencyDBs = config.ResidencyDBs
+	historyKeyring, err := shared.NewKeyring(config.HistoryEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	inferenceManager.HistoryKeyring = historyKeyring
+	inferenceManager.ProviderKeyring = config.ProviderKeyring
+	inferenceManager.TitleModel = config.TitleModel
+	inferenceManager.FollowupModel = config.FollowupModel
+	inferenceManager.RedactionModel = config.RedactionModel
+	inferenceManager.RerankModel = config.SearchRerankModel
+	inferenceManager.RerankBudget = config.SearchRerankBudget
+	inferenceManager.Lag = config.LagMonitor
+	inferenceManager.Lifecycle = config.Lifecycle
+	inferenceManager.Tokenizers = config.Tokenizers
+	inferenceManager.Upstream = config.Upstream
+	inferenceManager.BodyLimits = config.BodyLimits
 	umw, err := middleware.GetUserMiddleware()
 	if err != nil {
 		return nil, err
 	}
 
-	inferenceRouter := InferenceRouter{ih: inferenceManager}
-
-	v1 := e.Group("v1")
-	extractUser := v1.Group("", umw.ExtractUser)
-	requireUser := v1.Group("", umw.ExtractUser, umw.RequireUser)
+	inferenceRouter := InferenceRouter{ih: inferenceManager, geoCountryHeader: config.GeoCountryHeader}
+	searchRouter := NewSearchRouter(inferenceManager, searchCache, search.NewAutocompleter(redisClient, log), providers, config.GeoCountryHeader, redisClient)
+
+	for _, version := range versionGroups(e, "") {
+		extractUser := version.Group("", umw.ExtractUser)
+		requireInference := version.Group("", umw.ExtractUser, umw.RequireUser, umw.RequireScope(shared.ScopeInference))
+		requireHistory := version.Group("", umw.ExtractUser, umw.RequireUser, umw.RequireScope(shared.ScopeHistoryRead))
+		requireAdminScope := version.Group("", umw.ExtractUser, umw.RequireUser, umw.RequireScope(shared.ScopeAdmin))
+
+		extractUser.GET("/models", inferenceRouter.GetModels)
+		requireInference.POST("/chat/completions", inferenceRouter.ChatRequest, umw.RateLimit)
+		requireInference.POST("/completions", inferenceRouter.CompletionRequest, umw.RateLimit)
+		requireInference.GET("/chat/completions/ws", inferenceRouter.ChatWebSocket, umw.RateLimit)
+		requireInference.GET("/completions/ws", inferenceRouter.CompletionWebSocket, umw.RateLimit)
+		requireInference.POST("/embeddings", inferenceRouter.EmbeddingRequest, umw.RateLimit)
+		requireInference.POST("/responses", inferenceRouter.ResponsesRequest, umw.RateLimit)
+		requireInference.POST("/chat/history", inferenceRouter.ChatHistory, umw.RateLimit)
+		requireInference.POST("/chat/history/import", inferenceRouter.ImportChatHistories)
+		requireInference.POST("/chat/history/:id/completions", inferenceRouter.ContinueChatHistory, umw.RateLimit)
+		requireInference.POST("/chat/history/:id/regenerate", inferenceRouter.RegenerateChatHistory, umw.RateLimit)
+		requireInference.POST("/chat/history/:id/branch", inferenceRouter.BranchChatHistory)
+		requireInference.POST("/tokenize", inferenceRouter.Tokenize)
+		requireInference.GET("/search", searchRouter.Web, umw.RateLimit)
+		requireInference.GET("/search/images", searchRouter.Images, umw.RateLimit)
+		requireInference.GET("/search/autocomplete", searchRouter.Autocomplete, umw.RateLimit)
+		requireInference.POST("/search/answer", searchRouter.Answer, umw.RateLimit)
+		requireInference.GET("/search/answer/:id", searchRouter.ResumeAnswer)
+		requireInference.GET("/search/news", searchRouter.News, umw.RateLimit)
+		requireInference.GET("/search/videos", searchRouter.Videos, umw.RateLimit)
+		requireInference.GET("/search/shopping", searchRouter.Shopping, umw.RateLimit)
+		requireHistory.GET("/search/history", searchRouter.ListHistory)
+		requireInference.DELETE("/search/history", searchRouter.DeleteHistory)
+		requireInference.DELETE("/search/:id", searchRouter.DeleteSaved)
+		version.GET("/search/:id", searchRouter.GetSaved)
+		requireHistory.GET("/requests/:id", inferenceRouter.GetRequest)
+		requireHistory.GET("/balance", inferenceRouter.GetBalance)
+		requireHistory.GET("/chat/history", inferenceRouter.ListChatHistories)
+		requireHistory.GET("/chat/history/:id", inferenceRouter.GetChatHistory)
+		requireInference.DELETE("/chat/history", inferenceRouter.DeleteAllChatHistories)
+		requireInference.DELETE("/chat/history/:id", inferenceRouter.DeleteChatHistory)
+		requireInference.GET("/data-deletions/:id", inferenceRouter.GetDeletionJob)
+		requireInference.POST("/chat/history/:id/share", inferenceRouter.ShareChatHistory)
+		requireInference.DELETE("/chat/history/:id/share", inferenceRouter.RevokeChatShare)
+		version.GET("/share/:token", inferenceRouter.GetSharedChat)
+		requireInference.GET("/templates", inferenceRouter.ListTemplates)
+		requireInference.POST("/templates", inferenceRouter.CreateTemplate)
+		requireInference.GET("/templates/:id", inferenceRouter.GetTemplate)
+		requireInference.PUT("/templates/:id", inferenceRouter.UpdateTemplate)
+		requireInference.DELETE("/templates/:id", inferenceRouter.DeleteTemplate)
+		requireAdminScope.GET("/me/retention", inferenceRouter.GetDataRetention)
+		requireAdminScope.PUT("/me/retention", inferenceRouter.SetDataRetention)
+		requireAdminScope.DELETE("/me/data", inferenceRouter.DeleteUserData)
+		requireAdminScope.GET("/me/redaction", inferenceRouter.GetPIIRedaction)
+		requireAdminScope.PUT("/me/redaction", inferenceRouter.SetPIIRedaction)
+		requireInference.GET("/me/search-settings", inferenceRouter.GetSearchDefaults)
+		requireInference.PUT("/me/search-settings", inferenceRouter.SetSearchDefaults)
+	}
 
-	extractUser.GET("/models", inferenceRouter.GetModels)
-	requireUser.POST("/chat/completions", inferenceRouter.ChatRequest)
-	requireUser.POST("/completions", inferenceRouter.CompletionRequest)
-	requireUser.POST("/embeddings", inferenceRouter.EmbeddingRequest)
-	requireUser.POST("/responses", inferenceRouter.ResponsesRequest)
-	requireUser.POST("/chat/history", inferenceRouter.ChatHistory)
-	return inferenceManager.ShutDown, nil
+	retentionCtx, cancel := context.WithCancel(context.Background())
+	go inferenceManager.RunRetentionCleanup(retentionCtx)
+	return func() {
+		cancel()
+		inferenceManager.ShutDown()
+	}, nil
 }
 
 type ModelList struct {
@@ -118,20 +249,80 @@ func (ir *InferenceRouter) ResponsesRequest(cc echo.Context) error {
 	return err
 }
 
-func (ir *InferenceRouter) Inference(cc echo.Context, endpoint string) (*inference.InferenceOutput, error) {
+func (ir *InferenceRouter) Tokenize(cc echo.Context) error {
 	c := cc.(*ctx.Context)
-	body, err := io.ReadAll(c.Request().Body)
+	body, ok, err := ir.readBody(c, shared.ENDPOINTS.CHAT)
+	if !ok {
+		return err
+	}
+
+	out, err := ir.ih.Tokenize(inference.TokenizeInput{
+		Ctx:  c.Request().Context(),
+		User: *c.User,
+		Body: body,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		var rerr *shared.RequestError
+		if errors.As(err, &rerr) {
+			return c.JSON(rerr.StatusCode, shared.OpenAIError{
+				Message: rerr.Error(),
+				Object:  "error",
+				Type:    "InternalError",
+				Code:    rerr.StatusCode,
+			})
+		}
+		return c.JSON(500, shared.OpenAIError{
+			Message: "internal server error",
+			Object:  "error",
+			Type:    "InternalError",
+			Code:    500,
+		})
+	}
+
+	return c.JSON(http.StatusOK, out)
+}
+
+// readBody reads a request body of up to the endpoints limit. When ok is
+// false the error response has already been sent
+func (ir *InferenceRouter) readBody(c *ctx.Context, endpoint string) ([]byte, bool, error) {
+	limit := ir.ih.MaxBodyBytes(endpoint)
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, limit+1))
 	if err != nil {
 		c.LogValues.AddError(err)
-		return nil, c.JSON(http.StatusBadRequest, shared.OpenAIError{
+		return nil, false, c.JSON(http.StatusBadRequest, shared.OpenAIError{
 			Message: "failed to read request body",
 			Object:  "error",
 			Type:    "BadRequest",
 			Code:    http.StatusBadRequest,
 		})
 	}
+	if int64(len(body)) > limit {
+		return nil, false, c.JSON(http.StatusRequestEntityTooLarge, shared.OpenAIError{
+			Message: fmt.Sprintf("request body is larger than the %d byte limit", limit),
+			Object:  "error",
+			Type:    "RequestTooLarge",
+			Code:    http.StatusRequestEntityTooLarge,
+		})
+	}
+	return body, true, nil
+}
+
+func (ir *InferenceRouter) Inference(cc echo.Context, endpoint string) (*inference.InferenceOutput, error) {
+	c := cc.(*ctx.Context)
+	body, ok, err := ir.readBody(c, endpoint)
+	if !ok {
+		return nil, err
+	}
+	return ir.infer(c, endpoint, body, func(stream bool) Responder {
+		return newResponder(c, stream)
+	})
+}
 
-	reqInfo, preErr := ir.ih.Preprocess(cc.Request().Context(), inference.PreprocessInput{
+// infer runs body through endpoint and sends the response with the Responder
+// responderFor returns for the request
+func (ir *InferenceRouter) infer(c *ctx.Context, endpoint string, body []byte, responderFor func(stream bool) Responder) (*inference.InferenceOutput, error) {
+	reqInfo, preErr := ir.ih.Preprocess(c.Request().Context(), inference.PreprocessInput{
 		Body:      body,
 		User:      *c.User,
 		Endpoint:  endpoint,
@@ -142,14 +333,14 @@ func (ir *InferenceRouter) Inference(cc echo.Context, endpoint string) (*inferen
 		c.LogValues.AddError(preErr)
 		var rerr *shared.RequestError
 		if errors.As(preErr, &rerr) {
-			return nil, c.JSON(rerr.StatusCode, shared.OpenAIError{
+			return nil, responderFor(false).Error(rerr.StatusCode, shared.OpenAIError{
 				Message: rerr.Error(),
 				Object:  "error",
 				Type:    "InternalError",
 				Code:    rerr.StatusCode,
 			})
 		}
-		return nil, c.JSON(500, shared.OpenAIError{
+		return nil, responderFor(false).Error(500, shared.OpenAIError{
 			Message: "internal server error",
 			Object:  "error",
 			Type:    "InternalError",
@@ -158,38 +349,36 @@ func (ir *InferenceRouter) Inference(cc echo.Context, endpoint string) (*inferen
 	}
 
 	// Track all metadata for request
-	c.LogValues.InferenceInfo = &ctx.InferenceInfo{
-		ModelName: reqInfo.Model,
-		ModelURL:  reqInfo.ModelMetadata.URL,
-		ModelID:   reqInfo.ModelMetadata.ModelID,
-		Stream:    reqInfo.Stream,
-	}
+	c.LogValues.InferenceInfo = newInferenceInfo(reqInfo)
 
-	var out *inference.InferenceOutput
-	var reqErr error
-	switch reqInfo.Stream {
-	case true:
-		out, reqErr = ir.StreamInference(c, reqInfo)
-	case false:
-		out, reqErr = ir.NonStreamInference(c, reqInfo)
+	// Returned so clients can reproduce outputs with the same seed
+	if reqInfo.Seed != nil {
+		c.Response().Header().Set("X-Sybil-Seed", strconv.FormatInt(*reqInfo.Seed, 10))
+	}
+	// Confirms to the client that nothing about the request is kept
+	if reqInfo.Ephemeral {
+		c.Response().Header().Set("X-Sybil-Ephemeral", "true")
 	}
 
-	// This is only the case that an error happens and no headers or data has been
-	// sent back. This *should* be a rare case
+	responder := responderFor(reqInfo.Stream)
+	out, reqErr := ir.respond(c, reqInfo, responder)
+
+	// Errors before any tokens were produced. Streams have already sent
+	// headers so these go out as an error frame
 	if reqErr != nil {
 		c.LogValues.AddError(reqErr)
 		c.LogValues.LogLevel = "ERROR"
 		var rerr *shared.RequestError
 		// Unkown error, shouldnt really happen
 		if !errors.As(reqErr, &rerr) {
-			return nil, c.JSON(500, shared.OpenAIError{
+			return nil, responder.Error(500, shared.OpenAIError{
 				Message: "unkown internal error",
 				Object:  "error",
 				Type:    "InternalError",
 				Code:    500,
 			})
 		}
-		return nil, c.JSON(rerr.StatusCode, shared.OpenAIError{
+		return nil, responder.Error(rerr.StatusCode, shared.OpenAIError{
 			Message: rerr.Error(),
 			Object:  "error",
 			Type:    "InternalError",
@@ -207,66 +396,105 @@ func (ir *InferenceRouter) Inference(cc echo.Context, endpoint string) (*inferen
 	return out, nil
 }
 
-func setupSSEHeaders(c *ctx.Context) {
-	c.Response().Header().Set("Content-Type", "text/event-stream")
-	c.Response().Header().Set("Cache-Control", "no-cache")
-	c.Response().Header().Set("Connection", "keep-alive")
-	c.Response().WriteHeader(http.StatusOK)
-}
+// newInferenceInfo builds the log info for a preprocessed request. Shared by
+// the plain inference and chat history paths
+func newInferenceInfo(reqInfo *inference.RequestInfo) *ctx.InferenceInfo {
+	return &ctx.InferenceInfo{
+		ModelName: reqInfo.Model,
+		ModelURL:  reqInfo.ModelMetadata.URL,
+		ModelID:   reqInfo.ModelMetadata.ModelID,
+		Stream:    reqInfo.Stream,
+		BYOK:      reqInfo.BYOK,
 
-func createStreamCallback(c *ctx.Context) func(token string) error {
-	return func(token string) error {
-		if c.Request().Context().Err() != nil {
-			return c.Request().Context().Err()
-		}
-		_, err := fmt.Fprintf(c.Response(), "%s\n\n", token)
-		if err != nil {
-			return err
-		}
-		c.Response().Flush()
-		return nil
+		PolicyID:      reqInfo.PolicyID,
+		PolicyVersion: reqInfo.PolicyVersion,
 	}
 }
 
-func (ir *InferenceRouter) StreamInference(c *ctx.Context, reqInfo *inference.RequestInfo) (*inference.InferenceOutput, error) {
-	setupSSEHeaders(c)
-	streamCallback := createStreamCallback(c)
-
+// respond runs inference for the request and sends the output through the
+// responder
+func (ir *InferenceRouter) respond(c *ctx.Context, reqInfo *inference.RequestInfo, responder Responder) (*inference.InferenceOutput, error) {
+	responder.Start()
 	out, reqErr := ir.ih.DoInference(inference.InferenceInput{
 		Req:          reqInfo,
 		User:         *c.User,
 		Ctx:          c.Request().Context(),
-		StreamWriter: streamCallback, // Pass the callback for real-time streaming
-	})
-	return out, reqErr
-}
-
-func (ir *InferenceRouter) NonStreamInference(c *ctx.Context, reqInfo *inference.RequestInfo) (*inference.InferenceOutput, error) {
-	out, reqErr := ir.ih.DoInference(inference.InferenceInput{
-		Req:  reqInfo,
-		User: *c.User,
-		Ctx:  c.Request().Context(),
+		StreamWriter: responder.StreamWriter(),
 	})
-
 	if reqErr != nil {
 		return out, reqErr
 	}
 
-	// Need to actually send back response for non streaming requests
-	c.Response().Header().Set("Content-Type", "application/json")
-	c.Response().WriteHeader(http.StatusOK)
-	if _, err := c.Response().Write(out.FinalResponse); err != nil {
-		c.LogValues.AddError(errors.Join(errors.New("failed writing final response"), err))
+	if reqInfo.CacheKey != "" {
+		cacheStatus := "MISS"
+		if out.Metadata.Cached {
+			cacheStatus = "HIT"
+		}
+		c.Response().Header().Set("X-Sybil-Cache", cacheStatus)
+	}
+	if err := responder.Finish(out.FinalResponse); err != nil {
+		c.LogValues.AddError(err)
 		c.LogValues.LogLevel = "ERROR"
 		return out, err
 	}
-	return out, reqErr
+	return out, nil
 }
 
-func classifyQueryForChat(ctx context.Context, query string, apiKey string) bool {
+func classifyQueryForChat(ctx context.Context, query string, apiKey string) inference.Classification {
 	return inference.ClassifyQuery(ctx, query, apiKey)
 }
 
-func queryGoogleSearchForChat(googleService *customsearch.Service, log *zap.SugaredLogger, googleSearchEngineID string, query string) (*shared.SearchResponseBody, error) {
-	return inference.QueryGoogleSearch(googleService, log, googleSearchEngineID, query)
+// newHeroCards builds the hero card adapters that can run, nil when hero cards
+// are off
+func newHeroCards(config *InferenceRouterConfig, log *zap.SugaredLogger) *herocard.Enricher {
+	if !config.HeroCards {
+		return nil
+	}
+	adapters := []herocard.Adapter{herocard.NewOpenMeteo(), herocard.NewDictionary()}
+	if config.AlphaVantageAPIKey != "" {
+		adapters = append(adapters, herocard.NewAlphaVantage(config.AlphaVantageAPIKey))
+	}
+	if config.TheSportsDBAPIKey != "" {
+		adapters = append(adapters, herocard.NewTheSportsDB(config.TheSportsDBAPIKey))
+	}
+	return herocard.NewEnricher(log, shared.HeroCardTimeout, adapters...)
+}
+
+// newSearchProviders builds the configured providers in the configured order,
+// nil when none has a key
+func newSearchProviders(config *InferenceRouterConfig, searchQuota *inference.SearchQuota, log *zap.SugaredLogger) *search.Providers {
+	order := config.SearchProviders
+	if order == "" {
+		order = strings.Join(shared.SearchProviders, ",")
+	}
+
+	var providers []search.Provider
+	for name := range strings.SplitSeq(order, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case shared.SearchProviderGoogle:
+			if config.GoogleAPIKey == "" || config.GoogleSearchEngineID == "" {
+				continue
+			}
+			google, err := search.NewGoogle(config.GoogleAPIKey, config.GoogleSearchEngineID, log)
+			if err != nil {
+				log.Warnw("Failed to create google search provider", "error", err)
+				continue
+			}
+			providers = append(providers, searchQuota.Limit(google))
+		case shared.SearchProviderBrave:
+			if config.BraveAPIKey != "" {
+				providers = append(providers, search.NewBrave(config.BraveAPIKey))
+			}
+		case shared.SearchProviderBing:
+			if config.BingAPIKey != "" {
+				providers = append(providers, search.NewBing(config.BingAPIKey))
+			}
+		default:
+			log.Warnw("Unknown search provider in order", "provider", name)
+		}
+	}
+	if len(providers) == 0 {
+		return nil
+	}
+	return search.NewProviders(log, providers...)
 }
@@ -0,0 +1,163 @@
+package routers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/modelalerts"
+	"sybil-api/internal/handlers/targon"
+	"sybil-api/internal/middleware"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type ModelAlertRouter struct {
+	mh *modelalerts.ModelAlertHandler
+}
+
+// RegisterModelAlertRoutes adds the routes model owners use to subscribe to
+// alerts on their deployments and starts the monitor and autoscaler. The
+// returned func stops both
+func RegisterModelAlertRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, redisClient *redis.Client, log *zap.SugaredLogger, targonAPIKey, targonURL, targonSigningSecret string) (func(), error) {
+	umw, err := middleware.GetUserMiddleware()
+	if err != nil {
+		return nil, err
+	}
+	targonHandler, err := targon.NewTargonHandler(wdb, rdb, redisClient, targonAPIKey, targonURL, targonSigningSecret, log)
+	if err != nil {
+		return nil, err
+	}
+
+	mr := ModelAlertRouter{mh: modelalerts.NewModelAlertHandler(wdb, rdb, redisClient, log, targonHandler)}
+	for _, requireAdminScope := range versionGroups(e, "", umw.ExtractUser, umw.RequireUser, umw.RequireScope(shared.ScopeAdmin)) {
+		requireAdminScope.GET("/model-alerts", mr.ListModelAlerts)
+		requireAdminScope.PUT("/model-alerts", mr.SetModelAlert)
+		requireAdminScope.DELETE("/model-alerts/:id", mr.DeleteModelAlert)
+		requireAdminScope.GET("/models/:id/cold-starts", mr.GetColdStartStats)
+	}
+
+	monitorCtx, cancel := context.WithCancel(context.Background())
+	go mr.mh.RunMonitor(monitorCtx)
+	go mr.mh.RunAutoscaler(monitorCtx)
+	go mr.mh.RunWarmPool(monitorCtx)
+	return cancel, nil
+}
+
+func (mr *ModelAlertRouter) SetModelAlert(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req modelalerts.SetModelAlertRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	alert, err := mr.mh.SetModelAlertLogic(modelalerts.ModelAlertInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		Req:    &req,
+	})
+	if err != nil {
+		return modelAlertErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, alert)
+}
+
+func (mr *ModelAlertRouter) ListModelAlerts(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	alerts, err := mr.mh.ListModelAlertsLogic(modelalerts.ModelAlertInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+	})
+	if err != nil {
+		return modelAlertErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": alerts})
+}
+
+func (mr *ModelAlertRouter) DeleteModelAlert(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	alertID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid model alert id"})
+	}
+
+	err = mr.mh.DeleteModelAlertLogic(modelalerts.ModelAlertInput{
+		Ctx:     c.Request().Context(),
+		UserID:  c.User.UserID,
+		AlertID: alertID,
+	})
+	if err != nil {
+		return modelAlertErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Model alert deleted",
+		"id":      alertID,
+	})
+}
+
+func (mr *ModelAlertRouter) GetColdStartStats(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	modelID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid model id"})
+	}
+	var windowMinutes uint64
+	if raw := c.QueryParam("window_minutes"); raw != "" {
+		windowMinutes, err = strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid window_minutes"})
+		}
+	}
+
+	stats, err := mr.mh.ColdStartStatsLogic(modelalerts.ColdStartStatsInput{
+		Ctx:           c.Request().Context(),
+		UserID:        c.User.UserID,
+		ModelID:       modelID,
+		WindowMinutes: windowMinutes,
+	})
+	if err != nil {
+		return modelAlertErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// GetWarmPoolReport returns the traffic forecast, warm state and savings
+// estimate of every model on the warm pool schedule with its recent changes
+func (mr *ModelAlertRouter) GetWarmPoolReport(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	report, err := mr.mh.WarmPoolReportLogic(c.Request().Context())
+	if err != nil {
+		return modelAlertErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+func modelAlertErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
@@ -0,0 +1,98 @@
+package routers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/policy"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+)
+
+type PolicyRouter struct {
+	ph *policy.PolicyHandler
+}
+
+func NewPolicyRouter(ph *policy.PolicyHandler) *PolicyRouter {
+	return &PolicyRouter{ph: ph}
+}
+
+func (pr *PolicyRouter) SetPolicy(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req policy.SetPolicyRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	p, err := pr.ph.SetPolicyLogic(policy.SetPolicyInput{
+		Ctx:     c.Request().Context(),
+		AdminID: c.User.UserID,
+		Req:     req,
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+func (pr *PolicyRouter) ListPolicies(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	userID, err := strconv.ParseUint(c.QueryParam("user_id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "user_id is required"})
+	}
+
+	policies, err := pr.ph.ListPoliciesLogic(policy.PolicyInput{
+		Ctx:    c.Request().Context(),
+		UserID: userID,
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": policies})
+}
+
+func (pr *PolicyRouter) DeactivatePolicy(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	policyID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid policy id"})
+	}
+
+	err = pr.ph.DeactivatePolicyLogic(policy.PolicyInput{
+		Ctx:      c.Request().Context(),
+		PolicyID: policyID,
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Policy deactivated",
+		"id":      policyID,
+	})
+}
+
+func policyErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
@@ -0,0 +1,102 @@
+package routers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/providerkeys"
+	"sybil-api/internal/middleware"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+type ProviderKeyRouter struct {
+	ph *providerkeys.ProviderKeyHandler
+}
+
+func RegisterProviderKeyRoutes(e *echo.Group, wdb *sql.DB, rdb *sql.DB, keyring *shared.Keyring, log *zap.SugaredLogger) error {
+	umw, err := middleware.GetUserMiddleware()
+	if err != nil {
+		return err
+	}
+
+	pr := ProviderKeyRouter{ph: providerkeys.NewProviderKeyHandler(wdb, rdb, keyring, log)}
+	for _, requireAdminScope := range versionGroups(e, "", umw.ExtractUser, umw.RequireUser, umw.RequireScope(shared.ScopeAdmin)) {
+		requireAdminScope.GET("/provider-keys", pr.ListProviderKeys)
+		requireAdminScope.PUT("/provider-keys", pr.SetProviderKey)
+		requireAdminScope.DELETE("/provider-keys/:provider", pr.DeleteProviderKey)
+	}
+	return nil
+}
+
+func (pr *ProviderKeyRouter) SetProviderKey(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req providerkeys.SetProviderKeyRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	key, err := pr.ph.SetProviderKeyLogic(providerkeys.ProviderKeyInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		Req:    &req,
+	})
+	if err != nil {
+		return providerKeyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, key)
+}
+
+func (pr *ProviderKeyRouter) ListProviderKeys(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	keys, err := pr.ph.ListProviderKeysLogic(providerkeys.ProviderKeyInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+	})
+	if err != nil {
+		return providerKeyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": keys})
+}
+
+func (pr *ProviderKeyRouter) DeleteProviderKey(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	err := pr.ph.DeleteProviderKeyLogic(providerkeys.ProviderKeyInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		Provider: c.Param("provider"),
+	})
+	if err != nil {
+		return providerKeyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":  "Provider key deleted",
+		"provider": c.Param("provider"),
+	})
+}
+
+func providerKeyErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
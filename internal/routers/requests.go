@@ -0,0 +1,387 @@
+package routers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/inference"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (ir *InferenceRouter) GetRequest(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	record, err := ir.ih.GetRequest(inference.GetRequestInput{
+		Ctx:       c.Request().Context(),
+		UserID:    c.User.UserID,
+		RequestID: c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		if errors.Is(err, shared.ErrNotFound) {
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "request not found"})
+		}
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, record)
+}
+
+func (ir *InferenceRouter) ListChatHistories(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+	output, err := ir.ih.ListChatHistories(inference.ListChatHistoriesInput{
+		Ctx:    c.Request().Context(),
+		User:   *c.User,
+		Limit:  limit,
+		Offset: offset,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, output)
+}
+
+func (ir *InferenceRouter) DeleteChatHistory(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	err := ir.ih.DeleteChatHistory(inference.GetChatHistoryInput{
+		Ctx:       c.Request().Context(),
+		User:      *c.User,
+		HistoryID: c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		if errors.Is(err, shared.ErrNotFound) {
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "history not found"})
+		}
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "History deleted",
+		"id":      c.Param("id"),
+	})
+}
+
+func (ir *InferenceRouter) GetChatHistory(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	record, err := ir.ih.GetChatHistory(inference.GetChatHistoryInput{
+		Ctx:       c.Request().Context(),
+		User:      *c.User,
+		HistoryID: c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		if errors.Is(err, shared.ErrNotFound) {
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "history not found"})
+		}
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, record)
+}
+
+func (ir *InferenceRouter) ShareChatHistory(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	share, err := ir.ih.ShareChatHistory(inference.GetChatHistoryInput{
+		Ctx:       c.Request().Context(),
+		User:      *c.User,
+		HistoryID: c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		if errors.Is(err, shared.ErrNotFound) {
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "history not found"})
+		}
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, share)
+}
+
+func (ir *InferenceRouter) RevokeChatShare(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	err := ir.ih.RevokeChatShare(inference.GetChatHistoryInput{
+		Ctx:       c.Request().Context(),
+		User:      *c.User,
+		HistoryID: c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		if errors.Is(err, shared.ErrNotFound) {
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "chat share not found"})
+		}
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Chat share revoked",
+		"id":      c.Param("id"),
+	})
+}
+
+// GetSharedChat is public, anyone with the token can read the transcript
+func (ir *InferenceRouter) GetSharedChat(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	token := c.Param("token")
+	if !strings.HasPrefix(token, "sh_") {
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "chat share not found"})
+	}
+	chat, err := ir.ih.GetSharedChat(inference.GetSharedChatInput{
+		Ctx:   c.Request().Context(),
+		Token: token,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		if errors.Is(err, shared.ErrNotFound) {
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "chat share not found"})
+		}
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, chat)
+}
+
+func (ir *InferenceRouter) BranchChatHistory(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	fromMessage, err := strconv.Atoi(c.QueryParam("from_message"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "from_message must be a message position"})
+	}
+	branch, err := ir.ih.BranchChatHistory(inference.BranchChatHistoryInput{
+		GetChatHistoryInput: inference.GetChatHistoryInput{
+			Ctx:       c.Request().Context(),
+			User:      *c.User,
+			HistoryID: c.Param("id"),
+		},
+		FromMessage: fromMessage,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		switch true {
+		case errors.Is(err, shared.ErrNotFound):
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "history not found"})
+		case errors.Is(err, shared.ErrBadRequest):
+			return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+		default:
+			return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+		}
+	}
+	return c.JSON(http.StatusOK, branch)
+}
+
+func (ir *InferenceRouter) ImportChatHistories(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, shared.ChatImportMaxBytes+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "failed to read request body"})
+	}
+	if len(body) > shared.ChatImportMaxBytes {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("imports are limited to %d bytes", shared.ChatImportMaxBytes)})
+	}
+
+	output, err := ir.ih.ImportChatHistories(inference.ImportChatHistoriesInput{
+		Ctx:  c.Request().Context(),
+		User: *c.User,
+		Body: body,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		switch true {
+		case errors.Is(err, shared.ErrBadRequest):
+			res := map[string]any{"error": shared.StackTrace(err)[0].Error()}
+			if output != nil && len(output.Errors) > 0 {
+				res["errors"] = output.Errors
+			}
+			return c.JSON(shared.ErrBadRequest.StatusCode, res)
+		default:
+			// Histories created before the failure are reported so the client
+			// can resume from there
+			res := map[string]any{"error": shared.ErrInternalServerError.Error()}
+			if output != nil {
+				res["data"] = output.Data
+			}
+			return c.JSON(shared.ErrInternalServerError.StatusCode, res)
+		}
+	}
+	return c.JSON(http.StatusOK, output)
+}
+
+// DeleteAllChatHistories answers without ?confirm= with a confirmation token,
+// repeating the call with it starts deleting every history of the user
+func (ir *InferenceRouter) DeleteAllChatHistories(cc echo.Context) error {
+	return bulkDelete(cc, ir.ih.DeleteAllChatHistories)
+}
+
+// DeleteUserData is DeleteAllChatHistories for all of the users stored content
+func (ir *InferenceRouter) DeleteUserData(cc echo.Context) error {
+	return bulkDelete(cc, ir.ih.DeleteUserData)
+}
+
+func bulkDelete(cc echo.Context, start func(inference.BulkDeleteInput) (*inference.DeletionConfirmation, *inference.DeletionJob, error)) error {
+	c := cc.(*ctx.Context)
+	confirmation, job, err := start(inference.BulkDeleteInput{
+		Ctx:          c.Request().Context(),
+		User:         *c.User,
+		Confirmation: c.QueryParam("confirm"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		switch true {
+		case errors.Is(err, shared.ErrBadRequest):
+			return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+		default:
+			return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+		}
+	}
+	if confirmation != nil {
+		return c.JSON(http.StatusOK, confirmation)
+	}
+	return c.JSON(http.StatusAccepted, job)
+}
+
+func (ir *InferenceRouter) GetDeletionJob(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	job, err := ir.ih.GetDeletionJob(inference.GetDeletionJobInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		JobID:  c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		switch true {
+		case errors.Is(err, shared.ErrNotFound):
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+		default:
+			return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+		}
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// GetBalance returns the callers balance with usage that has not been flushed
+// to the database yet taken off
+func (ir *InferenceRouter) GetBalance(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	balance, err := ir.ih.GetBalance(c.Request().Context(), *c.User)
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, balance)
+}
+
+func (ir *InferenceRouter) GetDataRetention(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	retention, err := ir.ih.GetDataRetention(c.Request().Context(), c.User.UserID)
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, retention)
+}
+
+func (ir *InferenceRouter) SetDataRetention(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+	var retention inference.DataRetention
+	if err := json.Unmarshal(body, &retention); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+	updated, err := ir.ih.SetDataRetention(inference.SetDataRetentionInput{
+		Ctx:       c.Request().Context(),
+		UserID:    c.User.UserID,
+		Retention: retention,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		switch true {
+		case errors.Is(err, shared.ErrBadRequest):
+			return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+		default:
+			return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+		}
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+func (ir *InferenceRouter) GetPIIRedaction(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	mode, err := ir.ih.GetPIIRedaction(c.Request().Context(), c.User.UserID)
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"mode": mode})
+}
+
+func (ir *InferenceRouter) SetPIIRedaction(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+	var req struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+	err = ir.ih.SetPIIRedaction(inference.SetPIIRedactionInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		Mode:   req.Mode,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		switch true {
+		case errors.Is(err, shared.ErrBadRequest):
+			return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+		default:
+			return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]string{"mode": req.Mode})
+}
+
+func (ir *InferenceRouter) GetSearchDefaults(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	defaults, err := ir.ih.GetSearchDefaults(c.Request().Context(), c.User.UserID)
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, defaults)
+}
+
+func (ir *InferenceRouter) SetSearchDefaults(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+	var req inference.SearchDefaults
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+	if msg := searchDefaultsError(req.Region, req.Language, req.Safe); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	req.Region = strings.ToLower(req.Region)
+	err = ir.ih.SetSearchDefaults(inference.SetSearchDefaultsInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		Defaults: req,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, req)
+}
@@ -0,0 +1,59 @@
+package routers
+
+import (
+	"errors"
+	"net/http"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/shared"
+)
+
+// Responder owns the transport for an inference response so handlers only
+// deal with tokens and final bodies
+type Responder interface {
+	// Start is called once before inference begins. Streaming transports
+	// commit their headers here
+	Start()
+	// StreamWriter returns the callback passed to the inference handler, or
+	// nil when the transport does not stream
+	StreamWriter() func(token string) error
+	// Finish sends the final response body. Streaming transports have already
+	// sent everything and ignore it
+	Finish(body []byte) error
+	// Error reports a failure to the client. Streaming transports that have
+	// already sent headers send it as an error frame instead
+	Error(statusCode int, body shared.OpenAIError) error
+}
+
+func newResponder(c *ctx.Context, stream bool) Responder {
+	// Lets clients quote the request when reporting problems
+	c.Response().Header().Set("X-Request-Id", "req_"+c.Reqid)
+	if stream {
+		return &sseResponder{c: c, done: make(chan struct{})}
+	}
+	return &jsonResponder{c: c}
+}
+
+// jsonResponder sends the full response body once inference completes
+type jsonResponder struct {
+	c *ctx.Context
+}
+
+func (r *jsonResponder) Start() {}
+
+func (r *jsonResponder) StreamWriter() func(token string) error {
+	return nil
+}
+
+func (r *jsonResponder) Finish(body []byte) error {
+	r.c.Response().Header().Set("Content-Type", "application/json")
+	r.c.Response().WriteHeader(http.StatusOK)
+	if _, err := r.c.Response().Write(body); err != nil {
+		return errors.Join(errors.New("failed writing final response"), err)
+	}
+	return nil
+}
+
+func (r *jsonResponder) Error(statusCode int, body shared.OpenAIError) error {
+	return r.c.JSON(statusCode, body)
+}
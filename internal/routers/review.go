@@ -0,0 +1,89 @@
+package routers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/review"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ReviewRouter struct {
+	rh *review.ReviewHandler
+}
+
+func NewReviewRouter(rh *review.ReviewHandler) *ReviewRouter {
+	return &ReviewRouter{rh: rh}
+}
+
+func (rr *ReviewRouter) ListSamples(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	modelID, _ := strconv.ParseUint(c.QueryParam("model_id"), 10, 64)
+	afterID, _ := strconv.ParseUint(c.QueryParam("after"), 10, 64)
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+
+	samples, err := rr.rh.ListSamplesLogic(review.ListSamplesInput{
+		Ctx:       c.Request().Context(),
+		ModelID:   modelID,
+		Unlabeled: c.QueryParam("status") == "unlabeled",
+		AfterID:   afterID,
+		Limit:     limit,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"data": samples,
+	})
+}
+
+func (rr *ReviewRouter) LabelSample(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	sampleID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid sample id"})
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req review.LabelRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	err = rr.rh.LabelSampleLogic(review.LabelSampleInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		SampleID: sampleID,
+		Req:      req,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		switch true {
+		case errors.Is(err, shared.ErrNotFound):
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "review sample not found"})
+		case errors.Is(err, shared.ErrBadRequest):
+			return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+		default:
+			return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Sample labeled",
+		"id":      sampleID,
+	})
+}
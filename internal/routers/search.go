@@ -0,0 +1,431 @@
+package routers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/inference"
+	"sybil-api/internal/search"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+type SearchRouter struct {
+	// Saves and reads search history, nil on the admin router
+	ih    *inference.InferenceHandler
+	cache *search.Cache
+	// Merges recent and trending queries into autocomplete, nil on the admin
+	// router
+	autocomplete *search.Autocompleter
+	// Nil when no search provider is configured, only the admin routes work
+	providers        *search.Providers
+	geoCountryHeader string
+	// Buffers answer streams so they can be resumed, nil on the admin router
+	redisClient *redis.Client
+}
+
+func NewSearchRouter(ih *inference.InferenceHandler, cache *search.Cache, autocomplete *search.Autocompleter, providers *search.Providers, geoCountryHeader string, redisClient *redis.Client) *SearchRouter {
+	return &SearchRouter{ih: ih, cache: cache, autocomplete: autocomplete, providers: providers, geoCountryHeader: geoCountryHeader, redisClient: redisClient}
+}
+
+// Web searches the web for the q query param
+func (sr *SearchRouter) Web(cc echo.Context) error {
+	return sr.search(cc, search.TypeWeb, sr.providers.Search)
+}
+
+// Images searches images for the q query param
+func (sr *SearchRouter) Images(cc echo.Context) error {
+	return sr.search(cc, search.TypeImages, sr.providers.Images)
+}
+
+// Autocomplete completes the partial query in the q query param, the
+// completions are in suggestions. Provider suggestions are ranked together
+// with the users recent searches and trending queries
+func (sr *SearchRouter) Autocomplete(cc echo.Context) error {
+	return sr.search(cc, search.TypeAutocomplete, func(ctx context.Context, provider string, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+		suggestions, err := sr.providers.Autocomplete(ctx, provider, query, locale)
+		if err != nil {
+			return nil, err
+		}
+		return &shared.SearchResponseBody{Query: query, Suggestions: suggestions}, nil
+	})
+}
+
+// News searches news articles for the q query param
+func (sr *SearchRouter) News(cc echo.Context) error {
+	return sr.search(cc, search.TypeNews, sr.providers.News)
+}
+
+// Videos searches videos for the q query param
+func (sr *SearchRouter) Videos(cc echo.Context) error {
+	return sr.search(cc, search.TypeVideos, sr.providers.Videos)
+}
+
+// Shopping searches product offers for the q query param
+func (sr *SearchRouter) Shopping(cc echo.Context) error {
+	return sr.search(cc, search.TypeShopping, sr.providers.Shopping)
+}
+
+// search runs a cached search of one type. The provider, region, lang and
+// safe query params override the users defaults, the locale otherwise comes
+// from the request like it does for chat search. Clients the abuse detector
+// blocks or challenges are refused with the search reason
+func (sr *SearchRouter) search(cc echo.Context, searchType string, run func(context.Context, string, string, *shared.SearchLocale) (*shared.SearchResponseBody, error)) error {
+	c := cc.(*ctx.Context)
+
+	if sr.providers == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "search is not available"})
+	}
+	query := strings.TrimSpace(c.QueryParam("q"))
+	if query == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "q is required"})
+	}
+	settings := &shared.ChatSettings{
+		SearchProvider: c.QueryParam("provider"),
+		SearchRegion:   c.QueryParam("region"),
+		SearchLanguage: c.QueryParam("lang"),
+		SearchSafe:     c.QueryParam("safe"),
+	}
+	if !validSearchProvider(settings) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "provider must be one of " + strings.Join(shared.SearchProviders, ", ")})
+	}
+	if msg := searchDefaultsError(settings.SearchRegion, settings.SearchLanguage, settings.SearchSafe); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	locale := requestSearchLocale(c, settings, sr.geoCountryHeader)
+	if locale != nil {
+		c.LogValues.SearchRegion = locale.Region
+		c.LogValues.SearchLanguage = locale.Language
+		c.LogValues.SearchLocaleSource = locale.Source
+	}
+
+	// Scored before the cache so cached queries still count towards velocity
+	if reason := sr.ih.SearchAbuseReason(c.Request().Context(), searchClient(c), query); reason != "" {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "search refused", "reason": reason})
+	}
+
+	key := search.CacheKey{Type: searchType, Provider: settings.SearchProvider, Query: query, Locale: locale}
+	res, err := sr.cache.Search(c.Request().Context(), key, func(ctx context.Context) (*shared.SearchResponseBody, error) {
+		return run(ctx, settings.SearchProvider, query, locale)
+	})
+	if searchType == search.TypeAutocomplete && sr.autocomplete != nil {
+		return sr.complete(c, query, res, err)
+	}
+	switch {
+	case errors.Is(err, search.ErrUnsupported):
+		return c.JSON(http.StatusNotImplemented, map[string]string{"error": searchType + " search is not offered by any configured provider"})
+	case err != nil:
+		c.LogValues.AddError(errors.Join(errors.New("failed to search "+searchType), err))
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "search failed"})
+	}
+
+	// Autocomplete runs on every keystroke and is not worth keeping, searches
+	// without results are not worth suggesting
+	if searchType == search.TypeAutocomplete || len(res.Results) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+	id, err := sr.ih.SaveSearch(inference.SaveSearchInput{
+		Ctx:       c.Request().Context(),
+		User:      *c.User,
+		RequestID: c.Reqid,
+		Type:      searchType,
+		Results:   res,
+	})
+	if err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to save search"), err))
+	}
+	if c.User.StoreData {
+		sr.autocomplete.Record(c.Request().Context(), c.User.UserID, query)
+	}
+	if id == "" {
+		return c.JSON(http.StatusOK, res)
+	}
+	saved := *res
+	saved.ID = id
+	return c.JSON(http.StatusOK, saved)
+}
+
+// complete ranks the cached provider suggestions with recent and trending
+// queries. Those still complete the query when every provider failed
+func (sr *SearchRouter) complete(c *ctx.Context, query string, res *shared.SearchResponseBody, err error) error {
+	if err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to search autocomplete"), err))
+		res = &shared.SearchResponseBody{Query: query}
+	}
+	// Recent searches are only kept for users who allow it
+	var userID uint64
+	if c.User.StoreData {
+		userID = c.User.UserID
+	}
+	completed := *res
+	completed.Suggestions = sr.autocomplete.Complete(c.Request().Context(), userID, query, res.Suggestions)
+	return c.JSON(http.StatusOK, completed)
+}
+
+type SearchAnswerRequest struct {
+	Query    string               `json:"query"`
+	Settings *shared.ChatSettings `json:"settings,omitempty"`
+	// Saves the query and answer as a chat history to continue from
+	SaveToHistory bool `json:"save_to_history,omitempty"`
+}
+
+// Answer searches the web for the query and streams an answer grounded in
+// the results, ending with a history_id event when the answer was saved to a
+// chat history and a search event holding the saved search id. The answer
+// keeps running when the client disconnects, see ResumeAnswer
+func (sr *SearchRouter) Answer(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "failed to read request body"})
+	}
+	var req SearchAnswerRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to unmarshal request body"), err))
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+	req.Query = strings.TrimSpace(req.Query)
+	if req.Query == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "query is required"})
+	}
+	settings := req.Settings
+	if settings == nil {
+		settings = &shared.ChatSettings{}
+	}
+	if !validSearchProvider(settings) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": searchProviderError})
+	}
+	locale := requestSearchLocale(c, settings, sr.geoCountryHeader)
+	if locale != nil {
+		c.LogValues.SearchRegion = locale.Region
+		c.LogValues.SearchLanguage = locale.Language
+		c.LogValues.SearchLocaleSource = locale.Source
+	}
+
+	responder := newResumableResponder(c, newSSEBuffer(sr.redisClient, c.User.UserID, c.Reqid))
+	responder.Start()
+
+	answerCtx, cancel := context.WithTimeout(context.WithoutCancel(c.Request().Context()), shared.SearchAnswerTimeout)
+	defer cancel()
+	output, err := sr.ih.SearchAnswer(&inference.SearchAnswerInput{
+		Query:         req.Query,
+		Settings:      settings,
+		User:          *c.User,
+		RequestID:     c.Reqid,
+		Ctx:           answerCtx,
+		StreamWriter:  responder.StreamWriter(),
+		SearchLocale:  locale,
+		SearchClient:  searchClient(c),
+		SaveToHistory: req.SaveToHistory,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		c.LogValues.LogLevel = "ERROR"
+		var rerr *shared.RequestError
+		if errors.As(err, &rerr) {
+			return responder.Error(rerr.StatusCode, shared.OpenAIError{
+				Message: rerr.Error(),
+				Object:  "error",
+				Type:    "RequestError",
+				Code:    rerr.StatusCode,
+			})
+		}
+		return responder.Error(http.StatusInternalServerError, shared.OpenAIError{
+			Message: "internal server error",
+			Object:  "error",
+			Type:    "InternalError",
+			Code:    http.StatusInternalServerError,
+		})
+	}
+	c.LogValues.InferenceInfo = newInferenceInfo(output.Req)
+	c.LogValues.InferenceInfo.InfMetadata = output.InfMetadata
+
+	if output.HistoryID != "" {
+		c.LogValues.HistoryID = output.HistoryID
+		historyJSON, _ := json.Marshal(map[string]any{"type": "history_id", "id": output.HistoryID})
+		_ = responder.StreamWriter()(fmt.Sprintf("data: %s", historyJSON))
+	}
+	if output.Results != nil && len(output.Results.Results) > 0 {
+		id, err := sr.ih.SaveSearch(inference.SaveSearchInput{
+			Ctx:       answerCtx,
+			User:      *c.User,
+			RequestID: c.Reqid,
+			Type:      search.TypeWeb,
+			Results:   output.Results,
+			HistoryID: output.HistoryID,
+		})
+		if err != nil {
+			c.LogValues.AddError(errors.Join(errors.New("failed to save search"), err))
+		}
+		if c.User.StoreData {
+			sr.autocomplete.Record(answerCtx, c.User.UserID, req.Query)
+		}
+		if id != "" {
+			searchJSON, _ := json.Marshal(map[string]any{"type": "search", "id": id})
+			_ = responder.StreamWriter()(fmt.Sprintf("data: %s", searchJSON))
+		}
+	}
+	return responder.Finish(nil)
+}
+
+// ResumeAnswer continues an answer stream the client lost, replaying the
+// events after the Last-Event-ID header (or last_event_id query param) and
+// then following the stream until it ends. Streams can be resumed for
+// shared.SSEResumeWindow after their last event
+func (sr *SearchRouter) ResumeAnswer(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid Last-Event-ID"})
+		}
+		lastID = id
+	}
+
+	buffer := newSSEBuffer(sr.redisClient, c.User.UserID, strings.TrimPrefix(c.Param("id"), "req_"))
+	frames, done, err := buffer.read(c.Request().Context(), lastID)
+	if errors.Is(err, errSSEBufferNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "stream not found or expired"})
+	}
+	if err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to read stream buffer"), err))
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+	}
+
+	responder := newResponder(c, true).(*sseResponder)
+	responder.Start()
+	defer responder.stop()
+
+	ticker := time.NewTicker(shared.SSEResumePollInterval)
+	defer ticker.Stop()
+	for {
+		if err := responder.replay(frames); err != nil {
+			return nil
+		}
+		lastID += int64(len(frames))
+		if done {
+			return nil
+		}
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+		frames, done, err = buffer.read(c.Request().Context(), lastID)
+		if err != nil {
+			// Expired while the original went quiet, nothing more will come
+			if !errors.Is(err, errSSEBufferNotFound) {
+				c.LogValues.AddError(errors.Join(errors.New("failed to read stream buffer"), err))
+			}
+			return nil
+		}
+	}
+}
+
+// ListHistory returns a page of the users saved searches, newest first
+func (sr *SearchRouter) ListHistory(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+	output, err := sr.ih.ListSearches(inference.ListSearchesInput{
+		Ctx:    c.Request().Context(),
+		User:   *c.User,
+		Limit:  limit,
+		Offset: offset,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, output)
+}
+
+// GetSaved returns a saved search with its results. It needs no account, the
+// id is the share link
+func (sr *SearchRouter) GetSaved(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	id := c.Param("id")
+	if !strings.HasPrefix(id, "srch_") {
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "search not found"})
+	}
+	saved, err := sr.ih.GetSearch(inference.GetSearchInput{
+		Ctx:      c.Request().Context(),
+		SearchID: id,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		if errors.Is(err, shared.ErrNotFound) {
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "search not found"})
+		}
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, saved)
+}
+
+// DeleteSaved deletes one of the users saved searches
+func (sr *SearchRouter) DeleteSaved(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	err := sr.ih.DeleteSearch(inference.GetSearchInput{
+		Ctx:      c.Request().Context(),
+		User:     *c.User,
+		SearchID: c.Param("id"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		if errors.Is(err, shared.ErrNotFound) {
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "search not found"})
+		}
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Search deleted",
+		"id":      c.Param("id"),
+	})
+}
+
+// DeleteHistory deletes every saved search of the user
+func (sr *SearchRouter) DeleteHistory(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	deleted, err := sr.ih.DeleteAllSearches(inference.ListSearchesInput{
+		Ctx:  c.Request().Context(),
+		User: *c.User,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Search history deleted",
+		"deleted": deleted,
+	})
+}
+
+// PurgeCache drops cached search results for the query param, or all of them
+// when it is not set
+func (sr *SearchRouter) PurgeCache(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	purged, err := sr.cache.Purge(c.Request().Context(), c.QueryParam("query"))
+	if err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to purge search cache"), err))
+		return c.JSON(http.StatusInternalServerError, map[string]any{"error": "failed to purge search cache", "purged": purged})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"purged": purged})
+}
@@ -0,0 +1,235 @@
+package routers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sseResponder streams tokens as server sent events, with a comment frame
+// every shared.SSEHeartbeatInterval so idle connections are not dropped by
+// proxies. Every event gets an increasing id, and when the stream has a
+// buffer its events are kept so a client can resume it with Last-Event-ID
+type sseResponder struct {
+	c       *ctx.Context
+	mu      sync.Mutex
+	started bool
+	closed  bool
+	done    chan struct{}
+	once    sync.Once
+	// Id of the last event sent
+	lastID int64
+	buffer *sseBuffer
+}
+
+// newResumableResponder streams like newResponder, keeping the events in
+// buffer for shared.SSEResumeWindow
+func newResumableResponder(c *ctx.Context, buffer *sseBuffer) *sseResponder {
+	c.Response().Header().Set("X-Request-Id", "req_"+c.Reqid)
+	return &sseResponder{c: c, done: make(chan struct{}), buffer: buffer}
+}
+
+func (r *sseResponder) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.c.Response().Header().Set("Content-Type", "text/event-stream")
+	r.c.Response().Header().Set("Cache-Control", "no-cache")
+	r.c.Response().Header().Set("Connection", "keep-alive")
+	r.c.Response().WriteHeader(http.StatusOK)
+	r.started = true
+	if r.buffer != nil {
+		r.buffer.open()
+	}
+	go r.heartbeat()
+}
+
+func (r *sseResponder) heartbeat() {
+	ticker := time.NewTicker(shared.SSEHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.c.Request().Context().Done():
+			return
+		case <-ticker.C:
+			if err := r.write(": ping"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// write sends one frame. Comment frames are not events and get no id. Events
+// are buffered even once the client is gone, it may come back for them
+func (r *sseResponder) write(frame string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errors.New("stream already finished")
+	}
+	if !strings.HasPrefix(frame, ":") {
+		r.lastID++
+		frame = fmt.Sprintf("id: %d\n%s", r.lastID, frame)
+		if r.buffer != nil {
+			r.buffer.append(frame)
+		}
+	}
+	return r.send(frame)
+}
+
+// send writes a frame as is, the caller holds mu
+func (r *sseResponder) send(frame string) error {
+	if r.c.Request().Context().Err() != nil {
+		return r.c.Request().Context().Err()
+	}
+	_, err := fmt.Fprintf(r.c.Response(), "%s\n\n", frame)
+	if err != nil {
+		return err
+	}
+	r.c.Response().Flush()
+	return nil
+}
+
+// replay sends frames of a buffered stream, which already carry their ids
+func (r *sseResponder) replay(frames []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, frame := range frames {
+		if err := r.send(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop ends the heartbeat and blocks any further writes, so nothing is sent
+// after the handler returns
+func (r *sseResponder) stop() {
+	r.once.Do(func() {
+		close(r.done)
+		if r.buffer != nil {
+			r.buffer.finish()
+		}
+	})
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+}
+
+func (r *sseResponder) StreamWriter() func(token string) error {
+	return r.write
+}
+
+func (r *sseResponder) Finish(_ []byte) error {
+	r.stop()
+	return nil
+}
+
+func (r *sseResponder) Error(statusCode int, body shared.OpenAIError) error {
+	r.mu.Lock()
+	started := r.started
+	r.mu.Unlock()
+	if !started {
+		r.stop()
+		return r.c.JSON(statusCode, body)
+	}
+	defer r.stop()
+	frame, err := json.Marshal(map[string]any{"error": body})
+	if err != nil {
+		return err
+	}
+	return r.write(fmt.Sprintf("data: %s", frame))
+}
+
+// sseBuffer keeps the events of a stream in redis. Event n is at index n-1
+// of the list, and the state key says whether the stream is still open
+type sseBuffer struct {
+	redis *redis.Client
+	key   string
+	// Set once the stream started, streams that failed before it are not
+	// resumable
+	opened bool
+	// Set after a failed write. The buffer is dropped rather than served
+	// with a gap
+	failed bool
+}
+
+func newSSEBuffer(redisClient *redis.Client, userID uint64, requestID string) *sseBuffer {
+	return &sseBuffer{redis: redisClient, key: fmt.Sprintf("sybil:v1:sse:%d:%s", userID, requestID)}
+}
+
+func (b *sseBuffer) setState(state string) {
+	if b.failed {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := b.redis.Set(ctx, b.key+":state", state, shared.SSEResumeWindow).Err(); err != nil {
+		b.drop(ctx)
+	}
+}
+
+// open marks the stream resumable before its first event
+func (b *sseBuffer) open() {
+	b.opened = true
+	b.setState("open")
+}
+
+func (b *sseBuffer) finish() {
+	if b.opened {
+		b.setState("done")
+	}
+}
+
+// append is called in event order under the responders lock
+func (b *sseBuffer) append(frame string) {
+	if b.failed {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	pipe := b.redis.TxPipeline()
+	pipe.RPush(ctx, b.key, frame)
+	pipe.Expire(ctx, b.key, shared.SSEResumeWindow)
+	pipe.Expire(ctx, b.key+":state", shared.SSEResumeWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		b.drop(ctx)
+	}
+}
+
+func (b *sseBuffer) drop(ctx context.Context) {
+	b.failed = true
+	b.redis.Del(ctx, b.key, b.key+":state")
+}
+
+// errSSEBufferNotFound is returned for streams that are unknown, expired or
+// could not be buffered
+var errSSEBufferNotFound = errors.New("stream not found")
+
+// read returns the events after lastID and whether the stream has ended.
+// The state is read first so no event sent before the end can be missed
+func (b *sseBuffer) read(ctx context.Context, lastID int64) ([]string, bool, error) {
+	state, err := b.redis.Get(ctx, b.key+":state").Result()
+	if err == redis.Nil {
+		return nil, false, errSSEBufferNotFound
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	frames, err := b.redis.LRange(ctx, b.key, lastID, -1).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	return frames, state == "done", nil
+}
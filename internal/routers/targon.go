@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strconv"
 
 	"sybil-api/internal/ctx"
 	"sybil-api/internal/handlers/targon"
@@ -44,9 +45,15 @@ func (tr *TargonRouter) CreateModel(cc echo.Context) error {
 	// Handle errors
 	if err != nil {
 		c.LogValues.AddError(err)
+		var conflictErr *targon.ModelNameConflictError
 		switch true {
 		case errors.Is(err, shared.ErrBadRequest):
 			return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.ErrBadRequest.Error()})
+		case errors.As(err, &conflictErr):
+			return c.JSON(shared.ErrConflict.StatusCode, map[string]any{
+				"error":     conflictErr.Error(),
+				"conflicts": conflictErr.Names,
+			})
 		default:
 			return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
 		}
@@ -115,6 +122,9 @@ func (tr *TargonRouter) UpdateModel(cc echo.Context) error {
 			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "model not found"})
 		case errors.Is(err, shared.ErrBadRequest):
 			return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.ErrBadRequest.Error()})
+		case errors.Is(err, shared.ErrConflict):
+			// The new config revision has no passing eval
+			return c.JSON(shared.ErrConflict.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
 		case errors.Is(err, shared.ErrPartialSuccess):
 			return c.JSON(shared.ErrPartialSuccess.StatusCode, map[string]string{"error": "partial success; resource may be in unknown state"})
 		default:
@@ -134,6 +144,333 @@ func (tr *TargonRouter) UpdateModel(cc echo.Context) error {
 	return c.JSON(http.StatusOK, response)
 }
 
+func (tr *TargonRouter) RegisterAdapter(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req targon.RegisterAdapterRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	output, err := tr.th.RegisterAdapterLogic(targon.AdapterInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		ModelUID: c.Param("uid"),
+		Req:      req,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return adapterErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":    output.Message,
+		"targon_uid": output.TargonUID,
+		"model_id":   output.ModelID,
+		"adapters":   output.Adapters,
+	})
+}
+
+func (tr *TargonRouter) ListAdapters(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	output, err := tr.th.ListAdaptersLogic(targon.AdapterInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		ModelUID: c.Param("uid"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return adapterErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"targon_uid": output.TargonUID,
+		"model_id":   output.ModelID,
+		"adapters":   output.Adapters,
+	})
+}
+
+func (tr *TargonRouter) DeactivateAdapter(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	output, err := tr.th.DeactivateAdapterLogic(targon.AdapterInput{
+		Ctx:         c.Request().Context(),
+		UserID:      c.User.UserID,
+		ModelUID:    c.Param("uid"),
+		AdapterName: c.Param("name"),
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		return adapterErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":    output.Message,
+		"targon_uid": output.TargonUID,
+		"model_id":   output.ModelID,
+		"adapters":   output.Adapters,
+	})
+}
+
+func (tr *TargonRouter) SaveEvalSet(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req targon.EvalSetRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	err = tr.th.SaveEvalSetLogic(targon.EvalSetInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		Req:    req,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		switch true {
+		case errors.Is(err, shared.ErrBadRequest):
+			return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+		default:
+			return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Eval set saved",
+		"name":    req.Name,
+		"cases":   len(req.Cases),
+	})
+}
+
+func (tr *TargonRouter) EvaluateModel(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req targon.EvaluateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	output, err := tr.th.EvaluateLogic(targon.EvaluateInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		ModelUID: c.Param("uid"),
+		Req:      req,
+	})
+	if err != nil {
+		c.LogValues.AddError(err)
+		switch true {
+		case errors.Is(err, shared.ErrNotFound):
+			return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "model or eval set not found"})
+		case errors.Is(err, shared.ErrBadRequest):
+			return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+		default:
+			return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+		}
+	}
+
+	return c.JSON(http.StatusOK, output)
+}
+
+func (tr *TargonRouter) ListAliases(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	output, err := tr.th.ListAliasesLogic(targon.AliasInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		ModelUID: c.Param("uid"),
+	})
+	if err != nil {
+		return aliasErrorResponse(c, err)
+	}
+	return aliasResponse(c, output)
+}
+
+func (tr *TargonRouter) AddAliases(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req targon.AliasesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	output, err := tr.th.AddAliasesLogic(targon.AliasInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		ModelUID: c.Param("uid"),
+		Req:      req,
+	})
+	if err != nil {
+		return aliasErrorResponse(c, err)
+	}
+	return aliasResponse(c, output)
+}
+
+func (tr *TargonRouter) RemoveAlias(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	output, err := tr.th.RemoveAliasLogic(targon.AliasInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		ModelUID: c.Param("uid"),
+		Alias:    c.Param("name"),
+	})
+	if err != nil {
+		return aliasErrorResponse(c, err)
+	}
+	return aliasResponse(c, output)
+}
+
+func aliasResponse(c *ctx.Context, output *targon.AliasOutput) error {
+	response := map[string]any{
+		"targon_uid": output.TargonUID,
+		"model_id":   output.ModelID,
+		"base_model": output.BaseModel,
+		"aliases":    output.Aliases,
+	}
+	if output.Message != "" {
+		response["message"] = output.Message
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func aliasErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	var conflictErr *targon.ModelNameConflictError
+	switch true {
+	case errors.As(err, &conflictErr):
+		return c.JSON(shared.ErrConflict.StatusCode, map[string]any{
+			"error":     conflictErr.Error(),
+			"conflicts": conflictErr.Names,
+		})
+	case errors.Is(err, shared.ErrConflict):
+		return c.JSON(shared.ErrConflict.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
+
+func (tr *TargonRouter) ListPrices(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	output, err := tr.th.ListPricesLogic(targon.PricingInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		ModelUID: c.Param("uid"),
+	})
+	if err != nil {
+		return pricingErrorResponse(c, err)
+	}
+	return pricingResponse(c, output)
+}
+
+func (tr *TargonRouter) SchedulePrice(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req targon.SchedulePriceRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	output, err := tr.th.SchedulePriceLogic(targon.PricingInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		ModelUID: c.Param("uid"),
+		Req:      req,
+	})
+	if err != nil {
+		return pricingErrorResponse(c, err)
+	}
+	return pricingResponse(c, output)
+}
+
+func (tr *TargonRouter) CancelPrice(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	priceID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid price id"})
+	}
+
+	output, err := tr.th.CancelPriceLogic(targon.PricingInput{
+		Ctx:      c.Request().Context(),
+		UserID:   c.User.UserID,
+		ModelUID: c.Param("uid"),
+		PriceID:  priceID,
+	})
+	if err != nil {
+		return pricingErrorResponse(c, err)
+	}
+	return pricingResponse(c, output)
+}
+
+func pricingResponse(c *ctx.Context, output *targon.PricingOutput) error {
+	response := map[string]any{
+		"targon_uid":   output.TargonUID,
+		"model_id":     output.ModelID,
+		"base_pricing": output.BasePricing,
+		"schedule":     output.Schedule,
+	}
+	if output.Message != "" {
+		response["message"] = output.Message
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func pricingErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
+
+func adapterErrorResponse(c *ctx.Context, err error) error {
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "model or adapter not found"})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.ErrBadRequest.Error()})
+	case errors.Is(err, shared.ErrConflict):
+		return c.JSON(shared.ErrConflict.StatusCode, map[string]string{"error": "adapter name is already in use"})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
+
 // RegisterTargonRoutes registers all targon routes
 func RegisterTargonRoutes(e *echo.Group, th *targon.TargonHandler) {
 	tr := NewTargonRouter(th)
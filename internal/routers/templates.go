@@ -0,0 +1,115 @@
+package routers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/inference"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (ir *InferenceRouter) ListTemplates(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	templates, err := ir.ih.ListPromptTemplates(inference.PromptTemplateInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+	})
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": templates})
+}
+
+func (ir *InferenceRouter) GetTemplate(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	template, err := ir.ih.GetPromptTemplate(inference.PromptTemplateInput{
+		Ctx:        c.Request().Context(),
+		UserID:     c.User.UserID,
+		TemplateID: c.Param("id"),
+	})
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, template)
+}
+
+func (ir *InferenceRouter) CreateTemplate(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	req, err := readTemplateRequest(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+	template, err := ir.ih.CreatePromptTemplate(inference.PromptTemplateInput{
+		Ctx:    c.Request().Context(),
+		UserID: c.User.UserID,
+		Req:    req,
+	})
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, template)
+}
+
+func (ir *InferenceRouter) UpdateTemplate(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	req, err := readTemplateRequest(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+	template, err := ir.ih.UpdatePromptTemplate(inference.PromptTemplateInput{
+		Ctx:        c.Request().Context(),
+		UserID:     c.User.UserID,
+		TemplateID: c.Param("id"),
+		Req:        req,
+	})
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, template)
+}
+
+func (ir *InferenceRouter) DeleteTemplate(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	err := ir.ih.DeletePromptTemplate(inference.PromptTemplateInput{
+		Ctx:        c.Request().Context(),
+		UserID:     c.User.UserID,
+		TemplateID: c.Param("id"),
+	})
+	if err != nil {
+		return templateErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Template deleted",
+		"id":      c.Param("id"),
+	})
+}
+
+func readTemplateRequest(c *ctx.Context) (*inference.PromptTemplateRequest, error) {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, err
+	}
+	var req inference.PromptTemplateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to unmarshal request body"), err))
+		return nil, err
+	}
+	return &req, nil
+}
+
+func templateErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": "template not found"})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
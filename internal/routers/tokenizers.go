@@ -0,0 +1,59 @@
+package routers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/shared"
+	"sybil-api/internal/tokenizer"
+
+	"github.com/labstack/echo/v4"
+)
+
+type TokenizerRouter struct {
+	tokenizers *tokenizer.Registry
+}
+
+func NewTokenizerRouter(tokenizers *tokenizer.Registry) *TokenizerRouter {
+	return &TokenizerRouter{tokenizers: tokenizers}
+}
+
+type RefreshTokenizersRequest struct {
+	// Hugging Face repos or urls as set in model metadata, empty refreshes
+	// every tokenizer loaded on this replica
+	Tokenizers []string `json:"tokenizers"`
+}
+
+// Refresh downloads tokenizers again, for when a model repo updated its
+// tokenizer.json. Every replica reloads them
+func (tr *TokenizerRouter) Refresh(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+	if tr.tokenizers == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "local tokenizers are not configured"})
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+	var req RefreshTokenizersRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+		}
+	}
+
+	refreshed, err := tr.tokenizers.Refresh(c.Request().Context(), req.Tokenizers)
+	if err != nil {
+		c.LogValues.AddError(errors.Join(errors.New("failed to refresh tokenizers"), err))
+		var rerr *shared.RequestError
+		if errors.As(err, &rerr) && rerr.StatusCode == http.StatusBadRequest {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": rerr.Err.Error()})
+		}
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "failed to download tokenizers"})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"refreshed": refreshed})
+}
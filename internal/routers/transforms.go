@@ -0,0 +1,91 @@
+package routers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/transforms"
+	"sybil-api/internal/shared"
+	"sybil-api/internal/transform"
+
+	"github.com/labstack/echo/v4"
+)
+
+type TransformRouter struct {
+	th *transforms.TransformHandler
+}
+
+func NewTransformRouter(th *transforms.TransformHandler) *TransformRouter {
+	return &TransformRouter{th: th}
+}
+
+func (tr *TransformRouter) CreateTransform(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, shared.ErrInternalServerError)
+	}
+
+	var req transforms.CreateTransformRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid JSON format"})
+	}
+
+	t, err := tr.th.CreateTransformLogic(transforms.TransformInput{
+		Ctx:     c.Request().Context(),
+		AdminID: c.User.UserID,
+		Req:     &req,
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+func (tr *TransformRouter) ListTransforms(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	list, err := tr.th.ListTransformsLogic(transforms.TransformInput{
+		Ctx:      c.Request().Context(),
+		Model:    c.QueryParam("model"),
+		APIKeyID: c.QueryParam("api_key_id"),
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"data": list})
+}
+
+func (tr *TransformRouter) DeactivateTransform(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	transformID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid transform id"})
+	}
+
+	err = tr.th.DeactivateTransformLogic(transforms.TransformInput{
+		Ctx:         c.Request().Context(),
+		TransformID: transformID,
+	})
+	if err != nil {
+		return policyErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"message": "Transform deactivated",
+		"id":      transformID,
+	})
+}
+
+// ListPlugins returns the plugins transforms can use, the built in ones and
+// any compiled into this build
+func (tr *TransformRouter) ListPlugins(cc echo.Context) error {
+	return cc.JSON(http.StatusOK, map[string]any{
+		"data":       transform.Plugins(),
+		"timeout_ms": shared.TransformTimeout.Milliseconds(),
+	})
+}
@@ -0,0 +1,173 @@
+package routers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/handlers/usage"
+	"sybil-api/internal/middleware"
+	"sybil-api/internal/shared"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+type UsageRouter struct {
+	uh *usage.UsageHandler
+}
+
+func RegisterUsageRoutes(e *echo.Group, rdb *sql.DB, log *zap.SugaredLogger) error {
+	umw, err := middleware.GetUserMiddleware()
+	if err != nil {
+		return err
+	}
+
+	ur := UsageRouter{uh: usage.NewUsageHandler(rdb, log)}
+	for _, requireHistory := range versionGroups(e, "", umw.ExtractUser, umw.RequireUser, umw.RequireScope(shared.ScopeHistoryRead)) {
+		requireHistory.GET("/usage", ur.GetUsage)
+		requireHistory.GET("/usage/export", ur.ExportUsage)
+	}
+	return nil
+}
+
+func (ur *UsageRouter) GetUsage(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	scope, err := usageScope(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid member_id"})
+	}
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+
+	out, err := ur.uh.GetUsageLogic(usage.UsageInput{
+		Ctx:       c.Request().Context(),
+		Scope:     scope,
+		GroupBy:   c.QueryParam("group_by"),
+		StartDate: c.QueryParam("start_date"),
+		EndDate:   c.QueryParam("end_date"),
+		Limit:     limit,
+		Offset:    offset,
+	})
+	if err != nil {
+		return usageErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func (ur *UsageRouter) ExportUsage(cc echo.Context) error {
+	c := cc.(*ctx.Context)
+
+	scope, err := usageScope(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid member_id"})
+	}
+	format := c.QueryParam("format")
+	if format == "" {
+		format = usage.ExportFormatCSV
+	}
+	writer := &exportWriter{c: c, format: format}
+	input := usage.ExportInput{
+		Ctx:       c.Request().Context(),
+		Scope:     scope,
+		Format:    format,
+		StartDate: c.QueryParam("start_date"),
+		EndDate:   c.QueryParam("end_date"),
+		Writer:    writer,
+		Flush:     writer.Flush,
+	}
+	if err := ur.uh.ValidateExport(input); err != nil {
+		return usageErrorResponse(c, err)
+	}
+
+	err = ur.uh.ExportLogic(input)
+	if err != nil && !writer.started {
+		return usageErrorResponse(c, err)
+	}
+	// Empty jsonl exports never wrote anything
+	writer.start()
+	if err != nil {
+		// Headers are already sent, the trailer tells the client the export
+		// is incomplete
+		c.LogValues.AddError(err)
+		c.LogValues.LogLevel = "ERROR"
+		c.Response().Header().Set(exportCompleteTrailer, "false")
+		return nil
+	}
+	c.Response().Header().Set(exportCompleteTrailer, "true")
+	return nil
+}
+
+// Trailer set to true once every row of an export was sent, a response
+// without it was cut short
+const exportCompleteTrailer = "X-Export-Complete"
+
+// exportWriter sends the export headers with the first row, so an export that
+// fails before any row was read still gets an error status
+type exportWriter struct {
+	c       *ctx.Context
+	format  string
+	started bool
+}
+
+func (w *exportWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	contentType := "text/csv"
+	if w.format == usage.ExportFormatJSONL {
+		contentType = "application/x-ndjson"
+	}
+	w.c.Response().Header().Set("Content-Type", contentType)
+	w.c.Response().Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage.%s"`, w.format))
+	w.c.Response().Header().Set("Trailer", exportCompleteTrailer)
+	w.c.Response().WriteHeader(http.StatusOK)
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	w.start()
+	return w.c.Response().Write(p)
+}
+
+func (w *exportWriter) Flush() {
+	if w.started {
+		w.c.Response().Flush()
+	}
+}
+
+// usageScope reads the scope and member_id query params
+func usageScope(c *ctx.Context) (usage.UsageScope, error) {
+	scope := usage.UsageScope{
+		UserID:           c.User.UserID,
+		OrganizationID:   c.User.OrganizationID,
+		OrganizationRole: c.User.OrganizationRole,
+		Scope:            c.QueryParam("scope"),
+	}
+	if memberID := c.QueryParam("member_id"); memberID != "" {
+		id, err := strconv.ParseUint(memberID, 10, 64)
+		if err != nil {
+			return scope, err
+		}
+		scope.MemberID = id
+	}
+	return scope, nil
+}
+
+func usageErrorResponse(c *ctx.Context, err error) error {
+	c.LogValues.AddError(err)
+	switch true {
+	case errors.Is(err, shared.ErrForbidden):
+		return c.JSON(shared.ErrForbidden.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrNotFound):
+		return c.JSON(shared.ErrNotFound.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	case errors.Is(err, shared.ErrBadRequest):
+		return c.JSON(shared.ErrBadRequest.StatusCode, map[string]string{"error": shared.StackTrace(err)[0].Error()})
+	default:
+		return c.JSON(shared.ErrInternalServerError.StatusCode, map[string]string{"error": shared.ErrInternalServerError.Error()})
+	}
+}
@@ -0,0 +1,187 @@
+package routers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/metrics"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Every api route is served under each version with the same handler. /v1 is
+// frozen, breaking changes to the response shape go into the v2 shim instead
+// of the handlers, so both versions keep sharing one implementation
+const (
+	APIVersionV1 = "v1"
+	APIVersionV2 = "v2"
+)
+
+var APIVersions = []string{APIVersionV1, APIVersionV2}
+
+// versionGroups returns a group per api version at prefix, routes must be
+// registered on each of them
+func versionGroups(e *echo.Group, prefix string, m ...echo.MiddlewareFunc) []*echo.Group {
+	groups := make([]*echo.Group, 0, len(APIVersions))
+	for _, version := range APIVersions {
+		groups = append(groups, e.Group(version+prefix, append([]echo.MiddlewareFunc{versionMiddleware(version)}, m...)...))
+	}
+	return groups
+}
+
+// versionMiddleware tags the request with its api version and counts it, so
+// migration off /v1 can be followed per route
+func versionMiddleware(version string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(cc echo.Context) error {
+			c := cc.(*ctx.Context)
+			c.APIVersion = version
+			metrics.APIVersionRequests.WithLabelValues(version, c.Path()).Inc()
+			if version == APIVersionV2 {
+				return v2Shim(c, next)
+			}
+			return next(c)
+		}
+	}
+}
+
+// v2Shim translates between the handlers, which speak v1, and the v2 shape.
+// Pages are requested with an opaque cursor instead of an offset, lists are
+// returned as {"object": "list", "data", "has_more", "next_cursor"} and errors
+// always as {"error": {"type", "message", "code", "request_id"}}. Streams are
+// passed through, errors inside them are already frames
+func v2Shim(c *ctx.Context, next echo.HandlerFunc) error {
+	// Read off the url, echo caches query params on first use and the
+	// handler has to see the rewritten offset
+	query := c.Request().URL.Query()
+	offset := 0
+	if cursor := query.Get("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			offset, err = strconv.Atoi(string(decoded))
+		}
+		if err != nil || offset < 0 {
+			return c.JSON(http.StatusBadRequest, v2Error(c, http.StatusBadRequest, "", "invalid cursor"))
+		}
+		query.Del("cursor")
+		query.Set("offset", strconv.Itoa(offset))
+		c.Request().URL.RawQuery = query.Encode()
+	} else if o, err := strconv.Atoi(query.Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+
+	writer := &v2Writer{ResponseWriter: c.Response().Writer}
+	c.Response().Writer = writer
+	err := next(c)
+	// Errors returned to echo are rendered here so they get the v2 shape too
+	if err != nil && !c.Response().Committed {
+		c.Error(err)
+	}
+	c.Response().Writer = writer.ResponseWriter
+	if !writer.buffered {
+		return err
+	}
+
+	status := writer.status
+	body := writer.buf.Bytes()
+	var decoded map[string]any
+	if json.Unmarshal(body, &decoded) == nil {
+		switch {
+		case status >= 400:
+			message, errorType := v1ErrorMessage(decoded)
+			body, _ = json.Marshal(v2Error(c, status, errorType, message))
+		case isList(decoded):
+			data, _ := decoded["data"].([]any)
+			decoded["object"] = "list"
+			if hasMore, _ := decoded["has_more"].(bool); hasMore {
+				decoded["next_cursor"] = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset + len(data))))
+			}
+			body, _ = json.Marshal(decoded)
+		}
+	}
+	writer.ResponseWriter.Header().Del("Content-Length")
+	writer.ResponseWriter.WriteHeader(status)
+	_, _ = writer.ResponseWriter.Write(body)
+	return err
+}
+
+func isList(body map[string]any) bool {
+	_, hasData := body["data"].([]any)
+	_, hasMore := body["has_more"].(bool)
+	return hasData && hasMore
+}
+
+// v1ErrorMessage reads the message and type out of the v1 error shapes,
+// {"error": "message"} and the OpenAI style {"message", "type"}
+func v1ErrorMessage(body map[string]any) (string, string) {
+	if message, ok := body["error"].(string); ok {
+		return message, ""
+	}
+	if nested, ok := body["error"].(map[string]any); ok {
+		body = nested
+	}
+	message, _ := body["message"].(string)
+	errorType, _ := body["type"].(string)
+	return message, errorType
+}
+
+func v2Error(c *ctx.Context, status int, errorType string, message string) map[string]any {
+	if errorType == "" {
+		errorType = strings.ReplaceAll(http.StatusText(status), " ", "")
+	}
+	if message == "" {
+		message = strings.ToLower(http.StatusText(status))
+	}
+	return map[string]any{"error": map[string]any{
+		"type":       errorType,
+		"message":    message,
+		"code":       status,
+		"request_id": "req_" + c.Reqid,
+	}}
+}
+
+// v2Writer holds back JSON responses so the shim can rewrite them, anything
+// else is written straight through
+type v2Writer struct {
+	http.ResponseWriter
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+	buffered    bool
+}
+
+func (w *v2Writer) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	w.buffered = strings.HasPrefix(w.Header().Get("Content-Type"), echo.MIMEApplicationJSON)
+	if !w.buffered {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *v2Writer) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffered {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *v2Writer) Flush() {
+	if w.buffered {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,208 @@
+package routers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"sybil-api/internal/ctx"
+	"sybil-api/internal/shared"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// Time allowed for a single message or close frame to be written
+const wsWriteTimeout = 10 * time.Second
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Same as the CORS policy, the socket is authenticated with an api key
+	// rather than cookies
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// wsResponder sends an inference response over a WebSocket. Each streamed
+// event is its own text message holding the events data, a non streaming
+// response is a single message, and the socket is closed once the response
+// is done. Errors are sent as an error message followed by a close frame with
+// code 4000 + the http status
+type wsResponder struct {
+	conn   *websocket.Conn
+	stream bool
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newWSResponder(conn *websocket.Conn) *wsResponder {
+	return &wsResponder{conn: conn, done: make(chan struct{})}
+}
+
+func (r *wsResponder) Start() {
+	go r.heartbeat()
+}
+
+func (r *wsResponder) heartbeat() {
+	ticker := time.NewTicker(shared.SSEHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			if r.closed {
+				r.mu.Unlock()
+				return
+			}
+			err := r.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			r.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// send writes one text message
+func (r *wsResponder) send(message []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errors.New("socket already closed")
+	}
+	_ = r.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return r.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// close sends a close frame with code and stops all further writes
+func (r *wsResponder) close(code int, text string) {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	_ = r.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(wsWriteTimeout))
+}
+
+// writeEvent takes an sse frame from the inference handler and sends its data
+func (r *wsResponder) writeEvent(frame string) error {
+	var data []string
+	for line := range strings.SplitSeq(frame, "\n") {
+		if payload, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, payload)
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return r.send([]byte(strings.Join(data, "\n")))
+}
+
+func (r *wsResponder) StreamWriter() func(token string) error {
+	if !r.stream {
+		return nil
+	}
+	return r.writeEvent
+}
+
+func (r *wsResponder) Finish(body []byte) error {
+	if !r.stream {
+		if err := r.send(body); err != nil {
+			r.close(websocket.CloseInternalServerErr, "")
+			return errors.Join(errors.New("failed writing final response"), err)
+		}
+	}
+	r.close(websocket.CloseNormalClosure, "")
+	return nil
+}
+
+func (r *wsResponder) Error(statusCode int, body shared.OpenAIError) error {
+	message, err := json.Marshal(map[string]any{"error": body})
+	if err != nil {
+		r.close(websocket.CloseInternalServerErr, "")
+		return err
+	}
+	err = r.send(message)
+	r.close(4000+statusCode, http.StatusText(statusCode))
+	return err
+}
+
+// webSocket serves endpoint over a WebSocket. The first message from the
+// client is the request body, the response is sent back through a
+// wsResponder
+func (ir *InferenceRouter) webSocket(cc echo.Context, endpoint string) error {
+	c := cc.(*ctx.Context)
+	// Lets clients quote the request when reporting problems
+	header := http.Header{"X-Request-Id": {"req_" + c.Reqid}}
+	conn, err := wsUpgrader.Upgrade(c.Response(), c.Request(), header)
+	if err != nil {
+		// The upgrader has already sent the error response
+		c.LogValues.AddError(err)
+		return nil
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	limit := ir.ih.MaxBodyBytes(endpoint)
+	conn.SetReadLimit(limit)
+
+	responder := newWSResponder(conn)
+	_, body, err := conn.ReadMessage()
+	if err != nil {
+		c.LogValues.AddError(err)
+		if errors.Is(err, websocket.ErrReadLimit) {
+			return responder.Error(http.StatusRequestEntityTooLarge, shared.OpenAIError{
+				Message: fmt.Sprintf("request body is larger than the %d byte limit", limit),
+				Object:  "error",
+				Type:    "RequestTooLarge",
+				Code:    http.StatusRequestEntityTooLarge,
+			})
+		}
+		return nil
+	}
+
+	// The hijacked connection no longer cancels the request context, so
+	// inference is cancelled once the client closes the socket instead
+	reqCtx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	c.SetRequest(c.Request().WithContext(reqCtx))
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Errors have been logged and sent on the socket, echo can no longer
+	// write to the hijacked connection
+	_, _ = ir.infer(c, endpoint, body, func(stream bool) Responder {
+		responder.stream = stream
+		return responder
+	})
+	return nil
+}
+
+// ChatWebSocket serves chat completions over a WebSocket
+func (ir *InferenceRouter) ChatWebSocket(cc echo.Context) error {
+	return ir.webSocket(cc, shared.ENDPOINTS.CHAT)
+}
+
+// CompletionWebSocket serves completions over a WebSocket
+func (ir *InferenceRouter) CompletionWebSocket(cc echo.Context) error {
+	return ir.webSocket(cc, shared.ENDPOINTS.COMPLETION)
+}
@@ -0,0 +1,187 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Autocompleter ranks completions from three sources: the provider, the
+// users own recent searches and queries trending across all users. Trending
+// counts are kept in one sorted set per hour, combined with weights halving
+// every shared.AutocompleteTrendingHalfLife so old spikes fade out
+type Autocompleter struct {
+	redis *redis.Client
+	log   *zap.SugaredLogger
+
+	mu        sync.Mutex
+	trending  []redis.Z
+	fetchedAt time.Time
+}
+
+func NewAutocompleter(redisClient *redis.Client, log *zap.SugaredLogger) *Autocompleter {
+	return &Autocompleter{redis: redisClient, log: log}
+}
+
+func recentKey(userID uint64) string {
+	return fmt.Sprintf("sybil:v1:autocomplete:recent:%d", userID)
+}
+
+func trendingHourKey(hour int64) string {
+	return fmt.Sprintf("sybil:v1:autocomplete:trending:%d", hour)
+}
+
+const trendingKey = "sybil:v1:autocomplete:trending"
+
+// normalizeQuery lowercases and collapses whitespace so the same query typed
+// differently is counted once
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// Record remembers a search the user ran for their own completions and counts
+// it towards trending queries. Callers only record users who allow their
+// content to be kept
+func (a *Autocompleter) Record(ctx context.Context, userID uint64, query string) {
+	query = normalizeQuery(query)
+	if query == "" || len(query) > shared.AutocompleteMaxQueryLength {
+		return
+	}
+	now := time.Now()
+	hourKey := trendingHourKey(now.Unix() / 3600)
+
+	pipe := a.redis.Pipeline()
+	pipe.ZAdd(ctx, recentKey(userID), redis.Z{Score: float64(now.Unix()), Member: query})
+	pipe.ZRemRangeByRank(ctx, recentKey(userID), 0, -shared.AutocompleteRecentMax-1)
+	pipe.Expire(ctx, recentKey(userID), shared.AutocompleteRecentTTL)
+	pipe.ZIncrBy(ctx, hourKey, 1, query)
+	pipe.Expire(ctx, hourKey, shared.AutocompleteTrendingWindow+time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		a.log.Warnw("Failed to record autocomplete query", "error", err)
+	}
+}
+
+// ForgetRecentQueries drops the users recent searches, their trending counts
+// stay as they cannot be told apart from other users
+func ForgetRecentQueries(ctx context.Context, redisClient *redis.Client, userID uint64) error {
+	return redisClient.Del(ctx, recentKey(userID)).Err()
+}
+
+type candidate struct {
+	text  string
+	score float64
+}
+
+// Complete ranks completions of prefix. Provider suggestions are passed in so
+// they can come from the search cache, userID 0 skips recent searches. The
+// best shared.SearchNumSuggestions are returned, deduplicated
+func (a *Autocompleter) Complete(ctx context.Context, userID uint64, prefix string, suggestions []string) []string {
+	prefix = normalizeQuery(prefix)
+	candidates := map[string]*candidate{}
+	add := func(text string, score float64) {
+		key := normalizeQuery(text)
+		if key == "" {
+			return
+		}
+		if c, ok := candidates[key]; ok {
+			c.score += score
+			return
+		}
+		candidates[key] = &candidate{text: text, score: score}
+	}
+
+	for i, suggestion := range suggestions {
+		add(suggestion, shared.AutocompleteProviderWeight*positionWeight(i, len(suggestions)))
+	}
+
+	if userID != 0 {
+		recent, err := a.redis.ZRevRange(ctx, recentKey(userID), 0, -1).Result()
+		if err != nil {
+			a.log.Warnw("Failed to read recent autocomplete queries", "error", err, "user_id", userID)
+		}
+		matches := []string{}
+		for _, query := range recent {
+			if query != prefix && strings.HasPrefix(query, prefix) {
+				matches = append(matches, query)
+			}
+		}
+		for i, query := range matches {
+			add(query, shared.AutocompleteRecentWeight*positionWeight(i, len(matches)))
+		}
+	}
+
+	trending := a.trendingQueries(ctx)
+	var top float64
+	for _, z := range trending {
+		query, _ := z.Member.(string)
+		if query != prefix && strings.HasPrefix(query, prefix) && z.Score >= shared.AutocompleteTrendingMinScore {
+			if top == 0 {
+				top = z.Score
+			}
+			add(query, shared.AutocompleteTrendingWeight*z.Score/top)
+		}
+	}
+
+	ranked := make([]*candidate, 0, len(candidates))
+	for _, c := range candidates {
+		ranked = append(ranked, c)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].text < ranked[j].text
+	})
+	completions := make([]string, 0, min(len(ranked), shared.SearchNumSuggestions))
+	for _, c := range ranked[:min(len(ranked), shared.SearchNumSuggestions)] {
+		completions = append(completions, c.text)
+	}
+	return completions
+}
+
+// positionWeight scores earlier entries of a list higher, from 1 down to
+// just above 0
+func positionWeight(i, n int) float64 {
+	return 1 - float64(i)/float64(n)
+}
+
+// trendingQueries returns the top trending queries, highest first. They are
+// kept in memory for shared.AutocompleteTrendingRefresh so keystrokes do not
+// each read the whole set
+func (a *Autocompleter) trendingQueries(ctx context.Context) []redis.Z {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.fetchedAt) < shared.AutocompleteTrendingRefresh {
+		return a.trending
+	}
+	// Failures are retried on the next refresh, not on every keystroke
+	a.fetchedAt = time.Now()
+
+	hours := int64(shared.AutocompleteTrendingWindow / time.Hour)
+	now := time.Now().Unix() / 3600
+	keys := make([]string, 0, hours)
+	weights := make([]float64, 0, hours)
+	for age := range hours {
+		keys = append(keys, trendingHourKey(now-age))
+		weights = append(weights, math.Pow(0.5, float64(age)*float64(time.Hour)/float64(shared.AutocompleteTrendingHalfLife)))
+	}
+	pipe := a.redis.Pipeline()
+	pipe.ZUnionStore(ctx, trendingKey, &redis.ZStore{Keys: keys, Weights: weights, Aggregate: "SUM"})
+	pipe.Expire(ctx, trendingKey, shared.AutocompleteTrendingRefresh)
+	top := pipe.ZRevRangeWithScores(ctx, trendingKey, 0, shared.AutocompleteTrendingCandidates-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		a.log.Warnw("Failed to read trending autocomplete queries", "error", err)
+		return a.trending
+	}
+	a.trending = top.Val()
+	return a.trending
+}
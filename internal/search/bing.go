@@ -0,0 +1,296 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sybil-api/internal/shared"
+	"sybil-api/internal/tracing"
+)
+
+const bingAPIURL = "https://api.bing.microsoft.com/v7.0"
+
+// Bing searches with the Bing Web Search api
+type Bing struct {
+	apiKey string
+	client *http.Client
+}
+
+func NewBing(apiKey string) *Bing {
+	return &Bing{apiKey: apiKey, client: &http.Client{Transport: tracing.Transport(nil)}}
+}
+
+func (b *Bing) Name() string {
+	return shared.SearchProviderBing
+}
+
+type bingWebResponse struct {
+	WebPages struct {
+		TotalEstimatedMatches int `json:"totalEstimatedMatches"`
+		Value                 []struct {
+			Name          string `json:"name"`
+			URL           string `json:"url"`
+			Snippet       string `json:"snippet"`
+			SiteName      string `json:"siteName"`
+			DatePublished string `json:"datePublished"`
+		} `json:"value"`
+	} `json:"webPages"`
+}
+
+type bingImageResponse struct {
+	TotalEstimatedMatches int `json:"totalEstimatedMatches"`
+	Value                 []struct {
+		Name               string `json:"name"`
+		ContentURL         string `json:"contentUrl"`
+		HostPageURL        string `json:"hostPageUrl"`
+		HostPageDisplayURL string `json:"hostPageDisplayUrl"`
+		ThumbnailURL       string `json:"thumbnailUrl"`
+		Width              int    `json:"width"`
+		Height             int    `json:"height"`
+	} `json:"value"`
+}
+
+type bingNewsResponse struct {
+	TotalEstimatedMatches int `json:"totalEstimatedMatches"`
+	Value                 []struct {
+		Name          string `json:"name"`
+		URL           string `json:"url"`
+		Description   string `json:"description"`
+		DatePublished string `json:"datePublished"`
+		Provider      []struct {
+			Name string `json:"name"`
+		} `json:"provider"`
+		Image struct {
+			Thumbnail struct {
+				ContentURL string `json:"contentUrl"`
+			} `json:"thumbnail"`
+		} `json:"image"`
+	} `json:"value"`
+}
+
+type bingVideoResponse struct {
+	TotalEstimatedMatches int `json:"totalEstimatedMatches"`
+	Value                 []struct {
+		Name          string `json:"name"`
+		Description   string `json:"description"`
+		HostPageURL   string `json:"hostPageUrl"`
+		ThumbnailURL  string `json:"thumbnailUrl"`
+		Duration      string `json:"duration"`
+		DatePublished string `json:"datePublished"`
+		Publisher     []struct {
+			Name string `json:"name"`
+		} `json:"publisher"`
+	} `json:"value"`
+}
+
+type bingSuggestionResponse struct {
+	SuggestionGroups []struct {
+		SearchSuggestions []struct {
+			Query string `json:"query"`
+		} `json:"searchSuggestions"`
+	} `json:"suggestionGroups"`
+}
+
+func (b *Bing) get(ctx context.Context, path string, query string, locale *shared.SearchLocale, count int, dest any) error {
+	params := url.Values{}
+	params.Set("q", query)
+	if count > 0 {
+		params.Set("count", fmt.Sprint(count))
+	}
+	if locale != nil {
+		if locale.Region != "" {
+			params.Set("cc", strings.ToUpper(locale.Region))
+		}
+		if locale.Language != "" {
+			params.Set("setLang", locale.Language)
+		}
+		if locale.SafeSearch != "" {
+			params.Set("safeSearch", strings.ToUpper(locale.SafeSearch[:1])+locale.SafeSearch[1:])
+		}
+	}
+	header := http.Header{}
+	header.Set("Ocp-Apim-Subscription-Key", b.apiKey)
+	return getJSON(ctx, b.client, bingAPIURL+path+"?"+params.Encode(), header, dest)
+}
+
+func (b *Bing) Search(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	var res bingWebResponse
+	if err := b.get(ctx, "/search", query, locale, shared.SearchNumResults, &res); err != nil {
+		return nil, err
+	}
+
+	results := make([]shared.SearchResults, 0, len(res.WebPages.Value))
+	for _, item := range res.WebPages.Value {
+		title := item.Name
+		content := item.Snippet
+		link := item.URL
+		source := ""
+		if parsed, err := url.Parse(link); err == nil {
+			source = parsed.Hostname()
+		}
+		website := item.SiteName
+		if website == "" {
+			website = source
+		}
+		parsedURL := strings.Split(source, ".")
+		publishedDate := item.DatePublished
+		results = append(results, shared.SearchResults{
+			Title:         &title,
+			Content:       &content,
+			URL:           &link,
+			ParsedURL:     &parsedURL,
+			Source:        &source,
+			Website:       &website,
+			PublishedDate: &publishedDate,
+		})
+	}
+	return &shared.SearchResponseBody{Query: query, NumberOfResults: res.WebPages.TotalEstimatedMatches, Results: results}, nil
+}
+
+func (b *Bing) Images(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	var res bingImageResponse
+	if err := b.get(ctx, "/images/search", query, locale, shared.SearchNumImageResults, &res); err != nil {
+		return nil, err
+	}
+
+	results := make([]shared.SearchResults, 0, len(res.Value))
+	for _, item := range res.Value {
+		title := item.Name
+		pageURL := item.HostPageURL
+		imgSource := item.ContentURL
+		thumbnail := item.ThumbnailURL
+		source := ""
+		if parsed, err := url.Parse(pageURL); err == nil {
+			source = parsed.Hostname()
+		}
+		result := shared.SearchResults{
+			Title:     &title,
+			URL:       &pageURL,
+			ImgSource: &imgSource,
+			Thumbnail: &thumbnail,
+			Source:    &source,
+			Website:   &source,
+		}
+		if item.Width > 0 && item.Height > 0 {
+			resolution := fmt.Sprintf("%dx%d", item.Width, item.Height)
+			result.Resolution = &resolution
+		}
+		results = append(results, result)
+	}
+	return &shared.SearchResponseBody{Query: query, NumberOfResults: res.TotalEstimatedMatches, Results: results}, nil
+}
+
+func (b *Bing) News(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	var res bingNewsResponse
+	if err := b.get(ctx, "/news/search", query, locale, shared.SearchNumVerticalResults, &res); err != nil {
+		return nil, err
+	}
+
+	results := make([]shared.SearchResults, 0, len(res.Value))
+	for _, item := range res.Value {
+		website := ""
+		if len(item.Provider) > 0 {
+			website = item.Provider[0].Name
+		}
+		result := bingResult(item.Name, item.Description, item.URL, website, item.DatePublished)
+		if item.Image.Thumbnail.ContentURL != "" {
+			thumbnail := item.Image.Thumbnail.ContentURL
+			result.Thumbnail = &thumbnail
+		}
+		results = append(results, result)
+	}
+	return &shared.SearchResponseBody{Query: query, NumberOfResults: res.TotalEstimatedMatches, Results: results}, nil
+}
+
+func (b *Bing) Videos(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	var res bingVideoResponse
+	if err := b.get(ctx, "/videos/search", query, locale, shared.SearchNumVerticalResults, &res); err != nil {
+		return nil, err
+	}
+
+	results := make([]shared.SearchResults, 0, len(res.Value))
+	for _, item := range res.Value {
+		website := ""
+		if len(item.Publisher) > 0 {
+			website = item.Publisher[0].Name
+		}
+		result := bingResult(item.Name, item.Description, item.HostPageURL, website, item.DatePublished)
+		if item.ThumbnailURL != "" {
+			thumbnail := item.ThumbnailURL
+			result.Thumbnail = &thumbnail
+		}
+		if duration := clockDuration(item.Duration); duration != "" {
+			result.Duration = &duration
+		}
+		results = append(results, result)
+	}
+	return &shared.SearchResponseBody{Query: query, NumberOfResults: res.TotalEstimatedMatches, Results: results}, nil
+}
+
+// Shopping is not offered by the Bing Search apis
+func (b *Bing) Shopping(context.Context, string, *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	return nil, ErrUnsupported
+}
+
+// bingResult fills the fields every Bing vertical has, the website falls back
+// to the host of link
+func bingResult(title string, content string, link string, website string, publishedDate string) shared.SearchResults {
+	source := ""
+	if parsed, err := url.Parse(link); err == nil {
+		source = parsed.Hostname()
+	}
+	if website == "" {
+		website = source
+	}
+	parsedURL := strings.Split(source, ".")
+	return shared.SearchResults{
+		Title:         &title,
+		Content:       &content,
+		URL:           &link,
+		ParsedURL:     &parsedURL,
+		Source:        &source,
+		Website:       &website,
+		PublishedDate: &publishedDate,
+	}
+}
+
+var isoDuration = regexp.MustCompile(`^PT(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?$`)
+
+// clockDuration turns an ISO 8601 duration like PT1H2M3S into 1:02:03, or
+// empty when it is not one
+func clockDuration(iso string) string {
+	match := isoDuration.FindStringSubmatch(iso)
+	if match == nil || iso == "PT" {
+		return ""
+	}
+	hours, _ := strconv.Atoi(match[1])
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.Atoi(match[3])
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
+	}
+	return fmt.Sprintf("%d:%02d", minutes, seconds)
+}
+
+func (b *Bing) Autocomplete(ctx context.Context, query string, locale *shared.SearchLocale) ([]string, error) {
+	var res bingSuggestionResponse
+	// The suggestions api has no count parameter
+	if err := b.get(ctx, "/suggestions", query, locale, 0, &res); err != nil {
+		return nil, err
+	}
+	suggestions := []string{}
+	for _, group := range res.SuggestionGroups {
+		for _, item := range group.SearchSuggestions {
+			suggestions = append(suggestions, item.Query)
+			if len(suggestions) == shared.SearchNumSuggestions {
+				return suggestions, nil
+			}
+		}
+	}
+	return suggestions, nil
+}
@@ -0,0 +1,247 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"sybil-api/internal/shared"
+	"sybil-api/internal/tracing"
+)
+
+const braveAPIURL = "https://api.search.brave.com/res/v1"
+
+// Brave searches with the Brave Search api
+type Brave struct {
+	apiKey string
+	client *http.Client
+}
+
+func NewBrave(apiKey string) *Brave {
+	return &Brave{apiKey: apiKey, client: &http.Client{Transport: tracing.Transport(nil)}}
+}
+
+func (b *Brave) Name() string {
+	return shared.SearchProviderBrave
+}
+
+type braveMetaURL struct {
+	Hostname string `json:"hostname"`
+}
+
+type braveWebResponse struct {
+	Web struct {
+		Results []struct {
+			Title       string       `json:"title"`
+			URL         string       `json:"url"`
+			Description string       `json:"description"`
+			PageAge     string       `json:"page_age"`
+			MetaURL     braveMetaURL `json:"meta_url"`
+			Profile     struct {
+				Name string `json:"name"`
+			} `json:"profile"`
+		} `json:"results"`
+	} `json:"web"`
+}
+
+type braveImageResponse struct {
+	Results []struct {
+		Title     string       `json:"title"`
+		URL       string       `json:"url"`
+		Source    string       `json:"source"`
+		MetaURL   braveMetaURL `json:"meta_url"`
+		Thumbnail struct {
+			Src string `json:"src"`
+		} `json:"thumbnail"`
+		Properties struct {
+			URL    string `json:"url"`
+			Width  int    `json:"width"`
+			Height int    `json:"height"`
+		} `json:"properties"`
+	} `json:"results"`
+}
+
+// braveVerticalResponse is the shape of both the news and video search
+// replies, video results add the video object
+type braveVerticalResponse struct {
+	Results []struct {
+		Title       string       `json:"title"`
+		URL         string       `json:"url"`
+		Description string       `json:"description"`
+		PageAge     string       `json:"page_age"`
+		MetaURL     braveMetaURL `json:"meta_url"`
+		Thumbnail   struct {
+			Src string `json:"src"`
+		} `json:"thumbnail"`
+		Video struct {
+			Duration  string `json:"duration"`
+			Publisher string `json:"publisher"`
+		} `json:"video"`
+	} `json:"results"`
+}
+
+type braveSuggestResponse struct {
+	Results []struct {
+		Query string `json:"query"`
+	} `json:"results"`
+}
+
+func (b *Brave) get(ctx context.Context, path string, query string, locale *shared.SearchLocale, count int, dest any) error {
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("count", fmt.Sprint(count))
+	if locale != nil {
+		if locale.Region != "" {
+			params.Set("country", strings.ToUpper(locale.Region))
+		}
+		if locale.Language != "" {
+			lang, _, _ := strings.Cut(locale.Language, "-")
+			params.Set("search_lang", strings.ToLower(lang))
+		}
+		// Suggestions are not filtered, image search has no moderate level
+		switch {
+		case locale.SafeSearch == "" || path == "/suggest/search":
+		case path == "/images/search" && locale.SafeSearch == shared.SearchSafeModerate:
+			params.Set("safesearch", shared.SearchSafeStrict)
+		default:
+			params.Set("safesearch", locale.SafeSearch)
+		}
+	}
+	header := http.Header{}
+	header.Set("X-Subscription-Token", b.apiKey)
+	return getJSON(ctx, b.client, braveAPIURL+path+"?"+params.Encode(), header, dest)
+}
+
+func (b *Brave) Search(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	var res braveWebResponse
+	if err := b.get(ctx, "/web/search", query, locale, shared.SearchNumResults, &res); err != nil {
+		return nil, err
+	}
+
+	results := make([]shared.SearchResults, 0, len(res.Web.Results))
+	for _, item := range res.Web.Results {
+		title := item.Title
+		content := item.Description
+		link := item.URL
+		source := item.MetaURL.Hostname
+		website := item.Profile.Name
+		if website == "" {
+			website = source
+		}
+		parsedURL := strings.Split(source, ".")
+		publishedDate := item.PageAge
+		results = append(results, shared.SearchResults{
+			Title:         &title,
+			Content:       &content,
+			URL:           &link,
+			ParsedURL:     &parsedURL,
+			Source:        &source,
+			Website:       &website,
+			PublishedDate: &publishedDate,
+		})
+	}
+	// Brave does not report a total, only the results it returned
+	return &shared.SearchResponseBody{Query: query, NumberOfResults: len(results), Results: results}, nil
+}
+
+func (b *Brave) Images(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	var res braveImageResponse
+	if err := b.get(ctx, "/images/search", query, locale, shared.SearchNumImageResults, &res); err != nil {
+		return nil, err
+	}
+
+	results := make([]shared.SearchResults, 0, len(res.Results))
+	for _, item := range res.Results {
+		title := item.Title
+		pageURL := item.URL
+		imgSource := item.Properties.URL
+		thumbnail := item.Thumbnail.Src
+		source := item.MetaURL.Hostname
+		website := item.Source
+		if website == "" {
+			website = source
+		}
+		result := shared.SearchResults{
+			Title:     &title,
+			URL:       &pageURL,
+			ImgSource: &imgSource,
+			Thumbnail: &thumbnail,
+			Source:    &source,
+			Website:   &website,
+		}
+		if item.Properties.Width > 0 && item.Properties.Height > 0 {
+			resolution := fmt.Sprintf("%dx%d", item.Properties.Width, item.Properties.Height)
+			result.Resolution = &resolution
+		}
+		results = append(results, result)
+	}
+	return &shared.SearchResponseBody{Query: query, NumberOfResults: len(results), Results: results}, nil
+}
+
+func (b *Brave) News(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	return b.vertical(ctx, "/news/search", query, locale)
+}
+
+func (b *Brave) Videos(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	return b.vertical(ctx, "/videos/search", query, locale)
+}
+
+// Shopping is not offered by the Brave Search api
+func (b *Brave) Shopping(context.Context, string, *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	return nil, ErrUnsupported
+}
+
+func (b *Brave) vertical(ctx context.Context, path string, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	var res braveVerticalResponse
+	if err := b.get(ctx, path, query, locale, shared.SearchNumVerticalResults, &res); err != nil {
+		return nil, err
+	}
+
+	results := make([]shared.SearchResults, 0, len(res.Results))
+	for _, item := range res.Results {
+		title := item.Title
+		content := item.Description
+		link := item.URL
+		source := item.MetaURL.Hostname
+		website := item.Video.Publisher
+		if website == "" {
+			website = source
+		}
+		parsedURL := strings.Split(source, ".")
+		publishedDate := item.PageAge
+		result := shared.SearchResults{
+			Title:         &title,
+			Content:       &content,
+			URL:           &link,
+			ParsedURL:     &parsedURL,
+			Source:        &source,
+			Website:       &website,
+			PublishedDate: &publishedDate,
+		}
+		if item.Thumbnail.Src != "" {
+			thumbnail := item.Thumbnail.Src
+			result.Thumbnail = &thumbnail
+		}
+		// Brave already reports durations as m:ss or h:mm:ss
+		if item.Video.Duration != "" {
+			duration := item.Video.Duration
+			result.Duration = &duration
+		}
+		results = append(results, result)
+	}
+	return &shared.SearchResponseBody{Query: query, NumberOfResults: len(results), Results: results}, nil
+}
+
+func (b *Brave) Autocomplete(ctx context.Context, query string, locale *shared.SearchLocale) ([]string, error) {
+	var res braveSuggestResponse
+	if err := b.get(ctx, "/suggest/search", query, locale, shared.SearchNumSuggestions, &res); err != nil {
+		return nil, err
+	}
+	suggestions := make([]string, 0, len(res.Results))
+	for _, item := range res.Results {
+		suggestions = append(suggestions, item.Query)
+	}
+	return suggestions, nil
+}
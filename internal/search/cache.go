@@ -0,0 +1,197 @@
+package search
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	TypeWeb      = "web"
+	TypeImages   = "images"
+	TypeNews     = "news"
+	TypeVideos   = "videos"
+	TypeShopping = "shopping"
+	// Autocomplete responses carry the completions in Suggestions
+	TypeAutocomplete = "autocomplete"
+)
+
+// CacheKey is what a cached response is stored under. Results from whichever
+// provider answered are shared unless the request asked for one
+type CacheKey struct {
+	Type     string
+	Provider string
+	Query    string
+	Locale   *shared.SearchLocale
+}
+
+func (k CacheKey) String() string {
+	provider := k.Provider
+	if provider == "" {
+		provider = "any"
+	}
+	region, language, safe := "", "", ""
+	if k.Locale != nil {
+		region, language, safe = k.Locale.Region, strings.ToLower(k.Locale.Language), k.Locale.SafeSearch
+	}
+	return fmt.Sprintf("sybil:v1:search:cache:%s:%s:%s:%s:%s:%s", k.Type, provider, region, language, safe, queryHash(k.Query))
+}
+
+// queryHash is the last part of every key, so one query can be purged across
+// types, providers and locales
+func queryHash(query string) string {
+	hash := sha256.Sum256([]byte(strings.Join(strings.Fields(strings.ToLower(query)), " ")))
+	return hex.EncodeToString(hash[:])
+}
+
+type cacheEntry struct {
+	Response  *shared.SearchResponseBody `json:"response"`
+	FetchedAt time.Time                  `json:"fetched_at"`
+}
+
+// Cache keeps search responses in redis. Entries are fresh for
+// SearchCacheFreshTTL, after that they are still served for up to
+// SearchCacheStaleTTL while one replica refreshes them in the background
+type Cache struct {
+	redis *redis.Client
+	log   *zap.SugaredLogger
+}
+
+func NewCache(redisClient *redis.Client, log *zap.SugaredLogger) *Cache {
+	return &Cache{redis: redisClient, log: log}
+}
+
+// Fetch runs a search against the providers
+type Fetch func(ctx context.Context) (*shared.SearchResponseBody, error)
+
+// Search returns the cached response for key, calling fetch on a miss.
+// Responses with a reason, like an exhausted quota, are not cached
+func (c *Cache) Search(ctx context.Context, key CacheKey, fetch Fetch) (*shared.SearchResponseBody, error) {
+	cacheKey := key.String()
+	lookupCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	entry := c.get(lookupCtx, cacheKey)
+	cancel()
+
+	if entry != nil {
+		if time.Since(entry.FetchedAt) < shared.SearchCacheFreshTTL {
+			metrics.SearchCacheRequests.WithLabelValues(key.Type, "hit").Inc()
+			return entry.Response, nil
+		}
+		metrics.SearchCacheRequests.WithLabelValues(key.Type, "stale").Inc()
+		go c.revalidate(key, cacheKey, fetch)
+		return entry.Response, nil
+	}
+
+	metrics.SearchCacheRequests.WithLabelValues(key.Type, "miss").Inc()
+	res, err := c.fetch(ctx, key, fetch)
+	if err != nil {
+		return nil, err
+	}
+	if res.Reason == "" {
+		go c.set(cacheKey, res)
+	}
+	return res, nil
+}
+
+func (c *Cache) fetch(ctx context.Context, key CacheKey, fetch Fetch) (*shared.SearchResponseBody, error) {
+	res, err := fetch(ctx)
+	if err != nil {
+		metrics.SearchQueries.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	if res.Reason != "" {
+		metrics.SearchQueries.WithLabelValues(res.Reason).Inc()
+		return res, nil
+	}
+	metrics.SearchQueries.WithLabelValues("ok").Inc()
+	return res, nil
+}
+
+// revalidate refreshes a stale entry. The lock keeps concurrent requests for
+// the same query from all spending a provider query on it
+func (c *Cache) revalidate(key CacheKey, cacheKey string, fetch Fetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*shared.SearchProviderTimeout)
+	defer cancel()
+
+	locked, err := c.redis.SetNX(ctx, cacheKey+":refresh", 1, 2*shared.SearchProviderTimeout).Result()
+	if err != nil || !locked {
+		return
+	}
+	res, err := c.fetch(ctx, key, fetch)
+	if err != nil {
+		c.log.Warnw("Failed to refresh stale search results", "error", err, "type", key.Type)
+		return
+	}
+	if res.Reason == "" {
+		c.set(cacheKey, res)
+	}
+}
+
+func (c *Cache) get(ctx context.Context, cacheKey string) *cacheEntry {
+	cached, err := c.redis.Get(ctx, cacheKey).Bytes()
+	if err != nil || len(cached) == 0 {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(cached, &entry); err != nil || entry.Response == nil {
+		return nil
+	}
+	return &entry
+}
+
+func (c *Cache) set(cacheKey string, res *shared.SearchResponseBody) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	entryJSON, err := json.Marshal(cacheEntry{Response: res, FetchedAt: time.Now()})
+	if err != nil {
+		return
+	}
+	if err := c.redis.Set(ctx, cacheKey, entryJSON, shared.SearchCacheFreshTTL+shared.SearchCacheStaleTTL).Err(); err != nil {
+		c.log.Warnw("Failed to cache search results", "error", err)
+	}
+}
+
+// Purge deletes cached responses for query, or every cached response when
+// query is empty. It returns how many entries were deleted
+func (c *Cache) Purge(ctx context.Context, query string) (int64, error) {
+	pattern := "sybil:v1:search:cache:*"
+	if strings.TrimSpace(query) != "" {
+		pattern = "sybil:v1:search:cache:*:" + queryHash(query)
+	}
+
+	var purged int64
+	iter := c.redis.Scan(ctx, 0, pattern, 1000).Iterator()
+	batch := make([]string, 0, 1000)
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == cap(batch) {
+			n, err := c.redis.Del(ctx, batch...).Result()
+			if err != nil {
+				return purged, err
+			}
+			purged += n
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return purged, err
+	}
+	if len(batch) > 0 {
+		n, err := c.redis.Del(ctx, batch...).Result()
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+	return purged, nil
+}
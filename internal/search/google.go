@@ -0,0 +1,209 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"sybil-api/internal/shared"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/customsearch/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Google searches with a Google programmable search engine. CSE has no
+// autocomplete or verticals, so those fall through to the next provider
+type Google struct {
+	service  *customsearch.Service
+	engineID string
+	log      *zap.SugaredLogger
+}
+
+func NewGoogle(apiKey string, engineID string, log *zap.SugaredLogger) (*Google, error) {
+	service, err := customsearch.NewService(context.Background(), option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create google search service: %w", err)
+	}
+	return &Google{service: service, engineID: engineID, log: log}, nil
+}
+
+func (g *Google) Name() string {
+	return shared.SearchProviderGoogle
+}
+
+func (g *Google) list(ctx context.Context, query string, locale *shared.SearchLocale) *customsearch.CseListCall {
+	search := g.service.Cse.List().Q(query).Cx(g.engineID).Num(shared.SearchNumResults).Context(ctx)
+	if locale != nil {
+		if locale.Region != "" {
+			search = search.Gl(locale.Region)
+		}
+		if locale.Language != "" {
+			search = search.Hl(locale.Language)
+		}
+		// CSE only filters or does not, moderate filters too
+		switch locale.SafeSearch {
+		case shared.SearchSafeOff:
+			search = search.Safe("off")
+		case shared.SearchSafeModerate, shared.SearchSafeStrict:
+			search = search.Safe("active")
+		}
+	}
+	return search
+}
+
+func (g *Google) Search(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	res, err := g.list(ctx, query, locale).Do()
+	if err != nil {
+		return nil, googleError(err)
+	}
+
+	results := make([]shared.SearchResults, 0, len(res.Items))
+	for _, item := range res.Items {
+		title := item.Title
+		content := item.Snippet
+		link := item.Link
+		source := ""
+		website := ""
+		metadata := ""
+		publishedDate := ""
+
+		if item.Pagemap != nil {
+			var pagemap map[string]any
+			if err := json.Unmarshal(item.Pagemap, &pagemap); err != nil {
+				g.log.Errorw("failed to unmarshal pagemap", "error", err.Error())
+				continue
+			}
+
+			if metatags, ok := pagemap["metatags"].([]any); ok {
+				if metatag := shared.GetFirstMap(metatags); metatag != nil {
+					publishedDate = shared.GetString(metatag, "article:published_time")
+					if desc := shared.GetString(metatag, "og:description"); desc != "" {
+						metadata = desc
+					}
+					if siteName := shared.GetString(metatag, "og:site_name"); siteName != "" {
+						website = siteName
+					}
+				}
+			}
+		}
+
+		parsedURL := []string{}
+		if link != "" {
+			if parsed, err := url.Parse(link); err == nil {
+				source = parsed.Hostname()
+				if website == "" {
+					website = source
+				}
+				parsedURL = strings.Split(source, ".")
+			}
+		}
+		results = append(results, shared.SearchResults{
+			Title:         &title,
+			Content:       &content,
+			URL:           &link,
+			ParsedURL:     &parsedURL,
+			Source:        &source,
+			Website:       &website,
+			Metadata:      &metadata,
+			PublishedDate: &publishedDate,
+		})
+	}
+
+	return &shared.SearchResponseBody{
+		Query:           query,
+		NumberOfResults: g.totalResults(res),
+		Results:         results,
+	}, nil
+}
+
+func (g *Google) Images(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	res, err := g.list(ctx, query, locale).SearchType("image").Do()
+	if err != nil {
+		return nil, googleError(err)
+	}
+
+	results := make([]shared.SearchResults, 0, len(res.Items))
+	for _, item := range res.Items {
+		if item.Image == nil {
+			continue
+		}
+		title := item.Title
+		imgSource := item.Link
+		pageURL := item.Image.ContextLink
+		thumbnail := item.Image.ThumbnailLink
+		resolution := fmt.Sprintf("%dx%d", item.Image.Width, item.Image.Height)
+		source := item.DisplayLink
+		results = append(results, shared.SearchResults{
+			Title:      &title,
+			URL:        &pageURL,
+			ImgSource:  &imgSource,
+			Thumbnail:  &thumbnail,
+			Resolution: &resolution,
+			Source:     &source,
+			Website:    &source,
+		})
+	}
+
+	return &shared.SearchResponseBody{
+		Query:           query,
+		NumberOfResults: g.totalResults(res),
+		Results:         results,
+	}, nil
+}
+
+func (g *Google) Autocomplete(context.Context, string, *shared.SearchLocale) ([]string, error) {
+	return nil, ErrUnsupported
+}
+
+func (g *Google) News(context.Context, string, *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	return nil, ErrUnsupported
+}
+
+func (g *Google) Videos(context.Context, string, *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	return nil, ErrUnsupported
+}
+
+func (g *Google) Shopping(context.Context, string, *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	return nil, ErrUnsupported
+}
+
+func (g *Google) totalResults(res *customsearch.Search) int {
+	if res.SearchInformation == nil {
+		return 0
+	}
+	totalResults, err := strconv.Atoi(res.SearchInformation.TotalResults)
+	if err != nil {
+		g.log.Warnw("error converting total results to int", "error", err.Error())
+		return 0
+	}
+	return totalResults
+}
+
+// googleError maps quota and bad query errors to the package errors
+func googleError(err error) error {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == 429 || (gerr.Code == 403 && isQuotaError(gerr)):
+			return fmt.Errorf("%w: %w", ErrRateLimited, err)
+		case gerr.Code == 400:
+			return fmt.Errorf("%w: %w", ErrInvalidQuery, err)
+		}
+	}
+	return err
+}
+
+func isQuotaError(gerr *googleapi.Error) bool {
+	for _, item := range gerr.Errors {
+		if strings.Contains(strings.ToLower(item.Reason), "limit") || strings.Contains(strings.ToLower(item.Reason), "quota") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package search
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"sybil-api/internal/shared"
+)
+
+// Web pages can carry text written for the model rather than the reader, like
+// "ignore previous instructions". Sentences matching known override phrases
+// are removed from results before they are put into a prompt
+
+// Removed marks where a suspicious sentence was taken out of a result
+const Removed = "[removed]"
+
+type injectionPattern struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+var injectionPatterns = []injectionPattern{
+	{kind: "ignore_instructions", re: regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override|bypass)\s+(all\s+|any\s+|the\s+)?(of\s+)?(your\s+|the\s+)?(previous|prior|above|earlier|preceding|original|system)\s+(instructions?|prompts?|rules|directions|guidelines|context)`)},
+	{kind: "role_override", re: regexp.MustCompile(`(?i)\b(you\s+are\s+now\s+(a|an|in|no\s+longer)\b|from\s+now\s+on,?\s+you\s+(are|will|must)|new\s+instructions\s*:)`)},
+	{kind: "prompt_leak", re: regexp.MustCompile(`(?i)\b(reveal|print|show|repeat|output)\s+(your|the)\s+(system\s+prompt|hidden\s+instructions|initial\s+instructions)`)},
+	{kind: "role_marker", re: regexp.MustCompile(`(?i)(<\|?(im_start|im_end|endoftext|system)\|?>|\[/?INST\]|(^|\n)\s*(system|assistant)\s*:|###\s*(system|instruction))`)},
+	{kind: "directive_to_model", re: regexp.MustCompile(`(?i)\b((note|message|instructions?|attention)\s+(to|for)\s+(the\s+)?(ai|assistant|llm|language\s+model|chatbot)s?|(ai|assistant|llm|language\s+model)s?\s+(reading\s+this\s+)?(must|should)\s+(now\s+)?(say|respond|reply|tell|recommend|state))\b`)},
+	{kind: "markdown_image", re: regexp.MustCompile(`!\[[^\]]*\]\(\s*https?://`)},
+}
+
+// Injection is a result that had suspicious text removed
+type Injection struct {
+	// Domain the result came from
+	Domain string
+	// The injectionPatterns kinds that matched
+	Kinds []string
+}
+
+// StripInjections returns copies of results with sentences matching override
+// phrases removed from their title, content and metadata
+func StripInjections(results []shared.SearchResults) ([]shared.SearchResults, []Injection) {
+	var injections []Injection
+	stripped := make([]shared.SearchResults, len(results))
+	for i, result := range results {
+		var kinds []string
+		result.Title = stripField(result.Title, &kinds)
+		result.Content = stripField(result.Content, &kinds)
+		result.Metadata = stripField(result.Metadata, &kinds)
+		stripped[i] = result
+		if len(kinds) > 0 {
+			injections = append(injections, Injection{Domain: resultDomain(result), Kinds: kinds})
+		}
+	}
+	return stripped, injections
+}
+
+func stripField(field *string, kinds *[]string) *string {
+	if field == nil || *field == "" {
+		return field
+	}
+	text := *field
+	for _, p := range injectionPatterns {
+		matches := p.re.FindAllStringIndex(text, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		if !slices.Contains(*kinds, p.kind) {
+			*kinds = append(*kinds, p.kind)
+		}
+		// Matches in the same sentence share one removal
+		var spans [][2]int
+		for _, match := range matches {
+			start, end := sentenceBounds(text, match[0], match[1])
+			if n := len(spans); n > 0 && start <= spans[n-1][1] {
+				spans[n-1][1] = max(spans[n-1][1], end)
+				continue
+			}
+			spans = append(spans, [2]int{start, end})
+		}
+		var sb strings.Builder
+		last := 0
+		for _, span := range spans {
+			sb.WriteString(text[last:span[0]])
+			sb.WriteString(Removed)
+			last = span[1]
+		}
+		sb.WriteString(text[last:])
+		text = sb.String()
+	}
+	return &text
+}
+
+// sentenceBounds widens a match to the sentence around it
+func sentenceBounds(text string, start int, end int) (int, int) {
+	if i := strings.LastIndexAny(text[:start], ".!?\n"); i >= 0 {
+		start = i + 1
+	} else {
+		start = 0
+	}
+	if i := strings.IndexAny(text[end:], ".!?\n"); i >= 0 {
+		end += i + 1
+	} else {
+		end = len(text)
+	}
+	// Keep the whitespace before the sentence so the text around it still reads
+	for start < end && (text[start] == ' ' || text[start] == '\t') {
+		start++
+	}
+	return start, end
+}
+
+func resultDomain(result shared.SearchResults) string {
+	if result.Source != nil && *result.Source != "" {
+		return strings.ToLower(*result.Source)
+	}
+	if result.URL != nil {
+		if parsed, err := url.Parse(*result.URL); err == nil {
+			return strings.ToLower(parsed.Hostname())
+		}
+	}
+	return ""
+}
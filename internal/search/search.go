@@ -0,0 +1,217 @@
+// Package search runs web searches against paid search providers. Providers
+// are tried in a configured order, so when one errors or runs out of quota the
+// next one answers. A request can prefer a provider, which is then tried first
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+	"sybil-api/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrRateLimited is returned when the provider refused the query for rate
+	// limits or an exhausted quota
+	ErrRateLimited = errors.New("search provider rate limited")
+	// ErrInvalidQuery is returned when the provider rejected the query itself,
+	// other providers are not tried
+	ErrInvalidQuery = errors.New("search provider rejected query")
+	// ErrUnsupported is returned by providers without the requested method
+	ErrUnsupported = errors.New("search provider does not support this method")
+)
+
+type Provider interface {
+	Name() string
+	// Search returns web results, with no results when nothing matched
+	Search(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error)
+	// Images returns image results, the image is in ImgSource and the page it
+	// is on in URL
+	Images(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error)
+	// Autocomplete returns query completions for a partial query
+	Autocomplete(ctx context.Context, query string, locale *shared.SearchLocale) ([]string, error)
+	// News returns news articles, newest first where the provider sorts them
+	News(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error)
+	// Videos returns videos, the page playing them is in URL
+	Videos(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error)
+	// Shopping returns product offers with their Price
+	Shopping(ctx context.Context, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error)
+}
+
+// Providers tries providers in order until one answers
+type Providers struct {
+	order []Provider
+	log   *zap.SugaredLogger
+}
+
+func NewProviders(log *zap.SugaredLogger, providers ...Provider) *Providers {
+	return &Providers{order: providers, log: log}
+}
+
+// Search runs query on the preferred provider, falling back to the others in
+// order. Rate limits and rejected queries are reported as the response reason
+// instead of an error
+func (p *Providers) Search(ctx context.Context, preferred string, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	res, err := fallback(ctx, p, "search", preferred, func(ctx context.Context, provider Provider) (*shared.SearchResponseBody, error) {
+		return provider.Search(ctx, query, locale)
+	})
+	return asReason(query, res, err)
+}
+
+// Images runs an image search with the same fallback as Search
+func (p *Providers) Images(ctx context.Context, preferred string, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	res, err := fallback(ctx, p, "images", preferred, func(ctx context.Context, provider Provider) (*shared.SearchResponseBody, error) {
+		return provider.Images(ctx, query, locale)
+	})
+	return asReason(query, res, err)
+}
+
+// News runs a news search with the same fallback as Search
+func (p *Providers) News(ctx context.Context, preferred string, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	res, err := fallback(ctx, p, "news", preferred, func(ctx context.Context, provider Provider) (*shared.SearchResponseBody, error) {
+		return provider.News(ctx, query, locale)
+	})
+	return asReason(query, res, err)
+}
+
+// Videos runs a video search with the same fallback as Search
+func (p *Providers) Videos(ctx context.Context, preferred string, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	res, err := fallback(ctx, p, "videos", preferred, func(ctx context.Context, provider Provider) (*shared.SearchResponseBody, error) {
+		return provider.Videos(ctx, query, locale)
+	})
+	return asReason(query, res, err)
+}
+
+// Shopping runs a product search with the same fallback as Search
+func (p *Providers) Shopping(ctx context.Context, preferred string, query string, locale *shared.SearchLocale) (*shared.SearchResponseBody, error) {
+	res, err := fallback(ctx, p, "shopping", preferred, func(ctx context.Context, provider Provider) (*shared.SearchResponseBody, error) {
+		return provider.Shopping(ctx, query, locale)
+	})
+	return asReason(query, res, err)
+}
+
+// Autocomplete returns completions from the first provider that has them
+func (p *Providers) Autocomplete(ctx context.Context, preferred string, query string, locale *shared.SearchLocale) ([]string, error) {
+	return fallback(ctx, p, "autocomplete", preferred, func(ctx context.Context, provider Provider) ([]string, error) {
+		return provider.Autocomplete(ctx, query, locale)
+	})
+}
+
+// fallback runs method on each provider, the preferred one first, until one
+// succeeds. A rejected query is not retried elsewhere, every other error moves
+// on to the next provider
+func fallback[T any](ctx context.Context, p *Providers, method string, preferred string, run func(context.Context, Provider) (T, error)) (T, error) {
+	var zero T
+	// Stays unsupported when no provider has the method
+	lastErr := ErrUnsupported
+	for i, provider := range p.ordered(preferred) {
+		attemptCtx, cancel := context.WithTimeout(ctx, shared.SearchProviderTimeout)
+		attemptCtx, span := tracing.Start(attemptCtx, "search."+method, attribute.String("search.provider", provider.Name()))
+		res, err := run(attemptCtx, provider)
+		if errors.Is(err, ErrUnsupported) {
+			tracing.End(span, nil)
+		} else {
+			tracing.End(span, err)
+		}
+		cancel()
+		if err == nil {
+			result := "ok"
+			if i > 0 {
+				result = "fallback"
+			}
+			metrics.SearchProviderRequests.WithLabelValues(provider.Name(), method, result).Inc()
+			return res, nil
+		}
+
+		switch {
+		case errors.Is(err, ErrUnsupported):
+			metrics.SearchProviderRequests.WithLabelValues(provider.Name(), method, "unsupported").Inc()
+			continue
+		case errors.Is(err, ErrInvalidQuery):
+			metrics.SearchProviderRequests.WithLabelValues(provider.Name(), method, "invalid_query").Inc()
+			return zero, err
+		case errors.Is(err, ErrRateLimited):
+			metrics.SearchProviderRequests.WithLabelValues(provider.Name(), method, "rate_limited").Inc()
+		default:
+			metrics.SearchProviderRequests.WithLabelValues(provider.Name(), method, "error").Inc()
+		}
+		p.log.Warnw("Search provider failed, trying next", "provider", provider.Name(), "method", method, "error", err)
+		lastErr = err
+	}
+	return zero, lastErr
+}
+
+// ordered puts the preferred provider first, unknown names keep the order
+func (p *Providers) ordered(preferred string) []Provider {
+	if preferred == "" || len(p.order) == 0 || preferred == p.order[0].Name() {
+		return p.order
+	}
+	ordered := make([]Provider, 0, len(p.order))
+	for _, provider := range p.order {
+		if provider.Name() == preferred {
+			ordered = append(ordered, provider)
+		}
+	}
+	for _, provider := range p.order {
+		if provider.Name() != preferred {
+			ordered = append(ordered, provider)
+		}
+	}
+	return ordered
+}
+
+// asReason reports rate limits and rejected queries as the response reason so
+// callers can show why there are no results
+func asReason(query string, res *shared.SearchResponseBody, err error) (*shared.SearchResponseBody, error) {
+	switch {
+	case err == nil:
+		if len(res.Results) == 0 && res.Reason == "" {
+			res.Reason = shared.SearchReasonNoResults
+		}
+		return res, nil
+	case errors.Is(err, ErrInvalidQuery):
+		return &shared.SearchResponseBody{Query: query, Reason: shared.SearchReasonInvalidQuery}, nil
+	case errors.Is(err, ErrRateLimited):
+		return &shared.SearchResponseBody{Query: query, Reason: shared.SearchReasonQuotaExceeded}, nil
+	}
+	return nil, err
+}
+
+// getJSON sends a GET to a provider api and decodes the reply into dest
+func getJSON(ctx context.Context, client *http.Client, endpoint string, header http.Header, dest any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	switch {
+	// Bing answers 403 once the monthly call volume is used up
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: status %d", ErrRateLimited, res.StatusCode)
+	case res.StatusCode == http.StatusBadRequest || res.StatusCode == http.StatusUnprocessableEntity:
+		return fmt.Errorf("%w: status %d", ErrInvalidQuery, res.StatusCode)
+	case res.StatusCode >= 300:
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("search provider returned status %d: %s", res.StatusCode, body)
+	}
+	return json.NewDecoder(res.Body).Decode(dest)
+}
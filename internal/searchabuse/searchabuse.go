@@ -0,0 +1,187 @@
+// Package searchabuse scores web search traffic for abuse. Searches cost a
+// paid provider query each and are reachable from the web app with only a
+// session, so clients are scored by ip and browser fingerprint on query
+// velocity, repeated identical queries and bot user agents. Scores past the
+// challenge threshold must pass a CAPTCHA, past the block threshold search is
+// refused. Counters live in redis so every replica sees the same traffic
+package searchabuse
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type Action string
+
+const (
+	ActionAllow     Action = "allow"
+	ActionChallenge Action = "challenge"
+	ActionBlock     Action = "block"
+)
+
+// Verdict is the score of one search and what to do about it
+type Verdict struct {
+	Score   int
+	Action  Action
+	Signals []string
+}
+
+// ChallengeVerifier checks a CAPTCHA token solved by the client at ip
+type ChallengeVerifier func(ctx context.Context, token string, ip string) (bool, error)
+
+type Detector struct {
+	redis *redis.Client
+	log   *zap.SugaredLogger
+	// Nil leaves challenges unenforced, clients that would be challenged are
+	// only counted. Blocks are always enforced
+	Verify ChallengeVerifier
+}
+
+func NewDetector(redisClient *redis.Client, log *zap.SugaredLogger) *Detector {
+	return &Detector{redis: redisClient, log: log}
+}
+
+var botUserAgent = regexp.MustCompile(`(?i)(bot|crawl|spider|scrapy|curl|wget|python-requests|python-urllib|aiohttp|httpx|go-http-client|java/|okhttp|libwww|headless|phantomjs|selenium|puppeteer|playwright)`)
+
+// Fingerprint identifies a browser across ips from the headers it sends
+func Fingerprint(header http.Header) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		header.Get("User-Agent"),
+		header.Get("Accept-Language"),
+		header.Get("Accept-Encoding"),
+		header.Get("Sec-Ch-Ua"),
+		header.Get("Sec-Ch-Ua-Platform"),
+	}, "|")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// velocityIP is the address velocity is counted under. IPv6 clients usually
+// hold a whole /64, so it is counted as one address
+func velocityIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() || addr.Is4In6() {
+		return ip
+	}
+	prefix, err := addr.Prefix(64)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// Check scores a search by client for query and counts it. Redis errors fail
+// open so search keeps working without the counters
+func (d *Detector) Check(ctx context.Context, client shared.SearchClient, query string) Verdict {
+	minute := time.Now().Unix() / 60
+	normalized := strings.Join(strings.Fields(strings.ToLower(query)), " ")
+	querySum := sha256.Sum256([]byte(normalized))
+
+	ipKey := fmt.Sprintf("sybil:v1:search-abuse:ip:%s:%d", velocityIP(client.IP), minute)
+	fingerprintKey := fmt.Sprintf("sybil:v1:search-abuse:fp:%s:%d", client.Fingerprint, minute)
+	repeatKey := fmt.Sprintf("sybil:v1:search-abuse:repeat:%s:%s", client.Fingerprint, hex.EncodeToString(querySum[:8]))
+	passedKey := fmt.Sprintf("sybil:v1:search-abuse:passed:%s", client.Fingerprint)
+
+	pipe := d.redis.Pipeline()
+	ipCount := pipe.Incr(ctx, ipKey)
+	pipe.Expire(ctx, ipKey, 2*time.Minute)
+	fingerprintCount := pipe.Incr(ctx, fingerprintKey)
+	pipe.Expire(ctx, fingerprintKey, 2*time.Minute)
+	repeatCount := pipe.Incr(ctx, repeatKey)
+	pipe.Expire(ctx, repeatKey, shared.SearchAbuseRepeatWindow)
+	passed := pipe.Exists(ctx, passedKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		d.log.Warnw("Failed to score search, allowing", "error", err)
+		return Verdict{Action: ActionAllow}
+	}
+
+	verdict := Verdict{}
+	add := func(signal string, points int) {
+		verdict.Score += points
+		verdict.Signals = append(verdict.Signals, signal)
+		metrics.SearchAbuseSignals.WithLabelValues(signal).Inc()
+	}
+	if velocity := velocityPoints(ipCount.Val(), shared.SearchAbuseIPPerMinute); velocity > 0 {
+		add("ip_velocity", velocity)
+	}
+	if velocity := velocityPoints(fingerprintCount.Val(), shared.SearchAbuseFingerprintPerMinute); velocity > 0 {
+		add("fingerprint_velocity", velocity)
+	}
+	if repeatCount.Val() > shared.SearchAbuseRepeatLimit {
+		add("repeated_query", 30)
+	}
+	if client.UserAgent == "" {
+		add("missing_user_agent", 30)
+	} else if botUserAgent.MatchString(client.UserAgent) {
+		add("bot_user_agent", 40)
+	}
+	verdict.Score = min(verdict.Score, 100)
+	metrics.SearchAbuseScore.Observe(float64(verdict.Score))
+
+	switch {
+	case verdict.Score >= shared.SearchAbuseBlockScore:
+		verdict.Action = ActionBlock
+	case verdict.Score >= shared.SearchAbuseChallengeScore:
+		verdict.Action = d.challenge(ctx, client, passedKey, passed.Val() > 0)
+	default:
+		verdict.Action = ActionAllow
+	}
+	metrics.SearchAbuseVerdicts.WithLabelValues(string(verdict.Action)).Inc()
+	if verdict.Action != ActionAllow {
+		d.log.Infow("Search abuse detected", "action", verdict.Action, "score", verdict.Score,
+			"signals", verdict.Signals, "ip", client.IP, "fingerprint", client.Fingerprint)
+	}
+	return verdict
+}
+
+// challenge lets the client through when it passed a challenge recently or
+// solved one with this request
+func (d *Detector) challenge(ctx context.Context, client shared.SearchClient, passedKey string, passed bool) Action {
+	if d.Verify == nil {
+		metrics.SearchAbuseVerdicts.WithLabelValues("unenforced").Inc()
+		return ActionAllow
+	}
+	if passed {
+		return ActionAllow
+	}
+	if client.ChallengeToken == "" {
+		return ActionChallenge
+	}
+	ok, err := d.Verify(ctx, client.ChallengeToken, client.IP)
+	if err != nil {
+		d.log.Warnw("Failed to verify search challenge", "error", err)
+		return ActionChallenge
+	}
+	if !ok {
+		return ActionChallenge
+	}
+	if err := d.redis.Set(ctx, passedKey, 1, shared.SearchAbuseChallengePassTTL).Err(); err != nil {
+		d.log.Warnw("Failed to store search challenge pass", "error", err)
+	}
+	return ActionAllow
+}
+
+// velocityPoints scores count searches in a minute against limit, 30 points
+// once over it and 50 from twice it
+func velocityPoints(count int64, limit int64) int {
+	switch {
+	case count > 2*limit:
+		return 50
+	case count > limit:
+		return 30
+	default:
+		return 0
+	}
+}
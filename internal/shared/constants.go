@@ -3,8 +3,21 @@ package shared
 import "time"
 
 const (
+	// Date of the last change to the api, reported by the /v1 index
+	APIRevision = "2026-10-16"
+
 	DefaultStreamRequestTimeout = 120 * time.Second
 	DefaultShutdownTimeout      = 10 * time.Minute
+	SSEHeartbeatInterval        = 15 * time.Second
+	// How long the events of a resumable stream are kept after they are sent
+	SSEResumeWindow = 2 * time.Minute
+	// How often a resumed stream checks for events the original sent since
+	SSEResumePollInterval = 250 * time.Millisecond
+	// Time a search answer may take. It keeps running when the client
+	// disconnects so the stream can be resumed
+	SearchAnswerTimeout = 3 * time.Minute
+	// How often streams that opted into the usage meter are sent it
+	UsageMeterInterval = 1 * time.Second
 )
 
 // Cache Configuration
@@ -13,11 +26,77 @@ const (
 	UserInfoCacheTTL     = 1 * time.Minute
 )
 
+// Response Cache Configuration
+const (
+	DefaultResponseCacheTTL = 10 * time.Minute
+	// Smaller responses are sent uncompressed, gzip would not pay for itself
+	CompressMinBytes = 1024
+)
+
+// Embedding Batch Configuration
+const (
+	EmbeddingBatchWindow  = 10 * time.Millisecond
+	EmbeddingMaxBatchSize = 256
+)
+
 // API Configuration
 const (
+	DefaultPageSize     = 50
+	MaxPageSize         = 200
 	DefaultMaxTokens    = 512
 	DefaultStreamOption = true
 	APIKeyLength        = 32
+	APIKeyMaxPerUser    = 50
+	APIKeyNameMaxLength = 64
+
+	ChatHistoryPreviewLength = 120
+	ChatShareTokenLength     = 24
+	SearchPublicIDLength     = 24
+	// How long after writing a users history reads skip the replica
+	HistoryReadYourWritesWindow = 10 * time.Second
+	// Limits of one chat history import request
+	ChatImportMaxBytes         = 50 << 20 // 50MB
+	ChatImportMaxConversations = 1000
+	ChatImportMaxMessages      = 2000
+	// Deleting all of a users histories
+	BulkDeleteConfirmTTL = 5 * time.Minute
+	BulkDeleteBatchSize  = 500
+	BulkDeleteStaleAfter = 10 * time.Minute
+	// Per user retention of stored content
+	RetentionMaxDays         = 3650
+	RetentionCleanupInterval = 1 * time.Hour
+	// Generated chat titles are capped so they fit the sidebar
+	ChatTitleMaxLength = 64
+	ChatTitleMaxTokens = 48
+	// Title generation runs in the background for up to ChatTitleTimeout.
+	// The history stream is held open up to ChatTitleWaitTimeout for it so
+	// the title can be sent as an event
+	ChatTitleTimeout     = 20 * time.Second
+	ChatTitleWaitTimeout = 3 * time.Second
+	// Follow-up questions suggested after a search answer, generated while
+	// the stream is still open
+	FollowupMinQuestions = 3
+	FollowupMaxQuestions = 5
+	FollowupMaxTokens    = 256
+	FollowupMaxLength    = 160
+	FollowupTimeout      = 8 * time.Second
+
+	APIKeyLastUsedInterval = 1 * time.Minute
+	// Max CIDRs and origins an api key can be restricted to, each
+	APIKeyMaxAllowlistEntries = 50
+	// Rejections are logged once per key, address and reason per interval
+	APIKeyRejectionLogInterval = 1 * time.Minute
+
+	RateLimitTimeout = 500 * time.Millisecond
+
+	// Session tokens from the web frontend
+	JWKSRefreshInterval    = 1 * time.Hour
+	JWKSMinRefreshInterval = 1 * time.Minute
+	JWKSFetchTimeout       = 5 * time.Second
+	JWTLeeway              = 30 * time.Second
+
+	// Signed control plane requests older or newer than this are rejected
+	SignatureMaxSkew = 5 * time.Minute
 )
 
 // Polling Configuration
@@ -28,9 +107,328 @@ const (
 	PollingMaxAttempts    = 360 // 360 * 30s = 180 minutes
 )
 
+// Evaluation Configuration
+const (
+	EvalMaxCases    = 200
+	EvalConcurrency = 4
+	EvalCaseTimeout = 2 * time.Minute
+)
+
+// Review Queue Configuration
+const (
+	MaxReviewSampleRate   = 0.05
+	ReviewMaxContentBytes = 64 * 1024
+)
+
+// Prompt Template Configuration
+const (
+	PromptTemplateMaxBytes = 64 * 1024
+)
+
+// System Policy Configuration
+const (
+	SystemPolicyMaxBytes = 16 * 1024
+	SystemPolicyCacheTTL = 1 * time.Minute
+)
+
+// Payload Transform Configuration
+const (
+	TransformConfigMaxBytes = 16 * 1024
+	TransformCacheTTL       = 1 * time.Minute
+	// Time each transform gets per request or response chunk, past it the
+	// plugin is abandoned
+	TransformTimeout = 50 * time.Millisecond
+	// Transforms applied to a single model or key
+	TransformMaxPerScope = 10
+)
+
+// Request Metadata Configuration
+const (
+	RequestMetadataMaxKeys        = 16
+	RequestMetadataMaxKeyLength   = 64
+	RequestMetadataMaxValueLength = 512
+)
+
+// Usage Reporting Configuration
+const (
+	UsageDefaultRangeDays = 30
+	UsageMaxRangeDays     = 366
+	UsageExportChunkSize  = 5000
+)
+
+// Budget Configuration
+const (
+	BudgetCacheTTL      = 30 * time.Second
+	BudgetMaxThresholds = 10
+	BudgetAlertTimeout  = 10 * time.Second
+)
+
+// Credits charged per request on external models called with the customers
+// own provider key, unless the model sets its own fee
+const DefaultBYOKRoutingFee = 10_000
+
+// Model Alert Configuration
+const (
+	ModelAlertCheckInterval        = 1 * time.Minute
+	ModelAlertCooldown             = 1 * time.Hour
+	ModelAlertTimeout              = 10 * time.Second
+	ModelAlertDefaultWindowMinutes = 60
+	ModelAlertMaxWindowMinutes     = 24 * 60
+	// Error rates over fewer requests are too noisy to alert on
+	ModelAlertMinRequests = 20
+
+	// Per minute model stats are kept a little longer than the largest window
+	ModelStatsTTL = 25 * time.Hour
+
+	// Models are listed as warm while targon reports replicas or they served a
+	// request within the window. Replica counts older than the ttl are unknown
+	ModelWarmWindow   = 5 * time.Minute
+	ModelWarmStateTTL = 5 * time.Minute
+)
+
+// Credit Ledger Configuration
+const (
+	MaxLedgerEntries = 500
+)
+
+// Billing Configuration
+const (
+	MaxInvoiceMonths       = 24
+	MinAutoRechargeCents   = 500
+	AutoRechargeInterval   = time.Minute
+	StripeRequestTimeout   = 30 * time.Second
+	StripeWebhookTolerance = 5 * time.Minute
+	// Incomplete requests are refunded in batches every interval, once they
+	// are older than the delay and until they pass the lookback
+	RefundReconcileInterval  = 5 * time.Minute
+	RefundReconcileDelay     = 10 * time.Minute
+	RefundReconcileLookback  = 24 * time.Hour
+	RefundReconcileBatchSize = 500
+)
+
+// Admin Audit Configuration
+const (
+	AuditLogMaxBodyBytes = 16 * 1024
+)
+
+// Search Configuration
+const (
+	// Cached results are served as is while fresh, then served stale while
+	// they are refreshed in the background
+	SearchCacheFreshTTL = 10 * time.Minute
+	SearchCacheStaleTTL = 6 * time.Hour
+	// How long one provider gets before the next one is tried
+	SearchProviderTimeout = 5 * time.Second
+	SearchNumResults      = 5
+	SearchNumImageResults = 20
+	SearchNumSuggestions  = 8
+	// Results per page on the news, video and shopping endpoints
+	SearchNumVerticalResults = 20
+	// Sorted set of domains by search results with prompt injections removed
+	SearchInjectionDomainsKey = "sybil:v1:search-injection:domains"
+	// How long reranking chat search results may take before they are used
+	// in provider order
+	SearchRerankBudget = 750 * time.Millisecond
+	// Snippets are cut to this many runes before they are embedded
+	SearchRerankMaxSnippetRunes = 1000
+)
+
+// Hero Card Configuration
+const (
+	// How long a hero card lookup may take, slower cards are not sent
+	HeroCardTimeout        = 2 * time.Second
+	HeroCardForecastDays   = 3
+	HeroCardMaxDefinitions = 3
+)
+
+// Autocomplete Configuration
+const (
+	// Recent searches kept per user for their own completions
+	AutocompleteRecentMax = 50
+	AutocompleteRecentTTL = 30 * 24 * time.Hour
+	// Trending counts older than the window are gone, within it they halve
+	// every half life
+	AutocompleteTrendingWindow   = 24 * time.Hour
+	AutocompleteTrendingHalfLife = 6 * time.Hour
+	// How long trending queries are kept in memory between reads
+	AutocompleteTrendingRefresh    = 1 * time.Minute
+	AutocompleteTrendingCandidates = 1000
+	// Decayed count a query needs before it is suggested to other users, so
+	// one off queries never leak
+	AutocompleteTrendingMinScore = 3.0
+	// Longer queries are not recorded
+	AutocompleteMaxQueryLength = 100
+	// How much each source adds to a completions rank
+	AutocompleteRecentWeight   = 3.0
+	AutocompleteTrendingWeight = 2.0
+	AutocompleteProviderWeight = 1.0
+)
+
+// Lifecycle Events Configuration
+const (
+	// Events queued beyond this while the publisher is behind are dropped
+	LifecycleQueueSize      = 10000
+	LifecycleBatchSize      = 500
+	LifecycleFlushInterval  = 1 * time.Second
+	LifecyclePublishTimeout = 5 * time.Second
+	LifecycleStreamMaxLen   = 1000000
+	LifecycleStream         = "sybil:v1:lifecycle:events"
+)
+
+// Search Abuse Configuration
+const (
+	SearchAbuseIPPerMinute          = 20
+	SearchAbuseFingerprintPerMinute = 10
+	// Identical queries from one fingerprint within the window
+	SearchAbuseRepeatLimit  = 5
+	SearchAbuseRepeatWindow = 10 * time.Minute
+	// Scores run from 0 to 100
+	SearchAbuseChallengeScore = 50
+	SearchAbuseBlockScore     = 80
+	// How long a solved challenge lets the fingerprint search unchallenged
+	SearchAbuseChallengePassTTL = 1 * time.Hour
+)
+
+// Replica Lag Configuration
+const (
+	ReplicaHeartbeatInterval = 1 * time.Second
+	// Reads that must see recent writes go to the primary past this lag
+	ReplicaLagThreshold = 3 * time.Second
+)
+
 // Bucket Configuration
 const (
+	// Defaults of the buckets.Settings flags
 	BucketFlushInterval = 1 * time.Minute
 	BucketRetryDelay    = 30 * time.Second
 	MaxFlushRetries     = 3
+	// 0 leaves buckets to the interval and inflight count
+	BucketFlushCredits = 0
+
+	BucketPollInterval = 1 * time.Second
+	// Runtime overrides of the settings reach every replica within this
+	BucketSettingsReloadInterval = 10 * time.Second
+
+	SaveRequestsChunkSize = 500
+	// Flushes that lost a lock conflict retry after this, times the attempt
+	LockConflictRetryDelay = 100 * time.Millisecond
+
+	// The flusher lease moves to another replica when the leader stops
+	// renewing it for the ttl
+	BucketLeaderLeaseTTL = 15 * time.Second
+	// Longer than any request can run, so counts left by a dead replica expire
+	BucketInflightTTL = 15 * time.Minute
+
+	// Default of the usage journal flag. Charges made directly while redis is
+	// down are kept here until they commit, so it must outlive the process
+	UsageJournalDir = "/var/lib/sybil/usage-journal"
+	// Journaled charges that failed are retried this often
+	UsageJournalReplayInterval = 30 * time.Second
+)
+
+// Capacity Configuration
+const (
+	// Reservations starting or ending are picked up within this long
+	ReservationCacheTTL = 1 * time.Minute
+	// Longer than any request can run, so slots left by a dead replica expire
+	CapacitySlotTTL = 15 * time.Minute
+	// Requests wait this long for a slot before being rejected, checking
+	// every poll interval
+	CapacityQueueTimeout      = 30 * time.Second
+	CapacityQueuePollInterval = 250 * time.Millisecond
+)
+
+// Autoscale Configuration
+const (
+	AutoscaleCheckInterval = 1 * time.Minute
+	// A model is scaled up after its queue holds at least the threshold for
+	// the sustained minutes, and back down after the quiet minutes without
+	AutoscaleQueueThreshold   = 10
+	AutoscaleSustainedMinutes = 5
+	AutoscaleQuietMinutes     = 30
+	AutoscaleReplicaStep      = 1
+	// At most one change per model per cooldown
+	AutoscaleCooldown = 10 * time.Minute
+)
+
+// Warm Pool Configuration
+const (
+	WarmPoolCheckInterval = 5 * time.Minute
+	// Weeks of daily_stats averaged into the per weekday forecast
+	WarmPoolLookbackWeeks = 4
+	// Days of requests the hourly shape of a day is taken from
+	WarmPoolShapeDays = 7
+	// How long a forecast is used before it is computed again
+	WarmPoolForecastTTL = 1 * time.Hour
+	// An hour is a peak when its forecast is at least this many times the
+	// average hour of the week and holds the minimum requests
+	WarmPoolPeakFactor        = 1.5
+	WarmPoolMinHourlyRequests = 100
+	// Models are scaled up this long before a peak hour starts
+	WarmPoolLeadTime = 30 * time.Minute
+	// Days of warm pool actions in the report
+	WarmPoolReportDays = 7
+)
+
+// Request Body Limits, per endpoint unless overridden by -max-body-bytes.
+// Chat and responses bodies can carry base64 images
+const (
+	MaxChatBodyBytes       = 20 << 20 // 20MB
+	MaxCompletionBodyBytes = 10 << 20 // 10MB
+	MaxEmbeddingBodyBytes  = 10 << 20 // 10MB
+	MaxResponsesBodyBytes  = 20 << 20 // 20MB
+)
+
+// Upstream Client Configuration
+const (
+	// Idle connections kept per model backend
+	UpstreamMaxIdleConnsPerHost = 32
+	UpstreamIdleConnTimeout     = 90 * time.Second
+	// Longest any request to a model may take, model timeouts cannot exceed it
+	UpstreamClientTimeout = 10 * time.Minute
+	// Longest line read from a model stream. Responses API completion events
+	// carry the whole output on one line
+	StreamMaxLineBytes = 16 << 20 // 16MB
+	// Chunk bytes kept per streamed response before text chunks are merged
+	StreamMaxBufferBytes = 32 << 20 // 32MB
+	StreamReadBufferSize = 64 << 10 // 64KB
+)
+
+// Incident Configuration
+const (
+	// Longest window an incident can cover, so a typo cannot refund months
+	IncidentMaxWindow     = 7 * 24 * time.Hour
+	IncidentRefundTimeout = 30 * time.Minute
+)
+
+// Fine-tuning Configuration
+const (
+	FineTuneMaxFileSize     = 100 << 20 // 100MB
+	FineTunePollingInterval = 1 * time.Minute
+	FineTunePollingMaxWait  = 72 * time.Hour
+)
+
+// Tokenizer Configuration
+const (
+	// tokenizer.json files are cached on disk here between restarts
+	TokenizerDir = "/var/cache/sybil/tokenizers"
+	// Downloads larger than this are rejected
+	TokenizerMaxBytes        = 64 << 20 // 64MB
+	TokenizerDownloadTimeout = 2 * time.Minute
+	// A tokenizer that failed to load is retried after this, requests use
+	// the estimate meanwhile
+	TokenizerRetryInterval = 10 * time.Minute
+	// Pre-tokenized words whose counts are remembered per tokenizer
+	TokenizerWordCacheSize = 50000
+	// Refreshes are published here so every replica reloads the tokenizer
+	TokenizerRefreshChannel = "sybil:v1:tokenizer:refresh"
+)
+
+// Tracing Configuration
+const (
+	TraceServiceName = "sybil-api"
+	// Share of new traces sampled, requests from trusted proxies arriving
+	// with a sampled traceparent are always traced
+	TraceSampleRatio     = 0.1
+	TraceShutdownTimeout = 10 * time.Second
 )
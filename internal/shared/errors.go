@@ -39,6 +39,8 @@ var (
 	ErrInternalServerError = &RequestError{Err: errors.New("internal server error"), StatusCode: 500}
 	ErrBadRequest          = &RequestError{Err: errors.New("bad request"), StatusCode: 400}
 	ErrNotFound            = &RequestError{Err: errors.New("not found"), StatusCode: 404}
+	ErrForbidden           = &RequestError{Err: errors.New("forbidden"), StatusCode: 403}
+	ErrConflict            = &RequestError{Err: errors.New("conflict"), StatusCode: 409}
 	ErrPartialSuccess      = &RequestError{Err: errors.New("partial success"), StatusCode: 200}
 
 	ErrColdStart              = &MetricsError{Msg: "model cold start", Code: "model_cold_start"}
@@ -47,6 +49,8 @@ var (
 	ErrFailedReadingResponse  = &MetricsError{Msg: "failed to read model response", Code: "model_response_err"}
 	ErrMissingDoneToken       = &MetricsError{Msg: "missing [DONE] token", Code: "missing_done_token"}
 	ErrModelContext           = &MetricsError{Msg: "model context canceled", Code: "model_context_err"}
+	ErrStreamLineTooLong      = &MetricsError{Msg: "model stream line over the size limit", Code: "stream_line_too_long"}
+	ErrStreamBufferFull       = &MetricsError{Msg: "model stream over the buffer limit", Code: "stream_buffer_full"}
 )
 
 
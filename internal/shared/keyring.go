@@ -0,0 +1,127 @@
+package shared
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Keyring holds key encryption keys for envelope encryption of stored
+// content. Each payload gets its own data key, which is stored wrapped by the
+// active key encryption key along with that keys id. Older keys are kept so
+// payloads sealed before a rotation can still be opened
+type Keyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+// SealedPayload is an encrypted payload ready to be stored
+type SealedPayload struct {
+	KeyID      string
+	DataKey    string
+	Ciphertext string
+}
+
+// NewKeyring parses a comma separated list of id:base64 key pairs. The first
+// key seals new payloads. An empty spec returns a nil keyring
+func NewKeyring(spec string) (*Keyring, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	kr := &Keyring{keys: map[string][]byte{}}
+	for _, pair := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" {
+			return nil, errors.New("invalid key entry, expected id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes of base64", id)
+		}
+		kr.keys[id] = key
+		if kr.activeID == "" {
+			kr.activeID = id
+		}
+	}
+	return kr, nil
+}
+
+// Seal encrypts plaintext under a fresh data key
+func (kr *Keyring) Seal(plaintext []byte) (*SealedPayload, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	ciphertext, err := gcmSeal(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := gcmSeal(kr.keys[kr.activeID], dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SealedPayload{
+		KeyID:      kr.activeID,
+		DataKey:    base64.StdEncoding.EncodeToString(wrapped),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}, nil
+}
+
+// Open unwraps the data key with the key it was sealed under and decrypts the
+// payload
+func (kr *Keyring) Open(sealed SealedPayload) ([]byte, error) {
+	kek, ok := kr.keys[sealed.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", sealed.KeyID)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(sealed.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := gcmOpen(kek, wrapped)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to unwrap data key"), err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(dataKey, ciphertext)
+}
+
+// gcmSeal returns the nonce followed by the AES-GCM ciphertext
+func gcmSeal(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func gcmOpen(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,26 @@
+package shared
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying the request scoped logger
+func WithLogger(ctx context.Context, log *zap.SugaredLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// LoggerFromContext returns the request scoped logger set by the track
+// middleware, or fallback for work that is not tied to a request
+func LoggerFromContext(ctx context.Context, fallback *zap.SugaredLogger) *zap.SugaredLogger {
+	if ctx == nil {
+		return fallback
+	}
+	if log, ok := ctx.Value(loggerKey{}).(*zap.SugaredLogger); ok && log != nil {
+		return log
+	}
+	return fallback
+}
@@ -1,6 +1,8 @@
 package shared
 
 import (
+	"fmt"
+	"slices"
 	"time"
 )
 
@@ -10,6 +12,8 @@ type ChatMessage struct {
 	Name    string          `json:"name,omitempty"`
 	Model   string          `json:"model,omitempty"`
 	Sources []SearchResults `json:"sources,omitempty"`
+	// Kept on assistant messages of chats with IncludeReasoning set
+	Reasoning string `json:"reasoning,omitempty"`
 }
 
 type Response struct {
@@ -24,11 +28,13 @@ type Choice struct {
 	Message *Message `json:"message,omitempty"`
 }
 type Delta struct {
-	Content string `json:"content"`
+	Content          string `json:"content"`
+	ReasoningContent string `json:"reasoning_content,omitempty"`
 }
 type Message struct {
-	Content string `json:"content"`
-	Role    string `json:"role,omitempty"`
+	Content          string `json:"content"`
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Role             string `json:"role,omitempty"`
 }
 
 type InferenceBody struct {
@@ -54,6 +60,65 @@ type ChatSettings struct {
 	Stream            bool     `json:"stream"`
 	Logprobs          bool     `json:"logprobs"`
 	Search            string   `json:"search"`
+
+	// Overrides for the region and language derived from the client ip
+	SearchRegion   string `json:"search_region,omitempty"`
+	SearchLanguage string `json:"search_language,omitempty"`
+	// Search provider tried first, the others still answer when it fails
+	SearchProvider string `json:"search_provider,omitempty"`
+	// One of the SearchSafe levels, empty for the users default
+	SearchSafe string `json:"search_safe,omitempty"`
+	// Reasoning of reasoning models is stored with the reply, otherwise only
+	// the answer is kept in the history
+	IncludeReasoning bool `json:"include_reasoning,omitempty"`
+}
+
+const (
+	SearchProviderGoogle = "google"
+	SearchProviderBrave  = "brave"
+	SearchProviderBing   = "bing"
+)
+
+var SearchProviders = []string{SearchProviderGoogle, SearchProviderBrave, SearchProviderBing}
+
+const (
+	SearchSafeOff      = "off"
+	SearchSafeModerate = "moderate"
+	SearchSafeStrict   = "strict"
+)
+
+var SearchSafeLevels = []string{SearchSafeOff, SearchSafeModerate, SearchSafeStrict}
+
+const (
+	SearchLocaleSourceSettings = "settings"
+	SearchLocaleSourceEdge     = "edge"
+	SearchLocaleSourceUser     = "user"
+)
+
+// SearchLocale biases search results towards a region and language. Empty
+// fields leave the search provider default
+const (
+	PIIRedactionRegex = "regex"
+	// Patterns followed by the redaction model
+	PIIRedactionModel = "model"
+)
+
+type SearchLocale struct {
+	Region   string `json:"region,omitempty"`
+	Language string `json:"language,omitempty"`
+	// One of the SearchSafe levels, empty for the provider default
+	SafeSearch string `json:"safe_search,omitempty"`
+	// Where the locale came from, for logging
+	Source string `json:"-"`
+}
+
+// SearchClient identifies who a web search is run for, scored for abuse
+type SearchClient struct {
+	IP          string
+	Fingerprint string
+	UserAgent   string
+	// CAPTCHA token sent after the client was challenged
+	ChallengeToken string
 }
 
 type SearchResults struct {
@@ -68,26 +133,168 @@ type SearchResults struct {
 	ParsedURL     *[]string `json:"parsed_url,omitempty"`
 	Metadata      *string   `json:"metadata,omitempty"`
 	PublishedDate *string   `json:"publishedDate,omitempty"`
+	// Video length as h:mm:ss or m:ss, set on video results
+	Duration *string `json:"duration,omitempty"`
+	// Price with its currency, set on shopping results
+	Price *string `json:"price,omitempty"`
 }
 
 type SearchResponseBody struct {
+	// Public id of the saved search, set when it was saved for the user
+	ID              string          `json:"id,omitempty"`
 	Query           string          `json:"query"`
 	NumberOfResults int             `json:"number_of_results"`
 	Results         []SearchResults `json:"results,omitempty"`
 	Suggestions     []string        `json:"suggestions,omitempty"`
+	// Set when there are no results, one of the SearchReason values
+	Reason string `json:"reason,omitempty"`
 }
 
+const (
+	SearchReasonNoResults     = "no_results"
+	SearchReasonQuotaExceeded = "quota_exceeded"
+	SearchReasonInvalidQuery  = "invalid_query"
+	SearchReasonUnavailable   = "unavailable"
+	// The client has to solve a CAPTCHA before searching again
+	SearchReasonChallenge = "challenge_required"
+	SearchReasonBlocked   = "blocked"
+)
+
 type UserMetadata struct {
 	Email          string `json:"email,omitempty"`
 	UserID         uint64 `json:"user_id,omitempty"`
 	Credits        uint64 `json:"credits,omitempty"`
 	PlanRequests   uint   `json:"plan_requests,omitempty"`
 	AllowOverspend bool   `json:"allow_overspend,omitempty"`
-	StoreData      bool   `json:"store_data,omitempty"`
-	Role           string `json:"role,omitempty"`
-	APIKey         string
+	// Request and response content may be kept, otherwise only counts and
+	// hashes are stored
+	StoreData bool   `json:"store_data,omitempty"`
+	Role      string `json:"role,omitempty"`
+	APIKey    string
+	// Set when the user belongs to an organization, in which case credits,
+	// plan requests and overspend come from the organization pool
+	OrganizationID   uint64 `json:"organization_id,omitempty"`
+	OrganizationRole string `json:"organization_role,omitempty"`
+	// Region user content must be stored in, empty for no requirement
+	DataResidency string `json:"data_residency,omitempty"`
+	// Chat history is envelope encrypted before it is stored
+	EncryptHistory bool `json:"encrypt_history,omitempty"`
+	// How personal information is redacted from stored content, empty for
+	// not at all
+	PIIRedaction string `json:"pii_redaction,omitempty"`
+	// Search defaults used when a request does not set its own, empty for
+	// the region and language of the client and the provider safe search
+	SearchRegion   string `json:"search_region,omitempty"`
+	SearchLanguage string `json:"search_language,omitempty"`
+	SearchSafe     string `json:"search_safe,omitempty"`
+	// Nil for keys created before scopes existed, which keep full access
+	Scopes    []string `json:"scopes,omitempty"`
+	ExpiresAt *int64   `json:"expires_at,omitempty"`
+	// Rate limits come from the users tier, api keys can set lower ones
+	RateLimitTier string  `json:"rate_limit_tier,omitempty"`
+	KeyRPM        *uint64 `json:"key_rpm,omitempty"`
+	KeyTPM        *uint64 `json:"key_tpm,omitempty"`
+	// Public id of the api key, safe to log
+	KeyID string `json:"key_id,omitempty"`
+	// CIDRs and origins the api key can be used from, empty allows any
+	AllowedIPs     []string `json:"allowed_ips,omitempty"`
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// Reasoning of reasoning models is stripped from responses to the key
+	HideReasoning bool `json:"hide_reasoning,omitempty"`
+	// Set instead of APIKey when the request authenticated with a web session
+	// token
+	SessionToken string `json:"-"`
+}
+
+// RateLimitKey identifies the api key, or the user for web sessions, that rate
+// limits are tracked against
+func (u *UserMetadata) RateLimitKey() string {
+	if u.APIKey == "" {
+		return fmt.Sprintf("session:%d", u.UserID)
+	}
+	return u.APIKey
+}
+
+// Credential is the bearer token the request authenticated with, for calls
+// back into the api on the users behalf
+func (u *UserMetadata) Credential() string {
+	if u.APIKey == "" {
+		return u.SessionToken
+	}
+	return u.APIKey
+}
+
+// RateLimit returns the limits that apply to the api key used for the request
+func (u *UserMetadata) RateLimit() RateLimit {
+	limit, ok := RateLimitTiers[u.RateLimitTier]
+	if !ok {
+		limit = RateLimitTiers[DefaultRateLimitTier]
+	}
+	if u.KeyRPM != nil && (limit.RequestsPerMinute == 0 || *u.KeyRPM < limit.RequestsPerMinute) {
+		limit.RequestsPerMinute = *u.KeyRPM
+	}
+	if u.KeyTPM != nil && (limit.TokensPerMinute == 0 || *u.KeyTPM < limit.TokensPerMinute) {
+		limit.TokensPerMinute = *u.KeyTPM
+	}
+	return limit
+}
+
+// HasScope reports whether the api key used for the request grants scope
+func (u *UserMetadata) HasScope(scope string) bool {
+	if u.Scopes == nil {
+		return true
+	}
+	return slices.Contains(u.Scopes, scope)
+}
+
+// Values of the user role column
+const (
+	RoleAdmin    = "ADMIN"
+	RoleOperator = "OPERATOR"
+	RoleBilling  = "BILLING"
+	RoleViewer   = "VIEWER"
+)
+
+// RateLimit caps requests and tokens per minute for an api key, zero is
+// unlimited
+type RateLimit struct {
+	RequestsPerMinute uint64 `json:"requests_per_minute"`
+	TokensPerMinute   uint64 `json:"tokens_per_minute"`
+}
+
+// Values of the user rate_limit_tier column
+const (
+	RateLimitTierFree       = "FREE"
+	RateLimitTierStandard   = "STANDARD"
+	RateLimitTierEnterprise = "ENTERPRISE"
+
+	DefaultRateLimitTier = RateLimitTierStandard
+)
+
+var RateLimitTiers = map[string]RateLimit{
+	RateLimitTierFree:       {RequestsPerMinute: 20, TokensPerMinute: 40_000},
+	RateLimitTierStandard:   {RequestsPerMinute: 500, TokensPerMinute: 1_000_000},
+	RateLimitTierEnterprise: {RequestsPerMinute: 5_000, TokensPerMinute: 10_000_000},
 }
 
+const (
+	OrganizationRoleOwner  = "OWNER"
+	OrganizationRoleMember = "MEMBER"
+)
+
+const (
+	ScopeInference   = "inference"
+	ScopeSearch      = "search"
+	ScopeAdmin       = "admin"
+	ScopeHistoryRead = "history:read"
+)
+
+var APIKeyScopes = []string{ScopeInference, ScopeSearch, ScopeAdmin, ScopeHistoryRead}
+
+// BYOKProviders are the external providers customers can bring their own key
+// for
+var BYOKProviders = []string{"openai", "anthropic", "google", "mistral", "together"}
+
 type Endpoints struct {
 	CHAT       string
 	COMPLETION string
@@ -114,6 +321,28 @@ type ProcessedQueryInfo struct {
 	TimeToFirstToken time.Duration
 	Usage            *Usage
 	TotalCredits     uint64
+	// Rates the request was billed at, kept with the request so it can be
+	// audited after the model price changes
+	ICPT uint64
+	OCPT uint64
+	CRC  uint64
+	// Off-peak multiplier applied to the rates, 1 outside off-peak hours
+	PriceMultiplier float64
+	Seed            *int64
+	Metadata        map[string]string
+	// Public id of the api key, budgets are charged per key on it
+	KeyID string
+	// Billed by the provider on the customers own key, TotalCredits is only
+	// the routing fee
+	BYOK bool
+	// Served on the users reserved capacity rather than on-demand
+	Reserved bool
+	// Metadata values are stored hashed when false
+	StoreData bool
+	// Only counted in the daily stats and charged, no request row is saved
+	Ephemeral bool
+	// The model finished its answer, false when it failed part way
+	Completed bool
 }
 
 // Usage tracks token usage for API requests
@@ -132,3 +361,70 @@ type OpenAIError struct {
 }
 
 const CreditsToUSD = 0.00000001
+
+// OffPeakWindow discounts a model between two UTC hours. Windows where
+// StartHour is after EndHour wrap past midnight
+type OffPeakWindow struct {
+	StartHour  int     `json:"start_hour"`
+	EndHour    int     `json:"end_hour"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// Valid reports whether the window covers a range of whole UTC hours with a
+// positive multiplier
+func (w OffPeakWindow) Valid() bool {
+	return w.StartHour >= 0 && w.StartHour < 24 && w.EndHour >= 0 && w.EndHour < 24 &&
+		w.StartHour != w.EndHour && w.Multiplier > 0
+}
+
+func (w OffPeakWindow) contains(hour int) bool {
+	if w.StartHour < w.EndHour {
+		return hour >= w.StartHour && hour < w.EndHour
+	}
+	return hour >= w.StartHour || hour < w.EndHour
+}
+
+// OffPeakMultiplier returns the multiplier of the first window containing t,
+// or 1 when t is outside every window. Malformed windows are ignored
+func OffPeakMultiplier(windows []OffPeakWindow, t time.Time) float64 {
+	hour := t.UTC().Hour()
+	for _, w := range windows {
+		if w.Valid() && w.contains(hour) {
+			return w.Multiplier
+		}
+	}
+	return 1
+}
+
+// NextOffPeakChange returns when the multiplier in effect at t next changes,
+// or nil when it never does
+func NextOffPeakChange(windows []OffPeakWindow, t time.Time) *time.Time {
+	current := OffPeakMultiplier(windows, t)
+	hour := t.UTC().Truncate(time.Hour)
+	for i := 1; i <= 24; i++ {
+		next := hour.Add(time.Duration(i) * time.Hour)
+		if OffPeakMultiplier(windows, next) != current {
+			return &next
+		}
+	}
+	return nil
+}
+
+const (
+	BudgetPeriodMonthly = "MONTHLY"
+	BudgetPeriodWeekly  = "WEEKLY"
+)
+
+// BudgetPeriodStart returns the UTC start of the budget period containing now.
+// Weekly periods start on Monday
+func BudgetPeriodStart(period string, now time.Time) time.Time {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case BudgetPeriodWeekly:
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	default:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
@@ -2,6 +2,13 @@
 package shared
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
 	"strings"
 
 	"github.com/labstack/echo/v4"
@@ -53,17 +60,117 @@ func DerefString(s *string) string {
 	return ""
 }
 
-// CalculateCredits calculates the number of credits used based on token usage and model
-func CalculateCredits(usage *Usage, icpt uint64, ocpt uint64, crc uint64) uint64 {
+// CalculateCredits calculates the number of credits used based on token usage
+// and model, scaled by the off-peak multiplier in effect when the request
+// started
+func CalculateCredits(usage *Usage, icpt uint64, ocpt uint64, crc uint64, multiplier float64) uint64 {
 	if usage == nil {
 		return 0
 	}
 	if usage.IsCanceled {
-		return crc
+		return applyMultiplier(crc, multiplier)
 	}
 	inputCredits := icpt * usage.PromptTokens
 	outputCredits := ocpt * usage.CompletionTokens
 
 	// Calculate total cost using the model's cpt
-	return inputCredits + outputCredits
+	return applyMultiplier(inputCredits+outputCredits, multiplier)
+}
+
+func applyMultiplier(credits uint64, multiplier float64) uint64 {
+	if multiplier <= 0 || multiplier == 1 {
+		return credits
+	}
+	return uint64(math.Round(float64(credits) * multiplier))
+}
+
+// APIKeyCacheKey is where the user metadata for an api key is cached
+func APIKeyCacheKey(apiKey string) string {
+	return fmt.Sprintf("sybil:v4:user:apikey:%s", apiKey)
+}
+
+// SessionCacheKey is where the user metadata for web sessions of a user is
+// cached
+func SessionCacheKey(userID uint64) string {
+	return fmt.Sprintf("sybil:v4:user:session:%d", userID)
+}
+
+// ReservationCacheKey is where the active capacity reservations of a model
+// are cached
+func ReservationCacheKey(modelID uint64) string {
+	return fmt.Sprintf("sybil:v1:capacity:reservations:%d", modelID)
+}
+
+// ModelWarmKey holds the replica count targon last reported for a model and
+// when it was checked
+func ModelWarmKey(modelID uint64) string {
+	return fmt.Sprintf("sybil:v1:model-warm:%d", modelID)
+}
+
+// CapacityQueueKey is the queue of requests waiting on admission to a model,
+// scored by the unix millisecond they joined it
+func CapacityQueueKey(modelID uint64) string {
+	return fmt.Sprintf("sybil:v1:capacity:%d:queue", modelID)
+}
+
+// ParseAllowedIP parses an api key allowlist entry, either a CIDR or a single
+// address which is treated as a /32 or /128
+func ParseAllowedIP(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// NormalizeOrigin reduces an origin to the lowercase scheme://host[:port]
+// form browsers send in the Origin header
+func NormalizeOrigin(origin string) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil {
+		return "", err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", errors.New("origin must be an http or https url")
+	}
+	if (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil {
+		return "", errors.New("origin cannot have a path, query or credentials")
+	}
+	return strings.ToLower(parsed.Scheme + "://" + parsed.Host), nil
+}
+
+// ValidateWebhookURL checks that a user supplied webhook is an https url whose
+// host does not resolve to a loopback, private or link-local address
+func ValidateWebhookURL(ctx context.Context, raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return errors.New("webhook_url must be an https url")
+	}
+	host := parsed.Hostname()
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil || len(addrs) == 0 {
+			return errors.New("webhook_url host does not resolve")
+		}
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+			addr.IsMulticast() || addr.IsUnspecified() || addr.IsInterfaceLocalMulticast() {
+			return errors.New("webhook_url cannot target a private or loopback address")
+		}
+	}
+	return nil
 }
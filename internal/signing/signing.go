@@ -0,0 +1,121 @@
+// Package signing signs and verifies control plane requests with
+// HMAC-SHA256 over the method, path, timestamp, nonce and body hash
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aidarkhanov/nanoid"
+)
+
+const (
+	HeaderTimestamp = "X-Sybil-Timestamp"
+	HeaderNonce     = "X-Sybil-Nonce"
+	HeaderBodyHash  = "X-Sybil-Content-SHA256"
+	HeaderSignature = "X-Sybil-Signature"
+)
+
+var (
+	ErrMissingHeaders   = errors.New("missing signature headers")
+	ErrStaleTimestamp   = errors.New("signature timestamp outside the allowed skew")
+	ErrBodyHashMismatch = errors.New("body does not match signed hash")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// BodyHash is the hex sha256 of the body, sent so the signature covers it
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign returns the hex signature of a request. path includes the query string
+func Sign(secret, method, path, timestamp, nonce, bodyHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{strings.ToUpper(method), path, timestamp, nonce, bodyHash}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the signature headers on req for body, which must be the
+// requests full body
+func SignRequest(req *http.Request, secret string, body []byte, now time.Time) error {
+	nonce, err := nanoid.Generate("0123456789abcdefghijklmnopqrstuvwxyz", 24)
+	if err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	bodyHash := BodyHash(body)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderBodyHash, bodyHash)
+	req.Header.Set(HeaderSignature, Sign(secret, req.Method, req.URL.RequestURI(), timestamp, nonce, bodyHash))
+	return nil
+}
+
+// Verify checks the signature headers of a request against its body and
+// returns the nonce, which the caller must reject if it has seen it before
+func Verify(secret string, header http.Header, method, path string, body []byte, now time.Time, maxSkew time.Duration) (string, error) {
+	timestamp := header.Get(HeaderTimestamp)
+	nonce := header.Get(HeaderNonce)
+	bodyHash := header.Get(HeaderBodyHash)
+	signature := header.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || bodyHash == "" || signature == "" {
+		return "", ErrMissingHeaders
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrMissingHeaders
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > maxSkew || skew < -maxSkew {
+		return "", ErrStaleTimestamp
+	}
+	if !hmac.Equal([]byte(bodyHash), []byte(BodyHash(body))) {
+		return "", ErrBodyHashMismatch
+	}
+	expected := Sign(secret, method, path, timestamp, nonce, bodyHash)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", ErrInvalidSignature
+	}
+	return nonce, nil
+}
+
+// Transport signs requests to host before passing them to Base. Requests to
+// other hosts, like model backends sharing the client, are sent unsigned
+type Transport struct {
+	Base   http.RoundTripper
+	Secret string
+	Host   string
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Secret == "" || req.URL.Host != t.Host {
+		return t.Base.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body for signing: %w", err)
+		}
+	}
+	// RoundTrippers must not modify the callers request
+	signed := req.Clone(req.Context())
+	if body != nil {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if err := SignRequest(signed, t.Secret, body, time.Now()); err != nil {
+		return nil, err
+	}
+	return t.Base.RoundTrip(signed)
+}
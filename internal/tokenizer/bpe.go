@@ -0,0 +1,218 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"sybil-api/internal/shared"
+)
+
+// Byte level models (GPT-2, Llama 3, Qwen) split text with a lookahead
+// pattern Go cannot run, this is the closest RE2 equivalent. Words only split
+// differently at runs of whitespace, which costs a token at most
+var byteLevelSplit = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// Sentencepiece style models (Llama 2, Mistral) mark spaces with this
+const metaspace = "▁"
+
+// BPE counts tokens with the vocabulary and merges of a Hugging Face
+// tokenizer.json
+type BPE struct {
+	ranks     map[string]int
+	vocab     map[string]int
+	byteLevel bool
+
+	mu    sync.Mutex
+	words map[string]int
+}
+
+type tokenizerJSON struct {
+	Model struct {
+		Type   string          `json:"type"`
+		Vocab  map[string]int  `json:"vocab"`
+		Merges json.RawMessage `json:"merges"`
+	} `json:"model"`
+	PreTokenizer json.RawMessage `json:"pre_tokenizer"`
+	Decoder      json.RawMessage `json:"decoder"`
+}
+
+// ParseBPE reads a tokenizer.json. Only BPE models are supported, which
+// covers the models we serve
+func ParseBPE(data []byte) (*BPE, error) {
+	var file tokenizerJSON
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid tokenizer.json: %w", err)
+	}
+	if file.Model.Type != "BPE" {
+		return nil, fmt.Errorf("unsupported tokenizer model %q", file.Model.Type)
+	}
+	if len(file.Model.Vocab) == 0 {
+		return nil, errors.New("tokenizer has an empty vocab")
+	}
+	merges, err := parseMerges(file.Model.Merges)
+	if err != nil {
+		return nil, err
+	}
+	b := &BPE{
+		ranks: make(map[string]int, len(merges)),
+		vocab: file.Model.Vocab,
+		// Byte level tokenizers name it in the pre-tokenizer or decoder
+		byteLevel: strings.Contains(string(file.PreTokenizer), `"ByteLevel"`) || strings.Contains(string(file.Decoder), `"ByteLevel"`),
+		words:     map[string]int{},
+	}
+	for rank, pair := range merges {
+		key := pair[0] + "\x00" + pair[1]
+		if _, ok := b.ranks[key]; !ok {
+			b.ranks[key] = rank
+		}
+	}
+	return b, nil
+}
+
+// Merges are "a b" strings in older files and ["a", "b"] pairs in newer ones
+func parseMerges(raw json.RawMessage) ([][2]string, error) {
+	var pairs [][2]string
+	if err := json.Unmarshal(raw, &pairs); err == nil {
+		return pairs, nil
+	}
+	var lines []string
+	if err := json.Unmarshal(raw, &lines); err != nil {
+		return nil, fmt.Errorf("invalid tokenizer merges: %w", err)
+	}
+	pairs = make([][2]string, 0, len(lines))
+	for _, line := range lines {
+		a, b, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid tokenizer merge %q", line)
+		}
+		pairs = append(pairs, [2]string{a, b})
+	}
+	return pairs, nil
+}
+
+func (b *BPE) Exact() bool {
+	return true
+}
+
+func (b *BPE) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	var words []string
+	if b.byteLevel {
+		words = byteLevelSplit.FindAllString(text, -1)
+	} else {
+		words = metaspaceWords(text)
+	}
+	total := 0
+	for _, word := range words {
+		total += b.countWord(word)
+	}
+	return total
+}
+
+// metaspaceWords replaces spaces with the metaspace and splits before each
+// one, the leading one included
+func metaspaceWords(text string) []string {
+	text = metaspace + strings.ReplaceAll(text, " ", metaspace)
+	words := strings.SplitAfter(text, metaspace)
+	out := make([]string, 0, len(words))
+	pending := ""
+	for _, word := range words {
+		// SplitAfter leaves the metaspace at the end, it starts the next word
+		word = pending + word
+		pending = ""
+		if rest, ok := strings.CutSuffix(word, metaspace); ok {
+			word, pending = rest, metaspace
+		}
+		if word != "" {
+			out = append(out, word)
+		}
+	}
+	if pending != "" {
+		out = append(out, pending)
+	}
+	return out
+}
+
+func (b *BPE) countWord(word string) int {
+	b.mu.Lock()
+	count, ok := b.words[word]
+	b.mu.Unlock()
+	if ok {
+		return count
+	}
+
+	symbols := b.symbols(word)
+	for len(symbols) > 1 {
+		best, bestRank := -1, 0
+		for i := 0; i < len(symbols)-1; i++ {
+			rank, ok := b.ranks[symbols[i]+"\x00"+symbols[i+1]]
+			if ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		merged := symbols[best] + symbols[best+1]
+		symbols = append(symbols[:best+1], symbols[best+2:]...)
+		symbols[best] = merged
+	}
+	count = 0
+	for _, symbol := range symbols {
+		// Byte fallback splits symbols outside the vocab into their bytes
+		if _, ok := b.vocab[symbol]; ok || b.byteLevel {
+			count++
+		} else {
+			count += len(symbol)
+		}
+	}
+
+	b.mu.Lock()
+	if len(b.words) >= shared.TokenizerWordCacheSize {
+		b.words = map[string]int{}
+	}
+	b.words[word] = count
+	b.mu.Unlock()
+	return count
+}
+
+// symbols splits a word into the units merges start from, characters for
+// sentencepiece models and bytes mapped to printable runes for byte level ones
+func (b *BPE) symbols(word string) []string {
+	symbols := make([]string, 0, len(word))
+	if b.byteLevel {
+		for i := 0; i < len(word); i++ {
+			symbols = append(symbols, byteRunes[word[i]])
+		}
+		return symbols
+	}
+	for len(word) > 0 {
+		_, size := utf8.DecodeRuneInString(word)
+		symbols = append(symbols, word[:size])
+		word = word[size:]
+	}
+	return symbols
+}
+
+// byteRunes is the GPT-2 byte to rune table, printable bytes map to
+// themselves and the rest to runes from 256 up
+var byteRunes = func() [256]string {
+	var table [256]string
+	next := 256
+	for i := range 256 {
+		if (i >= '!' && i <= '~') || (i >= 0xA1 && i <= 0xAC) || (i >= 0xAE && i <= 0xFF) {
+			table[i] = string(rune(i))
+			continue
+		}
+		table[i] = string(rune(next))
+		next++
+	}
+	return table
+}()
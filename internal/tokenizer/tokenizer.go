@@ -0,0 +1,291 @@
+// Package tokenizer counts tokens locally with the tokenizer of each model.
+// Models name their tokenizer in their metadata, either a Hugging Face repo
+// or a url of a tokenizer.json. Tokenizers are downloaded in the background
+// and cached on disk, until one is loaded the character estimate is used
+package tokenizer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type Tokenizer interface {
+	Count(text string) int
+	// False for the character estimate
+	Exact() bool
+}
+
+// Estimate is the bundled tokenizer, about four characters per token. It is
+// used for models without a tokenizer and while theirs loads
+type Estimate struct{}
+
+const charsPerToken = 4
+
+func (Estimate) Count(text string) int {
+	return (len(text) + charsPerToken - 1) / charsPerToken
+}
+
+func (Estimate) Exact() bool {
+	return false
+}
+
+// Registry loads and caches tokenizers by their source. A nil Registry
+// always estimates
+type Registry struct {
+	// Tells refreshes this replica published apart from the others
+	replica string
+	dir     string
+	client  *http.Client
+	redis   *redis.Client
+	log     *zap.SugaredLogger
+
+	mu      sync.Mutex
+	loaded  map[string]Tokenizer
+	loading map[string]bool
+	// Sources that failed to load and when they can be tried again
+	failed map[string]time.Time
+}
+
+// NewRegistry caches downloads in dir. With redisClient set refreshes are
+// published to every replica, see Listen
+func NewRegistry(dir string, redisClient *redis.Client, log *zap.SugaredLogger) *Registry {
+	return &Registry{
+		replica: rand.Text(),
+		dir:     dir,
+		client:  &http.Client{Timeout: shared.TokenizerDownloadTimeout},
+		redis:   redisClient,
+		log:     log,
+		loaded:  map[string]Tokenizer{},
+		loading: map[string]bool{},
+		failed:  map[string]time.Time{},
+	}
+}
+
+// Get returns the tokenizer of source without blocking. A source that is not
+// loaded yet starts loading and is estimated until it is
+func (r *Registry) Get(source string) Tokenizer {
+	if r == nil || source == "" {
+		return Estimate{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if tok, ok := r.loaded[source]; ok {
+		return tok
+	}
+	if r.loading[source] || time.Now().Before(r.failed[source]) {
+		return Estimate{}
+	}
+	r.loading[source] = true
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shared.TokenizerDownloadTimeout)
+		defer cancel()
+		if err := r.load(ctx, source, false); err != nil {
+			r.log.Warnw("Failed to load tokenizer, estimating tokens", "error", err, "tokenizer", source)
+		}
+	}()
+	return Estimate{}
+}
+
+// Refresh downloads the sources again, skipping the disk cache, and has every
+// replica reload them. No sources refreshes every loaded tokenizer
+func (r *Registry) Refresh(ctx context.Context, sources []string) ([]string, error) {
+	if len(sources) == 0 {
+		r.mu.Lock()
+		for source := range r.loaded {
+			sources = append(sources, source)
+		}
+		r.mu.Unlock()
+	}
+	for _, source := range sources {
+		if _, err := SourceURL(source); err != nil {
+			return nil, &shared.RequestError{StatusCode: 400, Err: err}
+		}
+	}
+	var errs error
+	for _, source := range sources {
+		if err := r.load(ctx, source, true); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", source, err))
+		}
+	}
+	if errs != nil {
+		return nil, errors.Join(errs, shared.ErrInternalServerError)
+	}
+	if r.redis != nil {
+		for _, source := range sources {
+			msg, _ := json.Marshal(refreshMessage{Replica: r.replica, Tokenizer: source})
+			if err := r.redis.Publish(ctx, shared.TokenizerRefreshChannel, msg).Err(); err != nil {
+				r.log.Warnw("Failed to publish tokenizer refresh", "error", err, "tokenizer", source)
+			}
+		}
+	}
+	return sources, nil
+}
+
+type refreshMessage struct {
+	Replica   string `json:"replica"`
+	Tokenizer string `json:"tokenizer"`
+}
+
+// Listen downloads tokenizers refreshed on other replicas again, until ctx is
+// done
+func (r *Registry) Listen(ctx context.Context) {
+	if r.redis == nil {
+		return
+	}
+	sub := r.redis.Subscribe(ctx, shared.TokenizerRefreshChannel)
+	defer func() {
+		_ = sub.Close()
+	}()
+	for msg := range sub.Channel() {
+		var refresh refreshMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &refresh); err != nil || refresh.Replica == r.replica {
+			continue
+		}
+		r.mu.Lock()
+		_, ok := r.loaded[refresh.Tokenizer]
+		r.mu.Unlock()
+		// Tokenizers this replica never used load on first use anyway
+		if !ok {
+			continue
+		}
+		if err := r.load(ctx, refresh.Tokenizer, true); err != nil {
+			r.log.Warnw("Failed to reload refreshed tokenizer", "error", err, "tokenizer", refresh.Tokenizer)
+		}
+	}
+}
+
+// load reads the tokenizer from the disk cache, downloading it when missing
+// or when download is set
+func (r *Registry) load(ctx context.Context, source string, download bool) error {
+	defer func() {
+		r.mu.Lock()
+		delete(r.loading, source)
+		r.mu.Unlock()
+	}()
+	tok, from, err := r.read(ctx, source, download)
+	if err != nil {
+		metrics.TokenizerLoads.WithLabelValues(from, "error").Inc()
+		r.mu.Lock()
+		r.failed[source] = time.Now().Add(shared.TokenizerRetryInterval)
+		r.mu.Unlock()
+		return err
+	}
+	metrics.TokenizerLoads.WithLabelValues(from, "ok").Inc()
+	r.mu.Lock()
+	r.loaded[source] = tok
+	delete(r.failed, source)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Registry) read(ctx context.Context, source string, download bool) (Tokenizer, string, error) {
+	path := filepath.Join(r.dir, cacheName(source))
+	if !download {
+		if data, err := os.ReadFile(path); err == nil {
+			if tok, err := ParseBPE(data); err == nil {
+				return tok, "disk", nil
+			}
+			r.log.Warnw("Cached tokenizer is invalid, downloading it again", "tokenizer", source, "path", path)
+		}
+	}
+
+	data, err := r.download(ctx, source)
+	if err != nil {
+		return nil, "download", err
+	}
+	tok, err := ParseBPE(data)
+	if err != nil {
+		return nil, "download", err
+	}
+	// A failed write only costs a download on the next restart
+	if err := writeCache(path, data); err != nil {
+		r.log.Warnw("Failed to cache tokenizer on disk", "error", err, "tokenizer", source, "path", path)
+	}
+	return tok, "download", nil
+}
+
+func (r *Registry) download(ctx context.Context, source string) ([]byte, error) {
+	url, err := SourceURL(source)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokenizer download returned %d", res.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, shared.TokenizerMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > shared.TokenizerMaxBytes {
+		return nil, fmt.Errorf("tokenizer is larger than %d bytes", shared.TokenizerMaxBytes)
+	}
+	return data, nil
+}
+
+// SourceURL resolves a tokenizer source, a https url or a Hugging Face repo
+// like org/model
+func SourceURL(source string) (string, error) {
+	if strings.HasPrefix(source, "https://") {
+		return source, nil
+	}
+	org, model, ok := strings.Cut(source, "/")
+	if !ok || org == "" || model == "" || strings.Contains(model, "/") || strings.Contains(source, "..") {
+		return "", fmt.Errorf("invalid tokenizer %q, expected a https url or org/model", source)
+	}
+	return "https://huggingface.co/" + source + "/resolve/main/tokenizer.json", nil
+}
+
+func cacheName(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:16]) + ".json"
+}
+
+// writeCache writes through a temp file so readers never see a partial file
+func writeCache(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tokenizer-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,102 @@
+// Package tracing sets up OpenTelemetry tracing. Spans are exported over OTLP
+// HTTP when an endpoint is configured; without one the no-op provider is kept
+// but traceparent headers of trusted proxies are still passed through to model
+// backends, so their trace is not broken by us. Baggage is not propagated,
+// clients could otherwise send arbitrary values on to every backend
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"sybil-api/internal/shared"
+
+	"github.com/XSAM/otelsql"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup installs the global tracer provider exporting to endpoint, a url
+// like http://otel-collector:4318. The returned func flushes pending spans
+// and must be called before exit
+func Setup(ctx context.Context, endpoint string, sampleRatio float64) (func(), error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if endpoint == "" {
+		return func() {}, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", shared.TraceServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shared.TraceShutdownTimeout)
+		defer cancel()
+		_ = provider.Shutdown(shutdownCtx)
+	}, nil
+}
+
+// Start starts a span named name under the span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(shared.TraceServiceName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it failed when err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Detach returns a background context carrying only the span of ctx, for
+// work that must outlive ctx but still belongs to its trace
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// Transport traces requests sent through base and adds the traceparent
+// header, nil base being http.DefaultTransport
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
+
+// OpenMySQL opens a mysql pool whose queries are traced. Query text is kept,
+// arguments never are
+func OpenMySQL(dsn string) (*sql.DB, error) {
+	return otelsql.Open("mysql", dsn,
+		otelsql.WithAttributes(attribute.String("db.system", "mysql")),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitConnPrepare:      true,
+			OmitRows:             true,
+		}),
+	)
+}
+
+// InstrumentRedis traces the commands of client. Commands are recorded
+// without their arguments, which hold api keys and cached responses
+func InstrumentRedis(client *redis.Client) error {
+	return redisotel.InstrumentTracing(client, redisotel.WithDBStatement(false))
+}
@@ -0,0 +1,191 @@
+package transform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+func init() {
+	Register("rename_params", newRenameParams)
+	Register("set_params", newSetParams)
+	Register("remove_params", newRemoveParams)
+	Register("banner", newBanner)
+}
+
+// requestOnly is embedded by plugins that leave responses alone
+type requestOnly struct{}
+
+func (requestOnly) Response(context.Context, *Response) error {
+	return nil
+}
+
+// renameParams moves top level request params, for clients still sending
+// legacy names. {"max_length": "max_tokens"}. A param already set under the
+// new name wins
+type renameParams struct {
+	requestOnly
+	names map[string]string
+}
+
+func newRenameParams(config json.RawMessage) (Plugin, error) {
+	var names map[string]string
+	if err := json.Unmarshal(config, &names); err != nil || len(names) == 0 {
+		return nil, errors.New(`rename_params config is a map of old to new names like {"max_length": "max_tokens"}`)
+	}
+	for from, to := range names {
+		if from == "" || to == "" || from == to {
+			return nil, fmt.Errorf("invalid rename from %q to %q", from, to)
+		}
+	}
+	return &renameParams{names: names}, nil
+}
+
+func (r *renameParams) Request(_ context.Context, req *Request) error {
+	for from, to := range r.names {
+		value, ok := req.Payload[from]
+		if !ok {
+			continue
+		}
+		delete(req.Payload, from)
+		if _, set := req.Payload[to]; !set {
+			req.Payload[to] = value
+		}
+	}
+	return nil
+}
+
+// setParams forces top level request params, replacing what the client sent.
+// {"temperature": 0, "logprobs": false}
+type setParams struct {
+	requestOnly
+	params map[string]any
+}
+
+// Params that decide who is billed and what is streamed cannot be forced
+var protectedParams = []string{"model", "stream", "stream_options", "messages", "prompt", "input"}
+
+func newSetParams(config json.RawMessage) (Plugin, error) {
+	var params map[string]any
+	if err := json.Unmarshal(config, &params); err != nil || len(params) == 0 {
+		return nil, errors.New(`set_params config is a map of params like {"temperature": 0}`)
+	}
+	for name := range params {
+		if slices.Contains(protectedParams, name) {
+			return nil, fmt.Errorf("%s cannot be set by a transform", name)
+		}
+	}
+	return &setParams{params: params}, nil
+}
+
+func (s *setParams) Request(_ context.Context, req *Request) error {
+	for name, value := range s.params {
+		req.Payload[name] = value
+	}
+	return nil
+}
+
+// removeParams drops top level request params the model should not get.
+// ["logit_bias", "user"]
+type removeParams struct {
+	requestOnly
+	names []string
+}
+
+func newRemoveParams(config json.RawMessage) (Plugin, error) {
+	var names []string
+	if err := json.Unmarshal(config, &names); err != nil || len(names) == 0 {
+		return nil, errors.New(`remove_params config is a list of params like ["logit_bias"]`)
+	}
+	for _, name := range names {
+		if slices.Contains(protectedParams, name) {
+			return nil, fmt.Errorf("%s cannot be removed by a transform", name)
+		}
+	}
+	return &removeParams{names: names}, nil
+}
+
+func (r *removeParams) Request(_ context.Context, req *Request) error {
+	for _, name := range r.names {
+		delete(req.Payload, name)
+	}
+	return nil
+}
+
+// banner adds text to the start or end of every chat and completion answer,
+// like a compliance notice. {"text": "AI generated", "position": "append"}
+type banner struct {
+	text   string
+	append bool
+}
+
+func newBanner(config json.RawMessage) (Plugin, error) {
+	var c struct {
+		Text     string `json:"text"`
+		Position string `json:"position"`
+	}
+	if err := json.Unmarshal(config, &c); err != nil || strings.TrimSpace(c.Text) == "" {
+		return nil, errors.New(`banner config is {"text": "...", "position": "prepend" or "append"}`)
+	}
+	switch c.Position {
+	case "", "prepend":
+		return &banner{text: c.Text}, nil
+	case "append":
+		return &banner{text: c.Text, append: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown banner position %q", c.Position)
+	}
+}
+
+func (b *banner) Request(context.Context, *Request) error {
+	return nil
+}
+
+// Response puts the banner on the first chunk of each choice when
+// prepending and on the chunk with its finish_reason when appending, so a
+// stream gets it exactly once. Streamed completions have no first chunk
+// marker and only support appending
+func (b *banner) Response(_ context.Context, res *Response) error {
+	choices, _ := res.Body["choices"].([]any)
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		if choice == nil {
+			continue
+		}
+		last := choice["finish_reason"] != nil
+		switch {
+		case !res.Stream:
+			if message, ok := choice["message"].(map[string]any); ok {
+				b.apply(message, "content")
+			} else if _, ok := choice["text"].(string); ok {
+				b.apply(choice, "text")
+			}
+		case b.append && last, !b.append && isFirstChunk(choice):
+			if delta, ok := choice["delta"].(map[string]any); ok {
+				b.apply(delta, "content")
+			} else if _, ok := choice["text"].(string); ok {
+				b.apply(choice, "text")
+			}
+		}
+	}
+	return nil
+}
+
+func (b *banner) apply(part map[string]any, key string) {
+	content, _ := part[key].(string)
+	if b.append {
+		part[key] = content + "\n\n" + b.text
+	} else {
+		part[key] = b.text + "\n\n" + content
+	}
+}
+
+// The first chat chunk of a choice carries its role
+func isFirstChunk(choice map[string]any) bool {
+	delta, _ := choice["delta"].(map[string]any)
+	_, ok := delta["role"]
+	return ok
+}
@@ -0,0 +1,208 @@
+// Package transform rewrites request and response payloads for enterprise
+// operators, like adding a compliance banner to answers or renaming the
+// parameters of a legacy client. Plugins are Go types registered by name,
+// operators attach them with a config to a model or api key through the
+// admin api. Every run is sandboxed: plugins get a copy of the payload, are
+// abandoned past shared.TransformTimeout and recovered when they panic, and
+// only a successful run replaces the payload
+package transform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"sybil-api/internal/metrics"
+	"sybil-api/internal/shared"
+)
+
+// Plugin transforms one payload. Either method may leave the payload as is
+type Plugin interface {
+	// Request is called with the request body before it is sent to the model
+	Request(ctx context.Context, req *Request) error
+	// Response is called with the body of a non streaming response, or each
+	// chunk of a stream
+	Response(ctx context.Context, res *Response) error
+}
+
+type Request struct {
+	Endpoint string
+	Model    string
+	Payload  map[string]any
+}
+
+type Response struct {
+	Endpoint string
+	Model    string
+	Stream   bool
+	// The response, or the chunk being streamed. Chunks carrying a
+	// finish_reason are the last of their choice
+	Body map[string]any
+}
+
+// Factory builds a plugin from the config stored with the transform,
+// returning an error for configs it cannot use
+type Factory func(config json.RawMessage) (Plugin, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// Register makes a plugin available to the admin api under name. Operators
+// with their own plugins register them from an init func in a file compiled
+// into the api
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[name] = factory
+}
+
+// Plugins returns the registered plugin names, sorted
+func Plugins() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Config is a transform as stored, see the transforms handler
+type Config struct {
+	ID     uint64          `json:"id"`
+	Plugin string          `json:"plugin"`
+	Config json.RawMessage `json:"config"`
+	// Failures skip the transform instead of failing the request
+	FailOpen bool `json:"fail_open"`
+}
+
+// Build validates a config by building its plugin
+func Build(config Config) (Plugin, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[config.Plugin]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin %q", config.Plugin)
+	}
+	return factory(config.Config)
+}
+
+type built struct {
+	config Config
+	plugin Plugin
+}
+
+// Pipeline runs the transforms of a request in order
+type Pipeline struct {
+	transforms []built
+}
+
+// NewPipeline builds the plugins of configs. A config that no longer builds
+// fails the pipeline unless it is fail open, in which case it is skipped
+func NewPipeline(configs []Config) (*Pipeline, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	p := &Pipeline{}
+	for _, config := range configs {
+		plugin, err := Build(config)
+		if err != nil {
+			metrics.Transforms.WithLabelValues(config.Plugin, "build", "error").Inc()
+			if config.FailOpen {
+				continue
+			}
+			return nil, fmt.Errorf("transform %d: %w", config.ID, err)
+		}
+		p.transforms = append(p.transforms, built{config: config, plugin: plugin})
+	}
+	return p, nil
+}
+
+// TransformRequest runs every plugin over the payload in order
+func (p *Pipeline) TransformRequest(ctx context.Context, endpoint, model string, payload map[string]any) (map[string]any, error) {
+	if p == nil {
+		return payload, nil
+	}
+	for _, t := range p.transforms {
+		out, err := sandbox(ctx, t, "request", payload, func(ctx context.Context, body map[string]any) error {
+			return t.plugin.Request(ctx, &Request{Endpoint: endpoint, Model: model, Payload: body})
+		})
+		if err != nil {
+			return nil, err
+		}
+		payload = out
+	}
+	return payload, nil
+}
+
+// TransformResponse runs every plugin over a response body or stream chunk
+func (p *Pipeline) TransformResponse(ctx context.Context, endpoint, model string, stream bool, body map[string]any) (map[string]any, error) {
+	if p == nil {
+		return body, nil
+	}
+	for _, t := range p.transforms {
+		out, err := sandbox(ctx, t, "response", body, func(ctx context.Context, body map[string]any) error {
+			return t.plugin.Response(ctx, &Response{Endpoint: endpoint, Model: model, Stream: stream, Body: body})
+		})
+		if err != nil {
+			return nil, err
+		}
+		body = out
+	}
+	return body, nil
+}
+
+// sandbox runs fn on a copy of body. A failed run of a fail open transform
+// keeps body unchanged
+func sandbox(ctx context.Context, t built, phase string, body map[string]any, fn func(context.Context, map[string]any) error) (map[string]any, error) {
+	cp, err := deepCopy(body)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, shared.TransformTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("plugin panicked: %v", r)
+			}
+		}()
+		done <- fn(ctx, cp)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// The goroutine is left to finish on its own copy
+		err = errors.New("plugin timed out")
+	}
+	if err != nil {
+		metrics.Transforms.WithLabelValues(t.config.Plugin, phase, "error").Inc()
+		if t.config.FailOpen {
+			return body, nil
+		}
+		return nil, fmt.Errorf("transform %d (%s): %w", t.config.ID, t.config.Plugin, err)
+	}
+	metrics.Transforms.WithLabelValues(t.config.Plugin, phase, "ok").Inc()
+	return cp, nil
+}
+
+func deepCopy(body map[string]any) (map[string]any, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var cp map[string]any
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}